@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"noppflow/internal/auth"
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+// subcommands run instead of the server when named as the first argument.
+var subcommands = map[string]func(args []string) error{
+	"install-systemd":      installSystemd,
+	"validate":             validateConfig,
+	"migrate-db":           migrateDB,
+	"reset-admin-password": resetAdminPassword,
+}
+
+// databaseConfig returns the store driver and DSN: MySQL with DB_DSN when DB_DRIVER=mysql, else
+// SQLite at dbPath (creating its directory), with the pure-Go driver when DB_DRIVER=sqlite.
+func databaseConfig(dbPath string) (string, string, error) {
+	driver := strings.TrimSpace(os.Getenv("DB_DRIVER"))
+	if driver == "mysql" {
+		dsn := strings.TrimSpace(os.Getenv("DB_DSN"))
+		if dsn == "" {
+			return "", "", errors.New("DB_DSN is required when DB_DRIVER=mysql (e.g. user:password@tcp(host:3306)/dbname?parseTime=true)")
+		}
+		return "mysql", dsn, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return "", "", fmt.Errorf("create data dir: %w", err)
+	}
+	if driver != "sqlite" {
+		driver = "sqlite3"
+	}
+	return driver, dbPath, nil
+}
+
+// validateConfig implements "cicd validate [-config apps.yaml] [-policy-file f] [-trains-file f]
+// [-hooks-file f] [-failure-rules-file f] [-secret-providers-file f] [-cloud-broker-file f]
+// [-ip-rules-file f]": it loads the files the way the server does at startup and reports the
+// first problem of each.
+func validateConfig(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", "config/apps.yaml", "path to apps.yaml")
+	policyFile := fs.String("policy-file", "", "path to a deploy policies file to check as well")
+	trainsFile := fs.String("trains-file", "", "path to a release trains file to check as well")
+	hooksFile := fs.String("hooks-file", "", "path to a hooks file to check as well")
+	failureRulesFile := fs.String("failure-rules-file", "", "path to a failure rules file to check as well")
+	secretProvidersFile := fs.String("secret-providers-file", "", "path to a secret providers file to check as well")
+	cloudBrokerFile := fs.String("cloud-broker-file", "", "path to a cloud credentials broker file to check as well")
+	ipRulesFile := fs.String("ip-rules-file", "", "path to an IP rules file to check as well")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var failed bool
+	check := func(path string, load func() (string, error)) {
+		summary, err := load()
+		if err != nil {
+			msg := err.Error()
+			if !strings.HasPrefix(msg, path) {
+				msg = path + ": " + msg
+			}
+			fmt.Fprintln(os.Stderr, msg)
+			failed = true
+			return
+		}
+		fmt.Printf("%s: ok (%s)\n", path, summary)
+	}
+	check(*configPath, func() (string, error) {
+		apps, err := config.LoadApps(*configPath)
+		return fmt.Sprintf("%d apps", len(apps)), err
+	})
+	if *policyFile != "" {
+		check(*policyFile, func() (string, error) {
+			cfg, err := config.LoadPolicies(*policyFile)
+			return fmt.Sprintf("%d policies, %d environments", len(cfg.Policies), len(cfg.Environments)), err
+		})
+	}
+	if *trainsFile != "" {
+		check(*trainsFile, func() (string, error) {
+			cfg, err := config.LoadTrains(*trainsFile)
+			return fmt.Sprintf("%d trains", len(cfg.Trains)), err
+		})
+	}
+	if *hooksFile != "" {
+		check(*hooksFile, func() (string, error) {
+			cfg, err := config.LoadHooks(*hooksFile)
+			return fmt.Sprintf("%d hooks", len(cfg.Hooks)), err
+		})
+	}
+	if *failureRulesFile != "" {
+		check(*failureRulesFile, func() (string, error) {
+			rules, err := config.LoadFailureRules(*failureRulesFile)
+			return fmt.Sprintf("%d failure rules", len(rules)), err
+		})
+	}
+	if *secretProvidersFile != "" {
+		check(*secretProvidersFile, func() (string, error) {
+			cfg, err := config.LoadSecretProviders(*secretProvidersFile)
+			return "secret providers: " + strings.Join(cfg.Schemes(), ", "), err
+		})
+	}
+	if *cloudBrokerFile != "" {
+		check(*cloudBrokerFile, func() (string, error) {
+			cfg, err := config.LoadCloudBroker(*cloudBrokerFile)
+			var clouds []string
+			if cfg.AWS != nil {
+				clouds = append(clouds, "aws")
+			}
+			if cfg.GCP != nil {
+				clouds = append(clouds, "gcp")
+			}
+			return "cloud broker: " + strings.Join(clouds, ", "), err
+		})
+	}
+	if *ipRulesFile != "" {
+		check(*ipRulesFile, func() (string, error) {
+			_, err := config.LoadIPRules(*ipRulesFile)
+			return "ip rules", err
+		})
+	}
+	if failed {
+		return errors.New("configuration is invalid")
+	}
+	return nil
+}
+
+// migrateDB implements "cicd migrate-db [-db path]": it opens the database configured like the
+// server's (DB_DRIVER, DB_DSN), which applies pending schema migrations, and exits.
+func migrateDB(args []string) error {
+	fs := flag.NewFlagSet("migrate-db", flag.ExitOnError)
+	dbPath := fs.String("db", "data/cicd.db", "path to SQLite database (used when DB_DRIVER is not mysql)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	driver, dsn, err := databaseConfig(*dbPath)
+	if err != nil {
+		return err
+	}
+	st, err := store.New(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	fmt.Printf("%s database schema is up to date\n", driver)
+	return nil
+}
+
+// resetAdminPassword implements "cicd reset-admin-password [-db path] [-username admin]
+// [-password-stdin]": it sets a new password on the user directly in the database (creating the
+// user when it no longer exists), makes it an admin, and signs it out everywhere. Without
+// -password-stdin a random password is generated and printed. It works while the server runs.
+func resetAdminPassword(args []string) error {
+	fs := flag.NewFlagSet("reset-admin-password", flag.ExitOnError)
+	dbPath := fs.String("db", "data/cicd.db", "path to SQLite database (used when DB_DRIVER is not mysql)")
+	username := fs.String("username", "admin", "user whose password is reset")
+	fromStdin := fs.Bool("password-stdin", false, "read the new password from the first line of stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(*username)
+	if name == "" {
+		return errors.New("-username is required")
+	}
+	password := ""
+	if *fromStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if password = strings.TrimSpace(line); password == "" {
+			return errors.New("empty password on stdin")
+		}
+	} else {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	driver, dsn, err := databaseConfig(*dbPath)
+	if err != nil {
+		return err
+	}
+	st, err := store.New(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	user, err := st.GetUserByUsername(name)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		if err := st.UpdateUserPassword(user.ID, hash); err != nil {
+			return err
+		}
+		if err := st.DeleteUserSessions(user.ID); err != nil {
+			return err
+		}
+	}
+	// Creates the user when it is gone, and makes an existing one an admin again.
+	if err := st.EnsureAdminUser(name, hash); err != nil {
+		return err
+	}
+	if *fromStdin {
+		fmt.Printf("password of admin %s reset\n", name)
+	} else {
+		fmt.Printf("password of admin %s reset to: %s\n", name, password)
+	}
+	return nil
+}
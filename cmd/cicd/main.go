@@ -4,13 +4,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
+	"syscall"
+	"time"
 
+	"noppflow/internal/artifacts"
 	"noppflow/internal/auth"
 	"noppflow/internal/config"
 	"noppflow/internal/pipeline"
@@ -18,32 +25,108 @@ import (
 	"noppflow/internal/store"
 )
 
+// version and commit are set at build time with -ldflags "-X main.version=... -X main.commit=..." (see Makefile).
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildCommit returns commit, falling back to the VCS revision recorded by the Go toolchain.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
 	configPath := flag.String("config", "config/apps.yaml", "path to apps.yaml")
 	dbPath := flag.String("db", "data/cicd.db", "path to SQLite database (used when DB_DRIVER is not mysql)")
 	workDir := flag.String("work", "work", "directory for cloning repos")
 	staticDir := flag.String("static", "web", "directory for web UI static files")
 	addr := flag.String("addr", ":8080", "HTTP listen address")
+	mirrorCache := flag.Bool("mirror-cache", false, "keep bare mirrors of app repos under <work>/.mirrors and use them as --reference for clones")
+	purgeDeletedAfter := flag.Duration("purge-deleted-runs-after", 30*24*time.Hour, "permanently delete soft-deleted runs after this long (0 disables)")
+	artifactStore := flag.String("artifact-store", "local", "artifact storage backend: local or s3 (S3 settings come from ARTIFACT_S3_* env vars)")
+	artifactDir := flag.String("artifact-dir", "data/artifacts", "directory for artifacts when -artifact-store=local")
+	logStore := flag.String("log-store", "db", "where run logs are kept: db (runs table), file (one file per run under -log-dir) or artifact (the artifact store, under logs/)")
+	logDir := flag.String("log-dir", "data/logs", "directory for run logs when -log-store=file")
+	maxLogMB := flag.Int64("max-log-mb", 0, "cap each run log at this many MiB, truncating the middle and keeping the full log as an artifact (0 = unlimited)")
+	driftInterval := flag.Duration("drift-check-interval", 15*time.Minute, "how often to compare the cluster state of kubectl and helm deployed apps with their last deploy (0 disables)")
+	reconcileInterval := flag.Duration("reconcile-interval", 5*time.Minute, "how often to delete Kubernetes Jobs/Secrets of runs the server no longer tracks (0 = only at startup)")
+	leaderElection := flag.Bool("leader-election", false, "elect one replica through the database to run periodic cleanup, for several servers sharing a MySQL database")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 2*time.Minute, "interrupt unfinished runs whose server has not reported them alive for this long (0 = disable heartbeats)")
+	requeueInterrupted := flag.Bool("requeue-interrupted", false, "start unfinished runs of a previous server process again instead of only marking them interrupted")
+	policyFile := flag.String("policy-file", "", "path to a YAML file with deploy policies and protected environments (empty = none)")
+	trainsFile := flag.String("trains-file", "", "path to a YAML file with release trains (empty = none)")
+	hooksFile := flag.String("hooks-file", "", "path to a YAML file with server-side hooks (commands or HTTP calls) run when runs start and finish (empty = none)")
+	failureRulesFile := flag.String("failure-rules-file", "", "path to a YAML file with failure rules labeling failed runs, tried before the built-in ones (empty = built-in rules only)")
+	secretProvidersFile := flag.String("secret-providers-file", "", "path to a YAML file with secret providers (Vault, AWS Secrets Manager, SOPS) that app and global env vars can reference as vault:, aws-sm: or sops: (empty = none)")
+	cloudBrokerFile := flag.String("cloud-broker-file", "", "path to a YAML file configuring how the server mints short-lived AWS and GCP credentials for the cloud_credentials of apps (empty = off)")
+	ipRulesFile := flag.String("ip-rules-file", "", "path to a YAML file with IP allow/deny rules for the admin API and webhook endpoints, reloaded when it changes (empty = none)")
+	publicURL := flag.String("public-url", "", "external base URL of the server (e.g. https://ci.example.com), used for links in Slack replies")
+	pidFile := flag.String("pidfile", "", "write the process ID to this file while the server runs (empty = none)")
+	serverLogFile := flag.String("server-log-file", "", "write the server log to this file instead of stderr; SIGHUP reopens it")
+	serverLogMaxMB := flag.Int64("server-log-max-mb", 100, "rotate -server-log-file when it reaches this many MiB (0 = never, e.g. with logrotate)")
+	serverLogBackups := flag.Int("server-log-backups", 5, "rotated copies of -server-log-file to keep")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "on SIGINT/SIGTERM, how long to wait for open HTTP requests before exiting")
+	corsOrigins := flag.String("cors-origins", "", "comma-separated browser origins (e.g. https://portal.example.com, or *) allowed to call the API cross-origin (empty = none)")
+	corsCredentials := flag.Bool("cors-credentials", false, "let the -cors-origins send the session cookie (Access-Control-Allow-Credentials)")
+	graphQL := flag.Bool("graphql", false, "serve the GraphQL API at /api/graphql (queries, and run subscriptions over server-sent events)")
+	timezone := flag.String("timezone", "UTC", "IANA timezone (e.g. Europe/Berlin) the UI shows times in; apps can override it with timezone")
+	demo := flag.Bool("demo", false, "demo mode: seed example apps, runs and read-only users (demo/demo, viewer/viewer); -config and -db default to data/demo-apps.yaml and data/demo.db")
 	flag.Parse()
 
-	dbDriver := strings.TrimSpace(os.Getenv("DB_DRIVER"))
-	if dbDriver == "" {
-		dbDriver = "sqlite3"
+	if *demo {
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["config"] {
+			*configPath = "data/demo-apps.yaml"
+		}
+		if !set["db"] {
+			*dbPath = "data/demo.db"
+		}
+		if err := writeDemoApps(*configPath); err != nil {
+			log.Fatalf("demo apps: %v", err)
+		}
 	}
 
-	var dbDSN string
-	switch dbDriver {
-	case "mysql":
-		dbDSN = strings.TrimSpace(os.Getenv("DB_DSN"))
-		if dbDSN == "" {
-			log.Fatal("DB_DSN is required when DB_DRIVER=mysql (e.g. user:password@tcp(host:3306)/dbname?parseTime=true)")
+	var logFile *rotatingFile
+	if *serverLogFile != "" {
+		var err error
+		if logFile, err = openRotatingFile(*serverLogFile, *serverLogMaxMB<<20, *serverLogBackups); err != nil {
+			log.Fatalf("open server log file: %v", err)
 		}
-	default:
-		dbDriver = "sqlite3"
-		dbDSN = *dbPath
-		if err := os.MkdirAll(filepath.Dir(dbDSN), 0755); err != nil {
-			log.Fatalf("create data dir: %v", err)
+		log.SetOutput(logFile)
+	}
+	if *pidFile != "" {
+		removePID, err := writePIDFile(*pidFile)
+		if err != nil {
+			log.Fatalf("pidfile: %v", err)
 		}
+		defer removePID()
+	}
+
+	dbDriver, dbDSN, err := databaseConfig(*dbPath)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if err := os.MkdirAll(*workDir, 0755); err != nil {
@@ -78,12 +161,173 @@ func main() {
 	}
 
 	runner := pipeline.NewRunner(*workDir)
+	runner.SetMirrorCache(*mirrorCache)
 	absConfig, _ := filepath.Abs(*configPath)
 	staticPath, _ := filepath.Abs(*staticDir)
 	srv := server.New(apps, st, runner, absConfig, staticPath)
+	artifactBackend, err := artifacts.Open(artifacts.Config{
+		Driver: *artifactStore,
+		Dir:    *artifactDir,
+		S3: artifacts.S3Config{
+			Endpoint:  strings.TrimSpace(os.Getenv("ARTIFACT_S3_ENDPOINT")),
+			Region:    strings.TrimSpace(os.Getenv("ARTIFACT_S3_REGION")),
+			Bucket:    strings.TrimSpace(os.Getenv("ARTIFACT_S3_BUCKET")),
+			AccessKey: strings.TrimSpace(os.Getenv("ARTIFACT_S3_ACCESS_KEY")),
+			SecretKey: strings.TrimSpace(os.Getenv("ARTIFACT_S3_SECRET_KEY")),
+			Prefix:    strings.TrimSpace(os.Getenv("ARTIFACT_S3_PREFIX")),
+			PathStyle: strings.TrimSpace(os.Getenv("ARTIFACT_S3_PATH_STYLE")) == "true",
+		},
+	})
+	if err != nil {
+		log.Fatalf("open artifact store: %v", err)
+	}
+	srv.SetArtifactStore(artifactBackend)
+	switch *logStore {
+	case "db":
+	case "file":
+		srv.SetLogStore(artifacts.NewLocal(*logDir), "")
+	case "artifact":
+		srv.SetLogStore(artifactBackend, "logs/")
+	default:
+		log.Fatalf("unknown -log-store %q (want db, file or artifact)", *logStore)
+	}
+	if *demo {
+		srv.SetDemo(true)
+		if err := srv.SeedDemo(); err != nil {
+			log.Fatalf("seed demo data: %v", err)
+		}
+	}
+	if *policyFile != "" {
+		policies, err := config.LoadPolicies(*policyFile)
+		if err != nil {
+			log.Fatalf("load policies: %v", err)
+		}
+		srv.SetPolicies(policies)
+	}
+	if *trainsFile != "" {
+		trains, err := config.LoadTrains(*trainsFile)
+		if err != nil {
+			log.Fatalf("load trains: %v", err)
+		}
+		srv.SetTrains(trains)
+	}
+	if *hooksFile != "" {
+		hooks, err := config.LoadHooks(*hooksFile)
+		if err != nil {
+			log.Fatalf("load hooks: %v", err)
+		}
+		srv.SetHooks(hooks)
+	}
+	if *failureRulesFile != "" {
+		rules, err := config.LoadFailureRules(*failureRulesFile)
+		if err != nil {
+			log.Fatalf("load failure rules: %v", err)
+		}
+		srv.SetFailureRules(rules)
+	}
+	if *secretProvidersFile != "" {
+		providers, err := config.LoadSecretProviders(*secretProvidersFile)
+		if err != nil {
+			log.Fatalf("load secret providers: %v", err)
+		}
+		srv.SetSecretProviders(providers)
+	}
+	if *cloudBrokerFile != "" {
+		broker, err := config.LoadCloudBroker(*cloudBrokerFile)
+		if err != nil {
+			log.Fatalf("load cloud broker: %v", err)
+		}
+		srv.SetCloudBroker(broker)
+	}
+	if *ipRulesFile != "" {
+		rules, err := config.LoadIPRules(*ipRulesFile)
+		if err != nil {
+			log.Fatalf("load ip rules: %v", err)
+		}
+		srv.SetIPRules(rules)
+		srv.StartIPRulesReloader(*ipRulesFile, 10*time.Second)
+	}
+	displayTZ, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("-timezone: %v", err)
+	}
+	srv.SetDisplayTimezone(displayTZ)
+	srv.SetPublicURL(*publicURL)
+	if err := srv.SetGraphQL(*graphQL); err != nil {
+		log.Fatalf("graphql schema: %v", err)
+	}
+	if err := srv.SetCORS(strings.Split(*corsOrigins, ","), *corsCredentials); err != nil {
+		log.Fatalf("-cors-origins: %v", err)
+	}
+	srv.SetMaxLogSize(*maxLogMB << 20)
+	srv.SetBuildInfo(version, buildCommit())
+	if addr := strings.TrimSpace(os.Getenv("SMTP_ADDR")); addr != "" {
+		srv.SetSMTP(addr, strings.TrimSpace(os.Getenv("SMTP_FROM")), strings.TrimSpace(os.Getenv("SMTP_USERNAME")), os.Getenv("SMTP_PASSWORD"))
+	}
+	if secret := strings.TrimSpace(os.Getenv("SLACK_SIGNING_SECRET")); secret != "" {
+		srv.SetSlack(secret, strings.TrimSpace(os.Getenv("SLACK_TEAM_ID")))
+		log.Printf("slack slash command enabled at /api/slack/command")
+	}
+	if *leaderElection {
+		srv.StartLeaderElection(30 * time.Second)
+	}
+	srv.StartDeletedRunPurger(*purgeDeletedAfter, time.Hour)
+	srv.SetRequeueInterrupted(*requeueInterrupted)
+	srv.StartRunHeartbeat(*heartbeatTimeout)
+	srv.StartSessionJanitor(10 * time.Minute)
+	srv.StartMaintenanceWatcher(10 * time.Second)
+	srv.StartPreviewJanitor(10 * time.Minute)
+	srv.StartOrphanReconciler(*reconcileInterval)
+	srv.StartDriftDetector(*driftInterval)
+	srv.ResumeTrainRuns()
 
-	log.Printf("listening on %s", *addr)
-	if err := http.ListenAndServe(*addr, srv.Handler()); err != nil {
+	httpServer := &http.Server{Addr: *addr, Handler: srv.Handler()}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
 		log.Fatalf("server: %v", err)
 	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpServer.Serve(listener) }()
+	log.Printf("listening on %s", *addr)
+	sdNotify("READY=1")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-serveErr:
+			log.Fatalf("server: %v", err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if logFile != nil {
+					if err := logFile.Reopen(); err != nil {
+						log.Printf("reopen server log file: %v", err)
+					}
+				}
+				continue
+			}
+			log.Printf("received %s, shutting down (unfinished runs are interrupted at the next start)", sig)
+			sdNotify("STOPPING=1")
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Printf("shutdown: %v", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// writeDemoApps writes the demo apps to path unless it already exists, so apps edited in a demo
+// survive restarts.
+func writeDemoApps(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return config.SaveApps(path, server.DemoApps())
 }
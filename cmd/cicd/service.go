@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writePIDFile writes the process ID to path and returns a func removing it. It refuses to
+// overwrite the PID file of a process that is still running.
+func writePIDFile(path string) (func(), error) {
+	if data, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid != os.Getpid() && processRunning(pid) {
+			return nil, fmt.Errorf("%s: process %d is still running", path, pid)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return func() { _ = os.Remove(path) }, nil
+}
+
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+// sdNotify sends a state (READY=1, STOPPING=1) to systemd when it started the process as a
+// Type=notify service; otherwise it does nothing.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(state))
+}
+
+// systemdUnit renders a Type=notify unit running exe with args from workDir.
+func systemdUnit(exe string, args []string, workDir, user string) string {
+	quoted := make([]string, 0, len(args)+1)
+	for _, a := range append([]string{exe}, args...) {
+		if strings.ContainsAny(a, " \t\"'\\") {
+			a = strconv.Quote(a)
+		}
+		quoted = append(quoted, a)
+	}
+	var b strings.Builder
+	b.WriteString("[Unit]\nDescription=NoppFlow CI/CD server\nAfter=network-online.target\nWants=network-online.target\n\n")
+	b.WriteString("[Service]\nType=notify\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quoted, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", workDir)
+	if user != "" {
+		fmt.Fprintf(&b, "User=%s\n", user)
+	}
+	b.WriteString("Restart=on-failure\nRestartSec=5\nKillSignal=SIGTERM\nTimeoutStopSec=60\n\n")
+	b.WriteString("[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// installSystemd implements "cicd install-systemd [-unit-file path] [-user name] [-- server flags]":
+// it writes a unit running this binary with the given server flags from the current directory.
+func installSystemd(args []string) error {
+	fs := flag.NewFlagSet("install-systemd", flag.ExitOnError)
+	unitFile := fs.String("unit-file", "/etc/systemd/system/noppflow.service", "where to write the unit (- for stdout)")
+	user := fs.String("user", "", "user the service runs as (default root)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	unit := systemdUnit(exe, fs.Args(), workDir, *user)
+	if *unitFile == "-" {
+		_, err := os.Stdout.WriteString(unit)
+		return err
+	}
+	if err := os.WriteFile(*unitFile, []byte(unit), 0644); err != nil {
+		return err
+	}
+	name := filepath.Base(*unitFile)
+	fmt.Printf("wrote %s\nenable and start it with: systemctl daemon-reload && systemctl enable --now %s\n", *unitFile, name)
+	return nil
+}
@@ -0,0 +1,65 @@
+// Package artifacts stores run artifacts as objects addressed by slash-separated keys
+// (e.g. "runs/42/dist/app.tar.gz"), on local disk or in an S3-compatible object store (AWS S3, MinIO).
+// The backend is chosen by server settings so artifacts can outlive the server's container.
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNotFound is returned by Get when no object exists for the key.
+var ErrNotFound = errors.New("artifact not found")
+
+// Store is an artifact storage backend.
+// Delete of a missing key is not an error.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Config selects and configures a backend. Driver is "local" (default) or "s3".
+type Config struct {
+	Driver string
+	Dir    string
+	S3     S3Config
+}
+
+// Open returns the backend described by cfg.
+func Open(cfg Config) (Store, error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.Driver)) {
+	case "", "local":
+		if strings.TrimSpace(cfg.Dir) == "" {
+			return nil, errors.New("artifact dir is required for the local artifact store")
+		}
+		return NewLocal(cfg.Dir), nil
+	case "s3":
+		return NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown artifact store driver %q (want local or s3)", cfg.Driver)
+	}
+}
+
+// validKey reports whether key is a relative slash-separated path without empty, "." or ".." segments.
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func checkKey(key string) error {
+	if !validKey(key) {
+		return fmt.Errorf("invalid artifact key %q", key)
+	}
+	return nil
+}
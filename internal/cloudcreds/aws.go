@@ -0,0 +1,126 @@
+// Package cloudcreds obtains short-lived cloud credentials: AWS role sessions from STS and GCP
+// access tokens through workload identity federation.
+package cloudcreds
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"noppflow/internal/awssig"
+)
+
+var invalidSessionChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// AWSSession is a role session returned by STS.
+type AWSSession struct {
+	Credentials awssig.Credentials
+	Expiration  time.Time
+}
+
+// STSEndpoint returns endpoint, or the regional STS endpoint when it is empty.
+func STSEndpoint(endpoint, region string) string {
+	if endpoint != "" {
+		return endpoint
+	}
+	return "https://sts." + region + ".amazonaws.com"
+}
+
+// AssumeRoleWithWebIdentity exchanges a web identity token (e.g. an EKS service account token)
+// for a session of roleARN. The call is not signed; the token authenticates it.
+func AssumeRoleWithWebIdentity(ctx context.Context, client *http.Client, endpoint, roleARN, token, session string, duration time.Duration) (AWSSession, error) {
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName(session)},
+		"WebIdentityToken": {strings.TrimSpace(token)},
+		"DurationSeconds":  {fmt.Sprint(int(duration.Seconds()))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return AWSSession{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doSTS(client, req)
+}
+
+// AssumeRole returns a session of roleARN, signing the call with creds.
+func AssumeRole(ctx context.Context, client *http.Client, endpoint, region string, creds awssig.Credentials, roleARN, session string, duration time.Duration) (AWSSession, error) {
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {roleARN},
+		"RoleSessionName": {sessionName(session)},
+		"DurationSeconds": {fmt.Sprint(int(duration.Seconds()))},
+	}
+	body := form.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", strings.NewReader(body))
+	if err != nil {
+		return AWSSession{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	awssig.Sign(req, creds, region, "sts", awssig.HashHex([]byte(body)), time.Now().UTC())
+	return doSTS(client, req)
+}
+
+// doSTS sends an STS query API request and decodes the credentials of its response.
+func doSTS(client *http.Client, req *http.Request) (AWSSession, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return AWSSession{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return AWSSession{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `xml:"Error>Message"`
+		}
+		_ = xml.Unmarshal(body, &e)
+		return AWSSession{}, fmt.Errorf("sts: %s: %s", resp.Status, e.Message)
+	}
+	var out struct {
+		WebIdentity stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+		Role        stsCredentials `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &out); err != nil {
+		return AWSSession{}, fmt.Errorf("sts: %v", err)
+	}
+	c := out.WebIdentity
+	if c.AccessKeyID == "" {
+		c = out.Role
+	}
+	if c.AccessKeyID == "" {
+		return AWSSession{}, errors.New("sts: no credentials in response")
+	}
+	return AWSSession{
+		Credentials: awssig.Credentials{AccessKey: c.AccessKeyID, SecretKey: c.SecretAccessKey, SessionToken: c.SessionToken},
+		Expiration:  c.Expiration,
+	}, nil
+}
+
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+// sessionName makes session a valid role session name.
+func sessionName(session string) string {
+	session = invalidSessionChars.ReplaceAllString(session, "-")
+	if len(session) > 64 {
+		session = session[:64]
+	}
+	return session
+}
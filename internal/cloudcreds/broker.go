@@ -0,0 +1,182 @@
+package cloudcreds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"noppflow/internal/awssig"
+	"noppflow/internal/config"
+)
+
+// requestTimeout bounds each call to a cloud's token API.
+const requestTimeout = 15 * time.Second
+
+// Broker mints the cloud credentials of apps' runs with the server's own identity.
+type Broker struct {
+	cfg    config.CloudBrokerConfig
+	client *http.Client
+}
+
+// NewBroker returns a broker for cfg.
+func NewBroker(cfg config.CloudBrokerConfig) *Broker {
+	return &Broker{cfg: cfg, client: &http.Client{Timeout: requestTimeout}}
+}
+
+// Credentials are the env vars set for a run's steps, with a source label per name, and when the
+// first of them expires.
+type Credentials struct {
+	Env        map[string]string
+	Sources    map[string]string
+	Expiration time.Time
+}
+
+// Check reports whether the broker may mint cc: each cloud must be configured, and the role or
+// service account must match its allowed patterns.
+func (b *Broker) Check(cc config.CloudCredentials) error {
+	if cc.DurationMin != 0 && (cc.DurationMin < config.MinCloudCredentialsMin || cc.DurationMin > b.cfg.MaxDurationMin) {
+		return fmt.Errorf("cloud_credentials duration_min must be between %d and %d", config.MinCloudCredentialsMin, b.cfg.MaxDurationMin)
+	}
+	if cc.AWS != nil {
+		if b.cfg.AWS == nil {
+			return errors.New("cloud_credentials aws: AWS is not configured in the cloud broker")
+		}
+		if !strings.HasPrefix(cc.AWS.RoleARN, "arn:") {
+			return errors.New("cloud_credentials aws role_arn must be an IAM role ARN")
+		}
+		if !matchAny(b.cfg.AWS.AllowedRoles, cc.AWS.RoleARN) {
+			return fmt.Errorf("cloud_credentials aws role %s is not allowed by the cloud broker", cc.AWS.RoleARN)
+		}
+	}
+	if cc.GCP != nil {
+		if b.cfg.GCP == nil {
+			return errors.New("cloud_credentials gcp: GCP is not configured in the cloud broker")
+		}
+		if !strings.Contains(cc.GCP.ServiceAccount, "@") {
+			return errors.New("cloud_credentials gcp service_account must be a service account email")
+		}
+		if !matchAny(b.cfg.GCP.AllowedServiceAccounts, cc.GCP.ServiceAccount) {
+			return fmt.Errorf("cloud_credentials gcp service account %s is not allowed by the cloud broker", cc.GCP.ServiceAccount)
+		}
+	}
+	return nil
+}
+
+// Mint obtains the credentials of cc for one run; session names the run in the cloud's audit
+// logs where it can (the AWS role session name).
+func (b *Broker) Mint(ctx context.Context, session string, cc config.CloudCredentials) (Credentials, error) {
+	if err := b.Check(cc); err != nil {
+		return Credentials{}, err
+	}
+	minutes := cc.DurationMin
+	if minutes == 0 {
+		minutes = config.DefaultCloudCredentialsMin
+		if minutes > b.cfg.MaxDurationMin {
+			minutes = b.cfg.MaxDurationMin
+		}
+	}
+	duration := time.Duration(minutes) * time.Minute
+	out := Credentials{Env: make(map[string]string), Sources: make(map[string]string)}
+	expires := func(t time.Time) {
+		if out.Expiration.IsZero() || (!t.IsZero() && t.Before(out.Expiration)) {
+			out.Expiration = t
+		}
+	}
+	if cc.AWS != nil {
+		sess, err := b.assumeAWSRole(ctx, cc.AWS.RoleARN, session, duration)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("aws role %s: %v", cc.AWS.RoleARN, err)
+		}
+		region := cc.AWS.Region
+		if region == "" {
+			region = b.cfg.AWS.Region
+		}
+		for name, value := range map[string]string{
+			"AWS_ACCESS_KEY_ID":     sess.Credentials.AccessKey,
+			"AWS_SECRET_ACCESS_KEY": sess.Credentials.SecretKey,
+			"AWS_SESSION_TOKEN":     sess.Credentials.SessionToken,
+			"AWS_REGION":            region,
+			"AWS_DEFAULT_REGION":    region,
+		} {
+			out.Env[name] = value
+			out.Sources[name] = "aws role"
+		}
+		expires(sess.Expiration)
+	}
+	if cc.GCP != nil {
+		token, err := b.impersonateGCP(ctx, cc.GCP.ServiceAccount, duration)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("gcp service account %s: %v", cc.GCP.ServiceAccount, err)
+		}
+		vars := map[string]string{
+			"CLOUDSDK_AUTH_ACCESS_TOKEN": token.AccessToken,
+			"GOOGLE_OAUTH_ACCESS_TOKEN":  token.AccessToken,
+		}
+		if cc.GCP.Project != "" {
+			vars["CLOUDSDK_CORE_PROJECT"] = cc.GCP.Project
+			vars["GOOGLE_CLOUD_PROJECT"] = cc.GCP.Project
+		}
+		for name, value := range vars {
+			out.Env[name] = value
+			out.Sources[name] = "gcp service account"
+		}
+		expires(token.Expiration)
+	}
+	return out, nil
+}
+
+// assumeAWSRole authenticates with the web identity token when there is one, otherwise with the
+// server's AWS_* env vars.
+func (b *Broker) assumeAWSRole(ctx context.Context, roleARN, session string, duration time.Duration) (AWSSession, error) {
+	endpoint := STSEndpoint(b.cfg.AWS.STSEndpoint, b.cfg.AWS.Region)
+	tokenFile := b.cfg.AWS.WebIdentityTokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return AWSSession{}, err
+		}
+		return AssumeRoleWithWebIdentity(ctx, b.client, endpoint, roleARN, string(token), session, duration)
+	}
+	creds := awssig.Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return AWSSession{}, errors.New("set web_identity_token_file, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return AssumeRole(ctx, b.client, endpoint, b.cfg.AWS.Region, creds, roleARN, session, duration)
+}
+
+func (b *Broker) impersonateGCP(ctx context.Context, serviceAccount string, lifetime time.Duration) (GCPToken, error) {
+	token, err := os.ReadFile(b.cfg.GCP.SubjectTokenFile)
+	if err != nil {
+		return GCPToken{}, err
+	}
+	stsEndpoint := b.cfg.GCP.STSEndpoint
+	if stsEndpoint == "" {
+		stsEndpoint = DefaultGoogleSTSEndpoint
+	}
+	iamEndpoint := b.cfg.GCP.IAMCredentialsEndpoint
+	if iamEndpoint == "" {
+		iamEndpoint = DefaultGoogleIAMCredentialsEndpoint
+	}
+	return ImpersonateServiceAccount(ctx, b.client, stsEndpoint, iamEndpoint, b.cfg.GCP.Audience, string(token), serviceAccount, lifetime)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
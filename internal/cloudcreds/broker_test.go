@@ -0,0 +1,137 @@
+package cloudcreds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"noppflow/internal/config"
+)
+
+func TestBrokerMintAWS(t *testing.T) {
+	var actions []string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		action := r.Form.Get("Action")
+		actions = append(actions, action)
+		if r.Form.Get("RoleArn") != "arn:aws:iam::1:role/ci-app" || r.Form.Get("RoleSessionName") != "noppflow-run-3" || r.Form.Get("DurationSeconds") != "1800" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<ErrorResponse><Error><Message>denied</Message></Error></ErrorResponse>`))
+			return
+		}
+		switch action {
+		case "AssumeRoleWithWebIdentity":
+			if r.Form.Get("WebIdentityToken") != "web-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		case "AssumeRole":
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKSERVER/") || !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/sts/") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		result := action + "Result"
+		_, _ = w.Write([]byte(`<` + action + `Response><` + result + `><Credentials>
+<AccessKeyId>ASIARUN</AccessKeyId><SecretAccessKey>run-secret</SecretAccessKey><SessionToken>run-session</SessionToken><Expiration>2030-01-01T00:30:00Z</Expiration>
+</Credentials></` + result + `></` + action + `Response>`))
+	}))
+	defer sts.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("web-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.CloudBrokerConfig{MaxDurationMin: 60, AWS: &config.AWSCloudBroker{
+		Region: "us-east-1", STSEndpoint: sts.URL, WebIdentityTokenFile: tokenFile, AllowedRoles: []string{"arn:aws:iam::1:role/ci-*"},
+	}}
+	cc := config.CloudCredentials{AWS: &config.AWSRole{RoleARN: "arn:aws:iam::1:role/ci-app", Region: "eu-west-1"}, DurationMin: 30}
+
+	creds, err := NewBroker(cfg).Mint(context.Background(), "noppflow-run-3", cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Env["AWS_ACCESS_KEY_ID"] != "ASIARUN" || creds.Env["AWS_SESSION_TOKEN"] != "run-session" || creds.Env["AWS_REGION"] != "eu-west-1" || creds.Sources["AWS_SECRET_ACCESS_KEY"] != "aws role" {
+		t.Fatalf("unexpected credentials %+v", creds)
+	}
+	if creds.Expiration.Format("15:04") != "00:30" {
+		t.Fatalf("unexpected expiration %v", creds.Expiration)
+	}
+
+	// Without a web identity token, AssumeRole is signed with the server's keys.
+	cfg.AWS.WebIdentityTokenFile = ""
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKSERVER")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "server-secret")
+	if _, err := NewBroker(cfg).Mint(context.Background(), "noppflow-run-3", cc); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(actions, ",") != "AssumeRoleWithWebIdentity,AssumeRole" {
+		t.Fatalf("unexpected STS calls %v", actions)
+	}
+
+	for _, bad := range []config.CloudCredentials{
+		{AWS: &config.AWSRole{RoleARN: "arn:aws:iam::1:role/admin"}},
+		{AWS: &config.AWSRole{RoleARN: "ci-app"}},
+		{AWS: &config.AWSRole{RoleARN: "arn:aws:iam::1:role/ci-app"}, DurationMin: 90},
+		{GCP: &config.GCPIdentity{ServiceAccount: "ci@p.iam.gserviceaccount.com"}},
+	} {
+		if err := NewBroker(cfg).Check(bad); err == nil {
+			t.Errorf("expected Check(%+v) to fail", bad)
+		}
+	}
+}
+
+func TestBrokerMintGCP(t *testing.T) {
+	google := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/token":
+			if body["subjectToken"] != "oidc-token" || body["audience"] != "//iam.googleapis.com/projects/1/providers/k8s" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant","error_description":"bad token"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"federated","expires_in":3600}`))
+		case "/v1/projects/-/serviceAccounts/ci@p.iam.gserviceaccount.com:generateAccessToken":
+			if r.Header.Get("Authorization") != "Bearer federated" || body["lifetime"] != "3600s" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"error":{"code":403,"message":"Permission denied"}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"accessToken":"ya29.run","expireTime":"2030-01-01T01:00:00Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer google.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("oidc-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.CloudBrokerConfig{MaxDurationMin: 60, GCP: &config.GCPCloudBroker{
+		Audience: "//iam.googleapis.com/projects/1/providers/k8s", SubjectTokenFile: tokenFile,
+		STSEndpoint: google.URL, IAMCredentialsEndpoint: google.URL, AllowedServiceAccounts: []string{"*@p.iam.gserviceaccount.com"},
+	}}
+	cc := config.CloudCredentials{GCP: &config.GCPIdentity{ServiceAccount: "ci@p.iam.gserviceaccount.com", Project: "p"}}
+
+	creds, err := NewBroker(cfg).Mint(context.Background(), "noppflow-run-4", cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Env["CLOUDSDK_AUTH_ACCESS_TOKEN"] != "ya29.run" || creds.Env["GOOGLE_OAUTH_ACCESS_TOKEN"] != "ya29.run" || creds.Env["CLOUDSDK_CORE_PROJECT"] != "p" {
+		t.Fatalf("unexpected credentials %+v", creds)
+	}
+
+	if err := os.WriteFile(tokenFile, []byte("expired"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBroker(cfg).Mint(context.Background(), "noppflow-run-4", cc); err == nil || !strings.Contains(err.Error(), "invalid_grant: bad token") {
+		t.Fatalf("expected the STS error, got %v", err)
+	}
+}
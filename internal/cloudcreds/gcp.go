@@ -0,0 +1,114 @@
+package cloudcreds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudPlatformScope is the OAuth scope of the access tokens minted for service accounts.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Default Google endpoints of workload identity federation.
+const (
+	DefaultGoogleSTSEndpoint            = "https://sts.googleapis.com"
+	DefaultGoogleIAMCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+)
+
+// GCPToken is an OAuth access token of a service account.
+type GCPToken struct {
+	AccessToken string
+	Expiration  time.Time
+}
+
+// ImpersonateServiceAccount exchanges an OIDC subject token at Google STS for a federated token
+// of the workload identity pool provider audience, then uses it to generate an access token of
+// serviceAccount valid for lifetime.
+func ImpersonateServiceAccount(ctx context.Context, client *http.Client, stsEndpoint, iamEndpoint, audience, subjectToken, serviceAccount string, lifetime time.Duration) (GCPToken, error) {
+	var federated struct {
+		AccessToken string `json:"access_token"`
+	}
+	err := postJSON(ctx, client, stsEndpoint+"/v1/token", "", map[string]string{
+		"grantType":          "urn:ietf:params:oauth:grant-type:token-exchange",
+		"audience":           audience,
+		"scope":              cloudPlatformScope,
+		"requestedTokenType": "urn:ietf:params:oauth:token-type:access_token",
+		"subjectTokenType":   "urn:ietf:params:oauth:token-type:jwt",
+		"subjectToken":       strings.TrimSpace(subjectToken),
+	}, &federated)
+	if err != nil {
+		return GCPToken{}, fmt.Errorf("google sts: %v", err)
+	}
+	if federated.AccessToken == "" {
+		return GCPToken{}, errors.New("google sts: no access token in response")
+	}
+	var out struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	err = postJSON(ctx, client, iamEndpoint+"/v1/projects/-/serviceAccounts/"+url.PathEscape(serviceAccount)+":generateAccessToken", federated.AccessToken, map[string]interface{}{
+		"scope":    []string{cloudPlatformScope},
+		"lifetime": fmt.Sprintf("%ds", int(lifetime.Seconds())),
+	}, &out)
+	if err != nil {
+		return GCPToken{}, fmt.Errorf("generate access token for %s: %v", serviceAccount, err)
+	}
+	if out.AccessToken == "" {
+		return GCPToken{}, fmt.Errorf("generate access token for %s: no access token in response", serviceAccount)
+	}
+	return GCPToken{AccessToken: out.AccessToken, Expiration: out.ExpireTime}, nil
+}
+
+// postJSON posts body as JSON and decodes the response into out. Google's error messages are
+// returned as the error.
+func postJSON(ctx context.Context, client *http.Client, endpoint, bearer string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// STS answers OAuth errors, IAM Credentials Google API errors.
+		var e struct {
+			Error            interface{} `json:"error"`
+			ErrorDescription string      `json:"error_description"`
+		}
+		_ = json.Unmarshal(data, &e)
+		switch v := e.Error.(type) {
+		case map[string]interface{}:
+			if msg, _ := v["message"].(string); msg != "" {
+				return fmt.Errorf("%s: %s", resp.Status, msg)
+			}
+		case string:
+			if e.ErrorDescription != "" {
+				v += ": " + e.ErrorDescription
+			}
+			return fmt.Errorf("%s: %s", resp.Status, v)
+		}
+		return errors.New(resp.Status)
+	}
+	return json.Unmarshal(data, out)
+}
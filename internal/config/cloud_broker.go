@@ -0,0 +1,138 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Bounds of the cloud credentials minted for a run, in minutes. AWS STS issues role sessions of
+// at least 15 minutes.
+const (
+	MinCloudCredentialsMin     = 15
+	DefaultCloudCredentialsMin = 60
+	MaxCloudCredentialsMin     = 720
+)
+
+// AWSCloudBroker mints AWS credentials for the roles of apps (cloud_credentials.aws.role_arn).
+// The server authenticates to STS with a web identity token (WebIdentityTokenFile, default
+// AWS_WEB_IDENTITY_TOKEN_FILE, as set up by EKS) and AssumeRoleWithWebIdentity, or otherwise
+// signs AssumeRole with the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN env
+// vars of the server. AllowedRoles lists path.Match patterns app roles must match.
+type AWSCloudBroker struct {
+	Region               string   `yaml:"region"`
+	STSEndpoint          string   `yaml:"sts_endpoint,omitempty"`
+	WebIdentityTokenFile string   `yaml:"web_identity_token_file,omitempty"`
+	AllowedRoles         []string `yaml:"allowed_roles"`
+}
+
+// GCPCloudBroker mints GCP access tokens for the service accounts of apps
+// (cloud_credentials.gcp.service_account) through workload identity federation: the OIDC token
+// in SubjectTokenFile is exchanged at Google STS for the pool provider named by Audience
+// (//iam.googleapis.com/projects/<n>/locations/global/workloadIdentityPools/<pool>/providers/<p>),
+// and the federated token impersonates the service account. AllowedServiceAccounts lists
+// path.Match patterns app service accounts must match.
+type GCPCloudBroker struct {
+	Audience               string   `yaml:"audience"`
+	SubjectTokenFile       string   `yaml:"subject_token_file"`
+	STSEndpoint            string   `yaml:"sts_endpoint,omitempty"`
+	IAMCredentialsEndpoint string   `yaml:"iam_credentials_endpoint,omitempty"`
+	AllowedServiceAccounts []string `yaml:"allowed_service_accounts"`
+}
+
+// CloudBrokerConfig is the root of the cloud credentials broker file. MaxDurationMin caps the
+// lifetime apps may ask for (default DefaultCloudCredentialsMin).
+type CloudBrokerConfig struct {
+	AWS            *AWSCloudBroker `yaml:"aws,omitempty"`
+	GCP            *GCPCloudBroker `yaml:"gcp,omitempty"`
+	MaxDurationMin int             `yaml:"max_duration_min,omitempty"`
+}
+
+// LoadCloudBroker reads and validates the cloud credentials broker file at path.
+func LoadCloudBroker(path string) (CloudBrokerConfig, error) {
+	var cfg CloudBrokerConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.AWS == nil && cfg.GCP == nil {
+		return cfg, fmt.Errorf("%s: no cloud configured (aws or gcp)", path)
+	}
+	if cfg.AWS != nil {
+		if err := cfg.AWS.init(); err != nil {
+			return cfg, fmt.Errorf("%s: aws: %w", path, err)
+		}
+	}
+	if cfg.GCP != nil {
+		if err := cfg.GCP.init(); err != nil {
+			return cfg, fmt.Errorf("%s: gcp: %w", path, err)
+		}
+	}
+	switch {
+	case cfg.MaxDurationMin == 0:
+		cfg.MaxDurationMin = DefaultCloudCredentialsMin
+	case cfg.MaxDurationMin < MinCloudCredentialsMin || cfg.MaxDurationMin > MaxCloudCredentialsMin:
+		return cfg, fmt.Errorf("%s: max_duration_min must be between %d and %d", path, MinCloudCredentialsMin, MaxCloudCredentialsMin)
+	}
+	return cfg, nil
+}
+
+func (a *AWSCloudBroker) init() error {
+	a.Region = strings.TrimSpace(a.Region)
+	if a.Region == "" {
+		return errors.New("region is required")
+	}
+	a.STSEndpoint = strings.TrimRight(strings.TrimSpace(a.STSEndpoint), "/")
+	if a.STSEndpoint != "" {
+		if err := checkHTTPURL(a.STSEndpoint); err != nil {
+			return fmt.Errorf("sts_endpoint: %w", err)
+		}
+	}
+	if len(a.AllowedRoles) == 0 {
+		return errors.New("allowed_roles is required")
+	}
+	return checkPatterns("allowed_roles", a.AllowedRoles)
+}
+
+func (g *GCPCloudBroker) init() error {
+	g.Audience = strings.TrimSpace(g.Audience)
+	if !strings.HasPrefix(g.Audience, "//iam.googleapis.com/") {
+		return errors.New("audience must be the workload identity pool provider (//iam.googleapis.com/...)")
+	}
+	if strings.TrimSpace(g.SubjectTokenFile) == "" {
+		return errors.New("subject_token_file is required")
+	}
+	for name, u := range map[string]*string{"sts_endpoint": &g.STSEndpoint, "iam_credentials_endpoint": &g.IAMCredentialsEndpoint} {
+		*u = strings.TrimRight(strings.TrimSpace(*u), "/")
+		if *u == "" {
+			continue
+		}
+		if err := checkHTTPURL(*u); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if len(g.AllowedServiceAccounts) == 0 {
+		return errors.New("allowed_service_accounts is required")
+	}
+	return checkPatterns("allowed_service_accounts", g.AllowedServiceAccounts)
+}
+
+func checkPatterns(field string, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("%s pattern %q: %w", field, p, err)
+		}
+	}
+	return nil
+}
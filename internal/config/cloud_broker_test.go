@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCloudBroker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cloud_broker.yaml")
+	content := `
+aws:
+  region: eu-west-1
+  sts_endpoint: https://sts.example.com/
+  allowed_roles: ["arn:aws:iam::123456789012:role/ci-*"]
+gcp:
+  audience: //iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/p/providers/k8s
+  subject_token_file: /var/run/token
+  allowed_service_accounts: ["ci-*@p.iam.gserviceaccount.com"]
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadCloudBroker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxDurationMin != DefaultCloudCredentialsMin || cfg.AWS.STSEndpoint != "https://sts.example.com" || cfg.GCP == nil {
+		t.Fatalf("unexpected cloud broker %+v", cfg)
+	}
+
+	bad := map[string]string{
+		"":                             "no cloud configured",
+		"aws:\n  region: x\n":          "allowed_roles is required",
+		"aws:\n  allowed_roles: [a]\n": "region is required",
+		"aws:\n  region: x\n  allowed_roles: ['[']\n":                    "allowed_roles pattern",
+		"gcp:\n  audience: projects/1\n":                                 "audience must be",
+		"gcp:\n  audience: //iam.googleapis.com/p\n":                     "subject_token_file",
+		"max_duration_min: 5\naws:\n  region: x\n  allowed_roles: [a]\n": "max_duration_min",
+		"azure:\n  tenant: x\n":                                          "field azure not found",
+	}
+	for content, want := range bad {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadCloudBroker(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadCloudBroker(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
@@ -4,24 +4,202 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Step defines one pipeline step.
+// Workdir, when set, is a path relative to the repository root where the step runs.
+// Env holds env vars for this step only; they override app and global env vars, and values
+// may reference those with $NAME or ${NAME} (see ResolveEnv).
+// ContinueOnError keeps the run going (and successful) when this step fails.
+// AlwaysRun executes the step even after an earlier step failed (e.g. cleanup or notify steps).
+// Artifacts lists files, directories, or glob patterns (relative to the repository root) collected
+// into the artifact store after the step succeeded.
+// Terraform makes the step a terraform/OpenTofu init, plan, approval, and apply in Workdir.
+// Ansible makes the step an ansible-playbook run in Workdir.
+// DBMigrate makes the step a database migration (goose, flyway, or atlas) in Workdir.
+// Scan makes the step a vulnerability scan (trivy or govulncheck) whose findings are stored per run.
+// WaitFor makes the step poll a URL or command until it succeeds (e.g. a health check or DNS).
+// Sign makes the step sign the images built by the run with cosign.
 type Step struct {
-	Name      string `yaml:"name" json:"name"`
-	Cmd       string `yaml:"cmd" json:"cmd"`
-	File      string `yaml:"file,omitempty" json:"file,omitempty"`
-	Script    string `yaml:"script,omitempty" json:"script,omitempty"`
-	K8sDeploy bool   `yaml:"k8s_deploy,omitempty" json:"k8s_deploy,omitempty"`
-	SleepSec  int    `yaml:"sleep_sec" json:"sleep_sec"`
+	Name            string            `yaml:"name" json:"name"`
+	Cmd             string            `yaml:"cmd" json:"cmd"`
+	File            string            `yaml:"file,omitempty" json:"file,omitempty"`
+	Script          string            `yaml:"script,omitempty" json:"script,omitempty"`
+	K8sDeploy       bool              `yaml:"k8s_deploy,omitempty" json:"k8s_deploy,omitempty"`
+	Terraform       *TerraformStep    `yaml:"terraform,omitempty" json:"terraform,omitempty"`
+	Ansible         *AnsibleStep      `yaml:"ansible,omitempty" json:"ansible,omitempty"`
+	DBMigrate       *DBMigrateStep    `yaml:"db_migrate,omitempty" json:"db_migrate,omitempty"`
+	Scan            *ScanStep         `yaml:"scan,omitempty" json:"scan,omitempty"`
+	WaitFor         *WaitForStep      `yaml:"wait_for,omitempty" json:"wait_for,omitempty"`
+	Sign            *SignStep         `yaml:"sign,omitempty" json:"sign,omitempty"`
+	Workdir         string            `yaml:"workdir,omitempty" json:"workdir,omitempty"`
+	Env             map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	ContinueOnError bool              `yaml:"continue_on_error,omitempty" json:"continue_on_error,omitempty"`
+	AlwaysRun       bool              `yaml:"always_run,omitempty" json:"always_run,omitempty"`
+	Artifacts       []string          `yaml:"artifacts,omitempty" json:"artifacts,omitempty"`
+	SleepSec        int               `yaml:"sleep_sec" json:"sleep_sec"`
+}
+
+// TerraformStep configures a terraform step. Binary is "terraform" (default) or "tofu".
+// BackendConfig entries are passed to init as -backend-config; values may reference env vars
+// ($NAME or ${NAME}), so state backend credentials can come from global env vars.
+// Workspace, when set, is selected (and created if missing) before the plan.
+// The plan waits for approval unless AutoApprove is set; ApprovalTimeoutSec bounds the wait
+// (DefaultApprovalTimeout when 0).
+type TerraformStep struct {
+	Binary             string            `yaml:"binary,omitempty" json:"binary,omitempty"`
+	VarFiles           []string          `yaml:"var_files,omitempty" json:"var_files,omitempty"`
+	Workspace          string            `yaml:"workspace,omitempty" json:"workspace,omitempty"`
+	BackendConfig      map[string]string `yaml:"backend_config,omitempty" json:"backend_config,omitempty"`
+	AutoApprove        bool              `yaml:"auto_approve,omitempty" json:"auto_approve,omitempty"`
+	ApprovalTimeoutSec int               `yaml:"approval_timeout_sec,omitempty" json:"approval_timeout_sec,omitempty"`
+}
+
+// DefaultApprovalTimeout is how long a terraform plan waits for approval by default.
+const DefaultApprovalTimeout = time.Hour
+
+// ApprovalTimeout returns how long the plan waits for approval.
+func (t TerraformStep) ApprovalTimeout() time.Duration {
+	if t.ApprovalTimeoutSec > 0 {
+		return time.Duration(t.ApprovalTimeoutSec) * time.Second
+	}
+	return DefaultApprovalTimeout
+}
+
+// AnsibleStep configures an ansible step. Playbook and Inventory are relative to the step's
+// workdir; Inventory may also be a comma-separated host list ("web1,web2,"). ExtraVars are passed
+// with --extra-vars. VaultPasswordEnv names the env var (e.g. a global env var) holding the
+// vault password, which is handed to ansible-playbook through a temporary file.
+type AnsibleStep struct {
+	Playbook         string            `yaml:"playbook" json:"playbook"`
+	Inventory        string            `yaml:"inventory,omitempty" json:"inventory,omitempty"`
+	ExtraVars        map[string]string `yaml:"extra_vars,omitempty" json:"extra_vars,omitempty"`
+	VaultPasswordEnv string            `yaml:"vault_password_env,omitempty" json:"vault_password_env,omitempty"`
+}
+
+// DBMigrateStep configures a db_migrate step. Tool is goose, flyway, or atlas; Driver is the goose
+// driver (e.g. postgres, mysql). Dir holds the migrations, relative to the step's workdir
+// ("migrations" when empty). DSNEnv names the env var (e.g. a global env var) holding the
+// connection string. Migrations of the same database never run concurrently: the lock is derived
+// from the DSN's host and database unless LockKey names it.
+type DBMigrateStep struct {
+	Tool    string `yaml:"tool" json:"tool"`
+	Driver  string `yaml:"driver,omitempty" json:"driver,omitempty"`
+	Dir     string `yaml:"dir,omitempty" json:"dir,omitempty"`
+	DSNEnv  string `yaml:"dsn_env" json:"dsn_env"`
+	LockKey string `yaml:"lock_key,omitempty" json:"lock_key,omitempty"`
+}
+
+// ScanStep configures a scan step. Tool is trivy-image (Target is the image, e.g.
+// $NOPPFLOW_IMAGE), trivy-fs (Target is a directory, "." when empty), or govulncheck (Target is a
+// package pattern, "./..." when empty). FailOn, when set, fails the step if a finding has that
+// severity or a higher one (LOW, MEDIUM, HIGH, CRITICAL).
+type ScanStep struct {
+	Tool   string `yaml:"tool" json:"tool"`
+	Target string `yaml:"target,omitempty" json:"target,omitempty"`
+	FailOn string `yaml:"fail_on,omitempty" json:"fail_on,omitempty"`
+}
+
+// WaitForStep configures a wait_for step, which checks URL or Cmd every IntervalSec until the
+// check succeeds or TimeoutSec has passed. A URL check is a GET that succeeds with a 2xx status,
+// or with ExpectStatus when set; URL may reference env vars ($NAME). A Cmd check is a shell
+// command that succeeds with exit status 0.
+type WaitForStep struct {
+	URL          string `yaml:"url,omitempty" json:"url,omitempty"`
+	Cmd          string `yaml:"cmd,omitempty" json:"cmd,omitempty"`
+	ExpectStatus int    `yaml:"expect_status,omitempty" json:"expect_status,omitempty"`
+	IntervalSec  int    `yaml:"interval_sec,omitempty" json:"interval_sec,omitempty"`
+	TimeoutSec   int    `yaml:"timeout_sec,omitempty" json:"timeout_sec,omitempty"`
+}
+
+// Default check interval and timeout of wait_for steps.
+const (
+	DefaultWaitForInterval = 10 * time.Second
+	DefaultWaitForTimeout  = 5 * time.Minute
+)
+
+// Interval returns the time between checks.
+func (w WaitForStep) Interval() time.Duration {
+	if w.IntervalSec <= 0 {
+		return DefaultWaitForInterval
+	}
+	return time.Duration(w.IntervalSec) * time.Second
+}
+
+// Timeout returns how long the step waits for a successful check.
+func (w WaitForStep) Timeout() time.Duration {
+	if w.TimeoutSec <= 0 {
+		return DefaultWaitForTimeout
+	}
+	return time.Duration(w.TimeoutSec) * time.Second
+}
+
+// SignStep configures a sign step, which signs pushed images with cosign. Image is the image to
+// sign (e.g. $NOPPFLOW_IMAGE, preferably with its digest); when empty, every image the previous
+// steps of the run built is signed by digest (see pipeline.ParseImageDigests). KeyEnv names the
+// env var holding the cosign private key, typically a secret reference resolved when the run
+// starts (e.g. vault:ci/cosign#key); PasswordEnv, when set, names the one holding its password.
+type SignStep struct {
+	Image       string `yaml:"image,omitempty" json:"image,omitempty"`
+	KeyEnv      string `yaml:"key_env" json:"key_env"`
+	PasswordEnv string `yaml:"password_env,omitempty" json:"password_env,omitempty"`
+}
+
+// ResolveEnv returns base merged with the step env. Step values are interpolated against base:
+// $NAME and ${NAME} are replaced when NAME is in base, other references are kept as written.
+// base is not modified.
+func (s Step) ResolveEnv(base map[string]string) map[string]string {
+	if len(s.Env) == 0 {
+		return base
+	}
+	out := make(map[string]string, len(base)+len(s.Env))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range s.Env {
+		out[k] = expandKnownEnv(v, base)
+	}
+	return out
+}
+
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// expandKnownEnv replaces $NAME and ${NAME} in v with values from vars, leaving unknown references untouched.
+func expandKnownEnv(v string, vars map[string]string) string {
+	return envRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+		name := strings.Trim(ref, "${}")
+		if val, ok := vars[name]; ok {
+			return val
+		}
+		return ref
+	})
+}
+
+// UnresolvedEnvRefs returns the $NAME and ${NAME} references in v that vars does not define, in
+// order of appearance; ResolveEnv leaves them untouched.
+func UnresolvedEnvRefs(v string, vars map[string]string) []string {
+	var names []string
+	for _, m := range envRefPattern.FindAllStringSubmatch(v, -1) {
+		name := m[1] + m[2]
+		if _, ok := vars[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
 // Kind returns which execution mode this step uses.
-// It returns "cmd", "file", "script", or "" when none/invalid.
+// It returns "cmd", "file", "script", "k8s_deploy", "terraform", "ansible", "db_migrate",
+// "scan", "wait_for", "sign", or "" when none/invalid.
 func (s Step) Kind() string {
 	cmd := strings.TrimSpace(s.Cmd)
 	file := strings.TrimSpace(s.File)
@@ -45,12 +223,45 @@ func (s Step) Kind() string {
 		count++
 		kind = "k8s_deploy"
 	}
+	if s.Terraform != nil {
+		count++
+		kind = "terraform"
+	}
+	if s.Ansible != nil {
+		count++
+		kind = "ansible"
+	}
+	if s.DBMigrate != nil {
+		count++
+		kind = "db_migrate"
+	}
+	if s.Scan != nil {
+		count++
+		kind = "scan"
+	}
+	if s.WaitFor != nil {
+		count++
+		kind = "wait_for"
+	}
+	if s.Sign != nil {
+		count++
+		kind = "sign"
+	}
 	if count != 1 {
 		return ""
 	}
 	return kind
 }
 
+// IsDeploy reports whether the step changes an environment: a k8s_deploy, terraform, or ansible step.
+func (s Step) IsDeploy() bool {
+	switch s.Kind() {
+	case "k8s_deploy", "terraform", "ansible":
+		return true
+	}
+	return false
+}
+
 // CommandValue returns the value for the configured Kind.
 func (s Step) CommandValue() string {
 	switch s.Kind() {
@@ -62,6 +273,18 @@ func (s Step) CommandValue() string {
 		return strings.TrimSpace(s.Script)
 	case "k8s_deploy":
 		return "k8s_deploy"
+	case "terraform":
+		return "terraform"
+	case "ansible":
+		return "ansible"
+	case "db_migrate":
+		return "db_migrate"
+	case "scan":
+		return "scan"
+	case "wait_for":
+		return "wait_for"
+	case "sign":
+		return "sign"
 	default:
 		return ""
 	}
@@ -72,51 +295,333 @@ func (s Step) CommandValue() string {
 // Repo is the git clone URL; Branch defaults to "main" if empty.
 // TestCmd and BuildCmd are required; DeployCmd is optional.
 // TestSleepSec, BuildSleepSec, DeploySleepSec are optional: when > 0, the pipeline sleeps that many seconds after the corresponding step.
+// GitSubmodules checks out submodules recursively; GitLFS pulls Git LFS objects after clone/pull.
+// Registries names registry credentials (see the registries API) that runs log in to before the steps.
+// SparsePaths, when set, limits the checkout to those directories (partial clone + cone-mode sparse checkout).
+// EnvReport records OS, tool versions, disk, and memory into the run log before the steps.
+// Shell runs script and file steps (sh when unset, e.g. bash); with LoginShell it runs as a login
+// shell (-l), and ProfileScripts are sourced first (e.g. ~/.nvm/nvm.sh, ~/.sdkman/bin/sdkman-init.sh).
+// LogColor asks step tools for colored output (FORCE_COLOR, CLICOLOR_FORCE, TERM); escape sequences are kept in the log.
+// Env holds app env vars passed to every step; they override global env vars with the same name.
+// Post holds optional on_success/on_failure/always hook steps run after the main steps.
+// Archived apps are hidden from listings and cannot be triggered; their runs are kept.
+// ExpectedDurationSec is the duration budget of a run; runs taking longer than SlowFactor times it
+// (DefaultSlowFactor when unset) are flagged slow and reported to NotifyWebhook.
+// AutoRetry starts a run again when it fails for an infrastructure reason (see AutoRetry).
+// CloudCredentials names the cloud roles the server mints short-lived credentials for and passes
+// to the steps of each run (see CloudCredentials).
+// NotifyWebhook, when set, receives run notifications as JSON POSTs.
+// WebhookProvider (github, gitlab, bitbucket, gitea) enables push webhooks for the app; deliveries must be
+// signed (or, for GitLab, carry the token) with WebhookSecret.
+// Promotion lists the environments a built image is promoted through, in order (e.g. staging, then prod).
+// Downstream lists apps whose runs start when a run of this app finishes (e.g. the services
+// depending on a library).
+// DependsOn lists the apps this app needs deployed first; a deploy with dependencies runs them
+// (and their own dependencies) before it, in dependency order.
+// Preview deploys pushes to other branches into an ephemeral namespace per branch (see PreviewConfig).
+// Environment names the environment the app's deploy steps change (e.g. prod); the protection rules
+// and deploy freezes of that environment apply to them.
+// Runner selects where runs execute: "local" (default) on the server host, or "kubernetes" as an
+// ephemeral Job in K8sNamespace. Apps with a k8s_deploy step always run as a Job.
+// K8sPodTemplate is a pod template snippet (metadata labels/annotations and spec) merged into the
+// generated Job's pod template, e.g. for volumes, sidecars, securityContext, or imagePullSecrets.
+// K8sCachePVC names a PersistentVolumeClaim in K8sNamespace holding a git mirror of the repo that
+// an init container updates and checks out from, so Job runs do not clone from scratch.
+// K8sDebugHoldMin keeps the pod of a failed Job run alive for that many minutes so admins can run
+// commands in it through the debug exec API.
+// With DeployMode "gitops", k8s_deploy steps do not touch the cluster: they rewrite the GitOpsImage
+// references in GitOpsPath of GitOpsRepo (cloned with GitOpsSSHKeyName, or SSHKeyName when unset)
+// to the new image and push the commit to GitOpsBranch, or open a pull request on it when GitOpsPR
+// names the provider (github or gitlab), for Argo CD or Flux to sync.
 type App struct {
-	ID                 string `yaml:"id" json:"id"`
-	Name               string `yaml:"name" json:"name"`
-	Repo               string `yaml:"repo" json:"repo"`
-	Branch             string `yaml:"branch" json:"branch"`
-	SSHKeyName         string `yaml:"ssh_key_name,omitempty" json:"ssh_key_name,omitempty"`
-	DeployMode         string `yaml:"deploy_mode,omitempty" json:"deploy_mode,omitempty"`
-	K8sNamespace       string `yaml:"k8s_namespace,omitempty" json:"k8s_namespace,omitempty"`
-	K8sServiceAccount  string `yaml:"k8s_service_account,omitempty" json:"k8s_service_account,omitempty"`
-	K8sRunnerImage     string `yaml:"k8s_runner_image,omitempty" json:"k8s_runner_image,omitempty"`
-	DeployManifestPath string `yaml:"deploy_manifest_path,omitempty" json:"deploy_manifest_path,omitempty"`
-	HelmChart          string `yaml:"helm_chart,omitempty" json:"helm_chart,omitempty"`
-	HelmValuesPath     string `yaml:"helm_values_path,omitempty" json:"helm_values_path,omitempty"`
-	Steps              []Step `yaml:"steps,omitempty" json:"steps,omitempty"`
-	BuildCmd           string `yaml:"build_cmd,omitempty" json:"build_cmd,omitempty"`
-	TestCmd            string `yaml:"test_cmd,omitempty" json:"test_cmd,omitempty"`
-	DeployCmd          string `yaml:"deploy_cmd,omitempty" json:"deploy_cmd,omitempty"`
-	TestSleepSec       int    `yaml:"test_sleep_sec,omitempty" json:"test_sleep_sec,omitempty"`
-	BuildSleepSec      int    `yaml:"build_sleep_sec,omitempty" json:"build_sleep_sec,omitempty"`
-	DeploySleepSec     int    `yaml:"deploy_sleep_sec,omitempty" json:"deploy_sleep_sec,omitempty"`
+	ID                  string                 `yaml:"id" json:"id"`
+	Name                string                 `yaml:"name" json:"name"`
+	Repo                string                 `yaml:"repo" json:"repo"`
+	Branch              string                 `yaml:"branch" json:"branch"`
+	SSHKeyName          string                 `yaml:"ssh_key_name,omitempty" json:"ssh_key_name,omitempty"`
+	Registries          []string               `yaml:"registries,omitempty" json:"registries,omitempty"`
+	Archived            bool                   `yaml:"archived,omitempty" json:"archived,omitempty"`
+	GitSubmodules       bool                   `yaml:"git_submodules,omitempty" json:"git_submodules,omitempty"`
+	GitLFS              bool                   `yaml:"git_lfs,omitempty" json:"git_lfs,omitempty"`
+	SparsePaths         []string               `yaml:"sparse_paths,omitempty" json:"sparse_paths,omitempty"`
+	EnvReport           bool                   `yaml:"env_report,omitempty" json:"env_report,omitempty"`
+	LogColor            bool                   `yaml:"log_color,omitempty" json:"log_color,omitempty"`
+	Shell               string                 `yaml:"shell,omitempty" json:"shell,omitempty"`
+	LoginShell          bool                   `yaml:"login_shell,omitempty" json:"login_shell,omitempty"`
+	ProfileScripts      []string               `yaml:"profile_scripts,omitempty" json:"profile_scripts,omitempty"`
+	Timezone            string                 `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	Env                 map[string]string      `yaml:"env,omitempty" json:"env,omitempty"`
+	ExpectedDurationSec int                    `yaml:"expected_duration_sec,omitempty" json:"expected_duration_sec,omitempty"`
+	SlowFactor          float64                `yaml:"slow_factor,omitempty" json:"slow_factor,omitempty"`
+	Owner               *AppOwner              `yaml:"owner,omitempty" json:"owner,omitempty"`
+	AutoRetry           *AutoRetry             `yaml:"auto_retry,omitempty" json:"auto_retry,omitempty"`
+	CloudCredentials    *CloudCredentials      `yaml:"cloud_credentials,omitempty" json:"cloud_credentials,omitempty"`
+	NotifyWebhook       string                 `yaml:"notify_webhook,omitempty" json:"notify_webhook,omitempty"`
+	WebhookProvider     string                 `yaml:"webhook_provider,omitempty" json:"webhook_provider,omitempty"`
+	WebhookSecret       string                 `yaml:"webhook_secret,omitempty" json:"webhook_secret,omitempty"`
+	Promotion           []PromotionEnv         `yaml:"promotion,omitempty" json:"promotion,omitempty"`
+	Downstream          []DownstreamTrigger    `yaml:"downstream,omitempty" json:"downstream,omitempty"`
+	DependsOn           []string               `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	Preview             *PreviewConfig         `yaml:"preview,omitempty" json:"preview,omitempty"`
+	Environment         string                 `yaml:"environment,omitempty" json:"environment,omitempty"`
+	Runner              string                 `yaml:"runner,omitempty" json:"runner,omitempty"`
+	DeployMode          string                 `yaml:"deploy_mode,omitempty" json:"deploy_mode,omitempty"`
+	K8sNamespace        string                 `yaml:"k8s_namespace,omitempty" json:"k8s_namespace,omitempty"`
+	K8sServiceAccount   string                 `yaml:"k8s_service_account,omitempty" json:"k8s_service_account,omitempty"`
+	K8sRunnerImage      string                 `yaml:"k8s_runner_image,omitempty" json:"k8s_runner_image,omitempty"`
+	K8sPodTemplate      map[string]interface{} `yaml:"k8s_pod_template,omitempty" json:"k8s_pod_template,omitempty"`
+	K8sCachePVC         string                 `yaml:"k8s_cache_pvc,omitempty" json:"k8s_cache_pvc,omitempty"`
+	K8sDebugHoldMin     int                    `yaml:"k8s_debug_hold_min,omitempty" json:"k8s_debug_hold_min,omitempty"`
+	DeployManifestPath  string                 `yaml:"deploy_manifest_path,omitempty" json:"deploy_manifest_path,omitempty"`
+	HelmChart           string                 `yaml:"helm_chart,omitempty" json:"helm_chart,omitempty"`
+	HelmValuesPath      string                 `yaml:"helm_values_path,omitempty" json:"helm_values_path,omitempty"`
+	GitOpsRepo          string                 `yaml:"gitops_repo,omitempty" json:"gitops_repo,omitempty"`
+	GitOpsBranch        string                 `yaml:"gitops_branch,omitempty" json:"gitops_branch,omitempty"`
+	GitOpsSSHKeyName    string                 `yaml:"gitops_ssh_key_name,omitempty" json:"gitops_ssh_key_name,omitempty"`
+	GitOpsPath          string                 `yaml:"gitops_path,omitempty" json:"gitops_path,omitempty"`
+	GitOpsImage         string                 `yaml:"gitops_image,omitempty" json:"gitops_image,omitempty"`
+	GitOpsPR            string                 `yaml:"gitops_pr,omitempty" json:"gitops_pr,omitempty"`
+	Steps               []Step                 `yaml:"steps,omitempty" json:"steps,omitempty"`
+	Post                *PostSteps             `yaml:"post,omitempty" json:"post,omitempty"`
+	BuildCmd            string                 `yaml:"build_cmd,omitempty" json:"build_cmd,omitempty"`
+	TestCmd             string                 `yaml:"test_cmd,omitempty" json:"test_cmd,omitempty"`
+	DeployCmd           string                 `yaml:"deploy_cmd,omitempty" json:"deploy_cmd,omitempty"`
+	TestSleepSec        int                    `yaml:"test_sleep_sec,omitempty" json:"test_sleep_sec,omitempty"`
+	BuildSleepSec       int                    `yaml:"build_sleep_sec,omitempty" json:"build_sleep_sec,omitempty"`
+	DeploySleepSec      int                    `yaml:"deploy_sleep_sec,omitempty" json:"deploy_sleep_sec,omitempty"`
+	// PreviewNamespace is set on the copy of the app a preview run runs: k8s_deploy steps deploy
+	// into it instead of K8sNamespace, where the Job still runs. It is never configured.
+	PreviewNamespace string `yaml:"-" json:"-"`
+}
+
+// DeployNamespace returns the namespace k8s_deploy steps deploy into.
+func (a App) DeployNamespace() string {
+	if a.PreviewNamespace != "" {
+		return a.PreviewNamespace
+	}
+	return a.K8sNamespace
+}
+
+// AutoRetry re-runs a failed run whose failure reason (see ClassifyFailure) is one of Reasons, or
+// of DefaultRetryReasons when empty, up to MaxRetries times before the failure is reported.
+type AutoRetry struct {
+	MaxRetries int      `yaml:"max_retries" json:"max_retries"`
+	Reasons    []string `yaml:"reasons,omitempty" json:"reasons,omitempty"`
+}
+
+// Retries reports whether a run that failed with reason is retried.
+func (r *AutoRetry) Retries(reason string) bool {
+	if r == nil || r.MaxRetries <= 0 || reason == "" {
+		return false
+	}
+	reasons := r.Reasons
+	if len(reasons) == 0 {
+		reasons = DefaultRetryReasons
+	}
+	for _, rr := range reasons {
+		if rr == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// CloudCredentials are the cloud identities of an app's runs. When a run starts, the server
+// mints credentials valid for DurationMin minutes (DefaultCloudCredentialsMin when unset) with
+// the cloud broker (see CloudBrokerConfig) and sets them in the steps' env, so no long-lived
+// cloud keys need to be kept in env vars.
+type CloudCredentials struct {
+	AWS         *AWSRole     `yaml:"aws,omitempty" json:"aws,omitempty"`
+	GCP         *GCPIdentity `yaml:"gcp,omitempty" json:"gcp,omitempty"`
+	DurationMin int          `yaml:"duration_min,omitempty" json:"duration_min,omitempty"`
+}
+
+// AWSRole is the IAM role assumed for a run; its credentials are set as AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN, with AWS_REGION and AWS_DEFAULT_REGION from
+// Region (the broker's region when unset).
+type AWSRole struct {
+	RoleARN string `yaml:"role_arn" json:"role_arn"`
+	Region  string `yaml:"region,omitempty" json:"region,omitempty"`
+}
+
+// GCPIdentity is the service account impersonated for a run; its access token is set as
+// CLOUDSDK_AUTH_ACCESS_TOKEN (gcloud) and GOOGLE_OAUTH_ACCESS_TOKEN (Terraform), with
+// CLOUDSDK_CORE_PROJECT and GOOGLE_CLOUD_PROJECT from Project when set.
+type GCPIdentity struct {
+	ServiceAccount string `yaml:"service_account" json:"service_account"`
+	Project        string `yaml:"project,omitempty" json:"project,omitempty"`
+}
+
+// AppOwner says who is responsible for an app and whom to contact when its runs fail.
+type AppOwner struct {
+	Team         string `yaml:"team,omitempty" json:"team,omitempty"`
+	OnCall       string `yaml:"on_call,omitempty" json:"on_call,omitempty"`
+	SlackChannel string `yaml:"slack_channel,omitempty" json:"slack_channel,omitempty"`
+}
+
+// String describes the owner for notification messages, e.g. "team payments, on-call
+// @alice, Slack #payments".
+func (o *AppOwner) String() string {
+	if o == nil {
+		return ""
+	}
+	var parts []string
+	if o.Team != "" {
+		parts = append(parts, "team "+o.Team)
+	}
+	if o.OnCall != "" {
+		parts = append(parts, "on-call "+o.OnCall)
+	}
+	if o.SlackChannel != "" {
+		parts = append(parts, "Slack "+o.SlackChannel)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// PromotionEnv is one stage of an app's image promotion chain. Promoting to it copies the image
+// digest of the previous stage (the app's last successful build for the first stage) to Image:Tag,
+// then triggers DeployApp, when set, with NOPPFLOW_IMAGE pointing at the promoted digest.
+// Tag defaults to the environment name.
+type PromotionEnv struct {
+	Name      string `yaml:"name" json:"name"`
+	Image     string `yaml:"image" json:"image"`
+	Tag       string `yaml:"tag,omitempty" json:"tag,omitempty"`
+	DeployApp string `yaml:"deploy_app,omitempty" json:"deploy_app,omitempty"`
+}
+
+// DownstreamTrigger starts a run of App when a run of the upstream app finishes with a status
+// matching On: "success" (default), "failure", or "always".
+type DownstreamTrigger struct {
+	App string `yaml:"app" json:"app"`
+	On  string `yaml:"on,omitempty" json:"on,omitempty"`
+}
+
+// Fires reports whether a finished upstream run with status starts the downstream run.
+func (t DownstreamTrigger) Fires(status string) bool {
+	switch t.On {
+	case "always":
+		return true
+	case "failure":
+		return status == "failed"
+	default:
+		return status == "success"
+	}
+}
+
+// DefaultPreviewTTL is how long a preview environment lives after its last deploy when the app sets
+// no ttl_hours.
+const DefaultPreviewTTL = 72 * time.Hour
+
+// PreviewConfig deploys pushes to branches other than the app branch into an ephemeral namespace
+// per branch. Namespace and URL are templates expanding $APP, $BRANCH (the branch as a DNS label,
+// see BranchSlug) and, in URL only, $NAMESPACE; Namespace defaults to "$APP-$BRANCH". Branches
+// restricts previews to branches matching one of its path.Match patterns. A preview is torn down
+// when its branch is deleted or its pull request closed, or TTLHours (DefaultPreviewTTL when 0)
+// after its last deploy.
+type PreviewConfig struct {
+	Namespace string   `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	URL       string   `yaml:"url,omitempty" json:"url,omitempty"`
+	Branches  []string `yaml:"branches,omitempty" json:"branches,omitempty"`
+	TTLHours  int      `yaml:"ttl_hours,omitempty" json:"ttl_hours,omitempty"`
+}
+
+// Matches reports whether pushes to branch get a preview.
+func (p PreviewConfig) Matches(branch string) bool {
+	return len(p.Branches) == 0 || MatchAny(p.Branches, branch)
+}
+
+// TTL returns how long a preview lives after its last deploy.
+func (p PreviewConfig) TTL() time.Duration {
+	if p.TTLHours <= 0 {
+		return DefaultPreviewTTL
+	}
+	return time.Duration(p.TTLHours) * time.Hour
+}
+
+// Target returns the namespace and URL of the preview of branch for appID.
+func (p PreviewConfig) Target(appID, branch string) (namespace, url string) {
+	vars := map[string]string{"APP": appID, "BRANCH": BranchSlug(branch)}
+	tmpl := p.Namespace
+	if tmpl == "" {
+		tmpl = "$APP-$BRANCH"
+	}
+	namespace = os.Expand(tmpl, func(name string) string { return vars[name] })
+	vars["NAMESPACE"] = namespace
+	url = os.Expand(p.URL, func(name string) string { return vars[name] })
+	return namespace, url
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// maxBranchSlugLen keeps namespaces templated from a slug and an app ID within the 63 characters
+// of a DNS label.
+const maxBranchSlugLen = 30
+
+// BranchSlug turns a branch name into a DNS label: lowercase letters, digits and dashes, at most
+// maxBranchSlugLen characters. Longer names are cut and suffixed with a hash of the full name so
+// that branches sharing a prefix keep distinct slugs.
+func BranchSlug(branch string) string {
+	slug := strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(branch), "-"), "-")
+	if len(slug) <= maxBranchSlugLen {
+		return slug
+	}
+	sum := sha256.Sum256([]byte(branch))
+	return strings.TrimRight(slug[:maxBranchSlugLen-9], "-") + "-" + hex.EncodeToString(sum[:4])
+}
+
+// PostSteps are hook sections the Runner executes after the main steps: OnSuccess when
+// all steps passed, OnFailure when the run failed, then Always in both cases.
+type PostSteps struct {
+	OnSuccess []Step `yaml:"on_success,omitempty" json:"on_success,omitempty"`
+	OnFailure []Step `yaml:"on_failure,omitempty" json:"on_failure,omitempty"`
+	Always    []Step `yaml:"always,omitempty" json:"always,omitempty"`
 }
 
 // AppsConfig is the root of apps.yaml.
+// Extensions collects other top-level keys; only "x-" keys (anchor holders) are accepted on load.
 type AppsConfig struct {
-	Apps []App `yaml:"apps"`
+	Defaults   *AppDefaults           `yaml:"defaults,omitempty"`
+	Apps       []App                  `yaml:"apps"`
+	Extensions map[string]interface{} `yaml:",inline"`
 }
 
-// LoadApps reads the YAML file at path (e.g. config/apps.yaml) and returns the list of apps.
-// Returns an error if the file cannot be read or YAML is invalid.
+// LoadApps reads the YAML file at path (e.g. config/apps.yaml) and returns the list of apps,
+// with the optional defaults block applied to each app.
+// Returns an error if the file cannot be read, YAML is invalid, or it contains unknown keys,
+// duplicate app IDs, or invalid steps (see decodeAppsConfig).
 func LoadApps(path string) ([]App, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	var cfg AppsConfig
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	cfg, err := decodeAppsConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Defaults != nil {
+		for i := range cfg.Apps {
+			cfg.Apps[i] = cfg.Defaults.Apply(cfg.Apps[i])
+		}
 	}
 	return cfg.Apps, nil
 }
 
 // SaveApps marshals the given apps to YAML and writes the file at path.
 // Used by the server when creating, updating, or deleting apps via the API.
+// The defaults block already in the file is kept, and values equal to a default are not repeated per app.
 func SaveApps(path string, apps []App) error {
+	defaults, err := LoadDefaults(path)
+	if err != nil {
+		return err
+	}
 	cfg := AppsConfig{Apps: apps}
+	if !defaults.empty() {
+		cfg.Defaults = &defaults
+		cfg.Apps = make([]App, len(apps))
+		for i, app := range apps {
+			cfg.Apps[i] = defaults.strip(app)
+		}
+	}
 	data, err := yaml.Marshal(&cfg)
 	if err != nil {
 		return err
@@ -127,26 +632,7 @@ func SaveApps(path string, apps []App) error {
 // EffectiveSteps returns app steps. If dynamic steps are not provided, it builds them from legacy fields.
 func (a App) EffectiveSteps() []Step {
 	if len(a.Steps) > 0 {
-		out := make([]Step, 0, len(a.Steps))
-		for i, s := range a.Steps {
-			name := strings.TrimSpace(s.Name)
-			if name == "" {
-				name = "step-" + strconvItoa(i+1)
-			}
-			normalized := Step{
-				Name:      name,
-				Cmd:       strings.TrimSpace(s.Cmd),
-				File:      strings.TrimSpace(s.File),
-				Script:    strings.TrimSpace(s.Script),
-				K8sDeploy: s.K8sDeploy,
-				SleepSec:  s.SleepSec,
-			}
-			if normalized.Kind() == "" {
-				continue
-			}
-			out = append(out, normalized)
-		}
-		return out
+		return normalizeSteps(a.Steps, "step-")
 	}
 	out := make([]Step, 0, 3)
 	if strings.TrimSpace(a.TestCmd) != "" {
@@ -161,9 +647,75 @@ func (a App) EffectiveSteps() []Step {
 	return out
 }
 
-// NormalizeAppSteps writes effective steps back to app.Steps.
+// DefaultSlowFactor is the slow_factor used when an app sets expected_duration_sec only.
+const DefaultSlowFactor = 1.5
+
+// SlowThreshold returns the run duration above which a run is flagged slow, or 0 when the app has no duration budget.
+func (a App) SlowThreshold() time.Duration {
+	if a.ExpectedDurationSec <= 0 {
+		return 0
+	}
+	factor := a.SlowFactor
+	if factor <= 0 {
+		factor = DefaultSlowFactor
+	}
+	return time.Duration(float64(a.ExpectedDurationSec) * factor * float64(time.Second))
+}
+
+// EffectivePost returns the normalized post sections. Unnamed hook steps are named after
+// their section (e.g. "on_failure-1").
+func (a App) EffectivePost() PostSteps {
+	if a.Post == nil {
+		return PostSteps{}
+	}
+	return PostSteps{
+		OnSuccess: normalizeSteps(a.Post.OnSuccess, "on_success-"),
+		OnFailure: normalizeSteps(a.Post.OnFailure, "on_failure-"),
+		Always:    normalizeSteps(a.Post.Always, "always-"),
+	}
+}
+
+// Empty reports whether no post section has steps.
+func (p PostSteps) Empty() bool {
+	return len(p.OnSuccess) == 0 && len(p.OnFailure) == 0 && len(p.Always) == 0
+}
+
+// normalizeSteps trims step fields, names unnamed steps namePrefix+index, and drops steps without a valid kind.
+func normalizeSteps(steps []Step, namePrefix string) []Step {
+	if len(steps) == 0 {
+		return nil
+	}
+	out := make([]Step, 0, len(steps))
+	for i, s := range steps {
+		name := strings.TrimSpace(s.Name)
+		if name == "" {
+			name = namePrefix + strconvItoa(i+1)
+		}
+		normalized := s
+		normalized.Name = name
+		normalized.Cmd = strings.TrimSpace(s.Cmd)
+		normalized.File = strings.TrimSpace(s.File)
+		normalized.Script = strings.TrimSpace(s.Script)
+		normalized.Workdir = strings.Trim(strings.TrimPrefix(strings.TrimSpace(s.Workdir), "./"), "/")
+		if normalized.Workdir == "." {
+			normalized.Workdir = ""
+		}
+		if normalized.Kind() == "" {
+			continue
+		}
+		out = append(out, normalized)
+	}
+	return out
+}
+
+// NormalizeAppSteps writes effective steps (and post sections) back to the app.
 func NormalizeAppSteps(app App) App {
 	app.Steps = app.EffectiveSteps()
+	post := app.EffectivePost()
+	app.Post = nil
+	if !post.Empty() {
+		app.Post = &post
+	}
 	return app
 }
 
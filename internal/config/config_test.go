@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadApps(t *testing.T) {
@@ -115,3 +117,131 @@ func TestEffectiveStepsSupportsK8sDeploy(t *testing.T) {
 		t.Fatalf("unexpected step: %+v", steps[0])
 	}
 }
+
+func TestEffectiveStepsNormalizesWorkdir(t *testing.T) {
+	app := App{
+		ID: "wd",
+		Steps: []Step{
+			{Name: "web", Cmd: "npm ci", Workdir: " ./frontend/ "},
+			{Name: "root", Cmd: "make", Workdir: "."},
+		},
+	}
+	steps := app.EffectiveSteps()
+	if steps[0].Workdir != "frontend" {
+		t.Fatalf("unexpected workdir: %q", steps[0].Workdir)
+	}
+	if steps[1].Workdir != "" {
+		t.Fatalf("expected repo root workdir to be empty, got %q", steps[1].Workdir)
+	}
+}
+
+func TestStepResolveEnv(t *testing.T) {
+	base := map[string]string{"API_URL": "https://api", "NODE_ENV": "development"}
+	step := Step{Env: map[string]string{
+		"NODE_ENV":  "production",
+		"HEALTH":    "${API_URL}/health",
+		"UNTOUCHED": "$MISSING-$API_URL",
+	}}
+	env := step.ResolveEnv(base)
+	if env["NODE_ENV"] != "production" || env["API_URL"] != "https://api" {
+		t.Fatalf("unexpected merge: %#v", env)
+	}
+	if env["HEALTH"] != "https://api/health" {
+		t.Fatalf("unexpected interpolation: %q", env["HEALTH"])
+	}
+	if env["UNTOUCHED"] != "$MISSING-https://api" {
+		t.Fatalf("unexpected unknown ref handling: %q", env["UNTOUCHED"])
+	}
+	if base["NODE_ENV"] != "development" {
+		t.Fatalf("base env was modified: %#v", base)
+	}
+}
+
+func TestLoadAppsStrictErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apps.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`
+apps:
+  - id: a
+    name: A
+    repo: r
+    brnach: main
+`)
+	_, err := LoadApps(path)
+	if err == nil || !strings.Contains(err.Error(), "line 6") || !strings.Contains(err.Error(), "brnach") {
+		t.Fatalf("expected unknown field error with line, got %v", err)
+	}
+
+	write(`
+settings: {}
+apps:
+  - id: a
+    name: A
+    repo: r
+    steps:
+      - name: ok
+        cmd: make
+      - name: both
+        cmd: make
+        script: make
+  - id: a
+    name: A2
+    repo: r
+`)
+	_, err = LoadApps(path)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		`line 2: unknown top-level key "settings"`,
+		`line 10: app "a" step 2: must define exactly one of`,
+		`line 13: duplicate app id "a" (first defined on line 4)`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error:\n%v", want, err)
+		}
+	}
+}
+
+func TestAppSlowThreshold(t *testing.T) {
+	if got := (App{}).SlowThreshold(); got != 0 {
+		t.Fatalf("expected no threshold without expected duration, got %s", got)
+	}
+	if got := (App{ExpectedDurationSec: 60}).SlowThreshold(); got != 90*time.Second {
+		t.Fatalf("expected default factor 1.5, got %s", got)
+	}
+	if got := (App{ExpectedDurationSec: 60, SlowFactor: 2}).SlowThreshold(); got != 2*time.Minute {
+		t.Fatalf("expected 2m, got %s", got)
+	}
+}
+
+func TestPreviewConfigTarget(t *testing.T) {
+	ns, url := PreviewConfig{URL: "https://$BRANCH.preview.example.com/$NAMESPACE"}.Target("shop", "Feature/Login_Form")
+	if ns != "shop-feature-login-form" {
+		t.Fatalf("unexpected default namespace %q", ns)
+	}
+	if url != "https://feature-login-form.preview.example.com/shop-feature-login-form" {
+		t.Fatalf("unexpected url %q", url)
+	}
+	ns, url = PreviewConfig{Namespace: "pr-${BRANCH}"}.Target("shop", "fix")
+	if ns != "pr-fix" || url != "" {
+		t.Fatalf("unexpected target %q %q", ns, url)
+	}
+	long := BranchSlug("feature/a-very-long-branch-name-that-goes-on-and-on")
+	other := BranchSlug("feature/a-very-long-branch-name-that-goes-on-and-off")
+	if len(long) > maxBranchSlugLen || long == other {
+		t.Fatalf("expected short distinct slugs, got %q and %q", long, other)
+	}
+	p := PreviewConfig{Branches: []string{"feature/*"}}
+	if !p.Matches("feature/x") || p.Matches("release/1") || !(PreviewConfig{}).Matches("any") {
+		t.Fatal("unexpected branch matching")
+	}
+	if (PreviewConfig{}).TTL() != DefaultPreviewTTL || (PreviewConfig{TTLHours: 2}).TTL() != 2*time.Hour {
+		t.Fatal("unexpected ttl")
+	}
+}
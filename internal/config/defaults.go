@@ -0,0 +1,122 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AppDefaults is the optional top-level defaults block of apps.yaml.
+// On load, each non-empty value fills the matching field of every app that leaves it empty;
+// Env entries are added to an app's env unless the app defines the same name.
+// YAML anchors and merge keys (<<: *anchor) work in apps.yaml as well, but they are expanded
+// when the server rewrites the file; the defaults block is kept.
+type AppDefaults struct {
+	Branch            string                 `yaml:"branch,omitempty" json:"branch,omitempty"`
+	SSHKeyName        string                 `yaml:"ssh_key_name,omitempty" json:"ssh_key_name,omitempty"`
+	Runner            string                 `yaml:"runner,omitempty" json:"runner,omitempty"`
+	Shell             string                 `yaml:"shell,omitempty" json:"shell,omitempty"`
+	Timezone          string                 `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	DeployMode        string                 `yaml:"deploy_mode,omitempty" json:"deploy_mode,omitempty"`
+	K8sNamespace      string                 `yaml:"k8s_namespace,omitempty" json:"k8s_namespace,omitempty"`
+	K8sServiceAccount string                 `yaml:"k8s_service_account,omitempty" json:"k8s_service_account,omitempty"`
+	K8sRunnerImage    string                 `yaml:"k8s_runner_image,omitempty" json:"k8s_runner_image,omitempty"`
+	K8sPodTemplate    map[string]interface{} `yaml:"k8s_pod_template,omitempty" json:"k8s_pod_template,omitempty"`
+	Env               map[string]string      `yaml:"env,omitempty" json:"env,omitempty"`
+}
+
+// LoadDefaults reads only the defaults block of the apps file at path.
+// A missing file or block yields empty defaults.
+func LoadDefaults(path string) (AppDefaults, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return AppDefaults{}, nil
+	}
+	if err != nil {
+		return AppDefaults{}, err
+	}
+	var cfg AppsConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return AppDefaults{}, err
+	}
+	if cfg.Defaults == nil {
+		return AppDefaults{}, nil
+	}
+	return *cfg.Defaults, nil
+}
+
+func (d AppDefaults) empty() bool {
+	return d.Branch == "" && d.SSHKeyName == "" && d.Runner == "" && d.Shell == "" && d.Timezone == "" && d.DeployMode == "" && d.K8sNamespace == "" &&
+		d.K8sServiceAccount == "" && d.K8sRunnerImage == "" && len(d.K8sPodTemplate) == 0 && len(d.Env) == 0
+}
+
+// Apply returns app with empty fields filled from the defaults.
+func (d AppDefaults) Apply(app App) App {
+	fill := func(dst *string, def string) {
+		if *dst == "" {
+			*dst = def
+		}
+	}
+	fill(&app.Branch, d.Branch)
+	fill(&app.SSHKeyName, d.SSHKeyName)
+	fill(&app.Runner, d.Runner)
+	fill(&app.Shell, d.Shell)
+	fill(&app.Timezone, d.Timezone)
+	fill(&app.DeployMode, d.DeployMode)
+	fill(&app.K8sNamespace, d.K8sNamespace)
+	fill(&app.K8sServiceAccount, d.K8sServiceAccount)
+	fill(&app.K8sRunnerImage, d.K8sRunnerImage)
+	if len(app.K8sPodTemplate) == 0 {
+		app.K8sPodTemplate = d.K8sPodTemplate
+	}
+	if len(d.Env) > 0 {
+		env := make(map[string]string, len(d.Env)+len(app.Env))
+		for k, v := range d.Env {
+			env[k] = v
+		}
+		for k, v := range app.Env {
+			env[k] = v
+		}
+		app.Env = env
+	}
+	return app
+}
+
+// strip is the inverse of Apply used before saving: fields equal to their default are cleared
+// so that the file keeps relying on the defaults block.
+func (d AppDefaults) strip(app App) App {
+	unset := func(dst *string, def string) {
+		if def != "" && *dst == def {
+			*dst = ""
+		}
+	}
+	unset(&app.Branch, d.Branch)
+	unset(&app.SSHKeyName, d.SSHKeyName)
+	unset(&app.Runner, d.Runner)
+	unset(&app.Shell, d.Shell)
+	unset(&app.Timezone, d.Timezone)
+	unset(&app.DeployMode, d.DeployMode)
+	unset(&app.K8sNamespace, d.K8sNamespace)
+	unset(&app.K8sServiceAccount, d.K8sServiceAccount)
+	unset(&app.K8sRunnerImage, d.K8sRunnerImage)
+	if len(d.K8sPodTemplate) > 0 && reflect.DeepEqual(app.K8sPodTemplate, d.K8sPodTemplate) {
+		app.K8sPodTemplate = nil
+	}
+	if len(d.Env) > 0 && len(app.Env) > 0 {
+		env := make(map[string]string, len(app.Env))
+		for k, v := range app.Env {
+			if def, ok := d.Env[k]; ok && def == v {
+				continue
+			}
+			env[k] = v
+		}
+		app.Env = nil
+		if len(env) > 0 {
+			app.Env = env
+		}
+	}
+	return app
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadAppsAppliesDefaultsAndAnchors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apps.yaml")
+	content := `
+defaults:
+  branch: develop
+  k8s_namespace: apps
+  k8s_runner_image: ghcr.io/org/runner:1
+  env:
+    LOG_LEVEL: info
+    REGION: eu
+x-steps: &go-steps
+  - name: test
+    cmd: go test ./...
+apps:
+  - id: a
+    name: A
+    repo: git@example.com:org/a.git
+    steps: *go-steps
+  - id: b
+    name: B
+    repo: git@example.com:org/b.git
+    branch: main
+    env:
+      REGION: us
+    steps: *go-steps
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apps, err := LoadApps(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 {
+		t.Fatalf("expected 2 apps, got %d", len(apps))
+	}
+	a, b := apps[0], apps[1]
+	if a.Branch != "develop" || a.K8sNamespace != "apps" || a.K8sRunnerImage != "ghcr.io/org/runner:1" {
+		t.Fatalf("defaults not applied: %+v", a)
+	}
+	if len(a.Steps) != 1 || a.Steps[0].Cmd != "go test ./..." {
+		t.Fatalf("anchor not expanded: %+v", a.Steps)
+	}
+	if b.Branch != "main" || b.Env["REGION"] != "us" || b.Env["LOG_LEVEL"] != "info" {
+		t.Fatalf("app values must win over defaults: %+v", b)
+	}
+
+	b.K8sNamespace = "custom"
+	if err := SaveApps(path, []App{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := string(data)
+	if !strings.Contains(saved, "defaults:") || strings.Count(saved, "ghcr.io/org/runner:1") != 1 || strings.Count(saved, "LOG_LEVEL") != 1 {
+		t.Fatalf("expected defaults kept and not repeated per app:\n%s", saved)
+	}
+	reloaded, err := LoadApps(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded[0].Branch != "develop" || reloaded[1].K8sNamespace != "custom" || reloaded[1].Env["REGION"] != "us" {
+		t.Fatalf("unexpected apps after round trip: %+v", reloaded)
+	}
+}
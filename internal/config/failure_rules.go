@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FailureRule labels a failed run with Reason when its log matches Pattern (a Go regexp).
+type FailureRule struct {
+	Reason  string `yaml:"reason" json:"reason"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// FailureRulesConfig is the root of the failure rules file. Rules are tried in order before the
+// built-in ones (DefaultFailureRules), which DisableDefaults turns off.
+type FailureRulesConfig struct {
+	Rules           []FailureRule `yaml:"rules"`
+	DisableDefaults bool          `yaml:"disable_defaults,omitempty"`
+}
+
+var failureReasonPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// defaultFailureRules are the failure signatures recognized without a rules file.
+var defaultFailureRules = []FailureRule{
+	{Reason: "oom", Pattern: `(?i)out of memory|OOMKilled|exit code 137|java\.lang\.OutOfMemoryError|heap out of memory|Killed process \d+`},
+	{Reason: "pod_evicted", Pattern: `(?i)\bEvicted\b|The node was low on resource|Pod was terminated in response to imminent node shutdown`},
+	{Reason: "registry_auth", Pattern: `(?i)unauthorized: authentication required|pull access denied|denied: requested access to the resource is denied|no basic auth credentials|unauthorized: incorrect username or password`},
+	{Reason: "git_auth", Pattern: `(?i)Permission denied \(publickey\)|Authentication failed for|could not read Username for|Host key verification failed|fatal: Could not read from remote repository`},
+	{Reason: "network_timeout", Pattern: `(?i)i/o timeout|connection timed out|connection reset by peer|TLS handshake timeout|Could not resolve host|temporary failure in name resolution|the remote end hung up unexpectedly|early EOF`},
+	{Reason: "test_failure", Pattern: `(?m)^--- FAIL: |^FAIL\s|^FAILED |\b\d+ (failed|failing)\b|Tests?:\s+\d+ failed`},
+}
+
+// DefaultRetryReasons are the infrastructure failure reasons an app's auto_retry retries when it
+// lists none: failures that say nothing about the code and usually pass on the next attempt.
+var DefaultRetryReasons = []string{"pod_evicted", "network_timeout"}
+
+// ValidFailureReason reports whether reason is a valid failure rule reason.
+func ValidFailureReason(reason string) bool {
+	return failureReasonPattern.MatchString(reason)
+}
+
+// DefaultFailureRules returns the built-in failure rules, compiled.
+func DefaultFailureRules() []FailureRule {
+	rules := make([]FailureRule, len(defaultFailureRules))
+	copy(rules, defaultFailureRules)
+	for i := range rules {
+		rules[i].re = regexp.MustCompile(rules[i].Pattern)
+	}
+	return rules
+}
+
+// LoadFailureRules reads and validates the failure rules file at path and returns the rules to
+// apply: the file's rules followed by the built-in ones unless disabled.
+func LoadFailureRules(path string) ([]FailureRule, error) {
+	var cfg FailureRulesConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rules := make([]FailureRule, 0, len(cfg.Rules)+len(defaultFailureRules))
+	for i, r := range cfg.Rules {
+		r.Reason = strings.TrimSpace(r.Reason)
+		if !ValidFailureReason(r.Reason) {
+			return nil, fmt.Errorf("%s: rule %d: reason %q must be lowercase letters, digits, '.', '_' or '-'", path, i+1, r.Reason)
+		}
+		if strings.TrimSpace(r.Pattern) == "" {
+			return nil, fmt.Errorf("%s: rule %d (%s): pattern is required", path, i+1, r.Reason)
+		}
+		if r.re, err = regexp.Compile(r.Pattern); err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %w", path, i+1, r.Reason, err)
+		}
+		rules = append(rules, r)
+	}
+	if !cfg.DisableDefaults {
+		rules = append(rules, DefaultFailureRules()...)
+	}
+	return rules, nil
+}
+
+// ClassifyFailure returns the reason of the first rule whose pattern matches log, or "".
+func ClassifyFailure(rules []FailureRule, log string) string {
+	for _, r := range rules {
+		if r.re != nil && r.re.MatchString(log) {
+			return r.Reason
+		}
+	}
+	return ""
+}
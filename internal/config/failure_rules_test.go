@@ -0,0 +1,69 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadFailureRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failure-rules.yaml")
+	content := `
+rules:
+  - reason: flaky_network
+    pattern: '(?i)connection reset by peer'
+  - reason: disk_full
+    pattern: 'no space left on device'
+  - reason: oom
+    pattern: 'exit status 9'
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadFailureRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3+len(DefaultFailureRules()) {
+		t.Fatalf("expected configured and default rules, got %d", len(rules))
+	}
+	cases := map[string]string{
+		"read: Connection reset by peer":                               "flaky_network",
+		"step test\n--- FAIL: TestLogin (0.02s)\nFAIL":                 "test_failure",
+		"container was OOMKilled":                                      "oom",
+		"Error: pull access denied for app/api":                        "registry_auth",
+		"git@github.com: Permission denied (publickey).":               "git_auth",
+		"Could not resolve host: git.example.com":                      "network_timeout",
+		"pod api-run-42 Evicted: The node was low on resource: memory": "pod_evicted",
+		"write /tmp/x: no space left on device":                        "disk_full",
+		"everything looks fine":                                        "",
+	}
+	for log, want := range cases {
+		if got := ClassifyFailure(rules, log); got != want {
+			t.Errorf("ClassifyFailure(%q) = %q, want %q", log, got, want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("disable_defaults: true\nrules:\n  - reason: custom\n    pattern: boom\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rules, err = LoadFailureRules(path); err != nil || len(rules) != 1 || ClassifyFailure(rules, "OOMKilled") != "" {
+		t.Fatalf("expected only the configured rule, got %+v, %v", rules, err)
+	}
+
+	bad := map[string]string{
+		"rules:\n  - reason: OOM\n    pattern: x\n":    "must be lowercase",
+		"rules:\n  - reason: oom\n":                    "pattern is required",
+		"rules:\n  - reason: oom\n    pattern: '(x'\n": "missing closing )",
+		"rules:\n  - reason: oom\n    regex: x\n":      "field regex not found",
+	}
+	for content, want := range bad {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFailureRules(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadFailureRules(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
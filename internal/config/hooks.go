@@ -0,0 +1,131 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Hook events: run.started when a run begins executing, run.finished when it ended (any status).
+const (
+	HookRunStarted  = "run.started"
+	HookRunFinished = "run.finished"
+)
+
+// DefaultHookTimeout bounds a hook that sets no timeout_sec.
+const DefaultHookTimeout = 30 * time.Second
+
+const maxHookTimeoutSec = 600
+
+// Hook is a server-side lifecycle hook: on its Events, Command (an argv, run on the server host
+// with the run metadata as NOPPFLOW_* env vars and as JSON on stdin) or URL (posted the JSON) is
+// called, e.g. to open a ticket or update a CMDB. Apps, when set, limits the hook to those apps.
+type Hook struct {
+	Name       string            `yaml:"name" json:"name"`
+	Events     []string          `yaml:"events" json:"events"`
+	Apps       []string          `yaml:"apps,omitempty" json:"apps,omitempty"`
+	Command    []string          `yaml:"command,omitempty" json:"command,omitempty"`
+	URL        string            `yaml:"url,omitempty" json:"url,omitempty"`
+	Headers    map[string]string `yaml:"headers,omitempty" json:"-"` // values may reference server env vars as ${NAME}
+	TimeoutSec int               `yaml:"timeout_sec,omitempty" json:"timeout_sec,omitempty"`
+}
+
+// HooksConfig is the root of the hooks file.
+type HooksConfig struct {
+	Hooks []Hook `yaml:"hooks"`
+}
+
+var hookNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,99}$`)
+
+// LoadHooks reads and validates the hooks file at path.
+func LoadHooks(path string) (HooksConfig, error) {
+	var cfg HooksConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool, len(cfg.Hooks))
+	for i := range cfg.Hooks {
+		h := &cfg.Hooks[i]
+		if err := h.init(); err != nil {
+			return cfg, fmt.Errorf("%s: hook %d: %w", path, i+1, err)
+		}
+		if seen[h.Name] {
+			return cfg, fmt.Errorf("%s: duplicate hook %q", path, h.Name)
+		}
+		seen[h.Name] = true
+	}
+	return cfg, nil
+}
+
+// init checks the hook and trims its name, url, and apps.
+func (h *Hook) init() error {
+	h.Name = strings.TrimSpace(h.Name)
+	if !hookNamePattern.MatchString(h.Name) {
+		return fmt.Errorf("name %q must be lowercase letters, digits, '.', '_' or '-'", h.Name)
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("%s: events are required (%s, %s)", h.Name, HookRunStarted, HookRunFinished)
+	}
+	for _, e := range h.Events {
+		if e != HookRunStarted && e != HookRunFinished {
+			return fmt.Errorf("%s: unknown event %q (want %s or %s)", h.Name, e, HookRunStarted, HookRunFinished)
+		}
+	}
+	h.URL = strings.TrimSpace(h.URL)
+	switch {
+	case len(h.Command) > 0 && h.URL != "":
+		return fmt.Errorf("%s: set either command or url, not both", h.Name)
+	case len(h.Command) > 0:
+		if strings.TrimSpace(h.Command[0]) == "" {
+			return fmt.Errorf("%s: command must start with the program to run", h.Name)
+		}
+		if len(h.Headers) > 0 {
+			return fmt.Errorf("%s: headers apply to url hooks only", h.Name)
+		}
+	case h.URL != "":
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: url must be an http or https URL", h.Name)
+		}
+	default:
+		return fmt.Errorf("%s: command or url is required", h.Name)
+	}
+	if h.TimeoutSec < 0 || h.TimeoutSec > maxHookTimeoutSec {
+		return fmt.Errorf("%s: timeout_sec must be between 0 and %d", h.Name, maxHookTimeoutSec)
+	}
+	for i, id := range h.Apps {
+		h.Apps[i] = strings.TrimSpace(id)
+	}
+	return nil
+}
+
+// Timeout returns how long the hook may take.
+func (h Hook) Timeout() time.Duration {
+	if h.TimeoutSec <= 0 {
+		return DefaultHookTimeout
+	}
+	return time.Duration(h.TimeoutSec) * time.Second
+}
+
+// Fires reports whether the hook runs on event for appID.
+func (h Hook) Fires(event, appID string) bool {
+	if len(h.Apps) > 0 && !slices.Contains(h.Apps, appID) {
+		return false
+	}
+	return slices.Contains(h.Events, event)
+}
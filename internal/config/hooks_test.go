@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.yaml")
+	content := `
+hooks:
+  - name: cmdb
+    events: [run.finished]
+    apps: [" api "]
+    url: https://cmdb.example.com/deployments
+    headers: {Authorization: "Bearer ${CMDB_TOKEN}"}
+  - name: ticket
+    events: [run.started, run.finished]
+    command: [/usr/local/bin/ticket-hook, --queue, ops]
+    timeout_sec: 5
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadHooks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Hooks) != 2 {
+		t.Fatalf("expected two hooks, got %+v", cfg.Hooks)
+	}
+	cmdb, ticket := cfg.Hooks[0], cfg.Hooks[1]
+	if !cmdb.Fires(HookRunFinished, "api") || cmdb.Fires(HookRunStarted, "api") || cmdb.Fires(HookRunFinished, "web") {
+		t.Fatalf("unexpected cmdb hook filters %+v", cmdb)
+	}
+	if !ticket.Fires(HookRunStarted, "web") || ticket.Timeout() != 5*time.Second || cmdb.Timeout() != DefaultHookTimeout {
+		t.Fatalf("unexpected ticket hook %+v", ticket)
+	}
+
+	bad := map[string]string{
+		"hooks:\n  - name: Ticket\n    events: [run.started]\n    url: https://x\n":                                                          "must be lowercase",
+		"hooks:\n  - name: x\n    url: https://x\n":                                                                                          "events are required",
+		"hooks:\n  - name: x\n    events: [run.failed]\n    url: https://x\n":                                                                "unknown event",
+		"hooks:\n  - name: x\n    events: [run.started]\n":                                                                                   "command or url is required",
+		"hooks:\n  - name: x\n    events: [run.started]\n    url: https://x\n    command: [true]\n":                                          "not both",
+		"hooks:\n  - name: x\n    events: [run.started]\n    url: ftp://x\n":                                                                 "http or https",
+		"hooks:\n  - name: x\n    events: [run.started]\n    command: [true]\n    headers: {A: b}\n":                                         "url hooks only",
+		"hooks:\n  - name: x\n    events: [run.started]\n    command: [true]\n    timeout_sec: 601\n":                                        "timeout_sec",
+		"hooks:\n  - name: x\n    events: [run.started]\n    command: [true]\n  - name: x\n    events: [run.started]\n    command: [true]\n": "duplicate hook",
+		"hooks:\n  - name: x\n    event: [run.started]\n":                                                                                    "field event not found",
+	}
+	for content, want := range bad {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadHooks(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadHooks(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
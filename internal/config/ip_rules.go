@@ -0,0 +1,144 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IPRuleSet restricts which client addresses may use a group of endpoints. Entries are CIDRs
+// ("10.0.0.0/8") or single addresses. An address matching Deny is rejected; otherwise, when
+// Allow is not empty, it must match one of Allow.
+type IPRuleSet struct {
+	Allow []string `yaml:"allow,omitempty" json:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty" json:"deny,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// IPRules is the root of the IP rules file: rules for the admin API (requests of admin users)
+// and for the inbound webhook endpoints. Requests from TrustedProxies are attributed to the
+// client address in their X-Forwarded-For header.
+type IPRules struct {
+	Admin          IPRuleSet `yaml:"admin" json:"admin"`
+	Webhooks       IPRuleSet `yaml:"webhooks" json:"webhooks"`
+	TrustedProxies []string  `yaml:"trusted_proxies,omitempty" json:"trusted_proxies,omitempty"`
+
+	trustedProxies []*net.IPNet
+}
+
+// LoadIPRules reads and validates the IP rules file at path.
+func LoadIPRules(path string) (IPRules, error) {
+	var rules IPRules
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return rules, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := rules.init(); err != nil {
+		return rules, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func (r *IPRules) init() error {
+	var err error
+	if r.Admin.allow, err = parseCIDRs("admin.allow", r.Admin.Allow); err != nil {
+		return err
+	}
+	if r.Admin.deny, err = parseCIDRs("admin.deny", r.Admin.Deny); err != nil {
+		return err
+	}
+	if r.Webhooks.allow, err = parseCIDRs("webhooks.allow", r.Webhooks.Allow); err != nil {
+		return err
+	}
+	if r.Webhooks.deny, err = parseCIDRs("webhooks.deny", r.Webhooks.Deny); err != nil {
+		return err
+	}
+	r.trustedProxies, err = parseCIDRs("trusted_proxies", r.TrustedProxies)
+	return err
+}
+
+// parseCIDRs parses CIDRs and single addresses (as /32 or /128 networks).
+func parseCIDRs(field string, entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%s: invalid address %q", field, entry)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid CIDR %q", field, entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether ip may use the endpoints of the rule set. A nil ip is only allowed by
+// an empty rule set.
+func (s IPRuleSet) Allows(ip net.IP) bool {
+	if len(s.allow) == 0 && len(s.deny) == 0 {
+		return true
+	}
+	if ip == nil || containsIP(s.deny, ip) {
+		return false
+	}
+	return len(s.allow) == 0 || containsIP(s.allow, ip)
+}
+
+// ClientIP returns the client address of a request from remoteAddr ("host:port"): when it is a
+// trusted proxy, the right-most address of xForwardedFor that is not a trusted proxy. It returns
+// nil when no address can be parsed.
+func (r IPRules) ClientIP(remoteAddr, xForwardedFor string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(r.trustedProxies, ip) || xForwardedFor == "" {
+		return ip
+	}
+	hops := strings.Split(xForwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return nil
+		}
+		ip = hop
+		if !containsIP(r.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
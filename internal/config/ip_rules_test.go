@@ -0,0 +1,52 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadIPRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_rules.yaml")
+	content := "admin:\n  allow: [10.0.0.0/8, 192.168.1.20]\n  deny: [10.66.0.0/16]\nwebhooks:\n  deny: [\"2001:db8::/32\"]\ntrusted_proxies: [127.0.0.1]\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadIPRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"10.1.2.3": true, "192.168.1.20": true, "192.168.1.21": false, "10.66.0.1": false} {
+		if got := rules.Admin.Allows(net.ParseIP(addr)); got != want {
+			t.Errorf("admin allows %s: expected %v, got %v", addr, want, got)
+		}
+	}
+	if !rules.Webhooks.Allows(net.ParseIP("203.0.113.9")) || rules.Webhooks.Allows(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected webhook rules %+v", rules.Webhooks)
+	}
+	if rules.Admin.Allows(nil) || !(IPRuleSet{}).Allows(nil) {
+		t.Fatal("expected unknown addresses to pass only empty rule sets")
+	}
+
+	if ip := rules.ClientIP("127.0.0.1:5000", "203.0.113.9, 127.0.0.1"); ip.String() != "203.0.113.9" {
+		t.Fatalf("expected forwarded client of a trusted proxy, got %s", ip)
+	}
+	if ip := rules.ClientIP("198.51.100.7:5000", "10.1.2.3"); ip.String() != "198.51.100.7" {
+		t.Fatalf("expected X-Forwarded-For of an untrusted peer to be ignored, got %s", ip)
+	}
+
+	for content, want := range map[string]string{
+		"admin:\n  allow: [10.0.0.0/33]\n": "admin.allow: invalid CIDR",
+		"webhooks:\n  deny: [nope]\n":      "webhooks.deny: invalid address",
+		"admins: {}\n":                     "field admins not found",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadIPRules(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadIPRules(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is a rule that runs with deploy steps of the matching apps must satisfy before they start.
+// An app matches when its ID matches one of Apps (path.Match patterns such as "*-prod") or it has
+// one of Tags; a policy without Apps and Tags applies to every app. Each non-empty condition must
+// hold: the app branch matches one of Branches, the run starts inside Hours (e.g.
+// "Mon-Fri 09:00-17:00", in Timezone or UTC), and the run was triggered by a member of one of
+// Groups or by a user matching one of Users (patterns like "webhook:*" match webhook runs).
+type Policy struct {
+	Name     string   `yaml:"name" json:"name"`
+	Apps     []string `yaml:"apps,omitempty" json:"apps,omitempty"`
+	Tags     []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Branches []string `yaml:"branches,omitempty" json:"branches,omitempty"`
+	Hours    string   `yaml:"hours,omitempty" json:"hours,omitempty"`
+	Timezone string   `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	Groups   []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Users    []string `yaml:"users,omitempty" json:"users,omitempty"`
+
+	window   *HoursWindow
+	location *time.Location
+}
+
+// Environment holds the protection rules of a deploy environment, applied to the deploy steps of
+// apps whose Environment names it: the app branch must match one of Branches, the step must not
+// start inside one of Freezes (hours windows such as "Fri 16:00-24:00", in Timezone or UTC), and
+// with ApproverGroups a member of one of them must approve the deploy, within ApprovalTimeoutSec
+// (DefaultApprovalTimeout when 0). With Signatures, the images a deploy step deploys must carry a
+// cosign signature that verifies.
+type Environment struct {
+	Name               string   `yaml:"name" json:"name"`
+	Branches           []string `yaml:"branches,omitempty" json:"branches,omitempty"`
+	ApproverGroups     []string `yaml:"approver_groups,omitempty" json:"approver_groups,omitempty"`
+	Freezes            []string `yaml:"freezes,omitempty" json:"freezes,omitempty"`
+	Timezone           string   `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	ApprovalTimeoutSec int      `yaml:"approval_timeout_sec,omitempty" json:"approval_timeout_sec,omitempty"`
+
+	Signatures *SignaturePolicy `yaml:"signatures,omitempty" json:"signatures,omitempty"`
+
+	freezes  []HoursWindow
+	location *time.Location
+}
+
+// SignaturePolicy says which cosign signatures an environment accepts: one made with the private
+// key of one of PublicKeys (key files or KMS URIs such as awskms:///alias/cosign), or a keyless
+// signature whose certificate identity matches the CertificateIdentity regexp and was issued by
+// CertificateOIDCIssuer.
+type SignaturePolicy struct {
+	PublicKeys            []string `yaml:"public_keys,omitempty" json:"public_keys,omitempty"`
+	CertificateIdentity   string   `yaml:"certificate_identity,omitempty" json:"certificate_identity,omitempty"`
+	CertificateOIDCIssuer string   `yaml:"certificate_oidc_issuer,omitempty" json:"certificate_oidc_issuer,omitempty"`
+}
+
+// PoliciesConfig is the root of the policy file.
+type PoliciesConfig struct {
+	Policies     []Policy      `yaml:"policies"`
+	Environments []Environment `yaml:"environments"`
+}
+
+// LoadPolicies reads and validates the policy file at path.
+func LoadPolicies(path string) (PoliciesConfig, error) {
+	var cfg PoliciesConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool, len(cfg.Policies))
+	for i := range cfg.Policies {
+		p := &cfg.Policies[i]
+		if err := p.init(); err != nil {
+			return cfg, fmt.Errorf("%s: policy %d: %w", path, i+1, err)
+		}
+		if seen[p.Name] {
+			return cfg, fmt.Errorf("%s: duplicate policy %q", path, p.Name)
+		}
+		seen[p.Name] = true
+	}
+	seen = make(map[string]bool, len(cfg.Environments))
+	for i := range cfg.Environments {
+		e := &cfg.Environments[i]
+		if err := e.init(); err != nil {
+			return cfg, fmt.Errorf("%s: environment %d: %w", path, i+1, err)
+		}
+		if seen[e.Name] {
+			return cfg, fmt.Errorf("%s: duplicate environment %q", path, e.Name)
+		}
+		seen[e.Name] = true
+	}
+	return cfg, nil
+}
+
+// init checks the policy and parses its hours and timezone.
+func (p *Policy) init() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	for _, patterns := range [][]string{p.Apps, p.Branches, p.Users} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid pattern %q", p.Name, pattern)
+			}
+		}
+	}
+	if len(p.Branches) == 0 && p.Hours == "" && len(p.Groups) == 0 && len(p.Users) == 0 {
+		return fmt.Errorf("%s: needs at least one of branches, hours, groups, users", p.Name)
+	}
+	p.location = time.UTC
+	if p.Timezone != "" {
+		if p.Hours == "" {
+			return fmt.Errorf("%s: timezone is only used with hours", p.Name)
+		}
+		loc, err := time.LoadLocation(p.Timezone)
+		if err != nil {
+			return fmt.Errorf("%s: invalid timezone %q", p.Name, p.Timezone)
+		}
+		p.location = loc
+	}
+	if p.Hours != "" {
+		w, err := ParseHoursWindow(p.Hours)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Name, err)
+		}
+		p.window = &w
+	}
+	return nil
+}
+
+// AppliesTo reports whether the policy covers an app with the given ID and tags.
+func (p Policy) AppliesTo(appID string, tags []string) bool {
+	if len(p.Apps) == 0 && len(p.Tags) == 0 {
+		return true
+	}
+	if MatchAny(p.Apps, appID) {
+		return true
+	}
+	for _, want := range p.Tags {
+		for _, tag := range tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// InHours reports whether t is inside the policy's hours (always true without hours).
+func (p Policy) InHours(t time.Time) bool {
+	if p.window == nil {
+		return true
+	}
+	return p.window.Contains(t.In(p.location))
+}
+
+// Location returns the timezone of the policy's hours.
+func (p Policy) Location() *time.Location {
+	if p.location == nil {
+		return time.UTC
+	}
+	return p.location
+}
+
+var environmentNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidEnvironmentName reports whether name can name an environment (e.g. prod, eu-staging).
+func ValidEnvironmentName(name string) bool {
+	return len(name) <= 64 && environmentNamePattern.MatchString(name)
+}
+
+// init checks the environment and parses its freezes and timezone.
+func (e *Environment) init() error {
+	e.Name = strings.TrimSpace(e.Name)
+	if !ValidEnvironmentName(e.Name) {
+		return fmt.Errorf("invalid name %q", e.Name)
+	}
+	for _, pattern := range e.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: invalid pattern %q", e.Name, pattern)
+		}
+	}
+	if e.ApprovalTimeoutSec < 0 {
+		return fmt.Errorf("%s: approval_timeout_sec must be >= 0", e.Name)
+	}
+	e.location = time.UTC
+	if e.Timezone != "" {
+		loc, err := time.LoadLocation(e.Timezone)
+		if err != nil {
+			return fmt.Errorf("%s: invalid timezone %q", e.Name, e.Timezone)
+		}
+		e.location = loc
+	}
+	e.freezes = nil
+	for _, f := range e.Freezes {
+		w, err := ParseHoursWindow(f)
+		if err != nil {
+			return fmt.Errorf("%s: freeze: %w", e.Name, err)
+		}
+		e.freezes = append(e.freezes, w)
+	}
+	if e.Signatures != nil {
+		if err := e.Signatures.check(); err != nil {
+			return fmt.Errorf("%s: signatures: %w", e.Name, err)
+		}
+	}
+	return nil
+}
+
+// check validates a signature policy: it needs public keys, a certificate identity, or both.
+func (p *SignaturePolicy) check() error {
+	for i, key := range p.PublicKeys {
+		p.PublicKeys[i] = strings.TrimSpace(key)
+		if p.PublicKeys[i] == "" {
+			return errors.New("public_keys must not be empty")
+		}
+	}
+	p.CertificateIdentity = strings.TrimSpace(p.CertificateIdentity)
+	p.CertificateOIDCIssuer = strings.TrimSpace(p.CertificateOIDCIssuer)
+	if (p.CertificateIdentity == "") != (p.CertificateOIDCIssuer == "") {
+		return errors.New("certificate_identity and certificate_oidc_issuer must be set together")
+	}
+	if p.CertificateIdentity != "" {
+		if _, err := regexp.Compile(p.CertificateIdentity); err != nil {
+			return fmt.Errorf("invalid certificate_identity: %v", err)
+		}
+	} else if len(p.PublicKeys) == 0 {
+		return errors.New("needs public_keys or certificate_identity")
+	}
+	return nil
+}
+
+// FrozenBy returns the freeze window containing t, or "" when deploys are allowed at t.
+func (e Environment) FrozenBy(t time.Time) string {
+	for i, w := range e.freezes {
+		if w.Contains(t.In(e.Location())) {
+			return e.Freezes[i]
+		}
+	}
+	return ""
+}
+
+// Location returns the timezone of the environment's freeze windows.
+func (e Environment) Location() *time.Location {
+	if e.location == nil {
+		return time.UTC
+	}
+	return e.location
+}
+
+// ApprovalTimeout returns how long a deploy waits for approval.
+func (e Environment) ApprovalTimeout() time.Duration {
+	if e.ApprovalTimeoutSec > 0 {
+		return time.Duration(e.ApprovalTimeoutSec) * time.Second
+	}
+	return DefaultApprovalTimeout
+}
+
+// MatchAny reports whether s matches one of the path.Match patterns.
+func MatchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HoursWindow is a daily time window on some weekdays, e.g. "Mon-Fri 09:00-17:00". The end is
+// exclusive; windows cannot cross midnight.
+type HoursWindow struct {
+	Days       [7]bool // indexed by time.Weekday
+	Start, End int     // minutes since midnight
+}
+
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// ParseHoursWindow parses "[days ]HH:MM-HH:MM" where days is a comma-separated list of weekdays
+// or ranges (Mon-Fri, Sat,Sun); without days every day is included.
+func ParseHoursWindow(s string) (HoursWindow, error) {
+	var w HoursWindow
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("hours %q must look like \"Mon-Fri 09:00-17:00\"", s)
+	}
+	if len(fields) == 1 {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, last := weekdayIndex(from), weekdayIndex(to)
+			if !isRange {
+				last = first
+			}
+			if first < 0 || last < 0 {
+				return w, fmt.Errorf("hours %q: unknown weekday in %q", s, part)
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.Days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	start, err1 := parseClock(from)
+	end, err2 := parseClock(to)
+	if !ok || err1 != nil || err2 != nil || start >= end {
+		return w, fmt.Errorf("hours %q: time range must look like 09:00-17:00", s)
+	}
+	w.Start, w.End = start, end
+	return w, nil
+}
+
+// Contains reports whether t (in the window's timezone) is inside the window.
+func (w HoursWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	return w.Days[t.Weekday()] && minute >= w.Start && minute < w.End
+}
+
+func weekdayIndex(name string) int {
+	for i, n := range weekdayNames {
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	content := `
+policies:
+  - name: prod-deploys
+    apps: ["*-prod"]
+    tags: [env:prod]
+    branches: [main]
+    hours: Mon-Fri 09:00-17:00
+    timezone: Europe/Berlin
+    groups: [release]
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := cfg.Policies
+	if len(policies) != 1 {
+		t.Fatalf("expected one policy, got %+v", policies)
+	}
+	p := policies[0]
+	if !p.AppliesTo("api-prod", nil) || !p.AppliesTo("api", []string{"env:prod"}) || p.AppliesTo("api", []string{"env:dev"}) {
+		t.Fatal("unexpected app matching")
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	if !p.InHours(time.Date(2026, 1, 5, 9, 0, 0, 0, berlin)) {
+		t.Fatal("expected Monday 09:00 in Berlin to be inside the window")
+	}
+	if p.InHours(time.Date(2026, 1, 5, 16, 30, 0, 0, time.UTC)) {
+		t.Fatal("expected Monday 16:30 UTC (17:30 in Berlin) to be outside the window")
+	}
+	if p.InHours(time.Date(2026, 1, 10, 10, 0, 0, 0, berlin)) {
+		t.Fatal("expected Saturday to be outside the window")
+	}
+
+	bad := map[string]string{
+		"policies:\n  - name: x\n    apps: [a]\n":                              "needs at least one of",
+		"policies:\n  - name: x\n    hours: Mon-Fry 09:00-17:00\n":             "unknown weekday",
+		"policies:\n  - name: x\n    hours: 17:00-09:00\n":                     "time range",
+		"policies:\n  - name: x\n    branches: [main]\n    timezone: Mars/X\n": "timezone is only used with hours",
+		"policies:\n  - name: x\n    branch: main\n":                           "field branch not found",
+	}
+	for content, want := range bad {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPolicies(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadPolicies(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
+
+func TestLoadPolicies_Environments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	content := `environments:
+  - name: prod
+    branches: [main]
+    approver_groups: [release]
+    freezes: ["Fri 16:00-24:00", "Sat,Sun 00:00-24:00"]
+    timezone: Europe/Berlin
+    signatures:
+      public_keys: [/etc/noppflow/cosign.pub]
+      certificate_identity: ^https://github.com/acme/
+      certificate_oidc_issuer: https://token.actions.githubusercontent.com
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Environments) != 1 || len(cfg.Policies) != 0 {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	env := cfg.Environments[0]
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	if got := env.FrozenBy(time.Date(2026, 1, 9, 16, 30, 0, 0, berlin)); got != "Fri 16:00-24:00" {
+		t.Fatalf("expected Friday afternoon to be frozen, got %q", got)
+	}
+	if got := env.FrozenBy(time.Date(2026, 1, 9, 14, 30, 0, 0, time.UTC)); got != "" {
+		t.Fatalf("expected Friday 15:30 in Berlin to be open, got %q", got)
+	}
+	if env.ApprovalTimeout() != DefaultApprovalTimeout {
+		t.Fatalf("unexpected approval timeout %s", env.ApprovalTimeout())
+	}
+	if env.Signatures == nil || len(env.Signatures.PublicKeys) != 1 || env.Signatures.CertificateOIDCIssuer != "https://token.actions.githubusercontent.com" {
+		t.Fatalf("unexpected signature policy %+v", env.Signatures)
+	}
+
+	bad := map[string]string{
+		"environments:\n  - name: \"prod eu\"\n":                                      "invalid name",
+		"environments:\n  - name: prod\n    freezes: [Fri]\n":                         "freeze",
+		"environments:\n  - name: prod\n  - name: prod\n":                             "duplicate environment",
+		"environments:\n  - name: prod\n    approval_timeout_sec: -1\n":               "approval_timeout_sec",
+		"environments:\n  - name: prod\n    signatures: {}\n":                         "needs public_keys or certificate_identity",
+		"environments:\n  - name: prod\n    signatures: {certificate_identity: ci}\n": "must be set together",
+		"environments:\n  - name: prod\n    signatures: {public_keys: [\"\"]}\n":      "public_keys must not be empty",
+	}
+	for content, want := range bad {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPolicies(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadPolicies(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
+
+func TestParseHoursWindow(t *testing.T) {
+	w, err := ParseHoursWindow("Sat,Sun 00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Contains(time.Date(2026, 1, 4, 23, 59, 0, 0, time.UTC)) || w.Contains(time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected window %+v", w)
+	}
+	w, err = ParseHoursWindow("Fri-Mon 08:00-10:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [7]bool{true, true, false, false, false, true, true}
+	if w.Days != want {
+		t.Fatalf("expected wrap-around day range, got %v", w.Days)
+	}
+}
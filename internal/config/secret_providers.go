@@ -0,0 +1,216 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret reference schemes: an app or global env var whose value is "<scheme>:<path>[#<key>]"
+// gets the secret resolved from the provider at run time instead of the literal value.
+const (
+	SecretSchemeVault = "vault"
+	SecretSchemeAWSSM = "aws-sm"
+	SecretSchemeSOPS  = "sops"
+)
+
+// IsSecretRef reports whether an env value has the form of a secret reference of any scheme,
+// whether or not its provider is configured.
+func IsSecretRef(value string) bool {
+	scheme, _, ok := strings.Cut(value, ":")
+	return ok && (scheme == SecretSchemeVault || scheme == SecretSchemeAWSSM || scheme == SecretSchemeSOPS)
+}
+
+// Vault auth methods.
+const (
+	VaultAuthToken      = "token"
+	VaultAuthAppRole    = "approle"
+	VaultAuthKubernetes = "kubernetes"
+)
+
+// DefaultKubernetesTokenFile is the service account token of a pod, used for Vault Kubernetes
+// auth and AWS web identity when no file is configured.
+const DefaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultProvider reads secrets from a HashiCorp Vault KV engine. References are
+// vault:<mount>/<path>#<field>. With approle or kubernetes auth, each run logs in for a token
+// that is revoked once its secrets are read; token auth uses the token in TokenEnv as is.
+type VaultProvider struct {
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace,omitempty"`
+	KVVersion int    `yaml:"kv_version,omitempty"` // 1 or 2 (default)
+	Auth      string `yaml:"auth"`
+	// TokenEnv names the server env var holding the token for token auth (default VAULT_TOKEN).
+	TokenEnv string `yaml:"token_env,omitempty"`
+	// RoleID and SecretIDFile are the AppRole credentials.
+	RoleID       string `yaml:"role_id,omitempty"`
+	SecretIDFile string `yaml:"secret_id_file,omitempty"`
+	// Role and JWTFile are the Kubernetes auth role and service account token.
+	Role    string `yaml:"role,omitempty"`
+	JWTFile string `yaml:"jwt_file,omitempty"`
+	// Mount is the path the auth method is mounted at (default approle or kubernetes).
+	Mount   string   `yaml:"mount,omitempty"`
+	Allowed []string `yaml:"allowed,omitempty"`
+}
+
+// AWSSecretsManagerProvider reads secrets from AWS Secrets Manager. References are
+// aws-sm:<name or ARN>[#<JSON field>]. Credentials are short-lived: with RoleARN (default
+// AWS_ROLE_ARN) and a web identity token file (default AWS_WEB_IDENTITY_TOKEN_FILE, as set up
+// by EKS), each run assumes the role through STS; otherwise the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN env vars of the server are used.
+type AWSSecretsManagerProvider struct {
+	Region               string   `yaml:"region"`
+	Endpoint             string   `yaml:"endpoint,omitempty"`
+	STSEndpoint          string   `yaml:"sts_endpoint,omitempty"`
+	RoleARN              string   `yaml:"role_arn,omitempty"`
+	WebIdentityTokenFile string   `yaml:"web_identity_token_file,omitempty"`
+	Allowed              []string `yaml:"allowed,omitempty"`
+}
+
+// SOPSProvider decrypts SOPS files on the server with the sops binary, which finds its keys
+// (age, PGP, cloud KMS) the usual way. References are sops:<file below Dir>#<key path>, with
+// nested keys separated by dots.
+type SOPSProvider struct {
+	Dir     string   `yaml:"dir"`
+	Binary  string   `yaml:"binary,omitempty"`
+	Allowed []string `yaml:"allowed,omitempty"`
+}
+
+// SecretProvidersConfig is the root of the secret providers file. Allowed, per provider, lists
+// path.Match patterns the referenced paths must match (empty = any); $APP in a pattern stands for
+// the ID of the app whose run resolves the reference.
+type SecretProvidersConfig struct {
+	Vault *VaultProvider             `yaml:"vault,omitempty"`
+	AWSSM *AWSSecretsManagerProvider `yaml:"aws_secrets_manager,omitempty"`
+	SOPS  *SOPSProvider              `yaml:"sops,omitempty"`
+}
+
+// Schemes returns the reference schemes of the configured providers.
+func (c SecretProvidersConfig) Schemes() []string {
+	var schemes []string
+	if c.Vault != nil {
+		schemes = append(schemes, SecretSchemeVault)
+	}
+	if c.AWSSM != nil {
+		schemes = append(schemes, SecretSchemeAWSSM)
+	}
+	if c.SOPS != nil {
+		schemes = append(schemes, SecretSchemeSOPS)
+	}
+	return schemes
+}
+
+// LoadSecretProviders reads and validates the secret providers file at path.
+func LoadSecretProviders(path string) (SecretProvidersConfig, error) {
+	var cfg SecretProvidersConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Vault != nil {
+		if err := cfg.Vault.init(); err != nil {
+			return cfg, fmt.Errorf("%s: vault: %w", path, err)
+		}
+	}
+	if cfg.AWSSM != nil {
+		if err := cfg.AWSSM.init(); err != nil {
+			return cfg, fmt.Errorf("%s: aws_secrets_manager: %w", path, err)
+		}
+	}
+	if cfg.SOPS != nil {
+		if err := cfg.SOPS.init(); err != nil {
+			return cfg, fmt.Errorf("%s: sops: %w", path, err)
+		}
+	}
+	if len(cfg.Schemes()) == 0 {
+		return cfg, fmt.Errorf("%s: no secret provider configured", path)
+	}
+	return cfg, nil
+}
+
+func (v *VaultProvider) init() error {
+	v.Address = strings.TrimRight(strings.TrimSpace(v.Address), "/")
+	if err := checkHTTPURL(v.Address); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	switch v.KVVersion {
+	case 0:
+		v.KVVersion = 2
+	case 1, 2:
+	default:
+		return errors.New("kv_version must be 1 or 2")
+	}
+	switch v.Auth {
+	case VaultAuthToken:
+		if v.TokenEnv == "" {
+			v.TokenEnv = "VAULT_TOKEN"
+		}
+	case VaultAuthAppRole:
+		if v.RoleID == "" || v.SecretIDFile == "" {
+			return errors.New("approle auth requires role_id and secret_id_file")
+		}
+		if v.Mount == "" {
+			v.Mount = "approle"
+		}
+	case VaultAuthKubernetes:
+		if v.Role == "" {
+			return errors.New("kubernetes auth requires role")
+		}
+		if v.JWTFile == "" {
+			v.JWTFile = DefaultKubernetesTokenFile
+		}
+		if v.Mount == "" {
+			v.Mount = "kubernetes"
+		}
+	default:
+		return fmt.Errorf("auth must be %s, %s, or %s", VaultAuthToken, VaultAuthAppRole, VaultAuthKubernetes)
+	}
+	v.Mount = strings.Trim(v.Mount, "/")
+	return checkPatterns("allowed", v.Allowed)
+}
+
+func (a *AWSSecretsManagerProvider) init() error {
+	a.Region = strings.TrimSpace(a.Region)
+	if a.Region == "" {
+		return errors.New("region is required")
+	}
+	for name, u := range map[string]*string{"endpoint": &a.Endpoint, "sts_endpoint": &a.STSEndpoint} {
+		*u = strings.TrimRight(strings.TrimSpace(*u), "/")
+		if *u == "" {
+			continue
+		}
+		if err := checkHTTPURL(*u); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return checkPatterns("allowed", a.Allowed)
+}
+
+func (s *SOPSProvider) init() error {
+	if strings.TrimSpace(s.Dir) == "" {
+		return errors.New("dir is required")
+	}
+	if s.Binary == "" {
+		s.Binary = "sops"
+	}
+	return checkPatterns("allowed", s.Allowed)
+}
+
+func checkHTTPURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an http or https URL")
+	}
+	return nil
+}
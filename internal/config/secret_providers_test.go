@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSecretProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret_providers.yaml")
+	content := `
+vault:
+  address: https://vault.example.com/
+  auth: kubernetes
+  role: noppflow
+  allowed: [kv/ci/*]
+aws_secrets_manager:
+  region: eu-west-1
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadSecretProviders(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cfg.Schemes(), ","); got != "vault,aws-sm" {
+		t.Fatalf("unexpected schemes %q", got)
+	}
+	v := cfg.Vault
+	if v.Address != "https://vault.example.com" || v.KVVersion != 2 || v.Mount != "kubernetes" || v.JWTFile != DefaultKubernetesTokenFile {
+		t.Fatalf("unexpected vault defaults %+v", v)
+	}
+
+	bad := map[string]string{
+		"": "no secret provider",
+		"vault:\n  address: vault:8200\n  auth: token\n":                 "http or https",
+		"vault:\n  address: https://v\n  auth: ldap\n":                   "auth must be",
+		"vault:\n  address: https://v\n  auth: approle\n  role_id: r\n":  "secret_id_file",
+		"vault:\n  address: https://v\n  auth: token\n  kv_version: 3\n": "kv_version",
+		"aws_secrets_manager:\n  endpoint: https://sm\n":                 "region is required",
+		"sops:\n  binary: sops\n":                                        "dir is required",
+		"sops:\n  dir: /s\n  allowed: ['[']\n":                           "allowed pattern",
+		"gcp:\n  project: x\n":                                           "field gcp not found",
+	}
+	for content, want := range bad {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSecretProviders(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadSecretProviders(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
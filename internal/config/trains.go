@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TrainStage is one step of a release train: runs of all its Apps start together, and the next
+// stage starts once all of them succeeded.
+type TrainStage struct {
+	Name string   `yaml:"name,omitempty" json:"name,omitempty"`
+	Apps []string `yaml:"apps" json:"apps"`
+}
+
+// Train is a release train: Stages run in order, the apps of a stage in parallel, and the train
+// fails at the first stage with a failed run. Params are the shared parameters passed to every
+// run as env vars, with their default values; a parameter without a default must be given when
+// the train is started.
+type Train struct {
+	Name        string            `yaml:"name" json:"name"`
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Params      map[string]string `yaml:"params,omitempty" json:"params,omitempty"`
+	Stages      []TrainStage      `yaml:"stages" json:"stages"`
+}
+
+// TrainsConfig is the root of the release trains file.
+type TrainsConfig struct {
+	Trains []Train `yaml:"trains"`
+}
+
+var (
+	trainNamePattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,99}$`)
+	trainParamPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// LoadTrains reads and validates the release trains file at path. Whether the apps exist is
+// checked when a train starts.
+func LoadTrains(path string) (TrainsConfig, error) {
+	var cfg TrainsConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool, len(cfg.Trains))
+	for i := range cfg.Trains {
+		t := &cfg.Trains[i]
+		if err := t.init(); err != nil {
+			return cfg, fmt.Errorf("%s: train %d: %w", path, i+1, err)
+		}
+		if seen[t.Name] {
+			return cfg, fmt.Errorf("%s: duplicate train %q", path, t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return cfg, nil
+}
+
+// init checks the train and names unnamed stages ("stage 1", ...).
+func (t *Train) init() error {
+	t.Name = strings.TrimSpace(t.Name)
+	if !trainNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("name %q must be lowercase letters, digits, '.', '_' or '-'", t.Name)
+	}
+	for name := range t.Params {
+		if !trainParamPattern.MatchString(name) || strings.HasPrefix(name, "NOPPFLOW_") {
+			return fmt.Errorf("%s: invalid param name %q", t.Name, name)
+		}
+	}
+	if len(t.Stages) == 0 {
+		return fmt.Errorf("%s: needs at least one stage", t.Name)
+	}
+	apps := make(map[string]bool)
+	for i := range t.Stages {
+		stage := &t.Stages[i]
+		stage.Name = strings.TrimSpace(stage.Name)
+		if stage.Name == "" {
+			stage.Name = fmt.Sprintf("stage %d", i+1)
+		}
+		if len(stage.Apps) == 0 {
+			return fmt.Errorf("%s: %s has no apps", t.Name, stage.Name)
+		}
+		for j, app := range stage.Apps {
+			app = strings.TrimSpace(app)
+			if app == "" {
+				return fmt.Errorf("%s: %s has an empty app", t.Name, stage.Name)
+			}
+			if apps[app] {
+				return fmt.Errorf("%s: app %s appears more than once", t.Name, app)
+			}
+			apps[app] = true
+			stage.Apps[j] = app
+		}
+	}
+	return nil
+}
+
+// AppIDs returns the apps of all stages in order.
+func (t Train) AppIDs() []string {
+	var ids []string
+	for _, stage := range t.Stages {
+		ids = append(ids, stage.Apps...)
+	}
+	return ids
+}
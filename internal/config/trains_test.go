@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTrains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trains.yaml")
+	content := `
+trains:
+  - name: platform
+    params: {VERSION: ""}
+    stages:
+      - apps: [db]
+      - name: services
+        apps: [" api ", billing]
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadTrains(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Trains) != 1 {
+		t.Fatalf("expected one train, got %+v", cfg.Trains)
+	}
+	train := cfg.Trains[0]
+	if train.Stages[0].Name != "stage 1" || train.Stages[1].Name != "services" {
+		t.Fatalf("unexpected stage names %+v", train.Stages)
+	}
+	if got := strings.Join(train.AppIDs(), ","); got != "db,api,billing" {
+		t.Fatalf("AppIDs() = %s", got)
+	}
+
+	bad := map[string]string{
+		"trains:\n  - name: Platform\n    stages: [{apps: [a]}]\n":                                  "must be lowercase",
+		"trains:\n  - name: x\n":                                                                    "needs at least one stage",
+		"trains:\n  - name: x\n    stages: [{apps: []}]\n":                                          "stage 1 has no apps",
+		"trains:\n  - name: x\n    stages: [{apps: [a]}, {apps: [a]}]\n":                            "app a appears more than once",
+		"trains:\n  - name: x\n    params: {NOPPFLOW_X: y}\n    stages: [{apps: [a]}]\n":            "invalid param name",
+		"trains:\n  - name: x\n    stages: [{apps: [a]}]\n  - name: x\n    stages: [{apps: [b]}]\n": "duplicate train",
+		"trains:\n  - name: x\n    stage: []\n":                                                     "field stage not found",
+	}
+	for content, want := range bad {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTrains(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadTrains(%q): expected error containing %q, got %v", content, want, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeAppsConfig decodes apps.yaml strictly. Unknown keys are rejected, except top-level keys
+// starting with "x-" which may hold YAML anchors. Duplicate app IDs and steps that do not define
+// exactly one execution mode are reported with their line numbers; all problems are returned at once.
+func decodeAppsConfig(data []byte) (AppsConfig, error) {
+	var cfg AppsConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return AppsConfig{}, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return AppsConfig{}, err
+	}
+	top := root.Content
+	var doc *yaml.Node
+	if len(top) > 0 {
+		doc = top[0]
+	}
+
+	var problems []error
+	for key := range cfg.Extensions {
+		if !strings.HasPrefix(key, "x-") {
+			problems = append(problems, fmt.Errorf("line %d: unknown top-level key %q (use an \"x-\" prefix for anchor blocks)", keyLine(doc, key), key))
+		}
+	}
+	appNodes := sequenceItems(mappingValue(doc, "apps"))
+	firstLine := make(map[string]int, len(cfg.Apps))
+	for i, app := range cfg.Apps {
+		var appNode *yaml.Node
+		if i < len(appNodes) {
+			appNode = appNodes[i]
+		}
+		line := nodeLine(appNode)
+		id := strings.TrimSpace(app.ID)
+		if id != "" {
+			if first, ok := firstLine[id]; ok {
+				problems = append(problems, fmt.Errorf("line %d: duplicate app id %q (first defined on line %d)", line, id, first))
+			} else {
+				firstLine[id] = line
+			}
+		}
+		label := id
+		if label == "" {
+			label = app.Name
+		}
+		problems = append(problems, invalidSteps(label, "step", app.Steps, mappingValue(appNode, "steps"), line)...)
+		if app.Post != nil {
+			postNode := mappingValue(appNode, "post")
+			problems = append(problems, invalidSteps(label, "on_success step", app.Post.OnSuccess, mappingValue(postNode, "on_success"), line)...)
+			problems = append(problems, invalidSteps(label, "on_failure step", app.Post.OnFailure, mappingValue(postNode, "on_failure"), line)...)
+			problems = append(problems, invalidSteps(label, "always step", app.Post.Always, mappingValue(postNode, "always"), line)...)
+		}
+	}
+	return cfg, errors.Join(problems...)
+}
+
+// invalidSteps reports steps that do not define exactly one execution mode (see Step.Kind).
+// fallbackLine is used when the step node cannot be located (e.g. it comes from a merge key).
+func invalidSteps(app, what string, steps []Step, seq *yaml.Node, fallbackLine int) []error {
+	items := sequenceItems(seq)
+	var problems []error
+	for i, step := range steps {
+		if step.Kind() != "" {
+			continue
+		}
+		line := fallbackLine
+		if i < len(items) {
+			line = nodeLine(items[i])
+		}
+		problems = append(problems, fmt.Errorf("line %d: app %q %s %d: must define exactly one of cmd, file, script, k8s_deploy, terraform, ansible, db_migrate, scan, wait_for, sign", line, app, what, i+1))
+	}
+	return problems
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+// mappingValue returns the value node for key in mapping node n, or nil.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	n = resolveAlias(n)
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return resolveAlias(n.Content[i+1])
+		}
+	}
+	return nil
+}
+
+func keyLine(n *yaml.Node, key string) int {
+	n = resolveAlias(n)
+	if n == nil || n.Kind != yaml.MappingNode {
+		return 0
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i].Line
+		}
+	}
+	return 0
+}
+
+func sequenceItems(n *yaml.Node) []*yaml.Node {
+	n = resolveAlias(n)
+	if n == nil || n.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return n.Content
+}
+
+func nodeLine(n *yaml.Node) int {
+	if n == nil {
+		return 0
+	}
+	return n.Line
+}
@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ansiPattern matches ANSI escape sequences: CSI (colors, cursor moves), OSC (titles, links), and
+// two-byte escapes.
+var ansiPattern = regexp.MustCompile("\x1b(?:\\[[0-?]*[ -/]*[@-~]|\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|[@-Z\\\\-_])")
+
+// ColorEnv forces color output from common tools even though step output is not a terminal.
+// Applied to runs of apps with log_color enabled; app, step, or global env vars win.
+var ColorEnv = map[string]string{
+	"FORCE_COLOR":    "1",
+	"CLICOLOR_FORCE": "1",
+	"TERM":           "xterm-256color",
+}
+
+// WithColorEnv returns env with ColorEnv entries added for names env does not define.
+func WithColorEnv(env map[string]string) map[string]string {
+	out := make(map[string]string, len(env)+len(ColorEnv))
+	for k, v := range ColorEnv {
+		out[k] = v
+	}
+	for k, v := range env {
+		out[k] = v
+	}
+	return out
+}
+
+// HasANSI reports whether s contains ANSI escape sequences.
+func HasANSI(s string) bool {
+	return strings.IndexByte(s, 0x1b) >= 0 && ansiPattern.MatchString(s)
+}
+
+// StripANSI removes ANSI escape sequences from s (plain-text log view and downloads).
+func StripANSI(s string) string {
+	if strings.IndexByte(s, 0x1b) < 0 {
+		return s
+	}
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+// LogChunk is the part of a run log written by one step (Step is empty for the clone/setup part
+// before the first step). Line numbers are 1-based and inclusive; ANSI tells whether the chunk
+// contains escape sequences and should be rendered as colored output.
+type LogChunk struct {
+	Step      string `json:"step,omitempty"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	ANSI      bool   `json:"ansi"`
+}
+
+// SplitLogChunks splits a run log at "=== Step: name ===" headers.
+func SplitLogChunks(log string) []LogChunk {
+	chunks := make([]LogChunk, 0)
+	if log == "" {
+		return chunks
+	}
+	lines := strings.Split(strings.TrimSuffix(log, "\n"), "\n")
+	current := LogChunk{StartLine: 1}
+	for i, line := range lines {
+		if name, ok := stepHeader(strings.TrimSpace(stripLineTimestamp(line))); ok {
+			if i > 0 {
+				current.EndLine = i
+				chunks = append(chunks, current)
+			}
+			current = LogChunk{Step: name, StartLine: i + 1}
+		}
+		if !current.ANSI && HasANSI(line) {
+			current.ANSI = true
+		}
+	}
+	current.EndLine = len(lines)
+	return append(chunks, current)
+}
@@ -0,0 +1,36 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// AnsibleScript returns the shell script of an ansible step, run in the step's workdir. With
+// vault_password_env the password is read from that env var into a temporary file passed as
+// --vault-password-file, so it never appears on a command line. Also used in Kubernetes Job scripts.
+func AnsibleScript(step config.Step) string {
+	a := step.Ansible
+	args := []string{"ansible-playbook"}
+	if a.Inventory != "" {
+		args = append(args, "-i", shellQuote(a.Inventory))
+	}
+	if len(a.ExtraVars) > 0 {
+		vars, _ := json.Marshal(a.ExtraVars)
+		args = append(args, "--extra-vars", shellQuote(string(vars)))
+	}
+	lines := []string{"set -eu"}
+	if a.VaultPasswordEnv != "" {
+		lines = append(lines,
+			`noppflow_vault="$(mktemp)"`,
+			`trap 'rm -f "$noppflow_vault"' EXIT`,
+			fmt.Sprintf(`printf '%%s\n' "${%s:?%s}" > "$noppflow_vault"`, a.VaultPasswordEnv, "vault_password_env "+a.VaultPasswordEnv+" is not set"),
+		)
+		args = append(args, `--vault-password-file "$noppflow_vault"`)
+	}
+	args = append(args, shellQuote(a.Playbook))
+	lines = append(lines, strings.Join(args, " "))
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+)
+
+// maxArtifactsPerStep bounds how many files one step can collect.
+const maxArtifactsPerStep = 500
+
+// Artifact is a file produced by a step, collected after the step succeeded.
+// Name is its slash-separated path relative to the repository root; Path is the local file.
+type Artifact struct {
+	Step string
+	Name string
+	Path string
+	Size int64
+}
+
+// collectArtifacts resolves the step's artifacts patterns in repoDir. Directories are collected
+// recursively. It returns the files (sorted by name) and the patterns that matched nothing.
+func collectArtifacts(repoDir, stepName string, patterns []string) ([]Artifact, []string) {
+	seen := map[string]bool{}
+	var out []Artifact
+	var unmatched []string
+	add := func(path string, info fs.FileInfo) {
+		rel, err := filepath.Rel(repoDir, path)
+		if err != nil || seen[rel] || !info.Mode().IsRegular() || len(out) >= maxArtifactsPerStep {
+			return
+		}
+		seen[rel] = true
+		out = append(out, Artifact{Step: stepName, Name: filepath.ToSlash(rel), Path: path, Size: info.Size()})
+	}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(repoDir, filepath.FromSlash(pattern)))
+		before := len(out)
+		for _, match := range matches {
+			_ = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return nil
+				}
+				if info, err := d.Info(); err == nil {
+					add(path, info)
+				}
+				return nil
+			})
+		}
+		if len(out) == before {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, unmatched
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"noppflow/internal/config"
+)
+
+// checkout clones the app repository into dir, or pulls when it is already cloned,
+// then applies the app's sparse checkout, submodule, and LFS options.
+// Mirror cache problems are logged through logf and never fail the checkout.
+func (r *Runner) checkout(ctx context.Context, env []string, dir string, app config.App, logf func(format string, args ...interface{})) error {
+	reference := ""
+	if r.mirrorCache {
+		mirror, err := r.updateMirror(ctx, env, app.Repo)
+		if err != nil {
+			logf("mirror cache: %v (cloning directly)", err)
+		} else {
+			reference = mirror
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("mkdir app dir: %w", err)
+		}
+		args := cloneArgs(app, ".")
+		if reference != "" {
+			args = append([]string{args[0], "--reference-if-able", reference}, args[1:]...)
+		}
+		if err := r.runCmd(ctx, env, dir, "git", args...); err != nil {
+			return fmt.Errorf("git clone: %w", err)
+		}
+		if len(app.SparsePaths) > 0 {
+			if err := r.runCmd(ctx, env, dir, "git", sparseSetArgs(app.SparsePaths)...); err != nil {
+				return fmt.Errorf("git sparse-checkout: %w", err)
+			}
+		}
+	} else {
+		if len(app.SparsePaths) > 0 {
+			if err := r.runCmd(ctx, env, dir, "git", sparseSetArgs(app.SparsePaths)...); err != nil {
+				return fmt.Errorf("git sparse-checkout: %w", err)
+			}
+		} else if sparse, _ := r.output(env, dir, "git", "config", "--bool", "core.sparseCheckout"); strings.TrimSpace(sparse) == "true" {
+			if err := r.runCmd(ctx, env, dir, "git", "sparse-checkout", "disable"); err != nil {
+				return fmt.Errorf("git sparse-checkout disable: %w", err)
+			}
+		}
+		if err := r.runCmd(ctx, env, dir, "git", "pull", "origin", app.Branch); err != nil {
+			return fmt.Errorf("git pull: %w", err)
+		}
+	}
+
+	if app.GitSubmodules {
+		if err := r.runCmd(ctx, env, dir, "git", "submodule", "sync", "--recursive"); err != nil {
+			return fmt.Errorf("git submodule sync: %w", err)
+		}
+		if err := r.runCmd(ctx, env, dir, "git", "submodule", "update", "--init", "--recursive"); err != nil {
+			return fmt.Errorf("git submodule update: %w", err)
+		}
+	}
+	if app.GitLFS {
+		if err := r.runCmd(ctx, env, dir, "git", "lfs", "pull"); err != nil {
+			return fmt.Errorf("git lfs pull: %w", err)
+		}
+		if app.GitSubmodules {
+			if err := r.runCmd(ctx, env, dir, "git", "submodule", "foreach", "--recursive", "git lfs pull"); err != nil {
+				return fmt.Errorf("git lfs pull (submodules): %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// mirrorDir returns the bare mirror path for a remote URL.
+func (r *Runner) mirrorDir(repo string) string {
+	sum := sha256.Sum256([]byte(repo))
+	return filepath.Join(r.workDir, ".mirrors", hex.EncodeToString(sum[:8])+".git")
+}
+
+// mirrorLock returns the mutex serializing access to one mirror directory.
+func (r *Runner) mirrorLock(dir string) *sync.Mutex {
+	r.mirrorMu.Lock()
+	defer r.mirrorMu.Unlock()
+	mu, ok := r.mirrorLocks[dir]
+	if !ok {
+		mu = &sync.Mutex{}
+		r.mirrorLocks[dir] = mu
+	}
+	return mu
+}
+
+// updateMirror creates or fetches the bare mirror for repo and returns its path.
+// Automatic gc is disabled in mirrors because app clones borrow their objects via alternates.
+func (r *Runner) updateMirror(ctx context.Context, env []string, repo string) (string, error) {
+	dir := r.mirrorDir(repo)
+	mu := r.mirrorLock(dir)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return "", fmt.Errorf("mkdir mirrors dir: %w", err)
+		}
+		if err := r.runCmd(ctx, env, filepath.Dir(dir), "git", "clone", "--mirror", repo, dir); err != nil {
+			_ = os.RemoveAll(dir)
+			return "", fmt.Errorf("git clone --mirror: %w", err)
+		}
+		if err := r.runCmd(ctx, env, dir, "git", "config", "gc.auto", "0"); err != nil {
+			return "", fmt.Errorf("git config: %w", err)
+		}
+		return dir, nil
+	}
+	if err := r.runCmd(ctx, env, dir, "git", "fetch", "--prune", "origin"); err != nil {
+		return "", fmt.Errorf("git fetch mirror: %w", err)
+	}
+	return dir, nil
+}
+
+// cloneArgs returns the git arguments to clone app into dest.
+// GIT_SSH_COMMAND from the environment is also used for submodule fetches.
+// With sparse paths, the clone is partial (no blobs up front) and starts with only top-level files.
+func cloneArgs(app config.App, dest string) []string {
+	args := []string{"clone", "--branch", app.Branch, "--single-branch"}
+	if len(app.SparsePaths) > 0 {
+		args = append(args, "--filter=blob:none", "--sparse")
+	}
+	if app.GitSubmodules {
+		args = append(args, "--recurse-submodules")
+	}
+	return append(args, app.Repo, dest)
+}
+
+// sparseSetArgs returns the git arguments to limit the checkout to paths (cone mode).
+func sparseSetArgs(paths []string) []string {
+	return append([]string{"sparse-checkout", "set", "--cone", "--"}, paths...)
+}
@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+)
+
+var commitSHAPattern = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// ParseCommitLine returns the commit a run checked out, from the "commit: <sha>" line written
+// after the checkout. ok is false when the log has no such line (e.g. the checkout failed).
+func ParseCommitLine(log string) (sha string, ok bool) {
+	for _, raw := range strings.Split(log, "\n") {
+		rest, found := strings.CutPrefix(strings.TrimSpace(stripLineTimestamp(raw)), "commit: ")
+		if !found {
+			continue
+		}
+		sha = strings.TrimSpace(rest)
+		return sha, commitSHAPattern.MatchString(sha)
+	}
+	return "", false
+}
+
+// ParseCommitSubject returns the subject of the commit a run checked out, from the
+// "subject: <subject>" line written after the commit line, or "" when the log has none.
+func ParseCommitSubject(log string) string {
+	for _, raw := range strings.Split(log, "\n") {
+		if rest, found := strings.CutPrefix(strings.TrimSpace(stripLineTimestamp(raw)), "subject: "); found {
+			return strings.TrimSpace(rest)
+		}
+	}
+	return ""
+}
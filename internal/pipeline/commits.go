@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// Commit is a commit of an app's branch listed by RecentCommits.
+type Commit struct {
+	SHA         string    `json:"sha"`
+	Subject     string    `json:"subject"`
+	Author      string    `json:"author"`
+	AuthorEmail string    `json:"author_email"`
+	Time        time.Time `json:"time"`
+}
+
+// Commit sources reported by RecentCommits.
+const (
+	CommitsFromWorkspace = "workspace"
+	CommitsFromFetch     = "fetch"
+)
+
+// commitLogFormat separates the fields of a commit with the unit separator.
+const commitLogFormat = "--format=%H%x1f%an%x1f%ae%x1f%aI%x1f%s"
+
+// RecentCommits returns up to limit commits of the app's branch, newest first, and where they
+// were read from. The branch head is resolved with git ls-remote; its history comes from the
+// app's workspace when that already has the head commit, or else from a shallow fetch of the
+// branch into a per-app cache under the work dir. gitSSHCommand, when set, is used for the
+// remote calls.
+func (r *Runner) RecentCommits(ctx context.Context, app config.App, gitSSHCommand string, limit int) ([]Commit, string, error) {
+	var env []string
+	if strings.TrimSpace(gitSSHCommand) != "" {
+		env = append(os.Environ(), "GIT_SSH_COMMAND="+gitSSHCommand)
+	}
+	out, err := gitOutput(ctx, env, "", "ls-remote", app.Repo, "refs/heads/"+app.Branch)
+	if err != nil {
+		return nil, "", fmt.Errorf("git ls-remote: %w", err)
+	}
+	head, _, _ := strings.Cut(strings.TrimSpace(out), "\t")
+	if !commitSHAPattern.MatchString(head) {
+		return nil, "", fmt.Errorf("branch %s not found in %s", app.Branch, app.Repo)
+	}
+
+	workspace := r.WorkspaceDir(app.ID)
+	if _, err := os.Stat(filepath.Join(workspace, ".git")); err == nil {
+		if _, err := gitOutput(ctx, nil, workspace, "cat-file", "-e", head+"^{commit}"); err == nil {
+			commits, err := logCommits(ctx, workspace, head, limit)
+			return commits, CommitsFromWorkspace, err
+		}
+	}
+
+	cache := filepath.Join(r.workDir, ".commits", app.ID+".git")
+	mu := r.mirrorLock(cache)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := os.Stat(filepath.Join(cache, "HEAD")); err != nil {
+		if err := os.MkdirAll(cache, 0755); err != nil {
+			return nil, "", fmt.Errorf("mkdir commits cache: %w", err)
+		}
+		if _, err := gitOutput(ctx, nil, cache, "init", "-q", "--bare"); err != nil {
+			return nil, "", fmt.Errorf("git init: %w", err)
+		}
+	}
+	ref := "refs/heads/" + app.Branch
+	if _, err := gitOutput(ctx, env, cache, "fetch", "-q", "--no-tags", fmt.Sprintf("--depth=%d", limit), app.Repo, "+"+ref+":"+ref); err != nil {
+		return nil, "", fmt.Errorf("git fetch: %w", err)
+	}
+	commits, err := logCommits(ctx, cache, ref, limit)
+	return commits, CommitsFromFetch, err
+}
+
+// logCommits reads up to limit commits from rev in the repository at dir.
+func logCommits(ctx context.Context, dir, rev string, limit int) ([]Commit, error) {
+	out, err := gitOutput(ctx, nil, dir, "log", fmt.Sprintf("--max-count=%d", limit), commitLogFormat, rev)
+	if err != nil {
+		return nil, fmt.Errorf("git log: %w", err)
+	}
+	commits := make([]Commit, 0, limit)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 5 {
+			continue
+		}
+		c := Commit{SHA: fields[0], Author: fields[1], AuthorEmail: fields[2], Subject: fields[4]}
+		c.Time, _ = time.Parse(time.RFC3339, fields[3])
+		commits = append(commits, c)
+	}
+	return commits, nil
+}
+
+// gitOutput runs git in dir and returns its stdout; the error includes stderr.
+func gitOutput(ctx context.Context, env []string, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = env
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
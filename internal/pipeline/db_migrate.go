@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// DatabaseLocker blocks until the database lock named key is held, returning its release func,
+// or until ctx ends.
+type DatabaseLocker func(ctx context.Context, step, key string) (release func(), err error)
+
+// runDBMigrateWithLog applies the migrations of a db_migrate step in dir while holding the lock of
+// its database (when lock is set). The DSN is handed to goose and flyway through their env vars
+// so it stays off their command lines.
+func (r *Runner) runDBMigrateWithLog(ctx context.Context, env []string, dir string, step config.Step, lock DatabaseLocker, log io.Writer, usage *StepUsage) error {
+	m := *step.DBMigrate
+	dsn := envLookup(env)(m.DSNEnv)
+	if dsn == "" {
+		return fmt.Errorf("dsn_env %s is not set", m.DSNEnv)
+	}
+	migrations := m.Dir
+	if migrations == "" {
+		migrations = "migrations"
+	}
+	var args, toolEnv []string
+	switch m.Tool {
+	case "goose":
+		toolEnv = []string{"GOOSE_DRIVER=" + m.Driver, "GOOSE_DBSTRING=" + dsn, "GOOSE_MIGRATION_DIR=" + migrations}
+		args = []string{"up"}
+	case "flyway":
+		toolEnv = []string{"FLYWAY_URL=" + dsn, "FLYWAY_LOCATIONS=filesystem:" + migrations}
+		args = []string{"migrate"}
+	case "atlas":
+		args = []string{"migrate", "apply", "--dir", "file://" + migrations, "--url", dsn}
+	default:
+		return fmt.Errorf("unsupported db_migrate tool %q", m.Tool)
+	}
+	if lock != nil {
+		key := m.LockKey
+		if key == "" {
+			key = DatabaseLockKey(dsn)
+		}
+		release, err := lock(ctx, step.Name, key)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	fmt.Fprintf(log, "%s: migrating with %s (%s)\n", step.Name, m.Tool, migrations)
+	cmd := exec.CommandContext(ctx, m.Tool, args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), env...), toolEnv...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	return r.runSampled(cmd, usage)
+}
+
+// DatabaseLockKey identifies the database of a DSN without its credentials and options: host,
+// port, and database of URLs (including JDBC URLs) and of user:pass@tcp(host)/db DSNs. Other DSNs
+// are used whole.
+func DatabaseLockKey(dsn string) string {
+	s := strings.TrimPrefix(strings.TrimSpace(dsn), "jdbc:")
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		return strings.ToLower(u.Host[strings.LastIndex(u.Host, "@")+1:]) + u.Path
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s = s[i+1:]
+	}
+	s, _, _ = strings.Cut(s, "?")
+	return s
+}
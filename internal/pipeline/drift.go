@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+)
+
+// appliedResourcePattern matches a line of `kubectl apply` output, e.g.
+// "deployment.apps/web configured". Dry runs add a suffix and do not match.
+var appliedResourcePattern = regexp.MustCompile(`^([a-z0-9][a-z0-9.-]*/[a-z0-9][a-z0-9.:-]*) (created|configured|unchanged|serverside-applied)$`)
+
+// ParseAppliedResources returns the resources `kubectl apply` reports in the output of the steps
+// named in steps, as kind[.group]/name, in order of appearance and without duplicates.
+func ParseAppliedResources(log string, steps map[string]bool) []string {
+	out := make([]string, 0)
+	seen := make(map[string]bool)
+	step := ""
+	for _, raw := range strings.Split(log, "\n") {
+		line := strings.TrimSpace(stripLineTimestamp(raw))
+		if name, ok := stepHeader(line); ok {
+			step = name
+			continue
+		}
+		if !steps[step] {
+			continue
+		}
+		if m := appliedResourcePattern.FindStringSubmatch(line); m != nil && !seen[m[1]] {
+			seen[m[1]] = true
+			out = append(out, m[1])
+		}
+	}
+	return out
+}
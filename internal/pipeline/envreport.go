@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// EnvReportTool is one tool whose version is recorded by the environment report.
+type EnvReportTool struct {
+	Name string
+	Args []string
+}
+
+// EnvReportTools lists the tools probed by the environment report, in log order.
+var EnvReportTools = []EnvReportTool{
+	{Name: "git", Args: []string{"--version"}},
+	{Name: "go", Args: []string{"version"}},
+	{Name: "node", Args: []string{"--version"}},
+	{Name: "docker", Args: []string{"--version"}},
+	{Name: "kubectl", Args: []string{"version", "--client"}},
+	{Name: "helm", Args: []string{"version", "--short"}},
+}
+
+// envReportToolTimeout bounds each version probe so a hanging tool cannot stall the run.
+const envReportToolTimeout = 10 * time.Second
+
+// writeEnvReport records OS, tool versions, disk, and memory information into log.
+func (r *Runner) writeEnvReport(ctx context.Context, env []string, dir string, log io.Writer) {
+	fmt.Fprintf(log, "os: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	if host, err := os.Hostname(); err == nil {
+		fmt.Fprintf(log, "hostname: %s\n", host)
+	}
+	if out, err := probeOutput(ctx, env, dir, "uname", "-a"); err == nil {
+		fmt.Fprintf(log, "kernel: %s\n", out)
+	}
+	for _, tool := range EnvReportTools {
+		out, err := probeOutput(ctx, env, dir, tool.Name, tool.Args...)
+		if err != nil {
+			fmt.Fprintf(log, "%s: not available\n", tool.Name)
+			continue
+		}
+		fmt.Fprintf(log, "%s: %s\n", tool.Name, strings.ReplaceAll(out, "\n", " | "))
+	}
+	if out, err := probeOutput(ctx, env, dir, "df", "-h", "."); err == nil {
+		fmt.Fprintf(log, "disk:\n%s\n", out)
+	}
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "MemTotal:") || strings.HasPrefix(line, "MemAvailable:") {
+				fmt.Fprintf(log, "memory: %s\n", strings.Join(strings.Fields(line), " "))
+			}
+		}
+	}
+	fmt.Fprintf(log, "cpus: %d\n", runtime.NumCPU())
+}
+
+func probeOutput(ctx context.Context, env []string, dir, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, envReportToolTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// GitOpsRepoPath splits a GitOps repository URL (scp-like git@host:org/repo.git, ssh:// or
+// https://) into its host and repository path without the .git suffix.
+func GitOpsRepoPath(repo string) (host, path string, ok bool) {
+	repo = strings.TrimSpace(repo)
+	if u, err := url.Parse(repo); err == nil && u.Scheme != "" && u.Host != "" {
+		host, path = u.Hostname(), u.Path
+	} else if at, rest, found := strings.Cut(repo, "@"); found && !strings.Contains(at, "/") {
+		host, path, ok = strings.Cut(rest, ":")
+		if !ok {
+			return "", "", false
+		}
+	} else {
+		return "", "", false
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || !strings.Contains(path, "/") {
+		return "", "", false
+	}
+	return host, path, true
+}
+
+var gitOpsRegexMeta = regexp.MustCompile(`[\\.\[\]*^$+?(){}|#]`)
+
+// GitOpsScript returns the shell script of a k8s_deploy step with deploy_mode gitops. Run in the
+// app checkout with GIT_SSH_COMMAND set for the GitOps repo, it clones the repo, rewrites every
+// gitops_image reference (with any tag or digest) in gitops_path to NOPPFLOW_IMAGE, or to
+// gitops_image tagged with the checked out commit when unset, and commits the change. It then
+// pushes to gitops_branch (rebasing up to three times on concurrent pushes) or, with gitops_pr,
+// pushes a branch and opens a pull/merge request using the GITOPS_TOKEN env var.
+func GitOpsScript(app config.App) string {
+	branch := app.GitOpsBranch
+	if branch == "" {
+		branch = "main"
+	}
+	notID := `[^A-Za-z0-9_./-]`
+	pattern := "(^|" + notID + ")" + gitOpsRegexMeta.ReplaceAllString(app.GitOpsImage, `\$0`) +
+		`(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?(@sha256:[a-f0-9]{64})?(` + notID + "|$)"
+	path := shellQuote(app.GitOpsPath)
+	lines := []string{
+		"set -eu",
+		`noppflow_ref="${NOPPFLOW_IMAGE:-}"`,
+		fmt.Sprintf(`[ -n "$noppflow_ref" ] || noppflow_ref=%s:"$(git rev-parse HEAD)"`, shellQuote(app.GitOpsImage)),
+		`noppflow_gitops="$(mktemp -d)"`,
+		`trap 'rm -rf "$noppflow_gitops"' EXIT`,
+		fmt.Sprintf(`git clone --branch %s --single-branch %s "$noppflow_gitops"`, shellQuote(branch), shellQuote(app.GitOpsRepo)),
+		`cd "$noppflow_gitops"`,
+		fmt.Sprintf(`[ -f %s ] || { echo %s; exit 1; }`, path, shellQuote("gitops: "+app.GitOpsPath+" not found in "+app.GitOpsRepo)),
+		fmt.Sprintf(`sed -E %s"$noppflow_ref"%s %s > "$noppflow_gitops.new"`, shellQuote("s#"+pattern+`#\1`), shellQuote(`\4#g`), path),
+		fmt.Sprintf(`mv "$noppflow_gitops.new" %s`, path),
+		fmt.Sprintf(`if git diff --quiet; then echo %s"$noppflow_ref"; exit 0; fi`, shellQuote("gitops: "+app.GitOpsPath+" already deploys ")),
+		fmt.Sprintf(`git -c user.name=NoppFlow -c user.email=noppflow@localhost commit -q -am %s"$noppflow_ref"`, shellQuote("Deploy "+app.ID+" ")),
+	}
+	if app.GitOpsPR == "" {
+		lines = append(lines,
+			"noppflow_try=1",
+			fmt.Sprintf(`until git push -q origin HEAD:%s; do`, shellQuote(branch)),
+			`  [ "$noppflow_try" -lt 3 ] || exit 1`,
+			"  noppflow_try=$((noppflow_try + 1))",
+			fmt.Sprintf("  git -c user.name=NoppFlow -c user.email=noppflow@localhost pull -q --rebase origin %s", shellQuote(branch)),
+			"done",
+			fmt.Sprintf(`echo 'gitops: pushed '"$noppflow_ref"%s`, shellQuote(" to "+app.GitOpsRepo+" "+branch)),
+		)
+		return strings.Join(lines, "\n")
+	}
+	lines = append(lines,
+		`: "${GITOPS_TOKEN:?gitops_pr needs the GITOPS_TOKEN env var}"`,
+		fmt.Sprintf(`noppflow_branch=%s"$(date +%%s)"`, shellQuote("noppflow/"+app.ID+"-")),
+		`git push -q origin "HEAD:refs/heads/$noppflow_branch"`,
+	)
+	lines = append(lines, gitOpsPRLines(app, branch)...)
+	lines = append(lines, fmt.Sprintf(`echo 'gitops: opened a pull request from '"$noppflow_branch"%s`, shellQuote(" to "+branch)))
+	return strings.Join(lines, "\n")
+}
+
+// gitOpsPRLines returns the curl call opening the pull (GitHub) or merge (GitLab) request from
+// $noppflow_branch; the JSON body is assembled around the shell variables.
+func gitOpsPRLines(app config.App, base string) []string {
+	host, repoPath, _ := GitOpsRepoPath(app.GitOpsRepo)
+	title := jsonString("Deploy " + app.ID + " ")
+	title = title[:len(title)-1]
+	body := func(head, baseKey, tail string) string {
+		return shellQuote(`{"title":`+title) + `"$noppflow_ref"` + shellQuote(`","`+head+`":"`) + `"$noppflow_branch"` +
+			shellQuote(`","`+baseKey+`":`+jsonString(base)+tail+`}`)
+	}
+	switch app.GitOpsPR {
+	case "gitlab":
+		api := fmt.Sprintf("https://%s/api/v4/projects/%s/merge_requests", host, url.PathEscape(repoPath))
+		return []string{fmt.Sprintf(`curl -fsS -o /dev/null -X POST -H "PRIVATE-TOKEN: $GITOPS_TOKEN" -H 'Content-Type: application/json' -d %s %s`,
+			body("source_branch", "target_branch", `,"remove_source_branch":true`), shellQuote(api))}
+	default:
+		api := fmt.Sprintf("https://%s/api/v3/repos/%s/pulls", host, repoPath)
+		if host == "github.com" {
+			api = fmt.Sprintf("https://api.github.com/repos/%s/pulls", repoPath)
+		}
+		return []string{fmt.Sprintf(`curl -fsS -o /dev/null -X POST -H "Authorization: Bearer $GITOPS_TOKEN" -H 'Accept: application/vnd.github+json' -d %s %s`,
+			body("head", "base", ""), shellQuote(api))}
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
+}
@@ -0,0 +1,35 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+)
+
+var imageDigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ParseImageMarker returns the container image a run built, reported by a step with
+// "::image::registry.example.com/team/app[:tag]@sha256:<hex>" (e.g. from `docker buildx build --metadata-file`).
+// The last valid marker wins; ok is false when the log has none.
+func ParseImageMarker(log string) (image, digest string, ok bool) {
+	for _, raw := range strings.Split(log, "\n") {
+		line := strings.TrimSpace(stripLineTimestamp(raw))
+		rest, found := strings.CutPrefix(line, "::image::")
+		if !found {
+			continue
+		}
+		ref, valid := parseImageDigestRef(strings.TrimSpace(rest))
+		if !valid {
+			continue
+		}
+		image, digest, ok = ref.Image, ref.Digest, true
+	}
+	return image, digest, ok
+}
+
+var imageNamePattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-]+[a-z0-9]+)*)*$`)
+
+// ValidImageName reports whether name is an image repository without tag or digest
+// (e.g. "ghcr.io/acme/api" or "localhost:5000/api").
+func ValidImageName(name string) bool {
+	return name != "" && imageNamePattern.MatchString(name)
+}
@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxIssueCommits bounds how many commits since the previous commit are scanned for issue keys.
+const maxIssueCommits = 100
+
+// maxIssueKeys bounds the issue keys recorded for one run.
+const maxIssueKeys = 50
+
+// issueKeyPattern matches Jira-style issue keys such as PROJ-123.
+var issueKeyPattern = regexp.MustCompile(`\b[A-Z][A-Z0-9_]{1,9}-[1-9][0-9]{0,8}\b`)
+
+// IssueKeys returns the distinct issue keys mentioned in text, in order of first mention.
+func IssueKeys(text string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range issueKeyPattern.FindAllString(text, -1) {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+		if len(keys) == maxIssueKeys {
+			break
+		}
+	}
+	return keys
+}
+
+// ParseIssuesLine returns the issue keys from the "issues: KEY-1, KEY-2" line written after the
+// checkout, or nil when the commits mention none.
+func ParseIssuesLine(log string) []string {
+	for _, raw := range strings.Split(log, "\n") {
+		rest, found := strings.CutPrefix(strings.TrimSpace(stripLineTimestamp(raw)), "issues: ")
+		if found {
+			return IssueKeys(rest)
+		}
+	}
+	return nil
+}
+
+// commitIssueKeys returns the issue keys in the messages of the commits checked out in dir since
+// previous (at most maxIssueCommits), or of HEAD alone when previous is unknown or not an
+// ancestor of HEAD.
+func (r *Runner) commitIssueKeys(env []string, dir, previous string) []string {
+	limit := "--max-count=1"
+	rev := "HEAD"
+	if commitSHAPattern.MatchString(previous) {
+		if _, err := r.output(env, dir, "git", "merge-base", "--is-ancestor", previous, "HEAD"); err == nil {
+			limit = "--max-count=" + strconv.Itoa(maxIssueCommits)
+			rev = previous + "..HEAD"
+		}
+	}
+	messages, err := r.output(env, dir, "git", "log", limit, "--format=%B", rev)
+	if err != nil {
+		return nil
+	}
+	return IssueKeys(messages)
+}
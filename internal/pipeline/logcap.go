@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FullLogArtifactName is the artifact name under which the full log of a truncated run is kept.
+const FullLogArtifactName = "noppflow-full.log"
+
+// cappedLog is the run log buffer. With max > 0 it keeps only the first and last max/2 bytes in
+// memory and writes everything to a spool file, so a runaway step cannot exhaust memory or the
+// database; String then returns head and tail joined by a truncation marker.
+type cappedLog struct {
+	max     int64
+	head    []byte
+	tail    []byte // the last tailCap bytes, possibly preceded by stale bytes (compacted lazily)
+	total   int64
+	spool   *os.File
+	spoolOK bool
+}
+
+func newCappedLog(max int64) *cappedLog {
+	c := &cappedLog{max: max}
+	if max > 0 {
+		if f, err := os.CreateTemp("", "noppflow-log-*.log"); err == nil {
+			c.spool, c.spoolOK = f, true
+		}
+	}
+	return c
+}
+
+func (c *cappedLog) headCap() int { return int(c.max / 2) }
+func (c *cappedLog) tailCap() int { return int(c.max - c.max/2) }
+
+func (c *cappedLog) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	if c.max <= 0 {
+		c.head = append(c.head, p...)
+		return len(p), nil
+	}
+	if c.spoolOK {
+		if _, err := c.spool.Write(p); err != nil {
+			c.spoolOK = false
+		}
+	}
+	rest := p
+	if room := c.headCap() - len(c.head); room > 0 {
+		n := min(room, len(rest))
+		c.head = append(c.head, rest[:n]...)
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		c.tail = append(c.tail, rest...)
+		if len(c.tail) >= 2*c.tailCap() {
+			c.tail = append([]byte(nil), c.tail[len(c.tail)-c.tailCap():]...)
+		}
+	}
+	return len(p), nil
+}
+
+func (c *cappedLog) WriteString(s string) (int, error) { return c.Write([]byte(s)) }
+
+func (c *cappedLog) WriteByte(b byte) error {
+	_, err := c.Write([]byte{b})
+	return err
+}
+
+// Truncated reports whether the log exceeded its cap.
+func (c *cappedLog) Truncated() bool { return c.max > 0 && c.total > c.max }
+
+// String returns the log, with the middle replaced by a marker line once it exceeded the cap.
+// Head and tail are cut at line boundaries.
+func (c *cappedLog) String() string {
+	if !c.Truncated() {
+		return string(c.head) + string(c.tail)
+	}
+	head := c.head
+	if i := bytes.LastIndexByte(head, '\n'); i >= 0 {
+		head = head[:i+1]
+	}
+	tail := c.tail[len(c.tail)-c.tailCap():]
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	where := "the full log was not kept"
+	if c.spoolOK {
+		where = "the full log is kept as artifact " + FullLogArtifactName
+	}
+	omitted := c.total - int64(len(head)) - int64(len(tail))
+	marker := fmt.Sprintf("[noppflow] ... log truncated: %d bytes omitted (log size %d bytes exceeds the %d byte limit; %s) ...\n",
+		omitted, c.total, c.max, where)
+	return string(head) + marker + string(tail)
+}
+
+// done closes the spool file and returns the path of the full log if the log was truncated.
+// Otherwise the spool file is removed.
+func (c *cappedLog) done() string {
+	if c.spool == nil {
+		return ""
+	}
+	name := c.spool.Name()
+	if err := c.spool.Close(); err != nil {
+		c.spoolOK = false
+	}
+	c.spool = nil
+	if !c.Truncated() || !c.spoolOK {
+		_ = os.Remove(name)
+		return ""
+	}
+	return name
+}
+
+var _ io.Writer = (*cappedLog)(nil)
@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Annotation levels produced by ::notice::, ::warning:: and ::error:: markers.
+const (
+	AnnotationNotice  = "notice"
+	AnnotationWarning = "warning"
+	AnnotationError   = "error"
+)
+
+// LogSection is a collapsible part of a run log opened by "::group::Title" and closed by
+// "::endgroup::" (or implicitly by the next group, the next step, or the end of the log).
+// Line numbers are 1-based and inclusive, counting the marker lines.
+type LogSection struct {
+	Title     string `json:"title"`
+	Step      string `json:"step,omitempty"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+}
+
+// Annotation is a message emitted by a step with "::warning::msg", "::error::msg" or "::notice::msg".
+// Markers may carry properties like GitHub Actions ("::warning file=main.go,line=12,title=Lint::msg").
+type Annotation struct {
+	Level    string `json:"level"`
+	Message  string `json:"message"`
+	Title    string `json:"title,omitempty"`
+	Step     string `json:"step,omitempty"`
+	Line     int    `json:"line"`
+	File     string `json:"file,omitempty"`
+	FileLine int    `json:"file_line,omitempty"`
+}
+
+// ParseLogMarkers scans a run log for step output markers and returns its sections and annotations.
+// Markers must start the line (after the capture timestamp and leading whitespace); the log itself is not modified.
+func ParseLogMarkers(log string) ([]LogSection, []Annotation) {
+	sections := make([]LogSection, 0)
+	annotations := make([]Annotation, 0)
+	if log == "" {
+		return sections, annotations
+	}
+	lines := strings.Split(strings.TrimSuffix(log, "\n"), "\n")
+	step := ""
+	open := -1
+	closeSection := func(end int) {
+		if open >= 0 {
+			sections[open].EndLine = end
+			open = -1
+		}
+	}
+	for i, raw := range lines {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripLineTimestamp(raw))
+		if name, ok := stepHeader(line); ok {
+			closeSection(lineNo - 1)
+			step = name
+			continue
+		}
+		if !strings.HasPrefix(line, "::") {
+			continue
+		}
+		command, props, message, ok := splitMarker(line[2:])
+		if !ok {
+			continue
+		}
+		switch command {
+		case "group":
+			closeSection(lineNo - 1)
+			sections = append(sections, LogSection{Title: message, Step: step, StartLine: lineNo, EndLine: lineNo})
+			open = len(sections) - 1
+		case "endgroup":
+			closeSection(lineNo)
+		case AnnotationNotice, AnnotationWarning, AnnotationError:
+			a := Annotation{Level: command, Message: message, Step: step, Line: lineNo, File: props["file"], Title: props["title"]}
+			if n, err := strconv.Atoi(props["line"]); err == nil && n > 0 {
+				a.FileLine = n
+			}
+			annotations = append(annotations, a)
+		}
+	}
+	closeSection(len(lines))
+	return sections, annotations
+}
+
+// stepHeader reports whether line is a "=== Step: name ===" header written by the runner.
+func stepHeader(line string) (string, bool) {
+	if !strings.HasPrefix(line, "=== Step: ") || !strings.HasSuffix(line, " ===") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(line, "=== Step: "), " ==="), true
+}
+
+// splitMarker parses "command[ k=v,...]::message" (the part after the leading "::").
+func splitMarker(s string) (command string, props map[string]string, message string, ok bool) {
+	head, message, found := strings.Cut(s, "::")
+	if !found {
+		return "", nil, "", false
+	}
+	command, rawProps, _ := strings.Cut(head, " ")
+	if command == "" || strings.ContainsAny(command, "\t=,") {
+		return "", nil, "", false
+	}
+	props = map[string]string{}
+	for _, kv := range strings.Split(rawProps, ",") {
+		k, v, found := strings.Cut(strings.TrimSpace(kv), "=")
+		if found && k != "" {
+			props[k] = strings.TrimSpace(v)
+		}
+	}
+	return command, props, strings.TrimSpace(message), true
+}
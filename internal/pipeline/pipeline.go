@@ -4,12 +4,15 @@
 package pipeline
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"noppflow/internal/config"
@@ -17,96 +20,311 @@ import (
 
 // Runner holds the base directory where app repositories are cloned (e.g. work/).
 // Each app gets workDir/<app.ID>/ as its working directory.
+// When the mirror cache is enabled, bare mirrors live under workDir/.mirrors/.
 type Runner struct {
 	workDir string
+
+	mirrorCache bool
+	mirrorMu    sync.Mutex
+	mirrorLocks map[string]*sync.Mutex
+
+	// usageInterval is the step resource sampling interval (defaultUsageInterval when zero).
+	usageInterval time.Duration
 }
 
 // NewRunner creates a pipeline runner. workDir is where repos are cloned (e.g. ./work).
 func NewRunner(workDir string) *Runner {
-	return &Runner{workDir: workDir}
+	return &Runner{workDir: workDir, mirrorLocks: make(map[string]*sync.Mutex)}
 }
 
-// Result holds the outcome of a pipeline run.
+// SetMirrorCache enables or disables the shared bare mirror cache used as --reference for clones.
+func (r *Runner) SetMirrorCache(enabled bool) {
+	r.mirrorCache = enabled
+}
+
+// Result holds the outcome of a pipeline run. Usage has one entry per executed step;
+// Artifacts lists the files collected from successful steps (still in the app work dir), plus the
+// plan of terraform steps. Findings lists the vulnerabilities reported by scan steps.
+// FullLogPath is set when Log was truncated (see RunOptions.MaxLogBytes): a temporary file with
+// the full log that the caller must remove.
 type Result struct {
-	Success bool
-	Log     string
+	Success     bool
+	Log         string
+	Usage       []StepUsage
+	Artifacts   []Artifact
+	Findings    []Finding
+	FullLogPath string
 }
 
 // RunOptions configures runtime behavior for a pipeline run.
+// Timeout, when > 0, bounds the whole run (clone and steps); running commands are killed when it expires.
+// EnvSources optionally labels where each StepEnv key came from (e.g. "global", "app"); it is logged
+// (names only, never values) at the start of the run.
+// MaxLogBytes, when > 0, caps the log: beyond it the middle is replaced by a truncation marker
+// and the full log is returned as Result.FullLogPath.
+// Approve is called when a terraform step's plan needs approval; without it such steps fail.
+// LockDatabase, when set, serializes db_migrate steps per database.
+// GuardDeploy, when set, is called before each deploy step (see config.Step.IsDeploy); the step
+// fails without running when it returns an error. VerifyImages, when set, is then called with the
+// images the step may deploy (see DeployImages) and can fail it the same way.
+// PreviousCommit, when set, is the commit the app's previous successful run checked out; the
+// messages of the commits since then are scanned for issue keys (see IssueKeys).
 type RunOptions struct {
 	GitSSHCommand string
-	StepEnv       map[string]string
+	// GitOpsSSHCommand is used instead of GitSSHCommand by k8s_deploy steps with deploy_mode gitops.
+	GitOpsSSHCommand string
+	StepEnv          map[string]string
+	EnvSources       map[string]string
+	Timeout          time.Duration
+	MaxLogBytes      int64
+	Approve          Approver
+	LockDatabase     DatabaseLocker
+	GuardDeploy      DeployGuard
+	VerifyImages     ImageVerifier
+	PreviousCommit   string
+}
+
+// DeployGuard checks whether a deploy step may run now, possibly waiting for an approval; it
+// reports what it waits for with logf.
+type DeployGuard func(ctx context.Context, step string, logf func(format string, args ...interface{})) error
+
+// WorkspaceDir returns the directory runs of an app check out and build in.
+func (r *Runner) WorkspaceDir(appID string) string {
+	return filepath.Join(r.workDir, appID)
 }
 
 // Run executes clone, test, build, and optionally deploy for the given app.
+// After a failing step, remaining steps are skipped unless marked always_run; failures of
+// continue_on_error steps are logged but do not fail the run. Post sections (on_success or
+// on_failure, then always) run after the main steps; a failing post step also fails the run.
 // If onLogUpdate is non-nil, it is called with the current log after each step so the UI can stream it.
 func (r *Runner) Run(app config.App, opts RunOptions, onLogUpdate func(log string)) Result {
-	var log bytes.Buffer
+	log := newCappedLog(opts.MaxLogBytes)
+	out := newTimestampWriter(log)
 	appendLog := func(format string, args ...interface{}) {
-		log.WriteString(fmt.Sprintf(format+"\n", args...))
+		fmt.Fprintf(out, format+"\n", args...)
 		if onLogUpdate != nil {
 			onLogUpdate(log.String())
 		}
 	}
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
 	gitEnv := []string(nil)
 	if strings.TrimSpace(opts.GitSSHCommand) != "" {
 		gitEnv = append(os.Environ(), "GIT_SSH_COMMAND="+opts.GitSSHCommand)
 	}
 
-	appWorkDir := filepath.Join(r.workDir, app.ID)
+	appWorkDir := r.WorkspaceDir(app.ID)
 	if err := os.MkdirAll(r.workDir, 0755); err != nil {
 		appendLog("mkdir work dir: %v", err)
-		return Result{Success: false, Log: log.String()}
+		return finishLog(log, Result{Success: false})
 	}
 
-	// Clone or pull
-	if _, err := os.Stat(filepath.Join(appWorkDir, ".git")); err != nil {
-		if err := os.MkdirAll(appWorkDir, 0755); err != nil {
-			appendLog("mkdir app dir: %v", err)
-			return Result{Success: false, Log: log.String()}
-		}
-		if err := r.runCmd(gitEnv, appWorkDir, "git", "clone", "--branch", app.Branch, "--single-branch", app.Repo, "."); err != nil {
-			appendLog("git clone: %v", err)
-			return Result{Success: false, Log: log.String()}
-		}
-	} else {
-		if err := r.runCmd(gitEnv, appWorkDir, "git", "pull", "origin", app.Branch); err != nil {
-			appendLog("git pull: %v", err)
-			return Result{Success: false, Log: log.String()}
-		}
+	unlock, err := r.lockWorkspace(ctx, app.ID, appendLog)
+	if err != nil {
+		appendLog("%v", err)
+		appendTimeoutLog(ctx, opts.Timeout, appendLog)
+		return finishLog(log, Result{Success: false})
+	}
+	defer unlock()
+
+	appendLog("checkout: branch %s", app.Branch)
+	if err := r.checkout(ctx, gitEnv, appWorkDir, app, appendLog); err != nil {
+		appendLog("%v", err)
+		appendTimeoutLog(ctx, opts.Timeout, appendLog)
+		return finishLog(log, Result{Success: false})
 	}
 
 	commit, _ := r.output(gitEnv, appWorkDir, "git", "rev-parse", "HEAD")
 	appendLog("commit: %s", strings.TrimSpace(commit))
+	if subject, _ := r.output(gitEnv, appWorkDir, "git", "log", "-1", "--format=%s"); strings.TrimSpace(subject) != "" {
+		appendLog("subject: %s", strings.TrimSpace(subject))
+	}
+	if keys := r.commitIssueKeys(gitEnv, appWorkDir, opts.PreviousCommit); len(keys) > 0 {
+		appendLog("issues: %s", strings.Join(keys, ", "))
+	}
 
+	if app.LogColor {
+		opts.StepEnv = WithColorEnv(opts.StepEnv)
+	}
 	stepEnv := envMapToList(opts.StepEnv)
-	steps := app.EffectiveSteps()
-	for _, step := range steps {
-		appendLog("=== Step: %s ===", step.Name)
-		if err := r.runStepWithLog(stepEnv, appWorkDir, app, step, &log); err != nil {
-			if onLogUpdate != nil {
-				onLogUpdate(log.String())
+	if len(opts.EnvSources) > 0 {
+		appendLog("env: %s", FormatEnvSources(opts.EnvSources))
+	}
+	if app.EnvReport {
+		appendLog("=== Environment report ===")
+		r.writeEnvReport(ctx, stepEnv, appWorkDir, out)
+		appendLog("=== End of environment report ===")
+	}
+	var usage []StepUsage
+	var artifacts []Artifact
+	var findings []Finding
+	var approve Approver
+	if opts.Approve != nil {
+		approve = func(ctx context.Context, step, plan string) error {
+			appendLog("%s: waiting for plan approval", step)
+			if err := opts.Approve(ctx, step, plan); err != nil {
+				return err
 			}
-			appendLog("%s step failed: %v", step.Name, err)
-			return Result{Success: false, Log: log.String()}
+			appendLog("%s: plan approved", step)
+			return nil
 		}
-		appendLog("%s step OK", step.Name)
-		if step.SleepSec > 0 {
-			appendLog("Sleeping %ds after %s...", step.SleepSec, step.Name)
-			time.Sleep(time.Duration(step.SleepSec) * time.Second)
-			if onLogUpdate != nil {
-				onLogUpdate(log.String())
+	}
+	var lockDB DatabaseLocker
+	if opts.LockDatabase != nil {
+		lockDB = func(ctx context.Context, step, key string) (func(), error) {
+			appendLog("%s: waiting for database lock", step)
+			release, err := opts.LockDatabase(ctx, step, key)
+			if err != nil {
+				return nil, err
 			}
+			appendLog("%s: database lock acquired", step)
+			return release, nil
 		}
 	}
+	// runSteps runs steps in order and reports whether one of them failed. After a failure
+	// only always_run steps execute.
+	runSteps := func(steps []config.Step) bool {
+		failed := false
+		for _, step := range steps {
+			if failed && (!step.AlwaysRun || ctx.Err() != nil) {
+				appendLog("%s step skipped (previous step failed)", step.Name)
+				continue
+			}
+			appendLog("=== Step: %s ===", step.Name)
+			if warning := CmdStepShellWarning(app, step); warning != "" {
+				appendLog("%s", warning)
+			}
+			env := stepEnv
+			if len(step.Env) > 0 {
+				appendLog("step env: %s", strings.Join(SortedKeys(step.Env), ", "))
+				env = envMapToList(step.ResolveEnv(opts.StepEnv))
+			}
+			if step.Kind() == "k8s_deploy" && opts.GitOpsSSHCommand != "" {
+				env = append(append([]string(nil), env...), "GIT_SSH_COMMAND="+opts.GitOpsSSHCommand)
+			}
+			// DurationMs stays -1 when the step did not start a process (e.g. missing workdir).
+			u := StepUsage{Step: step.Name, DurationMs: -1}
+			var produced stepOutput
+			var err error
+			if opts.GuardDeploy != nil && step.IsDeploy() {
+				err = opts.GuardDeploy(ctx, step.Name, appendLog)
+			}
+			if err == nil && opts.VerifyImages != nil && step.IsDeploy() {
+				images := DeployImages(step.ResolveEnv(opts.StepEnv), builtImages(log.String()))
+				err = opts.VerifyImages(ctx, step.Name, images, appendLog)
+			}
+			if err == nil {
+				var built []ImageDigest
+				if step.Kind() == "sign" {
+					built = builtImages(log.String())
+				}
+				produced, err = r.runStepWithLog(ctx, env, appWorkDir, app, step, built, approve, lockDB, out, &u)
+			}
+			artifacts = append(artifacts, produced.Artifacts...)
+			findings = append(findings, produced.Findings...)
+			if u.DurationMs >= 0 {
+				usage = append(usage, u)
+			}
+			if err != nil {
+				if onLogUpdate != nil {
+					onLogUpdate(log.String())
+				}
+				if step.ContinueOnError && ctx.Err() == nil {
+					appendLog("%s step failed (ignored: continue_on_error): %v", step.Name, err)
+					continue
+				}
+				appendLog("%s step failed: %v", step.Name, err)
+				appendTimeoutLog(ctx, opts.Timeout, appendLog)
+				failed = true
+				continue
+			}
+			appendLog("%s step OK", step.Name)
+			if len(step.Artifacts) > 0 {
+				collected, unmatched := collectArtifacts(appWorkDir, step.Name, step.Artifacts)
+				for _, pattern := range unmatched {
+					appendLog("artifacts: no files match %q", pattern)
+				}
+				if len(collected) > 0 {
+					var size int64
+					for _, a := range collected {
+						size += a.Size
+					}
+					appendLog("artifacts: %d file(s), %d bytes", len(collected), size)
+					artifacts = append(artifacts, collected...)
+				}
+			}
+			if step.SleepSec > 0 {
+				appendLog("Sleeping %ds after %s...", step.SleepSec, step.Name)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Duration(step.SleepSec) * time.Second):
+				}
+				if ctx.Err() != nil {
+					appendTimeoutLog(ctx, opts.Timeout, appendLog)
+					failed = true
+					continue
+				}
+				if onLogUpdate != nil {
+					onLogUpdate(log.String())
+				}
+			}
+		}
+		return failed
+	}
+
+	failed := runSteps(app.EffectiveSteps())
+	post := app.EffectivePost()
+	type postSection struct {
+		name  string
+		steps []config.Step
+	}
+	sections := []postSection{{"on_success", post.OnSuccess}, {"always", post.Always}}
+	if failed {
+		sections[0] = postSection{"on_failure", post.OnFailure}
+	}
+	for _, section := range sections {
+		if len(section.steps) == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			appendLog("post %s steps skipped (run stopped)", section.name)
+			continue
+		}
+		appendLog("=== Post: %s ===", section.name)
+		if runSteps(section.steps) {
+			failed = true
+		}
+	}
+	if failed {
+		return finishLog(log, Result{Success: false, Usage: usage, Artifacts: artifacts, Findings: findings})
+	}
 
 	appendLog("pipeline completed successfully")
-	return Result{Success: true, Log: log.String()}
+	return finishLog(log, Result{Success: true, Usage: usage, Artifacts: artifacts, Findings: findings})
+}
+
+// finishLog sets the final log of a run result.
+func finishLog(log *cappedLog, res Result) Result {
+	res.Log = log.String()
+	res.FullLogPath = log.done()
+	return res
+}
+
+// appendTimeoutLog records in the log that the run was stopped by its max duration.
+func appendTimeoutLog(ctx context.Context, timeout time.Duration, appendLog func(format string, args ...interface{})) {
+	if ctx.Err() == context.DeadlineExceeded {
+		appendLog("run exceeded max duration of %s", timeout)
+	}
 }
 
 // runCmd runs a command in dir with stdout/stderr attached to the process (for git clone/pull).
-func (r *Runner) runCmd(env []string, dir, name string, args ...string) error {
-	cmd := exec.Command(name, args...)
+func (r *Runner) runCmd(ctx context.Context, env []string, dir, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Dir = dir
 	if len(env) > 0 {
 		cmd.Env = env
@@ -117,58 +335,111 @@ func (r *Runner) runCmd(env []string, dir, name string, args ...string) error {
 }
 
 // runCmdWithLog runs a shell command (parsed by splitCommand) in dir and writes stdout/stderr to log.
-func (r *Runner) runCmdWithLog(env []string, dir, command string, log *bytes.Buffer) error {
+func (r *Runner) runCmdWithLog(ctx context.Context, env []string, dir, command string, log io.Writer, usage *StepUsage) error {
 	parts := splitCommand(command)
 	if len(parts) == 0 {
 		return nil
 	}
-	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
 	cmd.Dir = dir
 	if len(env) > 0 {
 		cmd.Env = append(os.Environ(), env...)
 	}
 	cmd.Stdout = log
 	cmd.Stderr = log
-	return cmd.Run()
+	return r.runSampled(cmd, usage)
 }
 
-// runFileWithLog runs a script file path via sh in dir.
-func (r *Runner) runFileWithLog(env []string, dir, filePath string, log *bytes.Buffer) error {
-	cmd := exec.Command("sh", filePath)
+// runShellWithLog runs a command line built by ScriptCommand or FileCommand in dir.
+func (r *Runner) runShellWithLog(ctx context.Context, env []string, dir string, args []string, log io.Writer, usage *StepUsage) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 	cmd.Dir = dir
 	if len(env) > 0 {
 		cmd.Env = append(os.Environ(), env...)
 	}
 	cmd.Stdout = log
 	cmd.Stderr = log
-	return cmd.Run()
+	return r.runSampled(cmd, usage)
 }
 
-// runScriptWithLog runs inline script text via sh -c in dir.
-func (r *Runner) runScriptWithLog(env []string, dir, script string, log *bytes.Buffer) error {
-	cmd := exec.Command("sh", "-c", script)
+// runScriptWithLog runs inline script text via sh -c in dir (for scripts NoppFlow generates).
+func (r *Runner) runScriptWithLog(ctx context.Context, env []string, dir, script string, log io.Writer, usage *StepUsage) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", script)
 	cmd.Dir = dir
 	if len(env) > 0 {
 		cmd.Env = append(os.Environ(), env...)
 	}
 	cmd.Stdout = log
 	cmd.Stderr = log
-	return cmd.Run()
+	return r.runSampled(cmd, usage)
 }
 
-func (r *Runner) runStepWithLog(env []string, dir string, app config.App, step config.Step, log *bytes.Buffer) error {
+// stepOutput is what a step produced besides its log, kept also when the step failed: files
+// regardless of its configured artifacts (the plan of terraform steps) and scan findings.
+type stepOutput struct {
+	Artifacts []Artifact
+	Findings  []Finding
+}
+
+// runStepWithLog runs one step in its workdir. built lists the images the run built so far, for
+// sign steps.
+func (r *Runner) runStepWithLog(ctx context.Context, env []string, dir string, app config.App, step config.Step, built []ImageDigest, approve Approver, lockDB DatabaseLocker, log io.Writer, usage *StepUsage) (stepOutput, error) {
+	if step.Workdir != "" {
+		dir = filepath.Join(dir, step.Workdir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return stepOutput{}, fmt.Errorf("workdir %q not found in repository", step.Workdir)
+		}
+	}
 	switch step.Kind() {
 	case "cmd":
-		return r.runCmdWithLog(env, dir, step.Cmd, log)
+		return stepOutput{}, r.runCmdWithLog(ctx, env, dir, step.Cmd, log, usage)
 	case "file":
-		return r.runFileWithLog(env, dir, step.File, log)
+		return stepOutput{}, r.runShellWithLog(ctx, env, dir, FileCommand(app, step.File), log, usage)
 	case "script":
-		return r.runScriptWithLog(env, dir, step.Script, log)
+		return stepOutput{}, r.runShellWithLog(ctx, env, dir, ScriptCommand(app, step.Script), log, usage)
 	case "k8s_deploy":
-		return r.runK8sDeployWithLog(dir, app, log)
+		return stepOutput{}, r.runK8sDeployWithLog(ctx, env, dir, app, log, usage)
+	case "ansible":
+		return stepOutput{}, r.runScriptWithLog(ctx, env, dir, AnsibleScript(step), log, usage)
+	case "db_migrate":
+		return stepOutput{}, r.runDBMigrateWithLog(ctx, env, dir, step, lockDB, log, usage)
+	case "wait_for":
+		return stepOutput{}, r.runWaitForWithLog(ctx, env, dir, step, log, usage)
+	case "sign":
+		return stepOutput{}, r.runSignWithLog(ctx, env, dir, step, built, log, usage)
+	case "scan":
+		findings, err := r.runScanWithLog(ctx, env, dir, step, log, usage)
+		return stepOutput{Findings: findings}, err
+	case "terraform":
+		artifacts, err := r.runTerraformWithLog(ctx, env, dir, step, approve, log, usage)
+		for i := range artifacts {
+			artifacts[i].Name = filepath.ToSlash(filepath.Join(step.Workdir, artifacts[i].Name))
+		}
+		return stepOutput{Artifacts: artifacts}, err
 	default:
-		return fmt.Errorf("invalid step execution mode")
+		return stepOutput{}, fmt.Errorf("invalid step execution mode")
+	}
+}
+
+// FormatEnvSources renders env var names with their source labels, sorted by name
+// (e.g. "API_URL (global), NODE_ENV (app, overrides global)").
+func FormatEnvSources(sources map[string]string) string {
+	names := SortedKeys(sources)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s (%s)", name, sources[name]))
 	}
+	return strings.Join(parts, ", ")
+}
+
+// SortedKeys returns the keys of m (e.g. env var names) in sorted order.
+func SortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func envMapToList(m map[string]string) []string {
@@ -186,18 +457,23 @@ func envMapToList(m map[string]string) []string {
 	return out
 }
 
-func (r *Runner) runK8sDeployWithLog(dir string, app config.App, log *bytes.Buffer) error {
+func (r *Runner) runK8sDeployWithLog(ctx context.Context, env []string, dir string, app config.App, log io.Writer, usage *StepUsage) error {
 	switch strings.TrimSpace(strings.ToLower(app.DeployMode)) {
+	case "gitops":
+		if app.GitOpsRepo == "" || app.GitOpsPath == "" || app.GitOpsImage == "" {
+			return fmt.Errorf("gitops_repo, gitops_path and gitops_image are required for deploy_mode=gitops")
+		}
+		return r.runScriptWithLog(ctx, env, dir, GitOpsScript(app), log, usage)
 	case "kubectl":
 		if strings.TrimSpace(app.DeployManifestPath) == "" {
 			return fmt.Errorf("deploy_manifest_path is required for deploy_mode=kubectl")
 		}
-		args := []string{"-n", app.K8sNamespace, "apply", "-f", app.DeployManifestPath}
-		cmd := exec.Command("kubectl", args...)
+		args := []string{"-n", app.DeployNamespace(), "apply", "-f", app.DeployManifestPath}
+		cmd := exec.CommandContext(ctx, "kubectl", args...)
 		cmd.Dir = dir
 		cmd.Stdout = log
 		cmd.Stderr = log
-		return cmd.Run()
+		return r.runSampled(cmd, usage)
 	case "helm":
 		if strings.TrimSpace(app.HelmChart) == "" {
 			return fmt.Errorf("helm_chart is required for deploy_mode=helm")
@@ -206,15 +482,15 @@ func (r *Runner) runK8sDeployWithLog(dir string, app config.App, log *bytes.Buff
 		if releaseName == "" {
 			releaseName = "noppflow-release"
 		}
-		args := []string{"upgrade", "--install", releaseName, app.HelmChart, "-n", app.K8sNamespace}
+		args := []string{"upgrade", "--install", releaseName, app.HelmChart, "-n", app.DeployNamespace()}
 		if strings.TrimSpace(app.HelmValuesPath) != "" {
 			args = append(args, "-f", app.HelmValuesPath)
 		}
-		cmd := exec.Command("helm", args...)
+		cmd := exec.CommandContext(ctx, "helm", args...)
 		cmd.Dir = dir
 		cmd.Stdout = log
 		cmd.Stderr = log
-		return cmd.Run()
+		return r.runSampled(cmd, usage)
 	default:
 		return fmt.Errorf("unsupported deploy_mode for k8s_deploy step: %q", app.DeployMode)
 	}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Kinds of image digests a run records.
+const (
+	DigestBuilt    = "built"
+	DigestDeployed = "deployed"
+)
+
+// ImageDigest is an image digest a run produced or deployed. Tag is the tag it was pushed or
+// referenced with, if any; Step names the step whose output reported it.
+type ImageDigest struct {
+	Kind   string `json:"kind"`
+	Image  string `json:"image"`
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest"`
+	Step   string `json:"step,omitempty"`
+}
+
+var (
+	// imageDigestRefPattern finds name[:tag]@sha256:<hex> references within a line.
+	imageDigestRefPattern = regexp.MustCompile(`[a-z0-9][a-z0-9._/:-]*@sha256:[a-f0-9]{64}\b`)
+	dockerPushRepoPattern = regexp.MustCompile(`^The push refers to repository \[([^\]]+)\]$`)
+	dockerPushedPattern   = regexp.MustCompile(`^([A-Za-z0-9_][A-Za-z0-9_.-]{0,127}): digest: (sha256:[a-f0-9]{64}) size: \d+$`)
+)
+
+// ParseImageDigests returns the image digests a run log reports, in order of appearance and
+// without duplicates:
+//   - built: "::image::name[:tag]@sha256:<hex>" markers, `docker push` output ("The push refers to
+//     repository [name]" then "<tag>: digest: sha256:<hex> size: <n>"), and buildx "pushing
+//     manifest for name:tag@sha256:<hex>" lines;
+//   - deployed: "::deployed::name[:tag]@sha256:<hex>" markers, and any name@sha256:<hex>
+//     reference printed by the steps named in deploySteps (e.g. helm or kubectl output).
+func ParseImageDigests(log string, deploySteps map[string]bool) []ImageDigest {
+	out := make([]ImageDigest, 0)
+	seen := make(map[ImageDigest]bool)
+	add := func(kind, ref, step string) {
+		d, ok := parseImageDigestRef(ref)
+		if !ok {
+			return
+		}
+		d.Kind, d.Step = kind, step
+		key := ImageDigest{Kind: d.Kind, Image: d.Image, Tag: d.Tag, Digest: d.Digest}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		out = append(out, d)
+	}
+	step, pushRepo := "", ""
+	for _, raw := range strings.Split(log, "\n") {
+		line := strings.TrimSpace(stripLineTimestamp(raw))
+		if name, ok := stepHeader(line); ok {
+			step, pushRepo = name, ""
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "::image::"); ok {
+			add(DigestBuilt, strings.TrimSpace(rest), step)
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "::deployed::"); ok {
+			add(DigestDeployed, strings.TrimSpace(rest), step)
+			continue
+		}
+		if m := dockerPushRepoPattern.FindStringSubmatch(line); m != nil {
+			pushRepo = m[1]
+			continue
+		}
+		if m := dockerPushedPattern.FindStringSubmatch(line); m != nil && pushRepo != "" {
+			add(DigestBuilt, pushRepo+":"+m[1]+"@"+m[2], step)
+			continue
+		}
+		if _, rest, ok := strings.Cut(line, "pushing manifest for "); ok {
+			if ref := imageDigestRefPattern.FindString(rest); ref != "" {
+				add(DigestBuilt, ref, step)
+			}
+			continue
+		}
+		if deploySteps[step] {
+			for _, ref := range imageDigestRefPattern.FindAllString(line, -1) {
+				add(DigestDeployed, ref, step)
+			}
+		}
+	}
+	return out
+}
+
+// parseImageDigestRef splits name[:tag]@sha256:<hex>.
+func parseImageDigestRef(ref string) (ImageDigest, bool) {
+	name, digest, ok := strings.Cut(ref, "@")
+	if !ok || !imageDigestPattern.MatchString(digest) {
+		return ImageDigest{}, false
+	}
+	tag := ""
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+		if tag == "" {
+			return ImageDigest{}, false
+		}
+	}
+	if !ValidImageName(name) {
+		return ImageDigest{}, false
+	}
+	return ImageDigest{Image: name, Tag: tag, Digest: digest}, true
+}
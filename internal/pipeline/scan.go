@@ -0,0 +1,258 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// Finding is one vulnerability reported by a scan step.
+type Finding struct {
+	Step             string
+	Tool             string
+	ID               string
+	Package          string
+	InstalledVersion string
+	FixedVersion     string
+	Severity         string
+	Title            string
+	Target           string
+}
+
+// ScanSeverities lists the severities a scan step can fail on, lowest first.
+var ScanSeverities = []string{"LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// severityRank orders severities; UNKNOWN and unrecognized values rank lowest.
+func severityRank(severity string) int {
+	for i, s := range ScanSeverities {
+		if s == severity {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// maxLoggedFindings bounds the findings listed in the run log (all of them are returned).
+const maxLoggedFindings = 50
+
+// runScanWithLog runs the scanner of a scan step in dir with JSON output and parses its findings,
+// worst first. They are returned also when the step fails because of fail_on.
+func (r *Runner) runScanWithLog(ctx context.Context, env []string, dir string, step config.Step, log io.Writer, usage *StepUsage) ([]Finding, error) {
+	sc := *step.Scan
+	target := os.Expand(sc.Target, envLookup(env))
+	var stdout bytes.Buffer
+	var name string
+	var args []string
+	report := ""
+	switch sc.Tool {
+	case "trivy-image", "trivy-fs":
+		if target == "" {
+			if sc.Tool == "trivy-image" {
+				return nil, fmt.Errorf("trivy-image needs a target image")
+			}
+			target = "."
+		}
+		f, err := os.CreateTemp("", "noppflow-trivy-*.json")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		report = f.Name()
+		defer os.Remove(report)
+		name = "trivy"
+		args = []string{strings.TrimPrefix(sc.Tool, "trivy-"), "--quiet", "--format", "json", "--output", report, target}
+	case "govulncheck":
+		if target == "" {
+			target = "./..."
+		}
+		name = "govulncheck"
+		args = []string{"-json", target}
+	default:
+		return nil, fmt.Errorf("unsupported scan tool %q", sc.Tool)
+	}
+	fmt.Fprintf(log, "%s: scanning %s with %s\n", step.Name, target, sc.Tool)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = log
+	if report == "" {
+		cmd.Stdout = &stdout
+	}
+	cmd.Stderr = log
+	if err := r.runSampled(cmd, usage); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var findings []Finding
+	var err error
+	if report != "" {
+		var data []byte
+		if data, err = os.ReadFile(report); err == nil {
+			findings, err = parseTrivyReport(data)
+		}
+	} else {
+		findings, err = parseGovulncheckOutput(stdout.Bytes())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s output: %w", sc.Tool, err)
+	}
+	for i := range findings {
+		findings[i].Step = step.Name
+		findings[i].Tool = sc.Tool
+		if findings[i].Target == "" {
+			findings[i].Target = filepath.ToSlash(target)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank(findings[i].Severity) > severityRank(findings[j].Severity)
+	})
+	logFindings(log, step.Name, findings)
+
+	if sc.FailOn != "" {
+		threshold := severityRank(sc.FailOn)
+		n := 0
+		for _, f := range findings {
+			if severityRank(f.Severity) >= threshold {
+				n++
+			}
+		}
+		if n > 0 {
+			return findings, fmt.Errorf("%d finding(s) with severity %s or higher", n, sc.FailOn)
+		}
+	}
+	return findings, nil
+}
+
+// logFindings writes a summary by severity and the first findings to the run log.
+func logFindings(log io.Writer, step string, findings []Finding) {
+	if len(findings) == 0 {
+		fmt.Fprintf(log, "%s: no vulnerabilities found\n", step)
+		return
+	}
+	counts := map[string]int{}
+	for _, f := range findings {
+		counts[f.Severity]++
+	}
+	var parts []string
+	for i := len(ScanSeverities) - 1; i >= 0; i-- {
+		if n := counts[ScanSeverities[i]]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", ScanSeverities[i], n))
+		}
+	}
+	if n := len(findings) - sumCounts(counts); n > 0 {
+		parts = append(parts, fmt.Sprintf("UNKNOWN %d", n))
+	}
+	fmt.Fprintf(log, "%s: %d vulnerabilities (%s)\n", step, len(findings), strings.Join(parts, ", "))
+	for i, f := range findings {
+		if i == maxLoggedFindings {
+			fmt.Fprintf(log, "  ... %d more\n", len(findings)-i)
+			break
+		}
+		fixed := f.FixedVersion
+		if fixed == "" {
+			fixed = "no fix"
+		}
+		fmt.Fprintf(log, "  %s %s %s %s (%s)\n", f.Severity, f.ID, f.Package, f.InstalledVersion, fixed)
+	}
+}
+
+func sumCounts(counts map[string]int) int {
+	n := 0
+	for _, s := range ScanSeverities {
+		n += counts[s]
+	}
+	return n
+}
+
+// parseTrivyReport reads the vulnerabilities of a trivy JSON report.
+func parseTrivyReport(data []byte) ([]Finding, error) {
+	var report struct {
+		Results []struct {
+			Target          string
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				FixedVersion     string
+				Severity         string
+				Title            string
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, res := range report.Results {
+		for _, v := range res.Vulnerabilities {
+			findings = append(findings, Finding{
+				ID: v.VulnerabilityID, Package: v.PkgName, InstalledVersion: v.InstalledVersion,
+				FixedVersion: v.FixedVersion, Severity: strings.ToUpper(v.Severity), Title: v.Title, Target: res.Target,
+			})
+		}
+	}
+	return findings, nil
+}
+
+// parseGovulncheckOutput reads the findings of govulncheck -json, a stream of messages. Only
+// vulnerabilities whose vulnerable functions are called are reported, once per OSV entry and
+// module. The Go vulnerability database has no severities, so they are reported as HIGH.
+func parseGovulncheckOutput(data []byte) ([]Finding, error) {
+	type frame struct {
+		Module   string `json:"module"`
+		Version  string `json:"version"`
+		Function string `json:"function"`
+	}
+	var msg struct {
+		OSV *struct {
+			ID      string `json:"id"`
+			Summary string `json:"summary"`
+		} `json:"osv"`
+		Finding *struct {
+			OSV          string  `json:"osv"`
+			FixedVersion string  `json:"fixed_version"`
+			Trace        []frame `json:"trace"`
+		} `json:"finding"`
+	}
+	summaries := map[string]string{}
+	seen := map[string]bool{}
+	var findings []Finding
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		msg.OSV, msg.Finding = nil, nil
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if msg.OSV != nil {
+			summaries[msg.OSV.ID] = msg.OSV.Summary
+		}
+		f := msg.Finding
+		if f == nil || len(f.Trace) == 0 || f.Trace[0].Function == "" {
+			continue
+		}
+		key := f.OSV + " " + f.Trace[0].Module
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		findings = append(findings, Finding{
+			ID: f.OSV, Package: f.Trace[0].Module, InstalledVersion: f.Trace[0].Version,
+			FixedVersion: f.FixedVersion, Severity: "HIGH",
+		})
+	}
+	for i := range findings {
+		findings[i].Title = summaries[findings[i].ID]
+	}
+	return findings, nil
+}
@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"path/filepath"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// DefaultShell runs script and file steps of apps without a shell setting.
+const DefaultShell = "sh"
+
+// StepShell returns the shell command line for the app's script and file steps: its shell (sh
+// when unset), with -l when it runs as a login shell so /etc/profile and ~/.profile are read.
+func StepShell(app config.App) []string {
+	shell := strings.TrimSpace(app.Shell)
+	if shell == "" {
+		shell = DefaultShell
+	}
+	if app.LoginShell {
+		return []string{shell, "-l"}
+	}
+	return []string{shell}
+}
+
+// WithProfileScripts prefixes script with sourcing the app's profile scripts (e.g. ~/.nvm/nvm.sh)
+// so the tools and shell functions they define are available to it.
+func WithProfileScripts(app config.App, script string) string {
+	if len(app.ProfileScripts) == 0 {
+		return script
+	}
+	var b strings.Builder
+	for _, p := range app.ProfileScripts {
+		b.WriteString(". " + p + "\n")
+	}
+	b.WriteString(script)
+	return b.String()
+}
+
+// ScriptCommand returns the command line running an inline script step.
+func ScriptCommand(app config.App, script string) []string {
+	return append(StepShell(app), "-c", WithProfileScripts(app, script))
+}
+
+// FileCommand returns the command line running a script file step. With profile scripts, the file
+// is sourced after them by the same shell.
+func FileCommand(app config.App, file string) []string {
+	if len(app.ProfileScripts) == 0 {
+		return append(StepShell(app), file)
+	}
+	if !filepath.IsAbs(file) && !strings.HasPrefix(file, "./") && !strings.HasPrefix(file, "../") {
+		// "." searches PATH for names without a slash.
+		file = "./" + file
+	}
+	return append(StepShell(app), "-c", WithProfileScripts(app, `. "$0"`), file)
+}
+
+// CmdStepShellWarning returns the warning logged before a cmd step of an app with profile scripts
+// or a login shell, which cmd steps run without (apps saved through the API cannot have both), or
+// "" for other steps.
+func CmdStepShellWarning(app config.App, step config.Step) string {
+	if step.Kind() != "cmd" || (len(app.ProfileScripts) == 0 && !app.LoginShell) {
+		return ""
+	}
+	return "warning: cmd steps do not run through the shell; profile_scripts and login_shell do not apply (use script instead)"
+}
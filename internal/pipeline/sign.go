@@ -0,0 +1,140 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// ImageVerifier checks the images a deploy step is about to deploy; the step fails without
+// running when it returns an error.
+type ImageVerifier func(ctx context.Context, step string, images []ImageDigest, logf func(format string, args ...interface{})) error
+
+// maxCosignErrorLen bounds the cosign output quoted in verification errors.
+const maxCosignErrorLen = 300
+
+// builtImages returns the images a run log reports as built, once per image and digest.
+func builtImages(log string) []ImageDigest {
+	var out []ImageDigest
+	seen := make(map[string]bool)
+	for _, d := range ParseImageDigests(log, nil) {
+		ref := d.Image + "@" + d.Digest
+		if d.Kind != DigestBuilt || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		out = append(out, d)
+	}
+	return out
+}
+
+// DeployImages returns the images a deploy step may deploy: the one in NOPPFLOW_IMAGE when it
+// names a digest (as set by promotions), then those built earlier in the run.
+func DeployImages(env map[string]string, built []ImageDigest) []ImageDigest {
+	var out []ImageDigest
+	if d, ok := parseImageDigestRef(strings.TrimSpace(env["NOPPFLOW_IMAGE"])); ok {
+		out = append(out, d)
+	}
+	for _, d := range built {
+		if len(out) > 0 && out[0].Image == d.Image && out[0].Digest == d.Digest {
+			continue
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// runSignWithLog signs the images of a sign step with cosign: its image, or the images built by
+// the previous steps. The key is passed as --key env://<key_env>, so it never reaches a file or
+// a command line; COSIGN_PASSWORD is set from password_env (empty for keys without a password).
+func (r *Runner) runSignWithLog(ctx context.Context, env []string, dir string, step config.Step, built []ImageDigest, log io.Writer, usage *StepUsage) error {
+	sg := *step.Sign
+	lookup := envLookup(env)
+	if lookup(sg.KeyEnv) == "" {
+		return fmt.Errorf("key_env %s is not set", sg.KeyEnv)
+	}
+	password := ""
+	if sg.PasswordEnv != "" {
+		if password = lookup(sg.PasswordEnv); password == "" {
+			return fmt.Errorf("password_env %s is not set", sg.PasswordEnv)
+		}
+	}
+	var refs []string
+	if sg.Image != "" {
+		ref := strings.TrimSpace(os.Expand(sg.Image, lookup))
+		if ref == "" {
+			return fmt.Errorf("image %s is empty", sg.Image)
+		}
+		refs = append(refs, ref)
+	} else {
+		for _, d := range built {
+			refs = append(refs, d.Image+"@"+d.Digest)
+		}
+	}
+	if len(refs) == 0 {
+		return errors.New("no image to sign: the previous steps reported no pushed image")
+	}
+	for _, ref := range refs {
+		fmt.Fprintf(log, "%s: signing %s with cosign\n", step.Name, ref)
+		cmd := exec.CommandContext(ctx, "cosign", "sign", "--yes", "--key", "env://"+sg.KeyEnv, ref)
+		cmd.Dir = dir
+		cmd.Env = append(append(os.Environ(), env...), "COSIGN_PASSWORD="+password)
+		cmd.Stdout = log
+		cmd.Stderr = log
+		if err := r.runSampled(cmd, usage); err != nil {
+			return fmt.Errorf("cosign sign %s: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+// VerifyImageSignature checks with `cosign verify` that an image carries a signature the policy
+// accepts, trying each public key and then the certificate identity. env is added to cosign's
+// environment (e.g. DOCKER_CONFIG for private registries).
+func VerifyImageSignature(ctx context.Context, env map[string]string, image ImageDigest, policy config.SignaturePolicy) error {
+	var attempts [][]string
+	for _, key := range policy.PublicKeys {
+		attempts = append(attempts, []string{"--key", key})
+	}
+	if policy.CertificateIdentity != "" {
+		attempts = append(attempts, []string{"--certificate-identity-regexp", policy.CertificateIdentity, "--certificate-oidc-issuer", policy.CertificateOIDCIssuer})
+	}
+	ref := image.Image + "@" + image.Digest
+	var failures []string
+	for _, args := range attempts {
+		args = append(append([]string{"verify"}, args...), ref)
+		cmd := exec.CommandContext(ctx, "cosign", args...)
+		cmd.Env = append(os.Environ(), envMapToList(env)...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, cosignFailure(err, stderr.String()))
+	}
+	if len(failures) == 0 {
+		return errors.New("signature policy has no keys or identity")
+	}
+	return errors.New(strings.Join(failures, "; "))
+}
+
+// cosignFailure describes a failed cosign call by the last line of its error output.
+func cosignFailure(err error, stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	msg := strings.TrimSpace(lines[len(lines)-1])
+	if msg == "" {
+		return err.Error()
+	}
+	if len(msg) > maxCosignErrorLen {
+		msg = msg[:maxCosignErrorLen]
+	}
+	return msg
+}
@@ -0,0 +1,128 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// Files a terraform step writes into its workdir: the saved plan applied after approval and its
+// rendering, collected as the step's plan artifact.
+const (
+	TerraformPlanFile     = "noppflow.tfplan"
+	TerraformPlanTextFile = "noppflow-plan.txt"
+)
+
+// maxApprovalPlanBytes bounds the plan text handed to the approver (the artifact has all of it).
+const maxApprovalPlanBytes = 64 << 10
+
+// Approver blocks until the plan of step is approved (nil) or rejected, or ctx ends (error).
+type Approver func(ctx context.Context, step, plan string) error
+
+// runTerraformWithLog runs init, plan, approval, and apply for a terraform step in dir. The plan
+// text is returned as an artifact whenever the plan succeeded, also when approval is refused.
+// A plan without changes skips approval and apply.
+func (r *Runner) runTerraformWithLog(ctx context.Context, env []string, dir string, step config.Step, approve Approver, log io.Writer, usage *StepUsage) ([]Artifact, error) {
+	tf := *step.Terraform
+	bin := tf.Binary
+	if bin == "" {
+		bin = "terraform"
+	}
+	env = append(append([]string(nil), env...), "TF_IN_AUTOMATION=1", "TF_INPUT=0")
+	run := func(out io.Writer, u *StepUsage, args ...string) error {
+		cmd := exec.CommandContext(ctx, bin, args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = out
+		cmd.Stderr = log
+		return r.runSampled(cmd, u)
+	}
+
+	initArgs := []string{"init", "-input=false", "-no-color"}
+	if len(tf.BackendConfig) > 0 {
+		lookup := envLookup(env)
+		for _, key := range SortedKeys(tf.BackendConfig) {
+			initArgs = append(initArgs, "-backend-config="+key+"="+os.Expand(tf.BackendConfig[key], lookup))
+		}
+		fmt.Fprintf(log, "%s init (backend config: %s)\n", bin, strings.Join(SortedKeys(tf.BackendConfig), ", "))
+	}
+	if err := run(log, nil, initArgs...); err != nil {
+		return nil, fmt.Errorf("%s init: %w", bin, err)
+	}
+	if tf.Workspace != "" {
+		if err := run(log, nil, "workspace", "select", "-or-create", tf.Workspace); err != nil {
+			return nil, fmt.Errorf("%s workspace select: %w", bin, err)
+		}
+	}
+
+	planArgs := []string{"plan", "-input=false", "-no-color", "-detailed-exitcode", "-out=" + TerraformPlanFile}
+	for _, f := range tf.VarFiles {
+		planArgs = append(planArgs, "-var-file="+f)
+	}
+	err := run(log, usage, planArgs...)
+	var exitErr *exec.ExitError
+	changes := errors.As(err, &exitErr) && exitErr.ExitCode() == 2
+	if err != nil && !changes {
+		return nil, fmt.Errorf("%s plan: %w", bin, err)
+	}
+	if !changes {
+		fmt.Fprintln(log, "terraform: no changes, skipping apply")
+		return nil, nil
+	}
+
+	var plan strings.Builder
+	if err := run(&plan, nil, "show", "-no-color", TerraformPlanFile); err != nil {
+		return nil, fmt.Errorf("%s show: %w", bin, err)
+	}
+	textPath := filepath.Join(dir, TerraformPlanTextFile)
+	if err := os.WriteFile(textPath, []byte(plan.String()), 0644); err != nil {
+		return nil, err
+	}
+	var artifacts []Artifact
+	if info, err := os.Stat(textPath); err == nil {
+		artifacts = append(artifacts, Artifact{Step: step.Name, Name: TerraformPlanTextFile, Path: textPath, Size: info.Size()})
+	}
+
+	if !tf.AutoApprove {
+		if approve == nil {
+			return artifacts, errors.New("plan needs approval but runs of this server cannot be approved")
+		}
+		text := plan.String()
+		if len(text) > maxApprovalPlanBytes {
+			text = text[len(text)-maxApprovalPlanBytes:]
+		}
+		actx, cancel := context.WithTimeout(ctx, tf.ApprovalTimeout())
+		err := approve(actx, step.Name, text)
+		cancel()
+		if err != nil {
+			return artifacts, err
+		}
+	}
+	if err := run(log, usage, "apply", "-input=false", "-no-color", TerraformPlanFile); err != nil {
+		return artifacts, fmt.Errorf("%s apply: %w", bin, err)
+	}
+	return artifacts, nil
+}
+
+// envLookup resolves names from an env list (later entries win), falling back to the process env.
+func envLookup(env []string) func(string) string {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			vars[k] = v
+		}
+	}
+	return func(name string) string {
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	}
+}
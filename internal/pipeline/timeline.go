@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"strings"
+	"time"
+)
+
+// Timeline event kinds found in run logs.
+const (
+	TimelineCloneStart  = "clone.start"
+	TimelineCloneEnd    = "clone.end"
+	TimelineStepStart   = "step.start"
+	TimelineStepEnd     = "step.end"
+	TimelineStepSkipped = "step.skipped"
+	TimelinePostStart   = "post.start"
+)
+
+// TimelineEvent is a point in time of a run. Name is the step (step events), the post section
+// (post.start), or the notification event; Section is the section of a step (steps, on_success,
+// on_failure, always). End events carry the status of the step (success, failed, or ignored for
+// continue_on_error failures) and the time since their start event.
+type TimelineEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Name       string    `json:"name,omitempty"`
+	Section    string    `json:"section,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// ParseLogTimeline returns the clone, step and post section events of a run log in log order,
+// timed by the capture timestamps of their lines. Lines without a timestamp are ignored. Logs
+// of Kubernetes Jobs have no clone events: the clone runs in an init container.
+func ParseLogTimeline(log string) []TimelineEvent {
+	events := make([]TimelineEvent, 0)
+	section := "steps"
+	var cloneStart, stepStart time.Time
+	step := ""
+	for _, raw := range strings.Split(log, "\n") {
+		loc := logTimestampPattern.FindStringIndex(raw)
+		if loc == nil {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(raw[:loc[1]]))
+		if err != nil {
+			continue
+		}
+		line := strings.TrimSpace(raw[loc[1]:])
+		if name, ok := stepHeader(line); ok {
+			step, stepStart = name, t
+			events = append(events, TimelineEvent{Time: t, Event: TimelineStepStart, Name: name, Section: section})
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "checkout: "):
+			cloneStart = t
+			events = append(events, TimelineEvent{Time: t, Event: TimelineCloneStart, Message: strings.TrimPrefix(line, "checkout: ")})
+		case strings.HasPrefix(line, "commit: ") && !cloneStart.IsZero():
+			events = append(events, TimelineEvent{Time: t, Event: TimelineCloneEnd, DurationMs: t.Sub(cloneStart).Milliseconds(), Message: line})
+			cloneStart = time.Time{}
+		case strings.HasPrefix(line, "=== Post: ") && strings.HasSuffix(line, " ==="):
+			section = strings.TrimSuffix(strings.TrimPrefix(line, "=== Post: "), " ===")
+			step = ""
+			events = append(events, TimelineEvent{Time: t, Event: TimelinePostStart, Name: section})
+		case strings.HasSuffix(line, " step skipped (previous step failed)"):
+			name := strings.TrimSuffix(line, " step skipped (previous step failed)")
+			events = append(events, TimelineEvent{Time: t, Event: TimelineStepSkipped, Name: name, Section: section})
+		case step != "" && strings.HasPrefix(line, step+" step "):
+			status := ""
+			switch rest := strings.TrimPrefix(line, step+" step "); {
+			case rest == "OK":
+				status = "success"
+			case strings.HasPrefix(rest, "failed (ignored"):
+				status = "ignored"
+			case strings.HasPrefix(rest, "failed"):
+				status = "failed"
+			default:
+				continue
+			}
+			events = append(events, TimelineEvent{Time: t, Event: TimelineStepEnd, Name: step, Section: section, Status: status, DurationMs: t.Sub(stepStart).Milliseconds()})
+			step = ""
+		}
+	}
+	return events
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"time"
+)
+
+// LogTimestampLayout is the UTC capture time the Runner writes before every log line
+// (e.g. "2026-01-02T15:04:05.123Z build started"). Kubernetes Job logs use the
+// RFC 3339 timestamps of kubectl logs --timestamps, which match the same pattern.
+const LogTimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+var logTimestampPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2}) `)
+
+var logTimestampLinePattern = regexp.MustCompile(`(?m)` + logTimestampPattern.String()[1:])
+
+// logSink is what timestampWriter writes to (a bytes.Buffer or the run's cappedLog).
+type logSink interface {
+	io.Writer
+	io.StringWriter
+	io.ByteWriter
+}
+
+// timestampWriter prefixes each line written to buf with the time its first byte arrived.
+type timestampWriter struct {
+	buf       logSink
+	lineStart bool
+}
+
+func newTimestampWriter(buf logSink) *timestampWriter {
+	return &timestampWriter{buf: buf, lineStart: true}
+}
+
+func (w *timestampWriter) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		if w.lineStart {
+			w.buf.WriteString(time.Now().UTC().Format(LogTimestampLayout))
+			w.buf.WriteByte(' ')
+			w.lineStart = false
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			w.buf.Write(rest)
+			break
+		}
+		w.buf.Write(rest[:i+1])
+		rest = rest[i+1:]
+		w.lineStart = true
+	}
+	return len(p), nil
+}
+
+var _ io.Writer = (*timestampWriter)(nil)
+
+// StripLogTimestamps removes the capture timestamp prefix from every log line.
+func StripLogTimestamps(log string) string {
+	return logTimestampLinePattern.ReplaceAllString(log, "")
+}
+
+// stripLineTimestamp removes the capture timestamp prefix from a single log line.
+func stripLineTimestamp(line string) string {
+	if loc := logTimestampPattern.FindStringIndex(line); loc != nil {
+		return line[loc[1]:]
+	}
+	return line
+}
@@ -0,0 +1,206 @@
+package pipeline
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultUsageInterval is how often step processes are sampled.
+const defaultUsageInterval = time.Second
+
+// clockTicks is USER_HZ, the unit of utime/stime in /proc/<pid>/stat (100 on all common Linux builds).
+const clockTicks = 100
+
+// StepUsage is the resource usage of one step's process tree. CPU and RSS averages and peaks come from
+// /proc samples (Linux only); CPUSeconds, PeakRSSBytes and the disk counters also include the
+// rusage reported when the step exits. Steps running in Kubernetes Jobs are not sampled.
+type StepUsage struct {
+	Step           string  `json:"step"`
+	DurationMs     int64   `json:"duration_ms"`
+	CPUSeconds     float64 `json:"cpu_seconds"`
+	AvgCPUPercent  float64 `json:"avg_cpu_percent"`
+	PeakCPUPercent float64 `json:"peak_cpu_percent"`
+	AvgRSSBytes    int64   `json:"avg_rss_bytes"`
+	PeakRSSBytes   int64   `json:"peak_rss_bytes"`
+	DiskReadBytes  int64   `json:"disk_read_bytes"`
+	DiskWriteBytes int64   `json:"disk_write_bytes"`
+	Samples        int     `json:"samples"`
+}
+
+// runSampled starts cmd, samples its process tree until it exits, and records usage into u (if non-nil).
+func (r *Runner) runSampled(cmd *exec.Cmd, u *StepUsage) error {
+	if u == nil {
+		return cmd.Run()
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		interval := r.usageInterval
+		if interval <= 0 {
+			interval = defaultUsageInterval
+		}
+		s := newUsageSampler(cmd.Process.Pid)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				s.fill(u)
+				return
+			case <-ticker.C:
+				s.sample()
+			}
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	<-sampled
+
+	u.DurationMs = time.Since(start).Milliseconds()
+	if ps := cmd.ProcessState; ps != nil {
+		u.CPUSeconds = (ps.UserTime() + ps.SystemTime()).Seconds()
+		maxRSS, inBlocks, outBlocks := rusageStats(ps)
+		if maxRSS > u.PeakRSSBytes {
+			u.PeakRSSBytes = maxRSS
+		}
+		u.DiskReadBytes = inBlocks * 512
+		u.DiskWriteBytes = outBlocks * 512
+	}
+	if u.DurationMs > 0 && u.AvgCPUPercent == 0 {
+		u.AvgCPUPercent = u.CPUSeconds / (float64(u.DurationMs) / 1000) * 100
+	}
+	return err
+}
+
+// usageSampler reads /proc for a process and its descendants.
+type usageSampler struct {
+	root      int
+	last      time.Time
+	lastTicks map[int]uint64
+	samples   int
+	cpuSum    float64
+	cpuPeak   float64
+	rssSum    int64
+	rssPeak   int64
+}
+
+func newUsageSampler(pid int) *usageSampler {
+	return &usageSampler{root: pid, last: time.Now(), lastTicks: map[int]uint64{}}
+}
+
+func (s *usageSampler) sample() {
+	stats := procTreeStats(s.root)
+	if len(stats) == 0 {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(s.last).Seconds()
+	s.last = now
+	var deltaTicks uint64
+	var rss int64
+	ticks := make(map[int]uint64, len(stats))
+	for pid, st := range stats {
+		ticks[pid] = st.ticks
+		if st.ticks > s.lastTicks[pid] {
+			deltaTicks += st.ticks - s.lastTicks[pid]
+		}
+		rss += st.rss
+	}
+	s.lastTicks = ticks
+	cpu := 0.0
+	if elapsed > 0 {
+		cpu = float64(deltaTicks) / clockTicks / elapsed * 100
+	}
+	s.samples++
+	s.cpuSum += cpu
+	s.rssSum += rss
+	if cpu > s.cpuPeak {
+		s.cpuPeak = cpu
+	}
+	if rss > s.rssPeak {
+		s.rssPeak = rss
+	}
+}
+
+func (s *usageSampler) fill(u *StepUsage) {
+	u.Samples = s.samples
+	if s.samples == 0 {
+		return
+	}
+	u.AvgCPUPercent = s.cpuSum / float64(s.samples)
+	u.PeakCPUPercent = s.cpuPeak
+	u.AvgRSSBytes = s.rssSum / int64(s.samples)
+	u.PeakRSSBytes = s.rssPeak
+}
+
+type procStat struct {
+	ppid  int
+	ticks uint64
+	rss   int64
+}
+
+// procTreeStats returns /proc stats of root and all its descendants; empty when /proc is unavailable.
+func procTreeStats(root int) map[int]procStat {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	all := make(map[int]procStat, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if st, ok := readProcStat(pid); ok {
+			all[pid] = st
+		}
+	}
+	tree := map[int]procStat{}
+	if st, ok := all[root]; ok {
+		tree[root] = st
+	}
+	for grew := true; grew; {
+		grew = false
+		for pid, st := range all {
+			if _, in := tree[pid]; in {
+				continue
+			}
+			if _, parentIn := tree[st.ppid]; parentIn {
+				tree[pid] = st
+				grew = true
+			}
+		}
+	}
+	return tree
+}
+
+func readProcStat(pid int) (procStat, bool) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, false
+	}
+	// The command name (field 2) may contain spaces; fields after it start at the last ')'.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return procStat{}, false
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	// fields[0] is state (field 3): ppid is field 4, utime 14, stime 15, rss 24.
+	if len(fields) < 22 {
+		return procStat{}, false
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rssPages, _ := strconv.ParseInt(fields[21], 10, 64)
+	return procStat{ppid: ppid, ticks: utime + stime, rss: rssPages * int64(os.Getpagesize())}, true
+}
@@ -0,0 +1,15 @@
+package pipeline
+
+import (
+	"os"
+	"syscall"
+)
+
+// rusageStats returns max RSS in bytes and block input/output operations from the exit rusage.
+func rusageStats(ps *os.ProcessState) (maxRSS, inBlocks, outBlocks int64) {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return 0, 0, 0
+	}
+	return int64(ru.Maxrss) * 1024, int64(ru.Inblock), int64(ru.Oublock)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package pipeline
+
+import "os"
+
+// rusageStats is only implemented on Linux.
+func rusageStats(ps *os.ProcessState) (maxRSS, inBlocks, outBlocks int64) {
+	return 0, 0, 0
+}
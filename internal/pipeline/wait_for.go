@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// waitForRequestTimeout bounds a single URL check of a wait_for step.
+const waitForRequestTimeout = 30 * time.Second
+
+// runWaitForWithLog checks the URL or command of a wait_for step until a check succeeds, waiting
+// the step's interval between checks. It fails when the step's timeout passes first.
+func (r *Runner) runWaitForWithLog(ctx context.Context, env []string, dir string, step config.Step, log io.Writer, usage *StepUsage) error {
+	wf := *step.WaitFor
+	timeout := wf.Timeout()
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var check func() error
+	target := wf.Cmd
+	if wf.URL != "" {
+		target = os.Expand(wf.URL, envLookup(env))
+		check = func() error { return checkWaitForURL(ctx, target, wf.ExpectStatus) }
+	} else {
+		check = func() error { return r.runScriptWithLog(ctx, env, dir, wf.Cmd, log, usage) }
+	}
+	fmt.Fprintf(log, "%s: waiting for %s (every %s, up to %s)\n", step.Name, target, wf.Interval(), timeout)
+	for attempt := 1; ; attempt++ {
+		err := check()
+		if err == nil {
+			fmt.Fprintf(log, "%s: ready after %d check(s)\n", step.Name, attempt)
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Fprintf(log, "%s: check %d: %v\n", step.Name, attempt, err)
+		t := time.NewTimer(wf.Interval())
+		select {
+		case <-ctx.Done():
+			t.Stop()
+		case <-t.C:
+			continue
+		}
+		break
+	}
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+	return fmt.Errorf("%s not ready after %s", target, timeout)
+}
+
+// checkWaitForURL GETs url and succeeds on expectStatus, or on any 2xx status when it is 0.
+func checkWaitForURL(ctx context.Context, url string, expectStatus int) error {
+	ctx, cancel := context.WithTimeout(ctx, waitForRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	if expectStatus != 0 {
+		if resp.StatusCode != expectStatus {
+			return fmt.Errorf("status %d, want %d", resp.StatusCode, expectStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// workspaceLockPoll is how often a run waiting for a workspace lock retries.
+var workspaceLockPoll = 500 * time.Millisecond
+
+// lockWorkspace takes the exclusive lock of the app's workspace (workDir/<app>), waiting until
+// ctx is done. The lock is a file under workDir/.locks/ held with flock, so runs in this process
+// and in other server processes sharing the work directory never use the workspace at the same
+// time (a concurrent git checkout fails with "index.lock exists"). The returned func releases it.
+func (r *Runner) lockWorkspace(ctx context.Context, appID string, logf func(format string, args ...interface{})) (func(), error) {
+	dir := filepath.Join(r.workDir, ".locks")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir locks dir: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, appID+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open workspace lock: %w", err)
+	}
+	waiting := false
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock workspace: %w", err)
+		}
+		if locked {
+			if waiting {
+				logf("workspace: lock acquired")
+			}
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if !waiting {
+			logf("workspace: waiting for another run of %s to release the workspace", appID)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("lock workspace: %w", ctx.Err())
+		case <-time.After(workspaceLockPoll):
+		}
+	}
+}
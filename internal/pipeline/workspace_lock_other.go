@@ -0,0 +1,30 @@
+//go:build !linux
+
+package pipeline
+
+import (
+	"os"
+	"sync"
+)
+
+// Without flock, workspaces are only locked within this process.
+var (
+	fileLocksMu sync.Mutex
+	fileLocks   = map[string]bool{}
+)
+
+func tryLockFile(f *os.File) (bool, error) {
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+	if fileLocks[f.Name()] {
+		return false, nil
+	}
+	fileLocks[f.Name()] = true
+	return true, nil
+}
+
+func unlockFile(f *os.File) {
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+	delete(fileLocks, f.Name())
+}
@@ -0,0 +1,138 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"noppflow/internal/awssig"
+	"noppflow/internal/cloudcreds"
+	"noppflow/internal/config"
+)
+
+// stsSessionDuration is how long the role credentials of a run are valid (the STS minimum).
+const stsSessionDuration = 15 * time.Minute
+
+// awsSMProvider reads secrets from AWS Secrets Manager over its JSON API.
+type awsSMProvider struct {
+	cfg    config.AWSSecretsManagerProvider
+	client *http.Client
+	now    func() time.Time
+}
+
+func (p *awsSMProvider) fetch(ctx context.Context, session string, refs []Ref) ([]string, error) {
+	creds, err := p.credentials(ctx, session)
+	if err != nil {
+		return nil, fmt.Errorf("aws credentials: %v", err)
+	}
+	secrets := make(map[string]string)
+	values := make([]string, len(refs))
+	for i, ref := range refs {
+		secret, ok := secrets[ref.Path]
+		if !ok {
+			if secret, err = p.getSecretValue(ctx, creds, ref.Path); err != nil {
+				return nil, fmt.Errorf("%s: %v", ref, err)
+			}
+			secrets[ref.Path] = secret
+		}
+		if ref.Key == "" {
+			values[i] = secret
+			continue
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(secret), &data); err != nil {
+			return nil, fmt.Errorf("%s: secret is not a JSON object", ref)
+		}
+		if values[i], err = fieldValue(ref, data); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// credentials returns credentials for one run: the role assumed with the web identity token
+// when configured, otherwise the server's AWS_* env vars.
+func (p *awsSMProvider) credentials(ctx context.Context, session string) (awssig.Credentials, error) {
+	roleARN := p.cfg.RoleARN
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	tokenFile := p.cfg.WebIdentityTokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if roleARN != "" && tokenFile != "" {
+		return p.assumeRoleWithWebIdentity(ctx, roleARN, tokenFile, session)
+	}
+	creds := awssig.Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return creds, errors.New("set role_arn and web_identity_token_file, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return creds, nil
+}
+
+// assumeRoleWithWebIdentity exchanges the web identity token for role credentials valid for
+// stsSessionDuration.
+func (p *awsSMProvider) assumeRoleWithWebIdentity(ctx context.Context, roleARN, tokenFile, session string) (awssig.Credentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awssig.Credentials{}, err
+	}
+	endpoint := cloudcreds.STSEndpoint(p.cfg.STSEndpoint, p.cfg.Region)
+	sess, err := cloudcreds.AssumeRoleWithWebIdentity(ctx, p.client, endpoint, roleARN, string(token), session, stsSessionDuration)
+	return sess.Credentials, err
+}
+
+// getSecretValue returns the current SecretString of a secret (name or ARN).
+func (p *awsSMProvider) getSecretValue(ctx context.Context, creds awssig.Credentials, secretID string) (string, error) {
+	endpoint := p.cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + p.cfg.Region + ".amazonaws.com"
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	awssig.Sign(req, creds, p.cfg.Region, "secretsmanager", awssig.HashHex(body), p.now().UTC())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		SecretString *string `json:"SecretString"`
+		Type         string  `json:"__type"`
+		Message      string  `json:"message"`
+		MessageUpper string  `json:"Message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return "", fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := out.Message
+		if msg == "" {
+			msg = out.MessageUpper
+		}
+		return "", fmt.Errorf("%s: %s %s", resp.Status, out.Type, msg)
+	}
+	if out.SecretString == nil {
+		return "", errors.New("secret has no SecretString (binary secrets are not supported)")
+	}
+	return *out.SecretString, nil
+}
@@ -0,0 +1,152 @@
+// Package secrets resolves env var values that reference secrets kept outside PiaFlow (Vault,
+// AWS Secrets Manager, SOPS files) when a run starts, so the database only holds references.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// requestTimeout bounds each call to a secret provider's API.
+const requestTimeout = 15 * time.Second
+
+// Ref is a parsed secret reference: <scheme>:<path>[#<key>].
+type Ref struct {
+	Scheme string
+	Path   string
+	Key    string
+}
+
+func (r Ref) String() string {
+	if r.Key == "" {
+		return r.Scheme + ":" + r.Path
+	}
+	return r.Scheme + ":" + r.Path + "#" + r.Key
+}
+
+// provider reads the secrets of one scheme. fetch is called once per run with all of the run's
+// references of that scheme, so that it can authenticate once for them; session names the run
+// where the provider records it (e.g. the STS role session).
+type provider interface {
+	fetch(ctx context.Context, session string, refs []Ref) ([]string, error)
+}
+
+// Resolver resolves secret references with the configured providers.
+type Resolver struct {
+	providers map[string]provider
+	allowed   map[string][]string
+}
+
+// New returns a resolver for the providers of cfg.
+func New(cfg config.SecretProvidersConfig) *Resolver {
+	client := &http.Client{Timeout: requestTimeout}
+	r := &Resolver{providers: make(map[string]provider), allowed: make(map[string][]string)}
+	if cfg.Vault != nil {
+		r.providers[config.SecretSchemeVault] = &vaultProvider{cfg: *cfg.Vault, client: client}
+		r.allowed[config.SecretSchemeVault] = cfg.Vault.Allowed
+	}
+	if cfg.AWSSM != nil {
+		r.providers[config.SecretSchemeAWSSM] = &awsSMProvider{cfg: *cfg.AWSSM, client: client, now: time.Now}
+		r.allowed[config.SecretSchemeAWSSM] = cfg.AWSSM.Allowed
+	}
+	if cfg.SOPS != nil {
+		r.providers[config.SecretSchemeSOPS] = &sopsProvider{cfg: *cfg.SOPS}
+		r.allowed[config.SecretSchemeSOPS] = cfg.SOPS.Allowed
+	}
+	return r
+}
+
+// ParseRef parses value as a reference to one of the resolver's providers. Values with another
+// or no scheme are not references.
+func (r *Resolver) ParseRef(value string) (Ref, bool) {
+	scheme, rest, ok := strings.Cut(value, ":")
+	if !ok {
+		return Ref{}, false
+	}
+	if _, known := r.providers[scheme]; !known {
+		return Ref{}, false
+	}
+	p, key, _ := strings.Cut(rest, "#")
+	return Ref{Scheme: scheme, Path: strings.TrimSpace(p), Key: strings.TrimSpace(key)}, true
+}
+
+// Resolve returns the secret values of the env vars in env that hold references, by name, for a
+// run of the app appID. It fails on the first reference that is malformed, not allowed, or cannot
+// be read; errors name the env var and reference, never a value.
+func (r *Resolver) Resolve(ctx context.Context, session, appID string, env map[string]string) (map[string]string, error) {
+	byScheme := make(map[string][]string)
+	refs := make(map[string]Ref)
+	for name, value := range env {
+		ref, ok := r.ParseRef(value)
+		if !ok {
+			continue
+		}
+		if err := r.check(ref, appID); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		refs[name] = ref
+		byScheme[ref.Scheme] = append(byScheme[ref.Scheme], name)
+	}
+	resolved := make(map[string]string, len(refs))
+	for scheme, names := range byScheme {
+		sort.Strings(names)
+		batch := make([]Ref, len(names))
+		for i, name := range names {
+			batch[i] = refs[name]
+		}
+		values, err := r.providers[scheme].fetch(ctx, session, batch)
+		if err != nil {
+			return nil, err
+		}
+		for i, name := range names {
+			resolved[name] = values[i]
+		}
+	}
+	return resolved, nil
+}
+
+// check validates a reference's path and key and matches the path against the provider's
+// allowed patterns, in which $APP stands for appID.
+func (r *Resolver) check(ref Ref, appID string) error {
+	if ref.Path == "" || strings.Contains(ref.Path, "..") {
+		return fmt.Errorf("invalid secret reference %s", ref)
+	}
+	if ref.Key == "" && ref.Scheme != config.SecretSchemeAWSSM {
+		return fmt.Errorf("secret reference %s needs a #key", ref)
+	}
+	allowed := r.allowed[ref.Scheme]
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(strings.ReplaceAll(pattern, "$APP", appID), ref.Path); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("secret reference %s is not allowed by the %s provider", ref, ref.Scheme)
+}
+
+// fieldValue returns a field of a decoded secret as a string; non-string values are returned
+// as JSON.
+func fieldValue(ref Ref, data map[string]interface{}) (string, error) {
+	v, ok := data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("%s: no such key", ref)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", ref, err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,145 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"noppflow/internal/config"
+)
+
+func TestResolveVault(t *testing.T) {
+	var revoked bool
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if body["role"] != "noppflow" || body["jwt"] != "sa-token" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"run-token"}}`))
+		case "/v1/kv/data/ci/payments":
+			if r.Header.Get("X-Vault-Token") != "run-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`{"data":{"data":{"db_password":"s3cret","port":5432}}}`))
+		case "/v1/auth/token/revoke-self":
+			revoked = r.Header.Get("X-Vault-Token") == "run-token"
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer vault.Close()
+	jwt := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwt, []byte("sa-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := New(config.SecretProvidersConfig{Vault: &config.VaultProvider{
+		Address: vault.URL, KVVersion: 2, Auth: config.VaultAuthKubernetes, Role: "noppflow", JWTFile: jwt, Mount: "kubernetes",
+		Allowed: []string{"kv/ci/*"},
+	}})
+
+	env := map[string]string{"DB_PASSWORD": "vault:kv/ci/payments#db_password", "DB_PORT": "vault:kv/ci/payments#port", "PLAIN": "aws-sm:not-configured"}
+	got, err := r.Resolve(context.Background(), "run-1", "app-a", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["DB_PASSWORD"] != "s3cret" || got["DB_PORT"] != "5432" || !revoked {
+		t.Fatalf("unexpected resolved env %v (revoked %v)", got, revoked)
+	}
+
+	for value, want := range map[string]string{
+		"vault:kv/ci/payments":         "needs a #key",
+		"vault:kv/prod/payments#x":     "not allowed",
+		"vault:kv/ci/payments#missing": "no such key",
+		"vault:kv/ci/other#x":          "404",
+	} {
+		if _, err := r.Resolve(context.Background(), "run-1", "app-a", map[string]string{"X": value}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Resolve(%q): expected error containing %q, got %v", value, want, err)
+		}
+	}
+}
+
+func TestResolveAWSSecretsManager(t *testing.T) {
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "web-token" || r.Form.Get("RoleSessionName") != "noppflow-run-7" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<ErrorResponse><Error><Message>denied</Message></Error></ErrorResponse>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIATEST</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	sm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.Contains(auth, "Credential=ASIATEST/") || !strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request") ||
+			r.Header.Get("X-Amz-Security-Token") != "session" || r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"__type":"AccessDeniedException","message":"bad signature"}`))
+			return
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch body["SecretId"] {
+		case "prod/api-key":
+			_, _ = w.Write([]byte(`{"SecretString":"plain-key"}`))
+		case "prod/payments":
+			_, _ = w.Write([]byte(`{"SecretString":"{\"stripe_key\":\"sk_live\"}"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret."}`))
+		}
+	}))
+	defer sm.Close()
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("web-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := New(config.SecretProvidersConfig{AWSSM: &config.AWSSecretsManagerProvider{
+		Region: "eu-west-1", Endpoint: sm.URL, STSEndpoint: sts.URL, RoleARN: "arn:aws:iam::1:role/ci", WebIdentityTokenFile: token,
+	}})
+	got, err := r.Resolve(context.Background(), "noppflow-run-7", "app-a", map[string]string{"API_KEY": "aws-sm:prod/api-key", "STRIPE": "aws-sm:prod/payments#stripe_key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["API_KEY"] != "plain-key" || got["STRIPE"] != "sk_live" {
+		t.Fatalf("unexpected resolved env %v", got)
+	}
+	if _, err := r.Resolve(context.Background(), "noppflow-run-7", "app-a", map[string]string{"X": "aws-sm:prod/missing"}); err == nil || !strings.Contains(err.Error(), "ResourceNotFoundException") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestResolveSOPS(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "fake-sops")
+	script := "#!/bin/sh\n[ \"$1 $2\" = \"--decrypt --extract\" ] || exit 2\necho \"value of $3 in $(basename \"$4\")\"\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r := New(config.SecretProvidersConfig{SOPS: &config.SOPSProvider{Dir: dir, Binary: bin}})
+	got, err := r.Resolve(context.Background(), "run-1", "app-a", map[string]string{"KEY": "sops:app.enc.yaml#signing.key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["KEY"] != `value of ["signing"]["key"] in app.enc.yaml` {
+		t.Fatalf("unexpected value %q", got["KEY"])
+	}
+	if _, err := r.Resolve(context.Background(), "run-1", "app-a", map[string]string{"KEY": "sops:../etc/passwd#x"}); err == nil {
+		t.Fatal("expected a path outside dir to be refused")
+	}
+}
@@ -0,0 +1,45 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// sopsProvider decrypts single values of SOPS files with the sops binary.
+type sopsProvider struct {
+	cfg config.SOPSProvider
+}
+
+func (p *sopsProvider) fetch(ctx context.Context, session string, refs []Ref) ([]string, error) {
+	values := make([]string, len(refs))
+	for i, ref := range refs {
+		file := filepath.Join(p.cfg.Dir, filepath.FromSlash(path.Clean("/"+ref.Path)))
+		extract := ""
+		for _, part := range strings.Split(ref.Key, ".") {
+			if part == "" || strings.ContainsAny(part, `"[]`) {
+				return nil, fmt.Errorf("%s: invalid key", ref)
+			}
+			extract += `["` + part + `"]`
+		}
+		cmd := exec.CommandContext(ctx, p.cfg.Binary, "--decrypt", "--extract", extract, file)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			msg := strings.TrimSpace(stderr.String())
+			if len(msg) > 500 {
+				msg = msg[:500]
+			}
+			return nil, fmt.Errorf("%s: sops: %v: %s", ref, err, msg)
+		}
+		values[i] = strings.TrimSuffix(stdout.String(), "\n")
+	}
+	return values, nil
+}
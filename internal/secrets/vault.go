@@ -0,0 +1,156 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// vaultProvider reads KV secrets from Vault over its HTTP API.
+type vaultProvider struct {
+	cfg    config.VaultProvider
+	client *http.Client
+}
+
+func (p *vaultProvider) fetch(ctx context.Context, session string, refs []Ref) ([]string, error) {
+	token, revoke, err := p.login(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("vault login: %v", err)
+	}
+	defer revoke()
+	secrets := make(map[string]map[string]interface{})
+	values := make([]string, len(refs))
+	for i, ref := range refs {
+		data, ok := secrets[ref.Path]
+		if !ok {
+			if data, err = p.read(ctx, token, ref.Path); err != nil {
+				return nil, fmt.Errorf("%s: %v", ref, err)
+			}
+			secrets[ref.Path] = data
+		}
+		if values[i], err = fieldValue(ref, data); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// login returns the token to read secrets with and a function that revokes it. AppRole and
+// Kubernetes logins yield a token just for this run, revoked once the secrets are read.
+func (p *vaultProvider) login(ctx context.Context) (string, func(), error) {
+	var body map[string]string
+	switch p.cfg.Auth {
+	case config.VaultAuthToken:
+		token := os.Getenv(p.cfg.TokenEnv)
+		if token == "" {
+			return "", nil, fmt.Errorf("env var %s is not set", p.cfg.TokenEnv)
+		}
+		return token, func() {}, nil
+	case config.VaultAuthAppRole:
+		secretID, err := os.ReadFile(p.cfg.SecretIDFile)
+		if err != nil {
+			return "", nil, err
+		}
+		body = map[string]string{"role_id": p.cfg.RoleID, "secret_id": strings.TrimSpace(string(secretID))}
+	case config.VaultAuthKubernetes:
+		jwt, err := os.ReadFile(p.cfg.JWTFile)
+		if err != nil {
+			return "", nil, err
+		}
+		body = map[string]string{"role": p.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return "", nil, fmt.Errorf("unknown auth %q", p.cfg.Auth)
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := p.do(ctx, http.MethodPost, "auth/"+p.cfg.Mount+"/login", "", body, &resp); err != nil {
+		return "", nil, err
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", nil, errors.New("no client token in login response")
+	}
+	revoke := func() {
+		// The token expires with its TTL anyway; revoking only shortens its life.
+		_ = p.do(context.Background(), http.MethodPost, "auth/token/revoke-self", resp.Auth.ClientToken, nil, nil)
+	}
+	return resp.Auth.ClientToken, revoke, nil
+}
+
+// read returns the fields of the secret at secretPath (<mount>/<path>).
+func (p *vaultProvider) read(ctx context.Context, token, secretPath string) (map[string]interface{}, error) {
+	apiPath := secretPath
+	if p.cfg.KVVersion == 2 {
+		mount, rest, ok := strings.Cut(secretPath, "/")
+		if !ok {
+			return nil, errors.New("path must be <mount>/<path>")
+		}
+		apiPath = mount + "/data/" + rest
+	}
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := p.do(ctx, http.MethodGet, apiPath, token, nil, &resp); err != nil {
+		return nil, err
+	}
+	if p.cfg.KVVersion == 1 {
+		return resp.Data, nil
+	}
+	data, _ := resp.Data["data"].(map[string]interface{})
+	if data == nil {
+		return nil, errors.New("secret has no data (deleted version?)")
+	}
+	return data, nil
+}
+
+// do calls the Vault API at /v1/<apiPath>, sending body as JSON and decoding the response into
+// out. Vault's error messages are returned as the error.
+func (p *vaultProvider) do(ctx context.Context, method, apiPath, token string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.cfg.Address+"/v1/"+strings.TrimLeft(apiPath, "/"), reqBody)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if p.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.cfg.Namespace)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		if len(e.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(e.Errors, "; "))
+		}
+		return errors.New(resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// validateAnsibleStep checks and normalizes an ansible step: the playbook is required and, like a
+// file inventory, must stay inside the repository; extra var and vault env names must be valid
+// identifiers.
+func validateAnsibleStep(step *config.Step) error {
+	a := step.Ansible
+	a.Playbook = strings.TrimPrefix(strings.TrimSpace(a.Playbook), "./")
+	if a.Playbook == "" {
+		return fmt.Errorf("step %s: ansible playbook is required", step.Name)
+	}
+	if !validRepoRelativePath(a.Playbook) {
+		return fmt.Errorf("step %s: ansible playbook must be a relative path inside the repository", step.Name)
+	}
+	a.Inventory = strings.TrimSpace(a.Inventory)
+	if !strings.Contains(a.Inventory, ",") && !validRepoRelativePath(a.Inventory) {
+		return fmt.Errorf("step %s: ansible inventory must be a relative path inside the repository or a comma-separated host list", step.Name)
+	}
+	for name := range a.ExtraVars {
+		if !validEnvVarName(name) {
+			return fmt.Errorf("step %s: invalid ansible extra var name %q", step.Name, name)
+		}
+	}
+	a.VaultPasswordEnv = strings.TrimSpace(a.VaultPasswordEnv)
+	if a.VaultPasswordEnv != "" && !validEnvVarName(a.VaultPasswordEnv) {
+		return fmt.Errorf("step %s: ansible vault_password_env must be an env var name", step.Name)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"noppflow/internal/store"
+)
+
+// API token scopes: full acts as the owner, read allows GET requests only, trigger allows
+// starting runs of apps and following them.
+const (
+	tokenScopeFull    = "full"
+	tokenScopeRead    = "read"
+	tokenScopeTrigger = "trigger"
+)
+
+const (
+	apiTokenPrefix     = "npf_"
+	maxAPITokenDays    = 365
+	apiTokenTouchEvery = time.Minute
+)
+
+// triggerScopeRoutes are the routes a trigger-scoped token may call, by method and pattern.
+var triggerScopeRoutes = map[string]bool{
+	"POST /api/apps/{appID}/run":   true,
+	"GET /api/runs/{id}":           true,
+	"GET /api/runs/{id}/log":       true,
+	"GET /api/runs/{id}/timeline":  true,
+	"GET /api/runs/{id}/artifacts": true,
+	"POST /api/trains/{name}/runs": true,
+	"GET /api/train-runs/{id}":     true,
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or "".
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// authenticateAPIToken authenticates a request by its bearer token and checks the token's scope
+// against the matched route. It writes the error response when it returns false.
+func (s *Server) authenticateAPIToken(w http.ResponseWriter, r *http.Request, secret string) (authUser, bool) {
+	t, err := s.store.GetAPITokenByHash(hashToken(secret))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return authUser{}, false
+	}
+	now := time.Now()
+	if t == nil || t.Expired(now) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or expired API token"})
+		return authUser{}, false
+	}
+	user, err := s.store.GetUser(t.UserID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return authUser{}, false
+	}
+	if user == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or expired API token"})
+		return authUser{}, false
+	}
+	route := r.Method + " " + chi.RouteContext(r.Context()).RoutePattern()
+	denial, err := s.apiTokenDenial(*t, r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return authUser{}, false
+	}
+	if denial != "" {
+		log.Printf("api token %d (%s, scope %s) of %s denied %s: %s", t.ID, t.Name, t.Scope, user.Username, route, denial)
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": denial})
+		return authUser{}, false
+	}
+	log.Printf("api token %d (%s, scope %s) of %s: %s", t.ID, t.Name, t.Scope, user.Username, route)
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= apiTokenTouchEvery {
+		if err := s.store.TouchAPIToken(t.ID, now); err != nil {
+			log.Printf("api token %d: record use: %v", t.ID, err)
+		}
+	}
+	return authUser{ID: user.ID, Username: user.Username, IsAdmin: user.IsAdmin}, true
+}
+
+// apiTokenDenial returns why t may not make request r, or "" when it may. Tokens cannot manage
+// tokens; app-limited tokens may only call routes naming one of their apps (an {appID}, the app
+// of a run {id}, or ?app_id= of GET /api/runs).
+func (s *Server) apiTokenDenial(t store.APIToken, r *http.Request) (string, error) {
+	pattern := chi.RouteContext(r.Context()).RoutePattern()
+	if strings.HasPrefix(pattern, "/api/tokens") {
+		return "API tokens are managed with a session, not with a token", nil
+	}
+	switch t.Scope {
+	case tokenScopeRead:
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return "token scope read allows only GET requests", nil
+		}
+	case tokenScopeTrigger:
+		if !triggerScopeRoutes[r.Method+" "+pattern] {
+			return "token scope trigger allows only starting and following runs", nil
+		}
+	}
+	if len(t.AppIDs) == 0 {
+		return "", nil
+	}
+	appID := ""
+	switch {
+	case strings.HasSuffix(pattern, "/deploy-with-dependencies"):
+		// Runs other apps too, like a train: not for tokens limited to apps.
+	case strings.Contains(pattern, "{appID}"):
+		appID = chi.URLParam(r, "appID")
+	case strings.HasPrefix(pattern, "/api/runs/{id}"):
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			return "", nil // the handler rejects the id
+		}
+		run, err := s.store.GetRun(id)
+		if err != nil {
+			return "", err
+		}
+		if run != nil {
+			appID = run.AppID
+		}
+	case pattern == "/api/runs" && r.Method == http.MethodGet:
+		appID = r.URL.Query().Get("app_id")
+	}
+	for _, id := range t.AppIDs {
+		if id == appID {
+			return "", nil
+		}
+	}
+	return "token is limited to apps " + strings.Join(t.AppIDs, ", "), nil
+}
+
+// listAPITokens returns the current user's API tokens (without secrets).
+func (s *Server) listAPITokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.store.ListAPITokens(authUserFromContext(r).ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// createAPIToken creates an API token for the current user. Body: name, scope (full, read, or
+// trigger; default read), app_ids (limit to these apps; empty for all the user can access), and
+// expires_in_days (0 = never, at most 365). The secret is returned only once.
+func (s *Server) createAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := authUserFromContext(r)
+	var body struct {
+		Name          string   `json:"name"`
+		Scope         string   `json:"scope"`
+		AppIDs        []string `json:"app_ids"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	t := store.APIToken{UserID: user.ID, Name: strings.TrimSpace(body.Name), Scope: strings.TrimSpace(body.Scope), AppIDs: make([]string, 0, len(body.AppIDs))}
+	if t.Scope == "" {
+		t.Scope = tokenScopeRead
+	}
+	if t.Name == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required"})
+		return
+	}
+	if t.Scope != tokenScopeFull && t.Scope != tokenScopeRead && t.Scope != tokenScopeTrigger {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "scope must be full, read, or trigger"})
+		return
+	}
+	for _, appID := range body.AppIDs {
+		appID = strings.TrimSpace(appID)
+		if _, ok := s.findApp(appID); !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("app %q not found", appID)})
+			return
+		}
+		if !user.IsAdmin {
+			ok, err := s.userCanAccessApp(user.ID, appID)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !ok {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("user has no access to app %q", appID)})
+				return
+			}
+		}
+		t.AppIDs = append(t.AppIDs, appID)
+	}
+	expiresAt, ok := apiTokenExpiry(w, body.ExpiresInDays)
+	if !ok {
+		return
+	}
+	t.ExpiresAt = expiresAt
+	secret, err := randomToken()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	secret = apiTokenPrefix + secret
+	t.TokenHash = hashToken(secret)
+	if t.ID, err = s.store.CreateAPIToken(t); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	t.CreatedAt = time.Now().UTC()
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"token": t, "secret": secret})
+}
+
+// rotateAPIToken replaces the secret of a token, keeping its name and scope; the old secret stops
+// working at once. Body (optional): expires_in_days, defaulting to the token's current validity
+// period. Owner or admin.
+func (s *Server) rotateAPIToken(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.ownedAPIToken(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		ExpiresInDays *int `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	days := 0
+	if body.ExpiresInDays != nil {
+		days = *body.ExpiresInDays
+	} else if t.ExpiresAt != nil {
+		since := t.CreatedAt
+		if t.RotatedAt != nil {
+			since = *t.RotatedAt
+		}
+		days = int((t.ExpiresAt.Sub(since) + 12*time.Hour) / (24 * time.Hour))
+		if days < 1 {
+			days = 1
+		}
+	}
+	expiresAt, ok := apiTokenExpiry(w, days)
+	if !ok {
+		return
+	}
+	secret, err := randomToken()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	secret = apiTokenPrefix + secret
+	if err := s.store.RotateAPIToken(t.ID, hashToken(secret), expiresAt); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "token not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	now := time.Now().UTC()
+	t.ExpiresAt, t.RotatedAt = expiresAt, &now
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": t, "secret": secret})
+}
+
+// deleteAPIToken revokes a token. Owner or admin.
+func (s *Server) deleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.ownedAPIToken(w, r)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteAPIToken(t.ID); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "token not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedAPIToken loads the token of the {tokenID} URL param if the current user owns it or is an
+// admin.
+func (s *Server) ownedAPIToken(w http.ResponseWriter, r *http.Request) (*store.APIToken, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "tokenID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid token id"})
+		return nil, false
+	}
+	t, err := s.store.GetAPIToken(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	user := authUserFromContext(r)
+	if t == nil || (t.UserID != user.ID && !user.IsAdmin) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "token not found"})
+		return nil, false
+	}
+	return t, true
+}
+
+// apiTokenExpiry returns the expiry of a token valid for days (nil for 0), writing a 400 when days
+// is out of range.
+func apiTokenExpiry(w http.ResponseWriter, days int) (*time.Time, bool) {
+	if days < 0 || days > maxAPITokenDays {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("expires_in_days must be between 0 and %d", maxAPITokenDays)})
+		return nil, false
+	}
+	if days == 0 {
+		return nil, true
+	}
+	t := time.Now().Add(time.Duration(days) * 24 * time.Hour).UTC()
+	return &t, true
+}
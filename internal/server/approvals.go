@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+)
+
+// approvalDecision is what a user decided on a pending run approval.
+type approvalDecision struct {
+	Approved bool
+	By       string
+}
+
+// pendingApproval is a run of this process blocked on an approval (see awaitApproval). Decisions
+// made on this replica wake it through Decide; decisions made on another replica are noticed by
+// polling the database every approvalPollInterval.
+type pendingApproval struct {
+	ID     int64
+	Decide chan approvalDecision
+}
+
+// approvalPollInterval is how often a waiting run checks the database for a decision made on
+// another replica.
+var approvalPollInterval = 2 * time.Second
+
+// runApprover returns the pipeline approver of a run, which waits for the plan of a step to be
+// approved (see awaitApproval).
+func (s *Server) runApprover(runID int64, app config.App) pipeline.Approver {
+	return func(ctx context.Context, step, plan string) error {
+		return s.awaitApproval(ctx, runID, app, step, "plan", plan, nil)
+	}
+}
+
+// awaitApproval records a pending approval of what (e.g. "plan") for a step of a run, sends a
+// run.approval_required notification, and waits until it is decided (by decideRunApproval on any
+// replica) or ctx ends. With groups, only members of one of them may decide.
+func (s *Server) awaitApproval(ctx context.Context, runID int64, app config.App, step, what, plan string, groups []string) error {
+	id, err := s.store.CreateRunApproval(runID, step, plan, groups)
+	if err != nil {
+		return fmt.Errorf("record approval: %w", err)
+	}
+	p := &pendingApproval{ID: id, Decide: make(chan approvalDecision, 1)}
+	s.approvalsMu.Lock()
+	s.approvals[runID] = p
+	s.approvalsMu.Unlock()
+	defer func() {
+		s.approvalsMu.Lock()
+		delete(s.approvals, runID)
+		s.approvalsMu.Unlock()
+	}()
+	go s.notify(app, notification{Event: "run.approval_required", RunID: runID, Message: fmt.Sprintf("step %s of run %d waits for %s approval", step, runID, what)})
+
+	ticker := time.NewTicker(approvalPollInterval)
+	defer ticker.Stop()
+	var d approvalDecision
+wait:
+	for {
+		select {
+		case d = <-p.Decide:
+			break wait
+		case <-ticker.C:
+			decided, ok, err := s.approvalDecision(runID, id)
+			if err != nil {
+				log.Printf("run %d: check approval: %v", runID, err)
+			} else if ok {
+				d = decided
+				break wait
+			}
+		case <-ctx.Done():
+			if err := s.store.ExpirePendingApprovals(runID); err != nil {
+				log.Printf("run %d: expire approval: %v", runID, err)
+			}
+			// A decision recorded just before the approval expired still counts.
+			decided, ok, err := s.approvalDecision(runID, id)
+			if err != nil || !ok {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return fmt.Errorf("%s was not approved in time", what)
+				}
+				return ctx.Err()
+			}
+			d = decided
+			break wait
+		}
+	}
+	if !d.Approved {
+		return fmt.Errorf("%s rejected by %s", what, d.By)
+	}
+	return nil
+}
+
+// approvalDecision returns the decision on approval id of a run, and false while it is pending or
+// when it expired undecided.
+func (s *Server) approvalDecision(runID, id int64) (approvalDecision, bool, error) {
+	a, err := s.store.LatestRunApproval(runID)
+	if err != nil || a == nil || a.ID != id || a.Status == "pending" {
+		return approvalDecision{}, false, err
+	}
+	if a.Status == "expired" {
+		return approvalDecision{}, false, nil
+	}
+	return approvalDecision{Approved: a.Status == "approved", By: a.DecidedBy}, true, nil
+}
+
+// decideRunApproval approves or rejects the pending approval of a run. Body: {"approve": bool}.
+// Any user with access to the run's app may decide, unless the approval is restricted to groups.
+func (s *Server) decideRunApproval(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Approve *bool `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Approve == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "approve (true or false) is required"})
+		return
+	}
+	pending, err := s.store.LatestRunApproval(run.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if pending == nil || pending.Status != "pending" {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "run is not waiting for approval"})
+		return
+	}
+	user := authUserFromContext(r)
+	if len(pending.ApproverGroups) > 0 {
+		groups, err := s.userGroupNames(user.Username)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !intersects(pending.ApproverGroups, groups) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only members of " + strings.Join(pending.ApproverGroups, ", ") + " may decide this approval"})
+			return
+		}
+	}
+	status := "rejected"
+	if *req.Approve {
+		status = "approved"
+	}
+	if err := s.store.DecideRunApproval(pending.ID, status, user.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "approval was already decided"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	// The run waits on this replica or polls for the decision on another one.
+	s.approvalsMu.Lock()
+	if p := s.approvals[run.ID]; p != nil && p.ID == pending.ID {
+		p.Decide <- approvalDecision{Approved: *req.Approve, By: user.Username}
+	}
+	s.approvalsMu.Unlock()
+	approval, err := s.store.LatestRunApproval(run.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, approval)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// appLastRun is the newest run of an app on the overview.
+type appLastRun struct {
+	ID          int64      `json:"id"`
+	Status      string     `json:"status"`
+	CommitSHA   string     `json:"commit_sha,omitempty"`
+	TriggeredBy string     `json:"triggered_by,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	DurationSec *int64     `json:"duration_sec,omitempty"`
+}
+
+type appOverview struct {
+	ID      string      `json:"id"`
+	Name    string      `json:"name"`
+	LastRun *appLastRun `json:"last_run"`
+}
+
+// getAppsOverview serves GET /api/apps/overview: the apps the user can see (not archived, in
+// config order, filtered by ?tag=) each with its last run, read with a single query.
+func (s *Server) getAppsOverview(w http.ResponseWriter, r *http.Request) {
+	user := authUserFromContext(r)
+	var allowed map[string]struct{}
+	var appIDs []string
+	if !user.IsAdmin {
+		var err error
+		allowed, appIDs, err = s.allowedAppIDsForUser(user.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	var tagged map[string]struct{}
+	if tags := tagFilter(r); len(tags) > 0 {
+		var err error
+		if tagged, err = s.taggedAppIDs(tags); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	runs, err := s.store.LatestRuns(appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	latest := make(map[string]*appLastRun, len(runs))
+	for _, run := range runs {
+		last := &appLastRun{ID: run.ID, Status: run.Status, CommitSHA: run.CommitSHA, TriggeredBy: run.TriggeredBy, StartedAt: run.StartedAt, EndedAt: run.EndedAt}
+		if run.EndedAt != nil {
+			sec := int64(run.EndedAt.Sub(run.StartedAt).Seconds())
+			last.DurationSec = &sec
+		}
+		latest[run.AppID] = last
+	}
+
+	s.appsMu.RLock()
+	defer s.appsMu.RUnlock()
+	out := make([]appOverview, 0, len(s.apps))
+	for _, app := range s.apps {
+		if app.Archived {
+			continue
+		}
+		if _, ok := tagged[app.ID]; tagged != nil && !ok {
+			continue
+		}
+		if _, ok := allowed[app.ID]; allowed != nil && !ok {
+			continue
+		}
+		out = append(out, appOverview{ID: app.ID, Name: app.Name, LastRun: latest[app.ID]})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/artifacts"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+// maxStepArtifactPatterns bounds the artifacts patterns of a single step.
+const maxStepArtifactPatterns = 20
+
+// SetArtifactStore sets the backend that step artifacts are uploaded to. Without one, artifacts are not kept.
+func (s *Server) SetArtifactStore(as artifacts.Store) {
+	s.artifacts = as
+}
+
+func runArtifactKey(runID int64, name string) string {
+	return path.Join("runs", strconv.FormatInt(runID, 10), name)
+}
+
+// saveRunArtifacts uploads the files collected by a run and records them. Failures are logged, not fatal.
+func (s *Server) saveRunArtifacts(runID int64, files []pipeline.Artifact) {
+	if len(files) == 0 {
+		return
+	}
+	if s.artifacts == nil {
+		log.Printf("run %d: %d artifact(s) not kept: no artifact store configured", runID, len(files))
+		return
+	}
+	for _, f := range files {
+		key := runArtifactKey(runID, f.Name)
+		if err := s.putArtifactFile(key, f); err != nil {
+			log.Printf("run %d: upload artifact %s: %v", runID, f.Name, err)
+			continue
+		}
+		if _, err := s.store.CreateRunArtifact(store.RunArtifact{RunID: runID, Step: f.Step, Name: f.Name, StorageKey: key, SizeBytes: f.Size}); err != nil {
+			log.Printf("run %d: record artifact %s: %v", runID, f.Name, err)
+		}
+	}
+}
+
+func (s *Server) putArtifactFile(key string, f pipeline.Artifact) error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return s.artifacts.Put(context.Background(), key, file, info.Size())
+}
+
+// deleteArtifactObjects removes objects from the artifact store before their runs are deleted.
+func (s *Server) deleteArtifactObjects(keys []string) {
+	if s.artifacts == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := s.artifacts.Delete(context.Background(), key); err != nil {
+			log.Printf("delete artifact %s: %v", key, err)
+		}
+	}
+}
+
+func (s *Server) listRunArtifacts(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	list, err := s.store.ListRunArtifacts(run.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) downloadRunArtifact(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	artifactID, err := strconv.ParseInt(chi.URLParam(r, "artifactID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid artifact id"})
+		return
+	}
+	a, err := s.store.GetRunArtifact(artifactID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if a == nil || a.RunID != run.ID {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "artifact not found"})
+		return
+	}
+	if s.artifacts == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no artifact store configured"})
+		return
+	}
+	body, err := s.artifacts.Get(r.Context(), a.StorageKey)
+	if err == artifacts.ErrNotFound {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "artifact object missing from store"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(a.SizeBytes, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(a.Name)))
+	_, _ = io.Copy(w, body)
+}
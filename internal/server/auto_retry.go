@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// maxAutoRetries caps auto_retry.max_retries so a broken cluster cannot multiply runs.
+const maxAutoRetries = 5
+
+// validateAutoRetry checks and normalizes an app's auto_retry; max_retries 0 removes it.
+func validateAutoRetry(app *config.App) error {
+	r := app.AutoRetry
+	if r == nil {
+		return nil
+	}
+	if r.MaxRetries < 0 || r.MaxRetries > maxAutoRetries {
+		return fmt.Errorf("auto_retry max_retries must be between 0 and %d", maxAutoRetries)
+	}
+	if r.MaxRetries == 0 {
+		app.AutoRetry = nil
+		return nil
+	}
+	reasons := make([]string, 0, len(r.Reasons))
+	seen := make(map[string]bool, len(r.Reasons))
+	for _, reason := range r.Reasons {
+		reason = strings.TrimSpace(reason)
+		if !config.ValidFailureReason(reason) {
+			return fmt.Errorf("auto_retry reason %q is not a failure reason (e.g. %s)", reason, strings.Join(config.DefaultRetryReasons, ", "))
+		}
+		if !seen[reason] {
+			seen[reason] = true
+			reasons = append(reasons, reason)
+		}
+	}
+	r.Reasons = reasons
+	return nil
+}
+
+// retryFailedRun starts a failed run again, with its trigger and run env, when the app's
+// auto_retry covers its failure reason and retries are left, and reports whether it did. The
+// failure is then not reported: a run.retried notification is sent instead. Runs of a release
+// train are not retried, since the train has already seen the failure.
+func (s *Server) retryFailedRun(runID int64, app config.App, reason string) bool {
+	if !app.AutoRetry.Retries(reason) {
+		return false
+	}
+	run, err := s.store.GetRun(runID)
+	if err != nil || run == nil {
+		log.Printf("run %d: auto retry: %v", runID, err)
+		return false
+	}
+	if strings.HasPrefix(run.TriggeredBy, "train:") {
+		return false
+	}
+	attempt := run.Attempt
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt > app.AutoRetry.MaxRetries {
+		return false
+	}
+	vars, err := s.store.ListRunEnv(runID)
+	if err != nil {
+		log.Printf("run %d: auto retry: %v", runID, err)
+		return false
+	}
+	runEnv := make(map[string]string, len(vars))
+	for _, v := range vars {
+		runEnv[v.Name] = v.Value
+	}
+	newID, _, err := s.queueRun(app, run.TriggeredBy, runEnv, false, runLink{upstreamRunID: run.TriggeredByRunID, retryOfRunID: runID, attempt: attempt + 1})
+	if err != nil {
+		log.Printf("run %d: auto retry: %v", runID, err)
+		return false
+	}
+	s.notify(app, notification{
+		Event:   "run.retried",
+		RunID:   runID,
+		Message: fmt.Sprintf("run %d of %s failed (%s); retrying as run %d, attempt %d of %d", runID, app.ID, reason, newID, attempt+1, app.AutoRetry.MaxRetries+1),
+	})
+	return true
+}
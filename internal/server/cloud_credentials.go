@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"noppflow/internal/cloudcreds"
+	"noppflow/internal/config"
+)
+
+// cloudMintTimeout bounds minting the cloud credentials of a run.
+const cloudMintTimeout = 30 * time.Second
+
+// SetCloudBroker lets apps name cloud roles (cloud_credentials) the server mints short-lived
+// credentials for at run time (see config.LoadCloudBroker).
+func (s *Server) SetCloudBroker(cfg config.CloudBrokerConfig) {
+	s.cloudBroker = cloudcreds.NewBroker(cfg)
+}
+
+// validateCloudCredentials normalizes an app's cloud_credentials, dropping it when it names no
+// cloud, and checks it against the broker's allowed roles and service accounts.
+func (s *Server) validateCloudCredentials(app *config.App) error {
+	if app.CloudCredentials == nil {
+		return nil
+	}
+	// Copied, as the pointers may be shared with the stored app.
+	cc := *app.CloudCredentials
+	if cc.AWS != nil {
+		role := config.AWSRole{RoleARN: strings.TrimSpace(cc.AWS.RoleARN), Region: strings.TrimSpace(cc.AWS.Region)}
+		cc.AWS = nil
+		if role.RoleARN != "" {
+			cc.AWS = &role
+		}
+	}
+	if cc.GCP != nil {
+		identity := config.GCPIdentity{ServiceAccount: strings.TrimSpace(cc.GCP.ServiceAccount), Project: strings.TrimSpace(cc.GCP.Project)}
+		cc.GCP = nil
+		if identity.ServiceAccount != "" {
+			cc.GCP = &identity
+		}
+	}
+	if cc.AWS == nil && cc.GCP == nil {
+		app.CloudCredentials = nil
+		return nil
+	}
+	app.CloudCredentials = &cc
+	if s.cloudBroker == nil {
+		return errors.New("cloud_credentials require a cloud broker (-cloud-broker-file)")
+	}
+	return s.cloudBroker.Check(cc)
+}
+
+// mintCloudCredentials sets the cloud credentials of a run in its env, overriding env vars of the
+// same name, and masks them in the run's log like resolved secrets.
+func (s *Server) mintCloudCredentials(runID int64, app config.App, env, sources map[string]string) error {
+	if app.CloudCredentials == nil {
+		return nil
+	}
+	if s.cloudBroker == nil {
+		return errors.New("no cloud broker is configured on this server")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cloudMintTimeout)
+	defer cancel()
+	creds, err := s.cloudBroker.Mint(ctx, fmt.Sprintf("noppflow-run-%d", runID), *app.CloudCredentials)
+	if err != nil {
+		return err
+	}
+	values := make([]string, 0, len(creds.Env))
+	for name, value := range creds.Env {
+		label := creds.Sources[name]
+		if _, ok := env[name]; ok {
+			label += ", overrides " + sources[name]
+		}
+		env[name] = value
+		sources[name] = label
+		values = append(values, value)
+	}
+	s.maskRunSecrets(runID, values)
+	return nil
+}
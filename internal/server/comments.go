@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxRunCommentLen = 2000
+
+// createRunComment attaches a comment to a run; any user who can see the run may comment.
+func (s *Server) createRunComment(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body is required"})
+		return
+	}
+	if len(body) > maxRunCommentLen {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be at most 2000 characters"})
+		return
+	}
+	user := authUserFromContext(r)
+	id, err := s.store.CreateRunComment(run.ID, user.Username, body)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	comment, err := s.store.GetRunComment(id)
+	if err != nil || comment == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load comment"})
+		return
+	}
+	writeJSON(w, http.StatusCreated, comment)
+}
+
+// deleteRunComment removes a comment; only its author or an admin may delete it.
+func (s *Server) deleteRunComment(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	commentID, err := strconv.ParseInt(chi.URLParam(r, "commentID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid comment id"})
+		return
+	}
+	comment, err := s.store.GetRunComment(commentID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if comment == nil || comment.RunID != run.ID {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "comment not found"})
+		return
+	}
+	user := authUserFromContext(r)
+	if !user.IsAdmin && comment.Author != user.Username {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the author or an admin can delete this comment"})
+		return
+	}
+	if err := s.store.DeleteRunComment(commentID); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "comment not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+const (
+	defaultAppCommits = 20
+	maxAppCommits     = 100
+	appCommitsTimeout = time.Minute
+)
+
+// appCommit is a commit listed by GET /api/apps/{appID}/commits with the latest run of the app
+// that checked it out.
+type appCommit struct {
+	pipeline.Commit
+	LastRun *store.Run `json:"last_run,omitempty"`
+}
+
+// listAppCommits returns the recent commits of the app's branch (?limit=, default 20, at most
+// 100), newest first, so users can pick the commit to run or roll back to.
+func (s *Server) listAppCommits(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	app, ok := s.findApp(appID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	if s.runner == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "this server has no runner to read commits with"})
+		return
+	}
+	limit := defaultAppCommits
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxAppCommits {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxAppCommits)})
+			return
+		}
+		limit = n
+	}
+	gitSSHCommand := ""
+	if strings.TrimSpace(app.SSHKeyName) != "" {
+		key, err := s.store.GetSSHKeyByName(app.SSHKeyName)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if key == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "configured ssh_key_name not found"})
+			return
+		}
+		keyPath, cleanup, err := writeTempSSHKey(key.PrivateKey)
+		defer cleanup()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to prepare ssh key"})
+			return
+		}
+		gitSSHCommand = buildGitSSHCommand(keyPath)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), appCommitsTimeout)
+	defer cancel()
+	commits, source, err := s.runner.RecentCommits(ctx, app, gitSSHCommand, limit)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	shas := make([]string, 0, len(commits))
+	for _, c := range commits {
+		shas = append(shas, c.SHA)
+	}
+	runs, err := s.store.LatestRunsByCommit(app.ID, shas)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	out := make([]appCommit, 0, len(commits))
+	for _, c := range commits {
+		ac := appCommit{Commit: c}
+		if run, ok := runs[c.SHA]; ok {
+			ac.LastRun = &run
+		}
+		out = append(out, ac)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"app_id": app.ID, "branch": app.Branch, "source": source, "commits": out})
+}
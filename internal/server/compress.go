@@ -0,0 +1,51 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// compressLevel is the gzip, deflate, and brotli level of compressed responses: most of the size
+// win of run JSON and logs at little CPU.
+const compressLevel = 5
+
+// compressibleTypes are the response types worth compressing: API JSON, logs, and the text
+// assets of the web UI. Images, archives, and artifact downloads are sent as they are.
+var compressibleTypes = []string{
+	"application/json",
+	"text/plain",
+	"text/html",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+// compressResponses compresses responses of compressibleTypes with brotli (preferred) or gzip,
+// as the client accepts. Streams are left alone: WebSocket upgrades and requests for
+// text/event-stream are passed through, since buffering in the encoder would hold back events.
+func compressResponses() func(http.Handler) http.Handler {
+	c := middleware.NewCompressor(compressLevel, compressibleTypes...)
+	c.SetEncoder("br", func(w io.Writer, level int) io.Writer {
+		return brotli.NewWriterLevel(w, level)
+	})
+	return func(next http.Handler) http.Handler {
+		compressed := c.Handler(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isStreamRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			compressed.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isStreamRequest reports whether r asks for a WebSocket or server-sent events stream.
+func isStreamRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, If-None-Match"
+	corsExposeHeaders = "ETag"
+	corsMaxAge        = "600"
+)
+
+// SetCORS lets browser frontends on other origins call the API. origins are scheme://host[:port]
+// origins or "*" (any origin, not allowed with credentials); with credentials the browser sends
+// the session cookie, which it only does for origins on the same site as the server.
+func (s *Server) SetCORS(origins []string, credentials bool) error {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+				return fmt.Errorf("invalid CORS origin %q (want scheme://host[:port])", origin)
+			}
+			origin = strings.ToLower(origin)
+		}
+		allowed[origin] = true
+	}
+	if allowed["*"] && credentials {
+		return fmt.Errorf("CORS origin * cannot be combined with credentials")
+	}
+	s.corsOrigins = allowed
+	s.corsCredentials = credentials
+	return nil
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin value for a request Origin, or "" when the
+// origin is not allowed.
+func (s *Server) corsOrigin(origin string) string {
+	switch {
+	case origin == "" || len(s.corsOrigins) == 0:
+		return ""
+	case s.corsOrigins[strings.ToLower(origin)]:
+		return origin
+	case s.corsOrigins["*"]:
+		return "*"
+	}
+	return ""
+}
+
+// cors adds the CORS headers for allowed origins and answers their preflight requests. Requests
+// from other origins get no CORS headers, so browsers keep blocking them.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(s.corsOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allow := s.corsOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if allow == "" {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allow)
+		if s.corsCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
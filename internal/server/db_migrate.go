@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// validateDBMigrateStep checks and normalizes a db_migrate step. The database lock is held by the
+// server process, so these steps cannot run in Kubernetes Jobs.
+func validateDBMigrateStep(app *config.App, step *config.Step) error {
+	m := step.DBMigrate
+	m.Tool = strings.ToLower(strings.TrimSpace(m.Tool))
+	switch m.Tool {
+	case "goose":
+		m.Driver = strings.TrimSpace(m.Driver)
+		if m.Driver == "" {
+			return fmt.Errorf("step %s: db_migrate driver is required for goose", step.Name)
+		}
+	case "flyway", "atlas":
+		if strings.TrimSpace(m.Driver) != "" {
+			return fmt.Errorf("step %s: db_migrate driver is only used by goose", step.Name)
+		}
+		m.Driver = ""
+	default:
+		return fmt.Errorf("step %s: db_migrate tool must be goose, flyway, or atlas", step.Name)
+	}
+	if appUsesK8sJob(*app) {
+		return fmt.Errorf("step %s: db_migrate steps cannot run as a Kubernetes Job (use runner local)", step.Name)
+	}
+	m.Dir = strings.TrimPrefix(strings.TrimSpace(m.Dir), "./")
+	if !validRepoRelativePath(m.Dir) {
+		return fmt.Errorf("step %s: db_migrate dir must be a relative path inside the repository", step.Name)
+	}
+	m.DSNEnv = strings.TrimSpace(m.DSNEnv)
+	if !validEnvVarName(m.DSNEnv) {
+		return fmt.Errorf("step %s: db_migrate dsn_env must be an env var name", step.Name)
+	}
+	m.LockKey = strings.TrimSpace(m.LockKey)
+	return nil
+}
+
+// lockDatabase is the pipeline.DatabaseLocker of local runs: one holder per key across all apps
+// of this server.
+func (s *Server) lockDatabase(ctx context.Context, step, key string) (func(), error) {
+	s.dbLocksMu.Lock()
+	l := s.dbLocks[key]
+	if l == nil {
+		l = make(chan struct{}, 1)
+		s.dbLocks[key] = l
+	}
+	s.dbLocksMu.Unlock()
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for database lock: %w", ctx.Err())
+	}
+}
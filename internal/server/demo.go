@@ -0,0 +1,231 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql/language/ast"
+
+	"noppflow/internal/auth"
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+)
+
+// demoGroup holds the demo users and gives them access to the demo apps.
+const demoGroup = "demo"
+
+// demoUsers are the read-only users seeded by SeedDemo; the password is the username.
+var demoUsers = []string{"demo", "viewer"}
+
+// DemoApps returns the example apps of demo mode. Their repositories do not exist, so they are
+// meant to be looked at (runs, logs, timelines) rather than run.
+func DemoApps() []config.App {
+	return []config.App{
+		{
+			ID: "storefront-web", Name: "Storefront Web", Repo: "https://git.example.com/shop/storefront-web.git", Branch: "main",
+			ExpectedDurationSec: 240,
+			Steps: []config.Step{
+				{Name: "install", Cmd: "npm ci"},
+				{Name: "lint", Cmd: "npm run lint"},
+				{Name: "test", Cmd: "npm test -- --ci"},
+				{Name: "build", Cmd: "npm run build", Artifacts: []string{"dist/**"}},
+			},
+		},
+		{
+			ID: "orders-api", Name: "Orders API", Repo: "https://git.example.com/shop/orders-api.git", Branch: "main",
+			Environment: "staging",
+			Steps: []config.Step{
+				{Name: "unit-tests", Cmd: "go test ./..."},
+				{Name: "image", Cmd: "docker build -t registry.example.com/shop/orders-api:$NOPPFLOW_COMMIT ."},
+				{Name: "deploy", Cmd: "kubectl -n shop-staging set image deployment/orders-api api=registry.example.com/shop/orders-api:$NOPPFLOW_COMMIT"},
+			},
+		},
+		{
+			ID: "nightly-backup", Name: "Nightly Backup", Repo: "https://git.example.com/ops/backup-scripts.git", Branch: "main",
+			Steps: []config.Step{
+				{Name: "dump", Script: "pg_dump \"$DATABASE_URL\" | gzip > backup.sql.gz"},
+				{Name: "upload", Cmd: "aws s3 cp backup.sql.gz s3://example-backups/$(date +%F).sql.gz"},
+			},
+		},
+	}
+}
+
+// demoStepOutput is the fake output of the demo steps by step name; demoStepFailure is the output
+// of a failing step.
+var demoStepOutput = map[string][]string{
+	"install": {"added 1284 packages, and audited 1285 packages in 21s", "found 0 vulnerabilities"},
+	"lint": {"> storefront-web@2.4.0 lint", "> eslint src --max-warnings 20",
+		"::warning file=src/cart/CartItem.tsx,line=41,title=react-hooks/exhaustive-deps::React Hook useEffect has a missing dependency: 'item.id'"},
+	"test": {"::group::Test suites", "PASS  src/cart/cart.test.ts", "PASS  src/checkout/address.test.ts",
+		"::endgroup::", "Tests:       214 passed, 214 total"},
+	"build":      {"vite v5.2.8 building for production...", "✓ 612 modules transformed.", "dist/assets/index-4f1c2a.js   182.41 kB │ gzip: 58.02 kB", "✓ built in 8.42s"},
+	"unit-tests": {"ok  \tshop/orders-api/internal/orders\t2.913s", "ok  \tshop/orders-api/internal/payments\t1.204s", "?   \tshop/orders-api/cmd/api\t[no test files]"},
+	"image": {"#1 [internal] load build definition from Dockerfile", "#8 [build 4/4] RUN go build -o /out/orders-api ./cmd/api",
+		"#11 exporting to image", "#11 naming to registry.example.com/shop/orders-api done"},
+	"deploy": {"deployment.apps/orders-api image updated", "Waiting for deployment \"orders-api\" rollout to finish: 1 of 3 updated replicas are available...",
+		"deployment \"orders-api\" successfully rolled out"},
+	"dump":   {"pg_dump: dumping contents of table \"public.orders\"", "pg_dump: dumping contents of table \"public.customers\""},
+	"upload": {"upload: ./backup.sql.gz to s3://example-backups/backup.sql.gz", "Completed 412.6 MiB"},
+}
+
+var demoStepFailure = map[string][]string{
+	"test": {"FAIL  src/checkout/payment.test.ts", "  ● payment › rejects expired cards",
+		"::error file=src/checkout/payment.test.ts,line=88::expect(received).toBe(expected) — Expected: \"declined\", Received: \"approved\"",
+		"Tests:       1 failed, 213 passed, 214 total"},
+	"deploy": {"deployment.apps/orders-api image updated", "error: deployment \"orders-api\" exceeded its progress deadline"},
+	"upload": {"upload failed: ./backup.sql.gz to s3://example-backups/backup.sql.gz",
+		"::error::An error occurred (RequestTimeout) when calling the UploadPart operation"},
+}
+
+// SetDemo switches demo mode: users that are not admins become read-only, so visitors can look
+// around the seeded apps and runs but not change anything.
+func (s *Server) SetDemo(enabled bool) {
+	s.demo = enabled
+}
+
+// demoReadOnly rejects requests that change something when demo mode is on and u is not an admin.
+// GraphQL requests pass; graphQL rejects their mutations (see demoGraphQLMutation).
+func (s *Server) demoReadOnly(w http.ResponseWriter, r *http.Request, u authUser) bool {
+	if !s.demo || u.IsAdmin || r.Method == http.MethodGet || r.Method == http.MethodHead || r.URL.Path == "/api/graphql" {
+		return false
+	}
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": "this is a read-only demo account"})
+	return true
+}
+
+// demoGraphQLMutation rejects a GraphQL mutation when demo mode is on and u is not an admin.
+func (s *Server) demoGraphQLMutation(w http.ResponseWriter, u authUser, operation string) bool {
+	if !s.demo || u.IsAdmin || operation != ast.OperationTypeMutation {
+		return false
+	}
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": "this is a read-only demo account"})
+	return true
+}
+
+// SeedDemo fills the store with the demo data: the read-only demo users in a group with access to
+// the demo apps, and a week of finished runs with logs for each demo app. It does nothing when
+// the demo users already exist, so restarting a demo server keeps its data.
+func (s *Server) SeedDemo() error {
+	if existing, err := s.store.GetUserByUsername(demoUsers[0]); err != nil || existing != nil {
+		return err
+	}
+	apps := DemoApps()
+	appIDs := make([]string, 0, len(apps))
+	for _, app := range apps {
+		appIDs = append(appIDs, app.ID)
+	}
+	groupID, err := s.store.CreateGroup(demoGroup)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetGroupApps(groupID, appIDs); err != nil {
+		return err
+	}
+	userIDs := make([]int64, 0, len(demoUsers))
+	for _, name := range demoUsers {
+		hash, err := auth.HashPassword(name)
+		if err != nil {
+			return err
+		}
+		id, err := s.store.CreateUser(name, hash, false)
+		if err != nil {
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	if err := s.store.SetGroupUsers(groupID, userIDs); err != nil {
+		return err
+	}
+
+	// A fixed seed keeps the demo the same on every fresh database.
+	rng := rand.New(rand.NewSource(1))
+	now := time.Now().UTC().Truncate(time.Second)
+	runs := 0
+	for _, app := range apps {
+		steps := app.EffectiveSteps()
+		for i := 9; i >= 0; i-- {
+			started := now.Add(-time.Duration(i)*17*time.Hour - time.Duration(rng.Intn(3600))*time.Second)
+			failAt := -1
+			if rng.Intn(4) == 0 {
+				failAt = demoFailingStep(steps)
+			}
+			sha := fmt.Sprintf("%016x%016x%08x", rng.Uint64(), rng.Uint64(), rng.Uint32())
+			runLog, ended := demoRunLog(rng, app, steps, sha, started, failAt)
+			status := "success"
+			if failAt >= 0 {
+				status = "failed"
+			}
+			triggeredBy := "webhook"
+			if rng.Intn(3) == 0 {
+				triggeredBy = demoUsers[rng.Intn(len(demoUsers))]
+			}
+			id, err := s.store.CreateFinishedRun(app.ID, sha, triggeredBy, status, started, ended)
+			if err != nil {
+				return err
+			}
+			if s.logStore != nil {
+				err = s.putRunLog(id, runLog)
+			} else {
+				err = s.store.UpdateRunLog(id, runLog)
+			}
+			if err != nil {
+				return err
+			}
+			runs++
+		}
+	}
+	log.Printf("demo: seeded %d apps, %d runs, and read-only users %s (password = username)", len(apps), runs, strings.Join(demoUsers, ", "))
+	return nil
+}
+
+// demoFailingStep picks the step a failed demo run fails in: one with failure output, else the last.
+func demoFailingStep(steps []config.Step) int {
+	for i, step := range steps {
+		if _, ok := demoStepFailure[step.Name]; ok {
+			return i
+		}
+	}
+	return len(steps) - 1
+}
+
+// demoRunLog renders the log of a demo run the way the Runner writes it (timestamped lines,
+// checkout, step headers and results) and returns it with the time the run ended.
+func demoRunLog(rng *rand.Rand, app config.App, steps []config.Step, sha string, started time.Time, failAt int) (string, time.Time) {
+	var b strings.Builder
+	t := started.Add(time.Duration(500+rng.Intn(1500)) * time.Millisecond)
+	line := func(format string, args ...interface{}) {
+		b.WriteString(t.Format(pipeline.LogTimestampLayout))
+		b.WriteByte(' ')
+		fmt.Fprintf(&b, format+"\n", args...)
+		t = t.Add(time.Duration(50+rng.Intn(400)) * time.Millisecond)
+	}
+	line("checkout: branch %s", app.Branch)
+	t = t.Add(time.Duration(1+rng.Intn(4)) * time.Second)
+	line("commit: %s", sha)
+	for i, step := range steps {
+		if failAt >= 0 && i > failAt {
+			line("%s step skipped (previous step failed)", step.Name)
+			continue
+		}
+		line("=== Step: %s ===", step.Name)
+		output := demoStepOutput[step.Name]
+		if i == failAt && demoStepFailure[step.Name] != nil {
+			output = demoStepFailure[step.Name]
+		}
+		for _, out := range output {
+			t = t.Add(time.Duration(rng.Intn(20)) * time.Second)
+			line("%s", out)
+		}
+		t = t.Add(time.Duration(2+rng.Intn(40)) * time.Second)
+		if i == failAt {
+			line("%s step failed: exit status 1", step.Name)
+		} else {
+			line("%s step OK", step.Name)
+		}
+	}
+	return b.String(), t
+}
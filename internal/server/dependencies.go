@@ -0,0 +1,223 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+)
+
+// dependencyTrainPrefix starts the train name of deploys with dependencies ("deps:<app id>"). It
+// cannot clash with configured trains, whose names have no colon.
+const dependencyTrainPrefix = "deps:"
+
+// validateDependsOn checks and normalizes an app's depends_on. Like downstream triggers, whether
+// the apps exist is checked when a deploy with dependencies starts.
+func validateDependsOn(app *config.App) error {
+	seen := make(map[string]bool, len(app.DependsOn))
+	deps := make([]string, 0, len(app.DependsOn))
+	for _, id := range app.DependsOn {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			return fmt.Errorf("depends_on must not contain empty app IDs")
+		}
+		if id == app.ID {
+			return fmt.Errorf("app cannot depend on itself")
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate depends_on app %s", id)
+		}
+		seen[id] = true
+		deps = append(deps, id)
+	}
+	app.DependsOn = nil
+	if len(deps) > 0 {
+		app.DependsOn = deps
+	}
+	return nil
+}
+
+// dependencyCycle returns a cycle of depends_on among apps (see appCycle), or nil.
+func dependencyCycle(apps []config.App) []string {
+	return appCycle(apps, func(app config.App) []string { return app.DependsOn })
+}
+
+// checkDependencyCycle rejects apps whose dependencies form a cycle.
+func checkDependencyCycle(apps []config.App) error {
+	if cycle := dependencyCycle(apps); cycle != nil {
+		return fmt.Errorf("depends_on forms a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// dependencyStages returns the stages of a deploy of appID with its dependencies: the apps it
+// depends on, directly or not, grouped so that each app's dependencies are all in earlier stages,
+// and appID alone in the last stage. Apps of a stage do not depend on each other.
+func dependencyStages(apps []config.App, appID string) ([]config.TrainStage, error) {
+	byID := make(map[string]config.App, len(apps))
+	for _, app := range apps {
+		byID[app.ID] = app
+	}
+	if cycle := dependencyCycle(apps); cycle != nil {
+		return nil, fmt.Errorf("depends_on forms a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	// level is the length of the longest dependency chain below an app.
+	level := make(map[string]int)
+	var visit func(id, from string) (int, error)
+	visit = func(id, from string) (int, error) {
+		if l, ok := level[id]; ok {
+			return l, nil
+		}
+		app, ok := byID[id]
+		if !ok {
+			return 0, fmt.Errorf("app %s (a dependency of %s) not found", id, from)
+		}
+		if app.Archived {
+			return 0, fmt.Errorf("app %s is archived", id)
+		}
+		l := 0
+		for _, dep := range app.DependsOn {
+			dl, err := visit(dep, id)
+			if err != nil {
+				return 0, err
+			}
+			if dl+1 > l {
+				l = dl + 1
+			}
+		}
+		level[id] = l
+		return l, nil
+	}
+	top, err := visit(appID, "")
+	if err != nil {
+		return nil, err
+	}
+	stages := make([]config.TrainStage, top+1)
+	for id, l := range level {
+		stages[l].Apps = append(stages[l].Apps, id)
+	}
+	for i := range stages {
+		sort.Strings(stages[i].Apps)
+		stages[i].Name = fmt.Sprintf("stage %d", i+1)
+	}
+	return stages, nil
+}
+
+// dependencyTrain returns the train that deploys appID with its dependencies.
+func (s *Server) dependencyTrain(appID string) (config.Train, error) {
+	s.appsMu.RLock()
+	stages, err := dependencyStages(s.apps, appID)
+	s.appsMu.RUnlock()
+	if err != nil {
+		return config.Train{}, err
+	}
+	return config.Train{Name: dependencyTrainPrefix + appID, Stages: stages}, nil
+}
+
+// trainOfRun returns the train a train run runs: a configured train, or the current dependency
+// train of a deploy with dependencies.
+func (s *Server) trainOfRun(name string) (config.Train, bool) {
+	if appID, ok := strings.CutPrefix(name, dependencyTrainPrefix); ok {
+		train, err := s.dependencyTrain(appID)
+		return train, err == nil
+	}
+	return s.findTrain(name)
+}
+
+type dependencyGraphApp struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	DependsOn  []string `json:"depends_on"`
+	Dependents []string `json:"dependents"`
+}
+
+// getDependencyGraph returns the dependency graph of the apps the user can access: each app with
+// the apps it depends on and those depending on it, and edges from an app to its dependencies.
+// Edges to apps the user cannot see are left out; cycle lists a cycle of hand-edited config.
+func (s *Server) getDependencyGraph(w http.ResponseWriter, r *http.Request) {
+	user := authUserFromContext(r)
+	var allowed map[string]struct{}
+	if !user.IsAdmin {
+		var err error
+		if allowed, _, err = s.allowedAppIDsForUser(user.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	s.appsMu.RLock()
+	apps := append([]config.App(nil), s.apps...)
+	s.appsMu.RUnlock()
+	visible := make(map[string]*dependencyGraphApp)
+	nodes := make([]*dependencyGraphApp, 0, len(apps))
+	for _, app := range apps {
+		if _, ok := allowed[app.ID]; !ok && allowed != nil {
+			continue
+		}
+		node := &dependencyGraphApp{ID: app.ID, Name: app.Name, DependsOn: []string{}, Dependents: []string{}}
+		visible[app.ID] = node
+		nodes = append(nodes, node)
+	}
+	type edge struct {
+		App       string `json:"app"`
+		DependsOn string `json:"depends_on"`
+	}
+	edges := make([]edge, 0)
+	for _, app := range apps {
+		node := visible[app.ID]
+		if node == nil {
+			continue
+		}
+		for _, dep := range app.DependsOn {
+			if target := visible[dep]; target != nil {
+				node.DependsOn = append(node.DependsOn, dep)
+				target.Dependents = append(target.Dependents, app.ID)
+				edges = append(edges, edge{App: app.ID, DependsOn: dep})
+			}
+		}
+	}
+	out := map[string]interface{}{"apps": nodes, "edges": edges}
+	if cycle := dependencyCycle(apps); cycle != nil {
+		out["cycle"] = cycle
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// deployWithDependencies starts a train run that deploys the app after its dependencies, stage
+// by stage (see dependencyStages); a failed run stops it before the stages after it. The user
+// needs access to every app of the train.
+func (s *Server) deployWithDependencies(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	user := authUserFromContext(r)
+	if !s.canEditApp(w, user, appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	train, err := s.dependencyTrain(appID)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	allowed, err := s.userCanAccessTrain(user, train)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if !allowed {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to all dependencies of this app"})
+		return
+	}
+	id, err := s.store.CreateTrainRun(train.Name, user.Username, nil)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	go s.driveTrainRun(id)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"train_run_id": id, "status": "running", "stages": train.Stages})
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// maxDownstreamDepth bounds a chain of runs started by downstream triggers.
+const maxDownstreamDepth = 10
+
+// validateDownstream checks and normalizes an app's downstream triggers. Whether the apps exist is
+// checked when a trigger fires, so apps can be created in any order.
+func validateDownstream(app *config.App) error {
+	seen := make(map[string]bool, len(app.Downstream))
+	for i := range app.Downstream {
+		t := &app.Downstream[i]
+		t.App = strings.TrimSpace(t.App)
+		t.On = strings.ToLower(strings.TrimSpace(t.On))
+		if t.App == "" {
+			return fmt.Errorf("each downstream trigger needs an app")
+		}
+		if t.App == app.ID {
+			return fmt.Errorf("downstream app %s is the app itself", t.App)
+		}
+		if seen[t.App] {
+			return fmt.Errorf("duplicate downstream app %s", t.App)
+		}
+		seen[t.App] = true
+		switch t.On {
+		case "", "success", "failure", "always":
+		default:
+			return fmt.Errorf("downstream app %s: on must be success, failure, or always", t.App)
+		}
+	}
+	return nil
+}
+
+// addedDownstreamApps returns the downstream apps of updated that current does not trigger yet.
+func addedDownstreamApps(current, updated config.App) []string {
+	var added []string
+	for _, t := range updated.Downstream {
+		if !slices.ContainsFunc(current.Downstream, func(c config.DownstreamTrigger) bool { return c.App == t.App }) {
+			added = append(added, t.App)
+		}
+	}
+	return added
+}
+
+// downstreamCycle returns a cycle of downstream triggers among apps as the app IDs along it
+// (first and last are the same), or nil when there is none.
+func downstreamCycle(apps []config.App) []string {
+	return appCycle(apps, func(app config.App) []string {
+		ids := make([]string, 0, len(app.Downstream))
+		for _, t := range app.Downstream {
+			ids = append(ids, t.App)
+		}
+		return ids
+	})
+}
+
+// appCycle returns a cycle in the graph whose edges lead from each app to the IDs next returns
+// for it, as the app IDs along the cycle (first and last are the same), or nil.
+func appCycle(apps []config.App, next func(app config.App) []string) []string {
+	edges := make(map[string][]string, len(apps))
+	for _, app := range apps {
+		edges[app.ID] = next(app)
+	}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(edges))
+	var path []string
+	var visit func(id string) []string
+	visit = func(id string) []string {
+		switch state[id] {
+		case visiting:
+			for i, p := range path {
+				if p == id {
+					return append(append([]string{}, path[i:]...), id)
+				}
+			}
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		path = append(path, id)
+		for _, to := range edges[id] {
+			if cycle := visit(to); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = done
+		return nil
+	}
+	for _, app := range apps {
+		if cycle := visit(app.ID); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// checkDownstreamCycle rejects apps whose downstream triggers form a cycle.
+func checkDownstreamCycle(apps []config.App) error {
+	if cycle := downstreamCycle(apps); cycle != nil {
+		return fmt.Errorf("downstream triggers form a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// upstreamChain returns the app IDs of the runs that led to runID through downstream triggers,
+// runID's own app first.
+func (s *Server) upstreamChain(runID int64) ([]string, error) {
+	var chain []string
+	for id := runID; id != 0 && len(chain) <= maxDownstreamDepth; {
+		run, err := s.store.GetRun(id)
+		if err != nil || run == nil {
+			return chain, err
+		}
+		chain = append(chain, run.AppID)
+		id = run.TriggeredByRunID
+	}
+	return chain, nil
+}
+
+// triggerDownstream starts the downstream runs of a finished run of app. A downstream app that
+// already ran in the chain leading to the run is skipped, as are chains longer than
+// maxDownstreamDepth, so a cycle in hand-edited config cannot loop.
+func (s *Server) triggerDownstream(runID int64, app config.App, status, commitSHA string) {
+	var chain []string
+	for _, t := range app.Downstream {
+		if !t.Fires(status) {
+			continue
+		}
+		if chain == nil {
+			var err error
+			if chain, err = s.upstreamChain(runID); err != nil {
+				log.Printf("run %d: downstream triggers: %v", runID, err)
+				return
+			}
+		}
+		if len(chain) > maxDownstreamDepth {
+			log.Printf("run %d: downstream triggers skipped: chain is longer than %d runs", runID, maxDownstreamDepth)
+			return
+		}
+		if slices.Contains(chain, t.App) {
+			log.Printf("run %d: downstream app %s skipped: it already ran in this chain (%s)", runID, t.App, strings.Join(chain, " <- "))
+			continue
+		}
+		target, ok := s.findApp(t.App)
+		if !ok {
+			log.Printf("run %d: downstream app %s not found", runID, t.App)
+			continue
+		}
+		newID, _, err := s.queueRun(target, "upstream:"+app.ID, map[string]string{
+			"NOPPFLOW_UPSTREAM_APP":    app.ID,
+			"NOPPFLOW_UPSTREAM_RUN_ID": strconv.FormatInt(runID, 10),
+			"NOPPFLOW_UPSTREAM_STATUS": status,
+			"NOPPFLOW_UPSTREAM_COMMIT": commitSHA,
+		}, false, runLink{upstreamRunID: runID})
+		if err != nil {
+			log.Printf("run %d: start downstream app %s: %v", runID, t.App, err)
+			continue
+		}
+		log.Printf("run %d: started downstream run %d of %s", runID, newID, t.App)
+	}
+}
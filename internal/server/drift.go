@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+const (
+	// driftCheckTimeout bounds the kubectl and helm calls of one app's drift check.
+	driftCheckTimeout = 2 * time.Minute
+	// maxDriftDiffLen bounds the diff kept for a drifted app.
+	maxDriftDiffLen = 64 << 10
+	// lastAppliedAnnotation holds the configuration `kubectl apply` last applied to an object.
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// appDeploysWithDiff reports whether drift detection covers the app: it deploys with kubectl or
+// helm (GitOps controllers watch for drift themselves).
+func appDeploysWithDiff(app config.App) bool {
+	return app.DeployMode == "kubectl" || app.DeployMode == "helm"
+}
+
+// recordAppDeploy stores a successful run as the app's last deploy, with the resources its
+// k8s_deploy steps applied, when one of those steps ran.
+func (s *Server) recordAppDeploy(runID int64, app config.App, runLog string) {
+	if !appDeploysWithDiff(app) {
+		return
+	}
+	deploySteps := make(map[string]bool)
+	post := app.EffectivePost()
+	for _, steps := range [][]config.Step{app.EffectiveSteps(), post.OnSuccess, post.OnFailure, post.Always} {
+		for _, step := range steps {
+			if step.Kind() == "k8s_deploy" {
+				deploySteps[step.Name] = true
+			}
+		}
+	}
+	ran := false
+	for _, chunk := range pipeline.SplitLogChunks(runLog) {
+		ran = ran || deploySteps[chunk.Step]
+	}
+	if !ran {
+		return
+	}
+	var resources []string
+	if app.DeployMode == "kubectl" {
+		if resources = pipeline.ParseAppliedResources(runLog, deploySteps); len(resources) == 0 {
+			log.Printf("run %d: no applied resources found in the kubectl output; drift detection skips %s", runID, app.ID)
+			return
+		}
+	}
+	if err := s.store.SetAppDeployed(app.ID, runID, resources); err != nil {
+		log.Printf("run %d: record deploy: %v", runID, err)
+	}
+}
+
+// driftDiff returns the `kubectl diff` between what an app last deployed and the live cluster,
+// "" when they match (a var for tests).
+var driftDiff = func(ctx context.Context, app config.App, resources []string) (string, error) {
+	var manifest string
+	var err error
+	if app.DeployMode == "helm" {
+		manifest, err = helmReleaseManifest(ctx, app)
+	} else {
+		manifest, err = lastAppliedManifest(ctx, app, resources)
+	}
+	if err != nil || strings.TrimSpace(manifest) == "" {
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, "kubectl", "-n", app.K8sNamespace, "diff", "-f", "-")
+	cmd.Stdin = strings.NewReader(manifest)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		// kubectl diff exits 1 when it found differences.
+		return stdout.String(), nil
+	default:
+		return "", fmt.Errorf("kubectl diff: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+}
+
+// helmReleaseManifest returns the manifest of the app's helm release as last installed.
+func helmReleaseManifest(ctx context.Context, app config.App) (string, error) {
+	cmd := exec.CommandContext(ctx, "helm", "get", "manifest", app.ID, "-n", app.K8sNamespace)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("helm get manifest %s: %v: %s", app.ID, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// lastAppliedManifest returns the configurations `kubectl apply` last applied to resources, as
+// a YAML stream. A deleted resource fails the check; resources without the annotation (server-side
+// apply) are skipped.
+func lastAppliedManifest(ctx context.Context, app config.App, resources []string) (string, error) {
+	var docs []string
+	for _, res := range resources {
+		cmd := exec.CommandContext(ctx, "kubectl", "-n", app.K8sNamespace, "get", res, "-o", "json", "--ignore-not-found")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("kubectl get %s: %v: %s", res, err, strings.TrimSpace(stderr.String()))
+		}
+		if len(bytes.TrimSpace(out)) == 0 {
+			return "", fmt.Errorf("%s no longer exists", res)
+		}
+		var obj struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(out, &obj); err != nil {
+			return "", fmt.Errorf("kubectl get %s: %v", res, err)
+		}
+		if applied := obj.Metadata.Annotations[lastAppliedAnnotation]; applied != "" {
+			docs = append(docs, applied)
+		}
+	}
+	return strings.Join(docs, "\n---\n"), nil
+}
+
+// checkAppDrift compares the live cluster against the app's recorded deploy and stores the
+// result. An app that starts or stops drifting sends app.drifted or app.drift_resolved, recorded
+// on the timeline of the deploy run.
+func (s *Server) checkAppDrift(app config.App, rec store.AppDrift) (*store.AppDrift, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), driftCheckTimeout)
+	defer cancel()
+	diff, err := driftDiff(ctx, app, rec.Resources)
+	status, errMsg := store.DriftInSync, ""
+	switch {
+	case err != nil:
+		status, errMsg, diff = store.DriftError, err.Error(), ""
+	case diff != "":
+		status = store.DriftDrifted
+		if len(diff) > maxDriftDiffLen {
+			diff = diff[:maxDriftDiffLen] + "\n[diff truncated]\n"
+		}
+	}
+	if err := s.store.SetAppDriftResult(app.ID, rec.DeployRunID, status, diff, errMsg, time.Now().UTC()); storeErrNoRows(err) {
+		// Deployed again while checking; the next check covers the new deploy.
+		return s.store.GetAppDrift(app.ID)
+	} else if err != nil {
+		return nil, err
+	}
+	if status == store.DriftDrifted && rec.Status != store.DriftDrifted {
+		go s.notify(app, notification{Event: "app.drifted", RunID: rec.DeployRunID, Message: fmt.Sprintf("the cluster state of %s no longer matches its deploy by run %d", app.ID, rec.DeployRunID)})
+	} else if status == store.DriftInSync && rec.Status == store.DriftDrifted {
+		go s.notify(app, notification{Event: "app.drift_resolved", RunID: rec.DeployRunID, Message: fmt.Sprintf("the cluster state of %s matches its deploy by run %d again", app.ID, rec.DeployRunID)})
+	}
+	return s.store.GetAppDrift(app.ID)
+}
+
+// checkAllDrift checks every app with a recorded kubectl or helm deploy that is still configured
+// so (on the leader only when leader election is on).
+func (s *Server) checkAllDrift() {
+	if !s.isLeader() {
+		return
+	}
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return
+	}
+	records, err := s.store.ListAppDrift(nil)
+	if err != nil {
+		log.Printf("drift: list deploys: %v", err)
+		return
+	}
+	for _, rec := range records {
+		app, found := s.findApp(rec.AppID)
+		if !found || app.Archived || !appDeploysWithDiff(app) {
+			continue
+		}
+		if _, err := s.checkAppDrift(app, rec); err != nil {
+			log.Printf("drift: %s: %v", app.ID, err)
+		}
+	}
+}
+
+// StartDriftDetector checks every interval whether the cluster state of apps deployed with
+// kubectl or helm still matches their last deploy. It returns immediately; interval <= 0
+// disables it.
+func (s *Server) StartDriftDetector(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.checkAllDrift()
+		}
+	}()
+}
+
+// driftedAppIDs returns the drifted apps among appIDs (nil = all), for the status endpoint.
+func (s *Server) driftedAppIDs(appIDs []string) ([]string, error) {
+	records, err := s.store.ListAppDrift(appIDs)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0)
+	for _, rec := range records {
+		if rec.Status == store.DriftDrifted {
+			out = append(out, rec.AppID)
+		}
+	}
+	return out, nil
+}
+
+// listAppDrift serves GET /api/drift: the drift records of the apps the user can access
+// (?status= filters them).
+func (s *Server) listAppDrift(w http.ResponseWriter, r *http.Request) {
+	appIDs, err := s.provenanceAppIDs(authUserFromContext(r))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	records, err := s.store.ListAppDrift(appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if status := strings.TrimSpace(r.URL.Query().Get("status")); status != "" {
+		filtered := make([]store.AppDrift, 0)
+		for _, rec := range records {
+			if rec.Status == status {
+				filtered = append(filtered, rec)
+			}
+		}
+		records = filtered
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// getAppDrift serves GET /api/apps/{appID}/drift.
+func (s *Server) getAppDrift(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	rec, err := s.store.GetAppDrift(appID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if rec == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no kubectl or helm deploy recorded for this app"})
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// checkAppDriftNow serves POST /api/apps/{appID}/drift/check: it checks the app at once and
+// returns the new record.
+func (s *Server) checkAppDriftNow(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	app, found := s.findApp(appID)
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	if !appDeploysWithDiff(app) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "drift detection needs deploy_mode kubectl or helm"})
+		return
+	}
+	rec, err := s.store.GetAppDrift(appID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if rec == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "no kubectl or helm deploy recorded for this app"})
+		return
+	}
+	if rec, err = s.checkAppDrift(app, *rec); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+)
+
+// maskedValue replaces secret values in env previews.
+const maskedValue = "********"
+
+// effectiveEnvVar is one variable of an env preview. Unresolved lists the $NAME references of a
+// step env value that no variable defines.
+type effectiveEnvVar struct {
+	Name       string   `json:"name"`
+	Value      string   `json:"value"`
+	Source     string   `json:"source"`
+	Masked     bool     `json:"masked,omitempty"`
+	Unresolved []string `json:"unresolved,omitempty"`
+}
+
+// effectiveStepEnv is the env a step adds on top of the run env.
+type effectiveStepEnv struct {
+	Step    string            `json:"step"`
+	Section string            `json:"section"`
+	Env     []effectiveEnvVar `json:"env"`
+}
+
+// getEffectiveEnv returns the env a new run of the app would receive: global env vars (values
+// masked), app env, variables set by app options (log_color, registries), and per step the
+// step env resolved against them. Values set only when the run starts (NOPPFLOW_* of triggers
+// and promotions, one-off run env) are not included.
+func (s *Server) getEffectiveEnv(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	app, ok := s.findApp(appID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	vars, err := s.store.ListGlobalEnvVars()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	// visible is the run env as shown: global values are masked, also inside step env values
+	// that reference them.
+	visible := make(map[string]string, len(vars)+len(app.Env))
+	byName := make(map[string]effectiveEnvVar, len(vars)+len(app.Env))
+	for _, v := range vars {
+		visible[v.Name] = maskedValue
+		byName[v.Name] = effectiveEnvVar{Name: v.Name, Value: maskedValue, Source: "global", Masked: true}
+	}
+	for name, value := range app.Env {
+		source := "app"
+		if _, ok := byName[name]; ok {
+			source = "app, overrides global"
+		}
+		visible[name] = value
+		byName[name] = effectiveEnvVar{Name: name, Value: value, Source: source}
+	}
+	if app.LogColor {
+		for name, value := range pipeline.ColorEnv {
+			if _, ok := byName[name]; !ok {
+				visible[name] = value
+				byName[name] = effectiveEnvVar{Name: name, Value: value, Source: "log_color"}
+			}
+		}
+	}
+	if len(app.Registries) > 0 {
+		for name := range registryLoginEnv("") {
+			visible[name] = "(per run)"
+			byName[name] = effectiveEnvVar{Name: name, Value: "(per run)", Source: "registries"}
+		}
+	}
+	env := make([]effectiveEnvVar, 0, len(byName))
+	for _, v := range byName {
+		env = append(env, v)
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+
+	steps := make([]effectiveStepEnv, 0)
+	post := app.EffectivePost()
+	sections := []struct {
+		name  string
+		steps []config.Step
+	}{{"steps", app.EffectiveSteps()}, {"on_success", post.OnSuccess}, {"on_failure", post.OnFailure}, {"always", post.Always}}
+	for _, section := range sections {
+		for _, step := range section.steps {
+			if len(step.Env) == 0 {
+				continue
+			}
+			resolved := step.ResolveEnv(visible)
+			stepEnv := effectiveStepEnv{Step: step.Name, Section: section.name, Env: make([]effectiveEnvVar, 0, len(step.Env))}
+			for _, name := range pipeline.SortedKeys(step.Env) {
+				source := "step"
+				if _, ok := visible[name]; ok {
+					source = "step, overrides " + byName[name].Source
+				}
+				stepEnv.Env = append(stepEnv.Env, effectiveEnvVar{
+					Name:       name,
+					Value:      resolved[name],
+					Source:     source,
+					Unresolved: config.UnresolvedEnvRefs(step.Env[name], visible),
+				})
+			}
+			steps = append(steps, stepEnv)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"app_id": app.ID, "env": env, "steps": steps})
+}
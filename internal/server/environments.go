@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+// findEnvironment returns the protection rules of an environment, or nil when it has none.
+func (s *Server) findEnvironment(name string) *config.Environment {
+	for i := range s.environments {
+		if s.environments[i].Name == name {
+			return &s.environments[i]
+		}
+	}
+	return nil
+}
+
+// checkEnvironment returns an error when a deploy of the app to its environment is not allowed at
+// now: the app branch is not allowed, or a recurring or declared freeze is active.
+func (s *Server) checkEnvironment(app config.App, now time.Time) error {
+	env := s.findEnvironment(app.Environment)
+	if env != nil {
+		if len(env.Branches) > 0 && !config.MatchAny(env.Branches, app.Branch) {
+			return fmt.Errorf("environment %s only accepts deploys from branch %s (app branch is %s)",
+				env.Name, strings.Join(env.Branches, ", "), app.Branch)
+		}
+		if w := env.FrozenBy(now); w != "" {
+			return fmt.Errorf("environment %s is frozen %s %s (now %s)",
+				env.Name, w, env.Location(), now.In(env.Location()).Format("Mon 15:04"))
+		}
+	}
+	freezes, err := s.store.ListDeployFreezes(now)
+	if err != nil {
+		return fmt.Errorf("environment check: %w", err)
+	}
+	for _, f := range freezes {
+		if !f.Active(app.Environment, now) {
+			continue
+		}
+		msg := fmt.Sprintf("environment %s is frozen until %s", app.Environment, f.EndsAt.UTC().Format(time.RFC3339))
+		if f.Reason != "" {
+			msg += ": " + f.Reason
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// deployGuard returns the guard of a run's deploy steps, or nil when the app has no environment.
+// Each deploy step is checked with checkEnvironment; with approver groups, the first one waits
+// for a member of a group to approve the deploy.
+func (s *Server) deployGuard(runID int64, app config.App) pipeline.DeployGuard {
+	if app.Environment == "" {
+		return nil
+	}
+	approved := false
+	return func(ctx context.Context, step string, logf func(format string, args ...interface{})) error {
+		if err := s.checkEnvironment(app, time.Now()); err != nil {
+			go s.notify(app, notification{Event: "run.deploy_blocked", RunID: runID, Message: err.Error()})
+			return err
+		}
+		env := s.findEnvironment(app.Environment)
+		if env == nil || len(env.ApproverGroups) == 0 || approved {
+			return nil
+		}
+		logf("%s: waiting for deploy approval by members of %s", step, strings.Join(env.ApproverGroups, ", "))
+		plan := fmt.Sprintf("deploy %s (branch %s) to environment %s", app.ID, app.Branch, env.Name)
+		actx, cancel := context.WithTimeout(ctx, env.ApprovalTimeout())
+		err := s.awaitApproval(actx, runID, app, step, "deploy", plan, env.ApproverGroups)
+		cancel()
+		if err != nil {
+			return err
+		}
+		approved = true
+		logf("%s: deploy approved", step)
+		// A freeze may have started while the deploy waited.
+		if err := s.checkEnvironment(app, time.Now()); err != nil {
+			go s.notify(app, notification{Event: "run.deploy_blocked", RunID: runID, Message: err.Error()})
+			return err
+		}
+		return nil
+	}
+}
+
+// guardK8sJob applies the deploy guard of an app running as a Kubernetes Job before the Job is
+// created, since its steps run outside this process; it does nothing for local runs. Waiting is
+// reported through onLogUpdate.
+func (s *Server) guardK8sJob(runID int64, app config.App, onLogUpdate func(string)) error {
+	guard := s.deployGuard(runID, app)
+	if guard == nil || !appUsesK8sJob(app) || !appHasDeploySteps(app) {
+		return nil
+	}
+	var log strings.Builder
+	return guard(context.Background(), "deploy", func(format string, args ...interface{}) {
+		fmt.Fprintf(&log, format+"\n", args...)
+		onLogUpdate(log.String())
+	})
+}
+
+// listEnvironments returns the protection rules of all environments.
+func (s *Server) listEnvironments(w http.ResponseWriter, r *http.Request) {
+	envs := s.environments
+	if envs == nil {
+		envs = []config.Environment{}
+	}
+	writeJSON(w, http.StatusOK, envs)
+}
+
+// listFreezes returns the current and upcoming deploy freezes.
+func (s *Server) listFreezes(w http.ResponseWriter, r *http.Request) {
+	freezes, err := s.store.ListDeployFreezes(time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, freezes)
+}
+
+type createFreezeRequest struct {
+	Environment string     `json:"environment"`
+	StartsAt    *time.Time `json:"starts_at"`
+	EndsAt      time.Time  `json:"ends_at"`
+	Reason      string     `json:"reason"`
+}
+
+// createFreeze declares a deploy freeze (admin). starts_at defaults to now.
+func (s *Server) createFreeze(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req createFreezeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	f := store.DeployFreeze{
+		Environment: strings.TrimSpace(req.Environment),
+		StartsAt:    time.Now(),
+		EndsAt:      req.EndsAt,
+		Reason:      strings.TrimSpace(req.Reason),
+		CreatedBy:   user.Username,
+	}
+	if req.StartsAt != nil {
+		f.StartsAt = *req.StartsAt
+	}
+	if f.Environment != "*" && !config.ValidEnvironmentName(f.Environment) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "environment must be an environment name or *"})
+		return
+	}
+	if !f.EndsAt.After(f.StartsAt) || !f.EndsAt.After(time.Now()) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ends_at must be in the future and after starts_at"})
+		return
+	}
+	id, err := s.store.CreateDeployFreeze(f)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	f.ID = id
+	f.StartsAt, f.EndsAt = f.StartsAt.UTC(), f.EndsAt.UTC()
+	f.CreatedAt = time.Now().UTC()
+	writeJSON(w, http.StatusCreated, f)
+}
+
+// deleteFreeze lifts a deploy freeze (admin).
+func (s *Server) deleteFreeze(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "freezeID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid freeze id"})
+		return
+	}
+	if err := s.store.DeleteDeployFreeze(id); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "freeze not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
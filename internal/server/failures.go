@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+const (
+	// failureScanBytes is how much of the end of a failed run's log the failure rules see.
+	failureScanBytes = 1 << 20
+	// unclassifiedFailure is the reason reported for failed runs that matched no rule.
+	unclassifiedFailure = "unclassified"
+	maxFailureStatsDays = 365
+)
+
+// SetFailureRules sets the rules that label failed runs (see config.LoadFailureRules). New
+// starts with config.DefaultFailureRules.
+func (s *Server) SetFailureRules(rules []config.FailureRule) {
+	s.failureRules = rules
+}
+
+// classifyFailure labels a failed run with the reason of the first failure rule matching the end
+// of its log and returns the reason ("" when none matched).
+func (s *Server) classifyFailure(runID int64, runLog string) string {
+	if len(runLog) > failureScanBytes {
+		runLog = runLog[len(runLog)-failureScanBytes:]
+	}
+	reason := config.ClassifyFailure(s.failureRules, runLog)
+	if reason == "" {
+		return ""
+	}
+	if err := s.store.SetRunFailureReason(runID, reason); err != nil {
+		log.Printf("set failure reason of run %d: %v", runID, err)
+	}
+	return reason
+}
+
+// failureReasonStat is the number of failed runs with a reason.
+type failureReasonStat struct {
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+// getFailureStats serves GET /api/stats/failures: the failed runs of the last ?days= (default 30)
+// of the apps the user can access (or ?app_id=), counted by failure reason overall and per app.
+func (s *Server) getFailureStats(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxFailureStatsDays {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "days must be between 1 and 365"})
+			return
+		}
+		days = n
+	}
+	user := authUserFromContext(r)
+	var appIDs []string
+	if appID := strings.TrimSpace(r.URL.Query().Get("app_id")); appID != "" {
+		if !s.appExists(appID) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+			return
+		}
+		if !user.IsAdmin {
+			ok, err := s.userCanAccessApp(user.ID, appID)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !ok {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to this app"})
+				return
+			}
+		}
+		appIDs = []string{appID}
+	} else if !user.IsAdmin {
+		var err error
+		if _, appIDs, err = s.allowedAppIDsForUser(user.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if appIDs == nil {
+			appIDs = []string{}
+		}
+	}
+	counts, err := s.store.FailureReasonCounts(appIDs, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	var total int64
+	byReason := make(map[string]int64)
+	for i := range counts {
+		if counts[i].Reason == "" {
+			counts[i].Reason = unclassifiedFailure
+		}
+		byReason[counts[i].Reason] += counts[i].Count
+		total += counts[i].Count
+	}
+	reasons := make([]failureReasonStat, 0, len(byReason))
+	for reason, n := range byReason {
+		reasons = append(reasons, failureReasonStat{Reason: reason, Count: n})
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if reasons[i].Count != reasons[j].Count {
+			return reasons[i].Count > reasons[j].Count
+		}
+		return reasons[i].Reason < reasons[j].Reason
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"days": days, "failed": total, "reasons": reasons, "apps": counts})
+}
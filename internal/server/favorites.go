@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// addFavorite pins an app for the current user; the user must be able to access the app.
+func (s *Server) addFavorite(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	user := authUserFromContext(r)
+	if !s.canEditApp(w, user, appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	if err := s.store.AddFavorite(user.ID, appID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"app_id": appID, "favorite": true})
+}
+
+// removeFavorite unpins an app for the current user.
+func (s *Server) removeFavorite(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	user := authUserFromContext(r)
+	if err := s.store.RemoveFavorite(user.ID, appID); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app is not a favorite"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
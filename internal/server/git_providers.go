@@ -0,0 +1,424 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/store"
+)
+
+const (
+	gitProviderGitHub = "github"
+	gitProviderGitLab = "gitlab"
+
+	gitProviderTimeout  = 15 * time.Second
+	gitProviderPageSize = 100
+	// maxGitProviderPages bounds the repositories or branches listed per request.
+	maxGitProviderPages = 10
+)
+
+// defaultGitProviderAPIURLs are the API URLs of github.com and gitlab.com, used when a provider
+// sets none.
+var defaultGitProviderAPIURLs = map[string]string{
+	gitProviderGitHub: "https://api.github.com",
+	gitProviderGitLab: "https://gitlab.com/api/v4",
+}
+
+var gitProviderClient = &http.Client{Timeout: gitProviderTimeout}
+
+type gitProviderRequest struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	APIURL string `json:"api_url"`
+	Token  string `json:"token"`
+}
+
+// providerRepo is a repository listed by GET /api/git-providers/{providerID}/repos.
+type providerRepo struct {
+	FullName      string    `json:"full_name"`
+	Name          string    `json:"name"`
+	Description   string    `json:"description,omitempty"`
+	DefaultBranch string    `json:"default_branch"`
+	CloneURL      string    `json:"clone_url"`
+	SSHURL        string    `json:"ssh_url"`
+	Private       bool      `json:"private"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// providerBranch is a branch listed by GET /api/git-providers/{providerID}/branches.
+type providerBranch struct {
+	Name      string `json:"name"`
+	CommitSHA string `json:"commit_sha"`
+}
+
+// gitProviderError is a failed provider API call; NotFound lets callers fall back (e.g. from
+// an organization to a user).
+type gitProviderError struct {
+	Kind     string
+	Status   string
+	NotFound bool
+}
+
+func (e *gitProviderError) Error() string {
+	return fmt.Sprintf("%s returned %s", e.Kind, e.Status)
+}
+
+// normalizeGitProviderAPIURL returns the API URL of a provider without trailing slash, or the
+// kind's default for an empty raw.
+func normalizeGitProviderAPIURL(kind, raw string) (string, error) {
+	raw = strings.TrimRight(strings.TrimSpace(raw), "/")
+	if raw == "" {
+		return defaultGitProviderAPIURLs[kind], nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return "", fmt.Errorf("api_url must be an http or https URL (e.g. https://github.example.com/api/v3)")
+	}
+	return raw, nil
+}
+
+func (s *Server) listGitProviders(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	providers, err := s.store.ListGitProviders()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, providers)
+}
+
+func (s *Server) createGitProvider(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	var body gitProviderRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	p := store.GitProvider{Name: strings.TrimSpace(body.Name), Kind: strings.TrimSpace(body.Kind), Token: strings.TrimSpace(body.Token)}
+	if p.Name == "" || p.Token == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name and token are required"})
+		return
+	}
+	if _, ok := defaultGitProviderAPIURLs[p.Kind]; !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "kind must be github or gitlab"})
+		return
+	}
+	var err error
+	if p.APIURL, err = normalizeGitProviderAPIURL(p.Kind, body.APIURL); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if p.ID, err = s.store.CreateGitProvider(p); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// updateGitProvider changes the API URL and token (an empty token keeps the current one).
+func (s *Server) updateGitProvider(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	p, ok := s.gitProviderFromURL(w, r)
+	if !ok {
+		return
+	}
+	var body gitProviderRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if strings.TrimSpace(body.APIURL) != "" {
+		u, err := normalizeGitProviderAPIURL(p.Kind, body.APIURL)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		p.APIURL = u
+	}
+	if token := strings.TrimSpace(body.Token); token != "" {
+		p.Token = token
+	}
+	if err := s.store.UpdateGitProvider(*p); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) deleteGitProvider(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	p, ok := s.gitProviderFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteGitProvider(p.ID); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "git provider not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) gitProviderFromURL(w http.ResponseWriter, r *http.Request) (*store.GitProvider, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "providerID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid git provider id"})
+		return nil, false
+	}
+	p, err := s.store.GetGitProvider(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if p == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "git provider not found"})
+		return nil, false
+	}
+	return p, true
+}
+
+// listProviderRepos lists the repositories of ?owner= (a GitHub organization or user, a GitLab
+// group or user), or those the token can access without owner, optionally filtered by ?q= (admin).
+func (s *Server) listProviderRepos(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	p, ok := s.gitProviderFromURL(w, r)
+	if !ok {
+		return
+	}
+	owner := strings.Trim(strings.TrimSpace(r.URL.Query().Get("owner")), "/")
+	var repos []providerRepo
+	var err error
+	if p.Kind == gitProviderGitLab {
+		repos, err = gitLabRepos(p, owner)
+	} else {
+		repos, err = gitHubRepos(p, owner)
+	}
+	if err != nil {
+		writeGitProviderError(w, err)
+		return
+	}
+	out := make([]providerRepo, 0, len(repos))
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	for _, repo := range repos {
+		if q == "" || strings.Contains(strings.ToLower(repo.FullName), q) {
+			out = append(out, repo)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// listProviderBranches lists the branches of ?repo= (owner/name, or a GitLab project path) (admin).
+func (s *Server) listProviderBranches(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	p, ok := s.gitProviderFromURL(w, r)
+	if !ok {
+		return
+	}
+	repo := strings.Trim(strings.TrimSpace(r.URL.Query().Get("repo")), "/")
+	if !strings.Contains(repo, "/") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "repo must be a repository path like org/name"})
+		return
+	}
+	var branches []providerBranch
+	var err error
+	if p.Kind == gitProviderGitLab {
+		branches, err = gitLabBranches(p, repo)
+	} else {
+		branches, err = gitHubBranches(p, repo)
+	}
+	if err != nil {
+		writeGitProviderError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, branches)
+}
+
+// writeGitProviderError answers 404 when the provider does not know the owner or repository and
+// 502 for other provider failures.
+func writeGitProviderError(w http.ResponseWriter, err error) {
+	if pe, ok := err.(*gitProviderError); ok && pe.NotFound {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+}
+
+// gitHubRepos lists the repositories of an organization, falling back to a user, or of the
+// token's user when owner is empty.
+func gitHubRepos(p *store.GitProvider, owner string) ([]providerRepo, error) {
+	type ghRepo struct {
+		FullName      string    `json:"full_name"`
+		Name          string    `json:"name"`
+		Description   string    `json:"description"`
+		DefaultBranch string    `json:"default_branch"`
+		CloneURL      string    `json:"clone_url"`
+		SSHURL        string    `json:"ssh_url"`
+		Private       bool      `json:"private"`
+		PushedAt      time.Time `json:"pushed_at"`
+	}
+	list := func(path string) ([]providerRepo, error) {
+		var out []providerRepo
+		err := gitProviderPages(p, path, func(page json.RawMessage) (int, error) {
+			var repos []ghRepo
+			if err := json.Unmarshal(page, &repos); err != nil {
+				return 0, err
+			}
+			for _, r := range repos {
+				out = append(out, providerRepo{r.FullName, r.Name, r.Description, r.DefaultBranch, r.CloneURL, r.SSHURL, r.Private, r.PushedAt})
+			}
+			return len(repos), nil
+		})
+		return out, err
+	}
+	if owner == "" {
+		return list("/user/repos?sort=pushed")
+	}
+	repos, err := list("/orgs/" + url.PathEscape(owner) + "/repos?sort=pushed")
+	if pe, ok := err.(*gitProviderError); ok && pe.NotFound {
+		return list("/users/" + url.PathEscape(owner) + "/repos?sort=pushed")
+	}
+	return repos, err
+}
+
+// gitHubBranches lists the branches of owner/name.
+func gitHubBranches(p *store.GitProvider, repo string) ([]providerBranch, error) {
+	owner, name, _ := strings.Cut(repo, "/")
+	var out []providerBranch
+	err := gitProviderPages(p, "/repos/"+url.PathEscape(owner)+"/"+url.PathEscape(name)+"/branches", func(page json.RawMessage) (int, error) {
+		var branches []struct {
+			Name   string `json:"name"`
+			Commit struct {
+				SHA string `json:"sha"`
+			} `json:"commit"`
+		}
+		if err := json.Unmarshal(page, &branches); err != nil {
+			return 0, err
+		}
+		for _, b := range branches {
+			out = append(out, providerBranch{Name: b.Name, CommitSHA: b.Commit.SHA})
+		}
+		return len(branches), nil
+	})
+	return out, err
+}
+
+// gitLabRepos lists the projects of a group (with subgroups), falling back to a user, or the
+// projects the token's user is a member of when owner is empty.
+func gitLabRepos(p *store.GitProvider, owner string) ([]providerRepo, error) {
+	list := func(path string) ([]providerRepo, error) {
+		var out []providerRepo
+		err := gitProviderPages(p, path, func(page json.RawMessage) (int, error) {
+			var projects []struct {
+				PathWithNamespace string    `json:"path_with_namespace"`
+				Name              string    `json:"name"`
+				Description       string    `json:"description"`
+				DefaultBranch     string    `json:"default_branch"`
+				HTTPURL           string    `json:"http_url_to_repo"`
+				SSHURL            string    `json:"ssh_url_to_repo"`
+				Visibility        string    `json:"visibility"`
+				LastActivityAt    time.Time `json:"last_activity_at"`
+			}
+			if err := json.Unmarshal(page, &projects); err != nil {
+				return 0, err
+			}
+			for _, pr := range projects {
+				out = append(out, providerRepo{pr.PathWithNamespace, pr.Name, pr.Description, pr.DefaultBranch, pr.HTTPURL, pr.SSHURL, pr.Visibility != "public", pr.LastActivityAt})
+			}
+			return len(projects), nil
+		})
+		return out, err
+	}
+	if owner == "" {
+		return list("/projects?membership=true&order_by=last_activity_at")
+	}
+	repos, err := list("/groups/" + url.PathEscape(owner) + "/projects?include_subgroups=true&order_by=last_activity_at")
+	if pe, ok := err.(*gitProviderError); ok && pe.NotFound {
+		return list("/users/" + url.PathEscape(owner) + "/projects?order_by=last_activity_at")
+	}
+	return repos, err
+}
+
+// gitLabBranches lists the branches of a project path.
+func gitLabBranches(p *store.GitProvider, repo string) ([]providerBranch, error) {
+	var out []providerBranch
+	err := gitProviderPages(p, "/projects/"+url.PathEscape(repo)+"/repository/branches", func(page json.RawMessage) (int, error) {
+		var branches []struct {
+			Name   string `json:"name"`
+			Commit struct {
+				ID string `json:"id"`
+			} `json:"commit"`
+		}
+		if err := json.Unmarshal(page, &branches); err != nil {
+			return 0, err
+		}
+		for _, b := range branches {
+			out = append(out, providerBranch{Name: b.Name, CommitSHA: b.Commit.ID})
+		}
+		return len(branches), nil
+	})
+	return out, err
+}
+
+// gitProviderPages requests path page by page (up to maxGitProviderPages) and passes each page
+// to add, which returns its number of items; a short page ends the listing.
+func gitProviderPages(p *store.GitProvider, path string, add func(page json.RawMessage) (int, error)) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	for page := 1; page <= maxGitProviderPages; page++ {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s%sper_page=%d&page=%d", p.APIURL, path, sep, gitProviderPageSize, page), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		if p.Kind == gitProviderGitLab {
+			req.Header.Set("PRIVATE-TOKEN", p.Token)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+p.Token)
+		}
+		resp, err := gitProviderClient.Do(req)
+		if err != nil {
+			return err
+		}
+		var body json.RawMessage
+		if resp.StatusCode >= 300 {
+			resp.Body.Close()
+			return &gitProviderError{Kind: p.Kind, Status: resp.Status, NotFound: resp.StatusCode == http.StatusNotFound}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Kind, err)
+		}
+		n, err := add(body)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Kind, err)
+		}
+		if n < gitProviderPageSize {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+// validateGitOps checks and normalizes the settings of deploy_mode gitops, under which k8s_deploy
+// steps commit the new image to a GitOps repo instead of applying to the cluster.
+func (s *Server) validateGitOps(app *config.App) error {
+	app.GitOpsRepo = strings.TrimSpace(app.GitOpsRepo)
+	app.GitOpsBranch = strings.TrimSpace(app.GitOpsBranch)
+	app.GitOpsSSHKeyName = strings.TrimSpace(app.GitOpsSSHKeyName)
+	app.GitOpsPath = strings.Trim(strings.TrimPrefix(strings.TrimSpace(app.GitOpsPath), "./"), "/")
+	app.GitOpsImage = strings.TrimSpace(app.GitOpsImage)
+	app.GitOpsPR = strings.TrimSpace(strings.ToLower(app.GitOpsPR))
+	if app.DeployMode != "gitops" {
+		return nil
+	}
+	if app.GitOpsRepo == "" {
+		return errors.New("gitops_repo is required when deploy_mode=gitops")
+	}
+	if app.GitOpsPath == "" || !validRepoRelativePath(app.GitOpsPath) {
+		return errors.New("gitops_path must be a relative file path inside the gitops repository")
+	}
+	if app.GitOpsImage == "" || strings.ContainsAny(app.GitOpsImage, ":@ ") {
+		return errors.New("gitops_image must be an image name without tag or digest")
+	}
+	switch app.GitOpsPR {
+	case "":
+	case "github", "gitlab":
+		if _, _, ok := pipeline.GitOpsRepoPath(app.GitOpsRepo); !ok {
+			return errors.New("gitops_pr needs a gitops_repo URL with a host and repository path")
+		}
+	default:
+		return errors.New("gitops_pr must be github or gitlab")
+	}
+	if app.GitOpsSSHKeyName != "" {
+		key, err := s.store.GetSSHKeyByName(app.GitOpsSSHKeyName)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return errors.New("gitops_ssh_key_name not found")
+		}
+	}
+	return nil
+}
+
+// gitOpsKey returns the SSH key pushing to the GitOps repo: gitops_ssh_key_name, or appKey when
+// unset. It returns nil for apps not using deploy_mode gitops.
+func (s *Server) gitOpsKey(app config.App, appKey *store.SSHKey) (*store.SSHKey, error) {
+	if app.DeployMode != "gitops" {
+		return nil, nil
+	}
+	if app.GitOpsSSHKeyName == "" {
+		return appKey, nil
+	}
+	key, err := s.store.GetSSHKeyByName(app.GitOpsSSHKeyName)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, &statusError{Status: http.StatusBadRequest, Msg: "configured gitops_ssh_key_name not found"}
+	}
+	return key, nil
+}
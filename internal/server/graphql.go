@@ -0,0 +1,561 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+var (
+	errGraphQLAdmin    = errors.New("admin access required")
+	errGraphQLNotFound = errors.New("not found")
+)
+
+// SetGraphQL enables the GraphQL API at /api/graphql: apps, runs, steps, users, and groups with
+// nested queries, and a runUpdated subscription over server-sent events.
+func (s *Server) SetGraphQL(enabled bool) error {
+	if !enabled {
+		s.graphqlSchema = nil
+		return nil
+	}
+	schema, err := s.newGraphQLSchema()
+	if err != nil {
+		return err
+	}
+	s.graphqlSchema = &schema
+	return nil
+}
+
+// graphqlUser is the signed-in user of a resolver (requireAuth put it in the request context).
+func graphqlUser(p graphql.ResolveParams) authUser {
+	u, _ := p.Context.Value(authUserKey).(authUser)
+	return u
+}
+
+// graphqlAppVisible reports whether the user of a resolver may see the app.
+func (s *Server) graphqlAppVisible(p graphql.ResolveParams, appID string) (bool, error) {
+	u := graphqlUser(p)
+	if u.IsAdmin {
+		return true, nil
+	}
+	return s.userCanAccessApp(u.ID, appID)
+}
+
+// graphqlApps returns the configured apps (archived ones only with archived) the user may see.
+func (s *Server) graphqlApps(p graphql.ResolveParams, archived bool) ([]config.App, error) {
+	u := graphqlUser(p)
+	var allowed map[string]struct{}
+	if !u.IsAdmin {
+		var err error
+		if allowed, _, err = s.allowedAppIDsForUser(u.ID); err != nil {
+			return nil, err
+		}
+	}
+	s.appsMu.RLock()
+	defer s.appsMu.RUnlock()
+	apps := make([]config.App, 0, len(s.apps))
+	for _, app := range s.apps {
+		if app.Archived != archived {
+			continue
+		}
+		if _, ok := allowed[app.ID]; allowed != nil && !ok {
+			continue
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// graphqlApp returns a configured app the user may see, or nil.
+func (s *Server) graphqlApp(p graphql.ResolveParams, appID string) (interface{}, error) {
+	app, ok := s.findApp(appID)
+	if !ok {
+		return nil, nil
+	}
+	if visible, err := s.graphqlAppVisible(p, appID); err != nil || !visible {
+		return nil, err
+	}
+	return app, nil
+}
+
+// graphqlRun returns a run the user may see, or nil.
+func (s *Server) graphqlRun(p graphql.ResolveParams, id int64) (*store.Run, error) {
+	run, err := s.store.GetRun(id)
+	if err != nil || run == nil {
+		return nil, err
+	}
+	u := graphqlUser(p)
+	if run.DeletedAt != nil && !u.IsAdmin {
+		return nil, nil
+	}
+	if visible, err := s.graphqlAppVisible(p, run.AppID); err != nil || !visible {
+		return nil, err
+	}
+	return run, nil
+}
+
+func graphqlRequireAdmin(p graphql.ResolveParams) error {
+	if !graphqlUser(p).IsAdmin {
+		return errGraphQLAdmin
+	}
+	return nil
+}
+
+// graphqlSelfOrAdmin reports whether the user of a resolver is the user userID or an admin. Others
+// see no users but themselves through Group.users and only their own User.groups, so a query
+// cannot walk from a shared group to the groups, apps, and runs of its other members.
+func graphqlSelfOrAdmin(p graphql.ResolveParams, userID int64) bool {
+	u := graphqlUser(p)
+	return u.IsAdmin || u.ID == userID
+}
+
+// graphqlTime formats an optional time as RFC 3339 (UTC).
+func graphqlTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func graphqlIntArg(p graphql.ResolveParams, name string, def int) int {
+	if v, ok := p.Args[name].(int); ok {
+		return v
+	}
+	return def
+}
+
+// newGraphQLSchema builds the schema. Its types reference each other (App.runs, Run.app,
+// Group.users, User.groups), so the cross-references are added after the types exist.
+func (s *Server) newGraphQLSchema() (graphql.Schema, error) {
+	field := func(t graphql.Output, resolve graphql.FieldResolveFn) *graphql.Field {
+		return &graphql.Field{Type: t, Resolve: resolve}
+	}
+	nonNull := graphql.NewNonNull
+	listOf := func(t graphql.Type) graphql.Output { return nonNull(graphql.NewList(nonNull(t))) }
+	pageArgs := graphql.FieldConfigArgument{
+		"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 15},
+		"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+	}
+
+	stepType := graphql.NewObject(graphql.ObjectConfig{Name: "Step", Fields: graphql.Fields{
+		"name":    field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.Step).Name, nil }),
+		"kind":    field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.Step).Kind(), nil }),
+		"command": field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.Step).CommandValue(), nil }),
+		"deploy":  field(nonNull(graphql.Boolean), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.Step).IsDeploy(), nil }),
+		"artifacts": field(listOf(graphql.String), func(p graphql.ResolveParams) (interface{}, error) {
+			if a := p.Source.(config.Step).Artifacts; a != nil {
+				return a, nil
+			}
+			return []string{}, nil
+		}),
+	}})
+
+	runType := graphql.NewObject(graphql.ObjectConfig{Name: "Run", Fields: graphql.Fields{
+		"id":          field(nonNull(graphql.Int), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*store.Run).ID, nil }),
+		"appId":       field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*store.Run).AppID, nil }),
+		"status":      field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*store.Run).Status, nil }),
+		"commitSha":   field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*store.Run).CommitSHA, nil }),
+		"triggeredBy": field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*store.Run).TriggeredBy, nil }),
+		"slow":        field(nonNull(graphql.Boolean), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*store.Run).Slow, nil }),
+		"startedAt": field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) {
+			return graphqlTime(&p.Source.(*store.Run).StartedAt), nil
+		}),
+		"endedAt": field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) {
+			return graphqlTime(p.Source.(*store.Run).EndedAt), nil
+		}),
+		"durationSec": field(graphql.Int, func(p graphql.ResolveParams) (interface{}, error) {
+			run := p.Source.(*store.Run)
+			if run.EndedAt == nil {
+				return nil, nil
+			}
+			return int(run.EndedAt.Sub(run.StartedAt).Seconds()), nil
+		}),
+		"log": field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) {
+			// Listed runs carry no log key, so read the run again for its log.
+			run, err := s.graphqlRun(p, p.Source.(*store.Run).ID)
+			if err != nil || run == nil {
+				return nil, err
+			}
+			if err := s.loadRunLog(run); err != nil {
+				return nil, err
+			}
+			return run.Log, nil
+		}),
+	}})
+
+	appType := graphql.NewObject(graphql.ObjectConfig{Name: "App", Fields: graphql.Fields{
+		"id":          field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.App).ID, nil }),
+		"name":        field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.App).Name, nil }),
+		"repo":        field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.App).Repo, nil }),
+		"branch":      field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.App).Branch, nil }),
+		"environment": field(graphql.String, func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.App).Environment, nil }),
+		"archived":    field(nonNull(graphql.Boolean), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(config.App).Archived, nil }),
+		"timezone": field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) {
+			return s.appLocation(p.Source.(config.App)).String(), nil
+		}),
+		"tags": field(listOf(graphql.String), func(p graphql.ResolveParams) (interface{}, error) {
+			tags, err := s.store.AppTags(p.Source.(config.App).ID)
+			if tags == nil {
+				tags = []string{}
+			}
+			return tags, err
+		}),
+		"steps": field(listOf(stepType), func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(config.App).EffectiveSteps(), nil
+		}),
+		"runs": {
+			Type: listOf(runType),
+			Args: pageArgs,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				appID := p.Source.(config.App).ID
+				if visible, err := s.graphqlAppVisible(p, appID); err != nil || !visible {
+					return []*store.Run{}, err
+				}
+				runs, err := s.store.ListRuns(appID, graphqlIntArg(p, "limit", 15), graphqlIntArg(p, "offset", 0))
+				return runPointers(runs), err
+			},
+		},
+		"lastRun": field(runType, func(p graphql.ResolveParams) (interface{}, error) {
+			appID := p.Source.(config.App).ID
+			if visible, err := s.graphqlAppVisible(p, appID); err != nil || !visible {
+				return nil, err
+			}
+			runs, err := s.store.LatestRuns([]string{appID})
+			if err != nil || len(runs) == 0 {
+				return nil, err
+			}
+			return &runs[0], nil
+		}),
+	}})
+	runType.AddFieldConfig("app", field(appType, func(p graphql.ResolveParams) (interface{}, error) {
+		return s.graphqlApp(p, p.Source.(*store.Run).AppID)
+	}))
+
+	userType := graphql.NewObject(graphql.ObjectConfig{Name: "User", Fields: graphql.Fields{
+		"id":       field(nonNull(graphql.Int), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(store.User).ID, nil }),
+		"username": field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(store.User).Username, nil }),
+		"isAdmin":  field(nonNull(graphql.Boolean), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(store.User).IsAdmin, nil }),
+	}})
+	groupType := graphql.NewObject(graphql.ObjectConfig{Name: "Group", Fields: graphql.Fields{
+		"id":   field(nonNull(graphql.Int), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(store.Group).ID, nil }),
+		"name": field(nonNull(graphql.String), func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(store.Group).Name, nil }),
+		"users": field(listOf(userType), func(p graphql.ResolveParams) (interface{}, error) {
+			ids, err := s.store.GroupUserIDs(p.Source.(store.Group).ID)
+			if err != nil {
+				return nil, err
+			}
+			users := make([]store.User, 0, len(ids))
+			for _, id := range ids {
+				if !graphqlSelfOrAdmin(p, id) {
+					continue
+				}
+				u, err := s.store.GetUser(id)
+				if err != nil {
+					return nil, err
+				}
+				if u != nil {
+					users = append(users, *u)
+				}
+			}
+			return users, nil
+		}),
+		"apps": field(listOf(appType), func(p graphql.ResolveParams) (interface{}, error) {
+			ids, err := s.store.GroupAppIDs(p.Source.(store.Group).ID)
+			if err != nil {
+				return nil, err
+			}
+			apps := make([]config.App, 0, len(ids))
+			for _, id := range ids {
+				app, ok := s.findApp(id)
+				if !ok {
+					continue
+				}
+				if visible, err := s.graphqlAppVisible(p, id); err != nil {
+					return nil, err
+				} else if visible {
+					apps = append(apps, app)
+				}
+			}
+			return apps, nil
+		}),
+	}})
+	userType.AddFieldConfig("groups", field(listOf(groupType), func(p graphql.ResolveParams) (interface{}, error) {
+		if !graphqlSelfOrAdmin(p, p.Source.(store.User).ID) {
+			return []store.Group{}, nil
+		}
+		ids, err := s.store.UserGroupIDs(p.Source.(store.User).ID)
+		if err != nil {
+			return nil, err
+		}
+		groups := make([]store.Group, 0, len(ids))
+		for _, id := range ids {
+			g, err := s.store.GetGroup(id)
+			if err != nil {
+				return nil, err
+			}
+			if g != nil {
+				groups = append(groups, *g)
+			}
+		}
+		return groups, nil
+	}))
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: graphql.Fields{
+		"me": field(nonNull(userType), func(p graphql.ResolveParams) (interface{}, error) {
+			u := graphqlUser(p)
+			return store.User{ID: u.ID, Username: u.Username, IsAdmin: u.IsAdmin}, nil
+		}),
+		"apps": {
+			Type: listOf(appType),
+			Args: graphql.FieldConfigArgument{"archived": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				archived, _ := p.Args["archived"].(bool)
+				if archived {
+					if err := graphqlRequireAdmin(p); err != nil {
+						return nil, err
+					}
+				}
+				return s.graphqlApps(p, archived)
+			},
+		},
+		"app": {
+			Type: appType,
+			Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: nonNull(graphql.String)}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return s.graphqlApp(p, p.Args["id"].(string))
+			},
+		},
+		"runs": {
+			Type: listOf(runType),
+			Args: graphql.FieldConfigArgument{
+				"appId":  &graphql.ArgumentConfig{Type: graphql.String},
+				"limit":  pageArgs["limit"],
+				"offset": pageArgs["offset"],
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				limit, offset := graphqlIntArg(p, "limit", 15), graphqlIntArg(p, "offset", 0)
+				appID, _ := p.Args["appId"].(string)
+				u := graphqlUser(p)
+				if appID != "" {
+					if visible, err := s.graphqlAppVisible(p, appID); err != nil || !visible {
+						return []*store.Run{}, err
+					}
+				}
+				if u.IsAdmin || appID != "" {
+					runs, err := s.store.ListRuns(appID, limit, offset)
+					return runPointers(runs), err
+				}
+				_, allowed, err := s.allowedAppIDsForUser(u.ID)
+				if err != nil {
+					return nil, err
+				}
+				runs, err := s.store.ListRunsByAppIDs(allowed, limit, offset)
+				return runPointers(runs), err
+			},
+		},
+		"run": {
+			Type: runType,
+			Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: nonNull(graphql.Int)}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				run, err := s.graphqlRun(p, int64(p.Args["id"].(int)))
+				if run == nil {
+					return nil, err
+				}
+				return run, err
+			},
+		},
+		"users": field(listOf(userType), func(p graphql.ResolveParams) (interface{}, error) {
+			if err := graphqlRequireAdmin(p); err != nil {
+				return nil, err
+			}
+			return s.store.ListUsers()
+		}),
+		"groups": field(listOf(groupType), func(p graphql.ResolveParams) (interface{}, error) {
+			if err := graphqlRequireAdmin(p); err != nil {
+				return nil, err
+			}
+			return s.store.ListGroups()
+		}),
+		"group": {
+			Type: groupType,
+			Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: nonNull(graphql.Int)}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := graphqlRequireAdmin(p); err != nil {
+					return nil, err
+				}
+				g, err := s.store.GetGroup(int64(p.Args["id"].(int)))
+				if err != nil || g == nil {
+					return nil, err
+				}
+				return *g, nil
+			},
+		},
+	}})
+
+	subscriptionType := graphql.NewObject(graphql.ObjectConfig{Name: "Subscription", Fields: graphql.Fields{
+		"runUpdated": {
+			Type: runType,
+			Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: nonNull(graphql.Int)}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source, nil
+			},
+			Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+				run, err := s.graphqlRun(p, int64(p.Args["id"].(int)))
+				if err != nil {
+					return nil, err
+				}
+				if run == nil {
+					return nil, fmt.Errorf("run %w", errGraphQLNotFound)
+				}
+				return s.watchRun(p.Context, run), nil
+			},
+		},
+	}})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType, Subscription: subscriptionType})
+}
+
+func runPointers(runs []store.Run) []*store.Run {
+	out := make([]*store.Run, len(runs))
+	for i := range runs {
+		out[i] = &runs[i]
+	}
+	return out
+}
+
+// watchRun sends run, then the run again whenever its status, log size, or end changes, until it
+// finishes or ctx ends. It re-reads the run every runWaitInterval, so it sees runs of every replica.
+func (s *Server) watchRun(ctx context.Context, run *store.Run) chan interface{} {
+	updates := make(chan interface{})
+	go func() {
+		defer close(updates)
+		key := ""
+		ticker := time.NewTicker(runWaitInterval)
+		defer ticker.Stop()
+		for {
+			if k := fmt.Sprintf("%s/%d/%d/%v", run.Status, run.LogSize, len(run.Log), run.EndedAt != nil); k != key {
+				key = k
+				select {
+				case updates <- run:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if run.Status != "pending" && run.Status != "running" {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			latest, err := s.store.GetRun(run.ID)
+			if err != nil || latest == nil {
+				return
+			}
+			run = latest
+		}
+	}()
+	return updates
+}
+
+// graphqlRequest is a GraphQL request: the JSON body of a POST, or the query parameters of a GET.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// graphQL serves /api/graphql when the GraphQL API is enabled. Queries are answered with one JSON
+// result; subscriptions need Accept: text/event-stream and stream a "next" event per result and
+// a final "complete" event.
+func (s *Server) graphQL(w http.ResponseWriter, r *http.Request) {
+	schema := s.graphqlSchema
+	if schema == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "the GraphQL API is not enabled (-graphql)"})
+		return
+	}
+	var req graphqlRequest
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid variables"})
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "query is required"})
+		return
+	}
+	params := graphql.Params{
+		Schema:         *schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	}
+	operation := graphqlOperation(req.Query, req.OperationName)
+	if s.demoGraphQLMutation(w, authUserFromContext(r), operation) {
+		return
+	}
+	if operation != ast.OperationTypeSubscription {
+		writeJSON(w, http.StatusOK, graphql.Do(params))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		writeJSON(w, http.StatusNotAcceptable, map[string]string{"error": "subscriptions need Accept: text/event-stream"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for result := range graphql.Subscribe(params) {
+		data, err := json.Marshal(result)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	fmt.Fprint(w, "event: complete\ndata:\n\n")
+	flusher.Flush()
+}
+
+// graphqlOperation returns the type of the operation a request executes ("query" when the
+// document does not parse; execution reports the error).
+func graphqlOperation(query, operationName string) string {
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(query)})})
+	if err != nil {
+		return ast.OperationTypeQuery
+	}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" || (op.Name != nil && op.Name.Value == operationName) {
+			return op.Operation
+		}
+	}
+	return ast.OperationTypeQuery
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// StartRunHeartbeat records a heartbeat for the runs this process owns every timeout/4 and, as a
+// watchdog, interrupts unfinished runs that no process has reported alive for timeout (e.g. the
+// server executing them crashed while another replica kept running). It returns immediately;
+// timeout <= 0 disables both.
+func (s *Server) StartRunHeartbeat(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	s.heartbeatTimeout = timeout
+	go func() {
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.touchHeartbeats()
+			s.interruptStaleRuns()
+		}
+	}()
+}
+
+func (s *Server) touchHeartbeats() {
+	s.activeMu.Lock()
+	ids := make([]int64, 0, len(s.activeRuns))
+	for id := range s.activeRuns {
+		ids = append(ids, id)
+	}
+	s.activeMu.Unlock()
+	if err := s.store.TouchRunHeartbeats(ids); err != nil {
+		log.Printf("heartbeat: %v", err)
+	}
+}
+
+// interruptStaleRuns interrupts (and, with SetRequeueInterrupted, requeues) unfinished runs
+// without a recent heartbeat that this process does not run. Only the leader checks.
+func (s *Server) interruptStaleRuns() {
+	if !s.isLeader() {
+		return
+	}
+	runs, err := s.store.StaleRuns(s.heartbeatTimeout)
+	if err != nil {
+		log.Printf("heartbeat: list stale runs: %v", err)
+		return
+	}
+	for _, run := range runs {
+		if !s.runTracked(run.ID) && s.interruptRun(run, fmt.Sprintf("no heartbeat for %s; the server running it was lost", s.heartbeatTimeout)) && s.requeueInterrupted {
+			s.requeueRun(run)
+		}
+	}
+}
+
+// liveRunIDs returns the unfinished runs with a recent heartbeat (or start), which another server
+// process may still be running; after a restart they are left to the watchdog. It is empty when
+// heartbeats are disabled.
+func (s *Server) liveRunIDs() map[int64]bool {
+	live := map[int64]bool{}
+	if s.heartbeatTimeout <= 0 {
+		return live
+	}
+	runs, err := s.store.LiveRuns(s.heartbeatTimeout)
+	if err != nil {
+		log.Printf("heartbeat: list live runs: %v", err)
+		return live
+	}
+	for _, run := range runs {
+		live[run.ID] = true
+	}
+	return live
+}
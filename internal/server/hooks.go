@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// maxHookOutput is how much of a failed command hook's output is logged.
+const maxHookOutput = 1 << 10
+
+// hookPayload is the run metadata passed to hooks: posted as JSON to url hooks and written as
+// JSON to the stdin of command hooks.
+type hookPayload struct {
+	Event         string           `json:"event"`
+	Hook          string           `json:"hook"`
+	RunID         int64            `json:"run_id"`
+	AppID         string           `json:"app_id"`
+	AppName       string           `json:"app_name"`
+	Environment   string           `json:"environment,omitempty"`
+	Owner         *config.AppOwner `json:"owner,omitempty"`
+	TriggeredBy   string           `json:"triggered_by,omitempty"`
+	Status        string           `json:"status"`
+	CommitSHA     string           `json:"commit_sha,omitempty"`
+	FailureReason string           `json:"failure_reason,omitempty"`
+	Attempt       int              `json:"attempt,omitempty"`
+	StartedAt     time.Time        `json:"started_at"`
+	EndedAt       *time.Time       `json:"ended_at,omitempty"`
+	DurationMs    int64            `json:"duration_ms,omitempty"`
+	Time          time.Time        `json:"time"`
+}
+
+// env returns the payload as the NOPPFLOW_* env vars of command hooks.
+func (p hookPayload) env() []string {
+	return []string{
+		"NOPPFLOW_HOOK=" + p.Hook,
+		"NOPPFLOW_HOOK_EVENT=" + p.Event,
+		"NOPPFLOW_RUN_ID=" + strconv.FormatInt(p.RunID, 10),
+		"NOPPFLOW_APP_ID=" + p.AppID,
+		"NOPPFLOW_APP_NAME=" + p.AppName,
+		"NOPPFLOW_ENVIRONMENT=" + p.Environment,
+		"NOPPFLOW_TRIGGERED_BY=" + p.TriggeredBy,
+		"NOPPFLOW_RUN_STATUS=" + p.Status,
+		"NOPPFLOW_COMMIT=" + p.CommitSHA,
+		"NOPPFLOW_FAILURE_REASON=" + p.FailureReason,
+		"NOPPFLOW_DURATION_MS=" + strconv.FormatInt(p.DurationMs, 10),
+	}
+}
+
+// SetHooks sets the server-side lifecycle hooks (see config.LoadHooks).
+func (s *Server) SetHooks(cfg config.HooksConfig) {
+	s.hooks = cfg.Hooks
+}
+
+// runHooks calls the hooks that fire on event for the app's run, one after another. Failures are
+// logged only; runHooks blocks until all hooks are done, so callers run it in the background.
+func (s *Server) runHooks(event string, runID int64, app config.App) {
+	var hooks []config.Hook
+	for _, h := range s.hooks {
+		if h.Fires(event, app.ID) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	run, err := s.store.GetRun(runID)
+	if err != nil || run == nil {
+		log.Printf("hooks %s run=%d: load run: %v", event, runID, err)
+		return
+	}
+	p := hookPayload{
+		Event:         event,
+		RunID:         run.ID,
+		AppID:         app.ID,
+		AppName:       app.Name,
+		Environment:   app.Environment,
+		Owner:         app.Owner,
+		TriggeredBy:   run.TriggeredBy,
+		Status:        run.Status,
+		CommitSHA:     run.CommitSHA,
+		FailureReason: run.FailureReason,
+		Attempt:       run.Attempt,
+		StartedAt:     run.StartedAt.UTC(),
+		Time:          time.Now().UTC(),
+	}
+	if run.EndedAt != nil {
+		ended := run.EndedAt.UTC()
+		p.EndedAt = &ended
+		p.DurationMs = ended.Sub(p.StartedAt).Milliseconds()
+	}
+	for _, h := range hooks {
+		p.Hook = h.Name
+		if err := callHook(h, p); err != nil {
+			log.Printf("hook %s %s app=%s run=%d: %v", h.Name, event, app.ID, runID, err)
+		}
+	}
+}
+
+// callHook runs a command hook or posts to a url hook, within the hook's timeout.
+func callHook(h config.Hook, p hookPayload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout())
+	defer cancel()
+	if len(h.Command) > 0 {
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Env = append(os.Environ(), p.env()...)
+		cmd.Stdin = bytes.NewReader(body)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if len(out) > maxHookOutput {
+				out = out[len(out)-maxHookOutput:]
+			}
+			return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range h.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("returned %s", resp.Status)
+	}
+	return nil
+}
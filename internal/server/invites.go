@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"noppflow/internal/auth"
+	"noppflow/internal/store"
+)
+
+const (
+	defaultInviteTTL = 72 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+// inviteUser creates a single-use invite for a new user (admin). Body: username, optional email,
+// group_ids, is_admin, and expires_in_hours (default 72, at most 720). With an email and an SMTP
+// server the accept link is mailed; otherwise the token and link are returned once, to be passed
+// on by the admin.
+func (s *Server) inviteUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Username       string  `json:"username"`
+		Email          string  `json:"email"`
+		GroupIDs       []int64 `json:"group_ids"`
+		IsAdmin        bool    `json:"is_admin"`
+		ExpiresInHours int     `json:"expires_in_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	inv := store.UserInvite{
+		Username:  strings.TrimSpace(body.Username),
+		Email:     strings.TrimSpace(body.Email),
+		IsAdmin:   body.IsAdmin,
+		GroupIDs:  body.GroupIDs,
+		InvitedBy: admin.Username,
+	}
+	if inv.GroupIDs == nil {
+		inv.GroupIDs = []int64{}
+	}
+	if inv.Username == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "username is required"})
+		return
+	}
+	if inv.Email != "" {
+		if addr, err := mail.ParseAddress(inv.Email); err != nil || addr.Address != inv.Email {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "email must be a plain email address"})
+			return
+		}
+	}
+	ttl := defaultInviteTTL
+	if body.ExpiresInHours != 0 {
+		ttl = time.Duration(body.ExpiresInHours) * time.Hour
+	}
+	if ttl <= 0 || ttl > maxInviteTTL {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("expires_in_hours must be between 1 and %d", int(maxInviteTTL.Hours()))})
+		return
+	}
+	for _, groupID := range inv.GroupIDs {
+		group, err := s.store.GetGroup(groupID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if group == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("group %d not found", groupID)})
+			return
+		}
+	}
+	existing, err := s.store.GetUserByUsername(inv.Username)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if existing != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "user already exists"})
+		return
+	}
+	token, err := randomToken()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	inv.TokenHash = hashToken(token)
+	inv.ExpiresAt = time.Now().Add(ttl).UTC()
+	if inv.ID, err = s.store.CreateUserInvite(inv); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	link := s.publicURL + "/accept-invite.html?token=" + url.QueryEscape(token)
+	emailed := false
+	if inv.Email != "" && s.smtpAddr != "" {
+		text := fmt.Sprintf("%s invited you to NoppFlow as %s.\n\nSet your password here before %s:\n%s\n",
+			admin.Username, inv.Username, inv.ExpiresAt.In(s.displayLocation()).Format(time.RFC1123), link)
+		if err := s.sendMail(inv.Email, "Your NoppFlow invitation", text); err != nil {
+			log.Printf("invite %s: mail to %s: %v", inv.Username, inv.Email, err)
+		} else {
+			emailed = true
+		}
+	}
+	out := map[string]interface{}{"invite": inv, "emailed": emailed}
+	if !emailed {
+		out["token"] = token
+		out["url"] = link
+	}
+	writeJSON(w, http.StatusCreated, out)
+}
+
+// acceptInvite creates the user of an invite with the password they chose and signs them in with
+// a new session cookie. Body: token, password.
+func (s *Server) acceptInvite(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	password := strings.TrimSpace(body.Password)
+	if strings.TrimSpace(body.Token) == "" || password == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "token and password are required"})
+		return
+	}
+	inv, err := s.store.GetUserInviteByTokenHash(hashToken(strings.TrimSpace(body.Token)))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	if inv == nil || inv.AcceptedAt != nil || !now.Before(inv.ExpiresAt) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "invite not found, already used, or expired"})
+		return
+	}
+	if existing, err := s.store.GetUserByUsername(inv.Username); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	} else if existing != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "user already exists"})
+		return
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to hash password"})
+		return
+	}
+	userID, err := s.store.AcceptUserInvite(*inv, hash, now)
+	if storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "invite not found, already used, or expired"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	sessionUser := authUser{ID: userID, Username: inv.Username, IsAdmin: inv.IsAdmin}
+	if err := s.createSession(w, sessionUser); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create session"})
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"user": sessionUser})
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// SetIPRules sets the IP allow/deny rules of the admin API and the webhook endpoints.
+func (s *Server) SetIPRules(rules config.IPRules) {
+	s.ipRulesMu.Lock()
+	s.ipRules = rules
+	s.ipRulesMu.Unlock()
+}
+
+func (s *Server) currentIPRules() config.IPRules {
+	s.ipRulesMu.RLock()
+	defer s.ipRulesMu.RUnlock()
+	return s.ipRules
+}
+
+// StartIPRulesReloader reloads the IP rules file at path when its modification time changes,
+// checking every interval. A file that fails to load is logged and the previous rules stay in
+// effect. It returns immediately; interval <= 0 disables reloading.
+func (s *Server) StartIPRulesReloader(path string, interval time.Duration) {
+	if path == "" || interval <= 0 {
+		return
+	}
+	var loaded time.Time
+	if fi, err := os.Stat(path); err == nil {
+		loaded = fi.ModTime()
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			fi, err := os.Stat(path)
+			if err != nil {
+				log.Printf("ip rules: %v", err)
+				continue
+			}
+			if fi.ModTime().Equal(loaded) {
+				continue
+			}
+			loaded = fi.ModTime()
+			rules, err := config.LoadIPRules(path)
+			if err != nil {
+				log.Printf("ip rules: %v (keeping previous rules)", err)
+				continue
+			}
+			s.SetIPRules(rules)
+			log.Printf("ip rules reloaded from %s", path)
+		}
+	}()
+}
+
+// ipAllowed reports whether the client of r may use the endpoints of a rule set, logging
+// rejections.
+func (s *Server) ipAllowed(r *http.Request, set func(config.IPRules) config.IPRuleSet) bool {
+	rules := s.currentIPRules()
+	ip := rules.ClientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+	if set(rules).Allows(ip) {
+		return true
+	}
+	log.Printf("ip rules: rejected %s %s from %s", r.Method, r.URL.Path, ip)
+	return false
+}
+
+// requireWebhookIP rejects requests to inbound webhook endpoints from addresses the webhook IP
+// rules do not allow.
+func (s *Server) requireWebhookIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ipAllowed(r, func(rules config.IPRules) config.IPRuleSet { return rules.Webhooks }) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "address not allowed"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+const (
+	jiraTimeout          = 15 * time.Second
+	maxJiraUsernameLen   = 255
+	maxJiraTransitionLen = 100
+)
+
+var jiraClient = &http.Client{Timeout: jiraTimeout}
+
+// jiraRequest is the body of PUT /api/integrations/jira.
+type jiraRequest struct {
+	BaseURL      string                  `json:"base_url"`
+	Username     string                  `json:"username"`
+	Token        string                  `json:"token"`
+	Environments []store.JiraEnvironment `json:"environments"`
+}
+
+// jiraSettingsResponse is a JiraSettings without its token, which is never returned.
+type jiraSettingsResponse struct {
+	*store.JiraSettings
+	Configured bool `json:"configured"`
+}
+
+// runIssue is an issue key of a run with its link, when Jira is configured.
+type runIssue struct {
+	Key string `json:"key"`
+	URL string `json:"url,omitempty"`
+}
+
+// getJiraSettings returns the Jira settings without the token (admin).
+func (s *Server) getJiraSettings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	js, err := s.store.GetJiraSettings()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if js == nil {
+		writeJSON(w, http.StatusOK, jiraSettingsResponse{JiraSettings: &store.JiraSettings{Environments: []store.JiraEnvironment{}}})
+		return
+	}
+	writeJSON(w, http.StatusOK, jiraSettingsResponse{JiraSettings: js, Configured: true})
+}
+
+// setJiraSettings configures the Jira integration (admin). An empty token keeps the stored one.
+func (s *Server) setJiraSettings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	var body jiraRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	js := store.JiraSettings{
+		BaseURL:      strings.TrimRight(strings.TrimSpace(body.BaseURL), "/"),
+		Username:     strings.TrimSpace(body.Username),
+		Token:        strings.TrimSpace(body.Token),
+		Environments: body.Environments,
+	}
+	if js.Token == "" {
+		existing, err := s.store.GetJiraSettings()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if existing != nil {
+			js.Token = existing.Token
+		}
+	}
+	if err := validateJiraSettings(&js); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.store.SetJiraSettings(js); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	saved, err := s.store.GetJiraSettings()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, jiraSettingsResponse{JiraSettings: saved, Configured: true})
+}
+
+// deleteJiraSettings turns the Jira integration off (admin); issue keys are still recorded.
+func (s *Server) deleteJiraSettings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	if err := s.store.DeleteJiraSettings(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateJiraSettings checks and normalizes the Jira settings.
+func validateJiraSettings(js *store.JiraSettings) error {
+	u, err := url.Parse(js.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return fmt.Errorf("base_url must be the http or https URL of the Jira site (e.g. https://acme.atlassian.net)")
+	}
+	if js.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if len(js.Username) > maxJiraUsernameLen || strings.IndexFunc(js.Username, unicode.IsControl) >= 0 {
+		return fmt.Errorf("username must be at most %d characters on one line", maxJiraUsernameLen)
+	}
+	seen := make(map[string]bool, len(js.Environments))
+	envs := make([]store.JiraEnvironment, 0, len(js.Environments))
+	for _, e := range js.Environments {
+		e.Environment = strings.TrimSpace(e.Environment)
+		e.Transition = strings.TrimSpace(e.Transition)
+		if !config.ValidEnvironmentName(e.Environment) {
+			return fmt.Errorf("environment %q must be an environment name (e.g. prod, eu-staging)", e.Environment)
+		}
+		if seen[e.Environment] {
+			return fmt.Errorf("environment %s is listed twice", e.Environment)
+		}
+		seen[e.Environment] = true
+		if len(e.Transition) > maxJiraTransitionLen || strings.IndexFunc(e.Transition, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%s: transition must be at most %d characters on one line", e.Environment, maxJiraTransitionLen)
+		}
+		if !e.Comment && e.Transition == "" {
+			return fmt.Errorf("%s: set comment and/or transition", e.Environment)
+		}
+		envs = append(envs, e)
+	}
+	js.Environments = envs
+	return nil
+}
+
+// recordRunIssues stores the issue keys the run's commits mention and, after a successful deploy
+// to an environment configured in the Jira settings, updates those issues in the background.
+func (s *Server) recordRunIssues(runID int64, app config.App, result pipeline.Result, sha string) {
+	keys := pipeline.ParseIssuesLine(result.Log)
+	if len(keys) == 0 {
+		return
+	}
+	if err := s.store.SetRunIssues(runID, keys); err != nil {
+		log.Printf("run %d: record issues: %v", runID, err)
+		return
+	}
+	if result.Success && app.Environment != "" && appHasDeploySteps(app) {
+		go s.updateJiraIssues(runID, app, sha, keys)
+	}
+}
+
+// updateJiraIssues comments on and/or transitions the issues of a run deployed to app's
+// environment, as the Jira settings configure for it, and records the outcome as a run
+// notification.
+func (s *Server) updateJiraIssues(runID int64, app config.App, sha string, keys []string) {
+	js, err := s.store.GetJiraSettings()
+	if err != nil || js == nil {
+		return
+	}
+	var env *store.JiraEnvironment
+	for i := range js.Environments {
+		if js.Environments[i].Environment == app.Environment {
+			env = &js.Environments[i]
+			break
+		}
+	}
+	if env == nil {
+		return
+	}
+	short := sha
+	if len(short) > 12 {
+		short = short[:12]
+	}
+	comment := fmt.Sprintf("Deployed to %s by %s run #%d", app.Environment, app.Name, runID)
+	if short != "" {
+		comment += " (commit " + short + ")"
+	}
+	var updated, failed []string
+	for _, key := range keys {
+		if err := updateJiraIssue(js, *env, key, comment+"."); err != nil {
+			log.Printf("run %d: jira %s: %v", runID, key, err)
+			failed = append(failed, fmt.Sprintf("%s (%v)", key, err))
+			continue
+		}
+		updated = append(updated, key)
+	}
+	now := time.Now().UTC()
+	if len(updated) > 0 {
+		_, _ = s.store.CreateRunNotification(runID, "jira.updated", "updated "+strings.Join(updated, ", "), now)
+	}
+	if len(failed) > 0 {
+		_, _ = s.store.CreateRunNotification(runID, "jira.failed", "could not update "+strings.Join(failed, "; "), now)
+	}
+}
+
+// updateJiraIssue adds comment to an issue and applies the environment's transition. A
+// transition the issue does not offer (e.g. it is already past it) is skipped.
+func updateJiraIssue(js *store.JiraSettings, env store.JiraEnvironment, key, comment string) error {
+	issueURL := js.BaseURL + "/rest/api/2/issue/" + url.PathEscape(key)
+	if env.Comment {
+		if err := jiraDo(js, http.MethodPost, issueURL+"/comment", map[string]string{"body": comment}, nil); err != nil {
+			return fmt.Errorf("comment: %w", err)
+		}
+	}
+	if env.Transition == "" {
+		return nil
+	}
+	var list struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			To   struct {
+				Name string `json:"name"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+	if err := jiraDo(js, http.MethodGet, issueURL+"/transitions", nil, &list); err != nil {
+		return fmt.Errorf("transitions: %w", err)
+	}
+	for _, t := range list.Transitions {
+		if strings.EqualFold(t.Name, env.Transition) || strings.EqualFold(t.To.Name, env.Transition) {
+			body := map[string]interface{}{"transition": map[string]string{"id": t.ID}}
+			if err := jiraDo(js, http.MethodPost, issueURL+"/transitions", body, nil); err != nil {
+				return fmt.Errorf("transition %s: %w", env.Transition, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// jiraDo sends a Jira REST API request with the stored credentials: basic auth with the username
+// and API token, or the token as bearer token when no username is set.
+func jiraDo(js *store.JiraSettings, method, target string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if js.Username != "" {
+		req.SetBasicAuth(js.Username, js.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+js.Token)
+	}
+	resp, err := jiraClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("jira returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// runIssues returns the issues of a run, linked to the Jira site when one is configured.
+func (s *Server) runIssues(runID int64) ([]runIssue, error) {
+	keys, err := s.store.ListRunIssues(runID)
+	if err != nil || len(keys) == 0 {
+		return []runIssue{}, err
+	}
+	js, err := s.store.GetJiraSettings()
+	if err != nil {
+		return nil, err
+	}
+	issues := make([]runIssue, 0, len(keys))
+	for _, key := range keys {
+		issue := runIssue{Key: key}
+		if js != nil {
+			issue.URL = js.BaseURL + "/browse/" + url.PathEscape(key)
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// Clone cache layout: the init container mounts the cache PVC and checks out into the workspace
+// volume shared with the runner container.
+const (
+	k8sCloneContainer = "clone"
+	k8sCacheMountPath = "/var/cache/noppflow"
+)
+
+var k8sResourceNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?$`)
+
+func validateK8sCachePVC(name string) error {
+	if name != "" && !k8sResourceNamePattern.MatchString(name) {
+		return errors.New("k8s_cache_pvc must be a valid Kubernetes resource name")
+	}
+	return nil
+}
+
+// buildK8sCloneScript returns the clone init container script. It updates a bare mirror of the
+// repository on the cache PVC (one per app, recreated when an update fails), then clones the
+// branch from it into the workspace and points origin back at the real repository. flock, when
+// the image has it, serializes concurrent runs of the app on the mirror.
+func buildK8sCloneScript(app config.App) string {
+	mirror := shellQuote(fmt.Sprintf("%s/%s.git", k8sCacheMountPath, app.ID))
+	flags := ""
+	if len(app.SparsePaths) > 0 {
+		flags += " --sparse"
+	}
+	if app.GitSubmodules {
+		flags += " --recurse-submodules"
+	}
+	lines := []string{
+		"set -eu",
+		k8sGitSSHCommand,
+		"mirror=" + mirror,
+		`exec 9>"$mirror.lock"`,
+		"flock 9 2>/dev/null || true",
+		`if [ -d "$mirror" ]; then`,
+		"echo 'clone cache: updating mirror'",
+		fmt.Sprintf(`git -C "$mirror" remote set-url origin %s && git -C "$mirror" remote update --prune || rm -rf "$mirror"`, shellQuote(app.Repo)),
+		"fi",
+		`if [ ! -d "$mirror" ]; then`,
+		"echo 'clone cache: creating mirror'",
+		fmt.Sprintf(`git clone --mirror %s "$mirror" || { rm -rf "$mirror"; exit 1; }`, shellQuote(app.Repo)),
+		"fi",
+		fmt.Sprintf(`git clone --branch %s --single-branch%s "$mirror" /workspace/repo`, shellQuote(app.Branch), flags),
+		"exec 9>&-",
+		"cd /workspace/repo",
+		"git remote set-url origin " + shellQuote(app.Repo),
+	}
+	lines = append(lines, k8sSparseCheckoutLines(app)...)
+	return strings.Join(lines, "\n")
+}
+
+// k8sCloneCacheTemplate returns the pod template snippet adding the clone init container, the
+// cache PVC, and the workspace volume to a Job (merged with applyK8sPodTemplate).
+func k8sCloneCacheTemplate(app config.App, image string) map[string]interface{} {
+	workspaceMount := map[string]interface{}{"name": "workspace", "mountPath": "/workspace"}
+	return map[string]interface{}{
+		"spec": map[string]interface{}{
+			"initContainers": []interface{}{map[string]interface{}{
+				"name":            k8sCloneContainer,
+				"image":           image,
+				"imagePullPolicy": "IfNotPresent",
+				"command":         []interface{}{"/bin/sh", "-c", buildK8sCloneScript(app)},
+				"volumeMounts": []interface{}{
+					map[string]interface{}{"name": "ssh-key", "mountPath": "/var/run/noppflow-ssh", "readOnly": true},
+					map[string]interface{}{"name": "git-cache", "mountPath": k8sCacheMountPath},
+					workspaceMount,
+				},
+			}},
+			"containers": []interface{}{map[string]interface{}{
+				"name":         k8sRunnerContainer,
+				"volumeMounts": []interface{}{workspaceMount},
+			}},
+			"volumes": []interface{}{
+				map[string]interface{}{"name": "git-cache", "persistentVolumeClaim": map[string]interface{}{"claimName": app.K8sCachePVC}},
+				map[string]interface{}{"name": "workspace", "emptyDir": map[string]interface{}{}},
+			},
+		},
+	}
+}
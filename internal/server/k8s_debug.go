@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+const (
+	maxK8sDebugHoldMin       = 60
+	maxK8sDebugCommandBytes  = 4096
+	maxK8sDebugOutputBytes   = 1 << 20
+	k8sDebugExecTimeout      = time.Minute
+	k8sDebugHoldMarker       = "::debug-hold::"
+	k8sDebugNotificationSize = 200
+)
+
+// kubectlExec runs command with sh -c in the runner container of a pod and returns its combined
+// output (at most maxK8sDebugOutputBytes) and exit code (a var for tests).
+var kubectlExec = func(ctx context.Context, namespace, pod, command string) (string, bool, int, error) {
+	cmd := exec.CommandContext(ctx, "kubectl", "-n", namespace, "exec", pod, "-c", k8sRunnerContainer, "--", "sh", "-c", command)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	output, truncated := out.String(), false
+	if len(output) > maxK8sDebugOutputBytes {
+		output, truncated = output[:maxK8sDebugOutputBytes], true
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return output, truncated, exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return output, truncated, -1, err
+	}
+	return output, truncated, 0, nil
+}
+
+// holdK8sDebugPod records the pod of a failed Job run that now sleeps for the app's
+// k8s_debug_hold_min, and returns the line appended to the run log.
+func (s *Server) holdK8sDebugPod(runID int64, app config.App, namespace, jobName string) string {
+	pod, err := kubectlJobPod(namespace, jobName)
+	if err != nil {
+		return fmt.Sprintf("debug hold: pod of job %s/%s not found: %v", namespace, jobName, err)
+	}
+	p := store.K8sDebugHold{RunID: runID, AppID: app.ID, Namespace: namespace, Job: jobName, Pod: pod,
+		ExpiresAt: time.Now().UTC().Add(time.Duration(app.K8sDebugHoldMin) * time.Minute).Truncate(time.Second)}
+	if err := s.store.SaveK8sDebugHold(p); err != nil {
+		return fmt.Sprintf("debug hold: record pod %s/%s: %v", namespace, pod, err)
+	}
+	msg := fmt.Sprintf("pod %s/%s kept for debugging until %s", namespace, pod, p.ExpiresAt.Format(time.RFC3339))
+	_, _ = s.store.CreateRunNotification(runID, "debug.hold", msg, time.Now())
+	return "debug hold: " + msg
+}
+
+// k8sDebugPodHeld reports whether a run's Job is kept for debugging, so the reconciler leaves it.
+// Holds are read from the store, so the leader sees those of runs other replicas ran; when the
+// store cannot be read, the Job is left for the next reconcile.
+func (s *Server) k8sDebugPodHeld(runID int64) bool {
+	p, err := s.store.GetK8sDebugHold(runID, time.Now())
+	if err != nil {
+		log.Printf("reconcile: debug hold of run %d: %v", runID, err)
+		return true
+	}
+	return p != nil
+}
+
+// debugPodOfRequest resolves the run of the URL to its held pod (admin), writing an error
+// response when there is none.
+func (s *Server) debugPodOfRequest(w http.ResponseWriter, r *http.Request) (store.K8sDebugHold, bool) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return store.K8sDebugHold{}, false
+	}
+	runID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid run id"})
+		return store.K8sDebugHold{}, false
+	}
+	p, err := s.store.GetK8sDebugHold(runID, time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return store.K8sDebugHold{}, false
+	}
+	if p == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run has no pod kept for debugging"})
+		return store.K8sDebugHold{}, false
+	}
+	return *p, true
+}
+
+// getK8sDebugPod returns the pod kept for debugging after a failed Job run (admin).
+func (s *Server) getK8sDebugPod(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.debugPodOfRequest(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// execK8sDebugPod runs one command in the runner container of a held pod (admin) and returns
+// its output and exit code. Each command is recorded as a debug.exec run notification.
+func (s *Server) execK8sDebugPod(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.debugPodOfRequest(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Command string `json:"command"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Command) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "command is required"})
+		return
+	}
+	if len(req.Command) > maxK8sDebugCommandBytes {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("command must be at most %d bytes", maxK8sDebugCommandBytes)})
+		return
+	}
+	user := authUserFromContext(r)
+	ctx, cancel := context.WithTimeout(r.Context(), k8sDebugExecTimeout)
+	defer cancel()
+	output, truncated, exitCode, err := kubectlExec(ctx, p.Namespace, p.Pod, req.Command)
+	audit := req.Command
+	if len(audit) > k8sDebugNotificationSize {
+		audit = audit[:k8sDebugNotificationSize] + "..."
+	}
+	if err != nil {
+		log.Printf("run %d: %s ran %q in %s/%s: %v", p.RunID, user.Username, req.Command, p.Namespace, p.Pod, err)
+		_, _ = s.store.CreateRunNotification(p.RunID, "debug.exec", fmt.Sprintf("%s ran %q: %v", user.Username, audit, err), time.Now())
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error(), "output": output})
+		return
+	}
+	log.Printf("run %d: %s ran %q in %s/%s (exit %d)", p.RunID, user.Username, req.Command, p.Namespace, p.Pod, exitCode)
+	_, _ = s.store.CreateRunNotification(p.RunID, "debug.exec", fmt.Sprintf("%s ran %q (exit %d)", user.Username, audit, exitCode), time.Now())
+	writeJSON(w, http.StatusOK, map[string]interface{}{"output": output, "exit_code": exitCode, "truncated": truncated})
+}
+
+// releaseK8sDebugPod ends a debug hold early by deleting the run's Job and its pod (admin).
+func (s *Server) releaseK8sDebugPod(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.debugPodOfRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteK8sResource(p.Namespace, "job", p.Job); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.store.DeleteK8sDebugHold(p.RunID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	user := authUserFromContext(r)
+	log.Printf("run %d: %s released debug pod %s/%s", p.RunID, user.Username, p.Namespace, p.Pod)
+	_, _ = s.store.CreateRunNotification(p.RunID, "debug.released", user.Username+" deleted the debug pod", time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strings"
 	"time"
 
@@ -15,8 +18,33 @@ import (
 
 const k8sRunTimeout = 30 * time.Minute
 
+// Labels on the Jobs and Secrets NoppFlow creates, used by the orphan reconciler.
+const (
+	k8sManagedBySelector = "app.kubernetes.io/managed-by=noppflow"
+	k8sRunIDLabel        = "noppflow.io/run-id"
+)
+
+// k8sRunLabelsYAML renders the labels of a run's Job or Secret at the given indentation.
+func k8sRunLabelsYAML(runID int64, indent int) string {
+	prefix := strings.Repeat(" ", indent)
+	return fmt.Sprintf("%slabels:\n%s  app.kubernetes.io/managed-by: noppflow\n%s  %s: \"%d\"\n", prefix, prefix, prefix, k8sRunIDLabel, runID)
+}
+
+// appUsesK8sJob reports whether runs of app execute as a Kubernetes Job rather than on the
+// server host: either the app opts in with runner: kubernetes or it has a k8s_deploy step that
+// applies to the cluster (gitops deploys only push to a repository and run anywhere).
 func appUsesK8sJob(app config.App) bool {
-	for _, step := range app.EffectiveSteps() {
+	if app.Runner == "kubernetes" {
+		return true
+	}
+	if app.DeployMode == "gitops" {
+		return false
+	}
+	post := app.EffectivePost()
+	steps := append(app.EffectiveSteps(), post.OnSuccess...)
+	steps = append(steps, post.OnFailure...)
+	steps = append(steps, post.Always...)
+	for _, step := range steps {
 		if step.Kind() == "k8s_deploy" {
 			return true
 		}
@@ -24,7 +52,76 @@ func appUsesK8sJob(app config.App) bool {
 	return false
 }
 
-func (s *Server) runAppAsK8sJob(runID int64, app config.App, privateKey string, stepEnv map[string]string, onLogUpdate func(log string)) pipeline.Result {
+// validateRunner checks the app runner and, for runner: kubernetes, the Job settings it needs,
+// and that a debug hold is only set for apps that run as Jobs.
+// k8s_deploy steps are validated separately since they force a Job regardless of the runner.
+func validateRunner(app *config.App) error {
+	if app.K8sDebugHoldMin < 0 || app.K8sDebugHoldMin > maxK8sDebugHoldMin {
+		return fmt.Errorf("k8s_debug_hold_min must be between 0 and %d", maxK8sDebugHoldMin)
+	}
+	if app.K8sDebugHoldMin > 0 && !appUsesK8sJob(*app) {
+		return errors.New("k8s_debug_hold_min requires runs as Kubernetes Jobs (runner: kubernetes)")
+	}
+	switch app.Runner {
+	case "":
+		return nil
+	case "local":
+		if appUsesK8sJob(*app) {
+			return errors.New("runner local cannot be used with k8s_deploy steps")
+		}
+		return nil
+	case "kubernetes":
+	default:
+		return errors.New("runner must be local or kubernetes")
+	}
+	if app.K8sNamespace == "" {
+		return errors.New("k8s_namespace is required when runner is kubernetes")
+	}
+	if app.K8sServiceAccount == "" {
+		return errors.New("k8s_service_account is required when runner is kubernetes")
+	}
+	if app.K8sRunnerImage == "" {
+		return errors.New("k8s_runner_image is required when runner is kubernetes")
+	}
+	return nil
+}
+
+// k8sEnv is the step env of a Kubernetes Job run. Plain vars become container env vars in the
+// Job spec; Secret vars are stored in a per-run Secret loaded with envFrom, so their values never
+// appear in the Job spec or script. Sources labels each name for the run log (see buildRunEnv).
+type k8sEnv struct {
+	Plain   map[string]string
+	Secret  map[string]string
+	Sources map[string]string
+}
+
+// k8sSecretNamePattern matches env var names that look like credentials.
+var k8sSecretNamePattern = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIAL|API_?KEY|PRIVATE_?KEY)`)
+
+// splitK8sEnv sorts the step env into plain and secret vars. Global env vars (managed by admins in
+// the database) and vars whose names look like credentials are secret; app and run env vars are plain.
+func splitK8sEnv(stepEnv, sources map[string]string, logColor bool) k8sEnv {
+	if logColor {
+		stepEnv = pipeline.WithColorEnv(stepEnv)
+	}
+	env := k8sEnv{Plain: map[string]string{}, Secret: map[string]string{}, Sources: sources}
+	for name, value := range stepEnv {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if sources[name] == "global" || k8sSecretNamePattern.MatchString(name) {
+			env.Secret[name] = value
+		} else {
+			env.Plain[name] = value
+		}
+	}
+	return env
+}
+
+// runAppAsK8sJob runs the app pipeline as an ephemeral Job. timeout bounds the wait for
+// completion; when 0, k8sRunTimeout is used.
+func (s *Server) runAppAsK8sJob(runID int64, app config.App, privateKey, gitopsKey, dockerConfig string, stepEnv, envSources map[string]string, timeout time.Duration, onLogUpdate func(log string)) pipeline.Result {
 	namespace := strings.TrimSpace(app.K8sNamespace)
 	if namespace == "" {
 		return pipeline.Result{Success: false, Log: "k8s namespace is required"}
@@ -40,28 +137,58 @@ func (s *Server) runAppAsK8sJob(runID int64, app config.App, privateKey string,
 
 	jobName := fmt.Sprintf("noppflow-run-%d", runID)
 	secretName := jobName + "-ssh"
-	script := buildK8sJobScript(app, stepEnv)
+	env := splitK8sEnv(stepEnv, envSources, app.LogColor)
+	script := buildK8sJobScript(app, env)
 	if strings.TrimSpace(script) == "" {
 		return pipeline.Result{Success: false, Log: "empty k8s job script"}
 	}
 
-	secretYAML := buildK8sRunSecretYAML(namespace, secretName, privateKey)
+	secretYAML := buildK8sRunSecretYAML(namespace, secretName, runID, privateKey, gitopsKey, dockerConfig)
 	if err := kubectlApplyYAML(secretYAML); err != nil {
 		return pipeline.Result{Success: false, Log: fmt.Sprintf("failed to create ssh secret: %v", err)}
 	}
 	defer func() { _ = kubectlDeleteResource(namespace, "secret", secretName) }()
 
-	jobYAML := buildK8sRunJobYAML(namespace, jobName, serviceAccount, runnerImage, secretName, script)
+	envSecretName := ""
+	if len(env.Secret) > 0 {
+		envSecretName = jobName + "-env"
+		if err := kubectlApplyYAML(buildK8sEnvSecretYAML(namespace, envSecretName, runID, env.Secret)); err != nil {
+			return pipeline.Result{Success: false, Log: fmt.Sprintf("failed to create env secret: %v", err)}
+		}
+		defer func() { _ = kubectlDeleteResource(namespace, "secret", envSecretName) }()
+	}
+
+	jobYAML := buildK8sRunJobYAML(namespace, jobName, runID, serviceAccount, runnerImage, secretName, script, env.Plain, envSecretName)
+	var err error
+	if app.K8sCachePVC != "" {
+		if jobYAML, err = applyK8sPodTemplate(jobYAML, k8sCloneCacheTemplate(app, runnerImage)); err != nil {
+			return pipeline.Result{Success: false, Log: fmt.Sprintf("failed to add clone cache: %v", err)}
+		}
+	}
+	if jobYAML, err = applyK8sPodTemplate(jobYAML, app.K8sPodTemplate); err != nil {
+		return pipeline.Result{Success: false, Log: fmt.Sprintf("invalid k8s_pod_template: %v", err)}
+	}
 	if err := kubectlApplyYAML(jobYAML); err != nil {
 		return pipeline.Result{Success: false, Log: fmt.Sprintf("failed to create job: %v", err)}
 	}
+	// Owned by the Job, the Secrets are garbage-collected with it even if this process dies.
+	if uid, err := kubectlOutput("-n", namespace, "get", "job", jobName, "-o", "jsonpath={.metadata.uid}"); err == nil && uid != "" {
+		for _, name := range []string{secretName, envSecretName} {
+			if name != "" {
+				_ = kubectlSetJobOwner(namespace, "secret", name, jobName, uid)
+			}
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), k8sRunTimeout)
+	if timeout <= 0 {
+		timeout = k8sRunTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	lastLog := ""
 	for {
-		log, err := kubectlJobLogs(namespace, jobName)
+		log, err := kubectlJobLogs(namespace, jobName, app.K8sCachePVC != "")
 		if err == nil {
 			if log != lastLog {
 				lastLog = log
@@ -71,6 +198,11 @@ func (s *Server) runAppAsK8sJob(runID int64, app config.App, privateKey string,
 			}
 		}
 
+		if app.K8sDebugHoldMin > 0 && strings.Contains(lastLog, k8sDebugHoldMarker) {
+			// The script failed and now sleeps so the pod can be inspected; the run is over.
+			return pipeline.Result{Success: false, Log: lastLog + "\n\n" + s.holdK8sDebugPod(runID, app, namespace, jobName)}
+		}
+
 		done, success, err := kubectlJobDone(namespace, jobName)
 		if err == nil && done {
 			if success {
@@ -112,6 +244,13 @@ func kubectlDeleteResource(namespace, kind, name string) error {
 	return cmd.Run()
 }
 
+// kubectlSetJobOwner adds an owner reference to the Job to a resource.
+func kubectlSetJobOwner(namespace, kind, name, jobName, jobUID string) error {
+	patch := fmt.Sprintf(`{"metadata":{"ownerReferences":[{"apiVersion":"batch/v1","kind":"Job","name":%q,"uid":%q}]}}`, jobName, jobUID)
+	_, err := kubectlOutput("-n", namespace, "patch", kind, name, "--type=merge", "-p", patch)
+	return err
+}
+
 func kubectlOutput(args ...string) (string, error) {
 	cmd := exec.Command("kubectl", args...)
 	out, err := cmd.CombinedOutput()
@@ -139,7 +278,8 @@ func kubectlJobDone(namespace, jobName string) (done bool, success bool, err err
 	return false, false, nil
 }
 
-func kubectlJobLogs(namespace, jobName string) (string, error) {
+// kubectlJobPod returns the name of the Job's pod.
+func kubectlJobPod(namespace, jobName string) (string, error) {
 	podName, err := kubectlOutput("-n", namespace, "get", "pods", "-l", "job-name="+jobName, "-o", "jsonpath={.items[0].metadata.name}")
 	if err != nil {
 		return "", err
@@ -147,29 +287,97 @@ func kubectlJobLogs(namespace, jobName string) (string, error) {
 	if strings.TrimSpace(podName) == "" {
 		return "", fmt.Errorf("pod not ready")
 	}
-	return kubectlOutput("-n", namespace, "logs", podName, "--tail=-1")
+	return podName, nil
+}
+
+// kubectlJobLogs returns the runner container log of the Job's pod, preceded by the clone init
+// container log when withClone is set.
+func kubectlJobLogs(namespace, jobName string, withClone bool) (string, error) {
+	podName, err := kubectlJobPod(namespace, jobName)
+	if err != nil {
+		return "", err
+	}
+	cloneLog := ""
+	if withClone {
+		cloneLog, _ = kubectlOutput("-n", namespace, "logs", podName, "-c", k8sCloneContainer, "--tail=-1", "--timestamps")
+	}
+	log, err := kubectlOutput("-n", namespace, "logs", podName, "-c", k8sRunnerContainer, "--tail=-1", "--timestamps")
+	if err != nil {
+		if cloneLog != "" {
+			// The runner has not started yet while the clone is in progress.
+			return cloneLog, nil
+		}
+		return "", err
+	}
+	if cloneLog == "" {
+		return log, nil
+	}
+	return cloneLog + "\n" + log, nil
 }
 
-func buildK8sRunSecretYAML(namespace, secretName, privateKey string) string {
+// buildK8sRunSecretYAML returns the per-run Secret holding the SSH key, the GitOps repo SSH key
+// for deploy_mode gitops and, when the app uses registries, the Docker config.json with their credentials.
+func buildK8sRunSecretYAML(namespace, secretName string, runID int64, privateKey, gitopsKey, dockerConfig string) string {
 	encoded := base64.StdEncoding.EncodeToString([]byte(privateKey))
-	return fmt.Sprintf(`apiVersion: v1
+	out := fmt.Sprintf(`apiVersion: v1
 kind: Secret
 metadata:
   name: %s
   namespace: %s
-type: Opaque
+%stype: Opaque
 data:
   id_key: %s
-`, secretName, namespace, encoded)
+`, secretName, namespace, k8sRunLabelsYAML(runID, 2), encoded)
+	if gitopsKey != "" {
+		out += fmt.Sprintf("  gitops_key: %s\n", base64.StdEncoding.EncodeToString([]byte(gitopsKey)))
+	}
+	if dockerConfig != "" {
+		out += fmt.Sprintf("  config.json: %s\n", base64.StdEncoding.EncodeToString([]byte(dockerConfig)))
+	}
+	return out
+}
+
+// buildK8sEnvSecretYAML returns the per-run Secret holding the secret step env vars (loaded with envFrom).
+func buildK8sEnvSecretYAML(namespace, secretName string, runID int64, env map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `apiVersion: v1
+kind: Secret
+metadata:
+  name: %s
+  namespace: %s
+%stype: Opaque
+data:
+`, secretName, namespace, k8sRunLabelsYAML(runID, 2))
+	for _, name := range pipeline.SortedKeys(env) {
+		fmt.Fprintf(&b, "  %s: %s\n", name, base64.StdEncoding.EncodeToString([]byte(env[name])))
+	}
+	return b.String()
+}
+
+// buildK8sContainerEnvYAML renders the runner container's env (plain vars) and envFrom (the env
+// Secret) at container indentation; it is empty when there are neither.
+func buildK8sContainerEnvYAML(plainEnv map[string]string, envSecretName string) string {
+	var b strings.Builder
+	if len(plainEnv) > 0 {
+		b.WriteString("          env:\n")
+		for _, name := range pipeline.SortedKeys(plainEnv) {
+			value, _ := json.Marshal(plainEnv[name]) // a JSON string is a valid YAML double-quoted scalar
+			fmt.Fprintf(&b, "            - name: %s\n              value: %s\n", name, value)
+		}
+	}
+	if envSecretName != "" {
+		fmt.Fprintf(&b, "          envFrom:\n            - secretRef:\n                name: %s\n", envSecretName)
+	}
+	return b.String()
 }
 
-func buildK8sRunJobYAML(namespace, jobName, serviceAccount, image, secretName, script string) string {
+func buildK8sRunJobYAML(namespace, jobName string, runID int64, serviceAccount, image, secretName, script string, plainEnv map[string]string, envSecretName string) string {
 	return fmt.Sprintf(`apiVersion: batch/v1
 kind: Job
 metadata:
   name: %s
   namespace: %s
-spec:
+%sspec:
   backoffLimit: 0
   ttlSecondsAfterFinished: 3600
   template:
@@ -188,7 +396,7 @@ spec:
             - -c
             - |
 %s
-          volumeMounts:
+%s          volumeMounts:
             - name: ssh-key
               mountPath: /var/run/noppflow-ssh
               readOnly: true
@@ -196,53 +404,241 @@ spec:
         - name: ssh-key
           secret:
             secretName: %s
-`, jobName, namespace, serviceAccount, image, indentYAMLBlock(script, 14), secretName)
+`, jobName, namespace, k8sRunLabelsYAML(runID, 2), serviceAccount, image, indentYAMLBlock(script, 14), buildK8sContainerEnvYAML(plainEnv, envSecretName), secretName)
 }
 
-func buildK8sJobScript(app config.App, stepEnv map[string]string) string {
+// buildK8sJobScript returns the runner container script. The step env comes from the container
+// (see k8sEnv), so the script only exports step-level env vars.
+func buildK8sJobScript(app config.App, env k8sEnv) string {
 	steps := app.EffectiveSteps()
-	lines := []string{
-		"set -eu",
-		"mkdir -p /workspace",
-		"cd /workspace",
-		fmt.Sprintf("export GIT_SSH_COMMAND=%s", shellQuote("ssh -i /var/run/noppflow-ssh/id_key -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new")),
-		fmt.Sprintf("git clone --branch %s --single-branch %s repo", shellQuote(app.Branch), shellQuote(app.Repo)),
-		"cd repo",
-	}
-	for k, v := range stepEnv {
-		name := strings.TrimSpace(k)
-		if name == "" {
-			continue
+	lines := []string{"set -eu", k8sGitSSHCommand}
+	if app.K8sCachePVC != "" {
+		// The clone init container has checked out the repository (see buildK8sCloneScript).
+		lines = append(lines, "cd /workspace/repo")
+	} else {
+		lines = append(lines, "mkdir -p /workspace", "cd /workspace",
+			fmt.Sprintf("git clone --branch %s --single-branch%s %s repo", shellQuote(app.Branch), k8sCloneFlags(app), shellQuote(app.Repo)),
+			"cd repo",
+		)
+		lines = append(lines, k8sSparseCheckoutLines(app)...)
+	}
+	if app.GitLFS {
+		lines = append(lines, "git lfs pull")
+		if app.GitSubmodules {
+			lines = append(lines, "git submodule foreach --recursive 'git lfs pull'")
+		}
+	}
+	lines = append(lines, `echo "commit: $(git rev-parse HEAD)"`, `echo "subject: $(git log -1 --format=%s)"`)
+	if len(env.Sources) > 0 {
+		lines = append(lines, "echo "+shellQuote("env: "+pipeline.FormatEnvSources(env.Sources)))
+	}
+	if len(app.Registries) > 0 {
+		// The secret volume is read-only; copy config.json so docker can update it.
+		lines = append(lines,
+			"mkdir -p /tmp/noppflow-registry",
+			"cp /var/run/noppflow-ssh/config.json /tmp/noppflow-registry/config.json",
+			"export DOCKER_CONFIG=/tmp/noppflow-registry",
+			"export HELM_REGISTRY_CONFIG=/tmp/noppflow-registry/config.json",
+			"export REGISTRY_AUTH_FILE=/tmp/noppflow-registry/config.json",
+		)
+	}
+	if app.EnvReport {
+		lines = append(lines, buildK8sEnvReportLines()...)
+	}
+	lines = append(lines, "noppflow_failed=0")
+	lines = append(lines, buildK8sStepLines(app, env, steps, "noppflow_failed")...)
+	post := app.EffectivePost()
+	if !post.Empty() {
+		lines = append(lines, "noppflow_main_failed=$noppflow_failed")
+		if len(post.OnSuccess) > 0 {
+			lines = append(lines, `if [ "$noppflow_main_failed" = 0 ]; then`, "echo '=== Post: on_success ==='", "noppflow_post_failed=0")
+			lines = append(lines, buildK8sStepLines(app, env, post.OnSuccess, "noppflow_post_failed")...)
+			lines = append(lines, "fi")
+		}
+		if len(post.OnFailure) > 0 {
+			lines = append(lines, `if [ "$noppflow_main_failed" != 0 ]; then`, "echo '=== Post: on_failure ==='", "noppflow_post_failed=0")
+			lines = append(lines, buildK8sStepLines(app, env, post.OnFailure, "noppflow_post_failed")...)
+			lines = append(lines, "fi")
+		}
+		if len(post.Always) > 0 {
+			lines = append(lines, "echo '=== Post: always ==='", "noppflow_post_failed=0")
+			lines = append(lines, buildK8sStepLines(app, env, post.Always, "noppflow_post_failed")...)
 		}
-		lines = append(lines, fmt.Sprintf("export %s=%s", name, shellQuote(v)))
 	}
+	if app.K8sDebugHoldMin > 0 {
+		lines = append(lines, fmt.Sprintf(`if [ "$noppflow_failed" != 0 ]; then echo '%s%d'; sleep %d; exit 1; fi`, k8sDebugHoldMarker, app.K8sDebugHoldMin, app.K8sDebugHoldMin*60))
+	}
+	lines = append(lines, `if [ "$noppflow_failed" != 0 ]; then exit 1; fi`)
+	lines = append(lines, "echo 'pipeline completed successfully'")
+	return strings.Join(lines, "\n")
+}
+
+// buildK8sStepLines returns shell lines running steps in order. A failing step sets failedVar
+// (and noppflow_failed) to 1; later steps are skipped while failedVar is set, unless always_run.
+func buildK8sStepLines(app config.App, env k8sEnv, steps []config.Step, failedVar string) []string {
+	var lines []string
 	for _, step := range steps {
-		lines = append(lines, fmt.Sprintf("echo %s", shellQuote("=== Step: "+step.Name+" ===")))
+		stepCmd := ""
 		switch step.Kind() {
 		case "cmd":
-			lines = append(lines, fmt.Sprintf("sh -c %s", shellQuote(step.Cmd)))
+			stepCmd = fmt.Sprintf("sh -c %s", shellQuote(step.Cmd))
 		case "file":
-			lines = append(lines, fmt.Sprintf("sh %s", shellQuote(step.File)))
+			stepCmd = k8sShellFileCommand(app, step.File)
 		case "script":
-			lines = append(lines, fmt.Sprintf("printf %%s %s | sh", shellQuote(step.Script)))
+			stepCmd = fmt.Sprintf("printf %%s %s | %s", shellQuote(pipeline.WithProfileScripts(app, step.Script)), strings.Join(pipeline.StepShell(app), " "))
+		case "scan":
+			stepCmd = k8sScanCommand(step, env)
+		case "wait_for":
+			stepCmd = k8sWaitForCommand(step, env)
+		case "sign":
+			stepCmd = k8sSignCommand(step, env)
+		case "ansible":
+			stepCmd = fmt.Sprintf("sh -c %s", shellQuote(pipeline.AnsibleScript(step)))
 		case "k8s_deploy":
-			if app.DeployMode == "kubectl" {
-				lines = append(lines, fmt.Sprintf("kubectl -n %s apply -f %s", shellQuote(app.K8sNamespace), shellQuote(app.DeployManifestPath)))
+			if app.DeployMode == "gitops" {
+				stepCmd = fmt.Sprintf("GIT_SSH_COMMAND=%s sh -c %s", shellQuote(k8sGitOpsSSHCommand), shellQuote(pipeline.GitOpsScript(app)))
+			} else if app.DeployMode == "kubectl" {
+				stepCmd = fmt.Sprintf("kubectl -n %s apply -f %s", shellQuote(app.DeployNamespace()), shellQuote(app.DeployManifestPath))
 			} else if app.DeployMode == "helm" {
-				helmCmd := fmt.Sprintf("helm upgrade --install %s %s -n %s", shellQuote(app.ID), shellQuote(app.HelmChart), shellQuote(app.K8sNamespace))
+				stepCmd = fmt.Sprintf("helm upgrade --install %s %s -n %s", shellQuote(app.ID), shellQuote(app.HelmChart), shellQuote(app.DeployNamespace()))
 				if strings.TrimSpace(app.HelmValuesPath) != "" {
-					helmCmd += fmt.Sprintf(" -f %s", shellQuote(app.HelmValuesPath))
+					stepCmd += fmt.Sprintf(" -f %s", shellQuote(app.HelmValuesPath))
 				}
-				lines = append(lines, helmCmd)
 			}
 		}
-		lines = append(lines, fmt.Sprintf("echo %s", shellQuote(step.Name+" step OK")))
+		if stepCmd == "" {
+			stepCmd = "true"
+		}
+		var prefix []string
+		for _, name := range pipeline.SortedKeys(step.Env) {
+			prefix = append(prefix, fmt.Sprintf("export %s=%s", name, k8sStepEnvValue(step.Env[name], env)))
+		}
+		if step.Workdir != "" {
+			prefix = append(prefix, "cd "+shellQuote(step.Workdir))
+		}
+		if len(prefix) > 0 {
+			stepCmd = fmt.Sprintf("(%s && %s)", strings.Join(prefix, " && "), stepCmd)
+		}
+
+		onSuccess := fmt.Sprintf("echo %s", shellQuote(step.Name+" step OK"))
 		if step.SleepSec > 0 {
-			lines = append(lines, fmt.Sprintf("sleep %d", step.SleepSec))
+			onSuccess += fmt.Sprintf("; sleep %d", step.SleepSec)
+		}
+		onFailure := fmt.Sprintf("echo %s; %s=1", shellQuote(step.Name+" step failed"), failedVar)
+		if failedVar != "noppflow_failed" {
+			onFailure += "; noppflow_failed=1"
 		}
+		if step.ContinueOnError {
+			onFailure = fmt.Sprintf("echo %s", shellQuote(step.Name+" step failed (ignored: continue_on_error)"))
+		}
+		run := []string{fmt.Sprintf("echo %s", shellQuote("=== Step: "+step.Name+" ==="))}
+		if warning := pipeline.CmdStepShellWarning(app, step); warning != "" {
+			run = append(run, "echo "+shellQuote(warning))
+		}
+		run = append(run, fmt.Sprintf("if %s; then %s; else %s; fi", stepCmd, onSuccess, onFailure))
+		if step.AlwaysRun {
+			lines = append(lines, run...)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`if [ "$%s" = 0 ]; then`, failedVar))
+		lines = append(lines, run...)
+		lines = append(lines, "else", fmt.Sprintf("echo %s", shellQuote(step.Name+" step skipped (previous step failed)")), "fi")
 	}
-	lines = append(lines, "echo 'pipeline completed successfully'")
-	return strings.Join(lines, "\n")
+	return lines
+}
+
+var k8sEnvRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// k8sStepEnvValue renders a step env value as a shell word, interpolated like config.Step.ResolveEnv:
+// references to plain vars are replaced by their values, references to secret vars are left to the
+// shell ("${NAME}") so secret values stay out of the script, and other references are kept as written.
+func k8sStepEnvValue(v string, env k8sEnv) string {
+	var b strings.Builder
+	literal, last := "", 0
+	for _, m := range k8sEnvRefPattern.FindAllStringSubmatchIndex(v, -1) {
+		name := ""
+		if m[2] >= 0 {
+			name = v[m[2]:m[3]]
+		} else {
+			name = v[m[4]:m[5]]
+		}
+		literal += v[last:m[0]]
+		if value, ok := env.Plain[name]; ok {
+			literal += value
+		} else if _, ok := env.Secret[name]; ok {
+			b.WriteString(shellQuote(literal))
+			b.WriteString(`"${` + name + `}"`)
+			literal = ""
+		} else {
+			literal += v[m[0]:m[1]]
+		}
+		last = m[1]
+	}
+	b.WriteString(shellQuote(literal + v[last:]))
+	return b.String()
+}
+
+// buildK8sEnvReportLines returns shell lines printing the same diagnostics as the local environment report.
+func buildK8sEnvReportLines() []string {
+	lines := []string{
+		"echo '=== Environment report ==='",
+		`echo "os: $(uname -s)/$(uname -m)"`,
+		`echo "hostname: $(hostname 2>/dev/null || true)"`,
+		`echo "kernel: $(uname -a)"`,
+	}
+	for _, tool := range pipeline.EnvReportTools {
+		probe := strings.Join(append([]string{tool.Name}, tool.Args...), " ")
+		lines = append(lines, fmt.Sprintf(`if command -v %s >/dev/null 2>&1; then echo "%s: $(%s 2>&1 | tr '
+' ' ')"; else echo '%s: not available'; fi`, tool.Name, tool.Name, probe, tool.Name))
+	}
+	lines = append(lines,
+		"echo 'disk:'; df -h . || true",
+		"grep -E '^(MemTotal|MemAvailable):' /proc/meminfo | sed 's/^/memory: /' || true",
+		`echo "cpus: $(nproc 2>/dev/null || echo unknown)"`,
+		"echo '=== End of environment report ==='",
+	)
+	return lines
+}
+
+// k8sGitSSHCommand makes git use the run's SSH key from the ssh-key secret volume;
+// k8sGitOpsSSHCommand is its counterpart for the GitOps repo key of deploy_mode gitops.
+var (
+	k8sGitSSHCommand    = fmt.Sprintf("export GIT_SSH_COMMAND=%s", shellQuote("ssh -i /var/run/noppflow-ssh/id_key -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new"))
+	k8sGitOpsSSHCommand = "ssh -i /var/run/noppflow-ssh/gitops_key -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new"
+)
+
+func k8sSparseCheckoutLines(app config.App) []string {
+	if len(app.SparsePaths) == 0 {
+		return nil
+	}
+	quoted := make([]string, 0, len(app.SparsePaths))
+	for _, p := range app.SparsePaths {
+		quoted = append(quoted, shellQuote(p))
+	}
+	return []string{"git sparse-checkout set --cone -- " + strings.Join(quoted, " ")}
+}
+
+func k8sCloneFlags(app config.App) string {
+	flags := ""
+	if len(app.SparsePaths) > 0 {
+		flags += " --filter=blob:none --sparse"
+	}
+	if app.GitSubmodules {
+		flags += " --recurse-submodules"
+	}
+	return flags
+}
+
+// k8sShellFileCommand is pipeline.FileCommand as a shell line; the shell and its options are
+// validated words (see validateStepShell), so only the other arguments are quoted.
+func k8sShellFileCommand(app config.App, file string) string {
+	shell := pipeline.StepShell(app)
+	args := pipeline.FileCommand(app, file)
+	quoted := make([]string, 0, len(args)-len(shell))
+	for _, arg := range args[len(shell):] {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(shell, " ") + " " + strings.Join(quoted, " ")
 }
 
 func shellQuote(s string) string {
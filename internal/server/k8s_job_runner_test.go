@@ -0,0 +1,799 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"noppflow/internal/auth"
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+func TestBuildK8sJobScript_SubmodulesAndLFS(t *testing.T) {
+	app := config.App{
+		ID: "app-a", Repo: "git@example.com:org/a.git", Branch: "main",
+		GitSubmodules: true, GitLFS: true,
+		Steps: []config.Step{{Name: "build", Cmd: "make"}},
+	}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if !strings.Contains(script, "--single-branch --recurse-submodules 'git@example.com:org/a.git' repo") {
+		t.Fatalf("expected recursive clone, got:\n%s", script)
+	}
+	if !strings.Contains(script, "git lfs pull") || !strings.Contains(script, "git submodule foreach --recursive 'git lfs pull'") {
+		t.Fatalf("expected lfs pulls, got:\n%s", script)
+	}
+
+	plain := buildK8sJobScript(config.App{ID: "b", Repo: "r", Branch: "main", Steps: []config.Step{{Name: "x", Cmd: "true"}}}, k8sEnv{})
+	if strings.Contains(plain, "--recurse-submodules") || strings.Contains(plain, "git lfs") {
+		t.Fatalf("expected plain clone, got:\n%s", plain)
+	}
+}
+
+func TestBuildK8sJobScript_SparsePaths(t *testing.T) {
+	app := config.App{
+		ID: "mono", Repo: "git@example.com:org/mono.git", Branch: "main",
+		SparsePaths: []string{"services/api", "libs/common"},
+		Steps:       []config.Step{{Name: "build", Cmd: "make"}},
+	}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if !strings.Contains(script, "--single-branch --filter=blob:none --sparse 'git@example.com:org/mono.git' repo") {
+		t.Fatalf("expected partial sparse clone, got:\n%s", script)
+	}
+	if !strings.Contains(script, "git sparse-checkout set --cone -- 'services/api' 'libs/common'") {
+		t.Fatalf("expected sparse-checkout set, got:\n%s", script)
+	}
+}
+
+func TestBuildK8sJobScript_StepWorkdir(t *testing.T) {
+	app := config.App{ID: "a", Repo: "r", Branch: "main", Steps: []config.Step{
+		{Name: "web", Cmd: "npm ci", Workdir: "frontend"},
+		{Name: "api", Cmd: "go build ./..."},
+	}}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if !strings.Contains(script, "(cd 'frontend' && sh -c 'npm ci')") {
+		t.Fatalf("expected step to run in workdir, got:\n%s", script)
+	}
+	if !strings.Contains(script, "if sh -c 'go build ./...'; then") {
+		t.Fatalf("expected step without workdir unchanged, got:\n%s", script)
+	}
+}
+
+func TestBuildK8sJobScript_StepEnv(t *testing.T) {
+	app := config.App{ID: "a", Repo: "r", Branch: "main", Steps: []config.Step{
+		{Name: "web", Cmd: "npm run build", Workdir: "frontend", Env: map[string]string{"NODE_ENV": "production", "API": "${BASE}/v1"}},
+	}}
+	script := buildK8sJobScript(app, k8sEnv{Plain: map[string]string{"BASE": "https://api"}})
+	want := "(export API='https://api/v1' && export NODE_ENV='production' && cd 'frontend' && sh -c 'npm run build')"
+	if !strings.Contains(script, want) {
+		t.Fatalf("expected %q in script:\n%s", want, script)
+	}
+}
+
+func TestBuildK8sJobScript_ContinueOnErrorAndAlwaysRun(t *testing.T) {
+	app := config.App{ID: "a", Repo: "r", Branch: "main", Steps: []config.Step{
+		{Name: "lint", Cmd: "make lint", ContinueOnError: true},
+		{Name: "test", Cmd: "make test"},
+		{Name: "cleanup", Cmd: "make clean", AlwaysRun: true},
+	}}
+	script := buildK8sJobScript(app, k8sEnv{})
+	for _, want := range []string{
+		"if sh -c 'make lint'; then echo 'lint step OK'; else echo 'lint step failed (ignored: continue_on_error)'; fi",
+		"if sh -c 'make test'; then echo 'test step OK'; else echo 'test step failed'; noppflow_failed=1; fi",
+		"echo 'test step skipped (previous step failed)'",
+		"echo '=== Step: cleanup ==='\nif sh -c 'make clean'",
+		`if [ "$noppflow_failed" != 0 ]; then exit 1; fi`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("expected %q in script:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "cleanup step skipped") {
+		t.Fatalf("always_run step must not be guarded, got:\n%s", script)
+	}
+}
+
+func TestBuildK8sJobScript_PostSections(t *testing.T) {
+	app := config.App{ID: "a", Repo: "r", Branch: "main",
+		Steps: []config.Step{{Name: "deploy", Cmd: "make deploy"}},
+		Post: &config.PostSteps{
+			OnFailure: []config.Step{{Name: "rollback", Cmd: "make rollback"}},
+			Always:    []config.Step{{Name: "notify", Cmd: "make notify"}},
+		},
+	}
+	script := buildK8sJobScript(app, k8sEnv{})
+	for _, want := range []string{
+		"noppflow_main_failed=$noppflow_failed",
+		"if [ \"$noppflow_main_failed\" != 0 ]; then\necho '=== Post: on_failure ==='\nnoppflow_post_failed=0",
+		"else echo 'rollback step failed'; noppflow_post_failed=1; noppflow_failed=1; fi",
+		"echo '=== Post: always ==='",
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("expected %q in script:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "on_success") {
+		t.Fatalf("unexpected on_success section, got:\n%s", script)
+	}
+}
+
+func TestBuildK8sJobScript_RegistryLogin(t *testing.T) {
+	app := config.App{ID: "a", Repo: "r", Branch: "main", Registries: []string{"ghcr"}, Steps: []config.Step{{Name: "push", Cmd: "docker push x"}}}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if !strings.Contains(script, "export DOCKER_CONFIG=/tmp/noppflow-registry") || !strings.Contains(script, "export HELM_REGISTRY_CONFIG=/tmp/noppflow-registry/config.json") {
+		t.Fatalf("expected registry login env, got:\n%s", script)
+	}
+	secret := buildK8sRunSecretYAML("ns", "run-1-ssh", 1, "key", "", `{"auths":{}}`)
+	if !strings.Contains(secret, "  config.json: eyJhdXRocyI6e319\n") {
+		t.Fatalf("expected config.json in secret, got:\n%s", secret)
+	}
+	if strings.Contains(buildK8sRunSecretYAML("ns", "run-1-ssh", 1, "key", "", ""), "config.json") {
+		t.Fatal("expected no config.json without registries")
+	}
+}
+
+func TestK8sJob_StepEnvPlainAndSecret(t *testing.T) {
+	env := splitK8sEnv(
+		map[string]string{"NODE_ENV": "production", "DB_URL": "postgres://u:p@db", "NPM_TOKEN": "tok'en", "VERBOSE": "1"},
+		map[string]string{"NODE_ENV": "app", "DB_URL": "global", "NPM_TOKEN": "app", "VERBOSE": "run"},
+		false,
+	)
+	if len(env.Plain) != 2 || env.Plain["NODE_ENV"] != "production" || env.Plain["VERBOSE"] != "1" {
+		t.Fatalf("unexpected plain env %v", env.Plain)
+	}
+	if len(env.Secret) != 2 || env.Secret["DB_URL"] == "" || env.Secret["NPM_TOKEN"] == "" {
+		t.Fatalf("expected global and credential-like vars secret, got %v", env.Secret)
+	}
+
+	app := config.App{ID: "a", Repo: "r", Branch: "main", Steps: []config.Step{
+		{Name: "publish", Cmd: "npm publish", Env: map[string]string{"AUTH": "Bearer ${NPM_TOKEN}", "MODE": "$NODE_ENV-$UNKNOWN"}},
+	}}
+	script := buildK8sJobScript(app, env)
+	if strings.Contains(script, "tok") || strings.Contains(script, "postgres://") {
+		t.Fatalf("secret values must not be in the script:\n%s", script)
+	}
+	for _, want := range []string{
+		`export AUTH='Bearer '"${NPM_TOKEN}"''`,
+		`export MODE='production-$UNKNOWN'`,
+		"echo 'env: DB_URL (global), NODE_ENV (app), NPM_TOKEN (app), VERBOSE (run)'",
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("expected %q in script:\n%s", want, script)
+		}
+	}
+
+	job := buildK8sRunJobYAML("ns", "noppflow-run-1", 1, "sa", "img", "noppflow-run-1-ssh", script, env.Plain, "noppflow-run-1-env")
+	for _, want := range []string{
+		"          env:\n            - name: NODE_ENV\n              value: \"production\"\n            - name: VERBOSE\n              value: \"1\"\n",
+		"          envFrom:\n            - secretRef:\n                name: noppflow-run-1-env\n          volumeMounts:",
+	} {
+		if !strings.Contains(job, want) {
+			t.Fatalf("expected %q in job:\n%s", want, job)
+		}
+	}
+	if strings.Contains(job, "tok") {
+		t.Fatalf("secret values must not be in the job spec:\n%s", job)
+	}
+	secret := buildK8sEnvSecretYAML("ns", "noppflow-run-1-env", 1, env.Secret)
+	if !strings.Contains(secret, "  NPM_TOKEN: dG9rJ2Vu\n") || !strings.Contains(secret, "  DB_URL: ") {
+		t.Fatalf("unexpected env secret:\n%s", secret)
+	}
+	if plain := buildK8sRunJobYAML("ns", "j", 2, "sa", "img", "s", "true", nil, ""); strings.Contains(plain, "env:") || strings.Contains(plain, "envFrom") {
+		t.Fatalf("expected no env sections without env, got:\n%s", plain)
+	}
+}
+
+func TestServer_ProvisionK8sNamespace(t *testing.T) {
+	defer func(f func(context.Context, string, string, string, bool) (string, error)) { kubectlApplyManifest = f }(kubectlApplyManifest)
+	var gotConfig, gotManifest string
+	kubectlApplyManifest = func(_ context.Context, kubeconfig, _, manifest string, dryRun bool) (string, error) {
+		gotConfig, gotManifest = kubeconfig, manifest
+		return "namespace/shop created\nserviceaccount/noppflow-runner created\n", nil
+	}
+	h, st, _, _ := setupTestServer(t, nil)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateUser("alice", hash, false); err != nil {
+		t.Fatal(err)
+	}
+	aliceCookie := loginAndCookie(t, h, "alice", "alice123")
+	provision := func(cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/k8s/provision", strings.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := `{"namespace":"shop","runner_image":"runner:1","controller_service_account":"noppflow-controller","server":"https://k8s.example.com:6443","token":"t0ken"}`
+	if rec := provision(aliceCookie, body); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admins, got %d", rec.Code)
+	}
+	for _, bad := range []string{
+		`{"namespace":"Shop"}`,
+		`{"namespace":"shop","server":"http://k8s.example.com","token":"t"}`,
+		`{"namespace":"shop","server":"https://k8s.example.com"}`,
+		`{"namespace":"shop","kubeconfig":"apiVersion: v1","token":"t"}`,
+	} {
+		if rec := provision(adminCookie, bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d %s", bad, rec.Code, rec.Body.String())
+		}
+	}
+	rec := provision(adminCookie, body)
+	var out struct {
+		Applied     []string          `json:"applied"`
+		AppSettings map[string]string `json:"app_settings"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("provision: %d %s", rec.Code, rec.Body.String())
+	}
+	if len(out.Applied) != 2 || out.AppSettings["k8s_namespace"] != "shop" || out.AppSettings["k8s_service_account"] != "noppflow-runner" || out.AppSettings["k8s_runner_image"] != "runner:1" {
+		t.Fatalf("unexpected provisioning result %+v", out)
+	}
+	if !strings.Contains(gotConfig, `server: "https://k8s.example.com:6443"`) || !strings.Contains(gotConfig, `token: "t0ken"`) {
+		t.Fatalf("expected a kubeconfig for the given server, got:\n%s", gotConfig)
+	}
+	for _, want := range []string{"kind: Namespace", "kind: ServiceAccount", "name: noppflow-runner", "kind: RoleBinding", "name: noppflow-controller\n    namespace: noppflow"} {
+		if !strings.Contains(gotManifest, want) {
+			t.Fatalf("expected %q in the manifest:\n%s", want, gotManifest)
+		}
+	}
+	if rec := provision(adminCookie, `{"namespace":"shop"}`); rec.Code != http.StatusOK || gotConfig != "" || strings.Contains(gotManifest, "noppflow-controller") {
+		t.Fatalf("expected the server's own kubeconfig and no controller role, got %d %q", rec.Code, gotConfig)
+	}
+}
+
+// fakeKubectlPreflight answers `kubectl version` with version and `kubectl auth can-i` with no
+// for the denied permissions (as joined in k8sPreflightPermissions) and yes otherwise.
+func fakeKubectlPreflight(version string, denied []string) func(context.Context, ...string) (string, string, error) {
+	return func(_ context.Context, args ...string) (string, string, error) {
+		if args[0] == "version" {
+			return version, "", nil
+		}
+		perm := strings.Join(args[2:len(args)-2], " ")
+		for _, d := range denied {
+			if d == perm {
+				return "no\n", "", errors.New("exit status 1")
+			}
+		}
+		return "yes\n", "", nil
+	}
+}
+
+func TestPreflightK8sJob(t *testing.T) {
+	defer func(f func(context.Context, ...string) (string, string, error)) { kubectlPreflight = f }(kubectlPreflight)
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "preflight.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	app := config.App{ID: "app-a", Runner: "kubernetes", K8sNamespace: "apps", K8sServiceAccount: "runner", K8sRunnerImage: "runner:1"}
+	srv := New([]config.App{app}, st, nil, "", "")
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubectlPreflight = func(context.Context, ...string) (string, string, error) {
+		return `{"clientVersion":{"major":"1","minor":"30","gitVersion":"v1.30.1"}}`, "Unable to connect to the server: dial tcp 10.0.0.1:6443: i/o timeout", errors.New("exit status 1")
+	}
+	if err := srv.preflightK8sJob(runID, app); err == nil || !strings.Contains(err.Error(), "i/o timeout") || !strings.Contains(err.Error(), "kubeconfig") {
+		t.Fatalf("expected an unreachable cluster error, got %v", err)
+	}
+	if err := srv.preflightK8sJob(runID, config.App{ID: "local"}); err != nil {
+		t.Fatalf("expected local runs not to be checked, got %v", err)
+	}
+
+	skewed := `{"clientVersion":{"major":"1","minor":"26","gitVersion":"v1.26.0"},"serverVersion":{"major":"1","minor":"29+","gitVersion":"v1.29.4-eks"}}`
+	kubectlPreflight = fakeKubectlPreflight(skewed, []string{"delete jobs.batch", "get pods --subresource=log"})
+	err = srv.preflightK8sJob(runID, app)
+	if err == nil || !strings.Contains(err.Error(), "delete jobs.batch, get pods --subresource=log in namespace apps") || !strings.Contains(err.Error(), "controller-rbac") {
+		t.Fatalf("expected the denied permissions, got %v", err)
+	}
+	notes, err := st.ListRunNotifications(runID)
+	if err != nil || len(notes) != 1 || notes[0].Event != "k8s.version_skew" || !strings.Contains(notes[0].Message, "v1.26.0 is 3 minor versions away") {
+		t.Fatalf("expected a version skew warning, got %+v (%v)", notes, err)
+	}
+
+	calls := 0
+	allowed := fakeKubectlPreflight(skewed, nil)
+	kubectlPreflight = func(ctx context.Context, args ...string) (string, string, error) {
+		calls++
+		return allowed(ctx, args...)
+	}
+	for i := 0; i < 2; i++ {
+		if err := srv.preflightK8sJob(runID, app); err != nil {
+			t.Fatalf("expected the preflight to pass, got %v", err)
+		}
+	}
+	if calls != 1+len(k8sPreflightPermissions) {
+		t.Fatalf("expected a passed namespace not to be checked again, got %d kubectl calls", calls)
+	}
+
+	debugApp := app
+	debugApp.K8sDebugHoldMin = 10
+	kubectlPreflight = fakeKubectlPreflight(skewed, []string{"create pods --subresource=exec"})
+	if err := srv.preflightK8sJob(runID, debugApp); err == nil || !strings.Contains(err.Error(), "may not create pods --subresource=exec in namespace apps") {
+		t.Fatalf("expected debug holds to need exec, got %v", err)
+	}
+}
+
+func TestReconcile_InterruptsOrphanedRunsAndDeletesK8sResources(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "reconcile.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	srv := New([]config.App{{ID: "app-a", Name: "App A"}}, st, nil, "", "")
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, err := st.CreateRun("app-a", "", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := st.UpdateRunStatus(ids[2], "success", "done"); err != nil {
+		t.Fatal(err)
+	}
+	srv.trackRun(ids[1])
+	srv.interruptOrphanedRuns()
+	for i, want := range []string{"interrupted", "pending", "success"} {
+		run, err := st.GetRun(ids[i])
+		if err != nil || run.Status != want {
+			t.Fatalf("run %d: expected %s, got %+v (%v)", ids[i], want, run, err)
+		}
+	}
+
+	resources := parseK8sManagedResources("Job noppflow-run-2 2\nSecret noppflow-run-2-ssh 2\nJob noppflow-run-4 4\nSecret noppflow-run-4-env 4\nbogus line\n")
+	if len(resources) != 4 || resources[0] != (k8sManagedResource{Kind: "job", Name: "noppflow-run-2", RunID: 2}) {
+		t.Fatalf("unexpected parsed resources %+v", resources)
+	}
+	orphan, err := st.CreateRun("app-a", "", "admin")
+	if err != nil || orphan != 4 {
+		t.Fatalf("expected run 4, got %d (%v)", orphan, err)
+	}
+	if err := st.UpdateRunStatus(orphan, "running", ""); err != nil {
+		t.Fatal(err)
+	}
+	var deleted []string
+	prev := deleteK8sResource
+	deleteK8sResource = func(namespace, kind, name string) error {
+		deleted = append(deleted, namespace+"/"+kind+"/"+name)
+		return nil
+	}
+	defer func() { deleteK8sResource = prev }()
+	srv.cleanupK8sOrphans("apps", resources)
+	if strings.Join(deleted, ",") != "apps/job/noppflow-run-4,apps/secret/noppflow-run-4-env" {
+		t.Fatalf("expected only run 4 resources deleted, got %v", deleted)
+	}
+	if run, _ := st.GetRun(orphan); run.Status != "interrupted" || run.EndedAt == nil {
+		t.Fatalf("expected orphaned run interrupted, got %+v", run)
+	}
+	if run, _ := st.GetRun(ids[1]); run.Status != "pending" {
+		t.Fatalf("expected tracked run untouched, got %s", run.Status)
+	}
+}
+
+func TestApplyK8sPodTemplate_MergesIntoGeneratedJob(t *testing.T) {
+	base := buildK8sRunJobYAML("apps", "noppflow-run-7", 7, "runner-sa", "runner:1", "noppflow-run-7-ssh", "make", nil, "")
+	tmpl := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{"team": "build"}},
+		"spec": map[string]interface{}{
+			"imagePullSecrets": []interface{}{map[string]interface{}{"name": "ghcr"}},
+			"securityContext":  map[string]interface{}{"runAsUser": float64(1000)},
+			"initContainers": []interface{}{map[string]interface{}{
+				"name": "dind", "image": "docker:dind", "restartPolicy": "Always",
+			}},
+			"containers": []interface{}{map[string]interface{}{
+				"name":         "runner",
+				"env":          []interface{}{map[string]interface{}{"name": "DOCKER_HOST", "value": "tcp://localhost:2375"}},
+				"volumeMounts": []interface{}{map[string]interface{}{"name": "cache", "mountPath": "/cache"}},
+			}},
+			"volumes": []interface{}{map[string]interface{}{"name": "cache", "emptyDir": map[string]interface{}{}}},
+		},
+	}
+	out, err := applyK8sPodTemplate(base, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"serviceAccountName: runner-sa", "image: runner:1", "team: build", "name: ghcr",
+		"runAsUser: 1000", "image: docker:dind", "DOCKER_HOST", "mountPath: /cache",
+		"mountPath: /var/run/noppflow-ssh", "secretName: noppflow-run-7-ssh", "emptyDir: {}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in merged job, got:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "name: runner\n") != 1 {
+		t.Fatalf("expected runner container to be merged, not duplicated:\n%s", out)
+	}
+
+	if same, err := applyK8sPodTemplate(base, nil); err != nil || same != base {
+		t.Fatalf("expected job unchanged without template, err=%v", err)
+	}
+}
+
+func TestValidateK8sPodTemplate_RejectsOwnedFields(t *testing.T) {
+	cases := map[string]map[string]interface{}{
+		"only metadata and spec":           {"kind": "Pod"},
+		"only labels and annotations":      {"metadata": map[string]interface{}{"name": "x"}},
+		"restartPolicy is set by NoppFlow": {"spec": map[string]interface{}{"restartPolicy": "Always"}},
+		"image of the runner container": {"spec": map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{"name": "runner", "image": "evil"}},
+		}},
+		"ssh-key volume": {"spec": map[string]interface{}{
+			"volumes": []interface{}{map[string]interface{}{"name": "ssh-key", "emptyDir": map[string]interface{}{}}},
+		}},
+		"spec.containers must be a list": {"spec": map[string]interface{}{"containers": map[string]interface{}{"name": "x"}}},
+	}
+	for want, tmpl := range cases {
+		err := validateK8sPodTemplate(tmpl)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error containing %q, got %v", want, err)
+		}
+	}
+	if err := validateK8sPodTemplate(map[string]interface{}{"spec": map[string]interface{}{"nodeSelector": map[string]interface{}{"pool": "ci"}}}); err != nil {
+		t.Fatalf("expected valid template, got %v", err)
+	}
+}
+
+func TestK8sCloneCache_InitContainerChecksOutFromMirror(t *testing.T) {
+	app := config.App{
+		ID: "mono", Repo: "git@example.com:org/mono.git", Branch: "main",
+		SparsePaths: []string{"services/api"}, K8sCachePVC: "git-cache",
+		Steps: []config.Step{{Name: "build", Cmd: "make"}},
+	}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if strings.Contains(script, "git clone") || !strings.Contains(script, "cd /workspace/repo") {
+		t.Fatalf("expected runner to use the checked out workspace, got:\n%s", script)
+	}
+
+	clone := buildK8sCloneScript(app)
+	for _, want := range []string{
+		"mirror='/var/cache/noppflow/mono.git'",
+		`git clone --mirror 'git@example.com:org/mono.git' "$mirror"`,
+		`git -C "$mirror" remote update --prune || rm -rf "$mirror"`,
+		`git clone --branch 'main' --single-branch --sparse "$mirror" /workspace/repo`,
+		"git remote set-url origin 'git@example.com:org/mono.git'",
+		"git sparse-checkout set --cone -- 'services/api'",
+	} {
+		if !strings.Contains(clone, want) {
+			t.Fatalf("expected %q in clone script, got:\n%s", want, clone)
+		}
+	}
+
+	job, err := applyK8sPodTemplate(buildK8sRunJobYAML("apps", "j", 1, "sa", "runner:1", "s", script, nil, ""), k8sCloneCacheTemplate(app, "runner:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"initContainers:", "name: clone", "claimName: git-cache", "mountPath: /var/cache/noppflow", "mountPath: /workspace\n"} {
+		if !strings.Contains(job, want) {
+			t.Fatalf("expected %q in job, got:\n%s", want, job)
+		}
+	}
+	if strings.Count(job, "mountPath: /workspace\n") != 2 {
+		t.Fatalf("expected workspace mounted in clone and runner containers, got:\n%s", job)
+	}
+
+	if err := validateK8sCachePVC("Git_Cache"); err == nil {
+		t.Fatal("expected invalid pvc name to be rejected")
+	}
+}
+
+func TestBuildK8sJobScript_GitOpsDeployUsesGitOpsKey(t *testing.T) {
+	app := config.App{
+		ID: "a", Repo: "r", Branch: "main", Runner: "kubernetes", DeployMode: "gitops",
+		GitOpsRepo: "git@github.com:acme/deploy.git", GitOpsPath: "api.yaml", GitOpsImage: "ghcr.io/acme/api",
+		Steps: []config.Step{{Name: "deploy", K8sDeploy: true}},
+	}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if !strings.Contains(script, "if GIT_SSH_COMMAND='ssh -i /var/run/noppflow-ssh/gitops_key") || strings.Contains(script, "kubectl") {
+		t.Fatalf("expected gitops deploy with the gitops key, got:\n%s", script)
+	}
+	secret := buildK8sRunSecretYAML("ns", "run-1-ssh", 1, "key", "gitops", "")
+	if !strings.Contains(secret, "  gitops_key: Z2l0b3Bz\n") {
+		t.Fatalf("expected gitops_key in secret, got:\n%s", secret)
+	}
+}
+
+func TestBuildK8sJobScript_AnsibleStep(t *testing.T) {
+	app := config.App{
+		ID: "a", Repo: "r", Branch: "main", Runner: "kubernetes",
+		Steps: []config.Step{{Name: "vms", Workdir: "ops", Ansible: &config.AnsibleStep{Playbook: "site.yml", Inventory: "hosts.ini"}}},
+	}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if !strings.Contains(script, "(cd 'ops' && sh -c 'set -eu\nansible-playbook -i '\"'\"'hosts.ini'\"'\"' '\"'\"'site.yml'\"'\"'')") {
+		t.Fatalf("expected ansible-playbook step, got:\n%s", script)
+	}
+}
+
+func TestK8sScanCommand(t *testing.T) {
+	env := k8sEnv{Plain: map[string]string{"NOPPFLOW_IMAGE": "ghcr.io/acme/api:v1"}}
+	cases := []struct {
+		scan config.ScanStep
+		want string
+	}{
+		{config.ScanStep{Tool: "trivy-image", Target: "$NOPPFLOW_IMAGE", FailOn: "HIGH"}, "trivy image --quiet --exit-code 1 --severity HIGH,CRITICAL 'ghcr.io/acme/api:v1'"},
+		{config.ScanStep{Tool: "trivy-fs"}, "trivy fs --quiet ."},
+		{config.ScanStep{Tool: "govulncheck"}, "{ govulncheck ./... || [ $? = 3 ]; }"},
+		{config.ScanStep{Tool: "govulncheck", Target: "./cmd/...", FailOn: "MEDIUM"}, "govulncheck './cmd/...'"},
+	}
+	for _, c := range cases {
+		scan := c.scan
+		if got := k8sScanCommand(config.Step{Name: "scan", Scan: &scan}, env); got != c.want {
+			t.Errorf("k8sScanCommand(%+v) = %q, want %q", c.scan, got, c.want)
+		}
+	}
+}
+
+func TestWaitForStep(t *testing.T) {
+	for _, wf := range []config.WaitForStep{
+		{},
+		{URL: "https://example.com", Cmd: "true"},
+		{URL: "example.com/healthz"},
+		{Cmd: "true", ExpectStatus: 200},
+		{URL: "https://example.com", ExpectStatus: 42},
+		{Cmd: "true", TimeoutSec: -1},
+	} {
+		wf := wf
+		if err := validateWaitForStep(&config.Step{Name: "wait", WaitFor: &wf}); err == nil {
+			t.Errorf("validateWaitForStep(%+v) succeeded, want error", wf)
+		}
+	}
+
+	env := k8sEnv{Plain: map[string]string{"HOST": "api.example.com"}}
+	step := config.Step{Name: "wait", WaitFor: &config.WaitForStep{URL: " https://$HOST/healthz ", ExpectStatus: 204, TimeoutSec: 60}}
+	if err := validateWaitForStep(&step); err != nil {
+		t.Fatal(err)
+	}
+	got := k8sWaitForCommand(step, env)
+	want := `deadline=$(( $(date +%s) + 60 )); until [ "$(curl -sS -L -m 30 -o /dev/null -w '%{http_code}' 'https://api.example.com/healthz')" = 204 ]; do ` +
+		`if [ $(date +%s) -ge $deadline ]; then echo 'wait: not ready after 60s'; exit 1; fi; sleep 10; done`
+	if got != want {
+		t.Errorf("k8sWaitForCommand = %q, want %q", got, want)
+	}
+}
+
+func TestReconcile_RequeuesInterruptedRuns(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "requeue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := st.CreateSSHKey("deploy", "key"); err != nil {
+		t.Fatal(err)
+	}
+	srv := New([]config.App{{ID: "app-a", Name: "App A", SSHKeyName: "deploy"}}, st, nil, "", "")
+	srv.SetRequeueInterrupted(true)
+	// Hold the requeued run instead of executing it.
+	if err := st.SetMaintenance(store.Maintenance{QueueRuns: true, Since: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.CreateRun("app-a", "", "trigger:nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetRunEnv(id, map[string]string{"TARGET": "blue"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(id, "running", ""); err != nil {
+		t.Fatal(err)
+	}
+	srv.interruptOrphanedRuns()
+	if run, _ := st.GetRun(id); run.Status != "interrupted" {
+		t.Fatalf("expected run interrupted, got %s", run.Status)
+	}
+	requeued, err := st.GetRun(id + 1)
+	if err != nil || requeued == nil {
+		t.Fatalf("expected requeued run, got %v", err)
+	}
+	if requeued.Status != "pending" || requeued.AppID != "app-a" || requeued.TriggeredBy != "trigger:nightly" {
+		t.Fatalf("unexpected requeued run %+v", requeued)
+	}
+	env, err := st.ListRunEnv(requeued.ID)
+	if err != nil || len(env) != 1 || env[0] != (store.RunEnvVar{Name: "TARGET", Value: "blue"}) {
+		t.Fatalf("expected run env copied, got %+v (%v)", env, err)
+	}
+	if !srv.runTracked(requeued.ID) {
+		t.Fatal("expected requeued run to be tracked")
+	}
+}
+
+func TestReconcile_HeartbeatWatchdog(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "watchdog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	srv := New([]config.App{{ID: "app-a", Name: "App A"}}, st, nil, "", "")
+	srv.heartbeatTimeout = time.Hour
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		id, err := st.CreateRun("app-a", "", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	srv.trackRun(ids[0])
+	srv.touchHeartbeats()
+	if run, _ := st.GetRun(ids[0]); run.HeartbeatAt == nil {
+		t.Fatal("expected heartbeat of tracked run")
+	}
+	if run, _ := st.GetRun(ids[1]); run.HeartbeatAt != nil {
+		t.Fatal("expected no heartbeat of untracked run")
+	}
+
+	// A run started moments ago may belong to another server process.
+	srv.interruptOrphanedRuns()
+	srv.interruptStaleRuns()
+	if run, _ := st.GetRun(ids[1]); run.Status != "pending" {
+		t.Fatalf("expected recent run left alone, got %s", run.Status)
+	}
+
+	srv.heartbeatTimeout = 0
+	srv.interruptStaleRuns()
+	for i, want := range []string{"pending", "interrupted"} {
+		if run, _ := st.GetRun(ids[i]); run.Status != want {
+			t.Fatalf("run %d: expected %s, got %s", ids[i], want, run.Status)
+		}
+	}
+}
+
+func TestBuildK8sJobScript_ShellAndProfileScripts(t *testing.T) {
+	app := config.App{ID: "a", Repo: "r", Branch: "main", Shell: "bash", LoginShell: true, ProfileScripts: []string{"~/.sdkman/bin/sdkman-init.sh"}, Steps: []config.Step{
+		{Name: "build", Script: "sdk use java 21"},
+		{Name: "deploy", File: "deploy.sh"},
+	}}
+	script := buildK8sJobScript(app, k8sEnv{})
+	for _, want := range []string{
+		"printf %s '. ~/.sdkman/bin/sdkman-init.sh\nsdk use java 21' | bash -l",
+		"bash -l '-c' '. ~/.sdkman/bin/sdkman-init.sh\n. \"$0\"' './deploy.sh'",
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("expected %q in script:\n%s", want, script)
+		}
+	}
+	if err := validateStepShell(&config.App{Shell: "bash; rm -rf /"}); err == nil {
+		t.Fatal("expected shell with spaces rejected")
+	}
+	app = config.App{Shell: " /bin/zsh ", ProfileScripts: []string{" ~/.profile ", ""}}
+	if err := validateStepShell(&app); err != nil || app.Shell != "/bin/zsh" || len(app.ProfileScripts) != 1 || app.ProfileScripts[0] != "~/.profile" {
+		t.Fatalf("expected normalized shell settings, got %+v (%v)", app, err)
+	}
+	app = config.App{ProfileScripts: []string{"~/.nvm/nvm.sh"}, Steps: []config.Step{{Name: "build", Script: "npm ci"}},
+		Post: &config.PostSteps{Always: []config.Step{{Name: "cleanup", Cmd: "npm cache clean"}}}}
+	if err := validateStepShell(&app); err == nil || !strings.Contains(err.Error(), "step cleanup: cmd steps do not run through the shell") {
+		t.Fatalf("expected cmd steps rejected with profile scripts, got %v", err)
+	}
+	if err := validateStepShell(&config.App{LoginShell: true, TestCmd: "go test ./..."}); err == nil || !strings.Contains(err.Error(), "step test") {
+		t.Fatalf("expected legacy cmd steps rejected with a login shell, got %v", err)
+	}
+	if err := validateStepShell(&config.App{Shell: "bash", TestCmd: "go test ./..."}); err != nil {
+		t.Fatalf("expected cmd steps allowed with a plain shell, got %v", err)
+	}
+}
+
+func TestK8sDebugHold(t *testing.T) {
+	app := config.App{ID: "app-a", Name: "App A", Repo: "git@example.com:a.git", Branch: "main", Runner: "kubernetes",
+		K8sNamespace: "apps", K8sServiceAccount: "runner", K8sRunnerImage: "alpine/git", K8sDebugHoldMin: 5,
+		Steps: []config.Step{{Name: "test", Cmd: "go test ./..."}}}
+	if err := validateRunner(&app); err != nil {
+		t.Fatal(err)
+	}
+	script := buildK8sJobScript(app, k8sEnv{})
+	if !strings.Contains(script, `if [ "$noppflow_failed" != 0 ]; then echo '::debug-hold::5'; sleep 300; exit 1; fi`) {
+		t.Fatalf("expected failed runs to hold the pod, got:\n%s", script)
+	}
+	for _, bad := range []config.App{
+		{ID: "local", K8sDebugHoldMin: 5},
+		{ID: "long", Runner: "kubernetes", K8sNamespace: "apps", K8sServiceAccount: "runner", K8sRunnerImage: "alpine/git", K8sDebugHoldMin: 61},
+	} {
+		if err := validateRunner(&bad); err == nil {
+			t.Fatalf("expected %s rejected", bad.ID)
+		}
+	}
+
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "debug.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for name, admin := range map[string]bool{"admin": true, "alice": false} {
+		hash, err := auth.HashPassword(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.CreateUser(name, hash, admin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := New([]config.App{app}, st, nil, "", "")
+	h := srv.Handler()
+	held, _ := st.CreateRun("app-a", "", "admin")
+	expired, _ := st.CreateRun("app-a", "", "admin")
+	for _, id := range []int64{held, expired} {
+		if err := st.UpdateRunStatus(id, "failed", "boom"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Holds are stored, so the reconciler sees them whichever replica ran the Job.
+	for _, hold := range []store.K8sDebugHold{
+		{RunID: held, AppID: "app-a", Namespace: "apps", Job: "noppflow-run-1", Pod: "noppflow-run-1-abcde", ExpiresAt: time.Now().Add(5 * time.Minute)},
+		{RunID: expired, AppID: "app-a", Namespace: "apps", Job: "noppflow-run-2", Pod: "noppflow-run-2-abcde", ExpiresAt: time.Now().Add(-time.Second)},
+	} {
+		if err := st.SaveK8sDebugHold(hold); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var deleted []string
+	prevDelete, prevExec := deleteK8sResource, kubectlExec
+	deleteK8sResource = func(namespace, kind, name string) error {
+		deleted = append(deleted, namespace+"/"+kind+"/"+name)
+		return nil
+	}
+	var execs []string
+	kubectlExec = func(ctx context.Context, namespace, pod, command string) (string, bool, int, error) {
+		execs = append(execs, namespace+"/"+pod+": "+command)
+		return "go.mod\n", false, 3, nil
+	}
+	defer func() { deleteK8sResource, kubectlExec = prevDelete, prevExec }()
+
+	srv.cleanupK8sOrphans("apps", parseK8sManagedResources("Job noppflow-run-1 1\nJob noppflow-run-2 2\n"))
+	if strings.Join(deleted, ",") != "apps/job/noppflow-run-2" {
+		t.Fatalf("expected only the expired hold cleaned up, got %v", deleted)
+	}
+	deleted = nil
+
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(c *http.Cookie, method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewReader([]byte(body)))
+		req.AddCookie(c)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do(cookie, http.MethodGet, "/api/runs/1/debug", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"pod":"noppflow-run-1-abcde"`) {
+		t.Fatalf("get debug pod: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(cookie, http.MethodGet, "/api/runs/2/debug", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected expired hold gone, got %d", rec.Code)
+	}
+	if rec := do(loginAndCookie(t, h, "alice", "alice"), http.MethodPost, "/api/runs/1/debug/exec", `{"command":"id"}`); rec.Code != http.StatusForbidden || len(execs) != 0 {
+		t.Fatalf("expected non-admins refused, got %d (%v)", rec.Code, execs)
+	}
+	if rec := do(cookie, http.MethodPost, "/api/runs/1/debug/exec", `{"command":""}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected empty command rejected, got %d", rec.Code)
+	}
+	rec := do(cookie, http.MethodPost, "/api/runs/1/debug/exec", `{"command":"ls /workspace/repo"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"exit_code":3`) || !strings.Contains(rec.Body.String(), `"output":"go.mod\n"`) {
+		t.Fatalf("exec: %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Join(execs, ",") != "apps/noppflow-run-1-abcde: ls /workspace/repo" {
+		t.Fatalf("unexpected exec calls %v", execs)
+	}
+	notes, err := st.ListRunNotifications(held)
+	if err != nil || len(notes) != 1 || notes[0].Event != "debug.exec" || notes[0].Message != `admin ran "ls /workspace/repo" (exit 3)` {
+		t.Fatalf("expected the exec audited, got %+v (%v)", notes, err)
+	}
+
+	if rec := do(cookie, http.MethodDelete, "/api/runs/1/debug", ""); rec.Code != http.StatusNoContent || strings.Join(deleted, ",") != "apps/job/noppflow-run-1" {
+		t.Fatalf("release: %d %v", rec.Code, deleted)
+	}
+	if rec := do(cookie, http.MethodGet, "/api/runs/1/debug", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected released hold gone, got %d", rec.Code)
+	}
+}
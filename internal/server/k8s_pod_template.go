@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	"gopkg.in/yaml.v3"
+)
+
+// k8sRunnerContainer is the name of the container running the pipeline script in Job runs.
+const k8sRunnerContainer = "runner"
+
+// validateK8sPodTemplate checks an app pod template: only metadata labels/annotations and spec are
+// accepted, and the fields NoppFlow owns (restart policy, service account, the runner container's
+// image and command, the ssh-key volume) cannot be overridden. The template is also merged into a
+// sample Job to catch type mismatches such as a mapping where a list is expected.
+func validateK8sPodTemplate(tmpl map[string]interface{}) error {
+	if len(tmpl) == 0 {
+		return nil
+	}
+	for key, value := range tmpl {
+		switch key {
+		case "metadata":
+			meta, ok := value.(map[string]interface{})
+			if !ok {
+				return errors.New("k8s_pod_template.metadata must be a mapping")
+			}
+			for k := range meta {
+				if k != "labels" && k != "annotations" {
+					return fmt.Errorf("k8s_pod_template.metadata.%s is not allowed (only labels and annotations)", k)
+				}
+			}
+		case "spec":
+			spec, ok := value.(map[string]interface{})
+			if !ok {
+				return errors.New("k8s_pod_template.spec must be a mapping")
+			}
+			if err := validateK8sPodSpec(spec); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("k8s_pod_template.%s is not allowed (only metadata and spec)", key)
+		}
+	}
+	_, err := applyK8sPodTemplate(buildK8sRunJobYAML("ns", "job", 0, "sa", "image", "secret", "true", nil, ""), tmpl)
+	return err
+}
+
+func validateK8sPodSpec(spec map[string]interface{}) error {
+	for _, key := range []string{"restartPolicy", "serviceAccountName"} {
+		if _, ok := spec[key]; ok {
+			return fmt.Errorf("k8s_pod_template.spec.%s is set by NoppFlow", key)
+		}
+	}
+	containers, _ := spec["containers"].([]interface{})
+	for _, c := range containers {
+		container, _ := c.(map[string]interface{})
+		if container["name"] != k8sRunnerContainer {
+			continue
+		}
+		for _, key := range []string{"image", "command", "args"} {
+			if _, ok := container[key]; ok {
+				return fmt.Errorf("k8s_pod_template: %s of the %s container is set by NoppFlow", key, k8sRunnerContainer)
+			}
+		}
+	}
+	volumes, _ := spec["volumes"].([]interface{})
+	for _, v := range volumes {
+		if volume, _ := v.(map[string]interface{}); volume["name"] == "ssh-key" {
+			return errors.New("k8s_pod_template: the ssh-key volume is set by NoppFlow")
+		}
+	}
+	return nil
+}
+
+// applyK8sPodTemplate merges tmpl into the pod template of jobYAML. Mappings are merged
+// recursively and template scalars win; list items with a name (containers, volumes, volumeMounts,
+// env) are merged into the generated item of the same name, other items are appended.
+func applyK8sPodTemplate(jobYAML string, tmpl map[string]interface{}) (string, error) {
+	if len(tmpl) == 0 {
+		return jobYAML, nil
+	}
+	var job map[string]interface{}
+	if err := yaml.Unmarshal([]byte(jobYAML), &job); err != nil {
+		return "", err
+	}
+	spec, _ := job["spec"].(map[string]interface{})
+	pod, _ := spec["template"].(map[string]interface{})
+	if pod == nil {
+		return "", errors.New("generated job has no pod template")
+	}
+	merged, err := mergeK8sValue(pod, copyK8sValue(tmpl), "k8s_pod_template")
+	if err != nil {
+		return "", err
+	}
+	spec["template"] = merged
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(job); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func mergeK8sValue(dst, src interface{}, path string) (interface{}, error) {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		if dst == nil {
+			return s, nil
+		}
+		d, ok := dst.(map[string]interface{})
+		if !ok {
+			return nil, k8sTypeMismatch(dst, path)
+		}
+		for k, v := range s {
+			merged, err := mergeK8sValue(d[k], v, path+"."+k)
+			if err != nil {
+				return nil, err
+			}
+			d[k] = merged
+		}
+		return d, nil
+	case []interface{}:
+		if dst == nil {
+			return s, nil
+		}
+		d, ok := dst.([]interface{})
+		if !ok {
+			return nil, k8sTypeMismatch(dst, path)
+		}
+		for _, item := range s {
+			if i := namedK8sItem(d, item); i >= 0 {
+				merged, err := mergeK8sValue(d[i], item, fmt.Sprintf("%s[%v]", path, item.(map[string]interface{})["name"]))
+				if err != nil {
+					return nil, err
+				}
+				d[i] = merged
+				continue
+			}
+			d = append(d, item)
+		}
+		return d, nil
+	default:
+		switch dst.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, k8sTypeMismatch(dst, path)
+		}
+		return src, nil
+	}
+}
+
+// k8sTypeMismatch reports a template value whose type differs from the generated value dst.
+func k8sTypeMismatch(dst interface{}, path string) error {
+	switch dst.(type) {
+	case map[string]interface{}:
+		return fmt.Errorf("%s must be a mapping", path)
+	case []interface{}:
+		return fmt.Errorf("%s must be a list", path)
+	}
+	return fmt.Errorf("%s must be a scalar", path)
+}
+
+// namedK8sItem returns the index of the item in list with the same name as item, or -1.
+func namedK8sItem(list []interface{}, item interface{}) int {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return -1
+	}
+	name, ok := m["name"].(string)
+	if !ok || name == "" {
+		return -1
+	}
+	for i, existing := range list {
+		if e, ok := existing.(map[string]interface{}); ok && e["name"] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyK8sValue deep-copies a decoded YAML/JSON value. Whole floats (JSON numbers from the API)
+// become ints so that integer fields such as runAsUser are rendered without a decimal point.
+func copyK8sValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			out[k] = copyK8sValue(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, val := range t {
+			out[i] = copyK8sValue(val)
+		}
+		return out
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1<<53 {
+			return int64(t)
+		}
+		return t
+	default:
+		return v
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+const (
+	// k8sPreflightTimeout bounds the kubectl calls of one preflight.
+	k8sPreflightTimeout = 30 * time.Second
+	// k8sPreflightTTL is how long a namespace that passed the preflight is not checked again.
+	k8sPreflightTTL = 5 * time.Minute
+	// maxKubectlSkew is the minor version skew kubectl supports against the API server.
+	maxKubectlSkew = 1
+)
+
+// k8sPreflightPermissions are what the server does in an app namespace to run a Job (see
+// runAppAsK8sJob and k8s/controller-rbac.namespace.example.yaml), as `kubectl auth can-i` args.
+var k8sPreflightPermissions = [][]string{
+	{"create", "jobs.batch"},
+	{"delete", "jobs.batch"},
+	{"get", "pods"},
+	{"get", "pods", "--subresource=log"},
+	{"create", "secrets"},
+	{"delete", "secrets"},
+	{"patch", "secrets"},
+}
+
+// k8sDebugPreflightPermission is what the server also needs for apps with k8s_debug_hold_min, to
+// run debug commands in held pods (see execK8sDebugPod).
+var k8sDebugPreflightPermission = []string{"create", "pods", "--subresource=exec"}
+
+// kubectlPreflight runs kubectl with args and returns its stdout and stderr (a var for tests).
+var kubectlPreflight = func(ctx context.Context, args ...string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	return stdout.String(), strings.TrimSpace(stderr.String()), err
+}
+
+// k8sVersionInfo is a version of `kubectl version -o json`.
+type k8sVersionInfo struct {
+	Major      string `json:"major"`
+	Minor      string `json:"minor"`
+	GitVersion string `json:"gitVersion"`
+}
+
+// minorVersion returns the 1.x minor version, which some providers suffix (e.g. "29+").
+func (v k8sVersionInfo) minorVersion() (int, bool) {
+	if v.Major != "1" {
+		return 0, false
+	}
+	minor, err := strconv.Atoi(strings.TrimRight(v.Minor, "+"))
+	return minor, err == nil
+}
+
+// k8sVersionSkew returns how many minor versions kubectl is away from the API server, or 0 when
+// either version is unknown.
+func k8sVersionSkew(client, server k8sVersionInfo) int {
+	c, okC := client.minorVersion()
+	sv, okS := server.minorVersion()
+	if !okC || !okS {
+		return 0
+	}
+	if c > sv {
+		return c - sv
+	}
+	return sv - c
+}
+
+// preflightK8sJob checks before a Job run that the cluster is reachable and the server may run
+// Jobs in the app namespace (and exec into held pods, for apps with k8s_debug_hold_min), so that
+// a broken kubeconfig or missing RBAC fails the run at once with what to fix instead of partway
+// through creating its Job. A kubectl too far from the
+// cluster version only warns, on the run's timeline. Namespaces that passed are not checked again
+// for k8sPreflightTTL. Local runs are not checked.
+func (s *Server) preflightK8sJob(runID int64, app config.App) error {
+	if !appUsesK8sJob(app) {
+		return nil
+	}
+	namespace := strings.TrimSpace(app.K8sNamespace)
+	if namespace == "" {
+		return nil // runAppAsK8sJob reports it
+	}
+	perms, key := k8sPreflightPermissions, namespace
+	if app.K8sDebugHoldMin > 0 {
+		perms = append(append([][]string{}, perms...), k8sDebugPreflightPermission)
+		key = namespace + " (debug)"
+	}
+	s.k8sPreflightsMu.Lock()
+	passed, ok := s.k8sPreflights[key]
+	s.k8sPreflightsMu.Unlock()
+	if ok && time.Since(passed) < k8sPreflightTTL {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k8sPreflightTimeout)
+	defer cancel()
+
+	out, stderr, err := kubectlPreflight(ctx, "version", "-o", "json")
+	var version struct {
+		ClientVersion *k8sVersionInfo `json:"clientVersion"`
+		ServerVersion *k8sVersionInfo `json:"serverVersion"`
+	}
+	if jsonErr := json.Unmarshal([]byte(out), &version); jsonErr != nil || version.ClientVersion == nil {
+		return fmt.Errorf("kubectl is not usable on the server (%v): install kubectl", firstErr(err, jsonErr))
+	}
+	if version.ServerVersion == nil {
+		return fmt.Errorf("cannot reach the Kubernetes API server: %s; check the server's kubeconfig or in-cluster service account", kubectlFailure(err, stderr))
+	}
+	if skew := k8sVersionSkew(*version.ClientVersion, *version.ServerVersion); skew > maxKubectlSkew {
+		msg := fmt.Sprintf("kubectl %s is %d minor versions away from the cluster (%s); kubectl supports a skew of %d, so commands may fail: install a matching kubectl on the server",
+			version.ClientVersion.GitVersion, skew, version.ServerVersion.GitVersion, maxKubectlSkew)
+		log.Printf("run %d: %s", runID, msg)
+		_, _ = s.store.CreateRunNotification(runID, "k8s.version_skew", msg, time.Now())
+	}
+
+	var denied []string
+	for _, perm := range perms {
+		args := append([]string{"auth", "can-i"}, perm...)
+		out, stderr, err := kubectlPreflight(ctx, append(args, "-n", namespace)...)
+		switch answer := strings.TrimSpace(out); {
+		case answer == "yes":
+		case strings.HasPrefix(answer, "no"):
+			denied = append(denied, strings.Join(perm, " "))
+		default:
+			return fmt.Errorf("cannot check permissions in namespace %s: %s", namespace, kubectlFailure(err, stderr))
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("the server may not %s in namespace %s; apply k8s/controller-rbac.namespace.example.yaml there (or provision it with POST /api/k8s/provision and controller_service_account) for the server's service account",
+			strings.Join(denied, ", "), namespace)
+	}
+
+	s.k8sPreflightsMu.Lock()
+	s.k8sPreflights[key] = time.Now()
+	s.k8sPreflightsMu.Unlock()
+	return nil
+}
+
+// kubectlFailure describes a failed kubectl call by its stderr, or its error without one.
+func kubectlFailure(err error, stderr string) string {
+	if stderr != "" {
+		return stderr
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "no output"
+}
+
+// firstErr returns the first non-nil error.
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
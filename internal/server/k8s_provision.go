@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// k8sProvisionTimeout bounds the kubectl apply of a provisioning request.
+	k8sProvisionTimeout = time.Minute
+	// Defaults of a provisioning request, matching the example manifests in k8s/.
+	defaultRunnerServiceAccount = "noppflow-runner"
+	defaultControllerNamespace  = "noppflow"
+	// k8sControllerRole names the Role that lets the server manage Jobs in an app namespace.
+	k8sControllerRole = "noppflow-controller"
+)
+
+// k8sProvisionRequest is the body of POST /api/k8s/provision. The cluster credential is either a
+// Kubeconfig (with an optional Context) or a Server URL with a bearer Token and an optional
+// base64 CertificateAuthorityData; without one the server's own kubectl configuration is used.
+// ControllerServiceAccount, when set, also gets the Role the server needs in the namespace
+// (for a server running in the cluster as that service account of ControllerNamespace).
+type k8sProvisionRequest struct {
+	Namespace                string `json:"namespace"`
+	ServiceAccount           string `json:"service_account"`
+	RunnerImage              string `json:"runner_image"`
+	ControllerServiceAccount string `json:"controller_service_account"`
+	ControllerNamespace      string `json:"controller_namespace"`
+	Kubeconfig               string `json:"kubeconfig"`
+	Context                  string `json:"context"`
+	Server                   string `json:"server"`
+	Token                    string `json:"token"`
+	CertificateAuthorityData string `json:"certificate_authority_data"`
+	DryRun                   bool   `json:"dry_run"`
+}
+
+// normalize checks a provisioning request and fills in its defaults.
+func (req *k8sProvisionRequest) normalize() error {
+	req.Namespace = strings.TrimSpace(req.Namespace)
+	req.ServiceAccount = strings.TrimSpace(req.ServiceAccount)
+	req.RunnerImage = strings.TrimSpace(req.RunnerImage)
+	req.ControllerServiceAccount = strings.TrimSpace(req.ControllerServiceAccount)
+	req.ControllerNamespace = strings.TrimSpace(req.ControllerNamespace)
+	req.Context = strings.TrimSpace(req.Context)
+	req.Server = strings.TrimSpace(req.Server)
+	req.Token = strings.TrimSpace(req.Token)
+	req.CertificateAuthorityData = strings.TrimSpace(req.CertificateAuthorityData)
+	if req.ServiceAccount == "" {
+		req.ServiceAccount = defaultRunnerServiceAccount
+	}
+	if req.ControllerNamespace == "" {
+		req.ControllerNamespace = defaultControllerNamespace
+	}
+	if !dnsLabelPattern.MatchString(req.Namespace) {
+		return errors.New("namespace must be a valid namespace name (lowercase letters, digits and '-', at most 63 characters)")
+	}
+	if !dnsLabelPattern.MatchString(req.ControllerNamespace) {
+		return errors.New("controller_namespace must be a valid namespace name")
+	}
+	if !k8sResourceNamePattern.MatchString(req.ServiceAccount) {
+		return errors.New("service_account must be a valid Kubernetes name")
+	}
+	if req.ControllerServiceAccount != "" && !k8sResourceNamePattern.MatchString(req.ControllerServiceAccount) {
+		return errors.New("controller_service_account must be a valid Kubernetes name")
+	}
+	switch {
+	case strings.TrimSpace(req.Kubeconfig) != "":
+		if req.Server != "" || req.Token != "" || req.CertificateAuthorityData != "" {
+			return errors.New("give either kubeconfig or server and token, not both")
+		}
+	case req.Server != "":
+		u, err := url.Parse(req.Server)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("server must be an https URL")
+		}
+		if req.Token == "" {
+			return errors.New("token is required with server")
+		}
+		if req.CertificateAuthorityData != "" {
+			if _, err := base64.StdEncoding.DecodeString(req.CertificateAuthorityData); err != nil {
+				return errors.New("certificate_authority_data must be base64")
+			}
+		}
+		if req.Context != "" {
+			return errors.New("context needs a kubeconfig")
+		}
+	case req.Token != "" || req.CertificateAuthorityData != "":
+		return errors.New("server is required with token")
+	}
+	return nil
+}
+
+// kubeconfig returns the kubeconfig to apply with, or "" for the server's own configuration.
+func (req k8sProvisionRequest) kubeconfig() string {
+	if strings.TrimSpace(req.Kubeconfig) != "" || req.Server == "" {
+		return req.Kubeconfig
+	}
+	cluster := fmt.Sprintf("      server: %q\n", req.Server)
+	if req.CertificateAuthorityData != "" {
+		cluster += fmt.Sprintf("      certificate-authority-data: %q\n", req.CertificateAuthorityData)
+	}
+	return fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+  - name: target
+    cluster:
+%susers:
+  - name: noppflow
+    user:
+      token: %q
+contexts:
+  - name: target
+    context:
+      cluster: target
+      user: noppflow
+current-context: target
+`, cluster, req.Token)
+}
+
+// k8sProvisionManifest returns what the K8s runner needs in a namespace (see k8s/): the namespace,
+// the runner service account with a Role for deploy commands, and, for a controller service
+// account, the Role letting the server run Jobs there.
+func k8sProvisionManifest(req k8sProvisionRequest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `apiVersion: v1
+kind: Namespace
+metadata:
+  name: %[1]s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+rules:
+  - apiGroups: ["", "apps", "batch", "networking.k8s.io"]
+    resources: ["pods", "services", "configmaps", "secrets", "deployments", "statefulsets", "jobs", "cronjobs", "ingresses"]
+    verbs: ["get", "list", "watch", "create", "update", "patch", "delete"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+subjects:
+  - kind: ServiceAccount
+    name: %[2]s
+    namespace: %[1]s
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: %[2]s
+`, req.Namespace, req.ServiceAccount)
+	if req.ControllerServiceAccount == "" {
+		return b.String()
+	}
+	fmt.Fprintf(&b, `---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+rules:
+  - apiGroups: ["batch"]
+    resources: ["jobs"]
+    verbs: ["get", "list", "watch", "create", "delete"]
+  - apiGroups: [""]
+    resources: ["pods", "pods/log"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: [""]
+    resources: ["pods/exec"]
+    verbs: ["create"]
+  - apiGroups: [""]
+    resources: ["secrets"]
+    verbs: ["get", "create", "delete", "patch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+subjects:
+  - kind: ServiceAccount
+    name: %[3]s
+    namespace: %[4]s
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: %[2]s
+`, req.Namespace, k8sControllerRole, req.ControllerServiceAccount, req.ControllerNamespace)
+	return b.String()
+}
+
+// kubectlApplyManifest applies manifest with kubeconfig (the server's own configuration when "")
+// and returns the kubectl output, one line per object (a var for tests).
+var kubectlApplyManifest = func(ctx context.Context, kubeconfig, kubeContext, manifest string, dryRun bool) (string, error) {
+	var args []string
+	if kubeconfig != "" {
+		f, err := os.CreateTemp("", "noppflow-kubeconfig-*")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(kubeconfig)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--kubeconfig", f.Name())
+	}
+	if kubeContext != "" {
+		args = append(args, "--context", kubeContext)
+	}
+	args = append(args, "apply", "-f", "-")
+	if dryRun {
+		args = append(args, "--dry-run=server")
+	}
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	cmd.Stdin = strings.NewReader(manifest)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("kubectl apply: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// provisionK8sNamespace serves POST /api/k8s/provision (admin): it applies what the K8s runner
+// needs in a namespace with the given cluster credential, which is not stored, and returns the
+// app settings that use it. With dry_run the cluster validates the objects without creating them.
+func (s *Server) provisionK8sNamespace(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req k8sProvisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if err := req.normalize(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	manifest := k8sProvisionManifest(req)
+	ctx, cancel := context.WithTimeout(r.Context(), k8sProvisionTimeout)
+	defer cancel()
+	out, err := kubectlApplyManifest(ctx, req.kubeconfig(), req.Context, manifest, req.DryRun)
+	applied := make([]string, 0)
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			applied = append(applied, line)
+		}
+	}
+	if err != nil {
+		log.Printf("k8s provision of namespace %s by %s failed: %v", req.Namespace, admin.Username, err)
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{"error": err.Error(), "applied": applied})
+		return
+	}
+	log.Printf("k8s provision of namespace %s by %s (dry run %t): %s", req.Namespace, admin.Username, req.DryRun, strings.Join(applied, "; "))
+	settings := map[string]string{"k8s_namespace": req.Namespace, "k8s_service_account": req.ServiceAccount}
+	if req.RunnerImage != "" {
+		settings["k8s_runner_image"] = req.RunnerImage
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"applied": applied, "dry_run": req.DryRun, "app_settings": settings, "manifest": manifest})
+}
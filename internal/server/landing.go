@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/store"
+)
+
+// landingPages are the pages a group can land on after login ("" keeps the default, the run list).
+var landingPages = map[string]bool{"": true, "runs": true, "apps": true}
+
+// setGroupLanding sets what members of a group see first after login (admin). Body: page (runs,
+// apps, or "" for the default) and app_ids, the apps the apps list shows by default.
+func (s *Server) setGroupLanding(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "groupID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid group id"})
+		return
+	}
+	group, err := s.store.GetGroup(groupID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if group == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "group not found"})
+		return
+	}
+	var body struct {
+		Page   string   `json:"page"`
+		AppIDs []string `json:"app_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	l := store.GroupLanding{GroupID: groupID, Page: strings.TrimSpace(body.Page), AppIDs: make([]string, 0, len(body.AppIDs))}
+	if !landingPages[l.Page] {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "page must be runs, apps, or empty"})
+		return
+	}
+	seen := make(map[string]bool, len(body.AppIDs))
+	for _, id := range body.AppIDs {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		if !s.appExists(id) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("app %s not found", id)})
+			return
+		}
+		seen[id] = true
+		l.AppIDs = append(l.AppIDs, id)
+	}
+	if err := s.store.SetGroupLanding(groupID, l); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+// userLanding merges the landing pages of the user's groups: the page of the first group (by
+// name) that sets one, and the landing apps of all groups that the user can access and that are
+// not archived.
+func (s *Server) userLanding(user authUser) (store.GroupLanding, error) {
+	out := store.GroupLanding{AppIDs: []string{}}
+	landings, err := s.store.UserGroupLandings(user.ID)
+	if err != nil || len(landings) == 0 {
+		return out, err
+	}
+	var allowed map[string]struct{}
+	if !user.IsAdmin {
+		if allowed, _, err = s.allowedAppIDsForUser(user.ID); err != nil {
+			return out, err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, l := range landings {
+		if out.Page == "" {
+			out.Page = l.Page
+		}
+		for _, id := range l.AppIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if allowed != nil {
+				if _, ok := allowed[id]; !ok {
+					continue
+				}
+			}
+			if app, ok := s.findApp(id); ok && !app.Archived {
+				out.AppIDs = append(out.AppIDs, id)
+			}
+		}
+	}
+	return out, nil
+}
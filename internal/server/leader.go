@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// leaderLease is the lease held by the replica that runs the periodic janitor work (purging
+// deleted runs and expired sessions, Kubernetes orphan cleanup, the heartbeat watchdog).
+const leaderLease = "scheduler"
+
+// StartLeaderElection makes this process compete with the other replicas sharing the database for
+// the scheduler lease, renewing it every ttl/3. Until it is called every process is its own leader,
+// which suits a single server. It returns immediately.
+func (s *Server) StartLeaderElection(ttl time.Duration) {
+	s.leaderMu.Lock()
+	s.leaderElection = true
+	s.leaderMu.Unlock()
+	s.electLeader(ttl)
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.electLeader(ttl)
+		}
+	}()
+}
+
+func (s *Server) electLeader(ttl time.Duration) {
+	leader, err := s.store.AcquireLease(leaderLease, s.instanceID, ttl, time.Now())
+	if err != nil {
+		// Without the database nobody can renew, so step down rather than risk two leaders.
+		log.Printf("leader election: %v", err)
+		leader = false
+	}
+	s.leaderMu.Lock()
+	changed := s.leader != leader
+	s.leader = leader
+	s.leaderMu.Unlock()
+	if changed && leader {
+		log.Printf("leader election: %s is now the leader", s.instanceID)
+	} else if changed {
+		log.Printf("leader election: %s is no longer the leader", s.instanceID)
+	}
+}
+
+// isLeader reports whether this process should run the periodic janitor work.
+func (s *Server) isLeader() bool {
+	s.leaderMu.Lock()
+	defer s.leaderMu.Unlock()
+	return !s.leaderElection || s.leader
+}
+
+// newInstanceID names this process in leases: host, PID and a random suffix, so a restarted
+// process does not inherit the lease of its predecessor.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+const (
+	// redactedText replaces each match of a log redaction rule.
+	redactedText              = "[REDACTED]"
+	maxRedactionPatternLen    = 1000
+	maxRedactionDescLen       = 255
+	redactBatchSize           = 100
+	maxRedactErrorsReported   = 20
+	withheldRunLogPlaceholder = "run log withheld: log redaction rules could not be loaded"
+)
+
+// logRedactor holds the compiled log redaction rules.
+type logRedactor []*regexp.Regexp
+
+// redact replaces every match of the rules in text with redactedText.
+func (rd logRedactor) redact(text string) string {
+	for _, re := range rd {
+		text = re.ReplaceAllLiteralString(text, redactedText)
+	}
+	return text
+}
+
+// redactFile applies the rules line by line to a file, replacing it only when something was
+// redacted. It returns whether the file changed and its new size.
+func (rd logRedactor) redactFile(path string) (bool, int64, error) {
+	if len(rd) == 0 {
+		return false, 0, nil
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return false, 0, err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(path), ".redact-*")
+	if err != nil {
+		return false, 0, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	br, bw := bufio.NewReader(in), bufio.NewWriter(out)
+	changed := false
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			redacted := rd.redact(line)
+			changed = changed || redacted != line
+			if _, werr := bw.WriteString(redacted); werr != nil {
+				return false, 0, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	if !changed {
+		return false, 0, nil
+	}
+	if err := bw.Flush(); err != nil {
+		return false, 0, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return false, 0, err
+	}
+	if err := out.Close(); err != nil {
+		return false, 0, err
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return false, 0, err
+	}
+	return true, info.Size(), nil
+}
+
+// logRedactor loads and compiles the log redaction rules. They are read on every log write, so
+// rule changes apply at once on all replicas.
+func (s *Server) logRedactor() (logRedactor, error) {
+	rules, err := s.store.ListLogRedactionRules()
+	if err != nil {
+		return nil, err
+	}
+	rd := make(logRedactor, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Printf("log redaction rule %d: %v", rule.ID, err)
+			continue
+		}
+		rd = append(rd, re)
+	}
+	return rd, nil
+}
+
+// runLogRedactor returns the redaction rules plus the secrets resolved for a run, which are
+// masked the same way.
+func (s *Server) runLogRedactor(runID int64) (logRedactor, error) {
+	rd, err := s.logRedactor()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range s.runSecretValues(runID) {
+		rd = append(rd, regexp.MustCompile(regexp.QuoteMeta(value)))
+	}
+	return rd, nil
+}
+
+// compileRedactionPattern checks a redaction pattern: it must compile and must not match the
+// empty string, which would put redactedText between every character.
+func compileRedactionPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, errors.New("pattern is required")
+	}
+	if len(pattern) > maxRedactionPatternLen {
+		return nil, fmt.Errorf("pattern must be at most %d characters", maxRedactionPatternLen)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	if re.MatchString("") {
+		return nil, errors.New("pattern must not match the empty string")
+	}
+	return re, nil
+}
+
+// listLogRedactionRules returns the log redaction rules (admin).
+func (s *Server) listLogRedactionRules(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	rules, err := s.store.ListLogRedactionRules()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// createLogRedactionRule adds a redaction rule (admin). It applies to log writes from now on;
+// POST /api/runs/redact applies it to stored logs.
+func (s *Server) createLogRedactionRule(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Pattern     string `json:"pattern"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if _, err := compileRedactionPattern(req.Pattern); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Description) > maxRedactionDescLen {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("description must be at most %d characters", maxRedactionDescLen)})
+		return
+	}
+	rule := store.LogRedactionRule{Pattern: req.Pattern, Description: req.Description, CreatedBy: user.Username}
+	id, err := s.store.CreateLogRedactionRule(rule)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	rule.ID = id
+	log.Printf("log redaction: %s added rule %d", user.Username, id)
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// deleteLogRedactionRule removes a redaction rule (admin). Logs it already redacted stay redacted.
+func (s *Server) deleteLogRedactionRule(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "ruleID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid rule id"})
+		return
+	}
+	if err := s.store.DeleteLogRedactionRule(id); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "rule not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("log redaction: %s deleted rule %d", user.Username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redactRunLogs serves POST /api/runs/redact (admin): it applies the current redaction rules to
+// the stored logs of finished runs, of one run (run_id), one app (app_id), or all runs, and to
+// the full logs of truncated runs kept as artifacts. Running runs are redacted by their next
+// log write.
+func (s *Server) redactRunLogs(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		AppID string `json:"app_id"`
+		RunID int64  `json:"run_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	rd, err := s.logRedactor()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(rd) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "no log redaction rules configured"})
+		return
+	}
+	var scanned, redactedLogs, redactedArtifacts int
+	problems := make([]string, 0)
+	fail := func(runID int64, err error) {
+		if len(problems) < maxRedactErrorsReported {
+			problems = append(problems, fmt.Sprintf("run %d: %v", runID, err))
+		}
+	}
+	redactRun := func(runID int64) {
+		logChanged, artifacts, err := s.redactStoredRun(r.Context(), rd, runID)
+		if err != nil {
+			fail(runID, err)
+		}
+		scanned++
+		if logChanged {
+			redactedLogs++
+		}
+		redactedArtifacts += artifacts
+	}
+	if req.RunID != 0 {
+		run, err := s.store.GetRun(req.RunID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if run == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+			return
+		}
+		redactRun(run.ID)
+	} else {
+		var afterID int64
+		for {
+			ids, err := s.store.FinishedRunIDs(strings.TrimSpace(req.AppID), afterID, redactBatchSize)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			for _, id := range ids {
+				redactRun(id)
+			}
+			if len(ids) < redactBatchSize || r.Context().Err() != nil {
+				break
+			}
+			afterID = ids[len(ids)-1]
+		}
+	}
+	log.Printf("log redaction: %s redacted %d of %d run logs and %d full logs", user.Username, redactedLogs, scanned, redactedArtifacts)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"scanned":            scanned,
+		"redacted_logs":      redactedLogs,
+		"redacted_artifacts": redactedArtifacts,
+		"errors":             problems,
+	})
+}
+
+// redactStoredRun rewrites the stored log of a run, and its full-log artifact, where the rules
+// match. It returns whether the log changed and how many artifacts were rewritten.
+func (s *Server) redactStoredRun(ctx context.Context, rd logRedactor, runID int64) (bool, int, error) {
+	run, err := s.store.GetRun(runID)
+	if err != nil || run == nil {
+		return false, 0, err
+	}
+	if err := s.loadRunLog(run); err != nil {
+		return false, 0, err
+	}
+	logChanged := false
+	if redacted := rd.redact(run.Log); redacted != run.Log {
+		if run.LogKey != "" {
+			err = s.putRunLog(run.ID, redacted)
+		} else {
+			err = s.store.UpdateRunLog(run.ID, redacted)
+		}
+		if err != nil {
+			return false, 0, err
+		}
+		logChanged = true
+	}
+	if s.artifacts == nil {
+		return logChanged, 0, nil
+	}
+	arts, err := s.store.ListRunArtifacts(run.ID)
+	if err != nil {
+		return logChanged, 0, err
+	}
+	rewritten := 0
+	for _, a := range arts {
+		if a.Name != pipeline.FullLogArtifactName {
+			continue
+		}
+		changed, err := s.redactArtifact(ctx, rd, a)
+		if err != nil {
+			return logChanged, rewritten, fmt.Errorf("artifact %s: %v", a.Name, err)
+		}
+		if changed {
+			rewritten++
+		}
+	}
+	return logChanged, rewritten, nil
+}
+
+// redactArtifact downloads an artifact to a temporary file, redacts it, and uploads it again
+// under the same key when something matched.
+func (s *Server) redactArtifact(ctx context.Context, rd logRedactor, a store.RunArtifact) (bool, error) {
+	body, err := s.artifacts.Get(ctx, a.StorageKey)
+	if err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp("", "noppflow-redact-*")
+	if err != nil {
+		body.Close()
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	body.Close()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	changed, size, err := rd.redactFile(tmp.Name())
+	if err != nil || !changed {
+		return false, err
+	}
+	if err := s.putArtifactFile(a.StorageKey, pipeline.Artifact{Name: a.Name, Path: tmp.Name(), Size: size}); err != nil {
+		return false, err
+	}
+	return true, s.store.SetRunArtifactSize(a.ID, size)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"noppflow/internal/artifacts"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+// SetLogStore moves run logs out of the database: logs are written to ls under prefix + "<run_id>.log"
+// and the runs table only keeps the key and size. Without a log store, logs are kept in the runs table.
+func (s *Server) SetLogStore(ls artifacts.Store, prefix string) {
+	s.logStore = ls
+	s.logKeyPrefix = prefix
+}
+
+// SetMaxLogSize caps the log of local runs at maxBytes (0 = unlimited). Longer logs are truncated
+// in the middle and the full log is kept as a run artifact.
+func (s *Server) SetMaxLogSize(maxBytes int64) {
+	s.maxLogBytes = maxBytes
+}
+
+// saveFullLog keeps the full log of a truncated run (a temporary file from the runner) as a run artifact.
+func (s *Server) saveFullLog(runID int64, path string) {
+	if path == "" {
+		return
+	}
+	defer os.Remove(path)
+	rd, err := s.runLogRedactor(runID)
+	if err != nil {
+		log.Printf("run %d: full log not kept: load log redaction rules: %v", runID, err)
+		return
+	}
+	if _, _, err := rd.redactFile(path); err != nil {
+		log.Printf("run %d: full log not kept: redact: %v", runID, err)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("run %d: full log: %v", runID, err)
+		return
+	}
+	s.saveRunArtifacts(runID, []pipeline.Artifact{{Name: pipeline.FullLogArtifactName, Path: path, Size: info.Size()}})
+}
+
+func (s *Server) runLogKey(runID int64) string {
+	return s.logKeyPrefix + strconv.FormatInt(runID, 10) + ".log"
+}
+
+// putRunLog writes the log of a run to the log store and records its key and size.
+func (s *Server) putRunLog(runID int64, runLog string) error {
+	key := s.runLogKey(runID)
+	if err := s.logStore.Put(context.Background(), key, strings.NewReader(runLog), int64(len(runLog))); err != nil {
+		return err
+	}
+	return s.store.SetRunLogRef(runID, key, int64(len(runLog)))
+}
+
+// updateRunLog stores the log of a running run (called after each step so the UI can stream it).
+// The log redaction rules are applied first; if they cannot be loaded, the update is skipped.
+func (s *Server) updateRunLog(runID int64, runLog string) {
+	rd, err := s.runLogRedactor(runID)
+	if err != nil {
+		log.Printf("run %d: log update skipped: load log redaction rules: %v", runID, err)
+		return
+	}
+	runLog = rd.redact(runLog)
+	if s.logStore == nil {
+		_ = s.store.UpdateRunLog(runID, runLog)
+		return
+	}
+	if err := s.putRunLog(runID, runLog); err != nil {
+		log.Printf("run %d: write log to log store: %v", runID, err)
+	}
+}
+
+// completeRun sets the final status and log of a run, redacted by the log redaction rules. If
+// the log store fails, the log is kept in the runs table so it is not lost; if the rules cannot
+// be loaded, the log is withheld rather than stored unredacted.
+func (s *Server) completeRun(runID int64, status, runLog string) {
+	if rd, err := s.runLogRedactor(runID); err != nil {
+		log.Printf("run %d: log withheld: load log redaction rules: %v", runID, err)
+		runLog = withheldRunLogPlaceholder
+	} else {
+		runLog = rd.redact(runLog)
+	}
+	if s.logStore != nil {
+		err := s.putRunLog(runID, runLog)
+		if err == nil {
+			_ = s.store.UpdateRunStatus(runID, status, "")
+			return
+		}
+		log.Printf("run %d: write log to log store, keeping it in the database: %v", runID, err)
+		_ = s.store.SetRunLogRef(runID, "", 0)
+	}
+	_ = s.store.UpdateRunStatus(runID, status, runLog)
+}
+
+// loadRunLog fills run.Log from the log store for runs whose log lives there.
+func (s *Server) loadRunLog(run *store.Run) error {
+	if run.LogKey == "" {
+		return nil
+	}
+	if s.logStore == nil {
+		return errors.New("run log is in the log store, but no log store is configured")
+	}
+	rc, err := s.logStore.Get(context.Background(), run.LogKey)
+	if errors.Is(err, artifacts.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	run.Log = string(b)
+	return nil
+}
+
+// deleteLogObjects removes run logs from the log store before their runs are deleted.
+func (s *Server) deleteLogObjects(keys []string) {
+	if s.logStore == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := s.logStore.Delete(context.Background(), key); err != nil {
+			log.Printf("delete run log %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// smtpSendMail sends mail; tests replace it.
+var smtpSendMail = smtp.SendMail
+
+// SetSMTP sets the SMTP server used to email user invitations. addr is host:port; without a
+// username mail is sent unauthenticated.
+func (s *Server) SetSMTP(addr, from, username, password string) {
+	s.smtpAddr = addr
+	s.smtpFrom = from
+	s.smtpUsername = username
+	s.smtpPassword = password
+}
+
+// sendMail emails a plain-text message to one recipient.
+func (s *Server) sendMail(to, subject, body string) error {
+	if s.smtpAddr == "" || s.smtpFrom == "" {
+		return errors.New("no SMTP server configured")
+	}
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("invalid mail header")
+	}
+	var auth smtp.Auth
+	if s.smtpUsername != "" {
+		host, _, err := net.SplitHostPort(s.smtpAddr)
+		if err != nil {
+			return fmt.Errorf("smtp address: %w", err)
+		}
+		auth = smtp.PlainAuth("", s.smtpUsername, s.smtpPassword, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		s.smtpFrom, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtpSendMail(s.smtpAddr, auth, s.smtpFrom, []string{to}, []byte(msg))
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"noppflow/internal/store"
+)
+
+// maintenanceState is the maintenance mode switch. While Enabled, new runs are rejected with 503,
+// or held as pending runs when QueueRuns is set; webhook pushes are always held. Held runs start
+// when maintenance mode is switched off. The switch is stored in the database, so it applies to
+// every replica sharing it.
+type maintenanceState struct {
+	Enabled   bool       `json:"enabled"`
+	Message   string     `json:"message,omitempty"`
+	QueueRuns bool       `json:"queue_runs"`
+	Since     *time.Time `json:"since,omitempty"`
+	By        string     `json:"by,omitempty"`
+}
+
+// heldRun is a run created during maintenance mode, waiting to be launched. Held runs are
+// recorded in the database (for the count all replicas report) but launched by the replica that
+// created them, which has what they need to start.
+type heldRun struct {
+	RunID  int64
+	Launch func()
+}
+
+func (s *Server) maintenanceStatus() (maintenanceState, error) {
+	m, err := s.store.GetMaintenance()
+	if err != nil || m == nil {
+		return maintenanceState{}, err
+	}
+	since := m.Since
+	return maintenanceState{Enabled: true, Message: m.Message, QueueRuns: m.QueueRuns, Since: &since, By: m.By}, nil
+}
+
+// holdRun keeps a just-created run pending while maintenance mode is on and reports whether it did.
+func (s *Server) holdRun(runID int64, launch func()) bool {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+	m, err := s.maintenanceStatus()
+	if err != nil {
+		log.Printf("run %d: read maintenance mode: %v", runID, err)
+		return false
+	}
+	if !m.Enabled {
+		return false
+	}
+	if err := s.store.HoldRun(runID); err != nil {
+		log.Printf("run %d: record held run: %v", runID, err)
+	}
+	s.heldRuns = append(s.heldRuns, heldRun{RunID: runID, Launch: launch})
+	return true
+}
+
+// releaseHeldRuns launches the runs this process holds and returns how many it started.
+func (s *Server) releaseHeldRuns() int {
+	s.maintenanceMu.Lock()
+	released := s.heldRuns
+	s.heldRuns = nil
+	s.maintenanceMu.Unlock()
+	ids := make([]int64, 0, len(released))
+	for _, h := range released {
+		ids = append(ids, h.RunID)
+	}
+	if err := s.store.DeleteHeldRuns(ids); err != nil {
+		log.Printf("maintenance: delete held runs: %v", err)
+	}
+	for _, h := range released {
+		go h.Launch()
+	}
+	return len(released)
+}
+
+// StartMaintenanceWatcher checks every interval whether maintenance mode was switched off (on
+// another replica) while this process holds runs, and then launches them. It returns immediately.
+func (s *Server) StartMaintenanceWatcher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.releaseHeldRunsAfterMaintenance()
+		}
+	}()
+}
+
+func (s *Server) releaseHeldRunsAfterMaintenance() {
+	s.maintenanceMu.Lock()
+	holding := len(s.heldRuns) > 0
+	s.maintenanceMu.Unlock()
+	if !holding {
+		return
+	}
+	m, err := s.maintenanceStatus()
+	if err != nil {
+		log.Printf("maintenance: %v", err)
+		return
+	}
+	if !m.Enabled {
+		log.Printf("maintenance mode is off, starting %d held runs", s.releaseHeldRuns())
+	}
+}
+
+// maintenanceResponse is the maintenance state plus the number of held runs of all replicas.
+func (s *Server) maintenanceResponse() (map[string]interface{}, error) {
+	m, err := s.maintenanceStatus()
+	if err != nil {
+		return nil, err
+	}
+	held, err := s.store.CountHeldRuns()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"maintenance": m, "held_runs": held}, nil
+}
+
+func (s *Server) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	s.writeMaintenance(w)
+}
+
+// setMaintenance switches maintenance mode (admin). Switching it off launches the held runs of
+// this replica; the others launch theirs when their StartMaintenanceWatcher notices.
+func (s *Server) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Enabled   bool   `json:"enabled"`
+		Message   string `json:"message"`
+		QueueRuns bool   `json:"queue_runs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	body.Message = strings.TrimSpace(body.Message)
+	if len(body.Message) > 500 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "message must be at most 500 characters"})
+		return
+	}
+
+	var err error
+	if body.Enabled {
+		m := store.Maintenance{Message: body.Message, QueueRuns: body.QueueRuns, Since: time.Now().UTC().Truncate(time.Second), By: user.Username}
+		var current maintenanceState
+		if current, err = s.maintenanceStatus(); err == nil && current.Enabled {
+			m.Since = *current.Since
+		}
+		if err == nil {
+			err = s.store.SetMaintenance(m)
+		}
+	} else {
+		err = s.store.ClearMaintenance()
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if body.Enabled {
+		log.Printf("maintenance mode on (by %s, queue_runs=%t)", user.Username, body.QueueRuns)
+	} else {
+		log.Printf("maintenance mode off (by %s), starting %d held runs", user.Username, s.releaseHeldRuns())
+	}
+	s.writeMaintenance(w)
+}
+
+func (s *Server) writeMaintenance(w http.ResponseWriter) {
+	out, err := s.maintenanceResponse()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// notifyTimeout bounds each webhook delivery.
+const notifyTimeout = 10 * time.Second
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+// notification is the JSON payload posted to an app's notify_webhook.
+type notification struct {
+	Event   string           `json:"event"`
+	AppID   string           `json:"app_id"`
+	AppName string           `json:"app_name"`
+	RunID   int64            `json:"run_id,omitempty"`
+	Message string           `json:"message"`
+	Owner   *config.AppOwner `json:"owner,omitempty"`
+	Time    time.Time        `json:"time"`
+}
+
+// notify logs n, records it on the run's timeline, and, when the app has a notify_webhook, posts
+// it there. Delivery failures are logged only; notify blocks until the delivery is done, so
+// callers run it off the request path.
+func (s *Server) notify(app config.App, n notification) {
+	n.AppID = app.ID
+	n.AppName = app.Name
+	n.Owner = app.Owner
+	if n.Time.IsZero() {
+		n.Time = time.Now().UTC()
+	}
+	log.Printf("notify %s app=%s run=%d: %s", n.Event, app.ID, n.RunID, n.Message)
+	if n.RunID > 0 {
+		if _, err := s.store.CreateRunNotification(n.RunID, n.Event, n.Message, n.Time); err != nil {
+			log.Printf("notify %s app=%s: record: %v", n.Event, app.ID, err)
+		}
+	}
+	if app.NotifyWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("notify %s app=%s: %v", n.Event, app.ID, err)
+		return
+	}
+	resp, err := notifyClient.Post(app.NotifyWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("notify %s app=%s: %v", n.Event, app.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("notify %s app=%s: webhook returned %s", n.Event, app.ID, resp.Status)
+	}
+}
+
+// validateNotifyWebhook checks that raw is an absolute http(s) URL.
+func validateNotifyWebhook(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("notify_webhook must be an http or https URL")
+	}
+	return nil
+}
+
+// notifyRunFailed sends a run.failed notification naming the failure reason, when the log
+// matched a failure rule, and the app's owner, so whoever sees it knows whom to contact.
+func (s *Server) notifyRunFailed(runID int64, app config.App, reason string) {
+	msg := fmt.Sprintf("run %d of %s failed", runID, app.ID)
+	if reason != "" {
+		msg += " (" + reason + ")"
+	}
+	if owner := app.Owner.String(); owner != "" {
+		msg += "; owner: " + owner
+	}
+	s.notify(app, notification{Event: "run.failed", RunID: runID, Message: msg})
+}
+
+// checkDurationBudget flags a finished run as slow and sends a run.slow notification when it took
+// longer than the app's slow threshold (expected_duration_sec × slow_factor).
+func (s *Server) checkDurationBudget(runID int64, app config.App, elapsed time.Duration) {
+	threshold := app.SlowThreshold()
+	if threshold <= 0 || elapsed <= threshold {
+		return
+	}
+	if err := s.store.MarkRunSlow(runID); err != nil {
+		log.Printf("mark run %d slow: %v", runID, err)
+	}
+	expected := time.Duration(app.ExpectedDurationSec) * time.Second
+	s.notify(app, notification{
+		Event: "run.slow",
+		RunID: runID,
+		Message: fmt.Sprintf("run took %s, expected %s (slow above %s)",
+			elapsed.Round(time.Second), expected, threshold.Round(time.Second)),
+	})
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"noppflow/internal/config"
+)
+
+const (
+	maxOwnerTeamLen   = 100
+	maxOwnerOnCallLen = 200
+)
+
+// slackChannelPattern matches a channel name (#payments-alerts) or a channel ID (C0123ABCD).
+var slackChannelPattern = regexp.MustCompile(`^(#[a-z0-9][a-z0-9._-]{0,79}|[CG][A-Z0-9]{8,20})$`)
+
+// validateOwner checks and normalizes an app's owner; an owner with no field set is removed.
+func validateOwner(app *config.App) error {
+	o := app.Owner
+	if o == nil {
+		return nil
+	}
+	o.Team = strings.TrimSpace(o.Team)
+	o.OnCall = strings.TrimSpace(o.OnCall)
+	o.SlackChannel = strings.TrimSpace(o.SlackChannel)
+	if *o == (config.AppOwner{}) {
+		app.Owner = nil
+		return nil
+	}
+	if len(o.Team) > maxOwnerTeamLen || strings.IndexFunc(o.Team, unicode.IsControl) >= 0 {
+		return fmt.Errorf("owner team must be at most %d characters on one line", maxOwnerTeamLen)
+	}
+	if len(o.OnCall) > maxOwnerOnCallLen || strings.IndexFunc(o.OnCall, unicode.IsControl) >= 0 {
+		return fmt.Errorf("owner on_call must be at most %d characters on one line", maxOwnerOnCallLen)
+	}
+	if o.SlackChannel != "" && !slackChannelPattern.MatchString(o.SlackChannel) {
+		return fmt.Errorf("owner slack_channel must be a channel name like #team-alerts or a channel ID")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import "net/http"
+
+// permissionGroup is a row of the permission matrix. AppIDs may name apps that are no longer
+// configured; Access only covers the configured ones.
+type permissionGroup struct {
+	ID      int64    `json:"id"`
+	Name    string   `json:"name"`
+	UserIDs []int64  `json:"user_ids"`
+	AppIDs  []string `json:"app_ids"`
+	Access  []bool   `json:"access"`
+}
+
+type permissionApp struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// getPermissionMatrix returns the group × app access matrix in one call (admin): apps in config
+// order, and per group its users, its apps, and an access flag per app of the apps list.
+func (s *Server) getPermissionMatrix(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	groups, err := s.store.ListGroups()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	groupApps, err := s.store.AllGroupAppIDs()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	groupUsers, err := s.store.AllGroupUserIDs()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.appsMu.RLock()
+	apps := make([]permissionApp, 0, len(s.apps))
+	for _, a := range s.apps {
+		apps = append(apps, permissionApp{ID: a.ID, Name: a.Name})
+	}
+	s.appsMu.RUnlock()
+
+	rows := make([]permissionGroup, 0, len(groups))
+	for _, g := range groups {
+		row := permissionGroup{ID: g.ID, Name: g.Name, UserIDs: groupUsers[g.ID], AppIDs: groupApps[g.ID], Access: make([]bool, len(apps))}
+		if row.UserIDs == nil {
+			row.UserIDs = []int64{}
+		}
+		if row.AppIDs == nil {
+			row.AppIDs = []string{}
+		}
+		assigned := make(map[string]bool, len(row.AppIDs))
+		for _, id := range row.AppIDs {
+			assigned[id] = true
+		}
+		for i, a := range apps {
+			row.Access[i] = assigned[a.ID]
+		}
+		rows = append(rows, row)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"apps": apps, "groups": rows})
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+)
+
+// Edge conditions of a pipeline graph: the target runs when the steps before it succeeded, when
+// the run failed (on_failure section), or in any case (always_run steps, the always section).
+const (
+	graphOnSuccess = "success"
+	graphOnFailure = "failure"
+	graphAlways    = "always"
+)
+
+// pipelineGraph is an app's pipeline as a DAG for rendering. Steps run one after another, so
+// every node has at most one successor per condition today; clients should not rely on that.
+type pipelineGraph struct {
+	AppID  string      `json:"app_id"`
+	Runner string      `json:"runner"`
+	Nodes  []graphNode `json:"nodes"`
+	Edges  []graphEdge `json:"edges"`
+}
+
+// graphNode is one step. ID is "<section>/<index>" with section steps, on_success, on_failure,
+// or always. Approval is set for steps that wait for a user: terraform plans without
+// auto_approve, and deploy steps of an environment with approver groups.
+type graphNode struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Section         string   `json:"section"`
+	Kind            string   `json:"kind"`
+	Command         string   `json:"command,omitempty"`
+	Workdir         string   `json:"workdir,omitempty"`
+	Deploy          bool     `json:"deploy,omitempty"`
+	Environment     string   `json:"environment,omitempty"`
+	Approval        bool     `json:"approval,omitempty"`
+	ContinueOnError bool     `json:"continue_on_error,omitempty"`
+	AlwaysRun       bool     `json:"always_run,omitempty"`
+	SleepSec        int      `json:"sleep_sec,omitempty"`
+	Artifacts       []string `json:"artifacts,omitempty"`
+	EnvNames        []string `json:"env_names,omitempty"`
+}
+
+type graphEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Condition string `json:"condition"`
+}
+
+// getPipelineGraph is the HTTP handler for GET /api/apps/{appID}/pipeline-graph.
+func (s *Server) getPipelineGraph(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	app, ok := s.findApp(appID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.buildPipelineGraph(app))
+}
+
+// buildPipelineGraph turns the app's steps and post sections into nodes and edges in the order
+// the Runner executes them.
+func (s *Server) buildPipelineGraph(app config.App) pipelineGraph {
+	g := pipelineGraph{AppID: app.ID, Runner: "local", Nodes: make([]graphNode, 0), Edges: make([]graphEdge, 0)}
+	if appUsesK8sJob(app) {
+		g.Runner = "kubernetes"
+	}
+	env := s.findEnvironment(app.Environment)
+	deployApproval := app.Environment != "" && env != nil && len(env.ApproverGroups) > 0
+
+	// chain adds the steps of a section linked one after another, and returns the IDs of its
+	// first and last node ("" when empty).
+	chain := func(section string, steps []config.Step) (first, last string) {
+		var prev config.Step
+		for i, step := range steps {
+			n := graphNode{
+				ID:              fmt.Sprintf("%s/%d", section, i),
+				Name:            step.Name,
+				Section:         section,
+				Kind:            step.Kind(),
+				Command:         step.CommandValue(),
+				Workdir:         step.Workdir,
+				Deploy:          step.IsDeploy(),
+				ContinueOnError: step.ContinueOnError,
+				AlwaysRun:       step.AlwaysRun,
+				SleepSec:        step.SleepSec,
+				Artifacts:       step.Artifacts,
+				EnvNames:        pipeline.SortedKeys(step.Env),
+			}
+			if n.Command == n.Kind {
+				n.Command = ""
+			}
+			if n.Deploy {
+				n.Environment = app.Environment
+				n.Approval = deployApproval
+			}
+			if step.Terraform != nil && !step.Terraform.AutoApprove {
+				n.Approval = true
+			}
+			g.Nodes = append(g.Nodes, n)
+			if i == 0 {
+				first = n.ID
+			} else {
+				cond := graphOnSuccess
+				if step.AlwaysRun || prev.ContinueOnError {
+					cond = graphAlways
+				}
+				g.Edges = append(g.Edges, graphEdge{From: last, To: n.ID, Condition: cond})
+			}
+			last, prev = n.ID, step
+		}
+		return first, last
+	}
+
+	_, mainLast := chain("steps", app.EffectiveSteps())
+	post := app.EffectivePost()
+	successFirst, successLast := chain("on_success", post.OnSuccess)
+	failureFirst, failureLast := chain("on_failure", post.OnFailure)
+	alwaysFirst, _ := chain("always", post.Always)
+	if mainLast == "" {
+		return g
+	}
+	if successFirst != "" {
+		g.Edges = append(g.Edges, graphEdge{From: mainLast, To: successFirst, Condition: graphOnSuccess})
+	}
+	if failureFirst != "" {
+		g.Edges = append(g.Edges, graphEdge{From: mainLast, To: failureFirst, Condition: graphOnFailure})
+	}
+	if alwaysFirst != "" {
+		// always follows whichever of on_success and on_failure ran, or the main steps.
+		froms := []string{successLast, failureLast}
+		if successLast == "" || failureLast == "" {
+			froms = append(froms, mainLast)
+		}
+		for _, from := range froms {
+			if from != "" {
+				g.Edges = append(g.Edges, graphEdge{From: from, To: alwaysFirst, Condition: graphAlways})
+			}
+		}
+	}
+	return g
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// SetPolicies sets the deploy policies checked when a run with deploy steps starts and the
+// protection rules of environments checked before each deploy step.
+func (s *Server) SetPolicies(cfg config.PoliciesConfig) {
+	s.policies = cfg.Policies
+	s.environments = cfg.Environments
+}
+
+// appHasDeploySteps reports whether a run of the app changes an environment: it has a
+// k8s_deploy, terraform, or ansible step, also in post sections.
+func appHasDeploySteps(app config.App) bool {
+	post := app.EffectivePost()
+	for _, steps := range [][]config.Step{app.EffectiveSteps(), post.OnSuccess, post.OnFailure, post.Always} {
+		for _, step := range steps {
+			if step.IsDeploy() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPolicies returns an error naming the first policy a run of the app, triggered by
+// triggeredBy at now, violates. Runs without deploy steps are not checked.
+func (s *Server) checkPolicies(app config.App, triggeredBy string, now time.Time) error {
+	if len(s.policies) == 0 || !appHasDeploySteps(app) {
+		return nil
+	}
+	tags, err := s.store.AppTags(app.ID)
+	if err != nil {
+		return fmt.Errorf("policy check: %w", err)
+	}
+	var groups []string
+	groupsLoaded := false
+	for _, p := range s.policies {
+		if !p.AppliesTo(app.ID, tags) {
+			continue
+		}
+		if len(p.Branches) > 0 && !config.MatchAny(p.Branches, app.Branch) {
+			return fmt.Errorf("policy %s: deploys of %s are only allowed from branch %s (app branch is %s)",
+				p.Name, app.ID, strings.Join(p.Branches, ", "), app.Branch)
+		}
+		if !p.InHours(now) {
+			return fmt.Errorf("policy %s: deploys of %s are only allowed %s %s (now %s)",
+				p.Name, app.ID, p.Hours, p.Location(), now.In(p.Location()).Format("Mon 15:04"))
+		}
+		if len(p.Groups) == 0 && len(p.Users) == 0 {
+			continue
+		}
+		if config.MatchAny(p.Users, triggeredBy) {
+			continue
+		}
+		if !groupsLoaded {
+			if groups, err = s.userGroupNames(triggeredBy); err != nil {
+				return fmt.Errorf("policy check: %w", err)
+			}
+			groupsLoaded = true
+		}
+		if !intersects(p.Groups, groups) {
+			var allowed []string
+			if len(p.Groups) > 0 {
+				allowed = append(allowed, "members of "+strings.Join(p.Groups, ", "))
+			}
+			allowed = append(allowed, p.Users...)
+			return fmt.Errorf("policy %s: deploys of %s are only allowed for %s (run triggered by %s)",
+				p.Name, app.ID, strings.Join(allowed, " or "), triggeredBy)
+		}
+	}
+	return nil
+}
+
+// userGroupNames returns the names of the groups of a user, or nil when username is not a user
+// (e.g. "webhook:github").
+func (s *Server) userGroupNames(username string) ([]string, error) {
+	user, err := s.store.GetUserByUsername(username)
+	if err != nil || user == nil || len(user.GroupIDs) == 0 {
+		return nil, err
+	}
+	all, err := s.store.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	member := make(map[int64]bool, len(user.GroupIDs))
+	for _, id := range user.GroupIDs {
+		member[id] = true
+	}
+	var names []string
+	for _, g := range all {
+		if member[g.ID] {
+			names = append(names, g.Name)
+		}
+	}
+	return names, nil
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,636 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+// Run env vars identifying a preview run. A run with envPreviewBranch runs the preview copy of its
+// app (see previewApp), so retries and requeues of a preview run deploy the preview again.
+const (
+	envPreviewBranch    = "NOPPFLOW_PREVIEW_BRANCH"
+	envPreviewNamespace = "NOPPFLOW_PREVIEW_NAMESPACE"
+	envPreviewURL       = "NOPPFLOW_PREVIEW_URL"
+)
+
+const (
+	// maxPreviewTTLHours bounds preview.ttl_hours (30 days).
+	maxPreviewTTLHours = 720
+	// previewKubectlTimeout bounds the kubectl calls creating or deleting a preview namespace.
+	previewKubectlTimeout = time.Minute
+	// previewRoleBinding names the RoleBinding that lets the app's runner deploy into its previews.
+	previewRoleBinding = "noppflow-preview-deployer"
+	// Annotations naming the app and branch of a preview namespace.
+	previewAppAnnotation    = "noppflow.io/preview-app"
+	previewBranchAnnotation = "noppflow.io/preview-branch"
+)
+
+// dnsLabelPattern matches a Kubernetes namespace name (an RFC 1123 label).
+var dnsLabelPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// validatePreview checks and normalizes an app's preview config. Previews deploy with the app's
+// k8s_deploy steps, so the app needs deploy_mode kubectl or helm.
+func validatePreview(app *config.App) error {
+	p := app.Preview
+	if p == nil {
+		return nil
+	}
+	if !appDeploysWithDiff(*app) || !appUsesK8sJob(*app) {
+		return errors.New("preview needs a k8s_deploy step with deploy_mode kubectl or helm")
+	}
+	p.Namespace = strings.TrimSpace(p.Namespace)
+	p.URL = strings.TrimSpace(p.URL)
+	branches := make([]string, 0, len(p.Branches))
+	for _, pattern := range p.Branches {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			return fmt.Errorf("invalid preview branch pattern %q", pattern)
+		}
+		branches = append(branches, pattern)
+	}
+	p.Branches = nil
+	if len(branches) > 0 {
+		p.Branches = branches
+	}
+	if p.TTLHours < 0 || p.TTLHours > maxPreviewTTLHours {
+		return fmt.Errorf("preview.ttl_hours must be between 0 and %d", maxPreviewTTLHours)
+	}
+	nsA, urlA := p.Target(app.ID, "preview-a")
+	nsB, _ := p.Target(app.ID, "preview-b")
+	if nsA == nsB {
+		return errors.New("preview.namespace must contain $BRANCH")
+	}
+	if !dnsLabelPattern.MatchString(nsA) {
+		return fmt.Errorf("preview namespace %q is not a valid namespace name; set preview.namespace", nsA)
+	}
+	if p.URL != "" {
+		if u, err := url.Parse(urlA); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("preview.url must be an http(s) URL")
+		}
+	}
+	return nil
+}
+
+// previewTarget returns the namespace and URL of the preview of branch.
+func previewTarget(app config.App, branch string) (string, string, error) {
+	if app.Preview == nil {
+		return "", "", errors.New("app has no preview config")
+	}
+	if branch == app.Branch {
+		return "", "", fmt.Errorf("branch %s is the app branch", branch)
+	}
+	namespace, url := app.Preview.Target(app.ID, branch)
+	if !dnsLabelPattern.MatchString(namespace) {
+		return "", "", fmt.Errorf("preview namespace %q of branch %s is not a valid namespace name", namespace, branch)
+	}
+	if namespace == app.K8sNamespace {
+		return "", "", fmt.Errorf("preview namespace of branch %s is the app namespace", branch)
+	}
+	return namespace, url, nil
+}
+
+// previewApp returns the copy of app a preview run of branch runs: it checks out branch and
+// deploys into the preview namespace. It belongs to no environment, and promotions and
+// downstream triggers do not follow it.
+func previewApp(app config.App, branch string) (config.App, error) {
+	namespace, _, err := previewTarget(app, branch)
+	if err != nil {
+		return app, err
+	}
+	app.Branch = branch
+	app.PreviewNamespace = namespace
+	app.Environment = ""
+	app.Promotion = nil
+	app.Downstream = nil
+	return app, nil
+}
+
+// startPreview queues a preview run deploying branch and records the preview, whose TTL starts
+// over. alwaysHold is passed to queueRun.
+func (s *Server) startPreview(app config.App, branch, triggeredBy string, alwaysHold bool) (int64, bool, *store.PreviewEnv, error) {
+	namespace, url, err := previewTarget(app, branch)
+	if err != nil {
+		return 0, false, nil, &statusError{Status: http.StatusConflict, Msg: err.Error()}
+	}
+	runEnv := map[string]string{envPreviewBranch: branch, envPreviewNamespace: namespace, envPreviewURL: url}
+	runID, held, err := s.queueRun(app, triggeredBy, runEnv, alwaysHold, runLink{})
+	if err != nil {
+		return 0, false, nil, err
+	}
+	now := time.Now().UTC()
+	id, err := s.store.SavePreviewEnv(app.ID, branch, namespace, url, runID, now, now.Add(app.Preview.TTL()))
+	if err != nil {
+		return runID, held, nil, err
+	}
+	p, err := s.store.GetPreviewEnv(id)
+	return runID, held, p, err
+}
+
+// previewNamespaceYAML returns the preview namespace, annotated with its app and branch.
+func previewNamespaceYAML(app config.App) string {
+	return fmt.Sprintf(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: %s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+  annotations:
+    %s: %q
+    %s: %q
+`, app.PreviewNamespace, previewAppAnnotation, app.ID, previewBranchAnnotation, app.Branch)
+}
+
+// previewRoleBindingYAML returns the RoleBinding granting the app's runner service account the
+// edit ClusterRole in its preview namespace.
+func previewRoleBindingYAML(app config.App) string {
+	return fmt.Sprintf(`apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: %s
+  namespace: %s
+  labels:
+    app.kubernetes.io/managed-by: noppflow
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: edit
+subjects:
+  - kind: ServiceAccount
+    name: %s
+    namespace: %s
+`, previewRoleBinding, app.PreviewNamespace, app.K8sServiceAccount, app.K8sNamespace)
+}
+
+// previewNamespaceOwner returns the app a namespace is the preview of (its previewAppAnnotation,
+// "" for other namespaces) and whether the namespace exists (a var for tests).
+var previewNamespaceOwner = func(ctx context.Context, namespace string) (string, bool, error) {
+	cmd := exec.CommandContext(ctx, "kubectl", "get", "namespace", namespace, "--ignore-not-found=true", "-o", "json")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", false, fmt.Errorf("kubectl get namespace %s: %v: %s", namespace, err, strings.TrimSpace(stderr.String()))
+	}
+	if strings.TrimSpace(stdout.String()) == "" {
+		return "", false, nil
+	}
+	var ns struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &ns); err != nil {
+		return "", true, fmt.Errorf("kubectl get namespace %s: %v", namespace, err)
+	}
+	return ns.Metadata.Annotations[previewAppAnnotation], true, nil
+}
+
+// ensurePreviewNamespace creates the namespace of a preview run when create is set and lets the
+// runner deploy into it (a var for tests). The namespace is created, never applied, so an existing
+// one is not taken over.
+var ensurePreviewNamespace = func(ctx context.Context, app config.App, create bool) error {
+	kubectl := func(manifest string, args ...string) error {
+		cmd := exec.CommandContext(ctx, "kubectl", args...)
+		cmd.Stdin = strings.NewReader(manifest)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("kubectl %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+	if create {
+		if err := kubectl(previewNamespaceYAML(app), "create", "-f", "-"); err != nil {
+			return err
+		}
+	}
+	return kubectl(previewRoleBindingYAML(app), "apply", "-f", "-")
+}
+
+// deletePreviewNamespace deletes a preview namespace with everything deployed into it, without
+// waiting for its finalizers (a var for tests).
+var deletePreviewNamespace = func(ctx context.Context, namespace string) error {
+	cmd := exec.CommandContext(ctx, "kubectl", "delete", "namespace", namespace, "--ignore-not-found=true", "--wait=false")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("kubectl delete namespace %s: %v: %s", namespace, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// provisionPreview prepares the namespace of a preview run before its Job starts; other runs need
+// nothing. It refuses a namespace that exists but is not a preview of the app, so a preview
+// template or branch name colliding with another namespace cannot grant the runner rights there.
+func (s *Server) provisionPreview(app config.App) error {
+	if app.PreviewNamespace == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), previewKubectlTimeout)
+	defer cancel()
+	owner, exists, err := previewNamespaceOwner(ctx, app.PreviewNamespace)
+	if err != nil {
+		return err
+	}
+	if exists && owner != app.ID {
+		return fmt.Errorf("namespace %s exists and is not a preview of app %s (no %s=%s annotation)", app.PreviewNamespace, app.ID, previewAppAnnotation, app.ID)
+	}
+	return ensurePreviewNamespace(ctx, app, !exists)
+}
+
+// notifyPreviewReady sends run.preview_ready once a preview run deployed its branch.
+func (s *Server) notifyPreviewReady(runID int64, app config.App) {
+	_, url := app.Preview.Target(app.ID, app.Branch)
+	msg := fmt.Sprintf("preview of %s deployed to namespace %s", app.Branch, app.PreviewNamespace)
+	if url != "" {
+		msg += ": " + url
+	}
+	go s.notify(app, notification{Event: "run.preview_ready", RunID: runID, Message: msg})
+}
+
+// teardownPreview deletes the namespace of an active preview and records why. A namespace not
+// annotated as a preview of the app is left in place. A preview torn down concurrently is not an
+// error.
+func (s *Server) teardownPreview(p store.PreviewEnv, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), previewKubectlTimeout)
+	defer cancel()
+	owner, exists, err := previewNamespaceOwner(ctx, p.Namespace)
+	if err != nil {
+		return err
+	}
+	if exists && owner != p.AppID {
+		log.Printf("previews: namespace %s of %s %s is not a preview of the app; not deleting it", p.Namespace, p.AppID, p.Branch)
+	} else if exists {
+		if err := deletePreviewNamespace(ctx, p.Namespace); err != nil {
+			return err
+		}
+	}
+	if err := s.store.MarkPreviewEnvDeleted(p.ID, reason, time.Now().UTC()); storeErrNoRows(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if app, found := s.findApp(p.AppID); found {
+		go s.notify(app, notification{Event: "app.preview_deleted", RunID: p.LastRunID, Message: fmt.Sprintf("preview of %s in namespace %s torn down: %s", p.Branch, p.Namespace, reason)})
+	}
+	return nil
+}
+
+// expirePreviews tears down the previews whose TTL ran out (on the leader only when leader
+// election is on).
+func (s *Server) expirePreviews() {
+	if !s.isLeader() {
+		return
+	}
+	expired, err := s.store.ExpiredPreviewEnvs(time.Now().UTC())
+	if err != nil {
+		log.Printf("previews: list expired: %v", err)
+		return
+	}
+	for _, p := range expired {
+		if err := s.teardownPreview(p, "ttl expired"); err != nil {
+			log.Printf("previews: %s %s: %v", p.AppID, p.Branch, err)
+		}
+	}
+}
+
+// StartPreviewJanitor tears down expired preview environments every interval. It returns
+// immediately; interval <= 0 disables it.
+func (s *Server) StartPreviewJanitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.expirePreviews()
+		}
+	}()
+}
+
+// closedBranches extracts the branches a delivery reports gone: deleted by a push (or a GitHub
+// and Gitea delete event), or the source branch of a closed or merged pull request.
+func closedBranches(provider, event string, body []byte) []string {
+	var payload struct {
+		Ref         string `json:"ref"`
+		RefType     string `json:"ref_type"`
+		Deleted     bool   `json:"deleted"`
+		After       string `json:"after"`
+		Action      string `json:"action"`
+		PullRequest *struct {
+			Head struct {
+				Ref string `json:"ref"`
+			} `json:"head"`
+			Source struct {
+				Branch struct {
+					Name string `json:"name"`
+				} `json:"branch"`
+			} `json:"source"`
+		} `json:"pull_request"`
+		ObjectAttributes struct {
+			Action       string `json:"action"`
+			SourceBranch string `json:"source_branch"`
+		} `json:"object_attributes"`
+		Pullrequest struct {
+			Source struct {
+				Branch struct {
+					Name string `json:"name"`
+				} `json:"branch"`
+			} `json:"source"`
+		} `json:"pullrequest"`
+		Push struct {
+			Changes []struct {
+				Old *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"old"`
+				New *struct{} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+		Changes []struct {
+			Ref struct {
+				ID string `json:"id"`
+			} `json:"ref"`
+			Type string `json:"type"`
+		} `json:"changes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	var branches []string
+	switch provider {
+	case webhookGitHub, webhookGitea:
+		switch event {
+		case "push":
+			if b, ok := strings.CutPrefix(payload.Ref, "refs/heads/"); ok && payload.Deleted {
+				branches = append(branches, b)
+			}
+		case "delete":
+			if payload.RefType == "branch" && payload.Ref != "" {
+				branches = append(branches, payload.Ref)
+			}
+		case "pull_request":
+			if payload.Action == "closed" && payload.PullRequest != nil && payload.PullRequest.Head.Ref != "" {
+				branches = append(branches, payload.PullRequest.Head.Ref)
+			}
+		}
+	case webhookGitLab:
+		switch event {
+		case "Push Hook":
+			if b, ok := strings.CutPrefix(payload.Ref, "refs/heads/"); ok && strings.Trim(payload.After, "0") == "" {
+				branches = append(branches, b)
+			}
+		case "Merge Request Hook":
+			if a := payload.ObjectAttributes.Action; (a == "merge" || a == "close") && payload.ObjectAttributes.SourceBranch != "" {
+				branches = append(branches, payload.ObjectAttributes.SourceBranch)
+			}
+		}
+	case webhookBitbucket:
+		switch event {
+		case "repo:push":
+			for _, c := range payload.Push.Changes {
+				if c.New == nil && c.Old != nil && c.Old.Type == "branch" {
+					branches = append(branches, c.Old.Name)
+				}
+			}
+		case "repo:refs_changed":
+			for _, c := range payload.Changes {
+				if b, ok := strings.CutPrefix(c.Ref.ID, "refs/heads/"); ok && c.Type == "DELETE" {
+					branches = append(branches, b)
+				}
+			}
+		case "pullrequest:fulfilled", "pullrequest:rejected":
+			if b := payload.Pullrequest.Source.Branch.Name; b != "" {
+				branches = append(branches, b)
+			}
+		}
+	}
+	return branches
+}
+
+// previewWebhook handles the preview side of a webhook delivery to an app with previews and
+// reports whether it answered it. Previews of closed branches are torn down in the background;
+// pushes to other branches than the app branch that match preview.branches start preview runs.
+// Pushes to the app branch are left to receiveWebhook.
+func (s *Server) previewWebhook(w http.ResponseWriter, app config.App, event string, isPush bool, body []byte) bool {
+	if closed := closedBranches(app.WebhookProvider, event, body); len(closed) > 0 {
+		torn := make([]string, 0, len(closed))
+		for _, branch := range closed {
+			p, err := s.store.ActivePreviewEnv(app.ID, branch)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return true
+			}
+			if p == nil {
+				continue
+			}
+			torn = append(torn, branch)
+			go func(p store.PreviewEnv) {
+				if err := s.teardownPreview(p, "branch closed"); err != nil {
+					log.Printf("webhook app=%s: tear down preview of %s: %v", app.ID, p.Branch, err)
+				}
+			}(*p)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "previews_deleted", "branches": torn})
+		return true
+	}
+	if !isPush {
+		return false
+	}
+	var branches []string
+	for _, b := range pushedBranches(body) {
+		if b == app.Branch {
+			return false
+		}
+		if app.Preview.Matches(b) {
+			branches = append(branches, b)
+		}
+	}
+	if len(branches) == 0 {
+		return false
+	}
+	type started struct {
+		Branch    string `json:"branch"`
+		RunID     int64  `json:"run_id"`
+		Status    string `json:"status"`
+		Namespace string `json:"namespace"`
+		URL       string `json:"url,omitempty"`
+	}
+	out := make([]started, 0, len(branches))
+	for _, branch := range branches {
+		runID, held, p, err := s.startPreview(app, branch, "webhook:"+app.WebhookProvider, true)
+		if err != nil {
+			log.Printf("webhook app=%s provider=%s: preview of %s not started: %v", app.ID, app.WebhookProvider, branch, err)
+			writeStatusError(w, err)
+			return true
+		}
+		status := "pending"
+		if held {
+			status = "deferred"
+		}
+		out = append(out, started{Branch: branch, RunID: runID, Status: status, Namespace: p.Namespace, URL: p.URL})
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"previews": out})
+	return true
+}
+
+// runPreview is the preview a run deployed, from its run env.
+type runPreview struct {
+	Branch    string `json:"branch"`
+	Namespace string `json:"namespace"`
+	URL       string `json:"url,omitempty"`
+}
+
+// previewOfRun returns the preview of a preview run, or nil for other runs.
+func previewOfRun(env []store.RunEnvVar) *runPreview {
+	var p runPreview
+	for _, v := range env {
+		switch v.Name {
+		case envPreviewBranch:
+			p.Branch = v.Value
+		case envPreviewNamespace:
+			p.Namespace = v.Value
+		case envPreviewURL:
+			p.URL = v.Value
+		}
+	}
+	if p.Branch == "" {
+		return nil
+	}
+	return &p
+}
+
+// listPreviews serves GET /api/previews: the previews of the apps the user can access, newest
+// first (?status=active or deleted filters them).
+func (s *Server) listPreviews(w http.ResponseWriter, r *http.Request) {
+	appIDs, err := s.provenanceAppIDs(authUserFromContext(r))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	previews, err := s.store.ListPreviewEnvs(appIDs, strings.TrimSpace(r.URL.Query().Get("status")))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, previews)
+}
+
+// listAppPreviews serves GET /api/apps/{appID}/previews (?status= as for listPreviews).
+func (s *Server) listAppPreviews(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	previews, err := s.store.ListPreviewEnvs([]string{appID}, strings.TrimSpace(r.URL.Query().Get("status")))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, previews)
+}
+
+// deployPreview serves POST /api/apps/{appID}/previews: it deploys the preview of body.branch
+// like a push to it would.
+func (s *Server) deployPreview(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	user := authUserFromContext(r)
+	if !s.canEditApp(w, user, appID) {
+		return
+	}
+	app, found := s.findApp(appID)
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	if app.Preview == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "app has no preview config"})
+		return
+	}
+	var body struct {
+		Branch string `json:"branch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	branch := strings.TrimSpace(body.Branch)
+	if branch == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "branch is required"})
+		return
+	}
+	if !app.Preview.Matches(branch) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "branch does not match preview.branches"})
+		return
+	}
+	runID, _, p, err := s.startPreview(app, branch, user.Username, false)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"run_id": runID, "preview": p})
+}
+
+// deletePreview serves DELETE /api/apps/{appID}/previews/{previewID}: it tears the preview down.
+func (s *Server) deletePreview(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	user := authUserFromContext(r)
+	if !s.canEditApp(w, user, appID) {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "previewID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid preview id"})
+		return
+	}
+	p, err := s.store.GetPreviewEnv(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if p == nil || p.AppID != appID {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "preview not found"})
+		return
+	}
+	if p.Status != store.PreviewActive {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "preview is already deleted"})
+		return
+	}
+	if err := s.teardownPreview(*p, "deleted by "+user.Username); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// teardownAppPreviews tears down the active previews of a deleted app in the background.
+func (s *Server) teardownAppPreviews(previews []store.PreviewEnv) {
+	for _, p := range previews {
+		ctx, cancel := context.WithTimeout(context.Background(), previewKubectlTimeout)
+		if err := deletePreviewNamespace(ctx, p.Namespace); err != nil {
+			log.Printf("previews: %s %s: %v", p.AppID, p.Branch, err)
+		}
+		cancel()
+	}
+}
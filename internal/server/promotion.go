@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+// promoteTimeout bounds the registry copy of one promotion.
+const promoteTimeout = 10 * time.Minute
+
+var imageTagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// copyImage copies the image src (name@digest) to dst (name:tag) without rebuilding it and returns
+// the digest dst resolves to afterwards. It uses crane, which keeps manifests byte-for-byte.
+// It is a variable so tests can replace it.
+var copyImage = func(ctx context.Context, src, dst string) (string, error) {
+	if out, err := exec.CommandContext(ctx, "crane", "copy", src, dst).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("crane copy: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	out, err := exec.CommandContext(ctx, "crane", "digest", dst).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("crane digest: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// recordRunImage stores the image a successful run reported with an ::image:: marker.
+func (s *Server) recordRunImage(runID int64, runLog string) {
+	image, digest, ok := pipeline.ParseImageMarker(runLog)
+	if !ok {
+		return
+	}
+	if err := s.store.SetRunImage(runID, image, digest); err != nil {
+		log.Printf("run %d: record image: %v", runID, err)
+	}
+}
+
+// validatePromotion checks and normalizes an app's promotion environments.
+func validatePromotion(envs []config.PromotionEnv) error {
+	seen := make(map[string]bool, len(envs))
+	for i := range envs {
+		env := &envs[i]
+		env.Name = strings.TrimSpace(env.Name)
+		env.Image = strings.TrimSpace(env.Image)
+		env.Tag = strings.TrimSpace(env.Tag)
+		env.DeployApp = strings.TrimSpace(env.DeployApp)
+		if env.Name == "" {
+			return errors.New("each promotion environment needs a name")
+		}
+		if seen[env.Name] {
+			return fmt.Errorf("duplicate promotion environment %q", env.Name)
+		}
+		seen[env.Name] = true
+		if !pipeline.ValidImageName(env.Image) {
+			return fmt.Errorf("promotion environment %s: image must be a repository without tag or digest (e.g. ghcr.io/acme/api)", env.Name)
+		}
+		if env.Tag != "" && !imageTagPattern.MatchString(env.Tag) {
+			return fmt.Errorf("promotion environment %s: invalid tag %q", env.Name, env.Tag)
+		}
+		if env.Tag == "" && !imageTagPattern.MatchString(env.Name) {
+			return fmt.Errorf("promotion environment %s: tag is required when the name is not a valid tag", env.Name)
+		}
+	}
+	return nil
+}
+
+// addedPromotionDeployApps returns the promotion deploy apps of updated that current does not
+// deploy yet.
+func addedPromotionDeployApps(current, updated config.App) []string {
+	var added []string
+	for _, env := range updated.Promotion {
+		if env.DeployApp != "" && !slices.ContainsFunc(current.Promotion, func(c config.PromotionEnv) bool { return c.DeployApp == env.DeployApp }) {
+			added = append(added, env.DeployApp)
+		}
+	}
+	return added
+}
+
+func promotionTag(env config.PromotionEnv) string {
+	if env.Tag != "" {
+		return env.Tag
+	}
+	return env.Name
+}
+
+type promoteRequest struct {
+	Environment string `json:"environment"`
+	RunID       int64  `json:"run_id"`
+}
+
+// promoteApp is the HTTP handler for promote.
+func (s *Server) promoteApp(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	user := authUserFromContext(r)
+	if !s.canEditApp(w, user, appID) {
+		return
+	}
+	app, ok := s.findApp(appID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	var req promoteRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+	}
+	p, deployErr, err := s.promote(r.Context(), app, strings.TrimSpace(req.Environment), req.RunID, user)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if deployErr != nil {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"promotion": p, "deploy_error": deployErr.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"promotion": p})
+}
+
+// promote copies the image digest tested in the previous stage to an environment and triggers
+// the environment's deploy app. Without envName, the first stage that does not run the previous
+// stage's digest yet is promoted. runID picks a specific build for the first stage.
+// deployErr reports a deploy run that could not be started after the image was promoted. The
+// user must be able to access the deploy app.
+func (s *Server) promote(ctx context.Context, app config.App, envName string, runID int64, user authUser) (p store.Promotion, deployErr error, err error) {
+	if len(app.Promotion) == 0 {
+		return p, nil, &statusError{Status: http.StatusBadRequest, Msg: "app has no promotion environments"}
+	}
+	idx := -1
+	var source *store.Promotion
+	for i, env := range app.Promotion {
+		if envName != "" && env.Name != envName {
+			continue
+		}
+		if source, err = s.promotionSource(app, i, runID); err != nil {
+			return p, nil, err
+		}
+		if envName != "" {
+			idx = i
+			break
+		}
+		if source == nil {
+			break
+		}
+		current, err := s.store.LatestPromotion(app.ID, env.Name)
+		if err != nil {
+			return p, nil, err
+		}
+		if current == nil || current.Digest != source.Digest {
+			idx = i
+			break
+		}
+	}
+	if envName != "" && idx < 0 {
+		return p, nil, &statusError{Status: http.StatusNotFound, Msg: "promotion environment not found"}
+	}
+	if source == nil {
+		return p, nil, &statusError{Status: http.StatusConflict, Msg: "nothing to promote: no image recorded for the previous stage"}
+	}
+	if idx < 0 {
+		return p, nil, &statusError{Status: http.StatusConflict, Msg: "all environments already run the latest image"}
+	}
+	env := app.Promotion[idx]
+
+	var deployApp config.App
+	if env.DeployApp != "" {
+		var ok bool
+		if deployApp, ok = s.findApp(env.DeployApp); !ok {
+			return p, nil, &statusError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("deploy app %q of environment %s not found", env.DeployApp, env.Name)}
+		}
+		denied, err := s.inaccessibleApp(user, []string{env.DeployApp})
+		if err != nil {
+			return p, nil, err
+		}
+		if denied != "" {
+			return p, nil, &statusError{Status: http.StatusForbidden, Msg: fmt.Sprintf("user has no access to deploy app %s of environment %s", env.DeployApp, env.Name)}
+		}
+	}
+
+	src := source.TargetImage + "@" + source.Digest
+	dst := env.Image + ":" + promotionTag(env)
+	ctx, cancel := context.WithTimeout(ctx, promoteTimeout)
+	defer cancel()
+	digest, err := copyImage(ctx, src, dst)
+	if err != nil {
+		return p, nil, &statusError{Status: http.StatusBadGateway, Msg: err.Error()}
+	}
+	if digest != source.Digest {
+		return p, nil, &statusError{Status: http.StatusBadGateway, Msg: fmt.Sprintf("%s resolves to %s after copy, expected %s", dst, digest, source.Digest)}
+	}
+
+	p = store.Promotion{
+		AppID:       app.ID,
+		Environment: env.Name,
+		SourceImage: source.TargetImage,
+		TargetImage: env.Image,
+		Digest:      source.Digest,
+		SourceRunID: source.SourceRunID,
+		PromotedBy:  user.Username,
+	}
+	if env.DeployApp != "" {
+		p.DeployRunID, deployErr = s.startRun(deployApp, user.Username, map[string]string{
+			"NOPPFLOW_IMAGE":         env.Image + "@" + source.Digest,
+			"NOPPFLOW_IMAGE_TAG":     dst,
+			"NOPPFLOW_IMAGE_DIGEST":  source.Digest,
+			"NOPPFLOW_PROMOTION_ENV": env.Name,
+			"NOPPFLOW_PROMOTED_FROM": src,
+		})
+	}
+	if p.ID, err = s.store.CreatePromotion(p); err != nil {
+		return p, deployErr, err
+	}
+	go s.notify(app, notification{Event: "app.promoted", RunID: p.DeployRunID, Message: fmt.Sprintf("%s promoted to %s as %s", src, env.Name, dst)})
+	return p, deployErr, nil
+}
+
+// promotionSource returns what stage idx is promoted from, as a pseudo promotion whose TargetImage
+// and Digest name the source: the previous stage's latest promotion, or for the first stage the
+// image of run runID (or of the latest successful build when runID is 0). It returns nil when
+// the previous stage has nothing.
+func (s *Server) promotionSource(app config.App, idx int, runID int64) (*store.Promotion, error) {
+	if idx > 0 {
+		return s.store.LatestPromotion(app.ID, app.Promotion[idx-1].Name)
+	}
+	var img *store.RunImage
+	var err error
+	if runID > 0 {
+		run, err := s.store.GetRun(runID)
+		if err != nil || run == nil || run.AppID != app.ID || run.Status != "success" || run.DeletedAt != nil {
+			return nil, err
+		}
+		img, err = s.store.GetRunImage(runID)
+		if err != nil {
+			return nil, err
+		}
+	} else if img, err = s.store.LatestRunImage(app.ID); err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, nil
+	}
+	return &store.Promotion{TargetImage: img.Image, Digest: img.Digest, SourceRunID: img.RunID}, nil
+}
+
+func (s *Server) listPromotions(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	list, err := s.store.ListPromotions(appID, 100)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+var digestParamPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// recordRunDigests stores the image digests a successful run built or deployed (see
+// pipeline.ParseImageDigests). A built tag that pointed to another digest before is recorded
+// with that digest as replaced, since deploys by tag no longer get what was tested.
+func (s *Server) recordRunDigests(runID int64, app config.App, runLog string) {
+	deploySteps := make(map[string]bool)
+	post := app.EffectivePost()
+	for _, steps := range [][]config.Step{app.EffectiveSteps(), post.OnSuccess, post.OnFailure, post.Always} {
+		for _, step := range steps {
+			if step.IsDeploy() {
+				deploySteps[step.Name] = true
+			}
+		}
+	}
+	found := pipeline.ParseImageDigests(runLog, deploySteps)
+	if len(found) == 0 {
+		return
+	}
+	records := make([]store.RunDigest, 0, len(found))
+	for _, d := range found {
+		rec := store.RunDigest{RunID: runID, AppID: app.ID, Kind: d.Kind, Image: d.Image, Tag: d.Tag, Digest: d.Digest, Step: d.Step, Environment: app.Environment}
+		if d.Kind == pipeline.DigestBuilt && d.Tag != "" {
+			previous, err := s.store.LatestTagDigest(d.Image, d.Tag)
+			if err != nil {
+				log.Printf("run %d: look up %s:%s: %v", runID, d.Image, d.Tag, err)
+			} else if previous != "" && previous != d.Digest {
+				rec.ReplacedDigest = previous
+				log.Printf("run %d: tag %s:%s moved from %s to %s", runID, d.Image, d.Tag, previous, d.Digest)
+			}
+		}
+		records = append(records, rec)
+	}
+	if err := s.store.AddRunDigests(records); err != nil {
+		log.Printf("run %d: record image digests: %v", runID, err)
+	}
+}
+
+// listRunDigests returns the image digests a run built or deployed.
+func (s *Server) listRunDigests(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	list, err := s.store.ListRunDigests(run.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// provenanceAppIDs returns the apps whose provenance records the user may see (nil = all).
+func (s *Server) provenanceAppIDs(user authUser) ([]string, error) {
+	if user.IsAdmin {
+		return nil, nil
+	}
+	_, appIDs, err := s.allowedAppIDsForUser(user.ID)
+	if appIDs == nil {
+		appIDs = []string{}
+	}
+	return appIDs, err
+}
+
+// getDigestProvenance serves GET /api/digests/{digest}: the runs that built or deployed the
+// digest, its promotions, and where it is deployed now, among the apps the user can access.
+func (s *Server) getDigestProvenance(w http.ResponseWriter, r *http.Request) {
+	digest := chi.URLParam(r, "digest")
+	if !digestParamPattern.MatchString(digest) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "digest must be sha256:<64 hex digits>"})
+		return
+	}
+	appIDs, err := s.provenanceAppIDs(authUserFromContext(r))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	records, err := s.store.ListDigestRecords(digest, appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	promotions, err := s.store.PromotionsByDigest(digest, appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	current, err := s.store.CurrentDeployments(appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	deployedIn := make([]store.RunDigest, 0)
+	for _, d := range current {
+		if d.Digest == digest {
+			deployedIn = append(deployedIn, d)
+		}
+	}
+	if len(records) == 0 && len(promotions) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "digest not recorded"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"digest":      digest,
+		"records":     records,
+		"promotions":  promotions,
+		"deployed_in": deployedIn,
+	})
+}
+
+// listDeployments serves GET /api/deployments: the digest each app last deployed per
+// environment and image, optionally for one app (app_id).
+func (s *Server) listDeployments(w http.ResponseWriter, r *http.Request) {
+	appIDs, err := s.provenanceAppIDs(authUserFromContext(r))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	current, err := s.store.CurrentDeployments(appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if appID := strings.TrimSpace(r.URL.Query().Get("app_id")); appID != "" {
+		filtered := make([]store.RunDigest, 0)
+		for _, d := range current {
+			if d.AppID == appID {
+				filtered = append(filtered, d)
+			}
+		}
+		current = filtered
+	}
+	writeJSON(w, http.StatusOK, current)
+}
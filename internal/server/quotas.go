@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"noppflow/internal/store"
+)
+
+// quotaError describes why a run trigger was rejected by a quota.
+type quotaError struct {
+	Reason string
+	Msg    string
+}
+
+func (e *quotaError) Error() string { return e.Msg }
+
+func (s *Server) listQuotas(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	quotas, err := s.store.ListQuotas()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, quotas)
+}
+
+func (s *Server) setQuota(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	var q store.Quota
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	q.Scope = strings.TrimSpace(strings.ToLower(q.Scope))
+	q.ScopeID = strings.TrimSpace(q.ScopeID)
+	switch q.Scope {
+	case store.QuotaScopeApp:
+		if !s.appExists(q.ScopeID) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "app not found"})
+			return
+		}
+	case store.QuotaScopeGroup:
+		groupID, err := strconv.ParseInt(q.ScopeID, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid group id"})
+			return
+		}
+		group, err := s.store.GetGroup(groupID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if group == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "group not found"})
+			return
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "scope must be app or group"})
+		return
+	}
+	if q.MaxRunsPerDay < 0 || q.MaxRunDurationSec < 0 || q.MaxConcurrentRuns < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "quota limits must be >= 0 (0 means unlimited)"})
+		return
+	}
+	id, err := s.store.SetQuota(q)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	q.ID = id
+	writeJSON(w, http.StatusOK, q)
+}
+
+func (s *Server) deleteQuota(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "quotaID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid quota id"})
+		return
+	}
+	if err := s.store.DeleteQuota(id); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "quota not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkRunQuotas verifies the app and group quotas that apply to appID.
+// It returns a *quotaError when a new run would exceed a limit, and otherwise
+// the smallest configured max run duration (0 when none is set).
+func (s *Server) checkRunQuotas(appID string) (time.Duration, error) {
+	quotas, err := s.store.ListQuotas()
+	if err != nil {
+		return 0, err
+	}
+	if len(quotas) == 0 {
+		return 0, nil
+	}
+	groupIDs, err := s.store.AppGroupIDs(appID)
+	if err != nil {
+		return 0, err
+	}
+	appGroups := make(map[string]struct{}, len(groupIDs))
+	for _, id := range groupIDs {
+		appGroups[strconv.FormatInt(id, 10)] = struct{}{}
+	}
+
+	var maxDuration time.Duration
+	for _, q := range quotas {
+		var scopeAppIDs []string
+		label := ""
+		switch q.Scope {
+		case store.QuotaScopeApp:
+			if q.ScopeID != appID {
+				continue
+			}
+			scopeAppIDs = []string{appID}
+			label = "app " + appID
+		case store.QuotaScopeGroup:
+			if _, ok := appGroups[q.ScopeID]; !ok {
+				continue
+			}
+			groupID, _ := strconv.ParseInt(q.ScopeID, 10, 64)
+			scopeAppIDs, err = s.store.GroupAppIDs(groupID)
+			if err != nil {
+				return 0, err
+			}
+			label = "group " + q.ScopeID
+		default:
+			continue
+		}
+
+		if q.MaxConcurrentRuns > 0 {
+			active, err := s.store.CountActiveRuns(scopeAppIDs)
+			if err != nil {
+				return 0, err
+			}
+			if active >= int64(q.MaxConcurrentRuns) {
+				return 0, &quotaError{
+					Reason: "max_concurrent_runs",
+					Msg:    fmt.Sprintf("quota exceeded: %s already has %d active runs (max_concurrent_runs=%d)", label, active, q.MaxConcurrentRuns),
+				}
+			}
+		}
+		if q.MaxRunsPerDay > 0 {
+			count, err := s.store.CountRunsSince(scopeAppIDs, 24*time.Hour)
+			if err != nil {
+				return 0, err
+			}
+			if count >= int64(q.MaxRunsPerDay) {
+				return 0, &quotaError{
+					Reason: "max_runs_per_day",
+					Msg:    fmt.Sprintf("quota exceeded: %s already has %d runs in the last 24h (max_runs_per_day=%d)", label, count, q.MaxRunsPerDay),
+				}
+			}
+		}
+		if q.MaxRunDurationSec > 0 {
+			d := time.Duration(q.MaxRunDurationSec) * time.Second
+			if maxDuration == 0 || d < maxDuration {
+				maxDuration = d
+			}
+		}
+	}
+	return maxDuration, nil
+}
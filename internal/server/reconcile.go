@@ -0,0 +1,223 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"noppflow/internal/store"
+)
+
+// k8sManagedResource is a Job or Secret created for a run (see k8sRunLabelsYAML).
+type k8sManagedResource struct {
+	Kind  string // "job" or "secret"
+	Name  string
+	RunID int64
+}
+
+// listK8sManagedResources lists the Jobs and Secrets NoppFlow created in a namespace (a var for tests).
+var listK8sManagedResources = func(namespace string) ([]k8sManagedResource, error) {
+	out, err := kubectlOutput("-n", namespace, "get", "jobs,secrets", "-l", k8sManagedBySelector, "-o",
+		`jsonpath={range .items[*]}{.kind}{" "}{.metadata.name}{" "}{.metadata.labels.noppflow\.io/run-id}{"\n"}{end}`)
+	if err != nil {
+		return nil, err
+	}
+	return parseK8sManagedResources(out), nil
+}
+
+// deleteK8sResource deletes a Job (with its pods) or Secret (a var for tests).
+var deleteK8sResource = kubectlDeleteResource
+
+func parseK8sManagedResources(out string) []k8sManagedResource {
+	var res []k8sManagedResource
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		runID, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		res = append(res, k8sManagedResource{Kind: strings.ToLower(fields[0]), Name: fields[1], RunID: runID})
+	}
+	return res
+}
+
+// trackRun marks a run as owned by this process until untrackRun; runs that are unfinished in the
+// database but not tracked were lost (e.g. the server crashed mid-run).
+func (s *Server) trackRun(runID int64) {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	s.activeRuns[runID] = struct{}{}
+}
+
+func (s *Server) untrackRun(runID int64) {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	delete(s.activeRuns, runID)
+}
+
+func (s *Server) runTracked(runID int64) bool {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	_, ok := s.activeRuns[runID]
+	return ok
+}
+
+// SetRequeueInterrupted makes StartOrphanReconciler start a new run, with the same trigger and
+// run env, for each run it interrupts at startup.
+func (s *Server) SetRequeueInterrupted(requeue bool) {
+	s.requeueInterrupted = requeue
+}
+
+// StartOrphanReconciler marks runs left pending or running by a previous server process as
+// interrupted, then every interval deletes Kubernetes Jobs and Secrets of runs this process is not
+// running (interrupting those runs too). It returns immediately; interval <= 0 only does the first pass.
+func (s *Server) StartOrphanReconciler(interval time.Duration) {
+	s.interruptOrphanedRuns()
+	go func() {
+		s.reconcileK8sOrphans()
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.reconcileK8sOrphans()
+		}
+	}()
+}
+
+// interruptOrphanedRuns marks unfinished runs that this process does not run as interrupted, and
+// requeues them when SetRequeueInterrupted is on. Runs with a recent heartbeat are skipped.
+func (s *Server) interruptOrphanedRuns() {
+	runs, err := s.store.UnfinishedRuns()
+	if err != nil {
+		log.Printf("reconcile: list unfinished runs: %v", err)
+		return
+	}
+	live := s.liveRunIDs()
+	for _, run := range runs {
+		if live[run.ID] {
+			log.Printf("reconcile: run %d has a recent heartbeat, another server process may be running it; leaving it to the heartbeat watchdog", run.ID)
+			continue
+		}
+		if !s.runTracked(run.ID) && s.interruptRun(run, "run was "+run.Status+" when the server stopped") && s.requeueInterrupted {
+			s.requeueRun(run)
+		}
+	}
+}
+
+// requeueRun starts a new run of an interrupted run's app with its trigger and run env.
+func (s *Server) requeueRun(run store.Run) {
+	app, found := s.findApp(run.AppID)
+	if !found {
+		return
+	}
+	vars, err := s.store.ListRunEnv(run.ID)
+	if err != nil {
+		log.Printf("reconcile: requeue run %d: %v", run.ID, err)
+		return
+	}
+	runEnv := make(map[string]string, len(vars))
+	for _, v := range vars {
+		runEnv[v.Name] = v.Value
+	}
+	newID, err := s.startRun(app, run.TriggeredBy, runEnv)
+	if err != nil {
+		log.Printf("reconcile: requeue run %d: %v", run.ID, err)
+		return
+	}
+	log.Printf("reconcile: interrupted run %d requeued as run %d", run.ID, newID)
+}
+
+// interruptRun marks run interrupted and reports whether it was still unfinished.
+func (s *Server) interruptRun(run store.Run, reason string) bool {
+	ok, err := s.store.MarkRunInterrupted(run.ID)
+	if err != nil {
+		log.Printf("reconcile: interrupt run %d: %v", run.ID, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := s.store.ExpirePendingApprovals(run.ID); err != nil {
+		log.Printf("reconcile: expire approvals of run %d: %v", run.ID, err)
+	}
+	if app, found := s.findApp(run.AppID); found {
+		go s.notify(app, notification{Event: "run.interrupted", RunID: run.ID, Message: reason})
+	} else {
+		log.Printf("reconcile: run %d interrupted: %s", run.ID, reason)
+	}
+	return true
+}
+
+// k8sNamespaces returns the namespaces of apps that run as Kubernetes Jobs.
+func (s *Server) k8sNamespaces() []string {
+	s.appsMu.RLock()
+	defer s.appsMu.RUnlock()
+	seen := map[string]bool{}
+	var out []string
+	for _, app := range s.apps {
+		ns := strings.TrimSpace(app.K8sNamespace)
+		if ns != "" && !seen[ns] && appUsesK8sJob(app) {
+			seen[ns] = true
+			out = append(out, ns)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// reconcileK8sOrphans deletes Jobs and Secrets whose runs this process is not running, no
+// other replica reports alive, and no debug hold keeps (on the leader only when leader election
+// is on). Expired debug holds are dropped.
+func (s *Server) reconcileK8sOrphans() {
+	if !s.isLeader() {
+		return
+	}
+	if err := s.store.DeleteExpiredK8sDebugHolds(time.Now()); err != nil {
+		log.Printf("reconcile: delete expired debug holds: %v", err)
+	}
+	namespaces := s.k8sNamespaces()
+	if len(namespaces) == 0 {
+		return
+	}
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return
+	}
+	for _, ns := range namespaces {
+		resources, err := listK8sManagedResources(ns)
+		if err != nil {
+			log.Printf("reconcile: list k8s resources in %s: %v", ns, err)
+			continue
+		}
+		s.cleanupK8sOrphans(ns, resources)
+	}
+}
+
+func (s *Server) cleanupK8sOrphans(namespace string, resources []k8sManagedResource) {
+	live := s.liveRunIDs()
+	for _, res := range resources {
+		if s.runTracked(res.RunID) || live[res.RunID] || s.k8sDebugPodHeld(res.RunID) {
+			continue
+		}
+		if err := deleteK8sResource(namespace, res.Kind, res.Name); err != nil {
+			log.Printf("reconcile: delete orphaned %s %s/%s: %v", res.Kind, namespace, res.Name, err)
+			continue
+		}
+		log.Printf("reconcile: deleted orphaned %s %s/%s of run %d", res.Kind, namespace, res.Name, res.RunID)
+		run, err := s.store.GetRun(res.RunID)
+		if err != nil || run == nil {
+			continue
+		}
+		if run.Status == "pending" || run.Status == "running" {
+			s.interruptRun(*run, fmt.Sprintf("orphaned Kubernetes %s %s/%s was deleted", res.Kind, namespace, res.Name))
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+// dockerHubAuthKey is the key Docker uses for Docker Hub credentials in config.json.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// normalizeRegistryURL returns the registry host (with optional port) used as config.json key,
+// accepting forms like "https://ghcr.io/", "ghcr.io" or "docker.io".
+func normalizeRegistryURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	invalid := fmt.Errorf("invalid registry url %q (want a host like ghcr.io or registry.example.com:5000)", strings.TrimPrefix(raw, "https://"))
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", invalid
+	}
+	switch u.Host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return dockerHubAuthKey, nil
+	}
+	if strings.Trim(u.Path, "/") != "" {
+		return "", invalid
+	}
+	return u.Host, nil
+}
+
+// dockerConfigJSON builds a Docker config.json holding credentials for regs. Docker, Helm (OCI),
+// crane, skopeo and podman all read this format.
+func dockerConfigJSON(regs []store.Registry) (string, error) {
+	type authEntry struct {
+		Auth string `json:"auth"`
+	}
+	auths := make(map[string]authEntry, len(regs))
+	for _, reg := range regs {
+		auths[reg.URL] = authEntry{Auth: base64.StdEncoding.EncodeToString([]byte(reg.Username + ":" + reg.Token))}
+	}
+	data, err := json.Marshal(map[string]interface{}{"auths": auths})
+	return string(data), err
+}
+
+// appRegistries loads the registries an app logs in to. It fails when one no longer exists.
+func (s *Server) appRegistries(app config.App) ([]store.Registry, error) {
+	regs := make([]store.Registry, 0, len(app.Registries))
+	for _, name := range app.Registries {
+		reg, err := s.store.GetRegistryByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if reg == nil {
+			return nil, &statusError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("configured registry %q not found", name)}
+		}
+		regs = append(regs, *reg)
+	}
+	return regs, nil
+}
+
+// registryLoginEnv returns the env vars that point docker, helm, and podman-style tools at dir/config.json.
+func registryLoginEnv(dir string) map[string]string {
+	file := filepath.Join(dir, "config.json")
+	return map[string]string{
+		"DOCKER_CONFIG":        dir,
+		"HELM_REGISTRY_CONFIG": file,
+		"REGISTRY_AUTH_FILE":   file,
+	}
+}
+
+// applyRegistryLogin writes dockerConfig for a local run and points the step env at it.
+// It does nothing when the app uses no registries; the returned cleanup is always safe to call.
+func applyRegistryLogin(dockerConfig string, stepEnv, envSources map[string]string) (func(), error) {
+	if dockerConfig == "" {
+		return func() {}, nil
+	}
+	dir, cleanup, err := writeTempDockerConfig(dockerConfig)
+	if err != nil {
+		return cleanup, err
+	}
+	for name, value := range registryLoginEnv(dir) {
+		stepEnv[name] = value
+		envSources[name] = "registries"
+	}
+	return cleanup, nil
+}
+
+// writeTempDockerConfig writes config.json into a private temp directory for one local run.
+func writeTempDockerConfig(configJSON string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "noppflow-registry-*")
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(configJSON), 0600); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return dir, cleanup, nil
+}
+
+// validateAppRegistries trims and de-duplicates app registry names and checks that they exist.
+func (s *Server) validateAppRegistries(app *config.App) error {
+	names := make([]string, 0, len(app.Registries))
+	seen := map[string]bool{}
+	for _, raw := range app.Registries {
+		name := strings.TrimSpace(raw)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		reg, err := s.store.GetRegistryByName(name)
+		if err != nil {
+			return err
+		}
+		if reg == nil {
+			return fmt.Errorf("registry %q not found", name)
+		}
+		names = append(names, name)
+	}
+	app.Registries = nil
+	if len(names) > 0 {
+		app.Registries = names
+	}
+	return nil
+}
+
+type registryRequest struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+func (s *Server) listRegistries(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	regs, err := s.store.ListRegistries()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, regs)
+}
+
+func (s *Server) createRegistry(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	var body registryRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	reg := store.Registry{Name: strings.TrimSpace(body.Name), Username: strings.TrimSpace(body.Username), Token: strings.TrimSpace(body.Token)}
+	if reg.Name == "" || reg.Username == "" || reg.Token == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name, url, username and token are required"})
+		return
+	}
+	var err error
+	if reg.URL, err = normalizeRegistryURL(body.URL); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	reg.ID, err = s.store.CreateRegistry(reg)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, reg)
+}
+
+// updateRegistry changes URL, username, and token (an empty token keeps the current one).
+func (s *Server) updateRegistry(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	reg, ok := s.registryFromURL(w, r)
+	if !ok {
+		return
+	}
+	var body registryRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if strings.TrimSpace(body.URL) != "" {
+		u, err := normalizeRegistryURL(body.URL)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		reg.URL = u
+	}
+	if username := strings.TrimSpace(body.Username); username != "" {
+		reg.Username = username
+	}
+	if token := strings.TrimSpace(body.Token); token != "" {
+		reg.Token = token
+	}
+	if err := s.store.UpdateRegistry(*reg); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, reg)
+}
+
+func (s *Server) deleteRegistry(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	reg, ok := s.registryFromURL(w, r)
+	if !ok {
+		return
+	}
+	s.appsMu.RLock()
+	for _, app := range s.apps {
+		for _, name := range app.Registries {
+			if name == reg.Name {
+				s.appsMu.RUnlock()
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "registry is in use by an app"})
+				return
+			}
+		}
+	}
+	s.appsMu.RUnlock()
+	if err := s.store.DeleteRegistry(reg.ID); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "registry not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) registryFromURL(w http.ResponseWriter, r *http.Request) (*store.Registry, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "registryID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid registry id"})
+		return nil, false
+	}
+	reg, err := s.store.GetRegistry(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if reg == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "registry not found"})
+		return nil, false
+	}
+	return reg, true
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+const (
+	maxReleaseVersionLen   = 100
+	maxReleaseChangelogLen = 64 << 10
+	maxReleaseRuns         = 200
+)
+
+// releaseRequest is the body of POST /api/releases and PUT /api/releases/{releaseID}.
+type releaseRequest struct {
+	Version     string  `json:"version"`
+	Environment string  `json:"environment"`
+	Changelog   string  `json:"changelog"`
+	RunIDs      []int64 `json:"run_ids"`
+}
+
+// releaseTimelineEvent is an event of GET /api/releases/{releaseID}/timeline.
+type releaseTimelineEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	RunID      int64     `json:"run_id,omitempty"`
+	AppID      string    `json:"app_id,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// userCanAccessRelease reports whether u may see a release: admins always, others when they can
+// access the apps of all its runs.
+func (s *Server) userCanAccessRelease(u authUser, rel store.Release) (bool, error) {
+	if u.IsAdmin {
+		return true, nil
+	}
+	allowed, _, err := s.allowedAppIDsForUser(u.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, run := range rel.Runs {
+		if _, ok := allowed[run.AppID]; !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// accessibleRelease resolves the {releaseID} URL parameter to a release the user may see,
+// writing an error response when there is none.
+func (s *Server) accessibleRelease(w http.ResponseWriter, r *http.Request) (*store.Release, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "releaseID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid release id"})
+		return nil, false
+	}
+	rel, err := s.store.GetRelease(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if rel == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "release not found"})
+		return nil, false
+	}
+	ok, err := s.userCanAccessRelease(authUserFromContext(r), *rel)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if !ok {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to all runs of this release"})
+		return nil, false
+	}
+	return rel, true
+}
+
+// listReleases returns the releases the user may see, newest first (?environment=&limit=&offset=).
+// Limit and offset count all releases, so a page can hold fewer for users with limited access.
+func (s *Server) listReleases(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	releases, err := s.store.ListReleases(strings.TrimSpace(q.Get("environment")), limit, offset)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	user := authUserFromContext(r)
+	out := make([]store.Release, 0, len(releases))
+	for _, rel := range releases {
+		ok, err := s.userCanAccessRelease(user, rel)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if ok {
+			out = append(out, rel)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// getRelease returns a release with its runs.
+func (s *Server) getRelease(w http.ResponseWriter, r *http.Request) {
+	rel, ok := s.accessibleRelease(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, rel)
+}
+
+// createRelease records a release linking runs the user can access.
+func (s *Server) createRelease(w http.ResponseWriter, r *http.Request) {
+	user := authUserFromContext(r)
+	rel, runIDs, ok := s.decodeRelease(w, r, 0)
+	if !ok {
+		return
+	}
+	rel.CreatedBy = user.Username
+	id, err := s.store.CreateRelease(rel, runIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	created, err := s.store.GetRelease(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// updateRelease replaces the version, environment, changelog, and runs of a release (admin or
+// the user who created it).
+func (s *Server) updateRelease(w http.ResponseWriter, r *http.Request) {
+	existing, ok := s.modifiableRelease(w, r)
+	if !ok {
+		return
+	}
+	rel, runIDs, ok := s.decodeRelease(w, r, existing.ID)
+	if !ok {
+		return
+	}
+	rel.ID = existing.ID
+	if err := s.store.UpdateRelease(rel, runIDs); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "release not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	updated, err := s.store.GetRelease(rel.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// deleteRelease deletes a release (admin or the user who created it); its runs are kept.
+func (s *Server) deleteRelease(w http.ResponseWriter, r *http.Request) {
+	rel, ok := s.modifiableRelease(w, r)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteRelease(rel.ID); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "release not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// modifiableRelease is accessibleRelease for changes, which only admins and the creator may make.
+func (s *Server) modifiableRelease(w http.ResponseWriter, r *http.Request) (*store.Release, bool) {
+	rel, ok := s.accessibleRelease(w, r)
+	if !ok {
+		return nil, false
+	}
+	if user := authUserFromContext(r); !user.IsAdmin && rel.CreatedBy != user.Username {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only admins and the creator can change a release"})
+		return nil, false
+	}
+	return rel, true
+}
+
+// decodeRelease reads and validates a releaseRequest. The runs must exist and be accessible to
+// the user, and no release other than id may have the same version and environment.
+func (s *Server) decodeRelease(w http.ResponseWriter, r *http.Request, id int64) (store.Release, []int64, bool) {
+	var req releaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return store.Release{}, nil, false
+	}
+	rel := store.Release{
+		Version:     strings.TrimSpace(req.Version),
+		Environment: strings.TrimSpace(req.Environment),
+		Changelog:   strings.TrimSpace(req.Changelog),
+	}
+	if err := validateRelease(rel, len(req.RunIDs)); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return rel, nil, false
+	}
+	runIDs := make([]int64, 0, len(req.RunIDs))
+	seen := make(map[int64]bool, len(req.RunIDs))
+	user := authUserFromContext(r)
+	for _, runID := range req.RunIDs {
+		if seen[runID] {
+			continue
+		}
+		seen[runID] = true
+		run, err := s.store.GetRun(runID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return rel, nil, false
+		}
+		if run == nil || run.DeletedAt != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("run %d not found", runID)})
+			return rel, nil, false
+		}
+		if !user.IsAdmin {
+			ok, err := s.userCanAccessApp(user.ID, run.AppID)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return rel, nil, false
+			}
+			if !ok {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("user has no access to run %d", runID)})
+				return rel, nil, false
+			}
+		}
+		runIDs = append(runIDs, runID)
+	}
+	other, err := s.store.ReleaseIDByVersion(rel.Version, rel.Environment)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return rel, nil, false
+	}
+	if other != 0 && other != id {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("release %s to %s already exists (id %d)", rel.Version, rel.Environment, other)})
+		return rel, nil, false
+	}
+	return rel, runIDs, true
+}
+
+// validateRelease checks the fields of a release and its number of runs.
+func validateRelease(rel store.Release, runs int) error {
+	if rel.Version == "" || len(rel.Version) > maxReleaseVersionLen || strings.IndexFunc(rel.Version, unicode.IsControl) >= 0 {
+		return fmt.Errorf("version is required and must be at most %d characters on one line", maxReleaseVersionLen)
+	}
+	if !config.ValidEnvironmentName(rel.Environment) {
+		return fmt.Errorf("environment must be an environment name (e.g. prod, eu-staging)")
+	}
+	if len(rel.Changelog) > maxReleaseChangelogLen {
+		return fmt.Errorf("changelog must be at most %d KiB", maxReleaseChangelogLen>>10)
+	}
+	if runs > maxReleaseRuns {
+		return fmt.Errorf("a release links at most %d runs", maxReleaseRuns)
+	}
+	return nil
+}
+
+// getReleaseTimeline returns the events of a release ordered by time: created, and the queued
+// and finished events of each of its runs, to show how a release rolled out across apps.
+func (s *Server) getReleaseTimeline(w http.ResponseWriter, r *http.Request) {
+	rel, ok := s.accessibleRelease(w, r)
+	if !ok {
+		return
+	}
+	events := []releaseTimelineEvent{{Time: rel.CreatedAt.UTC(), Event: "release.created", Message: rel.CreatedBy}}
+	for _, run := range rel.Runs {
+		events = append(events, releaseTimelineEvent{Time: run.StartedAt.UTC(), Event: timelineQueued, RunID: run.ID, AppID: run.AppID, Message: run.TriggeredBy})
+		if run.EndedAt != nil {
+			events = append(events, releaseTimelineEvent{
+				Time:       run.EndedAt.UTC(),
+				Event:      timelineFinished,
+				RunID:      run.ID,
+				AppID:      run.AppID,
+				Status:     run.Status,
+				DurationMs: run.EndedAt.Sub(run.StartedAt).Milliseconds(),
+			})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"release_id": rel.ID, "version": rel.Version, "status": rel.Status, "events": events})
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"noppflow/internal/store"
+)
+
+const (
+	maxReportDays = 365
+	// untaggedReportGroup and ungroupedReportGroup collect the apps without a tag or group.
+	untaggedReportGroup  = "(untagged)"
+	ungroupedReportGroup = "(no group)"
+)
+
+// usageReportRow is one line of GET /api/reports: the runs of a set of apps over the period.
+type usageReportRow struct {
+	Group        string   `json:"group"`
+	Apps         []string `json:"apps"`
+	Runs         int64    `json:"runs"`
+	Succeeded    int64    `json:"succeeded"`
+	Failed       int64    `json:"failed"`
+	FailureRate  float64  `json:"failure_rate"`
+	BuildMinutes float64  `json:"build_minutes"`
+	buildSeconds float64
+}
+
+func (row *usageReportRow) add(u store.AppRunUsage) {
+	row.Apps = append(row.Apps, u.AppID)
+	row.Runs += u.Runs
+	row.Succeeded += u.Succeeded
+	row.Failed += u.Failed
+	row.buildSeconds += u.BuildSeconds
+}
+
+// finish derives the failure rate (failed share of succeeded and failed runs) and build minutes.
+func (row *usageReportRow) finish() {
+	if n := row.Succeeded + row.Failed; n > 0 {
+		row.FailureRate = math.Round(float64(row.Failed)/float64(n)*10000) / 10000
+	}
+	row.BuildMinutes = math.Round(row.buildSeconds/60*100) / 100
+	sort.Strings(row.Apps)
+}
+
+// getUsageReport serves GET /api/reports: runs, build minutes (wall-clock time of ended runs),
+// and failure rate over the last ?days= (default 30) of the apps the user can access, grouped
+// by ?group_by=app (default), tag, or group. An app with several tags or groups counts in each,
+// so the rows only add up to the total when grouped by app. ?format=csv returns the rows as CSV.
+func (s *Server) getUsageReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	days := 30
+	if v := q.Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxReportDays {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "days must be between 1 and 365"})
+			return
+		}
+		days = n
+	}
+	groupBy := strings.TrimSpace(q.Get("group_by"))
+	if groupBy == "" {
+		groupBy = "app"
+	}
+	if groupBy != "app" && groupBy != "tag" && groupBy != "group" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "group_by must be app, tag, or group"})
+		return
+	}
+	format := strings.TrimSpace(q.Get("format"))
+	if format != "" && format != "json" && format != "csv" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be json or csv"})
+		return
+	}
+	user := authUserFromContext(r)
+	var appIDs []string
+	if !user.IsAdmin {
+		var err error
+		if _, appIDs, err = s.allowedAppIDsForUser(user.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if appIDs == nil {
+			appIDs = []string{}
+		}
+	}
+	usage, err := s.store.RunUsageByApp(appIDs, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	keys, err := s.reportGroupKeys(groupBy)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	total := usageReportRow{Group: "(total)"}
+	byGroup := make(map[string]*usageReportRow)
+	for _, u := range usage {
+		total.add(u)
+		for _, key := range keys(u.AppID) {
+			row := byGroup[key]
+			if row == nil {
+				row = &usageReportRow{Group: key}
+				byGroup[key] = row
+			}
+			row.add(u)
+		}
+	}
+	rows := make([]usageReportRow, 0, len(byGroup))
+	for _, row := range byGroup {
+		row.finish()
+		rows = append(rows, *row)
+	}
+	total.finish()
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].BuildMinutes != rows[j].BuildMinutes {
+			return rows[i].BuildMinutes > rows[j].BuildMinutes
+		}
+		return rows[i].Group < rows[j].Group
+	})
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="noppflow-report-%s-%dd.csv"`, groupBy, days))
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{groupBy, "apps", "runs", "succeeded", "failed", "failure_rate", "build_minutes"})
+		for _, row := range append(rows, total) {
+			_ = cw.Write([]string{row.Group, strings.Join(row.Apps, " "),
+				strconv.FormatInt(row.Runs, 10), strconv.FormatInt(row.Succeeded, 10), strconv.FormatInt(row.Failed, 10),
+				strconv.FormatFloat(row.FailureRate, 'f', 4, 64), strconv.FormatFloat(row.BuildMinutes, 'f', 2, 64)})
+		}
+		cw.Flush()
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"days": days, "group_by": groupBy, "groups": rows, "total": total})
+}
+
+// reportGroupKeys returns the function mapping an app to the report groups it counts in.
+func (s *Server) reportGroupKeys(groupBy string) (func(appID string) []string, error) {
+	switch groupBy {
+	case "tag":
+		tags, err := s.store.AllAppTags()
+		if err != nil {
+			return nil, err
+		}
+		return func(appID string) []string {
+			if len(tags[appID]) == 0 {
+				return []string{untaggedReportGroup}
+			}
+			return tags[appID]
+		}, nil
+	case "group":
+		groups, err := s.store.ListGroups()
+		if err != nil {
+			return nil, err
+		}
+		groupApps, err := s.store.AllGroupAppIDs()
+		if err != nil {
+			return nil, err
+		}
+		byApp := make(map[string][]string)
+		for _, g := range groups {
+			for _, appID := range groupApps[g.ID] {
+				byApp[appID] = append(byApp[appID], g.Name)
+			}
+		}
+		return func(appID string) []string {
+			if len(byApp[appID]) == 0 {
+				return []string{ungroupedReportGroup}
+			}
+			return byApp[appID]
+		}, nil
+	}
+	return func(appID string) []string { return []string{appID} }, nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"noppflow/internal/pipeline"
+)
+
+// exportRun serves GET /api/runs/{id}/export: a zip of the run for postmortems and support
+// tickets with run.json (the GET /api/runs/{id} details without the log), run.log (ANSI escapes
+// stripped), timeline.json, and the run's artifacts (test reports among them) under artifacts/.
+// Artifacts that cannot be read are listed in export-errors.txt instead of failing the download.
+func (s *Server) exportRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	detail, err := s.runDetailJSON(run, false)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(detail, &meta); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	delete(meta, "log")
+	delete(meta, "chunks")
+	meta["exported_at"] = time.Now().UTC()
+	meta["exported_by"] = authUserFromContext(r).Username
+	events, err := s.runTimeline(run)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	arts, err := s.store.ListRunArtifacts(run.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	dir := fmt.Sprintf("run-%d", run.ID)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, dir))
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+	add := func(name string, body io.Reader) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join(dir, name), Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, body)
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, strings.NewReader(string(b)+"\n"))
+	}
+	if err := addJSON("run.json", meta); err != nil {
+		log.Printf("run %d: export: %v", run.ID, err)
+		return
+	}
+	if err := add("run.log", strings.NewReader(pipeline.StripANSI(run.Log))); err != nil {
+		log.Printf("run %d: export: %v", run.ID, err)
+		return
+	}
+	if err := addJSON("timeline.json", map[string]interface{}{"run_id": run.ID, "status": run.Status, "events": events}); err != nil {
+		log.Printf("run %d: export: %v", run.ID, err)
+		return
+	}
+	var problems []string
+	for _, a := range arts {
+		name := path.Join("artifacts", strings.TrimPrefix(path.Clean("/"+a.Name), "/"))
+		if s.artifacts == nil {
+			problems = append(problems, a.Name+": no artifact store configured")
+			continue
+		}
+		body, err := s.artifacts.Get(r.Context(), a.StorageKey)
+		if err != nil {
+			problems = append(problems, a.Name+": "+err.Error())
+			continue
+		}
+		err = add(name, body)
+		body.Close()
+		if err != nil {
+			log.Printf("run %d: export artifact %s: %v", run.ID, a.Name, err)
+			return
+		}
+	}
+	if len(problems) > 0 {
+		_ = add("export-errors.txt", strings.NewReader(strings.Join(problems, "\n")+"\n"))
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+)
+
+// listRunsByCommit serves GET /api/runs?group_by=commit : runs grouped by app and commit, so
+// retries and repeated triggers of one commit are a single row with an aggregate status. The
+// app_id and tag filters and the user's allowed apps apply as for the plain run list; limit and
+// offset count groups.
+func (s *Server) listRunsByCommit(w http.ResponseWriter, user authUser, appID string, tags []string, limit, offset int) {
+	var appIDs []string
+	if len(tags) > 0 {
+		ids, err := s.store.AppIDsWithTags(tags)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		appIDs = ids
+	}
+	var allowed map[string]struct{}
+	if !user.IsAdmin {
+		var allowedList []string
+		var err error
+		allowed, allowedList, err = s.allowedAppIDsForUser(user.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if appID != "" {
+			if _, ok := allowed[appID]; !ok {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to this app"})
+				return
+			}
+		}
+		if appIDs == nil {
+			appIDs = allowedList
+		}
+	}
+	if appID != "" && appIDs == nil {
+		appIDs = []string{appID}
+	}
+	if appIDs != nil {
+		filtered := make([]string, 0, len(appIDs))
+		for _, id := range appIDs {
+			if appID != "" && id != appID {
+				continue
+			}
+			if allowed != nil {
+				if _, ok := allowed[id]; !ok {
+					continue
+				}
+			}
+			filtered = append(filtered, id)
+		}
+		appIDs = filtered
+	}
+	groups, err := s.store.ListCommitGroups(appIDs, limit, offset)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	total, err := s.store.CountCommitGroups(appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groups": groups, "total": total})
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const maxPinNoteLen = 500
+
+// pinRun pins a run (e.g. the one that shipped a major release) so that it is never deleted or
+// purged, with an optional note. Users who can see the run may pin it.
+func (s *Server) pinRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	if run.DeletedAt != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "deleted runs cannot be pinned; restore it first"})
+		return
+	}
+	var req struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if len(req.Note) > maxPinNoteLen {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "note must be at most 500 characters"})
+		return
+	}
+	if err := s.store.PinRun(run.ID, authUserFromContext(r).Username, req.Note); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	run, err := s.store.GetRun(run.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	run.Log = ""
+	writeJSON(w, http.StatusOK, run)
+}
+
+// unpinRun removes the pin of a run, making it subject to deletion and retention again.
+func (s *Server) unpinRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	if err := s.store.UnpinRun(run.ID); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run is not pinned"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listPinnedRuns serves GET /api/runs?pinned=true: pinned runs of the apps the user can access,
+// optionally of one app, most recently started first.
+func (s *Server) listPinnedRuns(w http.ResponseWriter, user authUser, appID string, limit, offset int) {
+	var appIDs []string
+	if appID != "" {
+		appIDs = []string{appID}
+	}
+	if !user.IsAdmin {
+		allowed, allowedList, err := s.allowedAppIDsForUser(user.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if appID != "" {
+			if _, ok := allowed[appID]; !ok {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to this app"})
+				return
+			}
+		} else {
+			appIDs = append([]string{}, allowedList...)
+		}
+	}
+	runs, err := s.store.ListPinnedRuns(appIDs, limit, offset)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	total, err := s.store.CountPinnedRuns(appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs, "total": total})
+}
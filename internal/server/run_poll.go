@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"noppflow/internal/store"
+)
+
+const (
+	// maxRunWait caps the ?wait= long-poll of the run endpoints.
+	maxRunWait = 60 * time.Second
+	// runWaitInterval is how often a long-poll re-reads the run.
+	runWaitInterval = time.Second
+)
+
+// runWait parses ?wait= (seconds, capped at maxRunWait). It writes a 400 and returns false when
+// the value is not a non-negative integer.
+func runWait(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	raw := r.URL.Query().Get("wait")
+	if raw == "" {
+		return 0, true
+	}
+	sec, err := strconv.Atoi(raw)
+	if err != nil || sec < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "wait must be a number of seconds"})
+		return 0, false
+	}
+	if d := time.Duration(sec) * time.Second; d < maxRunWait {
+		return d, true
+	}
+	return maxRunWait, true
+}
+
+// bodyETag is the strong entity tag of a response body.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header names etag (or is "*").
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveRunPoll writes the body render returns for run with an ETag, or 304 Not Modified when the
+// request's If-None-Match still matches. With ?wait= and a matching ETag it re-reads the run every
+// runWaitInterval and answers as soon as the body changes, or with 304 when the wait is over, so
+// polling clients do not download an unchanged run (and its log) again.
+func (s *Server) serveRunPoll(w http.ResponseWriter, r *http.Request, run *store.Run, contentType string, render func(*store.Run) ([]byte, error)) {
+	wait, ok := runWait(w, r)
+	if !ok {
+		return
+	}
+	body, err := render(run)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	etag := bodyETag(body)
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	notModified := ifNoneMatch != "" && etagMatches(ifNoneMatch, etag)
+	if notModified && wait > 0 {
+		deadline := time.NewTimer(wait)
+		defer deadline.Stop()
+		ticker := time.NewTicker(runWaitInterval)
+		defer ticker.Stop()
+	poll:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-deadline.C:
+				break poll
+			case <-ticker.C:
+			}
+			latest, err := s.store.GetRun(run.ID)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if latest == nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+				return
+			}
+			if body, err = render(latest); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if etag = bodyETag(body); !etagMatches(ifNoneMatch, etag) {
+				notModified = false
+				break poll
+			}
+		}
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// deleteRun soft-deletes a run (admin only): it disappears from listings and from non-admin
+// views, but stays in the database until restored or purged.
+func (s *Server) deleteRun(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid run id"})
+		return
+	}
+	if run, err := s.store.GetRun(id); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	} else if run != nil && run.PinnedAt != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "run is pinned; unpin it before deleting"})
+		return
+	}
+	if err := s.store.SoftDeleteRun(id, user.Username); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreRun undoes a soft delete (admin only).
+func (s *Server) restoreRun(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid run id"})
+		return
+	}
+	if err := s.store.RestoreRun(id); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "deleted run not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	run, err := s.store.GetRun(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// listDeletedRuns serves GET /api/runs?deleted=true for admins.
+func (s *Server) listDeletedRuns(w http.ResponseWriter, limit, offset int) {
+	runs, err := s.store.ListDeletedRuns(limit, offset)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	total, err := s.store.CountDeletedRuns()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs, "total": total})
+}
+
+// StartDeletedRunPurger permanently removes runs soft-deleted more than retention ago,
+// checking every interval (on the leader only when leader election is on). It returns immediately; retention <= 0 disables purging.
+func (s *Server) StartDeletedRunPurger(retention, interval time.Duration) {
+	if retention <= 0 || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if !s.isLeader() {
+				<-ticker.C
+				continue
+			}
+			if keys, err := s.store.PurgeableArtifactKeys(retention); err != nil {
+				log.Printf("list artifacts of deleted runs: %v", err)
+			} else {
+				s.deleteArtifactObjects(keys)
+			}
+			if keys, err := s.store.PurgeableLogKeys(retention); err != nil {
+				log.Printf("list logs of deleted runs: %v", err)
+			} else {
+				s.deleteLogObjects(keys)
+			}
+			if n, err := s.store.PurgeDeletedRuns(retention); err != nil {
+				log.Printf("purge deleted runs: %v", err)
+			} else if n > 0 {
+				log.Printf("purged %d deleted runs older than %s", n, retention)
+			}
+			<-ticker.C
+		}
+	}()
+}
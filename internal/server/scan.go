@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+)
+
+// validateScanStep checks and normalizes a scan step.
+func validateScanStep(step *config.Step) error {
+	sc := step.Scan
+	sc.Tool = strings.ToLower(strings.TrimSpace(sc.Tool))
+	sc.Target = strings.TrimSpace(sc.Target)
+	switch sc.Tool {
+	case "trivy-image":
+		if sc.Target == "" {
+			return fmt.Errorf("step %s: scan target (the image) is required for trivy-image", step.Name)
+		}
+	case "trivy-fs", "govulncheck":
+		if !validRepoRelativePath(sc.Target) {
+			return fmt.Errorf("step %s: scan target must be a relative path inside the repository", step.Name)
+		}
+	default:
+		return fmt.Errorf("step %s: scan tool must be trivy-image, trivy-fs, or govulncheck", step.Name)
+	}
+	sc.FailOn = strings.ToUpper(strings.TrimSpace(sc.FailOn))
+	if sc.FailOn == "" {
+		return nil
+	}
+	for _, severity := range pipeline.ScanSeverities {
+		if sc.FailOn == severity {
+			return nil
+		}
+	}
+	return fmt.Errorf("step %s: scan fail_on must be one of %s", step.Name, strings.Join(pipeline.ScanSeverities, ", "))
+}
+
+// k8sScanCommand returns the shell command of a scan step in a Job script. Job runs print the
+// scanner's table output instead of storing findings; fail_on maps to the scanner's exit code.
+func k8sScanCommand(step config.Step, env k8sEnv) string {
+	sc := step.Scan
+	target := k8sStepEnvValue(sc.Target, env)
+	switch sc.Tool {
+	case "govulncheck":
+		if sc.Target == "" {
+			target = "./..."
+		}
+		// govulncheck exits 3 when called vulnerabilities were found; they count as HIGH.
+		if sc.FailOn == "" || sc.FailOn == "CRITICAL" {
+			return fmt.Sprintf("{ govulncheck %s || [ $? = 3 ]; }", target)
+		}
+		return "govulncheck " + target
+	default:
+		if sc.Target == "" {
+			target = "."
+		}
+		cmd := fmt.Sprintf("trivy %s --quiet", strings.TrimPrefix(sc.Tool, "trivy-"))
+		if sc.FailOn != "" {
+			var severities []string
+			for _, s := range pipeline.ScanSeverities {
+				if len(severities) > 0 || s == sc.FailOn {
+					severities = append(severities, s)
+				}
+			}
+			cmd += " --exit-code 1 --severity " + strings.Join(severities, ",")
+		}
+		return cmd + " " + target
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+const (
+	searchMinQueryLen = 2
+	searchMaxLimit    = 100
+)
+
+// searchResult is one entry of GET /api/search. Type is "app" or "run".
+type searchResult struct {
+	Type  string              `json:"type"`
+	AppID string              `json:"app_id"`
+	Name  string              `json:"name,omitempty"`
+	Run   *store.RunSearchHit `json:"run,omitempty"`
+}
+
+// search serves GET /api/search?q=&logs=true&limit= for the universal search box.
+// It matches app names/IDs, run commit SHAs (prefix) and triggered_by, and run logs when logs=true,
+// limited to apps the user can access. App results come first.
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	user := authUserFromContext(r)
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(q) < searchMinQueryLen {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q must be at least 2 characters"})
+		return
+	}
+	limit := 20
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+	includeLogs := r.URL.Query().Get("logs") == "true"
+
+	var allowed map[string]struct{}
+	var allowedList []string
+	if !user.IsAdmin {
+		var err error
+		allowed, allowedList, err = s.allowedAppIDsForUser(user.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if allowedList == nil {
+			allowedList = []string{}
+		}
+	}
+
+	results := make([]searchResult, 0)
+	lower := strings.ToLower(q)
+	s.appsMu.RLock()
+	for _, a := range s.apps {
+		if a.Archived {
+			continue
+		}
+		if !user.IsAdmin {
+			if _, ok := allowed[a.ID]; !ok {
+				continue
+			}
+		}
+		if strings.Contains(strings.ToLower(a.Name), lower) || strings.Contains(strings.ToLower(a.ID), lower) {
+			results = append(results, searchResult{Type: "app", AppID: a.ID, Name: a.Name})
+		}
+	}
+	s.appsMu.RUnlock()
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	if remaining := limit - len(results); remaining > 0 {
+		hits, err := s.store.SearchRuns(q, allowedList, includeLogs, remaining)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		for i := range hits {
+			hits[i].Snippet = pipeline.StripLogTimestamps(hits[i].Snippet)
+			results = append(results, searchResult{Type: "run", AppID: hits[i].AppID, Run: &hits[i]})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"query": q, "results": results})
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+	"noppflow/internal/secrets"
+)
+
+const (
+	secretResolveTimeout = 30 * time.Second
+	// minMaskedSecretLen is the shortest resolved secret masked in run logs; shorter values would
+	// mask ordinary output.
+	minMaskedSecretLen = 4
+)
+
+// SetSecretProviders lets app and global env vars reference external secrets (see
+// config.LoadSecretProviders). Without providers, env values are used as they are.
+func (s *Server) SetSecretProviders(cfg config.SecretProvidersConfig) {
+	s.secrets = secrets.New(cfg)
+}
+
+// resolveSecretEnv replaces the secret references among the app and global env vars of a run of
+// appID with the secrets, labels their sources with the provider, and keeps the values to mask
+// them in the run's log until forgetRunSecrets.
+func (s *Server) resolveSecretEnv(runID int64, appID string, env, sources map[string]string) error {
+	if s.secrets == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretResolveTimeout)
+	defer cancel()
+	resolved, err := s.secrets.Resolve(ctx, fmt.Sprintf("noppflow-run-%d", runID), appID, env)
+	if err != nil {
+		return err
+	}
+	values := make([]string, 0, len(resolved))
+	for name, value := range resolved {
+		if ref, ok := s.secrets.ParseRef(env[name]); ok {
+			sources[name] += ", " + ref.Scheme
+		}
+		env[name] = value
+		values = append(values, value)
+	}
+	s.maskRunSecrets(runID, values)
+	return nil
+}
+
+// changedSecretRef returns the name of an env var of updated that is a secret reference not
+// already in current, or "" when there is none. References are resolved with the server's
+// identity, so only admins add or change them.
+func changedSecretRef(current, updated map[string]string) string {
+	names := make([]string, 0, len(updated))
+	for name := range updated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := updated[name]; config.IsSecretRef(value) && current[name] != value {
+			return name
+		}
+	}
+	return ""
+}
+
+// maskRunSecrets adds values to the secrets masked in a run's log, line by line.
+func (s *Server) maskRunSecrets(runID int64, values []string) {
+	var masked []string
+	for _, value := range values {
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); len(line) >= minMaskedSecretLen {
+				masked = append(masked, line)
+			}
+		}
+	}
+	if len(masked) == 0 {
+		return
+	}
+	s.runSecretsMu.Lock()
+	s.runSecrets[runID] = append(s.runSecrets[runID], masked...)
+	s.runSecretsMu.Unlock()
+}
+
+// runSecretValues returns the resolved secrets of a run to mask in its log.
+func (s *Server) runSecretValues(runID int64) []string {
+	s.runSecretsMu.Lock()
+	defer s.runSecretsMu.Unlock()
+	return s.runSecrets[runID]
+}
+
+// forgetRunSecrets drops the resolved secrets of a finished run.
+func (s *Server) forgetRunSecrets(runID int64) {
+	s.runSecretsMu.Lock()
+	delete(s.runSecrets, runID)
+	s.runSecretsMu.Unlock()
+}
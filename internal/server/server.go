@@ -9,9 +9,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,9 +23,13 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/graphql-go/graphql"
+	"noppflow/internal/artifacts"
 	"noppflow/internal/auth"
+	"noppflow/internal/cloudcreds"
 	"noppflow/internal/config"
 	"noppflow/internal/pipeline"
+	"noppflow/internal/secrets"
 	"noppflow/internal/store"
 )
 
@@ -42,47 +49,152 @@ type authUser struct {
 	IsAdmin  bool   `json:"is_admin"`
 }
 
-type sessionData struct {
-	User      authUser
-	ExpiresAt time.Time
-}
-
 // Server holds app data, store, runner and session state.
 type Server struct {
 	appsMu    sync.RWMutex
 	apps      []config.App
-	store     *store.Store
+	store     store.Backend
 	runner    *pipeline.Runner
 	appsPath  string
 	staticDir string
-
-	sessionsMu sync.RWMutex
-	sessions   map[string]sessionData
+	artifacts artifacts.Store
+	publicURL string
+
+	logStore     artifacts.Store
+	logKeyPrefix string
+	maxLogBytes  int64
+
+	policies     []config.Policy
+	environments []config.Environment
+
+	startedAt time.Time
+	version   string
+	commit    string
+
+	slackSigningSecret string
+	slackTeamID        string
+
+	ipRulesMu sync.RWMutex
+	ipRules   config.IPRules
+
+	smtpAddr     string
+	smtpFrom     string
+	smtpUsername string
+	smtpPassword string
+
+	// triggerMu serializes quota checks with run creation.
+	triggerMu sync.Mutex
+
+	// activeRuns are the runs this process executes or holds (see trackRun).
+	activeMu   sync.Mutex
+	activeRuns map[int64]struct{}
+	// requeueInterrupted restarts runs interrupted at startup (see SetRequeueInterrupted).
+	requeueInterrupted bool
+	// instanceID identifies this process to the other replicas (see StartLeaderElection).
+	instanceID     string
+	leaderMu       sync.Mutex
+	leaderElection bool
+	leader         bool
+
+	// heartbeatTimeout is how long an unfinished run may go without a heartbeat (see StartRunHeartbeat).
+	heartbeatTimeout time.Duration
+	// demo makes users that are not admins read-only (see SetDemo).
+	demo bool
+	// displayTZ is the timezone of times shown to users (see SetDisplayTimezone).
+	displayTZ *time.Location
+
+	// heldRuns are the runs this process created during maintenance mode (see holdRun).
+	maintenanceMu sync.Mutex
+	heldRuns      []heldRun
+
+	// approvals are the runs waiting for a plan or deploy approval, by run ID (see awaitApproval).
+	approvalsMu sync.Mutex
+	approvals   map[int64]*pendingApproval
+
+	// k8sPreflights are when namespaces last passed the K8s Job preflight, keyed by namespace with
+	// " (debug)" when the exec permission was checked too (see preflightK8sJob).
+	k8sPreflightsMu sync.Mutex
+	k8sPreflights   map[string]time.Time
+
+	// dbLocks serialize db_migrate steps per database (see lockDatabase).
+	dbLocksMu sync.Mutex
+	dbLocks   map[string]chan struct{}
+
+	// corsOrigins are the browser origins allowed to call the API (see SetCORS).
+	corsOrigins     map[string]bool
+	corsCredentials bool
+
+	// graphqlSchema is the schema of /api/graphql, nil while the GraphQL API is off (see SetGraphQL).
+	graphqlSchema *graphql.Schema
+	// trains are the release trains (see SetTrains).
+	trainsMu sync.RWMutex
+	trains   []config.Train
+	// failureRules label failed runs with a failure reason (see SetFailureRules).
+	failureRules []config.FailureRule
+	// hooks are the server-side lifecycle hooks (see SetHooks).
+	hooks []config.Hook
+	// secrets resolves secret references in env vars, nil without providers (see SetSecretProviders).
+	secrets *secrets.Resolver
+	// runSecrets are the secret values resolved, and cloud credentials minted, for unfinished runs,
+	// by run ID; they are masked in the runs' logs (see maskRunSecrets).
+	runSecretsMu sync.Mutex
+	runSecrets   map[int64][]string
+	// cloudBroker mints the cloud credentials of apps' runs, nil when off (see SetCloudBroker).
+	cloudBroker *cloudcreds.Broker
+
+	// staticAssets caches the files of the static dir by path (see loadStaticAsset).
+	staticMu     sync.Mutex
+	staticAssets map[string]*staticAsset
 }
 
 // New builds a Server with the given apps slice, store, runner, and paths.
-func New(apps []config.App, st *store.Store, runner *pipeline.Runner, appsPath, staticDir string) *Server {
+func New(apps []config.App, st store.Backend, runner *pipeline.Runner, appsPath, staticDir string) *Server {
 	return &Server{
-		apps:      apps,
-		store:     st,
-		runner:    runner,
-		appsPath:  appsPath,
-		staticDir: staticDir,
-		sessions:  make(map[string]sessionData),
+		apps:       apps,
+		store:      st,
+		runner:     runner,
+		appsPath:   appsPath,
+		staticDir:  staticDir,
+		startedAt:  time.Now(),
+		instanceID: newInstanceID(),
+		version:    "dev",
+
+		activeRuns:    make(map[int64]struct{}),
+		approvals:     make(map[int64]*pendingApproval),
+		dbLocks:       make(map[string]chan struct{}),
+		k8sPreflights: make(map[string]time.Time),
+		runSecrets:    make(map[int64][]string),
+
+		failureRules: config.DefaultFailureRules(),
 	}
 }
 
+// SetBuildInfo sets the version and commit of the binary reported by GET /api/status.
+func (s *Server) SetBuildInfo(version, commit string) {
+	if version != "" {
+		s.version = version
+	}
+	s.commit = commit
+}
+
 // Handler returns the router for API and static pages.
 func (s *Server) Handler() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(compressResponses())
+	r.Use(s.cors)
 
 	r.Get("/health", s.health)
 	r.Route("/api", func(r chi.Router) {
 		r.Post("/auth/login", s.login)
 		r.Post("/auth/logout", s.logout)
+		r.Post("/users/accept-invite", s.acceptInvite)
 		r.Get("/auth/me", s.me)
+		r.With(s.requireWebhookIP).Post("/webhooks/{appID}", s.receiveWebhook)
+		r.With(s.requireWebhookIP).Post("/triggers/{token}", s.fireTrigger)
+		r.With(s.requireWebhookIP).Post("/slack/command", s.slackCommand)
+		r.Get("/status", s.status)
 
 		r.Group(func(r chi.Router) {
 			r.Use(s.requireAuth)
@@ -91,30 +203,126 @@ func (s *Server) Handler() http.Handler {
 			r.Get("/ssh-keys", s.listSSHKeys)
 			r.Post("/ssh-keys", s.createSSHKey)
 			r.Delete("/ssh-keys/{keyID}", s.deleteSSHKey)
+			r.Put("/ssh-keys/{keyID}/rotate", s.rotateSSHKey)
+			r.Get("/ssh-keys/{keyID}/rotations", s.listSSHKeyRotations)
+			r.Get("/registries", s.listRegistries)
+			r.Post("/registries", s.createRegistry)
+			r.Put("/registries/{registryID}", s.updateRegistry)
+			r.Delete("/registries/{registryID}", s.deleteRegistry)
+			r.Get("/git-providers", s.listGitProviders)
+			r.Post("/git-providers", s.createGitProvider)
+			r.Put("/git-providers/{providerID}", s.updateGitProvider)
+			r.Delete("/git-providers/{providerID}", s.deleteGitProvider)
+			r.Get("/git-providers/{providerID}/repos", s.listProviderRepos)
+			r.Get("/git-providers/{providerID}/branches", s.listProviderBranches)
+			r.Get("/integrations/jira", s.getJiraSettings)
+			r.Put("/integrations/jira", s.setJiraSettings)
+			r.Delete("/integrations/jira", s.deleteJiraSettings)
 			r.Get("/env-vars", s.listEnvVars)
 			r.Post("/env-vars", s.createEnvVar)
 			r.Put("/env-vars/{envVarID}", s.updateEnvVar)
 			r.Delete("/env-vars/{envVarID}", s.deleteEnvVar)
+			r.Get("/maintenance", s.getMaintenance)
+			r.Put("/maintenance", s.setMaintenance)
+			r.Post("/k8s/provision", s.provisionK8sNamespace)
+			r.Get("/environments", s.listEnvironments)
+			r.Get("/freezes", s.listFreezes)
+			r.Post("/freezes", s.createFreeze)
+			r.Delete("/freezes/{freezeID}", s.deleteFreeze)
+			r.Get("/quotas", s.listQuotas)
+			r.Put("/quotas", s.setQuota)
+			r.Delete("/quotas/{quotaID}", s.deleteQuota)
+			r.Get("/log-redaction-rules", s.listLogRedactionRules)
+			r.Post("/log-redaction-rules", s.createLogRedactionRule)
+			r.Delete("/log-redaction-rules/{ruleID}", s.deleteLogRedactionRule)
 			r.Get("/users", s.listUsers)
 			r.Post("/users", s.createUser)
+			r.Post("/users/invite", s.inviteUser)
 			r.Put("/users/{userID}/groups", s.setUserGroups)
 			r.Put("/users/{userID}/password", s.updateUserPassword)
+			r.Put("/users/{userID}/slack", s.setUserSlack)
 			r.Delete("/users/{userID}", s.deleteUser)
 			r.Get("/groups", s.listGroups)
 			r.Post("/groups", s.createGroup)
 			r.Get("/groups/{groupID}", s.getGroup)
 			r.Put("/groups/{groupID}/users", s.setGroupUsers)
 			r.Put("/groups/{groupID}/apps", s.setGroupApps)
+			r.Put("/groups/{groupID}/landing", s.setGroupLanding)
+			r.Get("/permissions/matrix", s.getPermissionMatrix)
 			r.Get("/apps", s.listApps)
+			r.Get("/apps/overview", s.getAppsOverview)
+			r.Get("/graphql", s.graphQL)
+			r.Post("/graphql", s.graphQL)
 			r.Post("/apps", s.createApp)
+			r.Get("/apps/dependency-graph", s.getDependencyGraph)
 			r.Get("/apps/{appID}", s.getApp)
 			r.Put("/apps/{appID}", s.updateApp)
 			r.Delete("/apps/{appID}", s.deleteApp)
+			r.Post("/apps/{appID}/archive", s.archiveApp)
+			r.Post("/apps/{appID}/unarchive", s.unarchiveApp)
 			r.Get("/apps/{appID}/groups", s.getAppGroups)
 			r.Put("/apps/{appID}/groups", s.setAppGroups)
+			r.Get("/apps/{appID}/effective-env", s.getEffectiveEnv)
+			r.Get("/apps/{appID}/pipeline-graph", s.getPipelineGraph)
+			r.Get("/apps/{appID}/commits", s.listAppCommits)
+			r.Get("/apps/{appID}/workspace", s.listWorkspace)
+			r.Get("/apps/{appID}/workspace/file", s.downloadWorkspaceFile)
+			r.Get("/apps/{appID}/tags", s.getAppTags)
+			r.Put("/apps/{appID}/tags", s.setAppTags)
+			r.Put("/apps/{appID}/favorite", s.addFavorite)
+			r.Delete("/apps/{appID}/favorite", s.removeFavorite)
 			r.Post("/apps/{appID}/run", s.triggerRun)
+			r.Post("/apps/{appID}/deploy-with-dependencies", s.deployWithDependencies)
+			r.Post("/apps/{appID}/promote", s.promoteApp)
+			r.Get("/apps/{appID}/promotions", s.listPromotions)
+			r.Get("/digests/{digest}", s.getDigestProvenance)
+			r.Get("/deployments", s.listDeployments)
+			r.Get("/drift", s.listAppDrift)
+			r.Get("/apps/{appID}/drift", s.getAppDrift)
+			r.Post("/apps/{appID}/drift/check", s.checkAppDriftNow)
+			r.Get("/previews", s.listPreviews)
+			r.Get("/apps/{appID}/previews", s.listAppPreviews)
+			r.Post("/apps/{appID}/previews", s.deployPreview)
+			r.Delete("/apps/{appID}/previews/{previewID}", s.deletePreview)
+			r.Get("/apps/{appID}/triggers", s.listRunTriggers)
+			r.Post("/apps/{appID}/triggers", s.createRunTrigger)
+			r.Delete("/apps/{appID}/triggers/{triggerID}", s.deleteRunTrigger)
+			r.Get("/trains", s.listTrains)
+			r.Post("/trains/{name}/runs", s.startTrain)
+			r.Get("/trains/{name}/runs", s.listTrainRuns)
+			r.Get("/train-runs/{id}", s.getTrainRun)
+			r.Get("/releases", s.listReleases)
+			r.Post("/releases", s.createRelease)
+			r.Get("/releases/{releaseID}", s.getRelease)
+			r.Put("/releases/{releaseID}", s.updateRelease)
+			r.Delete("/releases/{releaseID}", s.deleteRelease)
+			r.Get("/releases/{releaseID}/timeline", s.getReleaseTimeline)
 			r.Get("/runs", s.listRuns)
+			r.Post("/runs/redact", s.redactRunLogs)
+			r.Get("/search", s.search)
+			r.Get("/stats/failures", s.getFailureStats)
+			r.Get("/reports", s.getUsageReport)
 			r.Get("/runs/{id}", s.getRun)
+			r.Delete("/runs/{id}", s.deleteRun)
+			r.Post("/runs/{id}/restore", s.restoreRun)
+			r.Put("/runs/{id}/pin", s.pinRun)
+			r.Delete("/runs/{id}/pin", s.unpinRun)
+			r.Get("/runs/{id}/log", s.getRunLog)
+			r.Get("/runs/{id}/timeline", s.getRunTimeline)
+			r.Get("/runs/{id}/export", s.exportRun)
+			r.Get("/runs/{id}/artifacts", s.listRunArtifacts)
+			r.Get("/runs/{id}/digests", s.listRunDigests)
+			r.Get("/runs/{id}/artifacts/{artifactID}", s.downloadRunArtifact)
+			r.Post("/runs/{id}/approval", s.decideRunApproval)
+			r.Get("/runs/{id}/debug", s.getK8sDebugPod)
+			r.Post("/runs/{id}/debug/exec", s.execK8sDebugPod)
+			r.Delete("/runs/{id}/debug", s.releaseK8sDebugPod)
+			r.Post("/runs/{id}/comments", s.createRunComment)
+			r.Delete("/runs/{id}/comments/{commentID}", s.deleteRunComment)
+			r.Get("/tokens", s.listAPITokens)
+			r.Post("/tokens", s.createAPIToken)
+			r.Post("/tokens/{tokenID}/rotate", s.rotateAPIToken)
+			r.Delete("/tokens/{tokenID}", s.deleteAPIToken)
 		})
 	})
 	r.Get("/*", s.serveStatic)
@@ -125,7 +333,20 @@ func (s *Server) requireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		u, _, ok := s.authenticateSession(w, r, true)
 		if !ok {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+			secret := bearerToken(r)
+			if secret == "" {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+				return
+			}
+			if u, ok = s.authenticateAPIToken(w, r, secret); !ok {
+				return
+			}
+		}
+		if u.IsAdmin && !s.ipAllowed(r, func(rules config.IPRules) config.IPRuleSet { return rules.Admin }) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin access is not allowed from this address"})
+			return
+		}
+		if s.demoReadOnly(w, r, u) {
 			return
 		}
 		ctx := context.WithValue(r.Context(), authUserKey, u)
@@ -151,20 +372,6 @@ func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) (authUser,
 	return u, true
 }
 
-// serveStatic serves static files; falls back to index.html for unknown routes.
-func (s *Server) serveStatic(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/" || r.URL.Path == "" {
-		http.ServeFile(w, r, filepath.Join(s.staticDir, "index.html"))
-		return
-	}
-	path := filepath.Join(s.staticDir, strings.TrimPrefix(r.URL.Path, "/"))
-	if info, err := os.Stat(path); err == nil && !info.IsDir() {
-		http.ServeFile(w, r, path)
-		return
-	}
-	http.ServeFile(w, r, filepath.Join(s.staticDir, "index.html"))
-}
-
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
@@ -216,9 +423,7 @@ func (s *Server) login(w http.ResponseWriter, r *http.Request) {
 func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err == nil && cookie.Value != "" {
-		s.sessionsMu.Lock()
-		delete(s.sessions, cookie.Value)
-		s.sessionsMu.Unlock()
+		s.invalidateSession(cookie.Value)
 	}
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
@@ -318,6 +523,11 @@ func (s *Server) profile(w http.ResponseWriter, r *http.Request) {
 			groupsOut = append(groupsOut, groupOut{ID: g.ID, Name: g.Name})
 		}
 	}
+	landing, err := s.userLanding(user)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
 
 	s.appsMu.RLock()
 	type appOut struct {
@@ -329,6 +539,9 @@ func (s *Server) profile(w http.ResponseWriter, r *http.Request) {
 	if user.IsAdmin {
 		appsOut = make([]appOut, 0, len(s.apps))
 		for _, a := range s.apps {
+			if a.Archived {
+				continue
+			}
 			appsOut = append(appsOut, appOut{ID: a.ID, Name: a.Name, Repo: a.Repo})
 		}
 	} else {
@@ -339,7 +552,7 @@ func (s *Server) profile(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		for _, a := range s.apps {
-			if _, ok := allowed[a.ID]; !ok {
+			if _, ok := allowed[a.ID]; !ok || a.Archived {
 				continue
 			}
 			appsOut = append(appsOut, appOut{ID: a.ID, Name: a.Name, Repo: a.Repo})
@@ -353,12 +566,20 @@ func (s *Server) profile(w http.ResponseWriter, r *http.Request) {
 		"is_admin": user.IsAdmin,
 		"groups":   groupsOut,
 		"apps":     appsOut,
+		"landing":  landing,
 	})
 }
 
 // listApps returns all apps for admin, or only allowed apps for normal users.
+// listApps returns apps visible to the user with their tags, the user's favorites first. Archived apps
+// are hidden; admins can list them with ?archived=true. ?tag= keeps only apps having all given tags.
 func (s *Server) listApps(w http.ResponseWriter, r *http.Request) {
 	user := authUserFromContext(r)
+	archived := r.URL.Query().Get("archived") == "true"
+	if archived && !user.IsAdmin {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin access required"})
+		return
+	}
 	allowed := map[string]struct{}(nil)
 	if !user.IsAdmin {
 		var err error
@@ -369,21 +590,63 @@ func (s *Server) listApps(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	appTags, err := s.store.AllAppTags()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	var tagged map[string]struct{}
+	if tags := tagFilter(r); len(tags) > 0 {
+		if tagged, err = s.taggedAppIDs(tags); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	favoriteIDs, err := s.store.FavoriteAppIDs(user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	favorites := make(map[string]int, len(favoriteIDs))
+	for i, id := range favoriteIDs {
+		favorites[id] = i
+	}
+
 	s.appsMu.RLock()
 	defer s.appsMu.RUnlock()
 	type app struct {
-		ID   string `json:"id"`
-		Name string `json:"name"`
+		ID       string           `json:"id"`
+		Name     string           `json:"name"`
+		Tags     []string         `json:"tags,omitempty"`
+		Favorite bool             `json:"favorite,omitempty"`
+		Timezone string           `json:"timezone"`
+		Owner    *config.AppOwner `json:"owner,omitempty"`
 	}
 	out := make([]app, 0, len(s.apps))
 	for i := range s.apps {
+		if s.apps[i].Archived != archived {
+			continue
+		}
+		if tagged != nil {
+			if _, ok := tagged[s.apps[i].ID]; !ok {
+				continue
+			}
+		}
 		if !user.IsAdmin {
 			if _, ok := allowed[s.apps[i].ID]; !ok {
 				continue
 			}
 		}
-		out = append(out, app{ID: s.apps[i].ID, Name: s.apps[i].Name})
+		_, favorite := favorites[s.apps[i].ID]
+		out = append(out, app{ID: s.apps[i].ID, Name: s.apps[i].Name, Tags: appTags[s.apps[i].ID], Favorite: favorite, Timezone: s.appLocation(s.apps[i]).String(), Owner: s.apps[i].Owner})
 	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Favorite && out[j].Favorite {
+			return favorites[out[i].ID] < favorites[out[j].ID]
+		}
+		return out[i].Favorite && !out[j].Favorite
+	})
 	writeJSON(w, http.StatusOK, out)
 }
 
@@ -407,16 +670,46 @@ func (s *Server) getApp(w http.ResponseWriter, r *http.Request) {
 		if a.ID == appID {
 			writeJSON(w, http.StatusOK, map[string]interface{}{
 				"id": a.ID, "name": a.Name, "repo": a.Repo, "branch": a.Branch,
-				"ssh_key_name":         a.SSHKeyName,
-				"deploy_mode":          a.DeployMode,
-				"k8s_namespace":        a.K8sNamespace,
-				"k8s_service_account":  a.K8sServiceAccount,
-				"k8s_runner_image":     a.K8sRunnerImage,
-				"deploy_manifest_path": a.DeployManifestPath,
-				"helm_chart":           a.HelmChart,
-				"helm_values_path":     a.HelmValuesPath,
-				"steps":                a.EffectiveSteps(),
-				"test_cmd":             a.TestCmd, "build_cmd": a.BuildCmd, "deploy_cmd": a.DeployCmd,
+				"ssh_key_name":          a.SSHKeyName,
+				"registries":            a.Registries,
+				"archived":              a.Archived,
+				"git_submodules":        a.GitSubmodules,
+				"git_lfs":               a.GitLFS,
+				"sparse_paths":          a.SparsePaths,
+				"env_report":            a.EnvReport,
+				"log_color":             a.LogColor,
+				"env":                   a.Env,
+				"expected_duration_sec": a.ExpectedDurationSec,
+				"slow_factor":           a.SlowFactor,
+				"owner":                 a.Owner,
+				"auto_retry":            a.AutoRetry,
+				"cloud_credentials":     a.CloudCredentials,
+				"notify_webhook":        a.NotifyWebhook,
+				"webhook_provider":      a.WebhookProvider,
+				"webhook_secret_set":    a.WebhookSecret != "",
+				"promotion":             a.Promotion,
+				"downstream":            a.Downstream,
+				"depends_on":            a.DependsOn,
+				"environment":           a.Environment,
+				"runner":                a.Runner,
+				"deploy_mode":           a.DeployMode,
+				"k8s_namespace":         a.K8sNamespace,
+				"k8s_service_account":   a.K8sServiceAccount,
+				"k8s_runner_image":      a.K8sRunnerImage,
+				"k8s_pod_template":      a.K8sPodTemplate,
+				"k8s_cache_pvc":         a.K8sCachePVC,
+				"deploy_manifest_path":  a.DeployManifestPath,
+				"helm_chart":            a.HelmChart,
+				"helm_values_path":      a.HelmValuesPath,
+				"gitops_repo":           a.GitOpsRepo,
+				"gitops_branch":         a.GitOpsBranch,
+				"gitops_ssh_key_name":   a.GitOpsSSHKeyName,
+				"gitops_path":           a.GitOpsPath,
+				"gitops_image":          a.GitOpsImage,
+				"gitops_pr":             a.GitOpsPR,
+				"steps":                 a.EffectiveSteps(),
+				"post":                  a.Post,
+				"test_cmd":              a.TestCmd, "build_cmd": a.BuildCmd, "deploy_cmd": a.DeployCmd,
 				"test_sleep_sec": a.TestSleepSec, "build_sleep_sec": a.BuildSleepSec, "deploy_sleep_sec": a.DeploySleepSec,
 			})
 			return
@@ -460,7 +753,13 @@ func (s *Server) createApp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	s.apps = newApps
-	writeJSON(w, http.StatusCreated, app)
+	writeJSON(w, http.StatusCreated, withoutSecrets(app))
+}
+
+// withoutSecrets returns app as sent back to API clients, without its webhook secret.
+func withoutSecrets(app config.App) config.App {
+	app.WebhookSecret = ""
+	return app
 }
 
 func (s *Server) updateApp(w http.ResponseWriter, r *http.Request) {
@@ -486,26 +785,79 @@ func (s *Server) updateApp(w http.ResponseWriter, r *http.Request) {
 	}
 	app := body.App
 	app.ID = appID
+	secretRef := ""
+	var current config.App
 	s.appsMu.RLock()
 	for i := range s.apps {
 		if s.apps[i].ID == appID {
+			current = s.apps[i]
+			if !user.IsAdmin {
+				secretRef = changedSecretRef(s.apps[i].Env, app.Env)
+			}
 			if strings.TrimSpace(app.SSHKeyName) == "" {
 				app.SSHKeyName = s.apps[i].SSHKeyName
 			}
+			if strings.TrimSpace(app.WebhookSecret) == "" {
+				app.WebhookSecret = s.apps[i].WebhookSecret
+			}
+			// Only admins choose the cloud roles an app's runs get credentials for.
+			if app.CloudCredentials == nil || !user.IsAdmin {
+				app.CloudCredentials = s.apps[i].CloudCredentials
+			}
+			// Likewise the registry credentials its runs can read from their Docker config, and the
+			// Job pod template, which can reach the node (host namespaces, hostPath volumes,
+			// privileged containers) or other apps' secrets in the namespace.
+			if !user.IsAdmin {
+				app.Registries = s.apps[i].Registries
+				app.K8sPodTemplate = s.apps[i].K8sPodTemplate
+			}
+			// Only admins choose the environment, whose approvers, freezes, and branch rules
+			// guard the app's deploys, and previews, whose namespaces are created and deleted with
+			// the server's credentials.
+			if !user.IsAdmin {
+				app.Environment = s.apps[i].Environment
+				app.Preview = s.apps[i].Preview
+			}
+			app.Archived = s.apps[i].Archived
 			break
 		}
 	}
 	s.appsMu.RUnlock()
+	if secretRef != "" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("only admins can set secret references in env (%s)", secretRef)})
+		return
+	}
 	if err := s.validateAndNormalizeApp(&app, false); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
+	// Downstream apps and promotion deploy apps run on behalf of this one, so users may only add
+	// apps they can access.
+	denied, err := s.inaccessibleApp(user, addedDownstreamApps(current, app))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if denied != "" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("user has no access to downstream app %s", denied)})
+		return
+	}
+	if denied, err = s.inaccessibleApp(user, addedPromotionDeployApps(current, app)); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if denied != "" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("user has no access to promotion deploy app %s", denied)})
+		return
+	}
 	s.appsMu.Lock()
 	defer s.appsMu.Unlock()
+	newApps := make([]config.App, len(s.apps))
+	copy(newApps, s.apps)
 	found := false
-	for i := range s.apps {
-		if s.apps[i].ID == appID {
-			s.apps[i] = app
+	for i := range newApps {
+		if newApps[i].ID == appID {
+			newApps[i] = app
 			found = true
 			break
 		}
@@ -514,11 +866,20 @@ func (s *Server) updateApp(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
 		return
 	}
-	if err := config.SaveApps(s.appsPath, s.apps); err != nil {
+	if err := checkDownstreamCycle(newApps); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := checkDependencyCycle(newApps); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := config.SaveApps(s.appsPath, newApps); err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
-	writeJSON(w, http.StatusOK, app)
+	s.apps = newApps
+	writeJSON(w, http.StatusOK, withoutSecrets(app))
 }
 
 func (s *Server) generateUniqueAppIDLocked() (string, error) {
@@ -550,14 +911,99 @@ func generateAppID() (string, error) {
 }
 
 func (s *Server) validateAndNormalizeApp(app *config.App, requireSSHKey bool) error {
+	defaults, err := config.LoadDefaults(s.appsPath)
+	if err != nil {
+		return err
+	}
+	*app = defaults.Apply(*app)
 	app.SSHKeyName = strings.TrimSpace(app.SSHKeyName)
+	app.Runner = strings.TrimSpace(strings.ToLower(app.Runner))
 	app.DeployMode = strings.TrimSpace(strings.ToLower(app.DeployMode))
 	app.K8sNamespace = strings.TrimSpace(app.K8sNamespace)
 	app.K8sServiceAccount = strings.TrimSpace(app.K8sServiceAccount)
 	app.K8sRunnerImage = strings.TrimSpace(app.K8sRunnerImage)
+	app.K8sCachePVC = strings.TrimSpace(app.K8sCachePVC)
 	app.DeployManifestPath = strings.TrimSpace(app.DeployManifestPath)
 	app.HelmChart = strings.TrimSpace(app.HelmChart)
 	app.HelmValuesPath = strings.TrimSpace(app.HelmValuesPath)
+	app.Environment = strings.TrimSpace(app.Environment)
+	if app.Environment != "" && !config.ValidEnvironmentName(app.Environment) {
+		return errors.New("environment must be a name of letters, digits, '.', '_' or '-'")
+	}
+	sparsePaths := make([]string, 0, len(app.SparsePaths))
+	for _, raw := range app.SparsePaths {
+		if !validRepoRelativePath(raw) {
+			return errors.New("sparse_paths must be relative directories inside the repository")
+		}
+		p := strings.Trim(strings.TrimPrefix(strings.TrimSpace(raw), "./"), "/")
+		if p == "" {
+			continue
+		}
+		sparsePaths = append(sparsePaths, p)
+	}
+	app.SparsePaths = nil
+	if len(sparsePaths) > 0 {
+		app.SparsePaths = sparsePaths
+	}
+	app.Env, err = normalizeEnvMap(app.Env)
+	if err != nil {
+		return err
+	}
+	if app.ExpectedDurationSec < 0 {
+		return errors.New("expected_duration_sec must be >= 0")
+	}
+	if app.SlowFactor != 0 && app.SlowFactor < 1 {
+		return errors.New("slow_factor must be >= 1")
+	}
+	if err := validateOwner(app); err != nil {
+		return err
+	}
+	if err := validateAutoRetry(app); err != nil {
+		return err
+	}
+	if err := s.validateCloudCredentials(app); err != nil {
+		return err
+	}
+	app.NotifyWebhook = strings.TrimSpace(app.NotifyWebhook)
+	if err := validateNotifyWebhook(app.NotifyWebhook); err != nil {
+		return err
+	}
+	if err := validateWebhook(app); err != nil {
+		return err
+	}
+	if err := validatePromotion(app.Promotion); err != nil {
+		return err
+	}
+	if err := validateDownstream(app); err != nil {
+		return err
+	}
+	if err := validateDependsOn(app); err != nil {
+		return err
+	}
+	if err := validatePreview(app); err != nil {
+		return err
+	}
+	if err := validateAppTimezone(app); err != nil {
+		return err
+	}
+	if err := validateStepShell(app); err != nil {
+		return err
+	}
+	if err := validateRunner(app); err != nil {
+		return err
+	}
+	if err := validateK8sPodTemplate(app.K8sPodTemplate); err != nil {
+		return err
+	}
+	if err := validateK8sCachePVC(app.K8sCachePVC); err != nil {
+		return err
+	}
+	if err := s.validateGitOps(app); err != nil {
+		return err
+	}
+	if err := s.validateAppRegistries(app); err != nil {
+		return err
+	}
 	if requireSSHKey && app.SSHKeyName == "" {
 		return errors.New("ssh_key_name is required")
 	}
@@ -573,46 +1019,154 @@ func (s *Server) validateAndNormalizeApp(app *config.App, requireSSHKey bool) er
 	if app.Branch == "" {
 		app.Branch = "main"
 	}
+	rawSteps := append([]config.Step(nil), app.Steps...)
+	if app.Post != nil {
+		rawSteps = append(rawSteps, app.Post.OnSuccess...)
+		rawSteps = append(rawSteps, app.Post.OnFailure...)
+		rawSteps = append(rawSteps, app.Post.Always...)
+	}
+	for _, step := range rawSteps {
+		if !validRepoRelativePath(step.Workdir) {
+			return errors.New("each step workdir must be a relative directory inside the repository")
+		}
+	}
 	normalized := config.NormalizeAppSteps(*app)
 	if len(normalized.Steps) == 0 {
 		return errors.New("at least one step is required")
 	}
-	for _, step := range normalized.Steps {
-		kind := step.Kind()
-		if kind == "" {
-			return errors.New("each step must define exactly one of: cmd, file, script, k8s_deploy")
-		}
-		if kind == "k8s_deploy" {
-			switch app.DeployMode {
-			case "kubectl":
-				if app.DeployManifestPath == "" {
-					return errors.New("deploy_manifest_path is required when deploy_mode=kubectl and step uses k8s_deploy")
-				}
-			case "helm":
-				if app.HelmChart == "" {
-					return errors.New("helm_chart is required when deploy_mode=helm and step uses k8s_deploy")
-				}
-			default:
-				return errors.New("deploy_mode must be kubectl or helm when step uses k8s_deploy")
-			}
-			if app.K8sNamespace == "" {
-				return errors.New("k8s_namespace is required when step uses k8s_deploy")
+	sections := [][]config.Step{normalized.Steps}
+	if normalized.Post != nil {
+		sections = append(sections, normalized.Post.OnSuccess, normalized.Post.OnFailure, normalized.Post.Always)
+	}
+	for _, steps := range sections {
+		for i := range steps {
+			if err := validateAndNormalizeStep(app, &steps[i]); err != nil {
+				return err
 			}
-			if app.K8sServiceAccount == "" {
-				return errors.New("k8s_service_account is required when step uses k8s_deploy")
+		}
+	}
+	*app = normalized
+	return nil
+}
+
+// validateAndNormalizeStep checks a normalized step (main or post) against the app deploy settings.
+func validateAndNormalizeStep(app *config.App, step *config.Step) error {
+	stepEnv, err := normalizeEnvMap(step.Env)
+	if err != nil {
+		return fmt.Errorf("step %s: %w", step.Name, err)
+	}
+	step.Env = stepEnv
+	kind := step.Kind()
+	if kind == "" {
+		return errors.New("each step must define exactly one of: cmd, file, script, k8s_deploy, terraform, ansible, db_migrate, scan, wait_for, sign")
+	}
+	if kind == "k8s_deploy" && app.DeployMode != "gitops" {
+		switch app.DeployMode {
+		case "kubectl":
+			if app.DeployManifestPath == "" {
+				return errors.New("deploy_manifest_path is required when deploy_mode=kubectl and step uses k8s_deploy")
 			}
-			if app.K8sRunnerImage == "" {
-				return errors.New("k8s_runner_image is required when step uses k8s_deploy")
+		case "helm":
+			if app.HelmChart == "" {
+				return errors.New("helm_chart is required when deploy_mode=helm and step uses k8s_deploy")
 			}
+		default:
+			return errors.New("deploy_mode must be kubectl, helm, or gitops when step uses k8s_deploy")
 		}
-		if step.SleepSec < 0 || step.SleepSec > 3600 {
-			return errors.New("each step sleep_sec must be between 0 and 3600")
+		if app.K8sNamespace == "" {
+			return errors.New("k8s_namespace is required when step uses k8s_deploy")
+		}
+		if app.K8sServiceAccount == "" {
+			return errors.New("k8s_service_account is required when step uses k8s_deploy")
+		}
+		if app.K8sRunnerImage == "" {
+			return errors.New("k8s_runner_image is required when step uses k8s_deploy")
 		}
 	}
-	*app = normalized
+	if kind == "terraform" {
+		if err := validateTerraformStep(app, step); err != nil {
+			return err
+		}
+	}
+	if kind == "scan" {
+		if err := validateScanStep(step); err != nil {
+			return err
+		}
+	}
+	if kind == "wait_for" {
+		if err := validateWaitForStep(step); err != nil {
+			return err
+		}
+	}
+	if kind == "db_migrate" {
+		if err := validateDBMigrateStep(app, step); err != nil {
+			return err
+		}
+	}
+	if kind == "ansible" {
+		if err := validateAnsibleStep(step); err != nil {
+			return err
+		}
+	}
+	if kind == "sign" {
+		if err := validateSignStep(app, step); err != nil {
+			return err
+		}
+	}
+	if step.SleepSec < 0 || step.SleepSec > 3600 {
+		return errors.New("each step sleep_sec must be between 0 and 3600")
+	}
+	if len(step.Artifacts) > maxStepArtifactPatterns {
+		return fmt.Errorf("step %s: at most %d artifacts patterns are allowed", step.Name, maxStepArtifactPatterns)
+	}
+	patterns := make([]string, 0, len(step.Artifacts))
+	for _, raw := range step.Artifacts {
+		p := strings.TrimPrefix(strings.TrimSpace(raw), "./")
+		if p == "" || !validRepoRelativePath(p) {
+			return fmt.Errorf("step %s: artifacts must be relative paths inside the repository", step.Name)
+		}
+		patterns = append(patterns, p)
+	}
+	step.Artifacts = nil
+	if len(patterns) > 0 {
+		step.Artifacts = patterns
+	}
 	return nil
 }
 
+// normalizeEnvMap trims env var names and validates them. It returns nil for an empty map.
+func normalizeEnvMap(in map[string]string) (map[string]string, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(in))
+	for name, value := range in {
+		name = strings.TrimSpace(name)
+		if !validEnvVarName(name) {
+			return nil, fmt.Errorf("invalid env var name %q", name)
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+// validRepoRelativePath reports whether p is empty or a relative path that stays inside the repository.
+func validRepoRelativePath(p string) bool {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return true
+	}
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, "~") {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) deleteApp(w http.ResponseWriter, r *http.Request) {
 	if _, ok := s.requireAdmin(w, r); !ok {
 		return
@@ -634,14 +1188,95 @@ func (s *Server) deleteApp(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
+	artifactKeys, err := s.store.ArtifactKeysByAppID(appID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.deleteArtifactObjects(artifactKeys)
+	logKeys, err := s.store.LogKeysByAppID(appID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.deleteLogObjects(logKeys)
 	if err := s.store.DeleteRunsByAppID(appID); err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
+	if err := s.store.DeleteAppTags(appID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.store.DeleteAppFavorites(appID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.store.DeleteAppPromotions(appID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.store.DeleteAppRunTriggers(appID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.store.DeleteAppDrift(appID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	previews, err := s.store.ListPreviewEnvs([]string{appID}, store.PreviewActive)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	go s.teardownAppPreviews(previews)
+	if err := s.store.DeleteAppPreviewEnvs(appID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
 	s.apps = newApps
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) archiveApp(w http.ResponseWriter, r *http.Request) {
+	s.setAppArchived(w, r, true)
+}
+
+func (s *Server) unarchiveApp(w http.ResponseWriter, r *http.Request) {
+	s.setAppArchived(w, r, false)
+}
+
+// setAppArchived toggles the archived flag of an app. Archived apps keep their run history
+// but are hidden from listings and cannot be triggered.
+func (s *Server) setAppArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	appID := chi.URLParam(r, "appID")
+	s.appsMu.Lock()
+	defer s.appsMu.Unlock()
+	newApps := make([]config.App, len(s.apps))
+	copy(newApps, s.apps)
+	idx := -1
+	for i := range newApps {
+		if newApps[i].ID == appID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	newApps[idx].Archived = archived
+	if err := config.SaveApps(s.appsPath, newApps); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.apps = newApps
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": appID, "archived": archived})
+}
+
 func (s *Server) triggerRun(w http.ResponseWriter, r *http.Request) {
 	appID := chi.URLParam(r, "appID")
 	user := authUserFromContext(r)
@@ -657,65 +1292,290 @@ func (s *Server) triggerRun(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	app, ok := s.findApp(appID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	// The body is optional; {"env": {...}} sets one-off env vars for this run.
+	var body struct {
+		Env map[string]string `json:"env"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if err := validateRunEnv(body.Env); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	runID, err := s.startRun(app, user.Username, body.Env)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"run_id": runID, "status": "pending"})
+}
+
+// findApp returns a copy of the app with the given ID.
+func (s *Server) findApp(appID string) (config.App, bool) {
 	s.appsMu.RLock()
-	var app *config.App
-	for i := range s.apps {
-		if s.apps[i].ID == appID {
-			app = &s.apps[i]
-			break
+	defer s.appsMu.RUnlock()
+	for _, a := range s.apps {
+		if a.ID == appID {
+			return a, true
 		}
 	}
-	s.appsMu.RUnlock()
-	if app == nil {
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+	return config.App{}, false
+}
+
+// statusError is a refused request (e.g. a run start); Status is the HTTP status to answer with.
+type statusError struct {
+	Status int
+	Msg    string
+	Reason string
+}
+
+func (e *statusError) Error() string { return e.Msg }
+
+func writeStatusError(w http.ResponseWriter, err error) {
+	var sErr *statusError
+	if !errors.As(err, &sErr) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
+	body := map[string]string{"error": sErr.Msg}
+	if sErr.Reason != "" {
+		body["reason"] = sErr.Reason
+	}
+	writeJSON(w, sErr.Status, body)
+}
+
+// startRun checks that app can run (not archived, SSH key, quotas), creates a pending run and
+// executes it in the background. runEnv, when set, is added to the step env of this run only
+// and overrides global and app env vars with the same name.
+func (s *Server) startRun(app config.App, triggeredBy string, runEnv map[string]string) (int64, error) {
+	runID, _, err := s.queueRun(app, triggeredBy, runEnv, false, runLink{})
+	return runID, err
+}
+
+// runLink is what a queued run was started after: the upstream run whose completion started it
+// (downstream triggers), or the failed run it retries with its attempt number (auto_retry).
+type runLink struct {
+	upstreamRunID int64
+	retryOfRunID  int64
+	attempt       int
+}
+
+// queueRun is startRun that also reports whether the run is held by maintenance mode. Runs are
+// rejected during maintenance unless it queues runs or alwaysHold is set (webhook pushes).
+// link records the run it is queued after, if any.
+func (s *Server) queueRun(app config.App, triggeredBy string, runEnv map[string]string, alwaysHold bool, link runLink) (int64, bool, error) {
+	m, err := s.maintenanceStatus()
+	if err != nil {
+		return 0, false, err
+	}
+	if m.Enabled && !m.QueueRuns && !alwaysHold {
+		msg := "server is in maintenance mode"
+		if m.Message != "" {
+			msg += ": " + m.Message
+		}
+		return 0, false, &statusError{Status: http.StatusServiceUnavailable, Msg: msg, Reason: "maintenance"}
+	}
+	if app.Archived {
+		return 0, false, &statusError{Status: http.StatusConflict, Msg: "app is archived"}
+	}
+	if branch := runEnv[envPreviewBranch]; branch != "" {
+		var err error
+		if app, err = previewApp(app, branch); err != nil {
+			return 0, false, &statusError{Status: http.StatusConflict, Msg: "preview: " + err.Error()}
+		}
+	}
 	if strings.TrimSpace(app.SSHKeyName) == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "app has no ssh_key_name configured"})
-		return
+		return 0, false, &statusError{Status: http.StatusBadRequest, Msg: "app has no ssh_key_name configured"}
 	}
 	key, err := s.store.GetSSHKeyByName(app.SSHKeyName)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
-		return
+		return 0, false, err
 	}
 	if key == nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "configured ssh_key_name not found"})
-		return
+		return 0, false, &statusError{Status: http.StatusBadRequest, Msg: "configured ssh_key_name not found"}
+	}
+	gitopsKey, err := s.gitOpsKey(app, key)
+	if err != nil {
+		return 0, false, err
+	}
+	registries, err := s.appRegistries(app)
+	if err != nil {
+		return 0, false, err
+	}
+	dockerConfig := ""
+	if len(registries) > 0 {
+		if dockerConfig, err = dockerConfigJSON(registries); err != nil {
+			return 0, false, err
+		}
 	}
 
-	runID, err := s.store.CreateRun(appID, "", user.Username)
+	s.triggerMu.Lock()
+	maxDuration, err := s.checkRunQuotas(app.ID)
+	var qErr *quotaError
+	if errors.As(err, &qErr) {
+		s.triggerMu.Unlock()
+		return 0, false, &statusError{Status: http.StatusTooManyRequests, Msg: qErr.Msg, Reason: qErr.Reason}
+	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
-		return
+		s.triggerMu.Unlock()
+		return 0, false, err
+	}
+	runID, err := s.store.CreateRun(app.ID, "", triggeredBy)
+	if err == nil {
+		s.trackRun(runID)
+	}
+	s.triggerMu.Unlock()
+	if err != nil {
+		return 0, false, err
+	}
+	if link.upstreamRunID != 0 {
+		if err := s.store.SetRunTriggeredByRun(runID, link.upstreamRunID); err != nil {
+			log.Printf("run %d: record upstream run: %v", runID, err)
+		}
+	}
+	if link.retryOfRunID != 0 {
+		if err := s.store.SetRunRetry(runID, link.retryOfRunID, link.attempt); err != nil {
+			log.Printf("run %d: record retried run: %v", runID, err)
+		}
+	}
+	if len(runEnv) > 0 {
+		if err := s.store.SetRunEnv(runID, runEnv); err != nil {
+			log.Printf("run %d: record run env: %v", runID, err)
+		}
 	}
 
-	appCopy := *app
-	go func() {
-		_ = s.store.UpdateRunStatus(runID, "running", "")
-		onLogUpdate := func(log string) { _ = s.store.UpdateRunLog(runID, log) }
-		stepEnv := s.loadGlobalStepEnv()
+	launch := func() {
+		started := time.Now()
+		claimed, err := s.store.ClaimRun(runID)
+		if err != nil || !claimed {
+			// Another replica started it, or it was interrupted while held.
+			log.Printf("run %d: not claimed (%v)", runID, err)
+			s.untrackRun(runID)
+			return
+		}
+		go s.runHooks(config.HookRunStarted, runID, app)
+		onLogUpdate := func(log string) { s.updateRunLog(runID, log) }
+		stepEnv, envSources := s.buildRunEnv(app)
+		secretErr := s.resolveSecretEnv(runID, app.ID, stepEnv, envSources)
+		var cloudErr error
+		if secretErr == nil {
+			cloudErr = s.mintCloudCredentials(runID, app, stepEnv, envSources)
+		}
+		for name, value := range runEnv {
+			stepEnv[name] = value
+			envSources[name] = "run"
+		}
 		result := pipeline.Result{}
-		if appUsesK8sJob(appCopy) {
-			result = s.runAppAsK8sJob(runID, appCopy, key.PrivateKey, stepEnv, onLogUpdate)
+		if secretErr != nil {
+			result = pipeline.Result{Success: false, Log: "failed to resolve secrets: " + secretErr.Error()}
+		} else if cloudErr != nil {
+			result = pipeline.Result{Success: false, Log: "failed to mint cloud credentials: " + cloudErr.Error()}
+		} else if err := s.checkPolicies(app, triggeredBy, time.Now()); err != nil {
+			result = pipeline.Result{Success: false, Log: "deploy blocked by " + err.Error()}
+			go s.notify(app, notification{Event: "run.policy_violation", RunID: runID, Message: err.Error()})
+		} else if err := s.preflightK8sJob(runID, app); err != nil {
+			result = pipeline.Result{Success: false, Log: "k8s preflight failed: " + err.Error()}
+		} else if err := s.provisionPreview(app); err != nil {
+			result = pipeline.Result{Success: false, Log: "failed to provision preview namespace: " + err.Error()}
+		} else if err := s.guardK8sJob(runID, app, onLogUpdate); err != nil {
+			result = pipeline.Result{Success: false, Log: "deploy blocked: " + err.Error()}
+		} else if err := s.verifyK8sJobImages(runID, app, stepEnv); err != nil {
+			result = pipeline.Result{Success: false, Log: "deploy blocked: " + err.Error()}
+		} else if appUsesK8sJob(app) {
+			gitopsPrivateKey := ""
+			if gitopsKey != nil {
+				gitopsPrivateKey = gitopsKey.PrivateKey
+			}
+			result = s.runAppAsK8sJob(runID, app, key.PrivateKey, gitopsPrivateKey, dockerConfig, stepEnv, envSources, maxDuration, onLogUpdate)
 		} else {
 			keyPath, cleanupKey, err := writeTempSSHKey(key.PrivateKey)
+			defer cleanupKey()
+			cleanupConfig, cfgErr := applyRegistryLogin(dockerConfig, stepEnv, envSources)
+			defer cleanupConfig()
+			gitopsSSHCommand := ""
+			if err == nil && gitopsKey != nil {
+				gitopsKeyPath, cleanupGitOpsKey, keyErr := writeTempSSHKey(gitopsKey.PrivateKey)
+				defer cleanupGitOpsKey()
+				err = keyErr
+				gitopsSSHCommand = buildGitSSHCommand(gitopsKeyPath)
+			}
 			if err != nil {
 				result = pipeline.Result{Success: false, Log: "failed to prepare ssh key"}
+			} else if cfgErr != nil {
+				result = pipeline.Result{Success: false, Log: "failed to prepare registry credentials"}
 			} else {
-				defer cleanupKey()
 				gitSSHCommand := buildGitSSHCommand(keyPath)
-				result = s.runner.Run(appCopy, pipeline.RunOptions{GitSSHCommand: gitSSHCommand, StepEnv: stepEnv}, onLogUpdate)
+				previousCommit, _ := s.store.PreviousRunCommit(app.ID, runID)
+				result = s.runner.Run(app, pipeline.RunOptions{GitSSHCommand: gitSSHCommand, GitOpsSSHCommand: gitopsSSHCommand, StepEnv: stepEnv, EnvSources: envSources, Timeout: maxDuration, MaxLogBytes: s.maxLogBytes, Approve: s.runApprover(runID, app), LockDatabase: s.lockDatabase, GuardDeploy: s.deployGuard(runID, app), VerifyImages: s.imageVerifier(runID, app, stepEnv), PreviousCommit: previousCommit}, onLogUpdate)
 			}
 		}
-		status := "success"
-		if !result.Success {
-			status = "failed"
-		}
-		_ = s.store.UpdateRunStatus(runID, status, result.Log)
-	}()
+		s.finishRun(runID, app, result, time.Since(started))
+		s.forgetRunSecrets(runID)
+		s.untrackRun(runID)
+	}
+	if s.holdRun(runID, launch) {
+		return runID, true, nil
+	}
+	go launch()
+	return runID, false, nil
+}
 
-	writeJSON(w, http.StatusAccepted, map[string]interface{}{"run_id": runID, "status": "pending"})
+// finishRun stores the outcome of a run and what it produced.
+func (s *Server) finishRun(runID int64, app config.App, result pipeline.Result, elapsed time.Duration) {
+	status := "success"
+	if !result.Success {
+		status = "failed"
+	}
+	s.completeRun(runID, status, result.Log)
+	sha, ok := pipeline.ParseCommitLine(result.Log)
+	if ok {
+		_ = s.store.SetRunCommit(runID, sha, pipeline.ParseCommitSubject(result.Log))
+	}
+	s.recordRunIssues(runID, app, result, sha)
+	if len(result.Usage) > 0 {
+		usage := make([]store.RunStepUsage, 0, len(result.Usage))
+		for _, u := range result.Usage {
+			usage = append(usage, store.RunStepUsage(u))
+		}
+		_ = s.store.SetRunStepUsage(runID, usage)
+	}
+	if len(result.Findings) > 0 {
+		findings := make([]store.RunFinding, 0, len(result.Findings))
+		for _, f := range result.Findings {
+			findings = append(findings, store.RunFinding(f))
+		}
+		_ = s.store.SetRunFindings(runID, findings)
+	}
+	s.saveRunArtifacts(runID, result.Artifacts)
+	s.saveFullLog(runID, result.FullLogPath)
+	if result.Success && app.PreviewNamespace != "" {
+		// Preview builds are neither promoted nor the app's deploy.
+		s.notifyPreviewReady(runID, app)
+	} else if result.Success {
+		s.recordRunImage(runID, result.Log)
+		s.recordRunDigests(runID, app, result.Log)
+		s.recordAppDeploy(runID, app, result.Log)
+	}
+	s.checkDurationBudget(runID, app, elapsed)
+	var reason string
+	if !result.Success {
+		reason = s.classifyFailure(runID, result.Log)
+	}
+	go s.runHooks(config.HookRunFinished, runID, app)
+	if !result.Success {
+		if s.retryFailedRun(runID, app, reason) {
+			return
+		}
+		s.notifyRunFailed(runID, app, reason)
+	}
+	s.triggerDownstream(runID, app, status, sha)
 }
 
 func (s *Server) loadGlobalStepEnv() map[string]string {
@@ -730,6 +1590,30 @@ func (s *Server) loadGlobalStepEnv() map[string]string {
 	return out
 }
 
+// buildRunEnv merges global env vars with app env vars (app wins), adds TZ for apps with a
+// timezone, and returns the merged env plus a source label per name for the run log.
+func (s *Server) buildRunEnv(app config.App) (map[string]string, map[string]string) {
+	env := s.loadGlobalStepEnv()
+	sources := make(map[string]string, len(env)+len(app.Env))
+	for name := range env {
+		sources[name] = "global"
+	}
+	for name, value := range app.Env {
+		if _, ok := env[name]; ok {
+			sources[name] = "app, overrides global"
+		} else {
+			sources[name] = "app"
+		}
+		env[name] = value
+	}
+	// Step commands like date print the app's local time, unless TZ is set explicitly.
+	if _, ok := env["TZ"]; !ok && app.Timezone != "" {
+		env["TZ"] = app.Timezone
+		sources["TZ"] = "app timezone"
+	}
+	return env, sources
+}
+
 func buildGitSSHCommand(keyPath string) string {
 	return fmt.Sprintf("ssh -i %q -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", keyPath)
 }
@@ -835,6 +1719,31 @@ func (s *Server) listEnvVars(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, vars)
 }
 
+const (
+	maxRunEnvVars     = 50
+	maxRunEnvValueLen = 4096
+)
+
+// validateRunEnv checks one-off env vars of a run trigger. Names starting with NOPPFLOW_ are
+// reserved for values set by the server (triggers, promotions).
+func validateRunEnv(env map[string]string) error {
+	if len(env) > maxRunEnvVars {
+		return fmt.Errorf("at most %d env vars per run", maxRunEnvVars)
+	}
+	for name, value := range env {
+		if !validEnvVarName(name) {
+			return fmt.Errorf("invalid env var name %q", name)
+		}
+		if strings.HasPrefix(name, "NOPPFLOW_") {
+			return fmt.Errorf("env var %s: the NOPPFLOW_ prefix is reserved", name)
+		}
+		if len(value) > maxRunEnvValueLen {
+			return fmt.Errorf("env var %s: value longer than %d bytes", name, maxRunEnvValueLen)
+		}
+	}
+	return nil
+}
+
 func validEnvVarName(name string) bool {
 	if name == "" {
 		return false
@@ -1175,6 +2084,11 @@ func (s *Server) getGroup(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
+	landing, err := s.store.GroupLanding(groupID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
 
 	users, err := s.store.ListUsers()
 	if err != nil {
@@ -1206,6 +2120,7 @@ func (s *Server) getGroup(w http.ResponseWriter, r *http.Request) {
 		"name":            group.Name,
 		"user_ids":        userIDs,
 		"app_ids":         appIDs,
+		"landing":         landing,
 		"available_users": usersOut,
 		"available_apps":  appsOut,
 	})
@@ -1338,6 +2253,30 @@ func (s *Server) listRuns(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if r.URL.Query().Get("deleted") == "true" {
+		if _, ok := s.requireAdmin(w, r); !ok {
+			return
+		}
+		s.listDeletedRuns(w, limit, offset)
+		return
+	}
+	if r.URL.Query().Get("pinned") == "true" {
+		s.listPinnedRuns(w, user, appID, limit, offset)
+		return
+	}
+	switch r.URL.Query().Get("group_by") {
+	case "":
+	case "commit":
+		s.listRunsByCommit(w, user, appID, tagFilter(r), limit, offset)
+		return
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "group_by must be commit"})
+		return
+	}
+	if tags := tagFilter(r); len(tags) > 0 {
+		s.listRunsByTags(w, user, appID, tags, limit, offset)
+		return
+	}
 	if user.IsAdmin {
 		runs, err := s.store.ListRuns(appID, limit, offset)
 		if err != nil {
@@ -1390,66 +2329,171 @@ func (s *Server) listRuns(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs, "total": total})
 }
 
+// getRun returns a run with its log and details. It sets an ETag and answers 304 to a matching
+// If-None-Match; ?wait= (seconds) long-polls for a change first (serveRunPoll).
 func (s *Server) getRun(w http.ResponseWriter, r *http.Request) {
-	idStr := chi.URLParam(r, "id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	s.serveRunPoll(w, r, run, "application/json", func(run *store.Run) ([]byte, error) {
+		return s.runDetailJSON(run, r.URL.Query().Get("timestamps") == "false")
+	})
+}
+
+// runDetailJSON renders the GET /api/runs/{id} response: the run with its log and details.
+func (s *Server) runDetailJSON(run *store.Run, stripTimestamps bool) ([]byte, error) {
+	if err := s.loadRunLog(run); err != nil {
+		return nil, err
+	}
+	if stripTimestamps {
+		run.Log = pipeline.StripLogTimestamps(run.Log)
+	}
+	comments, err := s.store.ListRunComments(run.ID)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid run id"})
+		return nil, err
+	}
+	usage, err := s.store.ListRunStepUsage(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	env, err := s.store.ListRunEnv(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	approval, err := s.store.LatestRunApproval(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	findings, err := s.store.ListRunFindings(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	downstream, err := s.store.ListDownstreamRuns(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	issues, err := s.runIssues(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	sections, annotations := pipeline.ParseLogMarkers(run.Log)
+	body, err := json.Marshal(struct {
+		*store.Run
+		Env         []store.RunEnvVar     `json:"env"`
+		Preview     *runPreview           `json:"preview,omitempty"`
+		Approval    *store.RunApproval    `json:"approval,omitempty"`
+		Comments    []store.RunComment    `json:"comments"`
+		Usage       []store.RunStepUsage  `json:"usage"`
+		Findings    []store.RunFinding    `json:"findings"`
+		Downstream  []store.Run           `json:"downstream_runs"`
+		Issues      []runIssue            `json:"issues"`
+		Chunks      []pipeline.LogChunk   `json:"chunks"`
+		Sections    []pipeline.LogSection `json:"sections"`
+		Annotations []pipeline.Annotation `json:"annotations"`
+	}{run, env, previewOfRun(env), approval, comments, usage, findings, downstream, issues, pipeline.SplitLogChunks(run.Log), sections, annotations})
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// getRunLog returns the run log as text: plain (ANSI escapes stripped) by default, raw with ?ansi=true.
+// ?timestamps=false strips line timestamps; ?download=true sets a Content-Disposition attachment header.
+// Like getRun it supports If-None-Match and ?wait=.
+func (s *Server) getRunLog(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
 		return
 	}
+	if r.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="run-%d.log"`, run.ID))
+	}
+	s.serveRunPoll(w, r, run, "text/plain; charset=utf-8", func(run *store.Run) ([]byte, error) {
+		if err := s.loadRunLog(run); err != nil {
+			return nil, err
+		}
+		log := run.Log
+		if r.URL.Query().Get("ansi") != "true" {
+			log = pipeline.StripANSI(log)
+		}
+		if r.URL.Query().Get("timestamps") == "false" {
+			log = pipeline.StripLogTimestamps(log)
+		}
+		return []byte(log), nil
+	})
+}
+
+// accessibleRun loads the run from the {id} URL param and checks the current user may see it.
+// It writes the error response and returns false otherwise.
+func (s *Server) accessibleRun(w http.ResponseWriter, r *http.Request) (*store.Run, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid run id"})
+		return nil, false
+	}
 	run, err := s.store.GetRun(id)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
-		return
+		return nil, false
 	}
-	if run == nil {
+	user := authUserFromContext(r)
+	if run == nil || (run.DeletedAt != nil && !user.IsAdmin) {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
-		return
+		return nil, false
 	}
-	user := authUserFromContext(r)
 	if !user.IsAdmin {
 		ok, err := s.userCanAccessApp(user.ID, run.AppID)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
-			return
+			return nil, false
 		}
 		if !ok {
 			writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to this run"})
-			return
+			return nil, false
 		}
 	}
-	writeJSON(w, http.StatusOK, run)
+	return run, true
 }
 
 func (s *Server) readSessionUser(r *http.Request) (authUser, string, bool) {
+	session, token := s.readSession(r)
+	if session == nil {
+		return authUser{}, "", false
+	}
+	return authUser{ID: session.UserID, Username: session.Username, IsAdmin: session.IsAdmin}, token, true
+}
+
+// readSession returns the unexpired session of the request cookie, stored in the database so
+// every replica accepts it, and the cookie token.
+func (s *Server) readSession(r *http.Request) (*store.Session, string) {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil || strings.TrimSpace(cookie.Value) == "" {
-		return authUser{}, "", false
+		return nil, ""
 	}
 	token := cookie.Value
-	now := time.Now()
-	s.sessionsMu.RLock()
-	session, ok := s.sessions[token]
-	s.sessionsMu.RUnlock()
-	if !ok {
-		return authUser{}, "", false
+	session, err := s.store.GetSession(hashToken(token))
+	if err != nil {
+		log.Printf("read session: %v", err)
+		return nil, ""
 	}
-	if !session.ExpiresAt.After(now) {
+	if session == nil {
+		return nil, ""
+	}
+	if !session.ExpiresAt.After(time.Now()) {
 		s.invalidateSession(token)
-		return authUser{}, "", false
+		return nil, ""
 	}
-	return session.User, token, true
+	return session, token
 }
 
 func (s *Server) authenticateSession(w http.ResponseWriter, r *http.Request, rotate bool) (authUser, string, bool) {
-	u, token, ok := s.readSessionUser(r)
-	if !ok {
+	session, token := s.readSession(r)
+	if session == nil {
 		return authUser{}, "", false
 	}
+	u := authUser{ID: session.UserID, Username: session.Username, IsAdmin: session.IsAdmin}
 	if rotate {
-		s.sessionsMu.RLock()
-		session := s.sessions[token]
-		s.sessionsMu.RUnlock()
 		if time.Until(session.ExpiresAt) <= sessionRotateThreshold {
 			s.invalidateSession(token)
 			if err := s.createSession(w, u); err != nil {
@@ -1485,6 +2529,24 @@ func (s *Server) userCanAccessApp(userID int64, appID string) (bool, error) {
 	return ok, nil
 }
 
+// inaccessibleApp returns the first of appIDs u may not access, or "" when u may access all of
+// them (admins always).
+func (s *Server) inaccessibleApp(u authUser, appIDs []string) (string, error) {
+	if u.IsAdmin || len(appIDs) == 0 {
+		return "", nil
+	}
+	allowed, _, err := s.allowedAppIDsForUser(u.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, id := range appIDs {
+		if _, ok := allowed[id]; !ok {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
 func (s *Server) appExists(appID string) bool {
 	s.appsMu.RLock()
 	defer s.appsMu.RUnlock()
@@ -1514,9 +2576,10 @@ func (s *Server) createSession(w http.ResponseWriter, user authUser) error {
 		return err
 	}
 	exp := time.Now().Add(time.Duration(sessionTTLSeconds) * time.Second)
-	s.sessionsMu.Lock()
-	s.sessions[token] = sessionData{User: user, ExpiresAt: exp}
-	s.sessionsMu.Unlock()
+	session := store.Session{TokenHash: hashToken(token), UserID: user.ID, Username: user.Username, IsAdmin: user.IsAdmin, ExpiresAt: exp}
+	if err := s.store.CreateSession(session); err != nil {
+		return err
+	}
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    token,
@@ -1532,21 +2595,34 @@ func (s *Server) invalidateSession(token string) {
 	if strings.TrimSpace(token) == "" {
 		return
 	}
-	s.sessionsMu.Lock()
-	delete(s.sessions, token)
-	s.sessionsMu.Unlock()
+	if err := s.store.DeleteSession(hashToken(token)); err != nil {
+		log.Printf("delete session: %v", err)
+	}
 }
 
 func (s *Server) invalidateUserSessions(userID int64) {
-	s.sessionsMu.Lock()
-	defer s.sessionsMu.Unlock()
-	for token, session := range s.sessions {
-		if session.User.ID == userID {
-			delete(s.sessions, token)
-		}
+	if err := s.store.DeleteUserSessions(userID); err != nil {
+		log.Printf("delete sessions of user %d: %v", userID, err)
 	}
 }
 
+// StartSessionJanitor deletes expired sessions every interval (on the leader only when leader
+// election is on). It returns immediately.
+func (s *Server) StartSessionJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !s.isLeader() {
+				continue
+			}
+			if _, err := s.store.DeleteExpiredSessions(time.Now()); err != nil {
+				log.Printf("delete expired sessions: %v", err)
+			}
+		}
+	}()
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
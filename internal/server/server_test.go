@@ -1,15 +1,31 @@
 package server
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/smtp"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"noppflow/internal/artifacts"
 	"noppflow/internal/auth"
 	"noppflow/internal/config"
 	"noppflow/internal/pipeline"
@@ -280,6 +296,253 @@ func TestServer_RejectsK8sDeployStepWithoutDeployConfig(t *testing.T) {
 	}
 }
 
+func TestServer_RunnerKubernetesRequiresJobSettings(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "seed", Name: "Seed", Repo: "https://example.com/seed.git", Branch: "main", TestCmd: "echo test", BuildCmd: "echo build"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(body map[string]interface{}) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/apps", bytes.NewReader(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	body := map[string]interface{}{
+		"name":         "Cluster Build",
+		"repo":         "https://example.com/build.git",
+		"ssh_key_name": "key-main",
+		"runner":       "kubernetes",
+		"steps":        []map[string]interface{}{{"name": "build", "cmd": "make"}},
+	}
+	if rec := create(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "k8s_namespace is required when runner is kubernetes") {
+		t.Fatalf("expected 400 for missing k8s settings, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	body["k8s_namespace"] = "builds"
+	body["k8s_service_account"] = "noppflow-runner"
+	body["k8s_runner_image"] = "ghcr.io/acme/noppflow-runner:latest"
+	rec := create(body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created config.App
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Runner != "kubernetes" || !appUsesK8sJob(created) {
+		t.Fatalf("expected app to run as a k8s job, got %+v", created)
+	}
+
+	body["steps"] = []map[string]interface{}{{"name": "infra", "terraform": map[string]interface{}{"workspace": "prod"}}}
+	if rec := create(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "terraform steps cannot run as a Kubernetes Job") {
+		t.Fatalf("expected 400 for terraform step in a k8s job, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	body["runner"] = "docker"
+	if rec := create(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "runner must be local or kubernetes") {
+		t.Fatalf("expected 400 for unknown runner, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	body["runner"] = "local"
+	body["deploy_mode"] = "kubectl"
+	body["deploy_manifest_path"] = "k8s/"
+	body["steps"] = []map[string]interface{}{{"name": "deploy", "k8s_deploy": true}}
+	if rec := create(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "runner local cannot be used with k8s_deploy steps") {
+		t.Fatalf("expected 400 for local runner with k8s_deploy, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServer_GitOpsDeployMode(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "seed", Name: "Seed", Repo: "https://example.com/seed.git", Branch: "main", TestCmd: "echo test", BuildCmd: "echo build"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(body map[string]interface{}) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/apps", bytes.NewReader(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	body := map[string]interface{}{
+		"name":         "GitOps App",
+		"repo":         "https://example.com/api.git",
+		"ssh_key_name": "key-main",
+		"deploy_mode":  "gitops",
+		"steps":        []map[string]interface{}{{"name": "deploy", "k8s_deploy": true}},
+	}
+	if rec := create(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "gitops_repo is required") {
+		t.Fatalf("expected 400 without gitops_repo, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	body["gitops_repo"] = "git@github.com:acme/deploy.git"
+	body["gitops_path"] = "./apps/api/values.yaml"
+	body["gitops_image"] = "ghcr.io/acme/api"
+	body["gitops_pr"] = "bitbucket"
+	if rec := create(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "gitops_pr must be github or gitlab") {
+		t.Fatalf("expected 400 for unknown gitops_pr, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	body["gitops_pr"] = "GitHub"
+	body["gitops_ssh_key_name"] = "missing"
+	if rec := create(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "gitops_ssh_key_name not found") {
+		t.Fatalf("expected 400 for unknown gitops key, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	body["gitops_ssh_key_name"] = "key-main"
+	rec := create(body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 without k8s settings, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created config.App
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.GitOpsPath != "apps/api/values.yaml" || created.GitOpsPR != "github" {
+		t.Fatalf("expected normalized gitops settings, got %+v", created)
+	}
+	if appUsesK8sJob(created) {
+		t.Fatal("expected gitops deploys to run on the server host")
+	}
+}
+
+func TestServer_AnsibleStepValidated(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "seed", Name: "Seed", Repo: "https://example.com/seed.git", Branch: "main", TestCmd: "echo test"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(ansible map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"name":         "VMs",
+			"repo":         "https://example.com/vms.git",
+			"ssh_key_name": "key-main",
+			"steps":        []map[string]interface{}{{"name": "deploy", "ansible": ansible}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/apps", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := create(map[string]interface{}{"inventory": "hosts.ini"}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "ansible playbook is required") {
+		t.Fatalf("expected 400 without playbook, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := create(map[string]interface{}{"playbook": "../site.yml"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for playbook outside the repo, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := create(map[string]interface{}{"playbook": "site.yml", "vault_password_env": "vault pass"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid vault_password_env, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	rec := create(map[string]interface{}{"playbook": "./site.yml", "inventory": "web1,web2,", "vault_password_env": "VAULT_PASS"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created config.App
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if a := created.Steps[0].Ansible; a == nil || a.Playbook != "site.yml" || a.Inventory != "web1,web2," {
+		t.Fatalf("expected normalized ansible step, got %+v", created.Steps)
+	}
+}
+
+func TestServer_SparsePathsNormalizedAndValidated(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "seed", Name: "Seed", Repo: "https://example.com/seed.git", Branch: "main", TestCmd: "echo test"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(paths []string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"name": "Mono", "repo": "https://example.com/mono.git", "ssh_key_name": "key-main",
+			"sparse_paths": paths,
+			"steps":        []map[string]interface{}{{"name": "build", "cmd": "make"}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/apps", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := create([]string{"./services/api/", " ", "libs"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created config.App
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.SparsePaths) != 2 || created.SparsePaths[0] != "services/api" || created.SparsePaths[1] != "libs" {
+		t.Fatalf("unexpected normalized sparse_paths: %+v", created.SparsePaths)
+	}
+
+	if rec := create([]string{"../outside"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for sparse path outside repo, got %d", rec.Code)
+	}
+}
+
+func TestServer_StepEnvValidated(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "seed", Name: "Seed", Repo: "https://example.com/seed.git", Branch: "main", TestCmd: "echo test"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(env map[string]string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"name": "Web", "repo": "https://example.com/web.git", "ssh_key_name": "key-main",
+			"steps": []map[string]interface{}{{"name": "build", "cmd": "npm run build", "env": env}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/apps", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := create(map[string]string{" NODE_ENV ": "production"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created config.App
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.Steps) != 1 || created.Steps[0].Env["NODE_ENV"] != "production" {
+		t.Fatalf("unexpected step env: %+v", created.Steps)
+	}
+
+	if rec := create(map[string]string{"BAD-NAME": "x"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid step env name, got %d", rec.Code)
+	}
+}
+
 func TestServer_GlobalEnvVarsAdminCRUDAndNonAdminForbidden(t *testing.T) {
 	h, st, _, _ := setupTestServer(t, []config.App{
 		{ID: "seed", Name: "Seed", Repo: "https://example.com/seed.git", Branch: "main", TestCmd: "echo test", BuildCmd: "echo build"},
@@ -445,57 +708,5453 @@ func TestServer_DeleteAppAlsoDeletesRuns_AndAdminDeleteBlocked(t *testing.T) {
 	}
 }
 
-func setupTestServer(t *testing.T, apps []config.App) (http.Handler, *store.Store, string, string) {
-	t.Helper()
-	baseDir := t.TempDir()
-	dbPath := filepath.Join(baseDir, "test.db")
-	appsPath := filepath.Join(baseDir, "apps.yaml")
-	staticDir := filepath.Join(baseDir, "web")
+func TestServer_TriggerRunRejectedByQuota(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateRun("app-a", "", "admin"); err != nil {
+		t.Fatal(err)
+	}
 
-	if err := config.SaveApps(appsPath, apps); err != nil {
+	quotaBody, _ := json.Marshal(map[string]interface{}{"scope": "app", "scope_id": "app-a", "max_concurrent_runs": 1})
+	reqQuota := httptest.NewRequest(http.MethodPut, "/api/quotas", bytes.NewReader(quotaBody))
+	reqQuota.Header.Set("Content-Type", "application/json")
+	reqQuota.AddCookie(adminCookie)
+	recQuota := httptest.NewRecorder()
+	h.ServeHTTP(recQuota, reqQuota)
+	if recQuota.Code != http.StatusOK {
+		t.Fatalf("expected 200 setting quota, got %d body=%s", recQuota.Code, recQuota.Body.String())
+	}
+
+	reqRun := httptest.NewRequest(http.MethodPost, "/api/apps/app-a/run", nil)
+	reqRun.AddCookie(adminCookie)
+	recRun := httptest.NewRecorder()
+	h.ServeHTTP(recRun, reqRun)
+	if recRun.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 when quota is exceeded, got %d body=%s", recRun.Code, recRun.Body.String())
+	}
+	var resp map[string]string
+	if err := json.NewDecoder(recRun.Body).Decode(&resp); err != nil {
 		t.Fatal(err)
 	}
-	if err := os.MkdirAll(staticDir, 0o755); err != nil {
+	if resp["reason"] != "max_concurrent_runs" {
+		t.Fatalf("expected max_concurrent_runs reason, got %+v", resp)
+	}
+}
+
+func TestServer_ArchiveAppHidesAndBlocksRuns(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, st, appsPath, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateRun("app-a", "", "admin"); err != nil {
 		t.Fatal(err)
 	}
-	if err := os.WriteFile(filepath.Join(staticDir, "index.html"), []byte("ok"), 0o644); err != nil {
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	listIDs := func(path string) []string {
+		rec := do(http.MethodGet, path)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list %s: expected 200, got %d", path, rec.Code)
+		}
+		var out []struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0, len(out))
+		for _, a := range out {
+			ids = append(ids, a.ID)
+		}
+		return ids
+	}
+
+	if rec := do(http.MethodPost, "/api/apps/app-a/archive"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 archiving, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if ids := listIDs("/api/apps"); len(ids) != 1 || ids[0] != "app-b" {
+		t.Fatalf("expected archived app hidden, got %v", ids)
+	}
+	if ids := listIDs("/api/apps?archived=true"); len(ids) != 1 || ids[0] != "app-a" {
+		t.Fatalf("expected archived filter to list app-a, got %v", ids)
+	}
+	if rec := do(http.MethodPost, "/api/apps/app-a/run"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 triggering archived app, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	runs, err := st.ListRuns("app-a", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("expected run history preserved, got %d runs", len(runs))
+	}
+	saved, err := config.LoadApps(appsPath)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if !saved[0].Archived {
+		t.Fatalf("expected archived flag persisted, got %+v", saved[0])
+	}
 
-	st, err := store.New("sqlite3", dbPath)
+	if rec := do(http.MethodPost, "/api/apps/app-a/unarchive"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 unarchiving, got %d", rec.Code)
+	}
+	if ids := listIDs("/api/apps"); len(ids) != 2 {
+		t.Fatalf("expected both apps listed after unarchive, got %v", ids)
+	}
+}
+
+func TestServer_SoftDeleteAndRestoreRun(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	hash, err := auth.HashPassword("pw")
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Cleanup(func() { _ = st.Close() })
+	userID, err := st.CreateUser("dev", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID, err := st.CreateGroup("devs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(userID, []int64{groupID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(groupID, []string{"app-a"}); err != nil {
+		t.Fatal(err)
+	}
+	devCookie := loginAndCookie(t, h, "dev", "pw")
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runPath := "/api/runs/" + strconv.FormatInt(runID, 10)
 
-	adminHash, err := auth.HashPassword("admin")
+	do := func(method, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodDelete, runPath, devCookie); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin delete, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, runPath, adminCookie); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 deleting run, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, runPath, devCookie); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted run hidden from non-admin, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, runPath, adminCookie); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deleted_by":"admin"`) {
+		t.Fatalf("expected admin to audit deleted run, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/api/runs?deleted=true", devCookie); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 listing deleted runs as non-admin, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/runs?deleted=true", adminCookie); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"total":1`) {
+		t.Fatalf("expected one deleted run listed, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/api/runs", adminCookie); !strings.Contains(rec.Body.String(), `"total":0`) {
+		t.Fatalf("expected deleted run excluded from listing, body=%s", rec.Body.String())
+	}
+	if rec := do(http.MethodPost, runPath+"/restore", adminCookie); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 restoring run, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, runPath, devCookie); rec.Code != http.StatusOK {
+		t.Fatalf("expected restored run visible, got %d", rec.Code)
+	}
+}
+
+func TestServer_SearchRespectsAppAccess(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-web", Name: "Web Frontend", Repo: "https://example.com/web.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-billing", Name: "Billing", Repo: "https://example.com/billing.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	hash, err := auth.HashPassword("pw")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+	userID, err := st.CreateUser("dev", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID, err := st.CreateGroup("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(userID, []int64{groupID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(groupID, []string{"app-web"}); err != nil {
+		t.Fatal(err)
+	}
+	devCookie := loginAndCookie(t, h, "dev", "pw")
+	webRun, err := st.CreateRun("app-web", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(webRun, "failed", "npm ERR! timeout fetching registry\n"); err != nil {
+		t.Fatal(err)
+	}
+	billingRun, err := st.CreateRun("app-billing", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(billingRun, "failed", "timeout fetching registry\n"); err != nil {
 		t.Fatal(err)
 	}
 
-	runner := pipeline.NewRunner(filepath.Join(baseDir, "work"))
-	srv := New(apps, st, runner, appsPath, staticDir)
-	return srv.Handler(), st, appsPath, staticDir
+	search := func(cookie *http.Cookie, query string) []map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("search %s: expected 200, got %d body=%s", query, rec.Code, rec.Body.String())
+		}
+		var body struct {
+			Results []map[string]interface{} `json:"results"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Results
+	}
+
+	if res := search(adminCookie, "q=bill"); len(res) != 1 || res[0]["type"] != "app" || res[0]["app_id"] != "app-billing" {
+		t.Fatalf("unexpected app results: %+v", res)
+	}
+	if res := search(adminCookie, "q=timeout+fetching&logs=true"); len(res) != 2 {
+		t.Fatalf("expected both log hits for admin, got %+v", res)
+	}
+	res := search(devCookie, "q=timeout+fetching&logs=true")
+	if len(res) != 1 || res[0]["type"] != "run" || res[0]["app_id"] != "app-web" {
+		t.Fatalf("expected only accessible run for dev, got %+v", res)
+	}
+	if res := search(devCookie, "q=bill"); len(res) != 0 {
+		t.Fatalf("expected inaccessible app hidden, got %+v", res)
+	}
 }
 
-func loginAndCookie(t *testing.T, h http.Handler, username, password string) *http.Cookie {
-	t.Helper()
-	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
-	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	rec := httptest.NewRecorder()
-	h.ServeHTTP(rec, req)
-	if rec.Code != http.StatusOK {
-		t.Fatalf("login failed for %s, status=%d body=%s", username, rec.Code, rec.Body.String())
+func TestServer_AppTagsAndFiltering(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
 	}
-	for _, c := range rec.Result().Cookies() {
-		if c.Name == sessionCookieName {
-			return c
+	h, st, _, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	if _, err := st.CreateRun("app-a", "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateRun("app-b", "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			b, _ := json.Marshal(body)
+			reader = bytes.NewReader(b)
+		} else {
+			reader = bytes.NewReader(nil)
 		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPut, "/api/apps/app-a/tags", map[string]interface{}{"tags": []string{" Team:Payments ", "go", "go"}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"tags":["go","team:payments"]`) {
+		t.Fatalf("expected normalized tags, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPut, "/api/apps/app-b/tags", map[string]interface{}{"tags": []string{"bad tag"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid tag, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/api/apps/missing/tags", map[string]interface{}{"tags": []string{"go"}}); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown app, got %d", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/api/apps?tag=team:payments", nil)
+	var listed []struct {
+		ID   string   `json:"id"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != "app-a" || len(listed[0].Tags) != 2 {
+		t.Fatalf("unexpected filtered apps: %+v", listed)
+	}
+
+	rec = do(http.MethodGet, "/api/runs?tag=go", nil)
+	var runs struct {
+		Runs  []store.Run `json:"runs"`
+		Total int64       `json:"total"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&runs); err != nil {
+		t.Fatal(err)
+	}
+	if runs.Total != 1 || len(runs.Runs) != 1 || runs.Runs[0].AppID != "app-a" {
+		t.Fatalf("unexpected filtered runs: %+v", runs)
+	}
+}
+
+func TestServer_FavoriteAppsListedFirst(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-c", Name: "App C", Repo: "https://example.com/c.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, _, _, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	listIDs := func() []string {
+		rec := do(http.MethodGet, "/api/apps")
+		var listed []struct {
+			ID       string `json:"id"`
+			Favorite bool   `json:"favorite"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0, len(listed))
+		for _, a := range listed {
+			id := a.ID
+			if a.Favorite {
+				id += "*"
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	for _, appID := range []string{"app-c", "app-b"} {
+		if rec := do(http.MethodPut, "/api/apps/"+appID+"/favorite"); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 favoriting %s, got %d body=%s", appID, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := do(http.MethodPut, "/api/apps/missing/favorite"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown app, got %d", rec.Code)
+	}
+	if got := strings.Join(listIDs(), ","); got != "app-c*,app-b*,app-a" {
+		t.Fatalf("expected favorites first, got %s", got)
+	}
+
+	if rec := do(http.MethodDelete, "/api/apps/app-c/favorite"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 removing favorite, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/apps/app-c/favorite"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 removing missing favorite, got %d", rec.Code)
+	}
+	if got := strings.Join(listIDs(), ","); got != "app-b*,app-a,app-c" {
+		t.Fatalf("unexpected order after unfavorite, got %s", got)
+	}
+}
+
+func TestServer_RunComments(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-web", Name: "Web", Repo: "https://example.com/web.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-billing", Name: "Billing", Repo: "https://example.com/billing.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	hash, err := auth.HashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := st.CreateUser("dev", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID, err := st.CreateGroup("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(userID, []int64{groupID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(groupID, []string{"app-web"}); err != nil {
+		t.Fatal(err)
+	}
+	devCookie := loginAndCookie(t, h, "dev", "pw")
+	webRun, err := st.CreateRun("app-web", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	billingRun, err := st.CreateRun("app-billing", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	webPath := "/api/runs/" + strconv.FormatInt(webRun, 10)
+
+	rec := do(devCookie, http.MethodPost, webPath+"/comments", `{"body":" failed due to registry outage, safe to ignore "}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created store.RunComment
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Author != "dev" || created.Body != "failed due to registry outage, safe to ignore" {
+		t.Fatalf("unexpected comment: %+v", created)
+	}
+	if rec := do(devCookie, http.MethodPost, webPath+"/comments", `{"body":"  "}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for empty comment, got %d", rec.Code)
+	}
+	billingPath := "/api/runs/" + strconv.FormatInt(billingRun, 10)
+	if rec := do(devCookie, http.MethodPost, billingPath+"/comments", `{"body":"hi"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 commenting on inaccessible run, got %d", rec.Code)
+	}
+
+	rec = do(adminCookie, http.MethodGet, webPath, "")
+	var detail struct {
+		ID       int64              `json:"id"`
+		Comments []store.RunComment `json:"comments"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.ID != webRun || len(detail.Comments) != 1 || detail.Comments[0].ID != created.ID {
+		t.Fatalf("expected comment in run details, got %+v", detail)
+	}
+
+	commentPath := webPath + "/comments/" + strconv.FormatInt(created.ID, 10)
+	if rec := do(devCookie, http.MethodDelete, billingPath+"/comments/"+strconv.FormatInt(created.ID, 10), ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for inaccessible run, got %d", rec.Code)
+	}
+	if rec := do(adminCookie, http.MethodDelete, billingPath+"/comments/"+strconv.FormatInt(created.ID, 10), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for comment of another run, got %d", rec.Code)
+	}
+	if rec := do(devCookie, http.MethodDelete, commentPath, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected author to delete comment, got %d", rec.Code)
+	}
+	if rec := do(devCookie, http.MethodDelete, commentPath, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for deleted comment, got %d", rec.Code)
+	}
+}
+
+func TestServer_RunLogPlainAndANSI(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "success", "=== Step: test ===\n\x1b[31mFAIL\x1b[0m retry\n"); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	base := "/api/runs/" + strconv.FormatInt(runID, 10)
+
+	rec := get(base + "/log?download=true")
+	if rec.Code != http.StatusOK || rec.Body.String() != "=== Step: test ===\nFAIL retry\n" {
+		t.Fatalf("expected plain log, got %d %q", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), "run-"+strconv.FormatInt(runID, 10)+".log") {
+		t.Fatalf("expected attachment header, got %q", rec.Header().Get("Content-Disposition"))
+	}
+	if rec := get(base + "/log?ansi=true"); !strings.Contains(rec.Body.String(), "\x1b[31m") {
+		t.Fatalf("expected raw log with escapes, got %q", rec.Body.String())
+	}
+
+	rec = get(base)
+	var detail struct {
+		Chunks []pipeline.LogChunk `json:"chunks"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Chunks) != 1 || detail.Chunks[0].Step != "test" || !detail.Chunks[0].ANSI {
+		t.Fatalf("unexpected chunks: %+v", detail.Chunks)
+	}
+}
+
+func TestServer_DurationBudgetFlagsSlowRun(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "budget.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	received := make(chan notification, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decode notification: %v", err)
+		}
+		received <- n
+	}))
+	defer hook.Close()
+	srv := New(nil, st, nil, "", "")
+	app := config.App{ID: "app-a", Name: "App A", ExpectedDurationSec: 60, SlowFactor: 2, NotifyWebhook: hook.URL}
+
+	fast, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.checkDurationBudget(fast, app, 2*time.Minute)
+	if run, _ := st.GetRun(fast); run.Slow {
+		t.Fatalf("run within budget should not be slow")
+	}
+
+	slow, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.checkDurationBudget(slow, app, 3*time.Minute)
+	if run, _ := st.GetRun(slow); !run.Slow {
+		t.Fatalf("expected run over budget to be flagged slow")
+	}
+	select {
+	case n := <-received:
+		if n.Event != "run.slow" || n.RunID != slow || n.AppID != "app-a" || !strings.Contains(n.Message, "expected 1m0s") {
+			t.Fatalf("unexpected notification: %+v", n)
+		}
+	default:
+		t.Fatal("expected run.slow notification")
+	}
+}
+
+func TestServer_RunFailedNotifiesOwner(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "owner.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	received := make(chan notification, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decode notification: %v", err)
+		}
+		received <- n
+	}))
+	defer hook.Close()
+	srv := New(nil, st, nil, "", "")
+	app := config.App{ID: "app-a", Name: "App A", NotifyWebhook: hook.URL, Owner: &config.AppOwner{
+		Team: " payments ", OnCall: "@alice", SlackChannel: "#payments-alerts",
+	}}
+	if err := validateOwner(&app); err != nil {
+		t.Fatal(err)
+	}
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.notifyRunFailed(runID, app, "oom")
+	select {
+	case n := <-received:
+		if n.Event != "run.failed" || n.RunID != runID || n.Owner == nil || n.Owner.Team != "payments" || !strings.Contains(n.Message, "failed (oom)") ||
+			!strings.Contains(n.Message, "owner: team payments, on-call @alice, Slack #payments-alerts") {
+			t.Fatalf("unexpected notification: %+v", n)
+		}
+	default:
+		t.Fatal("expected run.failed notification")
+	}
+
+	empty := config.App{Owner: &config.AppOwner{Team: " "}}
+	if err := validateOwner(&empty); err != nil || empty.Owner != nil {
+		t.Fatalf("expected an empty owner to be removed, got %+v, %v", empty.Owner, err)
+	}
+	bad := config.App{Owner: &config.AppOwner{SlackChannel: "payments alerts"}}
+	if err := validateOwner(&bad); err == nil {
+		t.Fatal("expected an invalid slack_channel to be rejected")
+	}
+}
+
+func TestServer_FailureStats(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{{ID: "app-a", Name: "App A"}, {ID: "app-b", Name: "App B"}})
+	srv := New(nil, st, nil, "", "")
+	logs := map[string][]string{
+		"app-a": {"step build\nfatal: Authentication failed for 'https://git.example.com/a.git/'", "--- FAIL: TestThing (0.01s)\nFAIL", "npm ERR! something odd"},
+		"app-b": {"Killed: container OOMKilled"},
+	}
+	for appID, runLogs := range logs {
+		for _, runLog := range runLogs {
+			id, err := st.CreateRun(appID, "", "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := st.UpdateRunStatus(id, "failed", runLog); err != nil {
+				t.Fatal(err)
+			}
+			srv.classifyFailure(id, runLog)
+		}
+	}
+	runs, err := st.ListRuns("app-b", 10, 0)
+	if err != nil || len(runs) != 1 || runs[0].FailureReason != "oom" {
+		t.Fatalf("expected app-b run labeled oom, got %+v, %v", runs, err)
+	}
+
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	req := httptest.NewRequest(http.MethodGet, "/api/stats/failures?days=7", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failure stats: %d %s", rec.Code, rec.Body.String())
+	}
+	var stats struct {
+		Failed  int64               `json:"failed"`
+		Reasons []failureReasonStat `json:"reasons"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int64)
+	for _, r := range stats.Reasons {
+		got[r.Reason] = r.Count
+	}
+	if stats.Failed != 4 || got["git_auth"] != 1 || got["test_failure"] != 1 || got["oom"] != 1 || got[unclassifiedFailure] != 1 {
+		t.Fatalf("unexpected failure stats: %+v", stats)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/stats/failures?app_id=app-b", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || stats.Failed != 1 || len(stats.Reasons) != 1 || stats.Reasons[0].Reason != "oom" {
+		t.Fatalf("unexpected app-b failure stats: %d %+v", rec.Code, stats)
+	}
+
+	hash, err := auth.HashPassword("dev12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateUser("dev", hash, false); err != nil {
+		t.Fatal(err)
+	}
+	devCookie := loginAndCookie(t, h, "dev", "dev12345")
+	req = httptest.NewRequest(http.MethodGet, "/api/stats/failures", nil)
+	req.AddCookie(devCookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || stats.Failed != 0 {
+		t.Fatalf("expected no failures for a user without apps: %d %+v", rec.Code, stats)
+	}
+}
+
+func TestServer_UsageReport(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{{ID: "app-a", Name: "App A"}, {ID: "app-b", Name: "App B"}, {ID: "app-c", Name: "App C"}})
+	now := time.Now().UTC().Add(-time.Hour)
+	seed := []struct {
+		appID, status string
+		minutes       int
+	}{
+		{"app-a", "success", 10}, {"app-a", "failed", 5}, {"app-a", "success", 15},
+		{"app-b", "failed", 2}, {"app-c", "success", 3},
+	}
+	for _, s := range seed {
+		if _, err := st.CreateFinishedRun(s.appID, "", "admin", s.status, now, now.Add(time.Duration(s.minutes)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.CreateFinishedRun("app-a", "", "admin", "success", now.AddDate(0, 0, -40), now.AddDate(0, 0, -40).Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppTags("app-a", []string{"backend", "payments"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppTags("app-b", []string{"backend"}); err != nil {
+		t.Fatal(err)
+	}
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	get := func(c *http.Cookie, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/reports"+query, nil)
+		req.AddCookie(c)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	type report struct {
+		Groups []usageReportRow `json:"groups"`
+		Total  usageReportRow   `json:"total"`
+	}
+
+	rec := get(cookie, "?group_by=tag")
+	var rep report
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("report by tag: %d %v", rec.Code, err)
+	}
+	if rep.Total.Runs != 5 || rep.Total.Failed != 2 || rep.Total.BuildMinutes != 35 || rep.Total.FailureRate != 0.4 {
+		t.Fatalf("unexpected total: %+v", rep.Total)
+	}
+	got := make(map[string]usageReportRow)
+	for _, row := range rep.Groups {
+		got[row.Group] = row
+	}
+	if len(rep.Groups) != 3 || rep.Groups[0].Group != "backend" || got["backend"].Runs != 4 || got["backend"].BuildMinutes != 32 ||
+		got["payments"].Runs != 3 || got[untaggedReportGroup].BuildMinutes != 3 {
+		t.Fatalf("unexpected groups: %+v", rep.Groups)
+	}
+
+	rec = get(cookie, "?group_by=app&format=csv&days=7")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("csv report: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || records[0][0] != "app" || records[1][0] != "app-a" || records[1][2] != "3" || records[1][6] != "30.00" || records[4][0] != "(total)" {
+		t.Fatalf("unexpected csv: %v", records)
+	}
+
+	if rec := get(cookie, "?group_by=owner"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown group_by, got %d", rec.Code)
+	}
+
+	hash, err := auth.HashPassword("dev12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devID, err := st.CreateUser("dev", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID, err := st.CreateGroup("team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(groupID, []string{"app-b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(devID, []int64{groupID}); err != nil {
+		t.Fatal(err)
+	}
+	rec = get(loginAndCookie(t, h, "dev", "dev12345"), "?group_by=group")
+	rep = report{}
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil || len(rep.Groups) != 1 || rep.Groups[0].Group != "team-b" || rep.Total.Runs != 1 {
+		t.Fatalf("expected only team-b for the dev user: %d %+v", rec.Code, rep)
+	}
+}
+
+func TestServer_AutoRetry(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "failure_rules.yaml")
+	if err := os.WriteFile(rulesPath, []byte("rules:\n  - reason: clone_failed\n    pattern: 'git clone: exit status'\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := config.LoadFailureRules(rulesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.New("sqlite3", filepath.Join(dir, "retry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	app := config.App{ID: "app-a", Name: "App A", Repo: filepath.Join(dir, "missing.git"), Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test",
+		AutoRetry: &config.AutoRetry{MaxRetries: 2, Reasons: []string{"clone_failed"}}}
+	srv := New([]config.App{app}, st, pipeline.NewRunner(filepath.Join(dir, "work")), "", "")
+	srv.SetFailureRules(rules)
+	if _, err := srv.startRun(app, "admin", map[string]string{"RELEASE": "1.2.3"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		runs, err := st.ListRuns("app-a", 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) == 3 && runs[0].Status == "failed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the run and two retries to fail, got %+v", runs)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n, err := st.CountRuns("app-a"); err != nil || n != 3 {
+		t.Fatalf("expected retries to stop after max_retries, got %d runs (%v)", n, err)
+	}
+	for id := int64(1); id <= 3; id++ {
+		run, err := st.GetRun(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.Attempt != int(id) || run.RetryOfRunID != id-1 || run.FailureReason != "clone_failed" || run.TriggeredBy != "admin" {
+			t.Fatalf("unexpected attempt %d: %+v", id, run)
+		}
+		if env, err := st.ListRunEnv(id); err != nil || len(env) != 1 || env[0].Value != "1.2.3" {
+			t.Fatalf("expected the run env on attempt %d, got %+v (%v)", id, env, err)
+		}
+	}
+
+	app = config.App{AutoRetry: &config.AutoRetry{MaxRetries: 0}}
+	if err := validateAutoRetry(&app); err != nil || app.AutoRetry != nil {
+		t.Fatalf("expected max_retries 0 to remove auto_retry, got %+v, %v", app.AutoRetry, err)
+	}
+	for _, bad := range []config.AutoRetry{{MaxRetries: maxAutoRetries + 1}, {MaxRetries: 1, Reasons: []string{"Network Timeout"}}} {
+		app := config.App{AutoRetry: &bad}
+		if err := validateAutoRetry(&app); err == nil {
+			t.Fatalf("expected auto_retry %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestServer_RunHooks(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.New("sqlite3", filepath.Join(dir, "hooks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	t.Setenv("CMDB_TOKEN", "secret-token")
+	received := make(chan hookPayload, 1)
+	var auth string
+	cmdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		var p hookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("decode hook payload: %v", err)
+		}
+		received <- p
+	}))
+	defer cmdb.Close()
+	out := filepath.Join(dir, "hook.out")
+	srv := New(nil, st, nil, "", "")
+	srv.SetHooks(config.HooksConfig{Hooks: []config.Hook{
+		{Name: "cmdb", Events: []string{config.HookRunFinished}, URL: cmdb.URL, Headers: map[string]string{"Authorization": "Bearer ${CMDB_TOKEN}"}},
+		{Name: "ticket", Events: []string{config.HookRunFinished}, Apps: []string{"app-a"},
+			Command: []string{"sh", "-c", `echo "$NOPPFLOW_HOOK_EVENT $NOPPFLOW_RUN_ID $NOPPFLOW_RUN_STATUS" > "$0"; cat >> "$0"`, out}},
+		{Name: "other-app", Events: []string{config.HookRunFinished}, Apps: []string{"app-b"}, Command: []string{"false"}},
+	}})
+	app := config.App{ID: "app-a", Name: "App A", Environment: "prod"}
+	runID, err := st.CreateRun("app-a", "abc123", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "success", "ok"); err != nil {
+		t.Fatal(err)
+	}
+	srv.runHooks(config.HookRunFinished, runID, app)
+	select {
+	case p := <-received:
+		if p.Event != config.HookRunFinished || p.Hook != "cmdb" || p.RunID != runID || p.Status != "success" ||
+			p.CommitSHA != "abc123" || p.Environment != "prod" || p.EndedAt == nil || auth != "Bearer secret-token" {
+			t.Fatalf("unexpected url hook call %+v (Authorization %q)", p, auth)
+		}
+	default:
+		t.Fatal("expected the url hook to be called")
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, payload, _ := strings.Cut(string(data), "\n")
+	if first != fmt.Sprintf("run.finished %d success", runID) || !strings.Contains(payload, `"hook":"ticket"`) {
+		t.Fatalf("unexpected command hook output %q", data)
+	}
+
+	// No hook fires on run.started; the run is not even loaded.
+	srv.runHooks(config.HookRunStarted, 9999, app)
+}
+
+func TestServer_JiraIntegration(t *testing.T) {
+	app := config.App{ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", Environment: "prod", Steps: []config.Step{{Name: "deploy", K8sDeploy: true}}}
+	h, st, _, _ := setupTestServer(t, []config.App{app})
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	var mu sync.Mutex
+	var calls []string
+	jira := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		calls = append(calls, fmt.Sprintf("%s %s %s:%s %s", r.Method, r.URL.Path, user, pass, body))
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/OPS-2/comment"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodGet:
+			_, _ = w.Write([]byte(`{"transitions":[{"id":"11","name":"Start","to":{"name":"In Progress"}},{"id":"31","name":"Ship","to":{"name":"Released"}}]}`))
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer jira.Close()
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/integrations/jira", strings.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := put(`{"base_url":"` + jira.URL + `/","username":"ci@acme.io","environments":[{"environment":"prod","comment":true}]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a token to be required, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := put(`{"base_url":"` + jira.URL + `","username":"ci@acme.io","token":"t","environments":[{"environment":"prod"}]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an environment without action to be rejected, got %d", rec.Code)
+	}
+	if rec := put(`{"base_url":"` + jira.URL + `/","username":"ci@acme.io","token":"secret","environments":[{"environment":"prod","comment":true,"transition":" released "}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("set jira: %d %s", rec.Code, rec.Body.String())
+	}
+	// An empty token keeps the stored one.
+	rec := put(`{"base_url":"` + jira.URL + `","username":"ci@acme.io","environments":[{"environment":"prod","comment":true,"transition":"released"}]}`)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "secret") || !strings.Contains(rec.Body.String(), `"configured":true`) {
+		t.Fatalf("update jira: %d %s", rec.Code, rec.Body.String())
+	}
+
+	srv := New([]config.App{app}, st, nil, "", "")
+	sha := strings.Repeat("c", 40)
+	runID, err := st.CreateRun("api", sha, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.recordRunIssues(runID, app, pipeline.Result{Success: true, Log: "commit: " + sha + "\nissues: PAY-1, OPS-2\n"}, sha)
+	var notes []store.RunNotification
+	for i := 0; i < 100 && len(notes) < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if notes, err = st.ListRunNotifications(runID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(notes) != 2 || notes[0].Event != "jira.updated" || notes[0].Message != "updated PAY-1" || notes[1].Event != "jira.failed" || !strings.Contains(notes[1].Message, "OPS-2") {
+		t.Fatalf("unexpected notifications %+v", notes)
+	}
+	mu.Lock()
+	got := strings.Join(calls, "\n")
+	mu.Unlock()
+	for _, want := range []string{
+		"POST /rest/api/2/issue/PAY-1/comment ci@acme.io:secret {\"body\":\"Deployed to prod by API run #" + strconv.FormatInt(runID, 10) + " (commit cccccccccccc).\"}",
+		"GET /rest/api/2/issue/PAY-1/transitions",
+		`POST /rest/api/2/issue/PAY-1/transitions ci@acme.io:secret {"transition":{"id":"31"}}`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in jira calls:\n%s", want, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/runs/"+strconv.FormatInt(runID, 10), nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var detail struct {
+		Issues []runIssue `json:"issues"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Issues) != 2 || detail.Issues[0].Key != "PAY-1" || detail.Issues[0].URL != jira.URL+"/browse/PAY-1" {
+		t.Fatalf("unexpected run issues %+v", detail.Issues)
+	}
+
+	// Issues of runs that deploy nowhere are linked but left alone in Jira.
+	mu.Lock()
+	before := len(calls)
+	mu.Unlock()
+	build := config.App{ID: "api", Name: "API", Steps: []config.Step{{Name: "test", Cmd: "true"}}}
+	buildRun, _ := st.CreateRun("api", sha, "admin")
+	srv.recordRunIssues(buildRun, build, pipeline.Result{Success: true, Log: "issues: PAY-3\n"}, sha)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	after := len(calls)
+	mu.Unlock()
+	if keys, _ := st.ListRunIssues(buildRun); len(keys) != 1 || after != before {
+		t.Fatalf("expected PAY-3 recorded without jira calls, got %v and %d calls", keys, after-before)
+	}
+}
+
+func TestServer_GitProviderRepoBrowsing(t *testing.T) {
+	h, _, _, _ := setupTestServer(t, nil)
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	var auths []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization")+r.Header.Get("PRIVATE-TOKEN"))
+		switch r.URL.EscapedPath() {
+		case "/gh/orgs/alice/repos":
+			w.WriteHeader(http.StatusNotFound)
+		case "/gh/users/alice/repos":
+			_, _ = w.Write([]byte(`[{"full_name":"alice/api","name":"api","default_branch":"main","clone_url":"https://github.com/alice/api.git","ssh_url":"git@github.com:alice/api.git","private":true},
+				{"full_name":"alice/web","name":"web","default_branch":"trunk","clone_url":"https://github.com/alice/web.git"}]`))
+		case "/gh/repos/alice/api/branches":
+			_, _ = w.Write([]byte(`[{"name":"main","commit":{"sha":"abc"}},{"name":"release","commit":{"sha":"def"}}]`))
+		case "/gl/groups/acme%2Fplatform/projects":
+			if r.URL.Query().Get("include_subgroups") != "true" || r.URL.Query().Get("per_page") != "100" {
+				t.Errorf("unexpected gitlab query %s", r.URL.RawQuery)
+			}
+			_, _ = w.Write([]byte(`[{"path_with_namespace":"acme/platform/billing","name":"billing","default_branch":"main","http_url_to_repo":"https://gitlab.com/acme/platform/billing.git","visibility":"internal"}]`))
+		case "/gl/projects/acme%2Fplatform%2Fbilling/repository/branches":
+			_, _ = w.Write([]byte(`[{"name":"main","commit":{"id":"123"}}]`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.EscapedPath())
+			w.WriteHeader(http.StatusTeapot)
+		}
+	}))
+	defer api.Close()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do(http.MethodPost, "/api/git-providers", `{"name":"bitbucket","kind":"bitbucket","token":"t"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown kind rejected, got %d", rec.Code)
+	}
+	var gh, gl store.GitProvider
+	for _, c := range []struct {
+		body string
+		into *store.GitProvider
+	}{
+		{`{"name":"github","kind":"github","api_url":"` + api.URL + `/gh/","token":"gh-secret"}`, &gh},
+		{`{"name":"gitlab","kind":"gitlab","api_url":"` + api.URL + `/gl","token":"gl-secret"}`, &gl},
+	} {
+		rec := do(http.MethodPost, "/api/git-providers", c.body)
+		if rec.Code != http.StatusCreated || strings.Contains(rec.Body.String(), "secret") {
+			t.Fatalf("create provider: %d %s", rec.Code, rec.Body.String())
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), c.into)
+	}
+	if gh.APIURL != api.URL+"/gh" {
+		t.Fatalf("expected the api url without trailing slash, got %q", gh.APIURL)
+	}
+	if rec := do(http.MethodPost, "/api/git-providers", `{"name":"default","kind":"github","token":"t"}`); !strings.Contains(rec.Body.String(), `"api_url":"https://api.github.com"`) {
+		t.Fatalf("expected the github.com API by default, got %s", rec.Body.String())
+	}
+
+	rec := do(http.MethodGet, fmt.Sprintf("/api/git-providers/%d/repos?owner=alice&q=AP", gh.ID), "")
+	var repos []providerRepo
+	if err := json.Unmarshal(rec.Body.Bytes(), &repos); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("list repos: %d %s", rec.Code, rec.Body.String())
+	}
+	if len(repos) != 1 || repos[0].FullName != "alice/api" || repos[0].CloneURL != "https://github.com/alice/api.git" || !repos[0].Private {
+		t.Fatalf("expected the filtered user repos, got %+v", repos)
+	}
+	if auths[0] != "Bearer gh-secret" {
+		t.Fatalf("unexpected github auth %q", auths[0])
+	}
+	rec = do(http.MethodGet, fmt.Sprintf("/api/git-providers/%d/branches?repo=alice/api", gh.ID), "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `{"name":"release","commit_sha":"def"}`) {
+		t.Fatalf("list branches: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodGet, fmt.Sprintf("/api/git-providers/%d/repos?owner=acme/platform", gl.ID), "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"full_name":"acme/platform/billing"`) || !strings.Contains(rec.Body.String(), `"private":true`) {
+		t.Fatalf("list gitlab repos: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodGet, fmt.Sprintf("/api/git-providers/%d/branches?repo=acme/platform/billing", gl.ID), "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"commit_sha":"123"`) {
+		t.Fatalf("list gitlab branches: %d %s", rec.Code, rec.Body.String())
+	}
+	if auths[len(auths)-1] != "gl-secret" {
+		t.Fatalf("unexpected gitlab auth %q", auths[len(auths)-1])
+	}
+	if rec := do(http.MethodGet, fmt.Sprintf("/api/git-providers/%d/branches?repo=api", gh.ID), ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a repo without owner rejected, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/git-providers/%d", gl.ID), ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete provider: %d", rec.Code)
+	}
+}
+
+func TestServer_ListAppCommits(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	repoDir := t.TempDir()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=Alice", "GIT_AUTHOR_EMAIL=alice@example.com", "GIT_COMMITTER_NAME=Alice", "GIT_COMMITTER_EMAIL=alice@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	src := filepath.Join(repoDir, "src")
+	bare := filepath.Join(repoDir, "origin.git")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	git(src, "init", "-q", "-b", "main")
+	for _, msg := range []string{"first", "second", "third"} {
+		git(src, "commit", "-q", "--allow-empty", "-m", msg)
+	}
+	git(repoDir, "clone", "-q", "--bare", src, "origin.git")
+	head := git(src, "rev-parse", "HEAD")
+	second := git(src, "rev-parse", "HEAD~1")
+
+	app := config.App{ID: "app-a", Name: "App A", Repo: bare, Branch: "main", SSHKeyName: "deploy"}
+	h, st, appsPath, _ := setupTestServer(t, []config.App{app})
+	if _, err := st.CreateSSHKey("deploy", "not-a-real-key"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	runID, err := st.CreateFinishedRun("app-a", second, "admin", "success", now.Add(-time.Hour), now.Add(-50*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	list := func(query string) (int, map[string]interface{}, []appCommit) {
+		req := httptest.NewRequest(http.MethodGet, "/api/apps/app-a/commits"+query, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var body map[string]interface{}
+		var commits struct {
+			Commits []appCommit `json:"commits"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		_ = json.Unmarshal(rec.Body.Bytes(), &commits)
+		return rec.Code, body, commits.Commits
+	}
+
+	code, body, commits := list("?limit=2")
+	if code != http.StatusOK || body["source"] != "fetch" || body["branch"] != "main" {
+		t.Fatalf("expected commits fetched without a workspace, got %d %v", code, body)
+	}
+	if len(commits) != 2 || commits[0].SHA != head || commits[0].Subject != "third" || commits[0].Author != "Alice" || commits[0].Time.IsZero() || commits[0].LastRun != nil {
+		t.Fatalf("unexpected head commit %+v", commits)
+	}
+	if commits[1].SHA != second || commits[1].LastRun == nil || commits[1].LastRun.ID != runID || commits[1].LastRun.Status != "success" {
+		t.Fatalf("expected the run of the second commit, got %+v", commits[1])
+	}
+
+	// Once a run has cloned the branch, the workspace is used.
+	git(filepath.Dir(appsPath), "clone", "-q", bare, filepath.Join("work", "app-a"))
+	if code, body, commits := list(""); code != http.StatusOK || body["source"] != "workspace" || len(commits) != 3 {
+		t.Fatalf("expected all commits from the workspace, got %d %v %d", code, body, len(commits))
+	}
+	if code, _, _ := list("?limit=500"); code != http.StatusBadRequest {
+		t.Fatalf("expected an out-of-range limit rejected, got %d", code)
+	}
+}
+
+func TestServer_WorkspaceBrowser(t *testing.T) {
+	h, st, appsPath, _ := setupTestServer(t, []config.App{{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main"}})
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	get := func(c *http.Cookie, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.AddCookie(c)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get(cookie, "/api/apps/app-a/workspace"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before the first run, got %d", rec.Code)
+	}
+
+	ws := filepath.Join(filepath.Dir(appsPath), "work", "app-a")
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	files := map[string]string{"main.go": "package main\n", "build/out.txt": "built\n", ".env": "TOKEN=x\n", "deploy/tls.key": "key", ".git/config": "[remote]", "big.bin": ""}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(ws, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(ws, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Truncate(filepath.Join(ws, "big.bin"), maxWorkspaceFileBytes+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outside, []byte("outside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(ws, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".env", filepath.Join(ws, "env-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get(cookie, "/api/apps/app-a/workspace")
+	var listing struct {
+		Path    string           `json:"path"`
+		Entries []workspaceEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("list workspace: %d %s", rec.Code, rec.Body.String())
+	}
+	var names []string
+	for _, e := range listing.Entries {
+		names = append(names, fmt.Sprintf("%s:%s:%v", e.Name, e.Type, e.Excluded))
+	}
+	if got := strings.Join(names, ","); got != ".git:dir:false,build:dir:false,deploy:dir:false,.env:file:true,big.bin:file:false,env-link:symlink:false,escape.txt:symlink:false,main.go:file:false" {
+		t.Fatalf("unexpected entries %s", got)
+	}
+	if rec := get(cookie, "/api/apps/app-a/workspace?path=build/../deploy"); !strings.Contains(rec.Body.String(), `"path":"deploy/tls.key"`) || !strings.Contains(rec.Body.String(), `"excluded":true`) {
+		t.Fatalf("expected the key listed as excluded, got %s", rec.Body.String())
+	}
+
+	rec = get(cookie, "/api/apps/app-a/workspace/file?path=build/out.txt")
+	if rec.Code != http.StatusOK || rec.Body.String() != "built\n" || !strings.Contains(rec.Header().Get("Content-Disposition"), `filename="out.txt"`) {
+		t.Fatalf("download: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	for path, want := range map[string]int{
+		".env":            http.StatusForbidden,
+		"env-link":        http.StatusForbidden,
+		".git/config":     http.StatusForbidden,
+		"deploy/tls.key":  http.StatusForbidden,
+		"escape.txt":      http.StatusForbidden,
+		"../../apps.yaml": http.StatusNotFound,
+		"big.bin":         http.StatusRequestEntityTooLarge,
+		"build":           http.StatusBadRequest,
+	} {
+		if rec := get(cookie, "/api/apps/app-a/workspace/file?path="+url.QueryEscape(path)); rec.Code != want {
+			t.Fatalf("%s: expected %d, got %d %s", path, want, rec.Code, rec.Body.String())
+		}
+	}
+
+	hash, err := auth.HashPassword("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateUser("alice", hash, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(loginAndCookie(t, h, "alice", "alice"), "/api/apps/app-a/workspace"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admins refused, got %d", rec.Code)
+	}
+}
+
+func TestServer_PinRun(t *testing.T) {
+	apps := []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	hash, err := auth.HashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := st.CreateUser("dev", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID, err := st.CreateGroup("devs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(userID, []int64{groupID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(groupID, []string{"app-a"}); err != nil {
+		t.Fatal(err)
+	}
+	devCookie := loginAndCookie(t, h, "dev", "pw")
+	runA, _ := st.CreateRun("app-a", "", "admin")
+	runB, _ := st.CreateRun("app-b", "", "admin")
+	pathA, pathB := "/api/runs/"+strconv.FormatInt(runA, 10), "/api/runs/"+strconv.FormatInt(runB, 10)
+
+	do := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, pathB+"/pin", "", devCookie); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 pinning a run of another app, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, pathA+"/pin", `{"note":"shipped v2.0"}`, devCookie); rec.Code != http.StatusOK ||
+		!strings.Contains(rec.Body.String(), `"pinned_by":"dev"`) || !strings.Contains(rec.Body.String(), `"pin_note":"shipped v2.0"`) {
+		t.Fatalf("pin run: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPut, pathB+"/pin", "", adminCookie); rec.Code != http.StatusOK {
+		t.Fatalf("expected admin to pin without a note, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/api/runs?pinned=true", "", devCookie); !strings.Contains(rec.Body.String(), `"total":1`) || !strings.Contains(rec.Body.String(), `"app_id":"app-a"`) {
+		t.Fatalf("expected dev to list only accessible pinned runs, got %s", rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/api/runs?pinned=true&app_id=app-b", "", adminCookie); !strings.Contains(rec.Body.String(), `"total":1`) || !strings.Contains(rec.Body.String(), `"app_id":"app-b"`) {
+		t.Fatalf("expected app filter on pinned runs, got %s", rec.Body.String())
+	}
+	if rec := do(http.MethodDelete, pathA, "", adminCookie); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deleting a pinned run, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, "/api/apps/app-a", "", adminCookie); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete app: %d %s", rec.Code, rec.Body.String())
+	}
+	if run, _ := st.GetRun(runA); run == nil || run.PinnedAt == nil {
+		t.Fatalf("expected pinned run kept after deleting its app, got %+v", run)
+	}
+
+	if rec := do(http.MethodDelete, pathB+"/pin", "", adminCookie); rec.Code != http.StatusNoContent {
+		t.Fatalf("unpin: %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, pathB+"/pin", "", adminCookie); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 unpinning twice, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, pathB, "", adminCookie); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected unpinned run deletable, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, pathB+"/pin", "", adminCookie); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 pinning a deleted run, got %d", rec.Code)
+	}
+}
+
+func TestServer_BuildRunEnvAppOverridesGlobal(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "env.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := st.CreateGlobalEnvVar("API_URL", "https://global"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateGlobalEnvVar("REGION", "eu"); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(nil, st, nil, "", "")
+
+	env, sources := srv.buildRunEnv(config.App{ID: "a", Env: map[string]string{"API_URL": "https://app", "NODE_ENV": "production"}})
+	if env["API_URL"] != "https://app" || env["REGION"] != "eu" || env["NODE_ENV"] != "production" {
+		t.Fatalf("unexpected merged env: %+v", env)
+	}
+	if sources["API_URL"] != "app, overrides global" || sources["REGION"] != "global" || sources["NODE_ENV"] != "app" {
+		t.Fatalf("unexpected env sources: %+v", sources)
+	}
+}
+
+func TestServer_AppTimezone(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "tz.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	srv := New(nil, st, nil, "", "")
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no timezone database: %v", err)
+	}
+	srv.SetDisplayTimezone(berlin)
+
+	env, sources := srv.buildRunEnv(config.App{ID: "a", Timezone: "America/New_York"})
+	if env["TZ"] != "America/New_York" || sources["TZ"] != "app timezone" {
+		t.Fatalf("expected TZ from the app timezone, got %+v %+v", env, sources)
+	}
+	if env, _ := srv.buildRunEnv(config.App{ID: "a", Timezone: "America/New_York", Env: map[string]string{"TZ": "UTC"}}); env["TZ"] != "UTC" {
+		t.Fatalf("expected an explicit TZ to win, got %q", env["TZ"])
+	}
+	if loc := srv.appLocation(config.App{ID: "b"}); loc != berlin {
+		t.Fatalf("expected the display timezone for apps without one, got %v", loc)
+	}
+	if err := validateAppTimezone(&config.App{Timezone: "Mars/Olympus"}); err == nil {
+		t.Fatal("expected an unknown timezone to be rejected")
+	}
+}
+
+func setupTestServer(t *testing.T, apps []config.App) (http.Handler, *store.Store, string, string) {
+	t.Helper()
+	baseDir := t.TempDir()
+	dbPath := filepath.Join(baseDir, "test.db")
+	appsPath := filepath.Join(baseDir, "apps.yaml")
+	staticDir := filepath.Join(baseDir, "web")
+
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(staticDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(staticDir, "index.html"), []byte("ok"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := store.New("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := pipeline.NewRunner(filepath.Join(baseDir, "work"))
+	srv := New(apps, st, runner, appsPath, staticDir)
+	return srv.Handler(), st, appsPath, staticDir
+}
+
+func loginAndCookie(t *testing.T, h http.Handler, username, password string) *http.Cookie {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login failed for %s, status=%d body=%s", username, rec.Code, rec.Body.String())
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie in login response", sessionCookieName)
+	return nil
+}
+
+func TestServer_RunArtifactsUploadListDownload(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "artifacts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"}}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(apps, st, nil, appsPath, t.TempDir())
+	blobs := t.TempDir()
+	srv.SetArtifactStore(artifacts.NewLocal(blobs))
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "app.tar.gz")
+	if err := os.WriteFile(file, []byte("tarball"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv.saveRunArtifacts(runID, []pipeline.Artifact{{Step: "build", Name: "dist/app.tar.gz", Path: file, Size: 7}})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	base := "/api/runs/" + strconv.FormatInt(runID, 10) + "/artifacts"
+	rec := get(base)
+	var list []store.RunArtifact
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || len(list) != 1 || list[0].Name != "dist/app.tar.gz" || list[0].Step != "build" || list[0].SizeBytes != 7 {
+		t.Fatalf("unexpected artifact list: %d %+v", rec.Code, list)
+	}
+	rec = get(base + "/" + strconv.FormatInt(list[0].ID, 10))
+	if rec.Code != http.StatusOK || rec.Body.String() != "tarball" {
+		t.Fatalf("unexpected download: %d %q", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), `filename="app.tar.gz"`) {
+		t.Fatalf("expected attachment header, got %q", rec.Header().Get("Content-Disposition"))
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/apps/app-a", nil)
+	req.AddCookie(adminCookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete app: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(blobs, "runs", strconv.FormatInt(runID, 10), "dist", "app.tar.gz")); !os.IsNotExist(err) {
+		t.Fatalf("expected artifact object deleted with app, got %v", err)
+	}
+}
+
+func TestServer_ExportRunBundle(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "export.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"}}
+	srv := New(apps, st, nil, "", t.TempDir())
+	srv.SetArtifactStore(artifacts.NewLocal(t.TempDir()))
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "failed", "=== Step: test ===\n\x1b[31mFAIL\x1b[0m TestLogin\ntest step failed\n"); err != nil {
+		t.Fatal(err)
+	}
+	report := filepath.Join(t.TempDir(), "junit.xml")
+	if err := os.WriteFile(report, []byte("<testsuites/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv.saveRunArtifacts(runID, []pipeline.Artifact{{Step: "test", Name: "reports/junit.xml", Path: report, Size: 13}})
+	if _, err := st.CreateRunArtifact(store.RunArtifact{RunID: runID, Step: "build", Name: "dist/app.tar.gz", StorageKey: "runs/missing", SizeBytes: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/runs/"+strconv.FormatInt(runID, 10)+"/export", nil)
+	req.AddCookie(adminCookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" || !strings.Contains(rec.Header().Get("Content-Disposition"), `filename="run-1.zip"`) {
+		t.Fatalf("export: %d %v", rec.Code, rec.Header())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	var names []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+		names = append(names, f.Name)
+	}
+	if got := strings.Join(names, ","); got != "run-1/run.json,run-1/run.log,run-1/timeline.json,run-1/artifacts/reports/junit.xml,run-1/export-errors.txt" {
+		t.Fatalf("unexpected bundle entries %s", got)
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal([]byte(files["run-1/run.json"]), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta["status"] != "failed" || meta["exported_by"] != "admin" || meta["log"] != nil || meta["comments"] == nil {
+		t.Fatalf("unexpected run.json %v", meta)
+	}
+	if files["run-1/run.log"] != "=== Step: test ===\nFAIL TestLogin\ntest step failed\n" {
+		t.Fatalf("unexpected run.log %q", files["run-1/run.log"])
+	}
+	if !strings.Contains(files["run-1/timeline.json"], `"run.finished"`) || files["run-1/artifacts/reports/junit.xml"] != "<testsuites/>" {
+		t.Fatalf("unexpected timeline or report: %s %q", files["run-1/timeline.json"], files["run-1/artifacts/reports/junit.xml"])
+	}
+	if !strings.HasPrefix(files["run-1/export-errors.txt"], "dist/app.tar.gz: ") {
+		t.Fatalf("expected the missing artifact reported, got %q", files["run-1/export-errors.txt"])
+	}
+}
+
+func TestServer_DriftDetection(t *testing.T) {
+	defer func(f func(context.Context, config.App, []string) (string, error)) { driftDiff = f }(driftDiff)
+	var diff string
+	var checked []string
+	driftDiff = func(_ context.Context, app config.App, resources []string) (string, error) {
+		checked = resources
+		return diff, nil
+	}
+	app := config.App{ID: "web", Name: "Web", Repo: "https://example.com/web.git", Branch: "main", DeployMode: "kubectl", K8sNamespace: "apps", DeployManifestPath: "k8s", Steps: []config.Step{
+		{Name: "test", Cmd: "echo test"},
+		{Name: "deploy", K8sDeploy: true},
+	}}
+	other := config.App{ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", DeployMode: "helm", K8sNamespace: "apps", HelmChart: "chart", Steps: []config.Step{
+		{Name: "deploy", K8sDeploy: true},
+	}}
+	h, st, _, _ := setupTestServer(t, []config.App{app, other})
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	srv := New(nil, st, nil, "", "")
+	runID, err := st.CreateRun("web", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.recordAppDeploy(runID, app, "=== Step: test ===\nconfigmap/fixture created\n=== Step: deploy ===\ndeployment.apps/web configured\nservice/web unchanged\n")
+	// A run whose deploy step did not run records no deploy.
+	srv.recordAppDeploy(runID+1, other, "=== Step: test ===\nok\n")
+
+	if rec := do(http.MethodPost, "/api/apps/api/drift/check"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 without a recorded deploy, got %d %s", rec.Code, rec.Body.String())
+	}
+	diff = "-  replicas: 3\n+  replicas: 1\n"
+	rec := do(http.MethodPost, "/api/apps/web/drift/check")
+	var drift store.AppDrift
+	if err := json.Unmarshal(rec.Body.Bytes(), &drift); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("check drift: %d %s", rec.Code, rec.Body.String())
+	}
+	if drift.Status != store.DriftDrifted || drift.Diff != diff || drift.DeployRunID != runID || strings.Join(checked, ",") != "deployment.apps/web,service/web" {
+		t.Fatalf("unexpected drift %+v (checked %v)", drift, checked)
+	}
+	rec = do(http.MethodGet, "/api/status")
+	if !strings.Contains(rec.Body.String(), `"drifted_apps":["web"]`) {
+		t.Fatalf("expected web among the drifted apps, got %s", rec.Body.String())
+	}
+	rec = do(http.MethodGet, "/api/drift?status=drifted")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"app_id":"web"`) {
+		t.Fatalf("list drift: %d %s", rec.Code, rec.Body.String())
+	}
+
+	diff = ""
+	if rec := do(http.MethodPost, "/api/apps/web/drift/check"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"in_sync"`) {
+		t.Fatalf("expected web in sync, got %d %s", rec.Code, rec.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		notes, err := st.ListRunNotifications(runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := map[string]bool{}
+		for _, n := range notes {
+			events[n.Event] = true
+		}
+		if len(notes) == 2 && events["app.drifted"] && events["app.drift_resolved"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected drift notifications on the deploy run, got %+v", notes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := do(http.MethodGet, "/api/apps/api/drift"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a recorded deploy, got %d", rec.Code)
+	}
+}
+
+func TestServer_PreviewEnvironments(t *testing.T) {
+	defer func(f func(context.Context, config.App, bool) error) { ensurePreviewNamespace = f }(ensurePreviewNamespace)
+	defer func(f func(context.Context, string) error) { deletePreviewNamespace = f }(deletePreviewNamespace)
+	defer func(f func(context.Context, string) (string, bool, error)) { previewNamespaceOwner = f }(previewNamespaceOwner)
+	defer func(f func(context.Context, ...string) (string, string, error)) { kubectlPreflight = f }(kubectlPreflight)
+	kubectlPreflight = fakeKubectlPreflight(`{"clientVersion":{"major":"1","minor":"30"},"serverVersion":{"major":"1","minor":"30"}}`, nil)
+	var mu sync.Mutex
+	// owners are the namespaces in the cluster by their preview-app annotation; web-feature-taken
+	// belongs to someone else.
+	owners := map[string]string{"web-feature-taken": ""}
+	previewNamespaceOwner = func(_ context.Context, namespace string) (string, bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		owner, ok := owners[namespace]
+		return owner, ok, nil
+	}
+	provisioned := make(chan config.App, 4)
+	ensurePreviewNamespace = func(_ context.Context, app config.App, create bool) error {
+		mu.Lock()
+		if _, ok := owners[app.PreviewNamespace]; ok == create {
+			t.Errorf("unexpected create %t of namespace %s", create, app.PreviewNamespace)
+		}
+		owners[app.PreviewNamespace] = app.ID
+		mu.Unlock()
+		provisioned <- app
+		return nil
+	}
+	var deleted []string
+	deletePreviewNamespace = func(_ context.Context, namespace string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		deleted = append(deleted, namespace)
+		return nil
+	}
+	secret := "0123456789abcdef"
+	app := config.App{ID: "web", Name: "Web", Repo: filepath.Join(t.TempDir(), "missing.git"), Branch: "main", SSHKeyName: "key-main", Environment: "prod",
+		DeployMode: "kubectl", K8sNamespace: "apps", K8sServiceAccount: "deployer", K8sRunnerImage: "runner:1", DeployManifestPath: "k8s",
+		WebhookProvider: "github", WebhookSecret: secret,
+		Preview: &config.PreviewConfig{URL: "https://$BRANCH.preview.example.com", Branches: []string{"feature/*"}, TTLHours: 1},
+		Steps:   []config.Step{{Name: "deploy", K8sDeploy: true}}}
+	h, st, _, _ := setupTestServer(t, []config.App{app})
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	deliver := func(event, body string) *httptest.ResponseRecorder {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks/web", strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", event)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	var runIDs []int64
+	defer func() {
+		// Let the preview runs fail (there is no cluster) before the store closes.
+		deadline := time.Now().Add(10 * time.Second)
+		for _, runID := range runIDs {
+			for time.Now().Before(deadline) {
+				if run, err := st.GetRun(runID); err != nil || (run.Status != "pending" && run.Status != "running") {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}()
+
+	if rec := deliver("push", `{"ref":"refs/heads/spike"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "ignored") {
+		t.Fatalf("expected a push to a branch without previews ignored, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec := deliver("push", `{"ref":"refs/heads/feature/Login"}`)
+	var started struct {
+		Previews []struct {
+			Branch    string `json:"branch"`
+			RunID     int64  `json:"run_id"`
+			Namespace string `json:"namespace"`
+			URL       string `json:"url"`
+		} `json:"previews"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil || rec.Code != http.StatusAccepted || len(started.Previews) != 1 {
+		t.Fatalf("expected a preview run, got %d %s", rec.Code, rec.Body.String())
+	}
+	preview := started.Previews[0]
+	runIDs = append(runIDs, preview.RunID)
+	if preview.Namespace != "web-feature-login" || preview.URL != "https://feature-login.preview.example.com" {
+		t.Fatalf("unexpected preview %+v", preview)
+	}
+	select {
+	case got := <-provisioned:
+		if got.PreviewNamespace != "web-feature-login" || got.DeployNamespace() != "web-feature-login" || got.Branch != "feature/Login" || got.Environment != "" {
+			t.Fatalf("unexpected preview app %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the preview namespace provisioned")
+	}
+	rec = do(http.MethodGet, fmt.Sprintf("/api/runs/%d", preview.RunID), "")
+	if !strings.Contains(rec.Body.String(), `"preview":{"branch":"feature/Login","namespace":"web-feature-login","url":"https://feature-login.preview.example.com"}`) {
+		t.Fatalf("expected the preview on the run, got %s", rec.Body.String())
+	}
+	var previews []store.PreviewEnv
+	rec = do(http.MethodGet, "/api/apps/web/previews?status=active", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &previews); err != nil || len(previews) != 1 || previews[0].LastRunID != preview.RunID {
+		t.Fatalf("expected one active preview, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = deliver("pull_request", `{"action":"closed","pull_request":{"head":{"ref":"feature/Login"}}}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"branches":["feature/Login"]`) {
+		t.Fatalf("expected the preview torn down, got %d %s", rec.Code, rec.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p, err := st.GetPreviewEnv(previews[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status == store.PreviewDeleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the preview deleted, got %+v", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if rec := do(http.MethodPost, "/api/apps/web/previews", `{"branch":"main"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for the app branch, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodPost, "/api/apps/web/previews", `{"branch":"feature/ttl"}`)
+	var manual struct {
+		RunID   int64            `json:"run_id"`
+		Preview store.PreviewEnv `json:"preview"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &manual); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("expected a preview run, got %d %s", rec.Code, rec.Body.String())
+	}
+	runIDs = append(runIDs, manual.RunID)
+	select {
+	case <-provisioned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the preview namespace provisioned")
+	}
+	past := time.Now().UTC().Add(-2 * time.Hour)
+	if _, err := st.SavePreviewEnv("web", "feature/ttl", manual.Preview.Namespace, "", manual.RunID, past, past.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	New([]config.App{app}, st, nil, "", "").expirePreviews()
+	if p, err := st.GetPreviewEnv(manual.Preview.ID); err != nil || p.Status != store.PreviewDeleted || p.DeleteReason != "ttl expired" {
+		t.Fatalf("expected the expired preview torn down, got %+v (%v)", p, err)
+	}
+	rec = do(http.MethodPost, "/api/apps/web/previews", `{"branch":"feature/taken"}`)
+	var taken struct {
+		RunID   int64            `json:"run_id"`
+		Preview store.PreviewEnv `json:"preview"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &taken); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("expected a preview run, got %d %s", rec.Code, rec.Body.String())
+	}
+	runIDs = append(runIDs, taken.RunID)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		run, err := st.GetRun(taken.RunID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.Status == "failed" {
+			if !strings.Contains(run.Log, "namespace web-feature-taken exists and is not a preview of app web") {
+				t.Fatalf("expected the existing namespace refused, got %q", run.Log)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the preview run to fail, got %+v", run)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/apps/web/previews/%d", taken.Preview.ID), ""); rec.Code != http.StatusNoContent && rec.Code != http.StatusOK {
+		t.Fatalf("delete preview: %d %s", rec.Code, rec.Body.String())
+	}
+	if p, err := st.GetPreviewEnv(taken.Preview.ID); err != nil || p.Status != store.PreviewDeleted {
+		t.Fatalf("expected the preview record deleted, got %+v (%v)", p, err)
+	}
+	mu.Lock()
+	if strings.Join(deleted, ",") != "web-feature-login,web-feature-ttl" {
+		t.Fatalf("unexpected deleted namespaces %v", deleted)
+	}
+	mu.Unlock()
+
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, _ := st.CreateUser("alice", hash, false)
+	groupID, _ := st.CreateGroup("web-devs")
+	_ = st.SetGroupApps(groupID, []string{"web"})
+	_ = st.SetGroupUsers(groupID, []int64{aliceID})
+	edit := app
+	edit.Preview = &config.PreviewConfig{Namespace: "$BRANCH"}
+	body, _ := json.Marshal(edit)
+	req := httptest.NewRequest(http.MethodPut, "/api/apps/web", bytes.NewReader(body))
+	req.AddCookie(loginAndCookie(t, h, "alice", "alice123"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "$BRANCH\"") || !strings.Contains(rec.Body.String(), "https://$BRANCH.preview.example.com") {
+		t.Fatalf("expected a non-admin update to keep the preview config, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	bad := app
+	bad.Preview = &config.PreviewConfig{Namespace: "previews"}
+	if err := validatePreview(&bad); err == nil || !strings.Contains(err.Error(), "$BRANCH") {
+		t.Fatalf("expected a namespace without $BRANCH rejected, got %v", err)
+	}
+	bad.DeployMode, bad.Preview = "gitops", &config.PreviewConfig{}
+	if err := validatePreview(&bad); err == nil {
+		t.Fatal("expected previews of gitops apps rejected")
+	}
+}
+
+func TestServer_ImageProvenance(t *testing.T) {
+	app := config.App{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", Environment: "prod", Steps: []config.Step{
+		{Name: "build", Cmd: "docker push ghcr.io/acme/api:1.0"},
+		{Name: "deploy", K8sDeploy: true},
+	}}
+	h, st, _, _ := setupTestServer(t, []config.App{app})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	srv := New(nil, st, nil, "", "")
+	first := "sha256:" + strings.Repeat("1a", 32)
+	second := "sha256:" + strings.Repeat("2b", 32)
+	runLog := func(digest string) string {
+		return "=== Step: build ===\nThe push refers to repository [ghcr.io/acme/api]\n1.0: digest: " + digest + " size: 528\n" +
+			"=== Step: deploy ===\ndeployment.apps/api image set to ghcr.io/acme/api@" + digest + "\n"
+	}
+	var runIDs []int64
+	for _, digest := range []string{first, second} {
+		runID, err := st.CreateRun("app-a", "", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.recordRunDigests(runID, app, runLog(digest))
+		runIDs = append(runIDs, runID)
+	}
+	get := func(path string, out interface{}) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if out != nil {
+			_ = json.NewDecoder(rec.Body).Decode(out)
+		}
+		return rec.Code
+	}
+
+	var digests []store.RunDigest
+	if code := get(fmt.Sprintf("/api/runs/%d/digests", runIDs[1]), &digests); code != http.StatusOK || len(digests) != 2 {
+		t.Fatalf("expected 2 digests of the second run, got %d %+v", code, digests)
+	}
+	if d := digests[0]; d.Kind != "built" || d.Tag != "1.0" || d.Digest != second || d.ReplacedDigest != first {
+		t.Fatalf("expected the re-pushed tag to record the replaced digest, got %+v", d)
+	}
+	if d := digests[1]; d.Kind != "deployed" || d.Environment != "prod" || d.Step != "deploy" {
+		t.Fatalf("unexpected deployed record %+v", d)
+	}
+
+	var deployments []store.RunDigest
+	if code := get("/api/deployments?app_id=app-a", &deployments); code != http.StatusOK || len(deployments) != 1 || deployments[0].Digest != second {
+		t.Fatalf("expected the second digest deployed in prod, got %d %+v", code, deployments)
+	}
+	var provenance struct {
+		Records    []store.RunDigest `json:"records"`
+		DeployedIn []store.RunDigest `json:"deployed_in"`
+	}
+	if code := get("/api/digests/"+first, &provenance); code != http.StatusOK || len(provenance.Records) != 2 || len(provenance.DeployedIn) != 0 {
+		t.Fatalf("expected the first digest built and deployed but no longer deployed, got %d %+v", code, provenance)
+	}
+	if code := get("/api/digests/"+second, &provenance); code != http.StatusOK || len(provenance.DeployedIn) != 1 || provenance.DeployedIn[0].RunID != runIDs[1] {
+		t.Fatalf("expected the second digest deployed by the second run, got %d %+v", code, provenance)
+	}
+	if code := get("/api/digests/sha256:"+strings.Repeat("99", 32), nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown digest, got %d", code)
+	}
+	if code := get("/api/digests/latest", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed digest, got %d", code)
+	}
+}
+
+func TestServer_PromoteImageThroughEnvironments(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test", Promotion: []config.PromotionEnv{
+			{Name: "staging", Image: "registry.example.com/staging/api"},
+			{Name: "prod", Image: "registry.example.com/prod/api", Tag: "stable"},
+		}},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	var copies []string
+	origCopy := copyImage
+	copyImage = func(_ context.Context, src, dst string) (string, error) {
+		copies = append(copies, src+" -> "+dst)
+		_, digest, _ := strings.Cut(src, "@")
+		return digest, nil
+	}
+	defer func() { copyImage = origCopy }()
+
+	promote := func() (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/api/apps/app-a/promote", nil)
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var body map[string]interface{}
+		_ = json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Code, body
+	}
+	if code, _ := promote(); code != http.StatusConflict {
+		t.Fatalf("expected 409 without a built image, got %d", code)
+	}
+
+	digest := "sha256:" + strings.Repeat("0f", 32)
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "success", "::image::ghcr.io/acme/api@"+digest+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(nil, st, nil, "", "")
+	srv.recordRunImage(runID, "::image::ghcr.io/acme/api@"+digest+"\n")
+
+	if code, body := promote(); code != http.StatusCreated || body["promotion"].(map[string]interface{})["environment"] != "staging" {
+		t.Fatalf("expected promotion to staging, got %d %v", code, body)
+	}
+	if code, body := promote(); code != http.StatusCreated || body["promotion"].(map[string]interface{})["environment"] != "prod" {
+		t.Fatalf("expected promotion to prod, got %d %v", code, body)
+	}
+	if code, _ := promote(); code != http.StatusConflict {
+		t.Fatalf("expected 409 when all environments are current, got %d", code)
+	}
+	want := []string{
+		"ghcr.io/acme/api@" + digest + " -> registry.example.com/staging/api:staging",
+		"registry.example.com/staging/api@" + digest + " -> registry.example.com/prod/api:stable",
+	}
+	if strings.Join(copies, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected copies:\n%s", strings.Join(copies, "\n"))
+	}
+	list, err := st.ListPromotions("app-a", 10)
+	if err != nil || len(list) != 2 || list[0].Environment != "prod" || list[0].SourceRunID != runID || list[0].Digest != digest {
+		t.Fatalf("unexpected promotions: %+v (%v)", list, err)
+	}
+}
+
+func TestServer_PromotionDeployAppAccess(t *testing.T) {
+	prod := []config.PromotionEnv{{Name: "prod", Image: "registry.example.com/prod/api", DeployApp: "ops-deploy"}}
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test", Promotion: prod},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "ops-deploy", Name: "Ops deploy", Repo: "https://example.com/ops.git", Branch: "main", TestCmd: "echo test"},
+	})
+	var copies []string
+	origCopy := copyImage
+	copyImage = func(_ context.Context, src, dst string) (string, error) {
+		copies = append(copies, src+" -> "+dst)
+		_, digest, _ := strings.Cut(src, "@")
+		return digest, nil
+	}
+	defer func() { copyImage = origCopy }()
+	digest := "sha256:" + strings.Repeat("0f", 32)
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetRunImage(runID, "ghcr.io/acme/api", digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "success", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, _ := st.CreateUser("alice", hash, false)
+	groupID, _ := st.CreateGroup("api-devs")
+	_ = st.SetGroupApps(groupID, []string{"app-a", "app-b"})
+	_ = st.SetGroupUsers(groupID, []int64{aliceID})
+	aliceCookie := loginAndCookie(t, h, "alice", "alice123")
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.AddCookie(aliceCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/apps/app-a/promote", map[string]string{"environment": "prod"}); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "no access to deploy app ops-deploy") {
+		t.Fatalf("expected 403 promoting to an inaccessible deploy app, got %d %s", rec.Code, rec.Body.String())
+	}
+	if len(copies) != 0 {
+		t.Fatalf("expected no image copy before the access check, got %v", copies)
+	}
+	rec := do(http.MethodPut, "/api/apps/app-b", map[string]interface{}{"name": "App B", "repo": "https://example.com/b.git", "test_cmd": "echo test", "promotion": prod})
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "no access to promotion deploy app ops-deploy") {
+		t.Fatalf("expected 403 adding an inaccessible deploy app, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodPut, "/api/apps/app-b", map[string]interface{}{"name": "App B", "repo": "https://example.com/b.git", "test_cmd": "echo test",
+		"promotion": []config.PromotionEnv{{Name: "prod", Image: "registry.example.com/prod/b", DeployApp: "app-a"}}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected an accessible deploy app to be saved, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServer_K8sPodTemplateAdminOnly(t *testing.T) {
+	tmpl := map[string]interface{}{"spec": map[string]interface{}{"nodeSelector": map[string]interface{}{"pool": "ci"}}}
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test", K8sPodTemplate: tmpl},
+	})
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, _ := st.CreateUser("alice", hash, false)
+	groupID, _ := st.CreateGroup("a-devs")
+	_ = st.SetGroupApps(groupID, []string{"app-a"})
+	_ = st.SetGroupUsers(groupID, []int64{aliceID})
+	put := func(cookie *http.Cookie, podSpec map[string]interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(map[string]interface{}{"name": "App A", "repo": "https://example.com/a.git", "test_cmd": "echo test",
+			"k8s_pod_template": map[string]interface{}{"spec": podSpec}})
+		req := httptest.NewRequest(http.MethodPut, "/api/apps/app-a", bytes.NewReader(data))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := put(loginAndCookie(t, h, "alice", "alice123"), map[string]interface{}{"hostNetwork": true})
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "hostNetwork") || !strings.Contains(rec.Body.String(), `"pool":"ci"`) {
+		t.Fatalf("expected a non-admin update to keep the pod template, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = put(loginAndCookie(t, h, "admin", "admin"), map[string]interface{}{"nodeSelector": map[string]interface{}{"pool": "build"}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"pool":"build"`) {
+		t.Fatalf("expected an admin to change the pod template, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServer_RegistriesCRUDAndAppLogin(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/registries", map[string]string{"name": "ghcr", "url": "ghcr.io/acme", "username": "bot", "token": "t"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for url with path, got %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/api/registries", map[string]string{"name": "ghcr", "url": "https://ghcr.io/", "username": "bot", "token": "secret"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating registry, got %d %s", rec.Code, rec.Body.String())
+	}
+	var created store.Registry
+	_ = json.NewDecoder(rec.Body).Decode(&created)
+	if created.URL != "ghcr.io" || strings.Contains(rec.Body.String(), "secret") {
+		t.Fatalf("unexpected create response: %s", rec.Body.String())
+	}
+	if rec := do(http.MethodPut, fmt.Sprintf("/api/registries/%d", created.ID), map[string]string{"token": "rotated"}); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 updating registry, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodPut, "/api/apps/app-a", map[string]interface{}{"name": "App A", "repo": "https://example.com/a.git", "test_cmd": "echo test", "registries": []string{"missing"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown registry, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/api/apps/app-a", map[string]interface{}{"name": "App A", "repo": "https://example.com/a.git", "test_cmd": "echo test", "registries": []string{"ghcr"}}); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 updating app, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/registries/%d", created.ID), nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 deleting registry in use, got %d", rec.Code)
+	}
+
+	// Users who are not admins keep the app's registries.
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, _ := st.CreateUser("alice", hash, false)
+	groupID, _ := st.CreateGroup("a-devs")
+	_ = st.SetGroupApps(groupID, []string{"app-a"})
+	_ = st.SetGroupUsers(groupID, []int64{aliceID})
+	if rec := do(http.MethodPost, "/api/registries", map[string]string{"name": "prod", "url": "registry.example.com", "username": "deploy", "token": "prod-secret"}); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating registry, got %d %s", rec.Code, rec.Body.String())
+	}
+	update, _ := json.Marshal(map[string]interface{}{"name": "App A", "repo": "https://example.com/a.git", "test_cmd": "echo test", "registries": []string{"prod"}})
+	req := httptest.NewRequest(http.MethodPut, "/api/apps/app-a", bytes.NewReader(update))
+	req.AddCookie(loginAndCookie(t, h, "alice", "alice123"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"prod"`) || !strings.Contains(rec.Body.String(), `"registries":["ghcr"]`) {
+		t.Fatalf("expected a non-admin update to keep the registries, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	srv := New(nil, st, nil, "", "")
+	regs, err := srv.appRegistries(config.App{Registries: []string{"ghcr"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dockerConfigJSON(regs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"auths":{"ghcr.io":{"auth":"Ym90OnJvdGF0ZWQ="}}}`; cfg != want {
+		t.Fatalf("expected %s, got %s", want, cfg)
+	}
+	env, sources := map[string]string{}, map[string]string{}
+	cleanup, err := applyRegistryLogin(cfg, env, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(env["DOCKER_CONFIG"], "config.json"))
+	if err != nil || string(data) != cfg || sources["DOCKER_CONFIG"] != "registries" {
+		t.Fatalf("unexpected docker config %q (%v)", data, err)
+	}
+	cleanup()
+	if _, err := os.Stat(env["DOCKER_CONFIG"]); !os.IsNotExist(err) {
+		t.Fatalf("expected temp docker config removed, got %v", err)
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	secret := "0123456789abcdef"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+	cases := []struct {
+		provider string
+		header   http.Header
+		want     error
+	}{
+		{"github", http.Header{"X-Hub-Signature-256": {"sha256=" + sig}}, nil},
+		{"github", http.Header{}, errWebhookUnsigned},
+		{"github", http.Header{"X-Hub-Signature-256": {sig}}, errWebhookTampered},
+		{"bitbucket", http.Header{"X-Hub-Signature": {"sha256=" + sig}}, nil},
+		{"gitea", http.Header{"X-Gitea-Signature": {sig}}, nil},
+		{"gitea", http.Header{"X-Gitea-Signature": {strings.Repeat("0", 64)}}, errWebhookTampered},
+		{"gitlab", http.Header{"X-Gitlab-Token": {secret}}, nil},
+		{"gitlab", http.Header{"X-Gitlab-Token": {"wrong"}}, errWebhookTampered},
+	}
+	for _, c := range cases {
+		if err := verifyWebhookSignature(c.provider, secret, c.header, body); err != c.want {
+			t.Errorf("%s %v: expected %v, got %v", c.provider, c.header, c.want, err)
+		}
+	}
+	if err := verifyWebhookSignature("github", secret, http.Header{"X-Hub-Signature-256": {"sha256=" + sig}}, []byte(`{"ref":"refs/heads/prod"}`)); err != errWebhookTampered {
+		t.Fatalf("expected tampered body to be rejected, got %v", err)
+	}
+	if got := pushedBranches([]byte(`{"push":{"changes":[{"new":{"type":"branch","name":"main"}},{"new":null}]}}`)); len(got) != 1 || got[0] != "main" {
+		t.Fatalf("unexpected bitbucket branches: %v", got)
+	}
+}
+
+func TestClosedBranches(t *testing.T) {
+	cases := []struct {
+		provider, event, body, want string
+	}{
+		{webhookGitHub, "push", `{"ref":"refs/heads/feature/a","deleted":true}`, "feature/a"},
+		{webhookGitHub, "push", `{"ref":"refs/heads/feature/a"}`, ""},
+		{webhookGitHub, "pull_request", `{"action":"closed","pull_request":{"head":{"ref":"feature/b"},"merged":true}}`, "feature/b"},
+		{webhookGitHub, "pull_request", `{"action":"opened","pull_request":{"head":{"ref":"feature/b"}}}`, ""},
+		{webhookGitea, "delete", `{"ref":"feature/c","ref_type":"branch"}`, "feature/c"},
+		{webhookGitLab, "Push Hook", `{"ref":"refs/heads/feature/d","after":"0000000000000000000000000000000000000000"}`, "feature/d"},
+		{webhookGitLab, "Merge Request Hook", `{"object_attributes":{"action":"merge","source_branch":"feature/e"}}`, "feature/e"},
+		{webhookBitbucket, "repo:push", `{"push":{"changes":[{"old":{"type":"branch","name":"feature/f"},"new":null}]}}`, "feature/f"},
+		{webhookBitbucket, "repo:refs_changed", `{"changes":[{"ref":{"id":"refs/heads/feature/g"},"type":"DELETE"}]}`, "feature/g"},
+		{webhookBitbucket, "pullrequest:fulfilled", `{"pullrequest":{"source":{"branch":{"name":"feature/h"}}}}`, "feature/h"},
+	}
+	for _, c := range cases {
+		if got := strings.Join(closedBranches(c.provider, c.event, []byte(c.body)), ","); got != c.want {
+			t.Errorf("%s %s %s: got %q, want %q", c.provider, c.event, c.body, got, c.want)
+		}
+	}
+}
+
+func TestServer_WebhookRejectsUnsignedAndIgnoresOtherBranches(t *testing.T) {
+	secret := "0123456789abcdef"
+	h, _, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test", WebhookProvider: "github", WebhookSecret: secret},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
+	})
+	deliver := func(appID, event, body, sig string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks/"+appID, strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", event)
+		if sig != "" {
+			req.Header.Set("X-Hub-Signature-256", sig)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	push := `{"ref":"refs/heads/feature"}`
+	if rec := deliver("app-a", "push", push, ""); rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "missing signature") {
+		t.Fatalf("expected 401 for unsigned delivery, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := deliver("app-a", "push", push, sign(`{"ref":"refs/heads/main"}`)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for tampered delivery, got %d", rec.Code)
+	}
+	if rec := deliver("app-a", "push", push, sign(push)); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "ignored") {
+		t.Fatalf("expected push to other branch ignored, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := deliver("app-a", "ping", `{}`, sign(`{}`)); rec.Code != http.StatusOK {
+		t.Fatalf("expected ping acknowledged, got %d", rec.Code)
+	}
+	if rec := deliver("app-b", "push", push, sign(push)); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for app without webhooks, got %d", rec.Code)
+	}
+}
+
+func TestServer_InboundTriggerIdempotency(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: filepath.Join(t.TempDir(), "missing.git"), Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"},
+	})
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	req := httptest.NewRequest(http.MethodPost, "/api/apps/app-a/triggers", strings.NewReader(`{"name":"nightly"}`))
+	req.AddCookie(adminCookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated || created.Token == "" {
+		t.Fatalf("expected trigger token, got %d (%v)", rec.Code, err)
+	}
+
+	fire := func(token, key, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/api/triggers/"+token, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var out map[string]interface{}
+		_ = json.NewDecoder(rec.Body).Decode(&out)
+		return rec.Code, out
+	}
+	if code, _ := fire("bogus", "", `{}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown token, got %d", code)
+	}
+	if code, _ := fire(created.Token, "", `not json`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for non-JSON body, got %d", code)
+	}
+	code, first := fire(created.Token, "delivery-1", `{"source":"cron"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d %v", code, first)
+	}
+	code, retry := fire(created.Token, "delivery-1", `{"source":"cron"}`)
+	if code != http.StatusOK || retry["duplicate"] != true || retry["run_id"] != first["run_id"] {
+		t.Fatalf("expected duplicate delivery to return the first run, got %d %v", code, retry)
+	}
+	code, other := fire(created.Token, "delivery-2", `{}`)
+	if code != http.StatusAccepted || other["run_id"] == first["run_id"] {
+		t.Fatalf("expected a new run for another key, got %d %v", code, other)
+	}
+
+	for _, v := range []interface{}{first["run_id"], other["run_id"]} {
+		runID := int64(v.(float64))
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			run, err := st.GetRun(runID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.Status != "pending" && run.Status != "running" {
+				if run.TriggeredBy != "trigger:nightly" {
+					t.Fatalf("unexpected triggered_by %q", run.TriggeredBy)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("run %d did not finish", runID)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestServer_SlackSlashCommand(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "slack.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: filepath.Join(t.TempDir(), "missing.git"), Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"}}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(apps, st, pipeline.NewRunner(t.TempDir()), appsPath, t.TempDir())
+	srv.SetSlack("slack-signing-secret", "T1")
+	srv.SetPublicURL("https://ci.example.com/")
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+
+	prevInterval := slackStatusPollInterval
+	slackStatusPollInterval = 20 * time.Millisecond
+	defer func() { slackStatusPollInterval = prevInterval }()
+	final := make(chan string, 1)
+	responseSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg slackMessage
+		_ = json.NewDecoder(r.Body).Decode(&msg)
+		final <- msg.Text
+	}))
+	defer responseSrv.Close()
+
+	command := func(secret, team, user, text string) (int, slackMessage) {
+		body := url.Values{"team_id": {team}, "user_id": {user}, "text": {text}, "response_url": {responseSrv.URL}}.Encode()
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + ts + ":" + body))
+		req := httptest.NewRequest(http.MethodPost, "/api/slack/command", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Slack-Request-Timestamp", ts)
+		req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var msg slackMessage
+		_ = json.NewDecoder(rec.Body).Decode(&msg)
+		return rec.Code, msg
+	}
+	if code, _ := command("wrong-secret", "T1", "U1", "run app-a"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for bad signature, got %d", code)
+	}
+	if code, _ := command("slack-signing-secret", "T2", "U1", "run app-a"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for other workspace, got %d", code)
+	}
+	if code, msg := command("slack-signing-secret", "T1", "U1", "run app-a"); code != http.StatusOK || msg.ResponseType != "ephemeral" || !strings.Contains(msg.Text, "not linked") {
+		t.Fatalf("expected not-linked reply, got %d %+v", code, msg)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/users/1/slack", strings.NewReader(`{"slack_user_id":"U1"}`))
+	req.AddCookie(adminCookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("link slack user: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if _, msg := command("slack-signing-secret", "T1", "U1", "deploy nope"); !strings.Contains(msg.Text, "not found") {
+		t.Fatalf("expected app not found, got %+v", msg)
+	}
+	code, msg := command("slack-signing-secret", "T1", "U1", "run app a")
+	if code != http.StatusOK || !strings.Contains(msg.Text, "Unknown command") {
+		t.Fatalf("expected usage for malformed command, got %d %+v", code, msg)
+	}
+	code, msg = command("slack-signing-secret", "T1", "U1", "run app-a")
+	if code != http.StatusOK || msg.ResponseType != "in_channel" || !strings.Contains(msg.Text, "run #1") || !strings.Contains(msg.Text, "https://ci.example.com/?app_id=app-a") {
+		t.Fatalf("expected run started reply, got %d %+v", code, msg)
+	}
+	select {
+	case text := <-final:
+		if !strings.Contains(text, "Run #1") || !strings.Contains(text, "failed") {
+			t.Fatalf("unexpected final status message %q", text)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no final status posted to response_url")
+	}
+	run, err := st.GetRun(1)
+	if err != nil || run == nil || run.TriggeredBy != "admin" {
+		t.Fatalf("expected run triggered by admin, got %+v (%v)", run, err)
+	}
+}
+
+func TestServer_MaintenanceModeRejectsAndHoldsRuns(t *testing.T) {
+	secret := "0123456789abcdef"
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: filepath.Join(t.TempDir(), "missing.git"), Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test", WebhookProvider: "github", WebhookSecret: secret},
+	})
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	push := `{"ref":"refs/heads/main"}`
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(push))
+	deliverPush := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks/app-a", strings.NewReader(push))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/api/maintenance", `{"enabled":true,"message":"DB upgrade"}`, adminCookie); rec.Code != http.StatusOK {
+		t.Fatalf("enable maintenance: %d %s", rec.Code, rec.Body.String())
+	}
+	rec := do(http.MethodGet, "/api/status", "", nil)
+	var status struct {
+		Maintenance maintenanceState `json:"maintenance"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil || !status.Maintenance.Enabled || status.Maintenance.Message != "DB upgrade" || status.Maintenance.By != "admin" {
+		t.Fatalf("expected maintenance banner in status, got %+v (%v)", status, err)
+	}
+	if rec := do(http.MethodPost, "/api/apps/app-a/run", "", adminCookie); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"reason":"maintenance"`) {
+		t.Fatalf("expected 503 during maintenance, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = deliverPush()
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"status":"deferred"`) {
+		t.Fatalf("expected webhook deferred, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := do(http.MethodPut, "/api/maintenance", `{"enabled":true,"queue_runs":true}`, adminCookie); rec.Code != http.StatusOK {
+		t.Fatalf("switch to queueing: %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/apps/app-a/run", "", adminCookie); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected queued run, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodGet, "/api/maintenance", "", adminCookie)
+	if !strings.Contains(rec.Body.String(), `"held_runs":2`) {
+		t.Fatalf("expected 2 held runs, got %s", rec.Body.String())
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, id := range []int64{1, 2} {
+		if run, err := st.GetRun(id); err != nil || run == nil || run.Status != "pending" {
+			t.Fatalf("expected run %d held as pending, got %+v (%v)", id, run, err)
+		}
+	}
+
+	if rec := do(http.MethodPut, "/api/maintenance", `{"enabled":false}`, adminCookie); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"held_runs":0`) {
+		t.Fatalf("disable maintenance: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, id := range []int64{1, 2} {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			run, err := st.GetRun(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.Status != "pending" && run.Status != "running" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("held run %d did not start after maintenance", id)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestServer_MaintenanceModeIsSharedByReplicas(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "replicas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: filepath.Join(t.TempDir(), "missing.git"), Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"}}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	srvA := New(apps, st, pipeline.NewRunner(t.TempDir()), appsPath, t.TempDir())
+	srvB := New(apps, st, pipeline.NewRunner(t.TempDir()), appsPath, t.TempDir())
+	hA, hB := srvA.Handler(), srvB.Handler()
+	cookie := loginAndCookie(t, hA, "admin", "admin")
+	do := func(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Maintenance mode switched on one replica rejects runs on the other.
+	if rec := do(hA, http.MethodPut, "/api/maintenance", `{"enabled":true,"message":"DB upgrade"}`); rec.Code != http.StatusOK {
+		t.Fatalf("enable maintenance: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(hB, http.MethodPost, "/api/apps/app-a/run", ""); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "DB upgrade") {
+		t.Fatalf("expected 503 on the other replica, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Runs held on one replica are counted by all and start when another switches maintenance off.
+	if rec := do(hA, http.MethodPut, "/api/maintenance", `{"enabled":true,"queue_runs":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("switch to queueing: %d", rec.Code)
+	}
+	if rec := do(hB, http.MethodPost, "/api/apps/app-a/run", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected run held on the other replica, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(hA, http.MethodGet, "/api/maintenance", ""); !strings.Contains(rec.Body.String(), `"held_runs":1`) {
+		t.Fatalf("expected the held run counted on every replica, got %s", rec.Body.String())
+	}
+	if rec := do(hA, http.MethodPut, "/api/maintenance", `{"enabled":false}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"held_runs":1`) {
+		t.Fatalf("disable maintenance: %d %s", rec.Code, rec.Body.String())
+	}
+	if run, err := st.GetRun(1); err != nil || run == nil || run.Status != "pending" {
+		t.Fatalf("expected run 1 still held until its replica notices, got %+v (%v)", run, err)
+	}
+	srvB.releaseHeldRunsAfterMaintenance()
+	if rec := do(hA, http.MethodGet, "/api/maintenance", ""); !strings.Contains(rec.Body.String(), `"held_runs":0`) {
+		t.Fatalf("expected no held runs, got %s", rec.Body.String())
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		run, err := st.GetRun(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.Status != "pending" && run.Status != "running" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("held run did not start after maintenance")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServer_StatusEndpoint(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(nil, st, nil, "", t.TempDir())
+	srv.SetBuildInfo("v1.2.3", "abc123")
+	h := srv.Handler()
+	for _, status := range []string{"pending", "pending", "running", "success"} {
+		runID, err := st.CreateRun("app-a", "", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.UpdateRunStatus(runID, status, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(cookie *http.Cookie) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var out map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("status: %d (%v)", rec.Code, err)
+		}
+		return out
+	}
+	public := get(nil)
+	if public["version"] != "v1.2.3" || public["commit"] != "abc123" {
+		t.Fatalf("unexpected build info %v", public)
+	}
+	if _, ok := public["db_driver"]; ok {
+		t.Fatalf("expected no operational details without session, got %v", public)
+	}
+	full := get(loginAndCookie(t, h, "admin", "admin"))
+	if full["db_driver"] != st.Driver() || full["queue_depth"] != float64(2) || full["active_runs"] != float64(1) || full["uptime"] == nil {
+		t.Fatalf("unexpected status %v", full)
+	}
+}
+
+func TestServer_TriggerRunWithEnvOverrides(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: filepath.Join(t.TempDir(), "missing.git"), Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"},
+	})
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	trigger := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/apps/app-a/run", strings.NewReader(body))
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, body := range []string{`{"env":{"1BAD":"x"}}`, `{"env":{"NOPPFLOW_IMAGE":"x"}}`, `{"env":`} {
+		if rec := trigger(body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := trigger(""); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected run without body, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec := trigger(`{"env":{"VERBOSE":"1"}}`)
+	var started struct {
+		RunID int64 `json:"run_id"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&started); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("expected run with env, got %d (%v)", rec.Code, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/runs/"+strconv.FormatInt(started.RunID, 10), nil)
+	req.AddCookie(adminCookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var run struct {
+		Env []store.RunEnvVar `json:"env"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&run); err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Env) != 1 || run.Env[0] != (store.RunEnvVar{Name: "VERBOSE", Value: "1"}) {
+		t.Fatalf("expected recorded run env, got %+v", run.Env)
+	}
+	if env, err := st.ListRunEnv(1); err != nil || len(env) != 0 {
+		t.Fatalf("expected no env for run without overrides, got %+v (%v)", env, err)
+	}
+
+	for _, id := range []int64{1, started.RunID} {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			r, err := st.GetRun(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Status != "pending" && r.Status != "running" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("run %d did not finish", id)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestServer_RunLogsInLogStore(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "logs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: filepath.Join(t.TempDir(), "missing.git"), Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"}}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(apps, st, pipeline.NewRunner(t.TempDir()), appsPath, t.TempDir())
+	logDir := t.TempDir()
+	srv.SetLogStore(artifacts.NewLocal(logDir), "")
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+
+	runID, err := srv.startRun(apps[0], "admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		run, err := st.GetRun(runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.Status != "pending" && run.Status != "running" {
+			if run.Log != "" || run.LogKey != "1.log" || run.LogSize == 0 {
+				t.Fatalf("expected log only in the log store, got key=%q size=%d log=%q", run.LogKey, run.LogSize, run.Log)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("run did not finish")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	stored, err := os.ReadFile(filepath.Join(logDir, "1.log"))
+	if err != nil || len(stored) == 0 {
+		t.Fatalf("expected log file, got %d bytes (%v)", len(stored), err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/runs/1/log?ansi=true", nil)
+	req.AddCookie(adminCookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != string(stored) {
+		t.Fatalf("expected log from log store, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/apps/app-a", nil)
+	req.AddCookie(adminCookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete app: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(logDir, "1.log")); !os.IsNotExist(err) {
+		t.Fatalf("expected log file deleted with the app, got %v", err)
+	}
+}
+
+func TestServer_LogRedaction(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "redact.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A"}}
+	srv := New(apps, st, nil, "", "")
+	artifactDir := t.TempDir()
+	srv.SetArtifactStore(artifacts.NewLocal(artifactDir))
+	h := srv.Handler()
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A run that leaked a token before any rule existed, with its full log kept as an artifact.
+	now := time.Now().UTC()
+	oldRun, err := st.CreateFinishedRun("app-a", "", "admin", "success", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunLog(oldRun, "deploying with token ghp_abc123SECRET\ndone\n"); err != nil {
+		t.Fatal(err)
+	}
+	fullLog := filepath.Join(t.TempDir(), "full.log")
+	if err := os.WriteFile(fullLog, []byte("step 1\ntoken ghp_abc123SECRET\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv.saveRunArtifacts(oldRun, []pipeline.Artifact{{Name: pipeline.FullLogArtifactName, Path: fullLog, Size: 30}})
+
+	if rec := do(http.MethodPost, "/api/log-redaction-rules", `{"pattern":"x*"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a pattern matching the empty string, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/log-redaction-rules", `{"pattern":"ghp_[A-Za-z0-9]+","description":"GitHub tokens"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create rule: %d %s", rec.Code, rec.Body.String())
+	}
+
+	newRun, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.updateRunLog(newRun, "echo ghp_live1\n")
+	if run, err := st.GetRun(newRun); err != nil || strings.Contains(run.Log, "ghp_") || !strings.Contains(run.Log, redactedText) {
+		t.Fatalf("expected streamed log redacted, got %+v, %v", run, err)
+	}
+	srv.completeRun(newRun, "success", "echo ghp_live1\nok\n")
+	if run, err := st.GetRun(newRun); err != nil || run.Log != "echo [REDACTED]\nok\n" {
+		t.Fatalf("expected final log redacted, got %+v, %v", run, err)
+	}
+
+	rec := do(http.MethodPost, "/api/runs/redact", `{"app_id":"app-a"}`)
+	var res struct {
+		Scanned           int      `json:"scanned"`
+		RedactedLogs      int      `json:"redacted_logs"`
+		RedactedArtifacts int      `json:"redacted_artifacts"`
+		Errors            []string `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("redact: %d %v", rec.Code, err)
+	}
+	if res.Scanned != 2 || res.RedactedLogs != 1 || res.RedactedArtifacts != 1 || len(res.Errors) != 0 {
+		t.Fatalf("unexpected redaction result: %+v", res)
+	}
+	if run, err := st.GetRun(oldRun); err != nil || run.Log != "deploying with token [REDACTED]\ndone\n" {
+		t.Fatalf("expected stored log redacted, got %+v, %v", run, err)
+	}
+	arts, err := st.ListRunArtifacts(oldRun)
+	if err != nil || len(arts) != 1 {
+		t.Fatalf("expected the full log artifact, got %+v, %v", arts, err)
+	}
+	stored, err := os.ReadFile(filepath.Join(artifactDir, filepath.FromSlash(arts[0].StorageKey)))
+	if err != nil || string(stored) != "step 1\ntoken [REDACTED]\n" || arts[0].SizeBytes != int64(len(stored)) {
+		t.Fatalf("expected artifact redacted, got %q (%d bytes recorded), %v", stored, arts[0].SizeBytes, err)
+	}
+
+	rules, err := st.ListLogRedactionRules()
+	if err != nil || len(rules) != 1 || rules[0].CreatedBy != "admin" {
+		t.Fatalf("unexpected rules: %+v, %v", rules, err)
+	}
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/log-redaction-rules/%d", rules[0].ID), ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete rule: %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/runs/redact", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without rules, got %d", rec.Code)
+	}
+}
+
+func TestServer_SecretEnvResolvedAndMasked(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", TestCmd: "echo test", Env: map[string]string{"TOKEN": "sops:app-a/app.enc.yaml#token"}}})
+	srv := New(nil, st, nil, "", "")
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "fake-sops")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\necho sk_from_sops\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetSecretProviders(config.SecretProvidersConfig{SOPS: &config.SOPSProvider{Dir: dir, Binary: bin, Allowed: []string{"$APP/*", "app.enc.yaml"}}})
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"SIGNING_KEY": "sops:app.enc.yaml#key", "PLAIN": "value"}
+	sources := map[string]string{"SIGNING_KEY": "app", "PLAIN": "app"}
+	if err := srv.resolveSecretEnv(runID, "app-a", env, sources); err != nil {
+		t.Fatal(err)
+	}
+	if env["SIGNING_KEY"] != "sk_from_sops" || env["PLAIN"] != "value" || sources["SIGNING_KEY"] != "app, sops" {
+		t.Fatalf("unexpected env %v, sources %v", env, sources)
+	}
+	srv.updateRunLog(runID, "signing with sk_from_sops\n")
+	if run, err := st.GetRun(runID); err != nil || run.Log != "signing with [REDACTED]\n" {
+		t.Fatalf("expected the resolved secret masked in the log, got %+v, %v", run, err)
+	}
+	srv.forgetRunSecrets(runID)
+	if len(srv.runSecretValues(runID)) != 0 {
+		t.Fatal("expected the run's secrets forgotten")
+	}
+	if err := srv.resolveSecretEnv(runID, "app-a", map[string]string{"X": "sops:app.enc.yaml"}, map[string]string{}); err == nil || !strings.Contains(err.Error(), "X: ") {
+		t.Fatalf("expected an error naming the env var, got %v", err)
+	}
+	if err := srv.resolveSecretEnv(runID, "app-a", map[string]string{"X": "sops:app-a/app.enc.yaml#key"}, map[string]string{}); err != nil {
+		t.Fatalf("expected $APP to allow the app's own secrets, got %v", err)
+	}
+	if err := srv.resolveSecretEnv(runID, "app-a", map[string]string{"X": "sops:app-b/app.enc.yaml#key"}, map[string]string{}); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected another app's secrets not allowed, got %v", err)
+	}
+
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, _ := st.CreateUser("alice", hash, false)
+	groupID, _ := st.CreateGroup("dev")
+	_ = st.SetGroupApps(groupID, []string{"app-a"})
+	_ = st.SetGroupUsers(groupID, []int64{aliceID})
+	alice := loginAndCookie(t, h, "alice", "alice123")
+	update := func(env map[string]string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(map[string]interface{}{"name": "App A", "repo": "https://example.com/a.git", "test_cmd": "echo test", "env": env})
+		req := httptest.NewRequest(http.MethodPut, "/api/apps/app-a", bytes.NewReader(data))
+		req.AddCookie(alice)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := update(map[string]string{"TOKEN": "sops:app-a/app.enc.yaml#token", "X": "vault:secret/prod/db#password"}); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "(X)") {
+		t.Fatalf("expected a non-admin adding a secret reference refused, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := update(map[string]string{"TOKEN": "sops:app-a/other.enc.yaml#token"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a non-admin changing a secret reference refused, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := update(map[string]string{"TOKEN": "sops:app-a/app.enc.yaml#token", "PLAIN": "value"}); rec.Code != http.StatusOK {
+		t.Fatalf("expected a non-admin keeping the secret reference allowed, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServer_CloudCredentials(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "cloud.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIARUN</AccessKeyId><SecretAccessKey>run-secret-key</SecretAccessKey><SessionToken>run-session-token</SessionToken>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("web-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"}}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(apps, st, nil, appsPath, t.TempDir())
+	srv.SetCloudBroker(config.CloudBrokerConfig{MaxDurationMin: 60, AWS: &config.AWSCloudBroker{
+		Region: "eu-west-1", STSEndpoint: sts.URL, WebIdentityTokenFile: tokenFile, AllowedRoles: []string{"arn:aws:iam::1:role/ci-*"},
+	}})
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	devID, err := st.CreateGroup("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, err := st.CreateUser("alice", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(aliceID, []int64{devID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppGroups("app-a", []int64{devID}); err != nil {
+		t.Fatal(err)
+	}
+	aliceCookie := loginAndCookie(t, h, "alice", "alice123")
+	update := func(cookie *http.Cookie, roleARN string) *httptest.ResponseRecorder {
+		body := map[string]interface{}{"name": "App A", "repo": "https://example.com/a.git", "test_cmd": "echo test"}
+		if roleARN != "-" {
+			body["cloud_credentials"] = map[string]interface{}{"aws": map[string]string{"role_arn": roleARN}}
+		}
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPut, "/api/apps/app-a", bytes.NewReader(data))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	roleARN := func() string {
+		for _, a := range srv.apps {
+			if a.ID == "app-a" && a.CloudCredentials != nil {
+				return a.CloudCredentials.AWS.RoleARN
+			}
+		}
+		return ""
+	}
+
+	if rec := update(adminCookie, "arn:aws:iam::1:role/admin"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "not allowed") {
+		t.Fatalf("expected 400 for a role outside allowed_roles, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := update(adminCookie, "arn:aws:iam::1:role/ci-app"); rec.Code != http.StatusOK || roleARN() != "arn:aws:iam::1:role/ci-app" {
+		t.Fatalf("expected the admin to set the role, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := update(aliceCookie, "arn:aws:iam::1:role/ci-other"); rec.Code != http.StatusOK || roleARN() != "arn:aws:iam::1:role/ci-app" {
+		t.Fatalf("expected a non-admin update to keep the role, got %d, role %q", rec.Code, roleARN())
+	}
+	if rec := update(adminCookie, "-"); rec.Code != http.StatusOK || roleARN() != "arn:aws:iam::1:role/ci-app" {
+		t.Fatalf("expected an update without cloud_credentials to keep the role, got %d, role %q", rec.Code, roleARN())
+	}
+	if rec := update(adminCookie, ""); rec.Code != http.StatusOK || roleARN() != "" {
+		t.Fatalf("expected an empty role to remove cloud_credentials, got %d, role %q", rec.Code, roleARN())
+	}
+
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := config.App{ID: "app-a", CloudCredentials: &config.CloudCredentials{AWS: &config.AWSRole{RoleARN: "arn:aws:iam::1:role/ci-app"}}}
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "AKIALONGLIVED"}
+	sources := map[string]string{"AWS_ACCESS_KEY_ID": "app"}
+	if err := srv.mintCloudCredentials(runID, app, env, sources); err != nil {
+		t.Fatal(err)
+	}
+	if env["AWS_ACCESS_KEY_ID"] != "ASIARUN" || env["AWS_REGION"] != "eu-west-1" || sources["AWS_ACCESS_KEY_ID"] != "aws role, overrides app" || sources["AWS_SESSION_TOKEN"] != "aws role" {
+		t.Fatalf("unexpected env %v, sources %v", env, sources)
+	}
+	srv.updateRunLog(runID, "token run-session-token\n")
+	if run, err := st.GetRun(runID); err != nil || run.Log != "token [REDACTED]\n" {
+		t.Fatalf("expected the minted credentials masked in the log, got %+v, %v", run, err)
+	}
+	srv.forgetRunSecrets(runID)
+}
+
+func TestServer_TerraformPlanApproval(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "approvals.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"}}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(apps, st, nil, appsPath, t.TempDir())
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decide := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/runs/"+strconv.FormatInt(runID, 10)+"/approval", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := decide(`{"approve":true}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a run not waiting, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- srv.runApprover(runID, apps[0])(context.Background(), "infra", "Plan: 1 to add")
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.approvalsMu.Lock()
+		waiting := srv.approvals[runID] != nil
+		srv.approvalsMu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("approver did not register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := decide(`{}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without approve, got %d", rec.Code)
+	}
+	rec := decide(`{"approve":false}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var approval store.RunApproval
+	if err := json.NewDecoder(rec.Body).Decode(&approval); err != nil {
+		t.Fatal(err)
+	}
+	if approval.Status != "rejected" || approval.DecidedBy != "admin" || approval.Plan != "Plan: 1 to add" {
+		t.Fatalf("unexpected approval %+v", approval)
+	}
+	if err := <-result; err == nil || !strings.Contains(err.Error(), "plan rejected by admin") {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+}
+
+func TestServer_ApprovalDecidedOnAnotherReplica(t *testing.T) {
+	defer func(interval time.Duration) { approvalPollInterval = interval }(approvalPollInterval)
+	approvalPollInterval = 10 * time.Millisecond
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "approvals.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", hash); err != nil {
+		t.Fatal(err)
+	}
+	releaseID, err := st.CreateGroup("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, err := st.CreateUser("alice", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(aliceID, []int64{releaseID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(releaseID, []string{"app-a"}); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"}}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	runner := New(apps, st, nil, appsPath, t.TempDir())
+	other := New(apps, st, nil, appsPath, t.TempDir()).Handler()
+	decide := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/runs/1/approval", strings.NewReader(`{"approve":true}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		other.ServeHTTP(rec, req)
+		return rec
+	}
+
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- runner.awaitApproval(context.Background(), runID, apps[0], "deploy", "deploy", "", []string{"release"})
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if a, err := st.LatestRunApproval(runID); err == nil && a != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("approval was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := decide(loginAndCookie(t, other, "admin", "secret")); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected the approver groups enforced on the other replica, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := decide(loginAndCookie(t, other, "alice", "secret")); rec.Code != http.StatusOK {
+		t.Fatalf("expected alice to approve on the other replica, got %d %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("expected approval, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not notice the approval made on the other replica")
+	}
+}
+
+func TestServer_ProtectedEnvironment(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "environments.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", hash); err != nil {
+		t.Fatal(err)
+	}
+	releaseID, err := st.CreateGroup("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		id, err := st.CreateUser(name, hash, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "alice" {
+			if err := st.SetUserGroups(id, []int64{releaseID}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	app := config.App{ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", Environment: "prod", Steps: []config.Step{{Name: "deploy", K8sDeploy: true}}}
+	apps := []config.App{app}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(releaseID, []string{"api"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	content := "environments:\n  - name: prod\n    branches: [main, \"release/*\"]\n    approver_groups: [release]\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(apps, st, nil, appsPath, t.TempDir())
+	srv.SetPolicies(cfg)
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "secret")
+	do := func(method, url, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	logf := func(string, ...interface{}) {}
+
+	develop := app
+	develop.Branch = "develop"
+	if err := srv.deployGuard(1, develop)(context.Background(), "deploy", logf); err == nil || !strings.Contains(err.Error(), "only accepts deploys from branch main, release/*") {
+		t.Fatalf("expected branch rule violation, got %v", err)
+	}
+
+	// Only members of the approver groups may approve.
+	runID, err := st.CreateRun("api", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := srv.deployGuard(runID, app)
+	result := make(chan error, 1)
+	go func() { result <- guard(context.Background(), "deploy", logf) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.approvalsMu.Lock()
+		waiting := srv.approvals[runID] != nil
+		srv.approvalsMu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("deploy guard did not wait for approval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	approvalURL := "/api/runs/" + strconv.FormatInt(runID, 10) + "/approval"
+	if rec := do(http.MethodPost, approvalURL, `{"approve":true}`, adminCookie); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a non-member, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, approvalURL, `{"approve":true}`, loginAndCookie(t, h, "alice", "secret")); rec.Code != http.StatusOK {
+		t.Fatalf("expected alice to approve, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("expected approved deploy, got %v", err)
+	}
+	if err := guard(context.Background(), "deploy-2", logf); err != nil {
+		t.Fatalf("expected later deploy steps of the run not to wait again, got %v", err)
+	}
+
+	// Freezes are declared by admins and block deploys until they end.
+	bobCookie := loginAndCookie(t, h, "bob", "secret")
+	ends := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if rec := do(http.MethodPost, "/api/freezes", `{"environment":"prod","ends_at":"`+ends+`"}`, bobCookie); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/freezes", `{"environment":"prod","ends_at":"2020-01-01T00:00:00Z"}`, adminCookie); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a past freeze, got %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/api/freezes", `{"environment":"prod","ends_at":"`+ends+`","reason":"release week"}`, adminCookie)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var freeze store.DeployFreeze
+	if err := json.NewDecoder(rec.Body).Decode(&freeze); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard(context.Background(), "deploy-3", logf); err == nil || !strings.Contains(err.Error(), "environment prod is frozen until "+ends+": release week") {
+		t.Fatalf("expected freeze to block, got %v", err)
+	}
+	rec = do(http.MethodGet, "/api/freezes", "", bobCookie)
+	var freezes []store.DeployFreeze
+	if err := json.NewDecoder(rec.Body).Decode(&freezes); err != nil {
+		t.Fatal(err)
+	}
+	if len(freezes) != 1 || freezes[0].ID != freeze.ID || freezes[0].CreatedBy != "admin" {
+		t.Fatalf("unexpected freezes %+v", freezes)
+	}
+	if rec := do(http.MethodDelete, "/api/freezes/"+strconv.FormatInt(freeze.ID, 10), "", adminCookie); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if err := guard(context.Background(), "deploy-3", logf); err != nil {
+		t.Fatalf("expected deploy after the freeze was lifted, got %v", err)
+	}
+
+	// Only admins move an app out of (or into) an environment.
+	environment := func() string {
+		found, _ := srv.findApp("api")
+		return found.Environment
+	}
+	unprotected := app
+	unprotected.Environment = ""
+	unprotected.Steps = []config.Step{{Name: "deploy", Cmd: "make deploy"}}
+	body, _ := json.Marshal(unprotected)
+	if rec := do(http.MethodPut, "/api/apps/api", string(body), loginAndCookie(t, h, "alice", "secret")); rec.Code != http.StatusOK || environment() != "prod" {
+		t.Fatalf("expected a non-admin update to keep the environment, got %d, environment %q", rec.Code, environment())
+	}
+	if rec := do(http.MethodPut, "/api/apps/api", string(body), adminCookie); rec.Code != http.StatusOK || environment() != "" {
+		t.Fatalf("expected the admin to change the environment, got %d, environment %q", rec.Code, environment())
+	}
+}
+
+func TestServer_ImageSignaturePolicy(t *testing.T) {
+	signed := "sha256:" + strings.Repeat("a", 64)
+	unsigned := "sha256:" + strings.Repeat("b", 64)
+	binDir := t.TempDir()
+	// Fake cosign: only the image with the signed digest verifies, and only with the prod key.
+	script := "#!/bin/sh\ncase \"$*\" in\n\"verify --key /keys/prod.pub ghcr.io/acme/api@" + signed + "\") exit 0 ;;\nesac\necho 'Error: no matching signatures' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(binDir, "cosign"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "signatures.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	content := "environments:\n  - name: prod\n    signatures:\n      public_keys: [/keys/staging.pub, /keys/prod.pub]\n  - name: dev\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := config.App{ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", Environment: "prod", Steps: []config.Step{{Name: "deploy", K8sDeploy: true}}}
+	srv := New([]config.App{app}, st, nil, filepath.Join(t.TempDir(), "apps.yaml"), t.TempDir())
+	srv.SetPolicies(cfg)
+	logf := func(string, ...interface{}) {}
+	image := func(digest string) pipeline.ImageDigest {
+		return pipeline.ImageDigest{Kind: pipeline.DigestBuilt, Image: "ghcr.io/acme/api", Digest: digest}
+	}
+
+	verify := srv.imageVerifier(1, app, nil)
+	if err := verify(context.Background(), "deploy", []pipeline.ImageDigest{image(signed)}, logf); err != nil {
+		t.Fatalf("expected the signed image to verify, got %v", err)
+	}
+	err = verify(context.Background(), "deploy", []pipeline.ImageDigest{image(signed), image(unsigned)}, logf)
+	if err == nil || !strings.Contains(err.Error(), "environment prod only accepts signed images: ghcr.io/acme/api@"+unsigned+": Error: no matching signatures") {
+		t.Fatalf("expected the unsigned image to be refused, got %v", err)
+	}
+	if err := verify(context.Background(), "deploy", nil, logf); err == nil || !strings.Contains(err.Error(), "no image digest to verify") {
+		t.Fatalf("expected a deploy without known images to be refused, got %v", err)
+	}
+	dev := app
+	dev.Environment = "dev"
+	if srv.imageVerifier(1, dev, nil) != nil {
+		t.Fatal("expected no verification without a signature policy")
+	}
+
+	// Job runs only know the image passed to them.
+	job := app
+	job.Runner = "kubernetes"
+	if err := srv.verifyK8sJobImages(1, job, map[string]string{"NOPPFLOW_IMAGE": "ghcr.io/acme/api@" + signed}); err != nil {
+		t.Fatalf("expected the promoted signed image to verify, got %v", err)
+	}
+	if err := srv.verifyK8sJobImages(1, job, map[string]string{}); err == nil {
+		t.Fatal("expected a Job run without NOPPFLOW_IMAGE to be refused")
+	}
+
+	// Sign steps need a key env var, and an image when the app runs as a Job.
+	step := config.Step{Name: "sign", Sign: &config.SignStep{KeyEnv: "COSIGN_KEY"}}
+	if err := validateAndNormalizeStep(&config.App{ID: "api"}, &step); err != nil {
+		t.Fatalf("expected valid sign step, got %v", err)
+	}
+	step.Sign.KeyEnv = "cosign key"
+	if err := validateAndNormalizeStep(&config.App{ID: "api"}, &step); err == nil || !strings.Contains(err.Error(), "key_env must be an env var name") {
+		t.Fatalf("expected invalid key_env, got %v", err)
+	}
+	step.Sign.KeyEnv = "COSIGN_KEY"
+	if err := validateAndNormalizeStep(&job, &step); err == nil || !strings.Contains(err.Error(), "sign image is required") {
+		t.Fatalf("expected image to be required for Job runs, got %v", err)
+	}
+	step.Sign.Image, step.Sign.PasswordEnv = "$NOPPFLOW_IMAGE", "COSIGN_PASSWORD"
+	env := k8sEnv{Plain: map[string]string{"NOPPFLOW_IMAGE": "ghcr.io/acme/api@" + signed}}
+	want := `COSIGN_PASSWORD="${COSIGN_PASSWORD:?password_env COSIGN_PASSWORD is not set}" cosign sign --yes --key env://COSIGN_KEY 'ghcr.io/acme/api@` + signed + `'`
+	if got := k8sSignCommand(step, env); got != want {
+		t.Fatalf("k8sSignCommand = %q, want %q", got, want)
+	}
+}
+
+func TestServer_RotateSSHKey(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, nil)
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	keyID, err := st.CreateSSHKey("key-main", "dummy-private-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/api/ssh-keys/" + strconv.FormatInt(keyID, 10)
+	rotate := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, url+"/rotate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, body := range []string{`{}`, `{"generate":true,"private_key":"x"}`, `{"private_key":"not a key"}`} {
+		if rec := rotate(body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("rotate %s: expected 400, got %d body=%s", body, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := rotate(`{"generate":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Fingerprint string               `json:"fingerprint"`
+		PublicKey   string               `json:"public_key"`
+		Rotation    store.SSHKeyRotation `json:"rotation"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.PublicKey, "ssh-ed25519 ") || !strings.HasPrefix(resp.Fingerprint, "SHA256:") {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	key, err := st.GetSSHKeyByName("key-main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != keyID || sshKeyFingerprint(key.PrivateKey) != resp.Fingerprint {
+		t.Fatalf("expected the key to be replaced in place, got %+v", key)
+	}
+
+	// Rotating to the current key is refused; rotating to another key records a second entry.
+	current, _ := json.Marshal(map[string]string{"private_key": key.PrivateKey})
+	if rec := rotate(string(current)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for the current key, got %d", rec.Code)
+	}
+	next, err := generateSSHKey("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]string{"private_key": next})
+	if rec := rotate(string(body)); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, url+"/rotations", nil)
+	req.AddCookie(adminCookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var rotations []store.SSHKeyRotation
+	if err := json.NewDecoder(rec.Body).Decode(&rotations); err != nil {
+		t.Fatal(err)
+	}
+	if len(rotations) != 2 || rotations[0].Generated || rotations[0].OldFingerprint != resp.Fingerprint ||
+		!rotations[1].Generated || rotations[1].OldFingerprint != "" || rotations[1].RotatedBy != "admin" {
+		t.Fatalf("unexpected rotations %+v", rotations)
+	}
+}
+
+func TestServer_EffectiveEnv(t *testing.T) {
+	apps := []config.App{{
+		ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", LogColor: true,
+		Env: map[string]string{"REGION": "eu", "API_KEY": "app-key"},
+		Steps: []config.Step{
+			{Name: "build", Cmd: "make"},
+			{Name: "deploy", Cmd: "make deploy", Env: map[string]string{"URL": "https://$REGION.example.com/${TOKEN}/$MISSING", "REGION": "us"}},
+		},
+	}}
+	h, st, _, _ := setupTestServer(t, apps)
+	for name, value := range map[string]string{"TOKEN": "s3cret", "API_KEY": "global-key"} {
+		if _, err := st.CreateGlobalEnvVar(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	req := httptest.NewRequest(http.MethodGet, "/api/apps/api/effective-env", nil)
+	req.AddCookie(adminCookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "s3cret") || strings.Contains(rec.Body.String(), "global-key") {
+		t.Fatalf("secret value leaked: %s", rec.Body.String())
+	}
+	var resp struct {
+		Env   []effectiveEnvVar  `json:"env"`
+		Steps []effectiveStepEnv `json:"steps"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]effectiveEnvVar{}
+	for _, v := range resp.Env {
+		byName[v.Name] = v
+	}
+	if v := byName["TOKEN"]; v.Source != "global" || !v.Masked || v.Value != maskedValue {
+		t.Fatalf("unexpected TOKEN %+v", v)
+	}
+	if v := byName["API_KEY"]; v.Source != "app, overrides global" || v.Value != "app-key" {
+		t.Fatalf("unexpected API_KEY %+v", v)
+	}
+	if v := byName["FORCE_COLOR"]; v.Source != "log_color" {
+		t.Fatalf("unexpected FORCE_COLOR %+v", v)
+	}
+	if len(resp.Steps) != 1 || resp.Steps[0].Step != "deploy" || len(resp.Steps[0].Env) != 2 {
+		t.Fatalf("unexpected steps %+v", resp.Steps)
+	}
+	region, url := resp.Steps[0].Env[0], resp.Steps[0].Env[1]
+	if region.Value != "us" || region.Source != "step, overrides app" {
+		t.Fatalf("unexpected REGION %+v", region)
+	}
+	if url.Value != "https://eu.example.com/"+maskedValue+"/$MISSING" || len(url.Unresolved) != 1 || url.Unresolved[0] != "MISSING" {
+		t.Fatalf("unexpected URL %+v", url)
+	}
+
+	hash, err := auth.HashPassword("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateUser("bob", hash, false); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/apps/api/effective-env", nil)
+	req.AddCookie(loginAndCookie(t, h, "bob", "bob"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without app access, got %d", rec.Code)
+	}
+}
+
+func TestServer_PipelineGraph(t *testing.T) {
+	apps := []config.App{{
+		ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main",
+		Steps: []config.Step{
+			{Name: "test", Cmd: "go test ./...", ContinueOnError: true, Env: map[string]string{"B": "1", "A": "2"}},
+			{Name: "plan", Terraform: &config.TerraformStep{}, Workdir: "infra"},
+			{Name: "cleanup", Cmd: "make clean", AlwaysRun: true},
+		},
+		Post: &config.PostSteps{
+			OnFailure: []config.Step{{Name: "page", Cmd: "notify"}},
+			Always:    []config.Step{{Name: "report", Cmd: "report"}},
+		},
+	}}
+	h, _, _, _ := setupTestServer(t, apps)
+	req := httptest.NewRequest(http.MethodGet, "/api/apps/api/pipeline-graph", nil)
+	req.AddCookie(loginAndCookie(t, h, "admin", "admin"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var g pipelineGraph
+	if err := json.NewDecoder(rec.Body).Decode(&g); err != nil {
+		t.Fatal(err)
+	}
+	if g.Runner != "local" || len(g.Nodes) != 5 {
+		t.Fatalf("unexpected graph %+v", g)
+	}
+	test, plan := g.Nodes[0], g.Nodes[1]
+	if test.ID != "steps/0" || test.Command != "go test ./..." || strings.Join(test.EnvNames, ",") != "A,B" {
+		t.Fatalf("unexpected node %+v", test)
+	}
+	if plan.Kind != "terraform" || plan.Command != "" || !plan.Approval || !plan.Deploy || plan.Workdir != "infra" {
+		t.Fatalf("unexpected node %+v", plan)
+	}
+	var edges []string
+	for _, e := range g.Edges {
+		edges = append(edges, e.From+">"+e.To+":"+e.Condition)
+	}
+	want := "steps/0>steps/1:always steps/1>steps/2:always steps/2>on_failure/0:failure on_failure/0>always/0:always steps/2>always/0:always"
+	if got := strings.Join(edges, " "); got != want {
+		t.Fatalf("edges:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestServer_RunTimeline(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "timeline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", hash); err != nil {
+		t.Fatal(err)
+	}
+	app := config.App{ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", TestCmd: "go test ./..."}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, []config.App{app}); err != nil {
+		t.Fatal(err)
+	}
+	srv := New([]config.App{app}, st, nil, appsPath, t.TempDir())
+	h := srv.Handler()
+
+	runID, err := st.CreateRun("api", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Add(time.Second)
+	at := func(d time.Duration) string { return start.Add(d).Format(pipeline.LogTimestampLayout) }
+	log := strings.Join([]string{
+		at(0) + " checkout: branch main",
+		at(time.Second) + " commit: abc",
+		at(time.Second) + " === Step: test ===",
+		at(3*time.Second) + " test step failed: exit status 1",
+	}, "\n") + "\n"
+	if err := st.UpdateRunStatus(runID, "failed", log); err != nil {
+		t.Fatal(err)
+	}
+	srv.notify(app, notification{Event: "run.slow", RunID: runID, Message: "slow", Time: start.Add(2 * time.Second)})
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/runs/%d/timeline", runID), nil)
+	req.AddCookie(loginAndCookie(t, h, "admin", "secret"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Status string                   `json:"status"`
+		Events []pipeline.TimelineEvent `json:"events"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, e := range body.Events {
+		kinds = append(kinds, e.Event+":"+e.Name)
+	}
+	want := "run.queued:,clone.start:,clone.end:,step.start:test,notification:run.slow,step.end:test,run.finished:"
+	if body.Status != "failed" || strings.Join(kinds, ",") != want {
+		t.Fatalf("expected events %s, got %s (status %s)", want, strings.Join(kinds, ","), body.Status)
+	}
+	if end := body.Events[5]; end.Status != "failed" || end.DurationMs != 2000 {
+		t.Fatalf("unexpected step end %+v", end)
+	}
+	if last := body.Events[len(body.Events)-1]; last.Status != "failed" {
+		t.Fatalf("unexpected finished event %+v", last)
+	}
+}
+
+func TestServer_PermissionMatrix(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
+	})
+	devID, err := st.CreateGroup("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateGroup("ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(devID, []string{"app-b", "gone"}); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, err := st.CreateUser("alice", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(aliceID, []int64{devID}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/permissions/matrix", nil)
+	req.AddCookie(loginAndCookie(t, h, "alice", "secret"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/permissions/matrix", nil)
+	req.AddCookie(loginAndCookie(t, h, "admin", "admin"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Apps   []permissionApp   `json:"apps"`
+		Groups []permissionGroup `json:"groups"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Apps) != 2 || body.Apps[0].ID != "app-a" || len(body.Groups) != 2 {
+		t.Fatalf("unexpected matrix %+v", body)
+	}
+	dev, ops := body.Groups[0], body.Groups[1]
+	if dev.Name != "dev" || fmt.Sprint(dev.Access) != "[false true]" || strings.Join(dev.AppIDs, ",") != "app-b,gone" ||
+		len(dev.UserIDs) != 1 || dev.UserIDs[0] != aliceID {
+		t.Fatalf("unexpected dev row %+v", dev)
+	}
+	if ops.Name != "ops" || fmt.Sprint(ops.Access) != "[false false]" || len(ops.AppIDs) != 0 || len(ops.UserIDs) != 0 {
+		t.Fatalf("unexpected ops row %+v", ops)
+	}
+}
+
+func TestServer_UserInvite(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "invites.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	hash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", hash); err != nil {
+		t.Fatal(err)
+	}
+	devID, err := st.CreateGroup("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(nil, st, nil, filepath.Join(t.TempDir(), "apps.yaml"), t.TempDir())
+	srv.SetPublicURL("https://ci.example.com")
+	h := srv.Handler()
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, url, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/users/invite", `{"username":"admin"}`, adminCookie); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for existing user, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/users/invite", `{"username":"x","expires_in_hours":1000}`, adminCookie); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for too long expiry, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/users/invite", fmt.Sprintf(`{"username":"x","group_ids":[%d]}`, devID+100), adminCookie); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "not found") {
+		t.Fatalf("expected 400 for an unknown group, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	rec := do(http.MethodPost, "/api/users/invite", fmt.Sprintf(`{"username":"alice","group_ids":[%d]}`, devID), adminCookie)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var invite struct {
+		Token   string `json:"token"`
+		URL     string `json:"url"`
+		Emailed bool   `json:"emailed"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+	if invite.Emailed || invite.Token == "" || invite.URL != "https://ci.example.com/accept-invite.html?token="+invite.Token {
+		t.Fatalf("unexpected invite %+v", invite)
+	}
+
+	if rec := do(http.MethodPost, "/api/users/accept-invite", `{"token":"bogus","password":"pw"}`, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown token, got %d", rec.Code)
+	}
+	accept := fmt.Sprintf(`{"token":%q,"password":"alice-pw"}`, invite.Token)
+	if rec := do(http.MethodPost, "/api/users/accept-invite", accept, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/users/accept-invite", accept, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a used invite, got %d", rec.Code)
+	}
+	loginAndCookie(t, h, "alice", "alice-pw")
+	alice, err := st.GetUserByUsername("alice")
+	if err != nil || alice == nil || alice.IsAdmin || len(alice.GroupIDs) != 1 || alice.GroupIDs[0] != devID {
+		t.Fatalf("unexpected user %+v (err %v)", alice, err)
+	}
+
+	// With an email and an SMTP server the link is mailed instead of returned.
+	var sentTo []string
+	var sentMsg string
+	smtpSendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sentTo, sentMsg = to, string(msg)
+		return nil
+	}
+	defer func() { smtpSendMail = smtp.SendMail }()
+	srv.SetSMTP("mail.example.com:25", "ci@example.com", "", "")
+	rec = do(http.MethodPost, "/api/users/invite", `{"username":"bob","email":"bob@example.com"}`, adminCookie)
+	if rec.Code != http.StatusCreated || strings.Contains(rec.Body.String(), `"token"`) {
+		t.Fatalf("expected 201 without token, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if len(sentTo) != 1 || sentTo[0] != "bob@example.com" || !strings.Contains(sentMsg, "https://ci.example.com/accept-invite.html?token=") {
+		t.Fatalf("unexpected mail to %v: %s", sentTo, sentMsg)
+	}
+}
+
+func TestServer_APITokens(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{
+		{ID: "app-a", Name: "App A", Repo: "https://example.com/a.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "app-b", Name: "App B", Repo: "https://example.com/b.git", Branch: "main", TestCmd: "echo test"},
+	})
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, url, body string, cookie *http.Cookie, bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	create := func(body string) (store.APIToken, string) {
+		t.Helper()
+		rec := do(http.MethodPost, "/api/tokens", body, adminCookie, "")
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d body=%s", rec.Code, rec.Body.String())
+		}
+		var out struct {
+			Token  store.APIToken `json:"token"`
+			Secret string         `json:"secret"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Token, out.Secret
+	}
+
+	if rec := do(http.MethodPost, "/api/tokens", `{"name":"x","scope":"write"}`, adminCookie, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown scope, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/tokens", `{"name":"x","app_ids":["nope"]}`, adminCookie, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown app, got %d", rec.Code)
+	}
+
+	read, readSecret := create(`{"name":"dashboard","expires_in_days":30}`)
+	if read.Scope != tokenScopeRead || read.ExpiresAt == nil || !strings.HasPrefix(readSecret, apiTokenPrefix) {
+		t.Fatalf("unexpected token %+v", read)
+	}
+	if rec := do(http.MethodGet, "/api/apps", "", nil, readSecret); rec.Code != http.StatusOK {
+		t.Fatalf("expected read token to list apps, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/apps/app-a/run", "", nil, readSecret); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected read token to be denied a run, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/tokens", "", nil, readSecret); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected tokens to be denied token management, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/apps", "", nil, "npf_bogus"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for unknown token, got %d", rec.Code)
+	}
+
+	_, triggerSecret := create(`{"name":"ci","scope":"trigger","app_ids":["app-a"]}`)
+	if rec := do(http.MethodGet, "/api/apps", "", nil, triggerSecret); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected trigger token to be denied listing apps, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/apps/app-b/run", "", nil, triggerSecret); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected app-limited token to be denied another app, got %d", rec.Code)
+	}
+	runID, err := st.CreateRun("app-b", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(http.MethodGet, fmt.Sprintf("/api/runs/%d", runID), "", nil, triggerSecret); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected app-limited token to be denied a run of another app, got %d", rec.Code)
+	}
+
+	// Rotation keeps scope and validity period, and the old secret stops working.
+	rec := do(http.MethodPost, fmt.Sprintf("/api/tokens/%d/rotate", read.ID), "", adminCookie, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var rotated struct {
+		Token  store.APIToken `json:"token"`
+		Secret string         `json:"secret"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Secret == readSecret || rotated.Token.Scope != tokenScopeRead || rotated.Token.ExpiresAt == nil ||
+		rotated.Token.ExpiresAt.Sub(time.Now()) < 29*24*time.Hour {
+		t.Fatalf("unexpected rotated token %+v", rotated.Token)
+	}
+	if rec := do(http.MethodGet, "/api/apps", "", nil, readSecret); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected old secret to be rejected, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/apps", "", nil, rotated.Secret); rec.Code != http.StatusOK {
+		t.Fatalf("expected new secret to work, got %d", rec.Code)
+	}
+
+	// Expired tokens are rejected.
+	past := time.Now().Add(-time.Hour)
+	expiredSecret := apiTokenPrefix + "expired"
+	if _, err := st.CreateAPIToken(store.APIToken{UserID: read.UserID, Name: "old", Scope: tokenScopeFull, TokenHash: hashToken(expiredSecret), ExpiresAt: &past}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(http.MethodGet, "/api/apps", "", nil, expiredSecret); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected expired token to be rejected, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, fmt.Sprintf("/api/tokens/%d", read.ID), "", adminCookie, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/apps", "", nil, rotated.Secret); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected deleted token to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestServer_IPRules(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "iprules.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	hash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", hash); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ip_rules.yaml")
+	if err := os.WriteFile(path, []byte("admin:\n  allow: [10.0.0.0/8]\nwebhooks:\n  deny: [192.0.2.0/24]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := config.LoadIPRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(nil, st, nil, filepath.Join(t.TempDir(), "apps.yaml"), t.TempDir())
+	srv.SetIPRules(rules)
+	srv.StartIPRulesReloader(path, 10*time.Millisecond)
+	h := srv.Handler()
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, url, remote string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader("{}"))
+		req.RemoteAddr = remote
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do(http.MethodGet, "/api/users", "10.1.2.3:4000"); code != http.StatusOK {
+		t.Fatalf("expected admin from allowed network to pass, got %d", code)
+	}
+	if code := do(http.MethodGet, "/api/users", "203.0.113.5:4000"); code != http.StatusForbidden {
+		t.Fatalf("expected admin from other network to be rejected, got %d", code)
+	}
+	if code := do(http.MethodPost, "/api/triggers/abc", "192.0.2.9:4000"); code != http.StatusForbidden {
+		t.Fatalf("expected denied webhook address to be rejected, got %d", code)
+	}
+	if code := do(http.MethodPost, "/api/triggers/abc", "203.0.113.5:4000"); code == http.StatusForbidden {
+		t.Fatalf("expected webhook address to pass the IP rules, got %d", code)
+	}
+
+	// Changing the file replaces the rules without a restart.
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(path, []byte("admin:\n  allow: [203.0.113.0/24]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for do(http.MethodGet, "/api/users", "203.0.113.5:4000") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("IP rules were not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ReplicasShareSessionsAndElectOneLeader(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "replicas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	a := New(nil, st, nil, "", t.TempDir())
+	b := New(nil, st, nil, "", t.TempDir())
+
+	cookie := loginAndCookie(t, a.Handler(), "admin", "admin")
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/me", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	b.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected session accepted by the other replica, got %d %s", rec.Code, rec.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil)
+	req.AddCookie(cookie)
+	b.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/api/auth/me", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected logout on one replica to end the session on all, got %d", rec.Code)
+	}
+
+	if !a.isLeader() || !b.isLeader() {
+		t.Fatal("expected every server to lead without leader election")
+	}
+	a.leaderElection, b.leaderElection = true, true
+	a.electLeader(time.Minute)
+	b.electLeader(time.Minute)
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("expected only the first replica to lead, got a=%v b=%v", a.isLeader(), b.isLeader())
+	}
+	a.electLeader(time.Minute)
+	if !a.isLeader() {
+		t.Fatal("expected the leader to renew its lease")
+	}
+	if err := st.ReleaseLease(leaderLease, a.instanceID); err != nil {
+		t.Fatal(err)
+	}
+	b.electLeader(time.Minute)
+	if !b.isLeader() {
+		t.Fatal("expected the other replica to take over a released lease")
+	}
+	a.electLeader(time.Minute)
+	if a.isLeader() {
+		t.Fatal("expected the old leader to step down")
+	}
+
+	runID, err := st.CreateRun("app", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := st.ClaimRun(runID); err != nil || !ok {
+		t.Fatalf("expected first claim to win, got %v %v", ok, err)
+	}
+	if ok, err := st.ClaimRun(runID); err != nil || ok {
+		t.Fatalf("expected second claim to lose, got %v %v", ok, err)
+	}
+}
+
+func TestServer_ListRunsGroupByCommit(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{{ID: "app1", Name: "App 1"}, {ID: "app2", Name: "App 2"}})
+	sha := strings.Repeat("c", 40)
+	now := time.Now().UTC()
+	first, _ := st.CreateFinishedRun("app1", sha, "webhook", "failed", now.Add(-time.Hour), now.Add(-50*time.Minute))
+	retry, _ := st.CreateFinishedRun("app1", sha, "admin", "success", now.Add(-30*time.Minute), now.Add(-20*time.Minute))
+	if _, err := st.CreateFinishedRun("app2", sha, "webhook", "success", now.Add(-10*time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := st.CreateUser("alice", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID, err := st.CreateGroup("app1-team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(groupID, []string{"app1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupUsers(groupID, []int64{userID}); err != nil {
+		t.Fatal(err)
+	}
+	get := func(cookie *http.Cookie, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	admin := loginAndCookie(t, h, "admin", "admin")
+	rec := get(admin, "/api/runs?group_by=commit")
+	var resp struct {
+		Groups []store.CommitGroup `json:"groups"`
+		Total  int64               `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s (%v)", rec.Code, rec.Body.String(), err)
+	}
+	if resp.Total != 2 || len(resp.Groups) != 2 || resp.Groups[0].AppID != "app2" {
+		t.Fatalf("expected a group per app, got %+v", resp)
+	}
+	if g := resp.Groups[1]; g.Count != 2 || g.Status != "success" || g.Runs[0].ID != retry || g.Runs[1].ID != first {
+		t.Fatalf("expected the retry to collapse into the first run's group, got %+v", g)
+	}
+
+	alice := loginAndCookie(t, h, "alice", "alice123")
+	rec = get(alice, "/api/runs?group_by=commit")
+	resp.Groups = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Total != 1 || len(resp.Groups) != 1 || resp.Groups[0].AppID != "app1" {
+		t.Fatalf("expected only the app1 group for alice, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get(alice, "/api/runs?group_by=commit&app_id=app2"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for an app alice cannot see, got %d", rec.Code)
+	}
+	if rec := get(admin, "/api/runs?group_by=status"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown group_by, got %d", rec.Code)
+	}
+}
+
+func TestServer_AppsOverview(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{{ID: "app1", Name: "App 1"}, {ID: "app2", Name: "App 2"}, {ID: "app3", Name: "App 3"}})
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := st.CreateFinishedRun("app1", "old", "webhook", "failed", now.Add(-time.Hour), now.Add(-50*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := st.CreateFinishedRun("app1", "new", "admin", "success", now.Add(-10*time.Minute), now.Add(-8*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := st.CreateRun("app2", "", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := st.CreateUser("alice", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID, err := st.CreateGroup("app2-team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(groupID, []string{"app2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupUsers(groupID, []int64{userID}); err != nil {
+		t.Fatal(err)
+	}
+	overview := func(cookie *http.Cookie) []appOverview {
+		req := httptest.NewRequest(http.MethodGet, "/api/apps/overview", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var out []appOverview
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("unexpected overview %d %s (%v)", rec.Code, rec.Body.String(), err)
+		}
+		return out
+	}
+
+	apps := overview(loginAndCookie(t, h, "admin", "admin"))
+	if len(apps) != 3 || apps[0].ID != "app1" || apps[2].LastRun != nil {
+		t.Fatalf("expected all apps in config order, app3 without runs, got %+v", apps)
+	}
+	if last := apps[0].LastRun; last == nil || last.ID != latest || last.CommitSHA != "new" || last.Status != "success" ||
+		last.DurationSec == nil || *last.DurationSec != 120 {
+		t.Fatalf("unexpected last run of app1 %+v", last)
+	}
+	if last := apps[1].LastRun; last == nil || last.ID != running || last.DurationSec != nil {
+		t.Fatalf("unexpected last run of app2 %+v", last)
+	}
+	if apps := overview(loginAndCookie(t, h, "alice", "alice123")); len(apps) != 1 || apps[0].ID != "app2" {
+		t.Fatalf("expected only app2 for alice, got %+v", apps)
+	}
+}
+
+func TestServer_RunETagAndWait(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{{ID: "app1", Name: "App 1"}})
+	runID, err := st.CreateRun("app1", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "running", "line 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	get := func(url, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.AddCookie(cookie)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	url := fmt.Sprintf("/api/runs/%d", runID)
+	rec := get(url, "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || !strings.Contains(rec.Body.String(), "line 1") {
+		t.Fatalf("expected run with ETag, got %d %q %s", rec.Code, etag, rec.Body.String())
+	}
+	if rec := get(url, etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected 304 for an unchanged run, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get(url+"?wait=1", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 after waiting without change, got %d", rec.Code)
+	}
+	if rec := get(url+"?wait=soon", etag); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid wait, got %d", rec.Code)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = st.UpdateRunLog(runID, "line 1\nline 2\n")
+	}()
+	start := time.Now()
+	rec = get(url+"?wait=10", etag)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "line 2") || rec.Header().Get("ETag") == etag {
+		t.Fatalf("expected the changed run, got %d %s", rec.Code, rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the long-poll to return on change, took %v", elapsed)
+	}
+
+	logURL := fmt.Sprintf("/api/runs/%d/log", runID)
+	rec = get(logURL, "")
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == "" {
+		t.Fatalf("expected log with ETag, got %d", rec.Code)
+	}
+	if rec := get(logURL, rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for an unchanged log, got %d", rec.Code)
+	}
+}
+
+func TestServer_CompressesResponses(t *testing.T) {
+	h, st, _, _ := setupTestServer(t, []config.App{{ID: "app1", Name: "App 1"}})
+	runID, err := st.CreateRun("app1", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "success", strings.Repeat("step output line\n", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	get := func(url, acceptEncoding, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.AddCookie(cookie)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	url := fmt.Sprintf("/api/runs/%d", runID)
+
+	rec := get(url, "gzip", "")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip response, got %q", rec.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || !strings.Contains(string(body), "step output line") {
+		t.Fatalf("unexpected gzip body %q (%v)", body, err)
+	}
+	if rec := get(url, "gzip, br", ""); rec.Header().Get("Content-Encoding") != "br" || rec.Body.Len() >= len(body)/10 {
+		t.Fatalf("expected a small brotli response, got %q with %d bytes", rec.Header().Get("Content-Encoding"), rec.Body.Len())
+	}
+	if rec := get(url, "", ""); rec.Header().Get("Content-Encoding") != "" || !strings.Contains(rec.Body.String(), "step output line") {
+		t.Fatalf("expected an uncompressed response without Accept-Encoding, got %q", rec.Header().Get("Content-Encoding"))
+	}
+	if rec := get(url, "gzip", "text/event-stream"); rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected event streams to stay uncompressed, got %q", rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestServer_StaticAssets(t *testing.T) {
+	dir := t.TempDir()
+	staticDir := filepath.Join(dir, "web")
+	for name, content := range map[string]string{
+		"index.html":            `<script src="/js/app.js"></script><script src="/js/missing.js"></script>`,
+		"js/app.js":             "console.log(1)",
+		"js/vendor.1a2b3c4d.js": "vendor()",
+		".env":                  "SECRET=1",
+	} {
+		file := filepath.Join(staticDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "outside.txt"), []byte("outside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside.txt"), filepath.Join(staticDir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	h := New(nil, nil, nil, "", staticDir).Handler()
+	get := func(url string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/apps")
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" ||
+		!strings.Contains(body, `src="/js/app.js?v=`) || !strings.Contains(body, `src="/js/missing.js"`) {
+		t.Fatalf("expected the uncached index with fingerprinted refs, got %d %q %s", rec.Code, rec.Header().Get("Cache-Control"), body)
+	}
+	versioned := body[strings.Index(body, "/js/app.js?v="):]
+	versioned = versioned[:strings.Index(versioned, `"`)]
+	if rec := get(versioned); rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != immutableCacheControl {
+		t.Fatalf("expected the fingerprinted asset cached immutably, got %d %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if rec := get("/js/vendor.1a2b3c4d.js"); rec.Header().Get("Cache-Control") != immutableCacheControl {
+		t.Fatalf("expected a hashed file name cached immutably, got %q", rec.Header().Get("Cache-Control"))
+	}
+	rec = get("/js/app.js")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-cache" || etag == "" {
+		t.Fatalf("expected a revalidated asset with ETag, got %d %q %q", rec.Code, rec.Header().Get("Cache-Control"), etag)
+	}
+	if rec := get("/js/app.js", "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a matching ETag, got %d", rec.Code)
+	}
+	for _, url := range []string{"/js/missing.js", "/.env", "/link.txt", "/js/..%2f..%2foutside.txt", "/..%5coutside.txt"} {
+		if rec := get(url); rec.Code != http.StatusNotFound {
+			t.Fatalf("expected 404 for %s, got %d %s", url, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestServer_CORS(t *testing.T) {
+	srv := New(nil, stubBackend{driver: "stub"}, nil, filepath.Join(t.TempDir(), "apps.yaml"), t.TempDir())
+	if err := srv.SetCORS([]string{"*"}, true); err == nil {
+		t.Fatal("expected * with credentials to be rejected")
+	}
+	if err := srv.SetCORS([]string{"portal.example.com"}, false); err == nil {
+		t.Fatal("expected an origin without scheme to be rejected")
+	}
+	if err := srv.SetCORS([]string{" https://Portal.example.com/ ", ""}, true); err != nil {
+		t.Fatal(err)
+	}
+	h := srv.Handler()
+	do := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/status", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := do(http.MethodOptions, "https://portal.example.com")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://portal.example.com" ||
+		rec.Header().Get("Access-Control-Allow-Credentials") != "true" || !strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Fatalf("unexpected preflight response %d %v", rec.Code, rec.Header())
+	}
+	rec = do(http.MethodGet, "https://portal.example.com")
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "https://portal.example.com" || rec.Header().Get("Access-Control-Expose-Headers") != "ETag" {
+		t.Fatalf("unexpected CORS response %d %v", rec.Code, rec.Header())
+	}
+	if rec := do(http.MethodOptions, "https://evil.example.net"); rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected the preflight of another origin refused, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := do(http.MethodGet, "https://evil.example.net"); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected no CORS headers for another origin, got %v", rec.Header())
+	}
+}
+
+func TestServer_GraphQL(t *testing.T) {
+	baseDir := t.TempDir()
+	st, err := store.New("sqlite3", filepath.Join(baseDir, "graphql.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, _ := auth.HashPassword("admin")
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	apps := []config.App{
+		{ID: "app1", Name: "App 1", Steps: []config.Step{{Name: "test", Cmd: "go test ./..."}}},
+		{ID: "app2", Name: "App 2"},
+	}
+	srv := New(apps, st, nil, filepath.Join(baseDir, "apps.yaml"), baseDir)
+	h := srv.Handler()
+	now := time.Now().UTC()
+	runID, err := st.CreateFinishedRun("app1", strings.Repeat("a", 40), "admin", "success", now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateFinishedRun("app2", "", "admin", "failed", now.Add(-time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	aliceHash, _ := auth.HashPassword("alice123")
+	aliceID, _ := st.CreateUser("alice", aliceHash, false)
+	groupID, _ := st.CreateGroup("team")
+	_ = st.SetGroupApps(groupID, []string{"app1"})
+	_ = st.SetGroupUsers(groupID, []int64{aliceID})
+	admin := loginAndCookie(t, h, "admin", "admin")
+	alice := loginAndCookie(t, h, "alice", "alice123")
+	post := func(cookie *http.Cookie, query string, header ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		req := httptest.NewRequest(http.MethodPost, "/api/graphql", bytes.NewReader(body))
+		req.AddCookie(cookie)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post(admin, `{ me { username } }`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 while GraphQL is off, got %d", rec.Code)
+	}
+	if err := srv.SetGraphQL(true); err != nil {
+		t.Fatal(err)
+	}
+	rec := post(admin, `{ apps { id steps { name kind } lastRun { status commitSha } runs(limit: 5) { id app { name } } } groups { name users { username groups { name } } apps { id } } }`)
+	var out struct {
+		Data struct {
+			Apps []struct {
+				ID    string `json:"id"`
+				Steps []struct {
+					Name string `json:"name"`
+					Kind string `json:"kind"`
+				} `json:"steps"`
+				LastRun *struct {
+					Status    string `json:"status"`
+					CommitSha string `json:"commitSha"`
+				} `json:"lastRun"`
+				Runs []struct {
+					ID  int64 `json:"id"`
+					App struct {
+						Name string `json:"name"`
+					} `json:"app"`
+				} `json:"runs"`
+			} `json:"apps"`
+			Groups []struct {
+				Name  string `json:"name"`
+				Users []struct {
+					Username string `json:"username"`
+				} `json:"users"`
+			} `json:"groups"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || len(out.Errors) > 0 {
+		t.Fatalf("unexpected response %s (%v)", rec.Body.String(), err)
+	}
+	if len(out.Data.Apps) != 2 || out.Data.Apps[0].Steps[0].Name != "test" || out.Data.Apps[0].LastRun == nil ||
+		out.Data.Apps[0].LastRun.CommitSha != strings.Repeat("a", 40) || out.Data.Apps[0].Runs[0].ID != runID || out.Data.Apps[0].Runs[0].App.Name != "App 1" {
+		t.Fatalf("unexpected apps %+v", out.Data.Apps)
+	}
+	if len(out.Data.Groups) != 1 || out.Data.Groups[0].Users[0].Username != "alice" {
+		t.Fatalf("unexpected groups %+v", out.Data.Groups)
+	}
+
+	rec = post(alice, `{ apps { id } runs { appId } }`)
+	if body := rec.Body.String(); !strings.Contains(body, `"app1"`) || strings.Contains(body, "app2") {
+		t.Fatalf("expected alice to see only app1, got %s", body)
+	}
+	if rec := post(alice, `{ users { username } }`); !strings.Contains(rec.Body.String(), "admin access required") {
+		t.Fatalf("expected users to be admin-only, got %s", rec.Body.String())
+	}
+
+	sub := fmt.Sprintf(`subscription { runUpdated(id: %d) { id status } }`, runID)
+	if rec := post(admin, sub); rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("expected 406 for a subscription without an event stream, got %d", rec.Code)
+	}
+	rec = post(admin, sub, "Accept", "text/event-stream")
+	if body := rec.Body.String(); rec.Header().Get("Content-Type") != "text/event-stream" ||
+		!strings.Contains(body, `event: next`) || !strings.Contains(body, `"status":"success"`) || !strings.HasSuffix(body, "event: complete\ndata:\n\n") {
+		t.Fatalf("unexpected subscription stream %q", body)
+	}
+}
+
+func TestServer_GraphQLNestedAccess(t *testing.T) {
+	baseDir := t.TempDir()
+	st, err := store.New("sqlite3", filepath.Join(baseDir, "graphql.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	srv := New([]config.App{{ID: "shared", Name: "Shared"}, {ID: "secret", Name: "Secret"}}, st, nil, filepath.Join(baseDir, "apps.yaml"), baseDir)
+	if err := srv.SetGraphQL(true); err != nil {
+		t.Fatal(err)
+	}
+	h := srv.Handler()
+	runID, err := st.CreateRun("secret", "", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runID, "success", "db password hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	aliceHash, _ := auth.HashPassword("alice123")
+	aliceID, _ := st.CreateUser("alice", aliceHash, false)
+	bobID, _ := st.CreateUser("bob", aliceHash, false)
+	team, _ := st.CreateGroup("team")
+	_ = st.SetGroupApps(team, []string{"shared"})
+	_ = st.SetGroupUsers(team, []int64{aliceID, bobID})
+	ops, _ := st.CreateGroup("ops")
+	_ = st.SetGroupApps(ops, []string{"secret", "shared"})
+	_ = st.SetGroupUsers(ops, []int64{bobID})
+	alice := loginAndCookie(t, h, "alice", "alice123")
+
+	body, _ := json.Marshal(map[string]string{"query": `{ me { groups { name apps { id } users { username groups { name apps { id lastRun { log } runs { id log } } } } } } }`})
+	req := httptest.NewRequest(http.MethodPost, "/api/graphql", bytes.NewReader(body))
+	req.AddCookie(alice)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"errors"`) {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	for _, leak := range []string{"secret", "hunter2", "bob", "ops"} {
+		if strings.Contains(rec.Body.String(), leak) {
+			t.Fatalf("expected %q to stay hidden from alice, got %s", leak, rec.Body.String())
+		}
+	}
+	if !strings.Contains(rec.Body.String(), `"shared"`) || !strings.Contains(rec.Body.String(), `"alice"`) {
+		t.Fatalf("expected alice to see her group, app, and herself, got %s", rec.Body.String())
+	}
+}
+
+func TestServer_DownstreamTriggers(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "missing.git")
+	apps := []config.App{
+		{ID: "lib", Name: "Lib", Repo: repo, Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test",
+			Downstream: []config.DownstreamTrigger{{App: "svc", On: "always"}}},
+		// A cycle as it could be written by hand into apps.yaml; the run chain stops it.
+		{ID: "svc", Name: "Svc", Repo: repo, Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test",
+			Downstream: []config.DownstreamTrigger{{App: "lib", On: "always"}, {App: "other", On: "success"}}},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/apps/lib/run", "{}"); rec.Code != http.StatusAccepted {
+		t.Fatalf("trigger: %d %s", rec.Code, rec.Body.String())
+	}
+	var runs []store.Run
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var err error
+		if runs, err = st.ListRuns("", 10, 0); err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) == 2 && runs[0].Status == "failed" && runs[1].Status == "failed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the lib run and its downstream svc run to finish, got %+v", runs)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n, err := st.CountRuns(""); err != nil || n != 2 {
+		t.Fatalf("expected the chain to stop at lib, got %d runs (%v)", n, err)
+	}
+	svcRun, err := st.GetRun(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svcRun.AppID != "svc" || svcRun.TriggeredBy != "upstream:lib" || svcRun.TriggeredByRunID != 1 {
+		t.Fatalf("unexpected downstream run %+v", svcRun)
+	}
+	env, err := st.ListRunEnv(2)
+	if err != nil || len(env) != 4 {
+		t.Fatalf("expected upstream env on the downstream run, got %+v (%v)", env, err)
+	}
+
+	rec := do(http.MethodGet, "/api/runs/1", "")
+	var detail struct {
+		Downstream []store.Run `json:"downstream_runs"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &detail); err != nil || len(detail.Downstream) != 1 || detail.Downstream[0].AppID != "svc" {
+		t.Fatalf("expected svc in downstream_runs, got %s", rec.Body.String())
+	}
+
+	rec = do(http.MethodPut, "/api/apps/lib", `{"name":"Lib","repo":"`+repo+`","branch":"main","test_cmd":"echo test","downstream":[{"app":"svc"}]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "cycle: lib -\\u003e svc") {
+		t.Fatalf("expected cycle to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodPut, "/api/apps/svc", `{"name":"Svc","repo":"`+repo+`","branch":"main","test_cmd":"echo test","downstream":[{"app":"other","on":"sometimes"}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid on to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodPut, "/api/apps/svc", `{"name":"Svc","repo":"`+repo+`","branch":"main","test_cmd":"echo test","downstream":[{"app":"other"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected cycle to be removed, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// A user may only add downstream apps they can access; ones already there stay.
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, _ := st.CreateUser("alice", hash, false)
+	groupID, _ := st.CreateGroup("svc-devs")
+	_ = st.SetGroupApps(groupID, []string{"svc"})
+	_ = st.SetGroupUsers(groupID, []int64{aliceID})
+	aliceCookie := loginAndCookie(t, h, "alice", "alice123")
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/apps/svc", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(aliceCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = put(`{"name":"Svc","repo":"` + repo + `","branch":"main","test_cmd":"echo test","downstream":[{"app":"other"},{"app":"lib","on":"failure"}]}`)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "no access to downstream app lib") {
+		t.Fatalf("expected an inaccessible downstream app to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = put(`{"name":"Svc","repo":"` + repo + `","branch":"main","test_cmd":"echo test","downstream":[{"app":"other","on":"always"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected an existing downstream app to be kept, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServer_ReleaseTrains(t *testing.T) {
+	defer func(d time.Duration) { trainPollInterval = d }(trainPollInterval)
+	trainPollInterval = 10 * time.Millisecond
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "trains.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	adminHash, err := auth.HashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.EnsureAdminUser("admin", adminHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	var apps []config.App
+	for _, id := range []string{"db", "api", "billing", "web"} {
+		apps = append(apps, config.App{ID: id, Name: id, Repo: "https://example.com/" + id + ".git", Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test"})
+	}
+	appsPath := filepath.Join(t.TempDir(), "apps.yaml")
+	if err := config.SaveApps(appsPath, apps); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(apps, st, pipeline.NewRunner(t.TempDir()), appsPath, t.TempDir())
+	trainsPath := filepath.Join(t.TempDir(), "trains.yaml")
+	if err := os.WriteFile(trainsPath, []byte(`trains:
+  - name: platform
+    params: {VERSION: "", CHANNEL: stable}
+    stages:
+      - apps: [db]
+      - name: services
+        apps: [api, billing]
+      - apps: [web]
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	trains, err := config.LoadTrains(trainsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetTrains(trains)
+	h := srv.Handler()
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	// Hold the runs, so the test decides how they end.
+	if rec := do(http.MethodPut, "/api/maintenance", `{"enabled":true,"queue_runs":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("maintenance: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := do(http.MethodPost, "/api/trains/platform/runs", `{}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "param VERSION is required") {
+		t.Fatalf("expected missing param to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/trains/platform/runs", `{"params":{"VERSION":"1.2.0","OTHER":"x"}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown param to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec := do(http.MethodPost, "/api/trains/platform/runs", `{"params":{"VERSION":"1.2.0"}}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("start train: %d %s", rec.Code, rec.Body.String())
+	}
+	var started struct {
+		ID int64 `json:"train_run_id"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &started)
+
+	// waitStage waits until the train run has started stage and returns its app runs by app.
+	waitStage := func(stage int, n int) map[string]int64 {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			tr, err := st.GetTrainRun(started.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runs := map[string]int64{}
+			for _, r := range tr.Runs {
+				if r.Stage == stage {
+					runs[r.AppID] = r.RunID
+				}
+			}
+			if tr.Stage == stage && len(runs) == n {
+				return runs
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stage %d not started: %+v", stage, tr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	runs := waitStage(0, 1)
+	env, err := st.ListRunEnv(runs["db"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, v := range env {
+		got[v.Name] = v.Value
+	}
+	if got["VERSION"] != "1.2.0" || got["CHANNEL"] != "stable" || got["NOPPFLOW_TRAIN"] != "platform" || got["NOPPFLOW_TRAIN_STAGE"] != "stage 1" {
+		t.Fatalf("unexpected run env %v", got)
+	}
+	if err := st.UpdateRunStatus(runs["db"], "success", ""); err != nil {
+		t.Fatal(err)
+	}
+	runs = waitStage(1, 2)
+	if err := st.UpdateRunStatus(runs["api"], "success", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(runs["billing"], "failed", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var detail struct {
+		Status string              `json:"status"`
+		Error  string              `json:"error"`
+		Runs   []store.TrainRunRun `json:"runs"`
+		Stages []config.TrainStage `json:"stages"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for detail.Status != "failed" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the train run to fail, got %+v", detail)
+		}
+		time.Sleep(10 * time.Millisecond)
+		rec = do(http.MethodGet, fmt.Sprintf("/api/train-runs/%d", started.ID), "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &detail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(detail.Error, "services: run") || !strings.Contains(detail.Error, "of billing failed") || len(detail.Runs) != 3 || len(detail.Stages) != 3 {
+		t.Fatalf("unexpected failed train run %+v", detail)
+	}
+
+	rec = do(http.MethodGet, "/api/trains/platform/runs", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"failed"`) {
+		t.Fatalf("list train runs: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodGet, "/api/trains", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"name":"services"`) {
+		t.Fatalf("list trains: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/trains/missing/runs", `{}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown train, got %d", rec.Code)
+	}
+}
+
+func TestServer_DeployWithDependencies(t *testing.T) {
+	defer func(d time.Duration) { trainPollInterval = d }(trainPollInterval)
+	trainPollInterval = 10 * time.Millisecond
+	app := func(id string, deps ...string) config.App {
+		return config.App{ID: id, Name: id, Repo: "https://example.com/" + id + ".git", Branch: "main", SSHKeyName: "key-main", TestCmd: "echo test", DependsOn: deps}
+	}
+	apps := []config.App{app("db"), app("cache"), app("api", "db", "cache"), app("web", "api", "db"), app("worker", "missing")}
+	h, st, _, _ := setupTestServer(t, apps)
+	if _, err := st.CreateSSHKey("key-main", "dummy-private-key"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	// Hold the runs, so the test decides how they end.
+	if rec := do(http.MethodPut, "/api/maintenance", `{"enabled":true,"queue_runs":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("maintenance: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := do(http.MethodGet, "/api/apps/dependency-graph", "")
+	var graph struct {
+		Apps []struct {
+			ID         string   `json:"id"`
+			DependsOn  []string `json:"depends_on"`
+			Dependents []string `json:"dependents"`
+		} `json:"apps"`
+		Edges []map[string]string `json:"edges"`
+		Cycle []string            `json:"cycle"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &graph); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("graph: %d %s", rec.Code, rec.Body.String())
+	}
+	if len(graph.Apps) != 5 || len(graph.Edges) != 4 || graph.Cycle != nil || strings.Join(graph.Apps[0].Dependents, ",") != "api,web" {
+		t.Fatalf("unexpected graph %+v", graph)
+	}
+
+	rec = do(http.MethodPut, "/api/apps/db", `{"name":"db","repo":"https://example.com/db.git","branch":"main","test_cmd":"echo test","depends_on":["web"]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "cycle: db -\\u003e web -\\u003e api -\\u003e db") {
+		t.Fatalf("expected cycle to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodPut, "/api/apps/db", `{"name":"db","repo":"https://example.com/db.git","branch":"main","test_cmd":"echo test","depends_on":["db"]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected self-dependency to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/apps/worker/deploy-with-dependencies", ""); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "app missing") {
+		t.Fatalf("expected missing dependency to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/apps/nope/deploy-with-dependencies", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown app, got %d", rec.Code)
+	}
+
+	rec = do(http.MethodPost, "/api/apps/web/deploy-with-dependencies", "")
+	var started struct {
+		ID     int64               `json:"train_run_id"`
+		Stages []config.TrainStage `json:"stages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("deploy with dependencies: %d %s", rec.Code, rec.Body.String())
+	}
+	if len(started.Stages) != 3 || strings.Join(started.Stages[0].Apps, ",") != "cache,db" || started.Stages[1].Apps[0] != "api" || started.Stages[2].Apps[0] != "web" {
+		t.Fatalf("unexpected stages %+v", started.Stages)
+	}
+	waitStage := func(stage int, n int) map[string]int64 {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			tr, err := st.GetTrainRun(started.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runs := map[string]int64{}
+			for _, r := range tr.Runs {
+				if r.Stage == stage {
+					runs[r.AppID] = r.RunID
+				}
+			}
+			if tr.Stage == stage && len(runs) == n {
+				return runs
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stage %d not started: %+v", stage, tr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	runs := waitStage(0, 2)
+	for _, id := range runs {
+		if err := st.UpdateRunStatus(id, "success", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs = waitStage(1, 1)
+	if err := st.UpdateRunStatus(runs["api"], "failed", ""); err != nil {
+		t.Fatal(err)
+	}
+	var detail struct {
+		Train  string              `json:"train"`
+		Status string              `json:"status"`
+		Runs   []store.TrainRunRun `json:"runs"`
+		Stages []config.TrainStage `json:"stages"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for detail.Status != "failed" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the deploy to fail, got %+v", detail)
+		}
+		time.Sleep(10 * time.Millisecond)
+		rec = do(http.MethodGet, fmt.Sprintf("/api/train-runs/%d", started.ID), "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &detail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if detail.Train != "deps:web" || len(detail.Runs) != 3 || len(detail.Stages) != 3 {
+		t.Fatalf("expected web not to be deployed after api failed, got %+v", detail)
+	}
+}
+
+func TestServer_Releases(t *testing.T) {
+	apps := []config.App{
+		{ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "web", Name: "Web", Repo: "https://example.com/web.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	apiRun, err := st.CreateRun("api", "abc123", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webRun, err := st.CreateRun("web", "def456", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(apiRun, "success", ""); err != nil {
+		t.Fatal(err)
+	}
+	devID, err := st.CreateGroup("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, err := st.CreateUser("alice", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(aliceID, []int64{devID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppGroups("api", []int64{devID}); err != nil {
+		t.Fatal(err)
+	}
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	aliceCookie := loginAndCookie(t, h, "alice", "alice123")
+	do := func(cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(adminCookie, http.MethodPost, "/api/releases", `{"version":"","environment":"prod"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected missing version to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(adminCookie, http.MethodPost, "/api/releases", `{"version":"2.3.1","environment":"prod","run_ids":[999]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown run to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(aliceCookie, http.MethodPost, "/api/releases", fmt.Sprintf(`{"version":"2.3.1","environment":"prod","run_ids":[%d]}`, webRun)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected run of an inaccessible app to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec := do(adminCookie, http.MethodPost, "/api/releases", fmt.Sprintf(`{"version":"2.3.1","environment":"prod","changelog":"- faster checkout","run_ids":[%d,%d,%d]}`, apiRun, webRun, apiRun))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create release: %d %s", rec.Code, rec.Body.String())
+	}
+	var rel store.Release
+	if err := json.Unmarshal(rec.Body.Bytes(), &rel); err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != "2.3.1" || rel.CreatedBy != "admin" || len(rel.Runs) != 2 || rel.Status != "pending" {
+		t.Fatalf("unexpected release %+v", rel)
+	}
+	if rec := do(adminCookie, http.MethodPost, "/api/releases", `{"version":"2.3.1","environment":"prod"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected duplicate release to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	releasePath := fmt.Sprintf("/api/releases/%d", rel.ID)
+
+	// Alice cannot access web, so she does not see the release.
+	if rec := do(aliceCookie, http.MethodGet, releasePath, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for alice, got %d", rec.Code)
+	}
+	if rec := do(aliceCookie, http.MethodGet, "/api/releases", ""); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("expected no releases for alice, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if err := st.UpdateRunStatus(webRun, "failed", ""); err != nil {
+		t.Fatal(err)
+	}
+	rec = do(adminCookie, http.MethodGet, releasePath+"/timeline", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("timeline: %d %s", rec.Code, rec.Body.String())
+	}
+	var timeline struct {
+		Status string `json:"status"`
+		Events []struct {
+			Event string `json:"event"`
+			RunID int64  `json:"run_id"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &timeline); err != nil {
+		t.Fatal(err)
+	}
+	if timeline.Status != "failed" || len(timeline.Events) != 5 {
+		t.Fatalf("unexpected timeline %s", rec.Body.String())
+	}
+
+	// Updating replaces the runs; alice now sees the release but cannot change it.
+	rec = do(adminCookie, http.MethodPut, releasePath, fmt.Sprintf(`{"version":"2.3.1","environment":"prod","changelog":"- faster checkout","run_ids":[%d]}`, apiRun))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update release: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &rel); err != nil {
+		t.Fatal(err)
+	}
+	if len(rel.Runs) != 1 || rel.Status != "success" {
+		t.Fatalf("unexpected updated release %+v", rel)
+	}
+	if rec := do(aliceCookie, http.MethodGet, "/api/releases?environment=prod", ""); !strings.Contains(rec.Body.String(), `"version":"2.3.1"`) {
+		t.Fatalf("expected alice to see the release, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(aliceCookie, http.MethodGet, "/api/releases?environment=staging", ""); strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("expected no staging releases, got %s", rec.Body.String())
+	}
+	if rec := do(aliceCookie, http.MethodDelete, releasePath, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected alice not to delete the release, got %d", rec.Code)
+	}
+	if rec := do(adminCookie, http.MethodDelete, releasePath, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete release: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(adminCookie, http.MethodGet, releasePath, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted release to be gone, got %d", rec.Code)
+	}
+	if run, _ := st.GetRun(apiRun); run == nil {
+		t.Fatal("deleting a release must keep its runs")
+	}
+}
+
+func TestServer_GroupLanding(t *testing.T) {
+	apps := []config.App{
+		{ID: "api", Name: "API", Repo: "https://example.com/api.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "web", Name: "Web", Repo: "https://example.com/web.git", Branch: "main", TestCmd: "echo test"},
+		{ID: "ops", Name: "Ops", Repo: "https://example.com/ops.git", Branch: "main", TestCmd: "echo test"},
+	}
+	h, st, _, _ := setupTestServer(t, apps)
+	backendID, err := st.CreateGroup("backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontendID, err := st.CreateGroup("frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("alice123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, err := st.CreateUser("alice", hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(aliceID, []int64{backendID, frontendID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(backendID, []string{"api"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetGroupApps(frontendID, []string{"web"}); err != nil {
+		t.Fatal(err)
+	}
+	adminCookie := loginAndCookie(t, h, "admin", "admin")
+	do := func(cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	landingPath := func(id int64) string { return fmt.Sprintf("/api/groups/%d/landing", id) }
+
+	if rec := do(adminCookie, http.MethodPut, landingPath(backendID), `{"page":"dashboard"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown page to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(adminCookie, http.MethodPut, landingPath(backendID), `{"app_ids":["nope"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown app to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(adminCookie, http.MethodPut, landingPath(999), `{}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown group to be 404, got %d", rec.Code)
+	}
+	// ops is not accessible to alice, so it is left out of her landing apps.
+	if rec := do(adminCookie, http.MethodPut, landingPath(backendID), `{"page":"apps","app_ids":["api","ops","api"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("set landing: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(adminCookie, http.MethodPut, landingPath(frontendID), `{"page":"runs","app_ids":["web"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("set landing: %d %s", rec.Code, rec.Body.String())
+	}
+	rec := do(adminCookie, http.MethodGet, fmt.Sprintf("/api/groups/%d", backendID), "")
+	if !strings.Contains(rec.Body.String(), `"landing":{"group_id":`+strconv.FormatInt(backendID, 10)+`,"page":"apps","app_ids":["api","ops"]}`) {
+		t.Fatalf("expected landing in group, got %s", rec.Body.String())
+	}
+
+	aliceCookie := loginAndCookie(t, h, "alice", "alice123")
+	var profile struct {
+		Landing struct {
+			Page   string   `json:"page"`
+			AppIDs []string `json:"app_ids"`
+		} `json:"landing"`
+	}
+	readProfile := func() {
+		t.Helper()
+		rec := do(aliceCookie, http.MethodGet, "/api/auth/profile", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("profile: %d %s", rec.Code, rec.Body.String())
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readProfile()
+	if profile.Landing.Page != "apps" || strings.Join(profile.Landing.AppIDs, ",") != "api,web" {
+		t.Fatalf("unexpected landing %+v", profile.Landing)
+	}
+
+	// Clearing the backend landing leaves the frontend one.
+	if rec := do(adminCookie, http.MethodPut, landingPath(backendID), `{}`); rec.Code != http.StatusOK {
+		t.Fatalf("clear landing: %d %s", rec.Code, rec.Body.String())
+	}
+	readProfile()
+	if profile.Landing.Page != "runs" || strings.Join(profile.Landing.AppIDs, ",") != "web" {
+		t.Fatalf("unexpected landing after clearing %+v", profile.Landing)
+	}
+}
+
+func TestServer_DemoMode(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "demo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	srv := New(DemoApps(), st, nil, filepath.Join(t.TempDir(), "apps.yaml"), t.TempDir())
+	srv.SetDemo(true)
+	if err := srv.SeedDemo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SeedDemo(); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := st.ListRuns("orders-api", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 10 {
+		t.Fatalf("expected 10 seeded runs after seeding twice, got %d", len(runs))
+	}
+	h := srv.Handler()
+	cookie := loginAndCookie(t, h, "demo", "demo")
+	do := func(method, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(`{}`))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := do(http.MethodGet, fmt.Sprintf("/api/runs/%d/timeline", runs[0].ID))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"step.end"`) {
+		t.Fatalf("expected a timeline with step events, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/apps/orders-api/run"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a demo user starting a run, got %d", rec.Code)
+	}
+
+	if err := srv.SetGraphQL(true); err != nil {
+		t.Fatal(err)
+	}
+	graphQL := func(query string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		req := httptest.NewRequest(http.MethodPost, "/api/graphql", bytes.NewReader(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := graphQL(`{ me { username } }`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"username":"demo"`) {
+		t.Fatalf("expected a demo user to run GraphQL queries, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := graphQL(`mutation { deleteApp(id: "orders-api") }`); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a demo user's GraphQL mutation, got %d", rec.Code)
+	}
+}
+
+// stubBackend implements store.Backend for tests that need no database; methods it does not
+// override panic through the nil embedded Backend.
+type stubBackend struct {
+	store.Backend
+	driver string
+}
+
+func (b stubBackend) Driver() string { return b.driver }
+
+func (b stubBackend) GetSession(tokenHash string) (*store.Session, error) { return nil, nil }
+
+func (b stubBackend) GetMaintenance() (*store.Maintenance, error) { return nil, nil }
+
+func TestServer_StubBackend(t *testing.T) {
+	srv := New(nil, stubBackend{driver: "stub"}, nil, filepath.Join(t.TempDir(), "apps.yaml"), t.TempDir())
+	srv.SetBuildInfo("v1.2.3", "abc")
+	h := srv.Handler()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/status", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"version":"v1.2.3"`) {
+		t.Fatalf("unexpected status response %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a session, got %d", rec.Code)
+	}
+}
+
+func TestServer_LockDatabaseSerializesMigrations(t *testing.T) {
+	srv := New(nil, nil, nil, "", "")
+	release, err := srv.lockDatabase(context.Background(), "migrate", "db:5432/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := srv.lockDatabase(context.Background(), "migrate", "db:5432/other")
+	if err != nil {
+		t.Fatalf("expected another database to be lockable, got %v", err)
+	}
+	other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := srv.lockDatabase(ctx, "migrate", "db:5432/app"); err == nil {
+		t.Fatal("expected second lock of the same database to wait")
+	}
+	release()
+	again, err := srv.lockDatabase(context.Background(), "migrate", "db:5432/app")
+	if err != nil {
+		t.Fatalf("expected lock after release, got %v", err)
+	}
+	again()
+
+	app := &config.App{ID: "a", Runner: "kubernetes"}
+	step := &config.Step{Name: "migrate", DBMigrate: &config.DBMigrateStep{Tool: "Flyway", DSNEnv: "DATABASE_URL"}}
+	if err := validateDBMigrateStep(app, step); err == nil || !strings.Contains(err.Error(), "cannot run as a Kubernetes Job") {
+		t.Fatalf("expected k8s job runs to be rejected, got %v", err)
+	}
+	app.Runner = ""
+	if err := validateDBMigrateStep(app, step); err != nil || step.DBMigrate.Tool != "flyway" {
+		t.Fatalf("expected valid flyway step, got %v (%+v)", err, step.DBMigrate)
+	}
+	step.DBMigrate = &config.DBMigrateStep{Tool: "goose", DSNEnv: "DATABASE_URL"}
+	if err := validateDBMigrateStep(app, step); err == nil || !strings.Contains(err.Error(), "driver is required") {
+		t.Fatalf("expected goose without driver to be rejected, got %v", err)
+	}
+}
+
+func TestServer_DeployPolicies(t *testing.T) {
+	st, err := store.New("sqlite3", filepath.Join(t.TempDir(), "policies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	releaseID, err := st.CreateGroup("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID, err := st.CreateUser("alice", "x", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserGroups(aliceID, []int64{releaseID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateUser("bob", "x", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppTags("api", []string{"env:prod"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	content := "policies:\n  - name: prod\n    tags: [env:prod]\n    branches: [main]\n    hours: Mon-Fri 09:00-17:00\n    groups: [release]\n    users: [\"trigger:*\"]\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(nil, st, nil, "", "")
+	srv.SetPolicies(cfg)
+
+	deploy := config.App{ID: "api", Branch: "main", Steps: []config.Step{{Name: "deploy", K8sDeploy: true}}}
+	monday := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	if err := srv.checkPolicies(deploy, "alice", monday); err != nil {
+		t.Fatalf("expected alice to deploy, got %v", err)
+	}
+	if err := srv.checkPolicies(deploy, "trigger:nightly", monday); err != nil {
+		t.Fatalf("expected trigger runs to deploy, got %v", err)
+	}
+	if err := srv.checkPolicies(deploy, "bob", monday); err == nil || !strings.Contains(err.Error(), "only allowed for members of release or trigger:* (run triggered by bob)") {
+		t.Fatalf("expected bob to be blocked, got %v", err)
+	}
+	if err := srv.checkPolicies(deploy, "alice", monday.AddDate(0, 0, 5)); err == nil || !strings.Contains(err.Error(), "only allowed Mon-Fri 09:00-17:00 UTC (now Sat 10:00)") {
+		t.Fatalf("expected weekend deploy to be blocked, got %v", err)
+	}
+	feature := deploy
+	feature.Branch = "feature-x"
+	if err := srv.checkPolicies(feature, "alice", monday); err == nil || !strings.Contains(err.Error(), "policy prod: deploys of api are only allowed from branch main") {
+		t.Fatalf("expected feature branch deploy to be blocked, got %v", err)
+	}
+	build := config.App{ID: "api", Branch: "feature-x", Steps: []config.Step{{Name: "test", Cmd: "go test ./..."}}}
+	if err := srv.checkPolicies(build, "bob", monday.AddDate(0, 0, 5)); err != nil {
+		t.Fatalf("expected runs without deploy steps to be unchecked, got %v", err)
+	}
+	other := deploy
+	other.ID = "web"
+	if err := srv.checkPolicies(other, "bob", monday); err != nil {
+		t.Fatalf("expected apps without the tag to be unchecked, got %v", err)
 	}
-	t.Fatalf("no %s cookie in login response", sessionCookieName)
-	return nil
 }
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+var shellNameRE = regexp.MustCompile(`^[A-Za-z0-9_./+-]+$`)
+
+// validateStepShell checks and normalizes the app's shell (a command name or path, e.g. bash or
+// /bin/zsh) and profile scripts (one path each, sourced before every script and file step).
+// Since cmd steps run without a shell, apps with profile scripts or a login shell may not have
+// any, which would run without the environment those set up.
+func validateStepShell(app *config.App) error {
+	app.Shell = strings.TrimSpace(app.Shell)
+	if app.Shell != "" && !shellNameRE.MatchString(app.Shell) {
+		return errors.New("shell must be a command name or path without spaces, e.g. bash or /bin/zsh")
+	}
+	scripts := make([]string, 0, len(app.ProfileScripts))
+	for _, p := range app.ProfileScripts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if strings.ContainsAny(p, "\n\r;&|`") {
+			return errors.New("profile_scripts must be file paths, e.g. ~/.nvm/nvm.sh")
+		}
+		scripts = append(scripts, p)
+	}
+	app.ProfileScripts = nil
+	if len(scripts) > 0 {
+		app.ProfileScripts = scripts
+	}
+	if len(app.ProfileScripts) == 0 && !app.LoginShell {
+		return nil
+	}
+	post := app.EffectivePost()
+	for _, steps := range [][]config.Step{app.EffectiveSteps(), post.OnSuccess, post.OnFailure, post.Always} {
+		for _, step := range steps {
+			if step.Cmd != "" {
+				return fmt.Errorf("step %s: cmd steps do not run through the shell, so profile_scripts and login_shell do not apply to them; use script instead", step.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"noppflow/internal/config"
+	"noppflow/internal/pipeline"
+)
+
+// validateSignStep checks and normalizes a sign step: key_env (and password_env) must be env var
+// names. Job runs cannot read the images built by earlier steps, so there the image is required.
+func validateSignStep(app *config.App, step *config.Step) error {
+	sg := step.Sign
+	sg.Image = strings.TrimSpace(sg.Image)
+	sg.KeyEnv = strings.TrimSpace(sg.KeyEnv)
+	if !validEnvVarName(sg.KeyEnv) {
+		return fmt.Errorf("step %s: sign key_env must be an env var name", step.Name)
+	}
+	sg.PasswordEnv = strings.TrimSpace(sg.PasswordEnv)
+	if sg.PasswordEnv != "" && !validEnvVarName(sg.PasswordEnv) {
+		return fmt.Errorf("step %s: sign password_env must be an env var name", step.Name)
+	}
+	if sg.Image == "" && appUsesK8sJob(*app) {
+		return fmt.Errorf("step %s: sign image is required when the app runs as a Kubernetes Job", step.Name)
+	}
+	return nil
+}
+
+// k8sSignCommand returns the shell command of a sign step in a Job script.
+func k8sSignCommand(step config.Step, env k8sEnv) string {
+	sg := step.Sign
+	password := `""`
+	if sg.PasswordEnv != "" {
+		password = fmt.Sprintf(`"${%s:?%s}"`, sg.PasswordEnv, "password_env "+sg.PasswordEnv+" is not set")
+	}
+	return fmt.Sprintf(`COSIGN_PASSWORD=%s cosign sign --yes --key env://%s %s`, password, sg.KeyEnv, k8sStepEnvValue(sg.Image, env))
+}
+
+// imageVerifier returns the pipeline.ImageVerifier of a run, or nil when the app's environment
+// has no signature policy. Each image is verified once per run; stepEnv gives cosign the run's
+// registry credentials.
+func (s *Server) imageVerifier(runID int64, app config.App, stepEnv map[string]string) pipeline.ImageVerifier {
+	env := s.findEnvironment(app.Environment)
+	if env == nil || env.Signatures == nil {
+		return nil
+	}
+	policy := *env.Signatures
+	verified := make(map[string]bool)
+	return func(ctx context.Context, step string, images []pipeline.ImageDigest, logf func(format string, args ...interface{})) error {
+		blocked := func(err error) error {
+			go s.notify(app, notification{Event: "run.deploy_blocked", RunID: runID, Message: err.Error()})
+			return err
+		}
+		if len(images) == 0 {
+			return blocked(fmt.Errorf("environment %s only accepts signed images, and the run reports no image digest to verify", env.Name))
+		}
+		for _, img := range images {
+			ref := img.Image + "@" + img.Digest
+			if verified[ref] {
+				continue
+			}
+			logf("%s: verifying the signature of %s", step, ref)
+			if err := pipeline.VerifyImageSignature(ctx, stepEnv, img, policy); err != nil {
+				return blocked(fmt.Errorf("environment %s only accepts signed images: %s: %v", env.Name, ref, err))
+			}
+			verified[ref] = true
+		}
+		return nil
+	}
+}
+
+// verifyK8sJobImages applies the signature policy of an app running as a Kubernetes Job before the
+// Job is created. Only the image passed in NOPPFLOW_IMAGE (e.g. by a promotion) is known then, so
+// Job runs that build and deploy in one go cannot deploy to such environments.
+func (s *Server) verifyK8sJobImages(runID int64, app config.App, stepEnv map[string]string) error {
+	verify := s.imageVerifier(runID, app, stepEnv)
+	if verify == nil || !appUsesK8sJob(app) || !appHasDeploySteps(app) {
+		return nil
+	}
+	return verify(context.Background(), "deploy", pipeline.DeployImages(stepEnv, nil), func(string, ...interface{}) {})
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+const (
+	// slackMaxSkew is how old a Slack request timestamp may be (replay protection).
+	slackMaxSkew = 5 * time.Minute
+	// slackStatusTimeout bounds how long a run is followed for its final status (Slack response URLs expire after 30 minutes).
+	slackStatusTimeout = 30 * time.Minute
+)
+
+// slackStatusPollInterval is how often a run started from Slack is checked for completion.
+var slackStatusPollInterval = 5 * time.Second
+
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+// SetSlack enables the Slack slash command endpoint. Requests are verified with signingSecret;
+// teamID, when set, only accepts requests from that workspace.
+func (s *Server) SetSlack(signingSecret, teamID string) {
+	s.slackSigningSecret = signingSecret
+	s.slackTeamID = teamID
+}
+
+// SetPublicURL sets the external base URL of the server, used for links in messages sent to other systems.
+func (s *Server) SetPublicURL(u string) {
+	s.publicURL = strings.TrimRight(u, "/")
+}
+
+// appRunsURL links to the runs of an app in the web UI.
+func (s *Server) appRunsURL(appID string) string {
+	return s.publicURL + "/?app_id=" + url.QueryEscape(appID)
+}
+
+var (
+	errSlackStale     = errors.New("request timestamp missing or too old")
+	errSlackSignature = errors.New("signature does not match request")
+)
+
+// verifySlackRequest checks X-Slack-Signature: "v0=" + hex HMAC-SHA256(secret, "v0:" + timestamp + ":" + body).
+func verifySlackRequest(secret string, header http.Header, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil || now.Sub(time.Unix(ts, 0)).Abs() > slackMaxSkew {
+		return errSlackStale
+	}
+	sig, ok := strings.CutPrefix(header.Get("X-Slack-Signature"), "v0=")
+	got, err := hex.DecodeString(sig)
+	if !ok || err != nil {
+		return errSlackSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:", ts)
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errSlackSignature
+	}
+	return nil
+}
+
+// slackMessage is a slash command reply; in_channel replies are visible to everyone in the channel.
+type slackMessage struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+func replySlack(w http.ResponseWriter, inChannel bool, format string, args ...interface{}) {
+	msg := slackMessage{ResponseType: "ephemeral", Text: fmt.Sprintf(format, args...)}
+	if inChannel {
+		msg.ResponseType = "in_channel"
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+const slackHelp = "Usage:\n" +
+	"• `run <app>` — start a run of the app\n" +
+	"• `deploy <app>` — same as run\n" +
+	"• `deploy <app> to <environment>` — promote the app's image to an environment and deploy it\n" +
+	"Apps can be given by ID or name."
+
+// slackCommand handles the Slack slash command (e.g. "/piaflow deploy app-x to prod"). The request is
+// authenticated by Slack's signature and workspace; the Slack user must be linked to a user, whose
+// app access applies. Final run statuses are posted back to Slack's response_url.
+func (s *Server) slackCommand(w http.ResponseWriter, r *http.Request) {
+	if s.slackSigningSecret == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "slack integration is not enabled"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "could not read body"})
+		return
+	}
+	if err := verifySlackRequest(s.slackSigningSecret, r.Header, body, time.Now()); err != nil {
+		log.Printf("slack command from %s rejected: %v", r.RemoteAddr, err)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid slack request: " + err.Error()})
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid form body"})
+		return
+	}
+	if s.slackTeamID != "" && form.Get("team_id") != s.slackTeamID {
+		log.Printf("slack command from workspace %q rejected: not %s", form.Get("team_id"), s.slackTeamID)
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "slack workspace not allowed"})
+		return
+	}
+	slackUserID := form.Get("user_id")
+	user, err := s.store.UserBySlackID(slackUserID)
+	if err != nil {
+		replySlack(w, false, "Error: %v", err)
+		return
+	}
+	if user == nil {
+		replySlack(w, false, "Your Slack account is not linked to a user. Ask an admin to link Slack user ID `%s`.", slackUserID)
+		return
+	}
+
+	args := strings.Fields(form.Get("text"))
+	if len(args) == 0 || args[0] == "help" {
+		replySlack(w, false, "%s", slackHelp)
+		return
+	}
+	verb := strings.ToLower(args[0])
+	envName := ""
+	switch {
+	case (verb == "run" || verb == "deploy") && len(args) == 2:
+	case verb == "deploy" && len(args) == 4 && strings.EqualFold(args[2], "to"):
+		envName = args[3]
+	default:
+		replySlack(w, false, "Unknown command `%s`.\n%s", form.Get("text"), slackHelp)
+		return
+	}
+	app, ok := s.findAppByIDOrName(args[1])
+	if !ok {
+		replySlack(w, false, "App `%s` not found.", args[1])
+		return
+	}
+	if !user.IsAdmin {
+		allowed, err := s.userCanAccessApp(user.ID, app.ID)
+		if err != nil {
+			replySlack(w, false, "Error: %v", err)
+			return
+		}
+		if !allowed {
+			replySlack(w, false, "You have no access to app `%s`.", app.Name)
+			return
+		}
+	}
+	responseURL := form.Get("response_url")
+
+	if envName == "" {
+		runID, err := s.startRun(app, user.Username, nil)
+		if err != nil {
+			replySlack(w, false, "Could not start a run of %s: %v", app.Name, err)
+			return
+		}
+		go s.followRunForSlack(responseURL, app, runID)
+		replySlack(w, true, "%s started run #%d of *%s*: %s", user.Username, runID, app.Name, s.appRunsURL(app.ID))
+		return
+	}
+	p, deployErr, err := s.promote(context.Background(), app, envName, 0, authUser{ID: user.ID, Username: user.Username, IsAdmin: user.IsAdmin})
+	if err != nil {
+		replySlack(w, false, "Could not promote %s to %s: %v", app.Name, envName, err)
+		return
+	}
+	switch {
+	case deployErr != nil:
+		replySlack(w, true, "%s promoted *%s* (%s) to %s, but the deploy did not start: %v", user.Username, app.Name, p.Digest, envName, deployErr)
+	case p.DeployRunID > 0:
+		go s.followRunForSlack(responseURL, app, p.DeployRunID)
+		replySlack(w, true, "%s promoted *%s* (%s) to %s; deploy run #%d started: %s", user.Username, app.Name, p.Digest, envName, p.DeployRunID, s.appRunsURL(app.ID))
+	default:
+		replySlack(w, true, "%s promoted *%s* (%s) to %s.", user.Username, app.Name, p.Digest, envName)
+	}
+}
+
+// findAppByIDOrName looks an app up by ID, then by case-insensitive name.
+func (s *Server) findAppByIDOrName(ref string) (config.App, bool) {
+	if app, ok := s.findApp(ref); ok {
+		return app, true
+	}
+	s.appsMu.RLock()
+	defer s.appsMu.RUnlock()
+	for _, a := range s.apps {
+		if strings.EqualFold(a.Name, ref) {
+			return a, true
+		}
+	}
+	return config.App{}, false
+}
+
+// followRunForSlack waits for a run to finish and posts its final status to the slash command's response_url.
+func (s *Server) followRunForSlack(responseURL string, app config.App, runID int64) {
+	if responseURL == "" {
+		return
+	}
+	deadline := time.Now().Add(slackStatusTimeout)
+	var run *store.Run
+	for time.Now().Before(deadline) {
+		time.Sleep(slackStatusPollInterval)
+		var err error
+		if run, err = s.store.GetRun(runID); err != nil || run == nil {
+			log.Printf("slack: follow run %d: %v", runID, err)
+			return
+		}
+		if run.Status != "pending" && run.Status != "running" {
+			break
+		}
+	}
+	if run == nil || run.Status == "pending" || run.Status == "running" {
+		return
+	}
+	body, _ := json.Marshal(slackMessage{ResponseType: "in_channel", Text: fmt.Sprintf("Run #%d of *%s* finished: *%s* %s", runID, app.Name, run.Status, s.appRunsURL(app.ID))})
+	resp, err := slackClient.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("slack: post status of run %d: %v", runID, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// setUserSlack links a Slack user ID to a user (admin). An empty slack_user_id removes the link.
+func (s *Server) setUserSlack(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	user, err := s.store.GetUser(userID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if user == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+	var body struct {
+		SlackUserID string `json:"slack_user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	slackUserID := strings.TrimSpace(body.SlackUserID)
+	if len(slackUserID) > 64 || strings.ContainsAny(slackUserID, " \t\n") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid slack_user_id"})
+		return
+	}
+	if err := s.store.SetSlackUser(userID, slackUserID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "slack_user_id": slackUserID})
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/ssh"
+	"noppflow/internal/store"
+)
+
+// rotateSSHKey replaces the private key of an SSH key in place, so apps keep referencing it by
+// name (admin). Body: {"private_key": "..."} or {"generate": true} for a new ed25519 key, whose
+// public key is returned to be installed as deploy key. Runs already queued or running keep the
+// key they were started with.
+func (s *Server) rotateSSHKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	keyID, err := strconv.ParseInt(chi.URLParam(r, "keyID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid key id"})
+		return
+	}
+	var body struct {
+		PrivateKey string `json:"private_key"`
+		Generate   bool   `json:"generate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	privateKey := strings.TrimSpace(body.PrivateKey)
+	if (privateKey == "") == !body.Generate {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "exactly one of private_key and generate is required"})
+		return
+	}
+	key, err := s.store.GetSSHKey(keyID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if key == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "ssh key not found"})
+		return
+	}
+	if body.Generate {
+		if privateKey, err = generateSSHKey("noppflow " + key.Name); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "private_key must be an unencrypted SSH private key"})
+		return
+	}
+	rotation := store.SSHKeyRotation{
+		KeyID:          key.ID,
+		OldFingerprint: sshKeyFingerprint(key.PrivateKey),
+		NewFingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		Generated:      body.Generate,
+		RotatedBy:      user.Username,
+	}
+	if rotation.NewFingerprint == rotation.OldFingerprint {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "private_key is the current key"})
+		return
+	}
+	if rotation.ID, err = s.store.RotateSSHKey(privateKey, rotation); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "ssh key not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":          key.ID,
+		"name":        key.Name,
+		"fingerprint": rotation.NewFingerprint,
+		"public_key":  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		"rotation":    rotation,
+	})
+}
+
+// listSSHKeyRotations returns the rotation history of an SSH key (admin).
+func (s *Server) listSSHKeyRotations(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	keyID, err := strconv.ParseInt(chi.URLParam(r, "keyID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid key id"})
+		return
+	}
+	key, err := s.store.GetSSHKey(keyID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if key == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "ssh key not found"})
+		return
+	}
+	rotations, err := s.store.ListSSHKeyRotations(keyID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, rotations)
+}
+
+// generateSSHKey returns a new ed25519 private key in OpenSSH PEM format.
+func generateSSHKey(comment string) (string, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// sshKeyFingerprint returns the SHA256 fingerprint of a private key's public key, or "" when it
+// cannot be parsed (e.g. it is passphrase-protected).
+func sshKeyFingerprint(privateKey string) string {
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(signer.PublicKey())
+}
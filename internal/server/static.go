@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// immutableCacheControl is sent for fingerprinted assets, whose URL changes with their content.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// hashedAssetName matches fingerprinted file names such as app.3f9a2c1b.js.
+var hashedAssetName = regexp.MustCompile(`\.[0-9a-f]{8,}\.[A-Za-z0-9]+$`)
+
+// assetRefPattern matches the local script and stylesheet references of HTML pages, which
+// serveStatic fingerprints with ?v=<version>.
+var assetRefPattern = regexp.MustCompile(`((?:src|href)=")(/[^"?#:]+\.(?:js|css))"`)
+
+// staticAsset is a static file read into memory with its content version (a hash prefix).
+type staticAsset struct {
+	modTime time.Time
+	size    int64
+	body    []byte
+	version string
+}
+
+// serveStatic serves the files of the static dir and falls back to index.html for unknown routes
+// (but not for missing assets, which are 404). HTML pages are never cached and get their /js and
+// /css references fingerprinted; fingerprinted assets (hashed file names or the current ?v=) are
+// cached for a year, other files are revalidated with their ETag.
+func (s *Server) serveStatic(w http.ResponseWriter, r *http.Request) {
+	file, ok := s.staticFile(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	asset, err := s.loadStaticAsset(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.EqualFold(filepath.Ext(file), ".html") {
+		body := s.fingerprintAssetRefs(asset.body)
+		w.Header().Set("Cache-Control", "no-store")
+		http.ServeContent(w, r, file, time.Time{}, bytes.NewReader(body))
+		return
+	}
+	w.Header().Set("ETag", `"`+asset.version+`"`)
+	if v := r.URL.Query().Get("v"); hashedAssetName.MatchString(file) || (v != "" && v == asset.version) {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, file, asset.modTime, bytes.NewReader(asset.body))
+}
+
+// staticFile maps a URL path to a file of the static dir: index.html for "/" and for routes that
+// are not files, false for hidden files, missing assets, and anything resolving outside the dir.
+func (s *Server) staticFile(urlPath string) (string, bool) {
+	if strings.ContainsAny(urlPath, "\\\x00") {
+		return "", false
+	}
+	clean := path.Clean("/" + urlPath)
+	for _, segment := range strings.Split(clean, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", false
+		}
+	}
+	index := filepath.Join(s.staticDir, "index.html")
+	if clean == "/" {
+		return index, true
+	}
+	file := filepath.Join(s.staticDir, filepath.FromSlash(clean))
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		if ext := path.Ext(clean); ext != "" && ext != ".html" {
+			return "", false
+		}
+		return index, true
+	}
+	return file, withinDir(s.staticDir, file)
+}
+
+// withinDir reports whether file, with symlinks resolved, is inside dir.
+func withinDir(dir, file string) bool {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// loadStaticAsset returns file from the asset cache, reading it again when its size or
+// modification time changed.
+func (s *Server) loadStaticAsset(file string) (*staticAsset, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	s.staticMu.Lock()
+	cached := s.staticAssets[file]
+	s.staticMu.Unlock()
+	if cached != nil && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	asset := &staticAsset{modTime: info.ModTime(), size: info.Size(), body: body, version: hex.EncodeToString(sum[:8])}
+	s.staticMu.Lock()
+	if s.staticAssets == nil {
+		s.staticAssets = make(map[string]*staticAsset)
+	}
+	s.staticAssets[file] = asset
+	s.staticMu.Unlock()
+	return asset, nil
+}
+
+// fingerprintAssetRefs adds ?v=<version> to the local script and stylesheet references of an
+// HTML page, so a changed asset gets a new URL. References to missing files stay as they are.
+func (s *Server) fingerprintAssetRefs(html []byte) []byte {
+	return assetRefPattern.ReplaceAllFunc(html, func(ref []byte) []byte {
+		m := assetRefPattern.FindSubmatch(ref)
+		file, ok := s.staticFile(string(m[2]))
+		if !ok || strings.EqualFold(filepath.Ext(file), ".html") {
+			return ref
+		}
+		asset, err := s.loadStaticAsset(file)
+		if err != nil {
+			return ref
+		}
+		return []byte(string(m[1]) + string(m[2]) + "?v=" + asset.version + `"`)
+	})
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// status reports what is deployed (version, commit), the maintenance state, demo mode, and the
+// display timezone for the UI banner and footer. Signed-in users also get uptime, DB driver, queue
+// depth, active runs, which replica answered and whether it is the leader, and the apps they can
+// access whose cluster state drifted from their last deploy.
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	maintenance, err := s.maintenanceStatus()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	out := map[string]interface{}{
+		"version":     s.version,
+		"commit":      s.commit,
+		"maintenance": maintenance,
+		"demo":        s.demo,
+		"timezone":    s.displayLocation().String(),
+	}
+	if user, _, ok := s.readSessionUser(r); ok {
+		pending, running, err := s.store.CountUnfinishedRuns()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		uptime := time.Since(s.startedAt).Truncate(time.Second)
+		out["started_at"] = s.startedAt.UTC()
+		out["uptime"] = uptime.String()
+		out["uptime_seconds"] = int64(uptime.Seconds())
+		out["db_driver"] = s.store.Driver()
+		out["queue_depth"] = pending
+		out["active_runs"] = running
+		out["instance_id"] = s.instanceID
+		out["leader"] = s.isLeader()
+		appIDs, err := s.provenanceAppIDs(user)
+		if err == nil {
+			out["drifted_apps"], err = s.driftedAppIDs(appIDs)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxAppTags = 20
+
+// tagPattern allows free-form labels such as "team:payments", "go", or "tier-1".
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._:/-]{0,63}$`)
+
+// normalizeTags lowercases, trims, validates, deduplicates, and sorts tags.
+func normalizeTags(raw []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(raw))
+	out := make([]string, 0, len(raw))
+	for _, t := range raw {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !tagPattern.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q (use letters, digits and . _ : / -, max 64 chars)", t)
+		}
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		out = append(out, t)
+	}
+	if len(out) > maxAppTags {
+		return nil, fmt.Errorf("at most %d tags per app", maxAppTags)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// tagFilter returns the normalized tags from ?tag= (repeatable or comma-separated).
+func tagFilter(r *http.Request) []string {
+	var tags []string
+	for _, v := range r.URL.Query()["tag"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// canEditApp reports whether the user may modify the app (admins, or members of a group bound to it).
+func (s *Server) canEditApp(w http.ResponseWriter, user authUser, appID string) bool {
+	if user.IsAdmin {
+		return true
+	}
+	ok, err := s.userCanAccessApp(user.ID, appID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return false
+	}
+	if !ok {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to this app"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) getAppTags(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	tags, err := s.store.AppTags(appID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"app_id": appID, "tags": tags})
+}
+
+func (s *Server) setAppTags(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	tags, err := normalizeTags(body.Tags)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.store.SetAppTags(appID, tags); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"app_id": appID, "tags": tags})
+}
+
+// taggedAppIDs returns the set of app IDs having all tags.
+func (s *Server) taggedAppIDs(tags []string) (map[string]struct{}, error) {
+	ids, err := s.store.AppIDsWithTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set, nil
+}
+
+// listRunsByTags serves GET /api/runs?tag= : runs of apps having all tags, restricted to
+// appID when set and to the user's allowed apps for non-admins.
+func (s *Server) listRunsByTags(w http.ResponseWriter, user authUser, appID string, tags []string, limit, offset int) {
+	ids, err := s.store.AppIDsWithTags(tags)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	var allowed map[string]struct{}
+	if !user.IsAdmin {
+		allowed, _, err = s.allowedAppIDsForUser(user.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	appIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if appID != "" && id != appID {
+			continue
+		}
+		if allowed != nil {
+			if _, ok := allowed[id]; !ok {
+				continue
+			}
+		}
+		appIDs = append(appIDs, id)
+	}
+	runs, err := s.store.ListRunsByAppIDs(appIDs, limit, offset)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	total, err := s.store.CountRunsByAppIDs(appIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs, "total": total})
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// maxApprovalTimeoutSec bounds how long a terraform plan may wait for approval.
+const maxApprovalTimeoutSec = 7 * 24 * 3600
+
+// validateTerraformStep checks and normalizes a terraform step. Terraform steps wait for approval
+// inside the server process, so they cannot run in Kubernetes Jobs.
+func validateTerraformStep(app *config.App, step *config.Step) error {
+	tf := step.Terraform
+	tf.Binary = strings.TrimSpace(tf.Binary)
+	switch tf.Binary {
+	case "", "terraform", "tofu":
+	default:
+		return fmt.Errorf("step %s: terraform binary must be terraform or tofu", step.Name)
+	}
+	if appUsesK8sJob(*app) {
+		return fmt.Errorf("step %s: terraform steps cannot run as a Kubernetes Job (use runner local)", step.Name)
+	}
+	varFiles := make([]string, 0, len(tf.VarFiles))
+	for _, raw := range tf.VarFiles {
+		f := strings.TrimPrefix(strings.TrimSpace(raw), "./")
+		if f == "" || !validRepoRelativePath(f) {
+			return fmt.Errorf("step %s: terraform var_files must be relative paths inside the repository", step.Name)
+		}
+		varFiles = append(varFiles, f)
+	}
+	tf.VarFiles = nil
+	if len(varFiles) > 0 {
+		tf.VarFiles = varFiles
+	}
+	tf.Workspace = strings.TrimSpace(tf.Workspace)
+	for key := range tf.BackendConfig {
+		if strings.TrimSpace(key) == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("step %s: terraform backend_config keys must be non-empty and must not contain =", step.Name)
+		}
+	}
+	if tf.ApprovalTimeoutSec < 0 || tf.ApprovalTimeoutSec > maxApprovalTimeoutSec {
+		return errors.New("terraform approval_timeout_sec must be between 0 and 604800")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"noppflow/internal/pipeline"
+	"noppflow/internal/store"
+)
+
+// Timeline events recorded by the server; the others come from pipeline.ParseLogTimeline.
+const (
+	timelineQueued       = "run.queued"
+	timelineFinished     = "run.finished"
+	timelineNotification = "notification"
+)
+
+// getRunTimeline returns the events of a run ordered by time: queued, clone start and end, step
+// starts and ends, post sections, notifications sent, and finished (with the run status), for a
+// Gantt view of where the run spent its time.
+func (s *Server) getRunTimeline(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.accessibleRun(w, r)
+	if !ok {
+		return
+	}
+	if err := s.loadRunLog(run); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	events, err := s.runTimeline(run)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"run_id": run.ID, "status": run.Status, "events": events})
+}
+
+// runTimeline builds the timeline events of a run whose log is loaded.
+func (s *Server) runTimeline(run *store.Run) ([]pipeline.TimelineEvent, error) {
+	notifications, err := s.store.ListRunNotifications(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	events := pipeline.ParseLogTimeline(run.Log)
+	for _, n := range notifications {
+		events = append(events, pipeline.TimelineEvent{Time: n.CreatedAt.UTC(), Event: timelineNotification, Name: n.Event, Message: n.Message})
+	}
+	// Stable, so events logged in the same millisecond keep their log order.
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	// Run times are stored with second precision, so queued and finished are placed first and
+	// last rather than sorted.
+	events = append([]pipeline.TimelineEvent{{Time: run.StartedAt.UTC(), Event: timelineQueued, Message: run.TriggeredBy}}, events...)
+	if run.EndedAt != nil {
+		events = append(events, pipeline.TimelineEvent{
+			Time:       run.EndedAt.UTC(),
+			Event:      timelineFinished,
+			Status:     run.Status,
+			DurationMs: run.EndedAt.Sub(run.StartedAt).Milliseconds(),
+		})
+	}
+	return events, nil
+}
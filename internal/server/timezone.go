@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"noppflow/internal/config"
+)
+
+// SetDisplayTimezone sets the timezone the UI shows times in and server messages (e.g. invite
+// emails) are written in. Times are stored and returned by the API in UTC either way; nil means UTC.
+func (s *Server) SetDisplayTimezone(loc *time.Location) {
+	s.displayTZ = loc
+}
+
+func (s *Server) displayLocation() *time.Location {
+	if s.displayTZ == nil {
+		return time.UTC
+	}
+	return s.displayTZ
+}
+
+// appLocation is the app's timezone, or the display timezone when it has none.
+func (s *Server) appLocation(app config.App) *time.Location {
+	if app.Timezone != "" {
+		if loc, err := time.LoadLocation(app.Timezone); err == nil {
+			return loc
+		}
+	}
+	return s.displayLocation()
+}
+
+// validateAppTimezone checks that the app's timezone is an IANA name such as Europe/Berlin.
+func validateAppTimezone(app *config.App) error {
+	app.Timezone = strings.TrimSpace(app.Timezone)
+	if app.Timezone == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(app.Timezone); err != nil {
+		return fmt.Errorf("timezone must be an IANA timezone name such as Europe/Berlin: %q", app.Timezone)
+	}
+	return nil
+}
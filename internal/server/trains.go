@@ -0,0 +1,351 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+	"noppflow/internal/store"
+)
+
+// trainPollInterval is how often a train run checks the runs of its current stage (a var for tests).
+var trainPollInterval = 2 * time.Second
+
+// trainLeaseTTL is how long the lease of the server driving a train run lasts without renewal.
+const trainLeaseTTL = time.Minute
+
+// SetTrains sets the release trains that can be started with POST /api/trains/{name}/runs.
+func (s *Server) SetTrains(cfg config.TrainsConfig) {
+	s.trainsMu.Lock()
+	defer s.trainsMu.Unlock()
+	s.trains = cfg.Trains
+}
+
+// findTrain returns the configured train with name.
+func (s *Server) findTrain(name string) (config.Train, bool) {
+	s.trainsMu.RLock()
+	defer s.trainsMu.RUnlock()
+	for _, t := range s.trains {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return config.Train{}, false
+}
+
+// userCanAccessTrain reports whether u may see and start a train: admins always, others when
+// they can access every app of it.
+func (s *Server) userCanAccessTrain(u authUser, train config.Train) (bool, error) {
+	if u.IsAdmin {
+		return true, nil
+	}
+	allowed, _, err := s.allowedAppIDsForUser(u.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range train.AppIDs() {
+		if _, ok := allowed[id]; !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// accessibleTrain resolves the {name} URL parameter to a train the user may access, writing an
+// error response when there is none.
+func (s *Server) accessibleTrain(w http.ResponseWriter, r *http.Request) (config.Train, bool) {
+	train, ok := s.findTrain(chi.URLParam(r, "name"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "train not found"})
+		return train, false
+	}
+	allowed, err := s.userCanAccessTrain(authUserFromContext(r), train)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return train, false
+	}
+	if !allowed {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to all apps of this train"})
+		return train, false
+	}
+	return train, true
+}
+
+// listTrains returns the trains whose apps the user can all access.
+func (s *Server) listTrains(w http.ResponseWriter, r *http.Request) {
+	user := authUserFromContext(r)
+	s.trainsMu.RLock()
+	trains := s.trains
+	s.trainsMu.RUnlock()
+	out := make([]config.Train, 0, len(trains))
+	for _, t := range trains {
+		ok, err := s.userCanAccessTrain(user, t)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if ok {
+			out = append(out, t)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// startTrain starts a run of a train. Body: optional params, overriding the train's defaults.
+func (s *Server) startTrain(w http.ResponseWriter, r *http.Request) {
+	train, ok := s.accessibleTrain(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Params map[string]string `json:"params"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+	}
+	params, err := trainParams(train, body.Params)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, id := range train.AppIDs() {
+		if app, ok := s.findApp(id); !ok {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("app %s of the train not found", id)})
+			return
+		} else if app.Archived {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("app %s of the train is archived", id)})
+			return
+		}
+	}
+	id, err := s.store.CreateTrainRun(train.Name, authUserFromContext(r).Username, params)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	go s.driveTrainRun(id)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"train_run_id": id, "status": "running"})
+}
+
+// trainParams merges the given params into the train's defaults. Unknown names and params left
+// empty are rejected.
+func trainParams(train config.Train, given map[string]string) (map[string]string, error) {
+	params := make(map[string]string, len(train.Params))
+	for name, value := range train.Params {
+		params[name] = value
+	}
+	for name, value := range given {
+		if _, ok := train.Params[name]; !ok {
+			return nil, fmt.Errorf("unknown param %q", name)
+		}
+		params[name] = value
+	}
+	if err := validateRunEnv(params); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if params[name] == "" {
+			return nil, fmt.Errorf("param %s is required", name)
+		}
+	}
+	return params, nil
+}
+
+// listTrainRuns returns the runs of a train, newest first (?limit=&offset=).
+func (s *Server) listTrainRuns(w http.ResponseWriter, r *http.Request) {
+	train, ok := s.accessibleTrain(w, r)
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	runs, err := s.store.ListTrainRuns(train.Name, limit, offset)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// getTrainRun returns a train run with the stages of its train and the app runs it started.
+func (s *Server) getTrainRun(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid train run id"})
+		return
+	}
+	tr, err := s.store.GetTrainRun(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if tr == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "train run not found"})
+		return
+	}
+	user := authUserFromContext(r)
+	train, found := s.trainOfRun(tr.Train)
+	if !found && !user.IsAdmin {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "train run not found"})
+		return
+	}
+	if found {
+		allowed, err := s.userCanAccessTrain(user, train)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !allowed {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "user has no access to all apps of this train"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		*store.TrainRun
+		Stages []config.TrainStage `json:"stages"`
+	}{tr, train.Stages})
+}
+
+// ResumeTrainRuns continues the train runs left running by a previous server process, so a
+// restart does not strand a release half-way. Servers sharing a database may all resume a train
+// run: only the holder of its lease drives it, and the others take over when the lease expires.
+func (s *Server) ResumeTrainRuns() {
+	ids, err := s.store.RunningTrainRunIDs()
+	if err != nil {
+		log.Printf("trains: list running train runs: %v", err)
+		return
+	}
+	for _, id := range ids {
+		go s.driveTrainRun(id)
+	}
+}
+
+// driveTrainRun runs a train run to its end: it waits for the runs of the current stage, fails
+// the train run when one of them did not succeed, and otherwise starts the next stage.
+func (s *Server) driveTrainRun(id int64) {
+	lease := fmt.Sprintf("train-run-%d", id)
+	defer func() { _ = s.store.ReleaseLease(lease, s.instanceID) }()
+	for {
+		tr, err := s.store.GetTrainRun(id)
+		if err != nil {
+			log.Printf("train run %d: %v", id, err)
+			time.Sleep(trainPollInterval)
+			continue
+		}
+		if tr == nil || tr.Status != "running" {
+			return
+		}
+		if held, err := s.store.AcquireLease(lease, s.instanceID, trainLeaseTTL, time.Now()); err != nil || !held {
+			// Another server drives it.
+			time.Sleep(trainPollInterval)
+			continue
+		}
+		train, ok := s.trainOfRun(tr.Train)
+		if !ok {
+			s.finishTrainRun(id, "failed", "train "+tr.Train+" is no longer configured")
+			return
+		}
+		if tr.Stage >= len(train.Stages) {
+			s.finishTrainRun(id, "failed", "train "+tr.Train+" has fewer stages than when it started")
+			return
+		}
+		if tr.Stage >= 0 {
+			waiting, failed := trainStageState(tr, train.Stages[tr.Stage])
+			if failed != "" {
+				s.finishTrainRun(id, "failed", fmt.Sprintf("%s: %s", train.Stages[tr.Stage].Name, failed))
+				return
+			}
+			if waiting {
+				time.Sleep(trainPollInterval)
+				continue
+			}
+		}
+		next := tr.Stage + 1
+		if next == len(train.Stages) {
+			s.finishTrainRun(id, "success", "")
+			return
+		}
+		claimed, err := s.store.AdvanceTrainRun(id, tr.Stage, next)
+		if err != nil || !claimed {
+			// Another server advanced it after taking over an expired lease.
+			time.Sleep(trainPollInterval)
+			continue
+		}
+		if err := s.startTrainStage(tr, train, next); err != nil {
+			s.finishTrainRun(id, "failed", fmt.Sprintf("%s: %v", train.Stages[next].Name, err))
+			return
+		}
+	}
+}
+
+// trainStageState reports whether runs of stage are still pending or running, or why the stage
+// failed ("" when it did not).
+func trainStageState(tr *store.TrainRun, stage config.TrainStage) (waiting bool, failed string) {
+	started := make(map[string]store.TrainRunRun, len(tr.Runs))
+	for _, run := range tr.Runs {
+		if run.Stage == tr.Stage {
+			started[run.AppID] = run
+		}
+	}
+	for _, appID := range stage.Apps {
+		run, ok := started[appID]
+		switch {
+		case !ok:
+			return false, "run of " + appID + " was not started"
+		case run.Status == "pending" || run.Status == "running":
+			waiting = true
+		case run.Status != "success":
+			return false, fmt.Sprintf("run %d of %s %s", run.RunID, appID, run.Status)
+		}
+	}
+	return waiting, ""
+}
+
+// startTrainStage starts the runs of a stage's apps with the train params and records them.
+func (s *Server) startTrainStage(tr *store.TrainRun, train config.Train, stage int) error {
+	runEnv := make(map[string]string, len(tr.Params)+3)
+	for name, value := range tr.Params {
+		runEnv[name] = value
+	}
+	runEnv["NOPPFLOW_TRAIN"] = train.Name
+	runEnv["NOPPFLOW_TRAIN_RUN_ID"] = strconv.FormatInt(tr.ID, 10)
+	runEnv["NOPPFLOW_TRAIN_STAGE"] = train.Stages[stage].Name
+	for _, appID := range train.Stages[stage].Apps {
+		app, ok := s.findApp(appID)
+		if !ok {
+			return fmt.Errorf("app %s not found", appID)
+		}
+		runID, err := s.startRun(app, "train:"+train.Name, runEnv)
+		if err != nil {
+			return fmt.Errorf("start %s: %w", appID, err)
+		}
+		if err := s.store.AddTrainRunRun(tr.ID, stage, appID, runID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) finishTrainRun(id int64, status, errMsg string) {
+	if err := s.store.FinishTrainRun(id, status, errMsg); err != nil {
+		log.Printf("train run %d: finish: %v", id, err)
+		return
+	}
+	if errMsg != "" {
+		log.Printf("train run %d %s: %s", id, status, errMsg)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/store"
+)
+
+const (
+	// maxTriggerPayload bounds the JSON body of an inbound trigger; it is passed to steps as an env var.
+	maxTriggerPayload = 64 << 10
+	// maxIdempotencyKey bounds the Idempotency-Key header.
+	maxIdempotencyKey = 255
+	// idempotencyTTL is how long an Idempotency-Key is remembered.
+	idempotencyTTL = 24 * time.Hour
+)
+
+// hashToken returns the hex SHA-256 of a trigger or invite token, the form in which they are stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) listRunTriggers(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	list, err := s.store.ListRunTriggers(appID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// createRunTrigger creates an inbound trigger token for an app. The token is returned only once.
+func (s *Server) createRunTrigger(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	user := authUserFromContext(r)
+	if !s.canEditApp(w, user, appID) {
+		return
+	}
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > 100 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required (up to 100 characters)"})
+		return
+	}
+	token, err := randomToken()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	t := store.RunTrigger{AppID: appID, Name: name, TokenHash: hashToken(token), CreatedBy: user.Username}
+	if t.ID, err = s.store.CreateRunTrigger(t); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": t.ID, "name": name, "token": token, "url": "/api/triggers/" + token})
+}
+
+func (s *Server) deleteRunTrigger(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	if !s.canEditApp(w, authUserFromContext(r), appID) {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "triggerID"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid trigger id"})
+		return
+	}
+	if err := s.store.DeleteRunTrigger(appID, id); storeErrNoRows(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "trigger not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fireTrigger starts a run of the trigger's app (no session; the token in the URL authenticates).
+// The JSON body is passed to the steps as NOPPFLOW_TRIGGER_PAYLOAD. With an Idempotency-Key header,
+// a retried delivery returns the run of the first one instead of starting another.
+func (s *Server) fireTrigger(w http.ResponseWriter, r *http.Request) {
+	t, err := s.store.GetRunTriggerByTokenHash(hashToken(chi.URLParam(r, "token")))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if t == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown trigger"})
+		return
+	}
+	app, ok := s.findApp(t.AppID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxTriggerPayload+1))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "could not read body"})
+		return
+	}
+	if len(payload) > maxTriggerPayload {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "payload too large"})
+		return
+	}
+	if len(strings.TrimSpace(string(payload))) == 0 {
+		payload = []byte("{}")
+	}
+	if !json.Valid(payload) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be JSON"})
+		return
+	}
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > maxIdempotencyKey {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Idempotency-Key is too long"})
+		return
+	}
+	if key != "" {
+		claimed, runID, err := s.store.ReserveTriggerDelivery(t.ID, key, idempotencyTTL)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !claimed {
+			if runID == 0 {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "a delivery with this Idempotency-Key is in progress"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"run_id": runID, "duplicate": true})
+			return
+		}
+	}
+	runID, err := s.startRun(app, "trigger:"+t.Name, map[string]string{
+		"NOPPFLOW_TRIGGER":         t.Name,
+		"NOPPFLOW_TRIGGER_PAYLOAD": string(payload),
+	})
+	if err != nil {
+		if key != "" {
+			if relErr := s.store.ReleaseTriggerDelivery(t.ID, key); relErr != nil {
+				log.Printf("trigger %d: release idempotency key: %v", t.ID, relErr)
+			}
+		}
+		writeStatusError(w, err)
+		return
+	}
+	if key != "" {
+		if err := s.store.CompleteTriggerDelivery(t.ID, key, runID); err != nil {
+			log.Printf("trigger %d: record idempotency key: %v", t.ID, err)
+		}
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"run_id": runID, "status": "pending"})
+}
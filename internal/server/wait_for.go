@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"noppflow/internal/config"
+)
+
+// Upper bounds of a wait_for step's interval and timeout, in seconds.
+const (
+	maxWaitForIntervalSec = 3600
+	maxWaitForTimeoutSec  = 24 * 3600
+)
+
+// validateWaitForStep checks and normalizes a wait_for step.
+func validateWaitForStep(step *config.Step) error {
+	wf := step.WaitFor
+	wf.URL = strings.TrimSpace(wf.URL)
+	wf.Cmd = strings.TrimSpace(wf.Cmd)
+	if (wf.URL == "") == (wf.Cmd == "") {
+		return fmt.Errorf("step %s: wait_for needs exactly one of url or cmd", step.Name)
+	}
+	if wf.URL != "" && !strings.HasPrefix(wf.URL, "http://") && !strings.HasPrefix(wf.URL, "https://") {
+		return fmt.Errorf("step %s: wait_for url must start with http:// or https://", step.Name)
+	}
+	if wf.ExpectStatus != 0 && (wf.URL == "" || wf.ExpectStatus < 100 || wf.ExpectStatus > 599) {
+		return fmt.Errorf("step %s: wait_for expect_status must be an HTTP status (100-599) of a url check", step.Name)
+	}
+	if wf.IntervalSec < 0 || wf.IntervalSec > maxWaitForIntervalSec {
+		return fmt.Errorf("step %s: wait_for interval_sec must be between 0 and %d", step.Name, maxWaitForIntervalSec)
+	}
+	if wf.TimeoutSec < 0 || wf.TimeoutSec > maxWaitForTimeoutSec {
+		return fmt.Errorf("step %s: wait_for timeout_sec must be between 0 and %d", step.Name, maxWaitForTimeoutSec)
+	}
+	return nil
+}
+
+// k8sWaitForCommand returns the shell loop of a wait_for step in a Job script: the check runs
+// every interval until it succeeds, and the step fails once the timeout has passed.
+func k8sWaitForCommand(step config.Step, env k8sEnv) string {
+	wf := step.WaitFor
+	var check string
+	switch {
+	case wf.URL != "" && wf.ExpectStatus != 0:
+		check = fmt.Sprintf(`[ "$(curl -sS -L -m 30 -o /dev/null -w '%%{http_code}' %s)" = %d ]`, k8sStepEnvValue(wf.URL, env), wf.ExpectStatus)
+	case wf.URL != "":
+		check = fmt.Sprintf("curl -fsSL -m 30 -o /dev/null %s", k8sStepEnvValue(wf.URL, env))
+	default:
+		check = "sh -c " + shellQuote(wf.Cmd)
+	}
+	interval := int(wf.Interval().Seconds())
+	timeout := int(wf.Timeout().Seconds())
+	return fmt.Sprintf("deadline=$(( $(date +%%s) + %d )); until %s; do "+
+		"if [ $(date +%%s) -ge $deadline ]; then echo %s; exit 1; fi; sleep %d; done",
+		timeout, check, shellQuote(fmt.Sprintf("%s: not ready after %ds", step.Name, timeout)), interval)
+}
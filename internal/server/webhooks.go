@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"noppflow/internal/config"
+)
+
+// maxWebhookBody bounds the size of a webhook delivery.
+const maxWebhookBody = 5 << 20
+
+// Webhook providers an app can select with webhook_provider.
+const (
+	webhookGitHub    = "github"
+	webhookGitLab    = "gitlab"
+	webhookBitbucket = "bitbucket"
+	webhookGitea     = "gitea"
+)
+
+var (
+	errWebhookUnsigned = errors.New("missing signature")
+	errWebhookTampered = errors.New("signature does not match payload")
+)
+
+// validateWebhook checks an app's webhook_provider and webhook_secret.
+func validateWebhook(app *config.App) error {
+	app.WebhookProvider = strings.ToLower(strings.TrimSpace(app.WebhookProvider))
+	app.WebhookSecret = strings.TrimSpace(app.WebhookSecret)
+	switch app.WebhookProvider {
+	case "":
+		return nil
+	case webhookGitHub, webhookGitLab, webhookBitbucket, webhookGitea:
+	default:
+		return errors.New("webhook_provider must be github, gitlab, bitbucket, or gitea")
+	}
+	if len(app.WebhookSecret) < 16 {
+		return errors.New("webhook_secret of at least 16 characters is required when webhook_provider is set")
+	}
+	return nil
+}
+
+// verifyWebhookSignature checks a delivery the way provider signs it:
+//   - github: X-Hub-Signature-256 = "sha256=" + hex HMAC-SHA256(secret, body)
+//   - gitea: X-Gitea-Signature = hex HMAC-SHA256(secret, body)
+//   - bitbucket: X-Hub-Signature = "sha256=" + hex HMAC-SHA256(secret, body) (Cloud and Data Center)
+//   - gitlab: X-Gitlab-Token = secret (GitLab does not sign payloads)
+func verifyWebhookSignature(provider, secret string, header http.Header, body []byte) error {
+	var sig, prefix string
+	switch provider {
+	case webhookGitHub:
+		sig, prefix = header.Get("X-Hub-Signature-256"), "sha256="
+	case webhookBitbucket:
+		sig, prefix = header.Get("X-Hub-Signature"), "sha256="
+	case webhookGitea:
+		sig = header.Get("X-Gitea-Signature")
+	case webhookGitLab:
+		token := header.Get("X-Gitlab-Token")
+		if token == "" {
+			return errWebhookUnsigned
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return errWebhookTampered
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown webhook provider %q", provider)
+	}
+	if sig == "" {
+		return errWebhookUnsigned
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(sig, prefix))
+	if err != nil || !strings.HasPrefix(sig, prefix) {
+		return errWebhookTampered
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errWebhookTampered
+	}
+	return nil
+}
+
+// webhookEvent returns the provider's event name and whether it is a push.
+func webhookEvent(provider string, header http.Header) (string, bool) {
+	switch provider {
+	case webhookGitHub:
+		event := header.Get("X-GitHub-Event")
+		return event, event == "push"
+	case webhookGitea:
+		event := header.Get("X-Gitea-Event")
+		return event, event == "push"
+	case webhookGitLab:
+		event := header.Get("X-Gitlab-Event")
+		return event, event == "Push Hook"
+	case webhookBitbucket:
+		event := header.Get("X-Event-Key")
+		return event, event == "repo:push" || event == "repo:refs_changed"
+	}
+	return "", false
+}
+
+// pushedBranches extracts the branch names a push payload updated, for all supported providers.
+func pushedBranches(body []byte) []string {
+	var payload struct {
+		Ref  string `json:"ref"`
+		Push struct {
+			Changes []struct {
+				New *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+		Changes []struct {
+			Ref struct {
+				ID string `json:"id"`
+			} `json:"ref"`
+		} `json:"changes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	var branches []string
+	if b, ok := strings.CutPrefix(payload.Ref, "refs/heads/"); ok {
+		branches = append(branches, b)
+	}
+	for _, c := range payload.Push.Changes {
+		if c.New != nil && c.New.Type == "branch" {
+			branches = append(branches, c.New.Name)
+		}
+	}
+	for _, c := range payload.Changes {
+		if b, ok := strings.CutPrefix(c.Ref.ID, "refs/heads/"); ok {
+			branches = append(branches, b)
+		}
+	}
+	return branches
+}
+
+// receiveWebhook handles a push webhook for an app. The delivery is authenticated by its
+// signature only (no session); unsigned or tampered deliveries get 401 and are logged.
+// A push to the app branch starts a run; for apps with previews, pushes to other branches deploy
+// their previews and closed branches tear them down (see previewWebhook). Other events are
+// acknowledged and ignored.
+func (s *Server) receiveWebhook(w http.ResponseWriter, r *http.Request) {
+	appID := chi.URLParam(r, "appID")
+	app, ok := s.findApp(appID)
+	if !ok || app.WebhookProvider == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "webhooks are not enabled for this app"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "could not read body"})
+		return
+	}
+	if len(body) > maxWebhookBody {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "payload too large"})
+		return
+	}
+	if err := verifyWebhookSignature(app.WebhookProvider, app.WebhookSecret, r.Header, body); err != nil {
+		log.Printf("webhook app=%s provider=%s from %s rejected: %v", app.ID, app.WebhookProvider, r.RemoteAddr, err)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": fmt.Sprintf("invalid %s webhook delivery: %v", app.WebhookProvider, err)})
+		return
+	}
+	event, isPush := webhookEvent(app.WebhookProvider, r.Header)
+	if app.Preview != nil && s.previewWebhook(w, app, event, isPush, body) {
+		return
+	}
+	if !isPush {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": fmt.Sprintf("event %q does not trigger runs", event)})
+		return
+	}
+	matched := false
+	for _, b := range pushedBranches(body) {
+		if b == app.Branch {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": "push is not to branch " + app.Branch})
+		return
+	}
+	runID, held, err := s.queueRun(app, "webhook:"+app.WebhookProvider, nil, true, runLink{})
+	if err != nil {
+		log.Printf("webhook app=%s provider=%s: run not started: %v", app.ID, app.WebhookProvider, err)
+		writeStatusError(w, err)
+		return
+	}
+	if held {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"run_id": runID, "status": "deferred", "reason": "maintenance"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"run_id": runID, "status": "pending"})
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxWorkspaceFileBytes = 10 << 20
+	maxWorkspaceEntries   = 1000
+)
+
+// workspaceSecretPatterns match (path.Match) the names of files and directories the workspace
+// browser lists but never opens: credentials and state a build may have left behind.
+var workspaceSecretPatterns = []string{
+	".env", ".env.*", ".netrc", ".npmrc", ".pypirc", ".git-credentials", ".dockercfg",
+	".ssh", ".aws", ".docker", ".kube", ".gnupg", "kubeconfig",
+	"id_rsa*", "id_ecdsa*", "id_ed25519*", "*.pem", "*.key", "*.p12", "*.pfx", "*.jks", "*.keystore",
+	"*.tfstate", "*.tfstate.backup", "*.tfvars", "credentials", "credentials.json", "secrets.*",
+}
+
+// workspaceEntry is a file or directory listed by GET /api/apps/{appID}/workspace.
+type workspaceEntry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Type     string    `json:"type"` // file, dir, or symlink
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Excluded bool      `json:"excluded,omitempty"`
+}
+
+// workspaceSecretPath reports whether a slash-separated workspace path is or lies inside a
+// secret path: a name matching workspaceSecretPatterns, or the git config, which can hold
+// credentials in remote URLs.
+func workspaceSecretPath(rel string) bool {
+	if rel == ".git/config" {
+		return true
+	}
+	for _, name := range strings.Split(rel, "/") {
+		for _, pattern := range workspaceSecretPatterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// workspaceRoot resolves the app of the URL to its workspace directory (admin), writing an
+// error response when the app or its workspace does not exist.
+func (s *Server) workspaceRoot(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return "", "", false
+	}
+	appID := chi.URLParam(r, "appID")
+	if !s.appExists(appID) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return "", "", false
+	}
+	if s.runner == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "this server has no runner workspaces"})
+		return "", "", false
+	}
+	root, err := filepath.EvalSymlinks(s.runner.WorkspaceDir(appID))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app has no workspace (no local run yet)"})
+		return "", "", false
+	}
+	return appID, root, true
+}
+
+// resolveWorkspacePath returns the file system path of ?path= inside root and its cleaned
+// slash-separated form. Symlinks are followed but must stay inside root, and secret paths are
+// refused; on failure it writes an error response.
+func resolveWorkspacePath(w http.ResponseWriter, root, raw string) (string, string, bool) {
+	rel := strings.TrimPrefix(path.Clean("/"+strings.TrimSpace(raw)), "/")
+	full, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "path not found"})
+		return "", "", false
+	}
+	realRel, err := filepath.Rel(root, full)
+	if err != nil || realRel == ".." || strings.HasPrefix(realRel, ".."+string(filepath.Separator)) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "path leads outside the workspace"})
+		return "", "", false
+	}
+	if workspaceSecretPath(rel) || workspaceSecretPath(filepath.ToSlash(realRel)) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "path is excluded as it may hold secrets"})
+		return "", "", false
+	}
+	return full, rel, true
+}
+
+// listWorkspace lists a directory of an app's work directory (?path=, default the root), as
+// the last run left it (admin). Directories come first; at most 1000 entries are returned.
+func (s *Server) listWorkspace(w http.ResponseWriter, r *http.Request) {
+	appID, root, ok := s.workspaceRoot(w, r)
+	if !ok {
+		return
+	}
+	dir, rel, ok := resolveWorkspacePath(w, root, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+	infos, err := os.ReadDir(dir)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is not a directory"})
+		return
+	}
+	entries := make([]workspaceEntry, 0, len(infos))
+	for _, d := range infos {
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		e := workspaceEntry{Name: d.Name(), Path: path.Join(rel, d.Name()), Type: "file", Size: info.Size(), ModTime: info.ModTime().UTC()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Type = "symlink"
+		case info.IsDir():
+			e.Type = "dir"
+			e.Size = 0
+		}
+		e.Excluded = workspaceSecretPath(e.Path)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if (entries[i].Type == "dir") != (entries[j].Type == "dir") {
+			return entries[i].Type == "dir"
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	truncated := len(entries) > maxWorkspaceEntries
+	if truncated {
+		entries = entries[:maxWorkspaceEntries]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"app_id": appID, "path": rel, "entries": entries, "truncated": truncated})
+}
+
+// downloadWorkspaceFile sends a file of an app's work directory (?path=) as an attachment
+// (admin). Files over 10 MiB are refused; each download is logged.
+func (s *Server) downloadWorkspaceFile(w http.ResponseWriter, r *http.Request) {
+	appID, root, ok := s.workspaceRoot(w, r)
+	if !ok {
+		return
+	}
+	file, rel, ok := resolveWorkspacePath(w, root, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is not a file"})
+		return
+	}
+	if info.Size() > maxWorkspaceFileBytes {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("file is larger than %d MiB", maxWorkspaceFileBytes>>20)})
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	log.Printf("workspace: %s downloaded %s/%s", authUserFromContext(r).Username, appID, rel)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(rel)))
+	_, _ = io.CopyN(w, f, info.Size())
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// APIToken is a personal token for calling the API without a session. Scope limits what it may
+// do and AppIDs, when set, which apps it may touch. Only the SHA-256 hash of the token is stored.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	AppIDs     []string   `json:"app_ids"`
+	TokenHash  string     `json:"-"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the token has expired at now.
+func (t APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+const apiTokenColumns = `id, user_id, name, scope, app_ids, token_hash, expires_at, last_used_at, rotated_at, created_at`
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (APIToken, error) {
+	var t APIToken
+	var appIDs string
+	var expiresAt, lastUsedAt, rotatedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Scope, &appIDs, &t.TokenHash, &expiresAt, &lastUsedAt, &rotatedAt, &t.CreatedAt); err != nil {
+		return t, err
+	}
+	t.AppIDs = make([]string, 0)
+	if appIDs != "" {
+		t.AppIDs = strings.Split(appIDs, ",")
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	if rotatedAt.Valid {
+		t.RotatedAt = &rotatedAt.Time
+	}
+	return t, nil
+}
+
+func nullableTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// CreateAPIToken stores a token and returns its ID.
+func (s *Store) CreateAPIToken(t APIToken) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO api_tokens (user_id, name, scope, app_ids, token_hash, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		t.UserID, t.Name, t.Scope, strings.Join(t.AppIDs, ","), t.TokenHash, nullableTime(t.ExpiresAt))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListAPITokens returns the tokens of a user, newest first.
+func (s *Store) ListAPITokens(userID int64) ([]APIToken, error) {
+	rows, err := s.db.Query(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]APIToken, 0)
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// GetAPIToken returns a token by ID, or nil.
+func (s *Store) GetAPIToken(id int64) (*APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetAPITokenByHash returns the token with the given hash, or nil.
+func (s *Store) GetAPITokenByHash(hash string) (*APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RotateAPIToken replaces the secret and expiry of a token, keeping its scope.
+func (s *Store) RotateAPIToken(id int64, hash string, expiresAt *time.Time) error {
+	res, err := s.db.Exec(`UPDATE api_tokens SET token_hash = ?, expires_at = ?, rotated_at = `+s.nowExpr()+` WHERE id = ?`, hash, nullableTime(expiresAt), id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// TouchAPIToken records that a token was used at t.
+func (s *Store) TouchAPIToken(id int64, t time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, t.UTC(), id)
+	return err
+}
+
+// DeleteAPIToken deletes a token.
+func (s *Store) DeleteAPIToken(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
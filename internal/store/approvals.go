@@ -0,0 +1,70 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// RunApproval is a pause of a running run until a user approves or rejects what a step is about
+// to do, e.g. the plan of a terraform step. Status is pending, approved, rejected, or expired.
+// With ApproverGroups, only members of one of them may decide.
+type RunApproval struct {
+	ID             int64      `json:"id"`
+	RunID          int64      `json:"run_id"`
+	Step           string     `json:"step"`
+	Plan           string     `json:"plan"`
+	Status         string     `json:"status"`
+	ApproverGroups []string   `json:"approver_groups,omitempty"`
+	DecidedBy      string     `json:"decided_by,omitempty"`
+	DecidedAt      *time.Time `json:"decided_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// CreateRunApproval records a pending approval for a step of a run and returns its ID.
+func (s *Store) CreateRunApproval(runID int64, step, plan string, approverGroups []string) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO run_approvals (run_id, step, plan, status, approver_groups) VALUES (?, ?, ?, 'pending', ?)`, runID, step, plan, strings.Join(approverGroups, ","))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DecideRunApproval sets the outcome of a pending approval. It returns sql.ErrNoRows when the
+// approval does not exist or was already decided.
+func (s *Store) DecideRunApproval(id int64, status, by string) error {
+	res, err := s.db.Exec(`UPDATE run_approvals SET status = ?, decided_by = ?, decided_at = `+s.nowExpr()+` WHERE id = ? AND status = 'pending'`, status, by, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// LatestRunApproval returns the most recent approval of a run, or nil if it has none.
+func (s *Store) LatestRunApproval(runID int64) (*RunApproval, error) {
+	var a RunApproval
+	var groups string
+	var decidedAt sql.NullTime
+	err := s.db.QueryRow(`SELECT id, run_id, step, plan, status, approver_groups, COALESCE(decided_by,''), decided_at, created_at FROM run_approvals WHERE run_id = ? ORDER BY id DESC LIMIT 1`, runID).
+		Scan(&a.ID, &a.RunID, &a.Step, &a.Plan, &a.Status, &groups, &a.DecidedBy, &decidedAt, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if groups != "" {
+		a.ApproverGroups = strings.Split(groups, ",")
+	}
+	if decidedAt.Valid {
+		a.DecidedAt = &decidedAt.Time
+	}
+	return &a, nil
+}
+
+// ExpirePendingApprovals marks the pending approvals of a run expired, e.g. when the run ended
+// or was interrupted while waiting.
+func (s *Store) ExpirePendingApprovals(runID int64) error {
+	_, err := s.db.Exec(`UPDATE run_approvals SET status = 'expired', decided_at = `+s.nowExpr()+` WHERE run_id = ? AND status = 'pending'`, runID)
+	return err
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RunArtifact is a file collected from a run step. StorageKey addresses the object in the artifact store.
+type RunArtifact struct {
+	ID         int64     `json:"id"`
+	RunID      int64     `json:"run_id"`
+	Step       string    `json:"step"`
+	Name       string    `json:"name"`
+	StorageKey string    `json:"-"`
+	SizeBytes  int64     `json:"size_bytes"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateRunArtifact records an uploaded artifact and returns its ID.
+func (s *Store) CreateRunArtifact(a RunArtifact) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO run_artifacts (run_id, step, name, storage_key, size_bytes) VALUES (?, ?, ?, ?, ?)`,
+		a.RunID, a.Step, a.Name, a.StorageKey, a.SizeBytes)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListRunArtifacts returns the artifacts of a run ordered by name.
+func (s *Store) ListRunArtifacts(runID int64) ([]RunArtifact, error) {
+	rows, err := s.db.Query(`SELECT id, run_id, step, name, storage_key, size_bytes, created_at FROM run_artifacts WHERE run_id = ? ORDER BY name, id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunArtifact, 0)
+	for rows.Next() {
+		var a RunArtifact
+		if err := rows.Scan(&a.ID, &a.RunID, &a.Step, &a.Name, &a.StorageKey, &a.SizeBytes, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// GetRunArtifact returns an artifact by ID, or nil if it does not exist.
+func (s *Store) GetRunArtifact(id int64) (*RunArtifact, error) {
+	var a RunArtifact
+	err := s.db.QueryRow(`SELECT id, run_id, step, name, storage_key, size_bytes, created_at FROM run_artifacts WHERE id = ?`, id).
+		Scan(&a.ID, &a.RunID, &a.Step, &a.Name, &a.StorageKey, &a.SizeBytes, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// SetRunArtifactSize updates the recorded size of an artifact whose object was rewritten.
+func (s *Store) SetRunArtifactSize(id, size int64) error {
+	res, err := s.db.Exec(`UPDATE run_artifacts SET size_bytes = ? WHERE id = ?`, size, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// ArtifactKeysByAppID returns the storage keys of all artifacts of an app's unpinned runs
+// (deleted from the artifact store before DeleteRunsByAppID).
+func (s *Store) ArtifactKeysByAppID(appID string) ([]string, error) {
+	return s.artifactKeys(`app_id = ? AND pinned_at IS NULL`, appID)
+}
+
+// PurgeableArtifactKeys returns the storage keys of artifacts whose runs PurgeDeletedRuns(olderThan) would remove.
+func (s *Store) PurgeableArtifactKeys(olderThan time.Duration) ([]string, error) {
+	return s.artifactKeys(s.purgeableRunsCond(olderThan))
+}
+
+func (s *Store) artifactKeys(where string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(`SELECT storage_key FROM run_artifacts WHERE run_id IN (SELECT id FROM runs WHERE `+where+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,288 @@
+package store
+
+import "time"
+
+// The interfaces below split the Store API by concern. Backend is all of them; the server
+// depends on Backend only, so another implementation (another database, or in memory for
+// tests) can replace the SQL Store. Implementations follow the Store conventions: Get methods
+// return nil, nil when nothing matches, and updates of missing rows return sql.ErrNoRows.
+
+// RunStore persists runs: their lifecycle, listing, the trash, heartbeats, log references,
+// log redaction rules, and search.
+type RunStore interface {
+	CreateRun(appID, commitSHA, triggeredBy string) (int64, error)
+	CreateFinishedRun(appID, commitSHA, triggeredBy, status string, startedAt, endedAt time.Time) (int64, error)
+	UpdateRunLog(id int64, log string) error
+	UpdateRunStatus(id int64, status, log string) error
+	UnfinishedRuns() ([]Run, error)
+	ClaimRun(id int64) (bool, error)
+	MarkRunInterrupted(id int64) (bool, error)
+	MarkRunSlow(id int64) error
+	SetRunFailureReason(id int64, reason string) error
+	SetRunCommit(id int64, commitSHA, commitMessage string) error
+	PreviousRunCommit(appID string, beforeRunID int64) (string, error)
+	LatestRunsByCommit(appID string, shas []string) (map[string]Run, error)
+	SetRunTriggeredByRun(id, upstreamRunID int64) error
+	SetRunRetry(id, retryOfRunID int64, attempt int) error
+	ListDownstreamRuns(upstreamRunID int64) ([]Run, error)
+	GetRun(id int64) (*Run, error)
+	ListRuns(appID string, limit, offset int) ([]Run, error)
+	CountRuns(appID string) (int64, error)
+	CountUnfinishedRuns() (pending, running int64, err error)
+	DeleteRunsByAppID(appID string) error
+	ListRunsByAppIDs(appIDs []string, limit, offset int) ([]Run, error)
+	CountRunsByAppIDs(appIDs []string) (int64, error)
+	LatestRuns(appIDs []string) ([]Run, error)
+	ListCommitGroups(appIDs []string, limit, offset int) ([]CommitGroup, error)
+	CountCommitGroups(appIDs []string) (int64, error)
+	CountRunsSince(appIDs []string, d time.Duration) (int64, error)
+	CountActiveRuns(appIDs []string) (int64, error)
+	TouchRunHeartbeats(ids []int64) error
+	StaleRuns(olderThan time.Duration) ([]Run, error)
+	LiveRuns(within time.Duration) ([]Run, error)
+	SoftDeleteRun(id int64, deletedBy string) error
+	RestoreRun(id int64) error
+	ListDeletedRuns(limit, offset int) ([]Run, error)
+	CountDeletedRuns() (int64, error)
+	PurgeDeletedRuns(olderThan time.Duration) (int64, error)
+	PinRun(id int64, pinnedBy, note string) error
+	UnpinRun(id int64) error
+	ListPinnedRuns(appIDs []string, limit, offset int) ([]Run, error)
+	CountPinnedRuns(appIDs []string) (int64, error)
+	SetRunLogRef(id int64, key string, size int64) error
+	LogKeysByAppID(appID string) ([]string, error)
+	PurgeableLogKeys(olderThan time.Duration) ([]string, error)
+	SearchRuns(q string, appIDs []string, includeLog bool, limit int) ([]RunSearchHit, error)
+	FailureReasonCounts(appIDs []string, d time.Duration) ([]FailureReasonCount, error)
+	CreateLogRedactionRule(r LogRedactionRule) (int64, error)
+	ListLogRedactionRules() ([]LogRedactionRule, error)
+	DeleteLogRedactionRule(id int64) error
+	FinishedRunIDs(appID string, afterID int64, limit int) ([]int64, error)
+	RunUsageByApp(appIDs []string, d time.Duration) ([]AppRunUsage, error)
+}
+
+// RunDataStore persists what a run produces or collects besides its log: env, notifications,
+// step usage, findings, approvals, artifacts, comments, issue keys, built images, and the image
+// digests runs built or deployed.
+type RunDataStore interface {
+	SetRunEnv(runID int64, env map[string]string) error
+	ListRunEnv(runID int64) ([]RunEnvVar, error)
+	CreateRunNotification(runID int64, event, message string, t time.Time) (int64, error)
+	ListRunNotifications(runID int64) ([]RunNotification, error)
+	SetRunStepUsage(runID int64, usage []RunStepUsage) error
+	ListRunStepUsage(runID int64) ([]RunStepUsage, error)
+	SetRunFindings(runID int64, findings []RunFinding) error
+	ListRunFindings(runID int64) ([]RunFinding, error)
+	CreateRunApproval(runID int64, step, plan string, approverGroups []string) (int64, error)
+	DecideRunApproval(id int64, status, by string) error
+	LatestRunApproval(runID int64) (*RunApproval, error)
+	ExpirePendingApprovals(runID int64) error
+	CreateRunArtifact(a RunArtifact) (int64, error)
+	ListRunArtifacts(runID int64) ([]RunArtifact, error)
+	GetRunArtifact(id int64) (*RunArtifact, error)
+	SetRunArtifactSize(id, size int64) error
+	ArtifactKeysByAppID(appID string) ([]string, error)
+	PurgeableArtifactKeys(olderThan time.Duration) ([]string, error)
+	CreateRunComment(runID int64, author, body string) (int64, error)
+	GetRunComment(id int64) (*RunComment, error)
+	ListRunComments(runID int64) ([]RunComment, error)
+	DeleteRunComment(id int64) error
+	SetRunIssues(runID int64, keys []string) error
+	ListRunIssues(runID int64) ([]string, error)
+	SetRunImage(runID int64, image, digest string) error
+	GetRunImage(runID int64) (*RunImage, error)
+	LatestRunImage(appID string) (*RunImage, error)
+	AddRunDigests(digests []RunDigest) error
+	ListRunDigests(runID int64) ([]RunDigest, error)
+	ListDigestRecords(digest string, appIDs []string) ([]RunDigest, error)
+	CurrentDeployments(appIDs []string) ([]RunDigest, error)
+	LatestTagDigest(image, tag string) (string, error)
+}
+
+// UserStore persists users and what belongs to them: sessions, API tokens, invites, Slack
+// links, and favorites.
+type UserStore interface {
+	CreateUser(username, passwordHash string, isAdmin bool) (int64, error)
+	GetUser(id int64) (*User, error)
+	ListUsers() ([]User, error)
+	GetUserByUsername(username string) (*User, error)
+	EnsureAdminUser(username, passwordHash string) error
+	UpdateUserPassword(userID int64, passwordHash string) error
+	DeleteUser(userID int64) error
+	CreateSession(sess Session) error
+	GetSession(tokenHash string) (*Session, error)
+	DeleteSession(tokenHash string) error
+	DeleteUserSessions(userID int64) error
+	DeleteExpiredSessions(now time.Time) (int64, error)
+	CreateAPIToken(t APIToken) (int64, error)
+	ListAPITokens(userID int64) ([]APIToken, error)
+	GetAPIToken(id int64) (*APIToken, error)
+	GetAPITokenByHash(hash string) (*APIToken, error)
+	RotateAPIToken(id int64, hash string, expiresAt *time.Time) error
+	TouchAPIToken(id int64, t time.Time) error
+	DeleteAPIToken(id int64) error
+	CreateUserInvite(inv UserInvite) (int64, error)
+	GetUserInviteByTokenHash(hash string) (*UserInvite, error)
+	AcceptUserInvite(inv UserInvite, passwordHash string, now time.Time) (int64, error)
+	SetSlackUser(userID int64, slackUserID string) error
+	SlackUserID(userID int64) (string, error)
+	UserBySlackID(slackUserID string) (*User, error)
+	AddFavorite(userID int64, appID string) error
+	RemoveFavorite(userID int64, appID string) error
+	FavoriteAppIDs(userID int64) ([]string, error)
+	DeleteAppFavorites(appID string) error
+}
+
+// GroupStore persists groups, their user and app assignments, and their landing pages.
+type GroupStore interface {
+	CreateGroup(name string) (int64, error)
+	ListGroups() ([]Group, error)
+	GetGroup(groupID int64) (*Group, error)
+	UserGroupIDs(userID int64) ([]int64, error)
+	SetUserGroups(userID int64, groupIDs []int64) error
+	GroupUserIDs(groupID int64) ([]int64, error)
+	SetGroupUsers(groupID int64, userIDs []int64) error
+	AppGroupIDs(appID string) ([]int64, error)
+	SetAppGroups(appID string, groupIDs []int64) error
+	GroupAppIDs(groupID int64) ([]string, error)
+	SetGroupApps(groupID int64, appIDs []string) error
+	AppIDsByUserGroupIDs(groupIDs []int64) ([]string, error)
+	AllGroupAppIDs() (map[int64][]string, error)
+	AllGroupUserIDs() (map[int64][]int64, error)
+	GroupLanding(groupID int64) (GroupLanding, error)
+	SetGroupLanding(groupID int64, l GroupLanding) error
+	UserGroupLandings(userID int64) ([]GroupLanding, error)
+}
+
+// AppDataStore persists per-app settings and state kept outside apps.yaml: tags, inbound
+// triggers, promotions, deploy freezes, quotas, and cluster drift.
+type AppDataStore interface {
+	AppTags(appID string) ([]string, error)
+	AllAppTags() (map[string][]string, error)
+	SetAppTags(appID string, tags []string) error
+	AppIDsWithTags(tags []string) ([]string, error)
+	DeleteAppTags(appID string) error
+	CreateRunTrigger(t RunTrigger) (int64, error)
+	ListRunTriggers(appID string) ([]RunTrigger, error)
+	GetRunTriggerByTokenHash(hash string) (*RunTrigger, error)
+	DeleteRunTrigger(appID string, id int64) error
+	DeleteAppRunTriggers(appID string) error
+	ReserveTriggerDelivery(triggerID int64, key string, ttl time.Duration) (claimed bool, runID int64, err error)
+	CompleteTriggerDelivery(triggerID int64, key string, runID int64) error
+	ReleaseTriggerDelivery(triggerID int64, key string) error
+	CreatePromotion(p Promotion) (int64, error)
+	LatestPromotion(appID, environment string) (*Promotion, error)
+	ListPromotions(appID string, limit int) ([]Promotion, error)
+	DeleteAppPromotions(appID string) error
+	PromotionsByDigest(digest string, appIDs []string) ([]Promotion, error)
+	CreateDeployFreeze(f DeployFreeze) (int64, error)
+	ListDeployFreezes(since time.Time) ([]DeployFreeze, error)
+	DeleteDeployFreeze(id int64) error
+	SetQuota(q Quota) (int64, error)
+	ListQuotas() ([]Quota, error)
+	DeleteQuota(id int64) error
+	SetAppDeployed(appID string, runID int64, resources []string) error
+	SetAppDriftResult(appID string, runID int64, status, diff, errMsg string, checkedAt time.Time) error
+	GetAppDrift(appID string) (*AppDrift, error)
+	ListAppDrift(appIDs []string) ([]AppDrift, error)
+	DeleteAppDrift(appID string) error
+	SavePreviewEnv(appID, branch, namespace, url string, runID int64, now, expiresAt time.Time) (int64, error)
+	MarkPreviewEnvDeleted(id int64, reason string, at time.Time) error
+	GetPreviewEnv(id int64) (*PreviewEnv, error)
+	ActivePreviewEnv(appID, branch string) (*PreviewEnv, error)
+	ListPreviewEnvs(appIDs []string, status string) ([]PreviewEnv, error)
+	ExpiredPreviewEnvs(now time.Time) ([]PreviewEnv, error)
+	DeleteAppPreviewEnvs(appID string) error
+	SaveK8sDebugHold(h K8sDebugHold) error
+	GetK8sDebugHold(runID int64, now time.Time) (*K8sDebugHold, error)
+	DeleteK8sDebugHold(runID int64) error
+	DeleteExpiredK8sDebugHolds(now time.Time) error
+}
+
+// SecretStore persists credentials: SSH keys and their rotations, registries, global env vars,
+// the Jira settings, and git provider tokens.
+type SecretStore interface {
+	CreateSSHKey(name, privateKey string) (int64, error)
+	ListSSHKeys() ([]SSHKey, error)
+	GetSSHKey(id int64) (*SSHKey, error)
+	GetSSHKeyByName(name string) (*SSHKey, error)
+	DeleteSSHKey(id int64) error
+	RotateSSHKey(privateKey string, r SSHKeyRotation) (int64, error)
+	ListSSHKeyRotations(keyID int64) ([]SSHKeyRotation, error)
+	CreateRegistry(reg Registry) (int64, error)
+	ListRegistries() ([]Registry, error)
+	GetRegistry(id int64) (*Registry, error)
+	GetRegistryByName(name string) (*Registry, error)
+	UpdateRegistry(reg Registry) error
+	DeleteRegistry(id int64) error
+	CreateGlobalEnvVar(name, value string) (int64, error)
+	ListGlobalEnvVars() ([]GlobalEnvVar, error)
+	DeleteGlobalEnvVar(id int64) error
+	UpdateGlobalEnvVar(id int64, name, value string) error
+	GetJiraSettings() (*JiraSettings, error)
+	SetJiraSettings(js JiraSettings) error
+	DeleteJiraSettings() error
+	CreateGitProvider(p GitProvider) (int64, error)
+	ListGitProviders() ([]GitProvider, error)
+	GetGitProvider(id int64) (*GitProvider, error)
+	UpdateGitProvider(p GitProvider) error
+	DeleteGitProvider(id int64) error
+}
+
+// LeaseStore holds the named leases replicas compete for (see AcquireLease).
+type LeaseStore interface {
+	AcquireLease(name, holder string, ttl time.Duration, now time.Time) (bool, error)
+	LeaseHolder(name string, now time.Time) (string, error)
+	ReleaseLease(name, holder string) error
+}
+
+// MaintenanceStore holds the maintenance mode switch and the runs held while it is on, which all
+// replicas share.
+type MaintenanceStore interface {
+	GetMaintenance() (*Maintenance, error)
+	SetMaintenance(m Maintenance) error
+	ClearMaintenance() error
+	HoldRun(runID int64) error
+	DeleteHeldRuns(runIDs []int64) error
+	CountHeldRuns() (int, error)
+}
+
+// TrainStore persists release train runs and the app runs they started.
+type TrainStore interface {
+	CreateTrainRun(train, triggeredBy string, params map[string]string) (int64, error)
+	AdvanceTrainRun(id int64, from, to int) (bool, error)
+	AddTrainRunRun(trainRunID int64, stage int, appID string, runID int64) error
+	FinishTrainRun(id int64, status, errMsg string) error
+	GetTrainRun(id int64) (*TrainRun, error)
+	ListTrainRuns(train string, limit, offset int) ([]TrainRun, error)
+	RunningTrainRunIDs() ([]int64, error)
+}
+
+// ReleaseStore persists releases and the runs linked to them.
+type ReleaseStore interface {
+	CreateRelease(rel Release, runIDs []int64) (int64, error)
+	UpdateRelease(rel Release, runIDs []int64) error
+	DeleteRelease(id int64) error
+	GetRelease(id int64) (*Release, error)
+	ReleaseIDByVersion(version, environment string) (int64, error)
+	ListReleases(environment string, limit, offset int) ([]Release, error)
+}
+
+// Backend is the complete storage API used by the server.
+type Backend interface {
+	RunStore
+	RunDataStore
+	UserStore
+	GroupStore
+	AppDataStore
+	SecretStore
+	LeaseStore
+	MaintenanceStore
+	TrainStore
+	ReleaseStore
+	// Driver names the database driver ("sqlite3", "sqlite" or "mysql"); it is reported by the status endpoint.
+	Driver() string
+	Close() error
+}
+
+var _ Backend = (*Store)(nil)
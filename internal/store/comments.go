@@ -0,0 +1,65 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RunComment is a note attached to a run (e.g. "failed due to registry outage, safe to ignore").
+type RunComment struct {
+	ID        int64     `json:"id"`
+	RunID     int64     `json:"run_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateRunComment adds a comment to a run and returns its ID.
+func (s *Store) CreateRunComment(runID int64, author, body string) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO run_comments (run_id, author, body) VALUES (?, ?, ?)`, runID, author, body)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// GetRunComment returns a comment by ID, or nil if it does not exist.
+func (s *Store) GetRunComment(id int64) (*RunComment, error) {
+	var c RunComment
+	err := s.db.QueryRow(`SELECT id, run_id, author, body, created_at FROM run_comments WHERE id = ?`, id).
+		Scan(&c.ID, &c.RunID, &c.Author, &c.Body, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ListRunComments returns the comments of a run, oldest first.
+func (s *Store) ListRunComments(runID int64) ([]RunComment, error) {
+	rows, err := s.db.Query(`SELECT id, run_id, author, body, created_at FROM run_comments WHERE run_id = ? ORDER BY created_at, id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunComment, 0)
+	for rows.Next() {
+		var c RunComment
+		if err := rows.Scan(&c.ID, &c.RunID, &c.Author, &c.Body, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// DeleteRunComment removes a comment. Returns sql.ErrNoRows if it does not exist.
+func (s *Store) DeleteRunComment(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM run_comments WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
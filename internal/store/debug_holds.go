@@ -0,0 +1,55 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// K8sDebugHold is the pod of a failed Kubernetes Job run kept alive for debugging. The Job script
+// sleeps until ExpiresAt, after which the pod exits and the reconciler deletes the Job. Holds are
+// stored so that every replica, and the leader's reconciler in particular, sees them.
+type K8sDebugHold struct {
+	RunID     int64     `json:"run_id"`
+	AppID     string    `json:"app_id"`
+	Namespace string    `json:"namespace"`
+	Job       string    `json:"job"`
+	Pod       string    `json:"pod"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SaveK8sDebugHold records the debug hold of a run, replacing an earlier one.
+func (s *Store) SaveK8sDebugHold(h K8sDebugHold) error {
+	if err := s.DeleteK8sDebugHold(h.RunID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO k8s_debug_holds (run_id, app_id, namespace, job, pod, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		h.RunID, h.AppID, h.Namespace, h.Job, h.Pod, h.ExpiresAt.UTC())
+	return err
+}
+
+// GetK8sDebugHold returns the debug hold of a run, or nil when it has none or it expired before
+// now.
+func (s *Store) GetK8sDebugHold(runID int64, now time.Time) (*K8sDebugHold, error) {
+	var h K8sDebugHold
+	err := s.db.QueryRow(`SELECT run_id, app_id, namespace, job, pod, expires_at FROM k8s_debug_holds WHERE run_id = ? AND expires_at > ?`, runID, now.UTC()).
+		Scan(&h.RunID, &h.AppID, &h.Namespace, &h.Job, &h.Pod, &h.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// DeleteK8sDebugHold removes the debug hold of a run.
+func (s *Store) DeleteK8sDebugHold(runID int64) error {
+	_, err := s.db.Exec(`DELETE FROM k8s_debug_holds WHERE run_id = ?`, runID)
+	return err
+}
+
+// DeleteExpiredK8sDebugHolds removes the debug holds that expired before now.
+func (s *Store) DeleteExpiredK8sDebugHolds(now time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM k8s_debug_holds WHERE expires_at <= ?`, now.UTC())
+	return err
+}
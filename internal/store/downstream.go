@@ -0,0 +1,36 @@
+package store
+
+import "database/sql"
+
+// SetRunTriggeredByRun records that run id was started by the completion of upstreamRunID.
+func (s *Store) SetRunTriggeredByRun(id, upstreamRunID int64) error {
+	_, err := s.db.Exec(`UPDATE runs SET triggered_by_run_id = ? WHERE id = ?`, upstreamRunID, id)
+	return err
+}
+
+// ListDownstreamRuns returns the runs started by the completion of upstreamRunID that are not
+// soft-deleted, oldest first. Runs carry no log.
+func (s *Store) ListDownstreamRuns(upstreamRunID int64) ([]Run, error) {
+	rows, err := s.db.Query(`
+		SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), started_at, ended_at, COALESCE(slow,0), COALESCE(failure_reason,'')
+		FROM runs WHERE triggered_by_run_id = ? AND deleted_at IS NULL ORDER BY id
+	`, upstreamRunID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var r Run
+		var endedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			r.EndedAt = &endedAt.Time
+		}
+		r.TriggeredByRunID = upstreamRunID
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
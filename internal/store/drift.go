@@ -0,0 +1,128 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Drift states of an app.
+const (
+	DriftUnchecked = "unchecked"
+	DriftInSync    = "in_sync"
+	DriftDrifted   = "drifted"
+	DriftError     = "error"
+)
+
+// AppDrift is how the live cluster compares to the last deploy of an app deployed with kubectl or
+// helm. Resources are the objects `kubectl apply` reported (empty for helm, whose release knows
+// them); Diff is the `kubectl diff` output of the last check that found drift, and DriftedSince
+// when drift was first seen after the deploy.
+type AppDrift struct {
+	AppID        string     `json:"app_id"`
+	DeployRunID  int64      `json:"deploy_run_id"`
+	Resources    []string   `json:"resources"`
+	Status       string     `json:"status"`
+	Diff         string     `json:"diff,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	CheckedAt    *time.Time `json:"checked_at,omitempty"`
+	DriftedSince *time.Time `json:"drifted_since,omitempty"`
+}
+
+// SetAppDeployed records the deploy of an app by runID, replacing the earlier one; its drift is
+// unchecked until the next check.
+func (s *Store) SetAppDeployed(appID string, runID int64, resources []string) error {
+	if _, err := s.db.Exec(`DELETE FROM app_drift WHERE app_id = ?`, appID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO app_drift (app_id, deploy_run_id, resources, status, diff, error) VALUES (?, ?, ?, ?, '', '')`,
+		appID, runID, strings.Join(resources, "\n"), DriftUnchecked)
+	return err
+}
+
+// SetAppDriftResult records a drift check of the deploy by runID. It returns sql.ErrNoRows when
+// the app was deployed again (or its record deleted) since, so the result is stale.
+func (s *Store) SetAppDriftResult(appID string, runID int64, status, diff, errMsg string, checkedAt time.Time) error {
+	since := `NULL`
+	if status == DriftDrifted {
+		since = `COALESCE(drifted_since, ?)`
+	}
+	query := `UPDATE app_drift SET status = ?, diff = ?, error = ?, checked_at = ?, drifted_since = ` + since + ` WHERE app_id = ? AND deploy_run_id = ?`
+	args := []interface{}{status, diff, errMsg, checkedAt}
+	if status == DriftDrifted {
+		args = append(args, checkedAt)
+	}
+	res, err := s.db.Exec(query, append(args, appID, runID)...)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+const appDriftColumns = `app_id, deploy_run_id, resources, status, diff, error, checked_at, drifted_since`
+
+func scanAppDrift(scan func(dest ...interface{}) error) (AppDrift, error) {
+	var d AppDrift
+	var resources string
+	var checkedAt, driftedSince sql.NullTime
+	if err := scan(&d.AppID, &d.DeployRunID, &resources, &d.Status, &d.Diff, &d.Error, &checkedAt, &driftedSince); err != nil {
+		return d, err
+	}
+	d.Resources = []string{}
+	if resources != "" {
+		d.Resources = strings.Split(resources, "\n")
+	}
+	if checkedAt.Valid {
+		d.CheckedAt = &checkedAt.Time
+	}
+	if driftedSince.Valid {
+		d.DriftedSince = &driftedSince.Time
+	}
+	return d, nil
+}
+
+// GetAppDrift returns the drift record of an app, or nil when it has no recorded deploy.
+func (s *Store) GetAppDrift(appID string) (*AppDrift, error) {
+	d, err := scanAppDrift(s.db.QueryRow(`SELECT `+appDriftColumns+` FROM app_drift WHERE app_id = ?`, appID).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListAppDrift returns the drift records of the apps, ordered by app. appIDs restricts the apps
+// (nil = all).
+func (s *Store) ListAppDrift(appIDs []string) ([]AppDrift, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []AppDrift{}, nil
+	}
+	query, args := `SELECT `+appDriftColumns+` FROM app_drift`, []interface{}(nil)
+	if appIDs != nil {
+		var placeholders string
+		placeholders, args = inPlaceholders(appIDs)
+		query += ` WHERE app_id IN (` + placeholders + `)`
+	}
+	rows, err := s.db.Query(query+` ORDER BY app_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]AppDrift, 0)
+	for rows.Next() {
+		d, err := scanAppDrift(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// DeleteAppDrift removes the drift record of an app.
+func (s *Store) DeleteAppDrift(appID string) error {
+	_, err := s.db.Exec(`DELETE FROM app_drift WHERE app_id = ?`, appID)
+	return err
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// FailureReasonCount is the number of failed runs of an app with a failure reason ("" when the
+// log matched no failure rule).
+type FailureReasonCount struct {
+	AppID  string `json:"app_id"`
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+// FailureReasonCounts counts the failed runs started within the last d that are not soft-deleted,
+// by app and failure reason. appIDs restricts the apps (nil = all).
+func (s *Store) FailureReasonCounts(appIDs []string, d time.Duration) ([]FailureReasonCount, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []FailureReasonCount{}, nil
+	}
+	filter, args := "", []interface{}(nil)
+	if appIDs != nil {
+		var placeholders string
+		placeholders, args = inPlaceholders(appIDs)
+		filter = " AND app_id IN (" + placeholders + ")"
+	}
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT app_id, COALESCE(failure_reason,''), COUNT(*) FROM runs
+		WHERE status = 'failed' AND deleted_at IS NULL AND started_at >= %s%s
+		GROUP BY app_id, COALESCE(failure_reason,'') ORDER BY app_id, COUNT(*) DESC
+	`, s.agoExpr(d), filter), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]FailureReasonCount, 0)
+	for rows.Next() {
+		var c FailureReasonCount
+		if err := rows.Scan(&c.AppID, &c.Reason, &c.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
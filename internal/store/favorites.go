@@ -0,0 +1,45 @@
+package store
+
+// AddFavorite pins an app for a user after their existing favorites. Adding an existing favorite is a no-op.
+func (s *Store) AddFavorite(userID int64, appID string) error {
+	insert := `INSERT OR IGNORE`
+	if s.driver == "mysql" {
+		insert = `INSERT IGNORE`
+	}
+	_, err := s.db.Exec(insert+` INTO user_favorites (user_id, app_id, position)
+		SELECT ?, ?, COALESCE(MAX(position), 0) + 1 FROM user_favorites WHERE user_id = ?`, userID, appID, userID)
+	return err
+}
+
+// RemoveFavorite unpins an app for a user. Returns sql.ErrNoRows if it was not a favorite.
+func (s *Store) RemoveFavorite(userID int64, appID string) error {
+	res, err := s.db.Exec(`DELETE FROM user_favorites WHERE user_id = ? AND app_id = ?`, userID, appID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// FavoriteAppIDs returns the app IDs pinned by a user, in pin order.
+func (s *Store) FavoriteAppIDs(userID int64) ([]string, error) {
+	rows, err := s.db.Query(`SELECT app_id FROM user_favorites WHERE user_id = ? ORDER BY position, app_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]string, 0)
+	for rows.Next() {
+		var appID string
+		if err := rows.Scan(&appID); err != nil {
+			return nil, err
+		}
+		out = append(out, appID)
+	}
+	return out, rows.Err()
+}
+
+// DeleteAppFavorites removes an app from all users' favorites (used when the app is deleted).
+func (s *Store) DeleteAppFavorites(appID string) error {
+	_, err := s.db.Exec(`DELETE FROM user_favorites WHERE app_id = ?`, appID)
+	return err
+}
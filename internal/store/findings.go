@@ -0,0 +1,56 @@
+package store
+
+// RunFinding is a vulnerability reported by a scan step of a run (see pipeline.Finding).
+type RunFinding struct {
+	Step             string `json:"step"`
+	Tool             string `json:"tool"`
+	ID               string `json:"id"`
+	Package          string `json:"package"`
+	InstalledVersion string `json:"installed_version"`
+	FixedVersion     string `json:"fixed_version"`
+	Severity         string `json:"severity"`
+	Title            string `json:"title"`
+	Target           string `json:"target"`
+}
+
+// SetRunFindings replaces the findings of a run; they are stored in the given order.
+func (s *Store) SetRunFindings(runID int64, findings []RunFinding) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM run_findings WHERE run_id = ?`, runID); err != nil {
+		return err
+	}
+	for i, f := range findings {
+		if _, err := tx.Exec(`
+			INSERT INTO run_findings (run_id, position, step, tool, vuln_id, package, installed_version, fixed_version, severity, title, target)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, runID, i, f.Step, f.Tool, f.ID, f.Package, f.InstalledVersion, f.FixedVersion, f.Severity, f.Title, f.Target); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListRunFindings returns the findings of a run in the order they were reported.
+func (s *Store) ListRunFindings(runID int64) ([]RunFinding, error) {
+	rows, err := s.db.Query(`
+		SELECT step, tool, vuln_id, package, installed_version, fixed_version, severity, title, target
+		FROM run_findings WHERE run_id = ? ORDER BY position
+	`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunFinding, 0)
+	for rows.Next() {
+		var f RunFinding
+		if err := rows.Scan(&f.Step, &f.Tool, &f.ID, &f.Package, &f.InstalledVersion, &f.FixedVersion, &f.Severity, &f.Title, &f.Target); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,58 @@
+package store
+
+import "time"
+
+// DeployFreeze is a period declared by an admin during which deploy steps of apps in Environment
+// ("*" for every environment) are blocked.
+type DeployFreeze struct {
+	ID          int64     `json:"id"`
+	Environment string    `json:"environment"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	Reason      string    `json:"reason"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Active reports whether the freeze covers environment at t.
+func (f DeployFreeze) Active(environment string, t time.Time) bool {
+	return (f.Environment == "*" || f.Environment == environment) && !t.Before(f.StartsAt) && t.Before(f.EndsAt)
+}
+
+// CreateDeployFreeze records a freeze and returns its ID.
+func (s *Store) CreateDeployFreeze(f DeployFreeze) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO deploy_freezes (environment, starts_at, ends_at, reason, created_by) VALUES (?, ?, ?, ?, ?)`,
+		f.Environment, f.StartsAt.UTC(), f.EndsAt.UTC(), f.Reason, f.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListDeployFreezes returns the freezes ending after since, earliest start first.
+func (s *Store) ListDeployFreezes(since time.Time) ([]DeployFreeze, error) {
+	rows, err := s.db.Query(`SELECT id, environment, starts_at, ends_at, reason, created_by, created_at FROM deploy_freezes WHERE ends_at > ? ORDER BY starts_at, id`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	freezes := make([]DeployFreeze, 0)
+	for rows.Next() {
+		var f DeployFreeze
+		if err := rows.Scan(&f.ID, &f.Environment, &f.StartsAt, &f.EndsAt, &f.Reason, &f.CreatedBy, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		freezes = append(freezes, f)
+	}
+	return freezes, rows.Err()
+}
+
+// DeleteDeployFreeze deletes one freeze by ID.
+func (s *Store) DeleteDeployFreeze(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM deploy_freezes WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GitProvider holds an API token for a GitHub or GitLab instance, used to browse repositories
+// and branches when setting up apps.
+type GitProvider struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"` // github or gitlab
+	APIURL    string    `json:"api_url"`
+	Token     string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateGitProvider inserts a git provider and returns the generated ID.
+func (s *Store) CreateGitProvider(p GitProvider) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO git_providers (name, kind, api_url, token) VALUES (?, ?, ?, ?)`, p.Name, p.Kind, p.APIURL, p.Token)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListGitProviders returns git providers ordered by name, without tokens.
+func (s *Store) ListGitProviders() ([]GitProvider, error) {
+	rows, err := s.db.Query(`SELECT id, name, kind, api_url, created_at FROM git_providers ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]GitProvider, 0)
+	for rows.Next() {
+		var p GitProvider
+		if err := rows.Scan(&p.ID, &p.Name, &p.Kind, &p.APIURL, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// GetGitProvider returns a git provider by ID (including token), or nil if it does not exist.
+func (s *Store) GetGitProvider(id int64) (*GitProvider, error) {
+	var p GitProvider
+	err := s.db.QueryRow(`SELECT id, name, kind, api_url, token, created_at FROM git_providers WHERE id = ?`, id).
+		Scan(&p.ID, &p.Name, &p.Kind, &p.APIURL, &p.Token, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdateGitProvider updates the API URL and token of a git provider.
+func (s *Store) UpdateGitProvider(p GitProvider) error {
+	res, err := s.db.Exec(`UPDATE git_providers SET api_url = ?, token = ? WHERE id = ?`, p.APIURL, p.Token, p.ID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// DeleteGitProvider deletes one git provider by ID.
+func (s *Store) DeleteGitProvider(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM git_providers WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
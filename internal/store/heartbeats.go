@@ -0,0 +1,34 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TouchRunHeartbeats sets the heartbeat of the given runs to now.
+func (s *Store) TouchRunHeartbeats(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimRight(strings.Repeat("?,", len(ids)), ",")
+	_, err := s.db.Exec(fmt.Sprintf(`UPDATE runs SET heartbeat_at = %s WHERE id IN (%s)`, s.nowExpr(), placeholders), args...)
+	return err
+}
+
+// StaleRuns returns the pending and running runs that are not soft-deleted and whose last
+// heartbeat (or start, before the first heartbeat) is at least olderThan ago (ID, app, trigger,
+// and status only).
+func (s *Store) StaleRuns(olderThan time.Duration) ([]Run, error) {
+	return s.unfinishedRunsWhere(fmt.Sprintf(`COALESCE(heartbeat_at, started_at) <= %s`, s.agoExpr(olderThan)))
+}
+
+// LiveRuns returns the pending and running runs that are not soft-deleted and are not stale
+// for StaleRuns(within) (ID, app, trigger, and status only).
+func (s *Store) LiveRuns(within time.Duration) ([]Run, error) {
+	return s.unfinishedRunsWhere(fmt.Sprintf(`COALESCE(heartbeat_at, started_at) > %s`, s.agoExpr(within)))
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UserInvite is a pending account: the invited user sets their own password with the invite
+// token before ExpiresAt. Only the SHA-256 hash of the token is stored.
+type UserInvite struct {
+	ID         int64      `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email,omitempty"`
+	IsAdmin    bool       `json:"is_admin"`
+	GroupIDs   []int64    `json:"group_ids"`
+	TokenHash  string     `json:"-"`
+	InvitedBy  string     `json:"invited_by"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateUserInvite stores an invite and returns its ID.
+func (s *Store) CreateUserInvite(inv UserInvite) (int64, error) {
+	ids := make([]string, 0, len(inv.GroupIDs))
+	for _, id := range inv.GroupIDs {
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	res, err := s.db.Exec(`INSERT INTO user_invites (username, email, is_admin, group_ids, token_hash, invited_by, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		inv.Username, inv.Email, inv.IsAdmin, strings.Join(ids, ","), inv.TokenHash, inv.InvitedBy, inv.ExpiresAt.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// GetUserInviteByTokenHash returns the invite with the given token hash, or nil.
+func (s *Store) GetUserInviteByTokenHash(hash string) (*UserInvite, error) {
+	var inv UserInvite
+	var groupIDs string
+	var acceptedAt sql.NullTime
+	err := s.db.QueryRow(`SELECT id, username, email, is_admin, group_ids, token_hash, invited_by, expires_at, accepted_at, created_at FROM user_invites WHERE token_hash = ?`, hash).
+		Scan(&inv.ID, &inv.Username, &inv.Email, &inv.IsAdmin, &groupIDs, &inv.TokenHash, &inv.InvitedBy, &inv.ExpiresAt, &acceptedAt, &inv.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if acceptedAt.Valid {
+		inv.AcceptedAt = &acceptedAt.Time
+	}
+	inv.GroupIDs = make([]int64, 0)
+	for _, part := range strings.Split(groupIDs, ",") {
+		if id, err := strconv.ParseInt(part, 10, 64); err == nil {
+			inv.GroupIDs = append(inv.GroupIDs, id)
+		}
+	}
+	return &inv, nil
+}
+
+// AcceptUserInvite creates the invited user with passwordHash and its groups, and marks the invite
+// used, in one transaction. Returns sql.ErrNoRows when the invite was already used or expired
+// at now.
+func (s *Store) AcceptUserInvite(inv UserInvite, passwordHash string, now time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE user_invites SET accepted_at = ? WHERE id = ? AND accepted_at IS NULL AND expires_at > ?`, now.UTC(), inv.ID, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	if err := requireAffected(res); err != nil {
+		return 0, err
+	}
+	res, err = tx.Exec(`INSERT INTO users (username, password_hash, is_admin) VALUES (?, ?, ?)`, inv.Username, passwordHash, inv.IsAdmin)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, groupID := range inv.GroupIDs {
+		if _, err := tx.Exec(`INSERT INTO user_groups (user_id, group_id) VALUES (?, ?)`, userID, groupID); err != nil {
+			return 0, err
+		}
+	}
+	return userID, tx.Commit()
+}
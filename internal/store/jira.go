@@ -0,0 +1,115 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// JiraSettings configures the Jira integration: the site issues link to and, per environment,
+// what a successful deploy there does to the issues its commits mention.
+type JiraSettings struct {
+	BaseURL string `json:"base_url"`
+	// Username is the account email for Jira Cloud API tokens; without it Token is sent as a
+	// bearer token (a Jira Data Center personal access token).
+	Username     string            `json:"username"`
+	Token        string            `json:"-"`
+	Environments []JiraEnvironment `json:"environments"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// JiraEnvironment is what a successful deploy to Environment does to its issues: add a comment
+// and/or apply the workflow transition named Transition (e.g. "Deployed").
+type JiraEnvironment struct {
+	Environment string `json:"environment"`
+	Comment     bool   `json:"comment"`
+	Transition  string `json:"transition,omitempty"`
+}
+
+// GetJiraSettings returns the Jira settings (including token), or nil when Jira is not configured.
+func (s *Store) GetJiraSettings() (*JiraSettings, error) {
+	var js JiraSettings
+	var envs string
+	err := s.db.QueryRow(`SELECT base_url, username, token, environments, updated_at FROM jira_settings WHERE id = 1`).
+		Scan(&js.BaseURL, &js.Username, &js.Token, &envs, &js.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(envs), &js.Environments); err != nil {
+		return nil, err
+	}
+	if js.Environments == nil {
+		js.Environments = []JiraEnvironment{}
+	}
+	return &js, nil
+}
+
+// SetJiraSettings stores the Jira settings, replacing earlier ones.
+func (s *Store) SetJiraSettings(js JiraSettings) error {
+	if js.Environments == nil {
+		js.Environments = []JiraEnvironment{}
+	}
+	envs, err := json.Marshal(js.Environments)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM jira_settings WHERE id = 1`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO jira_settings (id, base_url, username, token, environments) VALUES (1, ?, ?, ?, ?)`,
+		js.BaseURL, js.Username, js.Token, string(envs)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteJiraSettings removes the Jira settings, turning the integration off.
+func (s *Store) DeleteJiraSettings() error {
+	_, err := s.db.Exec(`DELETE FROM jira_settings WHERE id = 1`)
+	return err
+}
+
+// SetRunIssues replaces the issue keys mentioned by the commits of a run; they are stored in the
+// given order.
+func (s *Store) SetRunIssues(runID int64, keys []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM run_issues WHERE run_id = ?`, runID); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if _, err := tx.Exec(`INSERT INTO run_issues (run_id, position, issue_key) VALUES (?, ?, ?)`, runID, i, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListRunIssues returns the issue keys of a run in the order they were found.
+func (s *Store) ListRunIssues(runID int64) ([]string, error) {
+	rows, err := s.db.Query(`SELECT issue_key FROM run_issues WHERE run_id = ? ORDER BY position`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		out = append(out, key)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// GroupLanding is what members of a group see first after login: Page is "runs" or "apps" (""
+// for the default), AppIDs the apps shown by default in the apps list (empty for all).
+type GroupLanding struct {
+	GroupID int64    `json:"group_id,omitempty"`
+	Page    string   `json:"page"`
+	AppIDs  []string `json:"app_ids"`
+}
+
+// GroupLanding returns the landing page of a group; the zero value (with empty AppIDs) when it
+// has none.
+func (s *Store) GroupLanding(groupID int64) (GroupLanding, error) {
+	l := GroupLanding{GroupID: groupID, AppIDs: []string{}}
+	var appIDs string
+	err := s.db.QueryRow(`SELECT page, app_ids FROM group_landing WHERE group_id = ?`, groupID).Scan(&l.Page, &appIDs)
+	if err == sql.ErrNoRows {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal([]byte(appIDs), &l.AppIDs); err != nil {
+		return l, fmt.Errorf("group %d: landing apps: %w", groupID, err)
+	}
+	return l, nil
+}
+
+// SetGroupLanding replaces the landing page of a group; an empty page and app list removes it.
+func (s *Store) SetGroupLanding(groupID int64, l GroupLanding) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM group_landing WHERE group_id = ?`, groupID); err != nil {
+		return err
+	}
+	if l.Page != "" || len(l.AppIDs) > 0 {
+		if l.AppIDs == nil {
+			l.AppIDs = []string{}
+		}
+		data, err := json.Marshal(l.AppIDs)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO group_landing (group_id, page, app_ids) VALUES (?, ?, ?)`, groupID, l.Page, string(data)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UserGroupLandings returns the landing pages of the groups of a user, ordered by group name.
+func (s *Store) UserGroupLandings(userID int64) ([]GroupLanding, error) {
+	rows, err := s.db.Query(`
+		SELECT l.group_id, l.page, l.app_ids FROM group_landing l
+		JOIN user_groups ug ON ug.group_id = l.group_id
+		JOIN groups g ON g.id = l.group_id
+		WHERE ug.user_id = ? ORDER BY g.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]GroupLanding, 0)
+	for rows.Next() {
+		var l GroupLanding
+		var appIDs string
+		if err := rows.Scan(&l.GroupID, &l.Page, &appIDs); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(appIDs), &l.AppIDs); err != nil {
+			return nil, fmt.Errorf("group %d: landing apps: %w", l.GroupID, err)
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
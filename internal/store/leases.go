@@ -0,0 +1,55 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AcquireLease takes or renews the named lease for holder until now+ttl and reports whether
+// holder has it. A lease held by someone else is only taken over once it expired, so at most one
+// holder has an unexpired lease at a time.
+func (s *Store) AcquireLease(name, holder string, ttl time.Duration, now time.Time) (bool, error) {
+	now = now.UTC()
+	expires := now.Add(ttl)
+	res, err := s.db.Exec(`UPDATE leader_leases SET holder = ?, expires_at = ? WHERE name = ? AND (holder = ? OR expires_at <= ?)`,
+		holder, expires, name, holder, now)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return true, nil
+	}
+	if _, err := s.db.Exec(`INSERT INTO leader_leases (name, holder, expires_at) VALUES (?, ?, ?)`, name, holder, expires); err == nil {
+		return true, nil
+	}
+	// The lease exists: another holder has it, or (MySQL counts unchanged rows as unaffected) a
+	// renewal within the same second left it as it was.
+	current, err := s.LeaseHolder(name, now)
+	if err != nil {
+		return false, err
+	}
+	return current == holder, nil
+}
+
+// LeaseHolder returns the holder of the named lease, or "" when it is free or expired.
+func (s *Store) LeaseHolder(name string, now time.Time) (string, error) {
+	var holder string
+	var expires time.Time
+	err := s.db.QueryRow(`SELECT holder, expires_at FROM leader_leases WHERE name = ?`, name).Scan(&holder, &expires)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !expires.After(now) {
+		return "", nil
+	}
+	return holder, nil
+}
+
+// ReleaseLease gives up the named lease if holder has it.
+func (s *Store) ReleaseLease(name, holder string) error {
+	_, err := s.db.Exec(`DELETE FROM leader_leases WHERE name = ? AND holder = ?`, name, holder)
+	return err
+}
@@ -0,0 +1,75 @@
+package store
+
+import "time"
+
+// LogRedactionRule is an admin-managed regular expression whose matches are replaced in run logs.
+type LogRedactionRule struct {
+	ID          int64     `json:"id"`
+	Pattern     string    `json:"pattern"`
+	Description string    `json:"description"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreateLogRedactionRule stores a redaction rule and returns its ID.
+func (s *Store) CreateLogRedactionRule(r LogRedactionRule) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO log_redaction_rules (pattern, description, created_by) VALUES (?, ?, ?)`,
+		r.Pattern, r.Description, r.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListLogRedactionRules returns all redaction rules, oldest first.
+func (s *Store) ListLogRedactionRules() ([]LogRedactionRule, error) {
+	rows, err := s.db.Query(`SELECT id, pattern, description, created_by, created_at FROM log_redaction_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]LogRedactionRule, 0)
+	for rows.Next() {
+		var r LogRedactionRule
+		if err := rows.Scan(&r.ID, &r.Pattern, &r.Description, &r.CreatedBy, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// DeleteLogRedactionRule deletes a redaction rule. Returns sql.ErrNoRows if it does not exist.
+func (s *Store) DeleteLogRedactionRule(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM log_redaction_rules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// FinishedRunIDs returns up to limit IDs above afterID, in ascending order, of the runs that are
+// neither pending nor running (soft-deleted ones included), of one app or of all apps when appID
+// is empty. Callers page through all runs by passing the last ID returned.
+func (s *Store) FinishedRunIDs(appID string, afterID int64, limit int) ([]int64, error) {
+	query := `SELECT id FROM runs WHERE id > ? AND status NOT IN ('pending', 'running')`
+	args := []interface{}{afterID}
+	if appID != "" {
+		query += ` AND app_id = ?`
+		args = append(args, appID)
+	}
+	rows, err := s.db.Query(query+` ORDER BY id LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,40 @@
+package store
+
+import "time"
+
+// SetRunLogRef records that a run's log lives in the log store under key (size in bytes).
+// An empty key means the log is kept in the runs table.
+func (s *Store) SetRunLogRef(id int64, key string, size int64) error {
+	res, err := s.db.Exec(`UPDATE runs SET log_key = ?, log_size = ? WHERE id = ?`, key, size, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// LogKeysByAppID returns the log store keys of an app's unpinned runs (deleted before DeleteRunsByAppID).
+func (s *Store) LogKeysByAppID(appID string) ([]string, error) {
+	return s.logKeys(`app_id = ? AND pinned_at IS NULL`, appID)
+}
+
+// PurgeableLogKeys returns the log store keys of the runs PurgeDeletedRuns(olderThan) would remove.
+func (s *Store) PurgeableLogKeys(olderThan time.Duration) ([]string, error) {
+	return s.logKeys(s.purgeableRunsCond(olderThan))
+}
+
+func (s *Store) logKeys(where string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(`SELECT log_key FROM runs WHERE log_key <> '' AND `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
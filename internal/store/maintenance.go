@@ -0,0 +1,82 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Maintenance is the maintenance mode switch. It is stored while maintenance mode is on, so that
+// every replica rejects or holds new runs, and removed when it is switched off.
+type Maintenance struct {
+	Message   string    `json:"message"`
+	QueueRuns bool      `json:"queue_runs"`
+	Since     time.Time `json:"since"`
+	By        string    `json:"by"`
+}
+
+// GetMaintenance returns the maintenance mode switch, or nil when maintenance mode is off.
+func (s *Store) GetMaintenance() (*Maintenance, error) {
+	var m Maintenance
+	err := s.db.QueryRow(`SELECT message, queue_runs, since, set_by FROM maintenance_mode WHERE id = 1`).
+		Scan(&m.Message, &m.QueueRuns, &m.Since, &m.By)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMaintenance switches maintenance mode on, replacing the earlier switch.
+func (s *Store) SetMaintenance(m Maintenance) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM maintenance_mode WHERE id = 1`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO maintenance_mode (id, message, queue_runs, since, set_by) VALUES (1, ?, ?, ?, ?)`,
+		m.Message, m.QueueRuns, m.Since.UTC(), m.By); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClearMaintenance switches maintenance mode off.
+func (s *Store) ClearMaintenance() error {
+	_, err := s.db.Exec(`DELETE FROM maintenance_mode WHERE id = 1`)
+	return err
+}
+
+// HoldRun records that a pending run is held until maintenance mode is switched off.
+func (s *Store) HoldRun(runID int64) error {
+	_, err := s.db.Exec(`INSERT INTO held_runs (run_id) VALUES (?)`, runID)
+	return err
+}
+
+// DeleteHeldRuns removes the given runs from the held runs, e.g. once they were started.
+func (s *Store) DeleteHeldRuns(runIDs []int64) error {
+	if len(runIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(runIDs))
+	for _, id := range runIDs {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimRight(strings.Repeat("?,", len(runIDs)), ",")
+	_, err := s.db.Exec(fmt.Sprintf(`DELETE FROM held_runs WHERE run_id IN (%s)`, placeholders), args...)
+	return err
+}
+
+// CountHeldRuns returns the number of held runs that are still pending; runs interrupted while
+// held (their server was lost) do not count.
+func (s *Store) CountHeldRuns() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM held_runs h JOIN runs r ON r.id = h.run_id WHERE r.status = 'pending'`).Scan(&n)
+	return n, err
+}
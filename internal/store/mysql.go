@@ -0,0 +1,130 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlUTCDSN makes a MySQL connection keep times in UTC like SQLite: the session time zone is
+// UTC, so NOW() and CURRENT_TIMESTAMP match datetime('now'), and DATETIME values are parsed as
+// UTC time.Time. A time_zone or loc in dsn is replaced.
+func mysqlUTCDSN(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	return cfg.FormatDSN(), nil
+}
+
+// mysqlDSNTimeZone returns the session time zone dsn sets (e.g. "Europe/Berlin"), or "" when the
+// server's default applies.
+func mysqlDSNTimeZone(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(cfg.Params["time_zone"], "'")
+}
+
+// mysqlUTCMigration names the conversion of times to UTC in store_migrations.
+const mysqlUTCMigration = "utc_times"
+
+// mysqlNowColumns are the DATETIME columns set with NOW() in queries. Together with the columns
+// defaulting to CURRENT_TIMESTAMP, they held the session's local time before connections used a
+// UTC session (see mysqlUTCDSN); times passed from Go were already UTC.
+var mysqlNowColumns = []string{
+	"api_tokens.rotated_at", "run_approvals.decided_at",
+	"runs.started_at", "runs.ended_at", "runs.heartbeat_at", "runs.pinned_at", "runs.deleted_at",
+	"train_runs.started_at", "train_runs.ended_at",
+}
+
+// mysqlGoTimeColumns default to CURRENT_TIMESTAMP but are always written from Go, so they are UTC.
+var mysqlGoTimeColumns = map[string]bool{"run_notifications.created_at": true}
+
+// migrateMySQLLocalTimes converts the times MySQL wrote from its own clock in the old session time
+// zone (fromZone, or the server's default when "") to UTC, once: a store_migrations row records
+// that it ran, in the same transaction. Named zones need the MySQL time zone tables; without them
+// it fails rather than leave times shifted.
+func migrateMySQLLocalTimes(db *sql.DB, fromZone string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS store_migrations (name VARCHAR(64) PRIMARY KEY, applied_at DATETIME NOT NULL)`); err != nil {
+		return err
+	}
+	var done int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM store_migrations WHERE name = ?`, mysqlUTCMigration).Scan(&done); err != nil || done > 0 {
+		return err
+	}
+	if fromZone == "" {
+		if err := db.QueryRow(`SELECT @@global.time_zone`).Scan(&fromZone); err != nil {
+			return err
+		}
+	}
+	var probe sql.NullString
+	if err := db.QueryRow(`SELECT CAST(CONVERT_TZ('2000-01-01 00:00:00', ?, '+00:00') AS CHAR)`, fromZone).Scan(&probe); err != nil {
+		return err
+	}
+	var runs int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM runs`).Scan(&runs); err != nil {
+		return err
+	}
+	var columns []string
+	switch {
+	case runs == 0 || probe.String == "2000-01-01 00:00:00":
+		// A new database, or times that are UTC already.
+	case !probe.Valid:
+		return fmt.Errorf("cannot convert stored times from MySQL time zone %s to UTC: load the time zone tables (mysql_tzinfo_to_sql) and start again", fromZone)
+	default:
+		var err error
+		if columns, err = mysqlLocalTimeColumns(db); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, name := range columns {
+		table, column, _ := strings.Cut(name, ".")
+		query := fmt.Sprintf("UPDATE `%s` SET `%s` = CONVERT_TZ(`%[2]s`, ?, '+00:00') WHERE `%[2]s` IS NOT NULL", table, column)
+		if _, err := tx.Exec(query, fromZone); err != nil {
+			return fmt.Errorf("convert %s to UTC: %w", name, err)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO store_migrations (name, applied_at) VALUES (?, NOW())`, mysqlUTCMigration); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mysqlLocalTimeColumns returns the columns migrateMySQLLocalTimes converts, as table.column:
+// mysqlNowColumns and those defaulting to CURRENT_TIMESTAMP, except mysqlGoTimeColumns.
+func mysqlLocalTimeColumns(db *sql.DB) ([]string, error) {
+	columns := append([]string(nil), mysqlNowColumns...)
+	rows, err := db.Query(`SELECT TABLE_NAME, COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND DATA_TYPE = 'datetime' AND UPPER(COLUMN_DEFAULT) LIKE 'CURRENT_TIMESTAMP%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		if name := table + "." + column; !mysqlGoTimeColumns[name] {
+			columns = append(columns, name)
+		}
+	}
+	return columns, rows.Err()
+}
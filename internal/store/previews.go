@@ -0,0 +1,144 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Preview environment states.
+const (
+	PreviewActive  = "active"
+	PreviewDeleted = "deleted"
+)
+
+// PreviewEnv is the ephemeral environment a branch of an app is deployed into. LastRunID is the
+// last preview run deploying it; ExpiresAt is when the TTL janitor tears it down unless the
+// branch is pushed again. DeleteReason says why a deleted preview was torn down (e.g.
+// "branch deleted", "ttl", or the user who deleted it).
+type PreviewEnv struct {
+	ID           int64      `json:"id"`
+	AppID        string     `json:"app_id"`
+	Branch       string     `json:"branch"`
+	Namespace    string     `json:"namespace"`
+	URL          string     `json:"url,omitempty"`
+	Status       string     `json:"status"`
+	LastRunID    int64      `json:"last_run_id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	DeleteReason string     `json:"delete_reason,omitempty"`
+}
+
+// SavePreviewEnv records a deploy by runID of the preview of branch: it updates the active preview
+// of the branch, or creates one, and returns its ID.
+func (s *Store) SavePreviewEnv(appID, branch, namespace, url string, runID int64, now, expiresAt time.Time) (int64, error) {
+	p, err := s.ActivePreviewEnv(appID, branch)
+	if err != nil {
+		return 0, err
+	}
+	if p != nil {
+		_, err := s.db.Exec(`UPDATE preview_envs SET namespace = ?, url = ?, last_run_id = ?, updated_at = ?, expires_at = ? WHERE id = ?`,
+			namespace, url, runID, now, expiresAt, p.ID)
+		return p.ID, err
+	}
+	res, err := s.db.Exec(`INSERT INTO preview_envs (app_id, branch, namespace, url, status, last_run_id, created_at, updated_at, expires_at, delete_reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '')`,
+		appID, branch, namespace, url, PreviewActive, runID, now, now, expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// MarkPreviewEnvDeleted records that an active preview was torn down. It returns sql.ErrNoRows
+// when the preview is not active (already torn down, or unknown).
+func (s *Store) MarkPreviewEnvDeleted(id int64, reason string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE preview_envs SET status = ?, deleted_at = ?, delete_reason = ? WHERE id = ? AND status = ?`,
+		PreviewDeleted, at, reason, id, PreviewActive)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+const previewEnvColumns = `id, app_id, branch, namespace, url, status, last_run_id, created_at, updated_at, expires_at, deleted_at, delete_reason`
+
+func scanPreviewEnv(scan func(dest ...interface{}) error) (PreviewEnv, error) {
+	var p PreviewEnv
+	var deletedAt sql.NullTime
+	if err := scan(&p.ID, &p.AppID, &p.Branch, &p.Namespace, &p.URL, &p.Status, &p.LastRunID, &p.CreatedAt, &p.UpdatedAt, &p.ExpiresAt, &deletedAt, &p.DeleteReason); err != nil {
+		return p, err
+	}
+	if deletedAt.Valid {
+		p.DeletedAt = &deletedAt.Time
+	}
+	return p, nil
+}
+
+func (s *Store) getPreviewEnv(where string, args ...interface{}) (*PreviewEnv, error) {
+	p, err := scanPreviewEnv(s.db.QueryRow(`SELECT `+previewEnvColumns+` FROM preview_envs WHERE `+where, args...).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetPreviewEnv returns a preview by ID, or nil when not found.
+func (s *Store) GetPreviewEnv(id int64) (*PreviewEnv, error) {
+	return s.getPreviewEnv(`id = ?`, id)
+}
+
+// ActivePreviewEnv returns the active preview of a branch of an app, or nil when it has none.
+func (s *Store) ActivePreviewEnv(appID, branch string) (*PreviewEnv, error) {
+	return s.getPreviewEnv(`app_id = ? AND branch = ? AND status = ?`, appID, branch, PreviewActive)
+}
+
+func (s *Store) listPreviewEnvs(query string, args ...interface{}) ([]PreviewEnv, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]PreviewEnv, 0)
+	for rows.Next() {
+		p, err := scanPreviewEnv(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// ListPreviewEnvs returns the previews of the apps, newest first. appIDs restricts the apps
+// (nil = all); status, when set, restricts them to that state.
+func (s *Store) ListPreviewEnvs(appIDs []string, status string) ([]PreviewEnv, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []PreviewEnv{}, nil
+	}
+	query, args := `SELECT `+previewEnvColumns+` FROM preview_envs WHERE 1 = 1`, []interface{}(nil)
+	if appIDs != nil {
+		placeholders, ids := inPlaceholders(appIDs)
+		query += ` AND app_id IN (` + placeholders + `)`
+		args = append(args, ids...)
+	}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	return s.listPreviewEnvs(query+` ORDER BY id DESC`, args...)
+}
+
+// ExpiredPreviewEnvs returns the active previews whose TTL ran out before now.
+func (s *Store) ExpiredPreviewEnvs(now time.Time) ([]PreviewEnv, error) {
+	return s.listPreviewEnvs(`SELECT `+previewEnvColumns+` FROM preview_envs WHERE status = ? AND expires_at < ? ORDER BY id`, PreviewActive, now)
+}
+
+// DeleteAppPreviewEnvs removes the preview records of an app.
+func (s *Store) DeleteAppPreviewEnvs(appID string) error {
+	_, err := s.db.Exec(`DELETE FROM preview_envs WHERE app_id = ?`, appID)
+	return err
+}
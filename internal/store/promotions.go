@@ -0,0 +1,120 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RunImage is the container image a successful run built, identified by its digest.
+type RunImage struct {
+	RunID  int64  `json:"run_id"`
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+}
+
+// SetRunImage records the image built by a run, replacing an earlier record.
+func (s *Store) SetRunImage(runID int64, image, digest string) error {
+	if _, err := s.db.Exec(`DELETE FROM run_images WHERE run_id = ?`, runID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO run_images (run_id, image, digest) VALUES (?, ?, ?)`, runID, image, digest)
+	return err
+}
+
+// GetRunImage returns the image built by a run, or nil if it recorded none.
+func (s *Store) GetRunImage(runID int64) (*RunImage, error) {
+	var img RunImage
+	err := s.db.QueryRow(`SELECT run_id, image, digest FROM run_images WHERE run_id = ?`, runID).Scan(&img.RunID, &img.Image, &img.Digest)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// LatestRunImage returns the image of the app's most recent successful, not deleted run that recorded one, or nil.
+func (s *Store) LatestRunImage(appID string) (*RunImage, error) {
+	var img RunImage
+	err := s.db.QueryRow(`
+		SELECT i.run_id, i.image, i.digest FROM run_images i JOIN runs r ON r.id = i.run_id
+		WHERE r.app_id = ? AND r.status = 'success' AND r.deleted_at IS NULL
+		ORDER BY r.id DESC LIMIT 1`, appID).Scan(&img.RunID, &img.Image, &img.Digest)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// Promotion records an image digest copied to an environment's registry/tag.
+// DeployRunID is the run started in the environment's deploy app (0 when none).
+type Promotion struct {
+	ID          int64     `json:"id"`
+	AppID       string    `json:"app_id"`
+	Environment string    `json:"environment"`
+	SourceImage string    `json:"source_image"`
+	TargetImage string    `json:"target_image"`
+	Digest      string    `json:"digest"`
+	SourceRunID int64     `json:"source_run_id"`
+	DeployRunID int64     `json:"deploy_run_id"`
+	PromotedBy  string    `json:"promoted_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreatePromotion records a promotion and returns its ID.
+func (s *Store) CreatePromotion(p Promotion) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO promotions (app_id, environment, source_image, target_image, digest, source_run_id, deploy_run_id, promoted_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.AppID, p.Environment, p.SourceImage, p.TargetImage, p.Digest, p.SourceRunID, p.DeployRunID, p.PromotedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+const promotionColumns = `id, app_id, environment, source_image, target_image, digest, source_run_id, deploy_run_id, promoted_by, created_at`
+
+func scanPromotion(row interface{ Scan(...interface{}) error }) (Promotion, error) {
+	var p Promotion
+	err := row.Scan(&p.ID, &p.AppID, &p.Environment, &p.SourceImage, &p.TargetImage, &p.Digest, &p.SourceRunID, &p.DeployRunID, &p.PromotedBy, &p.CreatedAt)
+	return p, err
+}
+
+// LatestPromotion returns the most recent promotion of the app to environment, or nil.
+func (s *Store) LatestPromotion(appID, environment string) (*Promotion, error) {
+	p, err := scanPromotion(s.db.QueryRow(`SELECT `+promotionColumns+` FROM promotions WHERE app_id = ? AND environment = ? ORDER BY id DESC LIMIT 1`, appID, environment))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ListPromotions returns the app's promotions, newest first.
+func (s *Store) ListPromotions(appID string, limit int) ([]Promotion, error) {
+	rows, err := s.db.Query(`SELECT `+promotionColumns+` FROM promotions WHERE app_id = ? ORDER BY id DESC LIMIT ?`, appID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Promotion, 0)
+	for rows.Next() {
+		p, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// DeleteAppPromotions removes the promotion history of an app.
+func (s *Store) DeleteAppPromotions(appID string) error {
+	_, err := s.db.Exec(`DELETE FROM promotions WHERE app_id = ?`, appID)
+	return err
+}
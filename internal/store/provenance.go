@@ -0,0 +1,131 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RunDigest records an image digest a run built or deployed. Environment is the app's
+// environment at the time (empty when it has none); ReplacedDigest is set on a built record
+// whose image:tag pointed to another digest before, i.e. the tag was pushed again.
+type RunDigest struct {
+	ID             int64     `json:"id"`
+	RunID          int64     `json:"run_id"`
+	AppID          string    `json:"app_id"`
+	Kind           string    `json:"kind"`
+	Image          string    `json:"image"`
+	Tag            string    `json:"tag,omitempty"`
+	Digest         string    `json:"digest"`
+	Step           string    `json:"step,omitempty"`
+	Environment    string    `json:"environment,omitempty"`
+	ReplacedDigest string    `json:"replaced_digest,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// AddRunDigests records the image digests of a run.
+func (s *Store) AddRunDigests(digests []RunDigest) error {
+	for _, d := range digests {
+		_, err := s.db.Exec(`INSERT INTO run_digests (run_id, app_id, kind, image, tag, digest, step, environment, replaced_digest) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			d.RunID, d.AppID, d.Kind, d.Image, d.Tag, d.Digest, d.Step, d.Environment, d.ReplacedDigest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const runDigestColumns = `id, run_id, app_id, kind, image, tag, digest, step, environment, replaced_digest, created_at`
+
+func (s *Store) queryRunDigests(query string, args ...interface{}) ([]RunDigest, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunDigest, 0)
+	for rows.Next() {
+		var d RunDigest
+		if err := rows.Scan(&d.ID, &d.RunID, &d.AppID, &d.Kind, &d.Image, &d.Tag, &d.Digest, &d.Step, &d.Environment, &d.ReplacedDigest, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// ListRunDigests returns the image digests of a run in the order they were recorded.
+func (s *Store) ListRunDigests(runID int64) ([]RunDigest, error) {
+	return s.queryRunDigests(`SELECT `+runDigestColumns+` FROM run_digests WHERE run_id = ? ORDER BY id`, runID)
+}
+
+// ListDigestRecords returns the runs' records of digest, newest first. appIDs restricts the
+// apps (nil = all).
+func (s *Store) ListDigestRecords(digest string, appIDs []string) ([]RunDigest, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []RunDigest{}, nil
+	}
+	query, args := `SELECT `+runDigestColumns+` FROM run_digests WHERE digest = ?`, []interface{}{digest}
+	if appIDs != nil {
+		placeholders, appArgs := inPlaceholders(appIDs)
+		query += ` AND app_id IN (` + placeholders + `)`
+		args = append(args, appArgs...)
+	}
+	return s.queryRunDigests(query+` ORDER BY id DESC`, args...)
+}
+
+// CurrentDeployments returns the latest deployed record per app, environment, and image, i.e.
+// what each app last deployed where, ordered by app, environment, and image. appIDs restricts
+// the apps (nil = all).
+func (s *Store) CurrentDeployments(appIDs []string) ([]RunDigest, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []RunDigest{}, nil
+	}
+	filter, args := "", []interface{}(nil)
+	if appIDs != nil {
+		var placeholders string
+		placeholders, args = inPlaceholders(appIDs)
+		filter = ` AND app_id IN (` + placeholders + `)`
+	}
+	return s.queryRunDigests(`SELECT `+runDigestColumns+` FROM run_digests WHERE id IN (
+		SELECT MAX(id) FROM run_digests WHERE kind = 'deployed'`+filter+` GROUP BY app_id, environment, image
+	) ORDER BY app_id, environment, image`, args...)
+}
+
+// LatestTagDigest returns the digest image:tag was last recorded as built with, or "" when it
+// never was.
+func (s *Store) LatestTagDigest(image, tag string) (string, error) {
+	var digest string
+	err := s.db.QueryRow(`SELECT digest FROM run_digests WHERE kind = 'built' AND image = ? AND tag = ? ORDER BY id DESC LIMIT 1`, image, tag).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return digest, err
+}
+
+// PromotionsByDigest returns the promotions of digest, newest first. appIDs restricts the apps
+// (nil = all).
+func (s *Store) PromotionsByDigest(digest string, appIDs []string) ([]Promotion, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []Promotion{}, nil
+	}
+	query, args := `SELECT `+promotionColumns+` FROM promotions WHERE digest = ?`, []interface{}{digest}
+	if appIDs != nil {
+		placeholders, appArgs := inPlaceholders(appIDs)
+		query += ` AND app_id IN (` + placeholders + `)`
+		args = append(args, appArgs...)
+	}
+	rows, err := s.db.Query(query+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Promotion, 0)
+	for rows.Next() {
+		p, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Quota scopes.
+const (
+	QuotaScopeApp   = "app"
+	QuotaScopeGroup = "group"
+)
+
+// Quota limits run usage for one app (scope "app", ScopeID = app ID) or for all apps
+// of one group combined (scope "group", ScopeID = group ID). Zero means unlimited.
+type Quota struct {
+	ID                int64  `json:"id"`
+	Scope             string `json:"scope"`
+	ScopeID           string `json:"scope_id"`
+	MaxRunsPerDay     int    `json:"max_runs_per_day"`
+	MaxRunDurationSec int    `json:"max_run_duration_sec"`
+	MaxConcurrentRuns int    `json:"max_concurrent_runs"`
+}
+
+// SetQuota creates or replaces the quota for q.Scope/q.ScopeID and returns its ID.
+func (s *Store) SetQuota(q Quota) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`SELECT id FROM quotas WHERE scope = ? AND scope_id = ?`, q.Scope, q.ScopeID).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		res, err := tx.Exec(`INSERT INTO quotas (scope, scope_id, max_runs_per_day, max_run_duration_sec, max_concurrent_runs) VALUES (?, ?, ?, ?, ?)`,
+			q.Scope, q.ScopeID, q.MaxRunsPerDay, q.MaxRunDurationSec, q.MaxConcurrentRuns)
+		if err != nil {
+			return 0, err
+		}
+		id, err = res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+	case err != nil:
+		return 0, err
+	default:
+		if _, err := tx.Exec(`UPDATE quotas SET max_runs_per_day = ?, max_run_duration_sec = ?, max_concurrent_runs = ? WHERE id = ?`,
+			q.MaxRunsPerDay, q.MaxRunDurationSec, q.MaxConcurrentRuns, id); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// ListQuotas returns all quotas.
+func (s *Store) ListQuotas() ([]Quota, error) {
+	rows, err := s.db.Query(`SELECT id, scope, scope_id, max_runs_per_day, max_run_duration_sec, max_concurrent_runs FROM quotas ORDER BY scope, scope_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotas := make([]Quota, 0)
+	for rows.Next() {
+		var q Quota
+		if err := rows.Scan(&q.ID, &q.Scope, &q.ScopeID, &q.MaxRunsPerDay, &q.MaxRunDurationSec, &q.MaxConcurrentRuns); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, rows.Err()
+}
+
+// DeleteQuota deletes one quota by ID.
+func (s *Store) DeleteQuota(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM quotas WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CountRunsSince returns the number of runs started within the last d for the given apps.
+func (s *Store) CountRunsSince(appIDs []string, d time.Duration) (int64, error) {
+	if len(appIDs) == 0 {
+		return 0, nil
+	}
+	placeholders, args := inPlaceholders(appIDs)
+	var count int64
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM runs WHERE app_id IN (%s) AND started_at >= %s`, placeholders, s.agoExpr(d))
+	err := s.db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
+
+// CountActiveRuns returns the number of pending or running runs for the given apps.
+func (s *Store) CountActiveRuns(appIDs []string) (int64, error) {
+	if len(appIDs) == 0 {
+		return 0, nil
+	}
+	placeholders, args := inPlaceholders(appIDs)
+	var count int64
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM runs WHERE app_id IN (%s) AND status IN ('pending', 'running')`, placeholders)
+	err := s.db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Registry holds credentials for a container/OCI registry that runs log in to (docker, helm).
+type Registry struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Username  string    `json:"username"`
+	Token     string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateRegistry inserts a registry and returns the generated ID.
+func (s *Store) CreateRegistry(reg Registry) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO registries (name, url, username, token) VALUES (?, ?, ?, ?)`, reg.Name, reg.URL, reg.Username, reg.Token)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListRegistries returns registries ordered by name, without tokens.
+func (s *Store) ListRegistries() ([]Registry, error) {
+	rows, err := s.db.Query(`SELECT id, name, url, username, created_at FROM registries ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Registry, 0)
+	for rows.Next() {
+		var reg Registry
+		if err := rows.Scan(&reg.ID, &reg.Name, &reg.URL, &reg.Username, &reg.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, reg)
+	}
+	return out, rows.Err()
+}
+
+// GetRegistry returns a registry by ID (including token), or nil if it does not exist.
+func (s *Store) GetRegistry(id int64) (*Registry, error) {
+	return s.getRegistry(`id = ?`, id)
+}
+
+// GetRegistryByName returns a registry by name (including token), or nil if it does not exist.
+func (s *Store) GetRegistryByName(name string) (*Registry, error) {
+	return s.getRegistry(`name = ?`, name)
+}
+
+func (s *Store) getRegistry(where string, arg interface{}) (*Registry, error) {
+	var reg Registry
+	err := s.db.QueryRow(`SELECT id, name, url, username, token, created_at FROM registries WHERE `+where, arg).
+		Scan(&reg.ID, &reg.Name, &reg.URL, &reg.Username, &reg.Token, &reg.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reg, nil
+}
+
+// UpdateRegistry updates URL, username and token of a registry. Its name cannot change, as apps reference it.
+func (s *Store) UpdateRegistry(reg Registry) error {
+	res, err := s.db.Exec(`UPDATE registries SET url = ?, username = ?, token = ? WHERE id = ?`, reg.URL, reg.Username, reg.Token, reg.ID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// DeleteRegistry deletes one registry by ID.
+func (s *Store) DeleteRegistry(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM registries WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
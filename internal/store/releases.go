@@ -0,0 +1,220 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Release is a business-level release ("2.3.1" to production) and the runs that delivered it.
+// Status aggregates the runs: running or pending while one of them is, failed when one did not
+// succeed, success when all did, and "" without runs. Runs carry no log.
+type Release struct {
+	ID          int64     `json:"id"`
+	Version     string    `json:"version"`
+	Environment string    `json:"environment"`
+	Changelog   string    `json:"changelog"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Status      string    `json:"status"`
+	Runs        []Run     `json:"runs"`
+}
+
+// releaseStatus aggregates the statuses of a release's runs.
+func releaseStatus(runs []Run) string {
+	if len(runs) == 0 {
+		return ""
+	}
+	status := "success"
+	for _, r := range runs {
+		switch {
+		case r.Status == "running" || r.Status == "pending":
+			return r.Status
+		case r.Status != "success":
+			status = "failed"
+		}
+	}
+	return status
+}
+
+// CreateRelease records a release with its runs and returns its ID.
+func (s *Store) CreateRelease(rel Release, runIDs []int64) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(fmt.Sprintf(`INSERT INTO releases (version, environment, changelog, created_by, created_at, updated_at) VALUES (?, ?, ?, ?, %s, %s)`, s.nowExpr(), s.nowExpr()),
+		rel.Version, rel.Environment, rel.Changelog, rel.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := insertReleaseRuns(tx, id, runIDs); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// UpdateRelease replaces the version, environment, changelog, and runs of a release. Returns
+// sql.ErrNoRows if it does not exist.
+func (s *Store) UpdateRelease(rel Release, runIDs []int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM releases WHERE id = ?`, rel.ID).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`UPDATE releases SET version = ?, environment = ?, changelog = ?, updated_at = %s WHERE id = ?`, s.nowExpr()),
+		rel.Version, rel.Environment, rel.Changelog, rel.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM release_runs WHERE release_id = ?`, rel.ID); err != nil {
+		return err
+	}
+	if err := insertReleaseRuns(tx, rel.ID, runIDs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertReleaseRuns(tx *sql.Tx, releaseID int64, runIDs []int64) error {
+	for _, runID := range runIDs {
+		if _, err := tx.Exec(`INSERT INTO release_runs (release_id, run_id) VALUES (?, ?)`, releaseID, runID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRelease deletes a release; its runs are kept. Returns sql.ErrNoRows if it does not exist.
+func (s *Store) DeleteRelease(id int64) error {
+	if _, err := s.db.Exec(`DELETE FROM release_runs WHERE release_id = ?`, id); err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`DELETE FROM releases WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+const releaseColumns = `id, version, environment, changelog, created_by, created_at, updated_at`
+
+func scanRelease(row interface{ Scan(...interface{}) error }) (Release, error) {
+	var rel Release
+	err := row.Scan(&rel.ID, &rel.Version, &rel.Environment, &rel.Changelog, &rel.CreatedBy, &rel.CreatedAt, &rel.UpdatedAt)
+	return rel, err
+}
+
+// GetRelease returns a release with its runs, or nil.
+func (s *Store) GetRelease(id int64) (*Release, error) {
+	rel, err := scanRelease(s.db.QueryRow(`SELECT `+releaseColumns+` FROM releases WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	releases := []Release{rel}
+	if err := s.loadReleaseRuns(releases); err != nil {
+		return nil, err
+	}
+	return &releases[0], nil
+}
+
+// ReleaseIDByVersion returns the ID of the release of version to environment, or 0.
+func (s *Store) ReleaseIDByVersion(version, environment string) (int64, error) {
+	var id int64
+	err := s.db.QueryRow(`SELECT id FROM releases WHERE version = ? AND environment = ?`, version, environment).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// ListReleases returns releases with their runs, newest first. environment filters when not "".
+func (s *Store) ListReleases(environment string, limit, offset int) ([]Release, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	where, args := "", []interface{}{}
+	if environment != "" {
+		where, args = ` WHERE environment = ?`, append(args, environment)
+	}
+	rows, err := s.db.Query(`SELECT `+releaseColumns+` FROM releases`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	releases := make([]Release, 0)
+	for rows.Next() {
+		rel, err := scanRelease(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		releases = append(releases, rel)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return releases, s.loadReleaseRuns(releases)
+}
+
+// loadReleaseRuns fills the runs (not soft-deleted, oldest first) and status of releases.
+func (s *Store) loadReleaseRuns(releases []Release) error {
+	if len(releases) == 0 {
+		return nil
+	}
+	index := make(map[int64]int, len(releases))
+	args := make([]interface{}, 0, len(releases))
+	for i := range releases {
+		releases[i].Runs = make([]Run, 0)
+		index[releases[i].ID] = i
+		args = append(args, releases[i].ID)
+	}
+	placeholders := strings.TrimRight(strings.Repeat("?,", len(args)), ",")
+	rows, err := s.db.Query(`
+		SELECT rr.release_id, r.id, r.app_id, COALESCE(r.triggered_by,''), r.status, COALESCE(r.commit_sha,''), r.started_at, r.ended_at, COALESCE(r.slow,0), COALESCE(r.failure_reason,'')
+		FROM release_runs rr JOIN runs r ON r.id = rr.run_id
+		WHERE rr.release_id IN (`+placeholders+`) AND r.deleted_at IS NULL ORDER BY r.id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var releaseID int64
+		var r Run
+		var endedAt sql.NullTime
+		if err := rows.Scan(&releaseID, &r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason); err != nil {
+			return err
+		}
+		if endedAt.Valid {
+			r.EndedAt = &endedAt.Time
+		}
+		i := index[releaseID]
+		releases[i].Runs = append(releases[i].Runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range releases {
+		releases[i].Status = releaseStatus(releases[i].Runs)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AppRunUsage sums up the runs of an app over a period. BuildSeconds is the wall-clock time of
+// the runs that have ended.
+type AppRunUsage struct {
+	AppID        string  `json:"app_id"`
+	Runs         int64   `json:"runs"`
+	Succeeded    int64   `json:"succeeded"`
+	Failed       int64   `json:"failed"`
+	BuildSeconds float64 `json:"build_seconds"`
+}
+
+// RunUsageByApp sums up the runs started within the last d that are not soft-deleted, per app,
+// ordered by app ID. appIDs restricts the apps (nil = all).
+func (s *Store) RunUsageByApp(appIDs []string, d time.Duration) ([]AppRunUsage, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []AppRunUsage{}, nil
+	}
+	filter, args := "", []interface{}(nil)
+	if appIDs != nil {
+		var placeholders string
+		placeholders, args = inPlaceholders(appIDs)
+		filter = " AND app_id IN (" + placeholders + ")"
+	}
+	// Durations are summed here rather than in SQL: SQLite and MySQL share no date arithmetic.
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT app_id, status, started_at, ended_at FROM runs
+		WHERE deleted_at IS NULL AND started_at >= %s%s
+		ORDER BY app_id
+	`, s.agoExpr(d), filter), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]AppRunUsage, 0)
+	for rows.Next() {
+		var appID, status string
+		var startedAt time.Time
+		var endedAt sql.NullTime
+		if err := rows.Scan(&appID, &status, &startedAt, &endedAt); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 || out[len(out)-1].AppID != appID {
+			out = append(out, AppRunUsage{AppID: appID})
+		}
+		u := &out[len(out)-1]
+		u.Runs++
+		switch status {
+		case "success":
+			u.Succeeded++
+		case "failed":
+			u.Failed++
+		}
+		if endedAt.Valid && endedAt.Time.After(startedAt) {
+			u.BuildSeconds += endedAt.Time.Sub(startedAt).Seconds()
+		}
+	}
+	return out, rows.Err()
+}
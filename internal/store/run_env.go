@@ -0,0 +1,43 @@
+package store
+
+// RunEnvVar is a one-off env var passed when a run was triggered and applied to that run only.
+type RunEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// SetRunEnv records the env overrides of a run.
+func (s *Store) SetRunEnv(runID int64, env map[string]string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM run_env WHERE run_id = ?`, runID); err != nil {
+		return err
+	}
+	for name, value := range env {
+		if _, err := tx.Exec(`INSERT INTO run_env (run_id, name, value) VALUES (?, ?, ?)`, runID, name, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListRunEnv returns the env overrides of a run ordered by name.
+func (s *Store) ListRunEnv(runID int64) ([]RunEnvVar, error) {
+	rows, err := s.db.Query(`SELECT name, value FROM run_env WHERE run_id = ? ORDER BY name`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunEnvVar, 0)
+	for rows.Next() {
+		var v RunEnvVar
+		if err := rows.Scan(&v.Name, &v.Value); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// CommitGroup is the runs of one app for one commit (retries and repeated triggers), newest
+// first. Runs without a commit form a group of their own. Status is "running" or "pending" while
+// one of the runs is, else the status of the newest run. Runs carry no log.
+type CommitGroup struct {
+	AppID     string         `json:"app_id"`
+	CommitSHA string         `json:"commit_sha,omitempty"`
+	Status    string         `json:"status"`
+	Count     int            `json:"count"`
+	Statuses  map[string]int `json:"statuses"`
+	Runs      []Run          `json:"runs"`
+}
+
+// commitGroupKey groups runs by app and commit; runs without a commit stay alone.
+const commitGroupKey = `app_id, COALESCE(commit_sha,''), CASE WHEN COALESCE(commit_sha,'') = '' THEN id ELSE 0 END`
+
+// commitGroupFilter restricts groups to appIDs; nil means all apps.
+func commitGroupFilter(appIDs []string) (string, []interface{}) {
+	if appIDs == nil {
+		return "", nil
+	}
+	placeholders, args := inPlaceholders(appIDs)
+	return " AND app_id IN (" + placeholders + ")", args
+}
+
+// ListCommitGroups returns the runs that are not soft-deleted grouped by app and commit, the group
+// with the newest run first, with limit and offset counting groups. appIDs restricts the apps (nil = all).
+func (s *Store) ListCommitGroups(appIDs []string, limit, offset int) ([]CommitGroup, error) {
+	groups := make([]CommitGroup, 0)
+	if appIDs != nil && len(appIDs) == 0 {
+		return groups, nil
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	filter, args := commitGroupFilter(appIDs)
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT app_id, COALESCE(commit_sha,''), MAX(id) FROM runs WHERE deleted_at IS NULL%s
+		GROUP BY %s ORDER BY MAX(id) DESC LIMIT ? OFFSET ?`, filter, commitGroupKey), append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	var latest []int64
+	for rows.Next() {
+		var g CommitGroup
+		var id int64
+		if err := rows.Scan(&g.AppID, &g.CommitSHA, &id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, g)
+		latest = append(latest, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		g := &groups[i]
+		where, arg := `app_id = ? AND commit_sha = ?`, []interface{}{g.AppID, g.CommitSHA}
+		if g.CommitSHA == "" {
+			where, arg = `id = ?`, []interface{}{latest[i]}
+		}
+		if g.Runs, err = s.listGroupRuns(where, arg...); err != nil {
+			return nil, err
+		}
+		g.Count = len(g.Runs)
+		g.Statuses = make(map[string]int)
+		for _, r := range g.Runs {
+			g.Statuses[r.Status]++
+		}
+		switch {
+		case g.Statuses["running"] > 0:
+			g.Status = "running"
+		case g.Statuses["pending"] > 0:
+			g.Status = "pending"
+		case len(g.Runs) > 0:
+			g.Status = g.Runs[0].Status
+		}
+	}
+	return groups, nil
+}
+
+// CountCommitGroups returns the number of groups ListCommitGroups pages through.
+func (s *Store) CountCommitGroups(appIDs []string) (int64, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return 0, nil
+	}
+	filter, args := commitGroupFilter(appIDs)
+	var count int64
+	err := s.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM (SELECT 1 FROM runs WHERE deleted_at IS NULL%s GROUP BY %s) g`, filter, commitGroupKey), args...).Scan(&count)
+	return count, err
+}
+
+func (s *Store) listGroupRuns(where string, args ...interface{}) ([]Run, error) {
+	rows, err := s.db.Query(`SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), started_at, ended_at, COALESCE(slow,0), COALESCE(failure_reason,'')
+		FROM runs WHERE deleted_at IS NULL AND `+where+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var r Run
+		var endedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			r.EndedAt = &endedAt.Time
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
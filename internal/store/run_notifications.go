@@ -0,0 +1,40 @@
+package store
+
+import "time"
+
+// RunNotification is a notification sent about a run, kept for its timeline.
+type RunNotification struct {
+	ID        int64     `json:"id"`
+	RunID     int64     `json:"run_id"`
+	Event     string    `json:"event"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateRunNotification records a notification sent at t and returns its ID.
+func (s *Store) CreateRunNotification(runID int64, event, message string, t time.Time) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO run_notifications (run_id, event, message, created_at) VALUES (?, ?, ?, ?)`,
+		runID, event, message, t.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListRunNotifications returns the notifications sent about a run, oldest first.
+func (s *Store) ListRunNotifications(runID int64) ([]RunNotification, error) {
+	rows, err := s.db.Query(`SELECT id, run_id, event, message, created_at FROM run_notifications WHERE run_id = ? ORDER BY created_at, id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunNotification, 0)
+	for rows.Next() {
+		var n RunNotification
+		if err := rows.Scan(&n.ID, &n.RunID, &n.Event, &n.Message, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
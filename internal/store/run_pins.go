@@ -0,0 +1,88 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// PinRun pins a run so that it is kept when its app is deleted and cannot be soft-deleted or
+// purged; pinning again updates the note. Returns sql.ErrNoRows if the run does not exist or is
+// deleted.
+func (s *Store) PinRun(id int64, pinnedBy, note string) error {
+	query := fmt.Sprintf(`UPDATE runs SET pinned_at = COALESCE(pinned_at, %s), pinned_by = ?, pin_note = ? WHERE id = ? AND deleted_at IS NULL`, s.nowExpr())
+	res, err := s.db.Exec(query, pinnedBy, note, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// UnpinRun clears the pin of a run. Returns sql.ErrNoRows if the run does not exist or is not pinned.
+func (s *Store) UnpinRun(id int64) error {
+	res, err := s.db.Exec(`UPDATE runs SET pinned_at = NULL, pinned_by = NULL, pin_note = '' WHERE id = ? AND pinned_at IS NOT NULL`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// ListPinnedRuns returns pinned runs of the given apps (of all apps when appIDs is nil), most
+// recently started first.
+func (s *Store) ListPinnedRuns(appIDs []string, limit, offset int) ([]Run, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []Run{}, nil
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	where, args := pinnedRunsWhere(appIDs)
+	rows, err := s.db.Query(`
+		SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), started_at, ended_at, COALESCE(slow,0), COALESCE(failure_reason,''),
+			pinned_at, COALESCE(pinned_by,''), COALESCE(pin_note,'')
+		FROM runs WHERE `+where+` ORDER BY started_at DESC LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var r Run
+		var endedAt, pinnedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason,
+			&pinnedAt, &r.PinnedBy, &r.PinNote); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			r.EndedAt = &endedAt.Time
+		}
+		if pinnedAt.Valid {
+			r.PinnedAt = &pinnedAt.Time
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// CountPinnedRuns returns the number of pinned runs of the given apps (of all apps when appIDs is nil).
+func (s *Store) CountPinnedRuns(appIDs []string) (int64, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return 0, nil
+	}
+	where, args := pinnedRunsWhere(appIDs)
+	var count int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM runs WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
+func pinnedRunsWhere(appIDs []string) (string, []interface{}) {
+	where := `pinned_at IS NOT NULL AND deleted_at IS NULL`
+	if appIDs == nil {
+		return where, nil
+	}
+	placeholders, args := inPlaceholders(appIDs)
+	return where + ` AND app_id IN (` + placeholders + `)`, args
+}
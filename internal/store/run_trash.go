@@ -0,0 +1,98 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SoftDeleteRun hides a run from listings by setting deleted_at; the run and its log are kept
+// until purged. Returns sql.ErrNoRows if the run does not exist, is already deleted, or is pinned.
+func (s *Store) SoftDeleteRun(id int64, deletedBy string) error {
+	query := fmt.Sprintf(`UPDATE runs SET deleted_at = %s, deleted_by = ? WHERE id = ? AND deleted_at IS NULL AND pinned_at IS NULL`, s.nowExpr())
+	res, err := s.db.Exec(query, deletedBy, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// RestoreRun clears the soft-delete of a run. Returns sql.ErrNoRows if the run does not exist or is not deleted.
+func (s *Store) RestoreRun(id int64) error {
+	res, err := s.db.Exec(`UPDATE runs SET deleted_at = NULL, deleted_by = NULL WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// ListDeletedRuns returns soft-deleted runs, most recently deleted first.
+func (s *Store) ListDeletedRuns(limit, offset int) ([]Run, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := s.db.Query(`
+		SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at, deleted_at, COALESCE(deleted_by,''), COALESCE(slow,0), COALESCE(failure_reason,'')
+		FROM runs WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var r Run
+		var endedAt, deletedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.Log, &r.StartedAt, &endedAt, &deletedAt, &r.DeletedBy, &r.Slow, &r.FailureReason); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			r.EndedAt = &endedAt.Time
+		}
+		if deletedAt.Valid {
+			r.DeletedAt = &deletedAt.Time
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// CountDeletedRuns returns the number of soft-deleted runs.
+func (s *Store) CountDeletedRuns() (int64, error) {
+	var count int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM runs WHERE deleted_at IS NOT NULL`).Scan(&count)
+	return count, err
+}
+
+// PurgeDeletedRuns permanently deletes unpinned runs soft-deleted more than olderThan ago and
+// returns how many were removed.
+func (s *Store) PurgeDeletedRuns(olderThan time.Duration) (int64, error) {
+	cond := s.purgeableRunsCond(olderThan)
+	if err := s.deleteRunDetails(cond); err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(`DELETE FROM runs WHERE ` + cond)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// purgeableRunsCond matches the runs PurgeDeletedRuns(olderThan) removes.
+func (s *Store) purgeableRunsCond(olderThan time.Duration) string {
+	return fmt.Sprintf(`deleted_at IS NOT NULL AND deleted_at <= %s AND pinned_at IS NULL`, s.agoExpr(olderThan))
+}
+
+func requireAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Log search backends selected by setupLogSearch.
+const (
+	logSearchFTS5     = "fts5"     // SQLite built with FTS5 (go build -tags sqlite_fts5)
+	logSearchFulltext = "fulltext" // MySQL FULLTEXT index on runs.log
+	logSearchLike     = "like"     // fallback: LIKE scan
+)
+
+// RunSearchHit is a run matched by SearchRuns. Matched is "commit_sha", "triggered_by",
+// "commit_message", or "log";
+// Snippet holds a short excerpt around the match for log hits.
+type RunSearchHit struct {
+	ID            int64     `json:"run_id"`
+	AppID         string    `json:"app_id"`
+	Status        string    `json:"status"`
+	CommitSHA     string    `json:"commit_sha,omitempty"`
+	CommitMessage string    `json:"commit_message,omitempty"`
+	TriggeredBy   string    `json:"triggered_by,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	Matched       string    `json:"matched"`
+	Snippet       string    `json:"snippet,omitempty"`
+}
+
+// setupLogSearch prepares full-text indexing of run logs and returns the backend to use.
+// SQLite uses an external-content FTS5 table kept in sync by triggers when the driver was built
+// with FTS5; MySQL uses a FULLTEXT index. Otherwise searches fall back to LIKE.
+func setupLogSearch(db *sql.DB, driver string) string {
+	if driver == "mysql" {
+		_, _ = db.Exec(`ALTER TABLE runs ADD FULLTEXT INDEX ft_runs_log (log)`)
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'runs' AND index_name = 'ft_runs_log'`).Scan(&n)
+		if err == nil && n > 0 {
+			return logSearchFulltext
+		}
+		return logSearchLike
+	}
+	var triggers int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name IN ('runs_fts_ai', 'runs_fts_ad', 'runs_fts_au')`).Scan(&triggers); err != nil {
+		return logSearchLike
+	}
+	if _, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS runs_fts USING fts5(log, content='runs', content_rowid='id')`); err != nil {
+		// Without FTS5 the sync triggers (left by an FTS5 build) would make every write to runs fail.
+		_, _ = db.Exec(`DROP TRIGGER IF EXISTS runs_fts_ai; DROP TRIGGER IF EXISTS runs_fts_ad; DROP TRIGGER IF EXISTS runs_fts_au;`)
+		return logSearchLike
+	}
+	_, err := db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS runs_fts_ai AFTER INSERT ON runs BEGIN
+			INSERT INTO runs_fts(rowid, log) VALUES (new.id, COALESCE(new.log, ''));
+		END;
+		CREATE TRIGGER IF NOT EXISTS runs_fts_ad AFTER DELETE ON runs BEGIN
+			INSERT INTO runs_fts(runs_fts, rowid, log) VALUES ('delete', old.id, COALESCE(old.log, ''));
+		END;
+		CREATE TRIGGER IF NOT EXISTS runs_fts_au AFTER UPDATE OF log ON runs BEGIN
+			INSERT INTO runs_fts(runs_fts, rowid, log) VALUES ('delete', old.id, COALESCE(old.log, ''));
+			INSERT INTO runs_fts(rowid, log) VALUES (new.id, COALESCE(new.log, ''));
+		END;
+	`)
+	if err != nil {
+		return logSearchLike
+	}
+	if triggers < 3 {
+		// New index, or runs changed while the triggers were missing.
+		if _, err := db.Exec(`INSERT INTO runs_fts(runs_fts) VALUES ('rebuild')`); err != nil {
+			return logSearchLike
+		}
+	}
+	return logSearchFTS5
+}
+
+// SearchRuns finds runs (not soft-deleted) whose commit SHA starts with q or whose triggered_by
+// or commit subject contains q; when includeLog is set, runs whose log contains q are added after those.
+// appIDs nil searches all apps; a non-nil empty slice matches nothing. Results are newest first.
+func (s *Store) SearchRuns(q string, appIDs []string, includeLog bool, limit int) ([]RunSearchHit, error) {
+	q = strings.TrimSpace(q)
+	if q == "" || (appIDs != nil && len(appIDs) == 0) {
+		return []RunSearchHit{}, nil
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+	appFilter, appArgs := "", []interface{}(nil)
+	if appIDs != nil {
+		placeholders, args := inPlaceholders(appIDs)
+		appFilter = fmt.Sprintf(" AND r.app_id IN (%s)", placeholders)
+		appArgs = args
+	}
+
+	args := []interface{}{likePrefix(q), likeContains(q), likeContains(q)}
+	args = append(args, appArgs...)
+	args = append(args, limit)
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT r.id, r.app_id, r.status, COALESCE(r.commit_sha,''), COALESCE(r.commit_message,''), COALESCE(r.triggered_by,''), r.started_at
+		FROM runs r
+		WHERE r.deleted_at IS NULL AND (r.commit_sha LIKE ? ESCAPE '!' OR r.triggered_by LIKE ? ESCAPE '!' OR r.commit_message LIKE ? ESCAPE '!')%s
+		ORDER BY r.started_at DESC LIMIT ?
+	`, appFilter), args...)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]RunSearchHit, 0)
+	seen := make(map[int64]struct{})
+	lower := strings.ToLower(q)
+	for rows.Next() {
+		var h RunSearchHit
+		if err := rows.Scan(&h.ID, &h.AppID, &h.Status, &h.CommitSHA, &h.CommitMessage, &h.TriggeredBy, &h.StartedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(strings.ToLower(h.CommitSHA), lower):
+			h.Matched = "commit_sha"
+		case strings.Contains(strings.ToLower(h.TriggeredBy), lower):
+			h.Matched = "triggered_by"
+		default:
+			h.Matched = "commit_message"
+		}
+		seen[h.ID] = struct{}{}
+		hits = append(hits, h)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if !includeLog || len(hits) >= limit {
+		return hits, nil
+	}
+
+	var logQuery string
+	var logArgs []interface{}
+	switch s.logSearch {
+	case logSearchFTS5:
+		logQuery = `FROM runs_fts JOIN runs r ON r.id = runs_fts.rowid WHERE runs_fts MATCH ?`
+		logArgs = []interface{}{ftsPhrase(q)}
+	case logSearchFulltext:
+		logQuery = `FROM runs r WHERE MATCH(r.log) AGAINST(? IN BOOLEAN MODE)`
+		logArgs = []interface{}{ftsPhrase(q)}
+	default:
+		logQuery = `FROM runs r WHERE r.log LIKE ? ESCAPE '!'`
+		logArgs = []interface{}{likeContains(q)}
+	}
+	logArgs = append(logArgs, appArgs...)
+	logArgs = append(logArgs, limit)
+	rows, err = s.db.Query(fmt.Sprintf(`
+		SELECT r.id, r.app_id, r.status, COALESCE(r.commit_sha,''), COALESCE(r.commit_message,''), COALESCE(r.triggered_by,''), r.started_at, COALESCE(r.log,'')
+		%s AND r.deleted_at IS NULL%s
+		ORDER BY r.started_at DESC LIMIT ?
+	`, logQuery, appFilter), logArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() && len(hits) < limit {
+		var h RunSearchHit
+		var log string
+		if err := rows.Scan(&h.ID, &h.AppID, &h.Status, &h.CommitSHA, &h.CommitMessage, &h.TriggeredBy, &h.StartedAt, &log); err != nil {
+			return nil, err
+		}
+		if _, ok := seen[h.ID]; ok {
+			continue
+		}
+		h.Matched = "log"
+		h.Snippet = logSnippet(log, q)
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// logSnippet returns the line of log containing q (case-insensitive), trimmed to about 160 characters.
+func logSnippet(log, q string) string {
+	idx := strings.Index(strings.ToLower(log), strings.ToLower(q))
+	if idx < 0 {
+		return ""
+	}
+	start := strings.LastIndex(log[:idx], "\n") + 1
+	end := len(log)
+	if n := strings.Index(log[idx:], "\n"); n >= 0 {
+		end = idx + n
+	}
+	const max = 160
+	if end-start > max {
+		start = idx - max/2
+		if start < 0 {
+			start = 0
+		}
+		if end > start+max {
+			end = start + max
+		}
+	}
+	return strings.TrimSpace(log[start:end])
+}
+
+func escapeLike(q string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(q)
+}
+
+func likePrefix(q string) string { return escapeLike(q) + "%" }
+
+func likeContains(q string) string { return "%" + escapeLike(q) + "%" }
+
+// ftsPhrase quotes q as a single phrase for FTS5 MATCH / MySQL boolean mode.
+// Embedded double quotes are dropped since the two dialects escape them differently.
+func ftsPhrase(q string) string {
+	return `"` + strings.ReplaceAll(q, `"`, " ") + `"`
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session is a signed-in browser session, shared by all server replicas. Only the SHA-256 hash
+// of the cookie token is stored; the user fields are a snapshot taken at sign-in.
+type Session struct {
+	TokenHash string
+	UserID    int64
+	Username  string
+	IsAdmin   bool
+	ExpiresAt time.Time
+}
+
+// CreateSession stores a session.
+func (s *Store) CreateSession(sess Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (token_hash, user_id, username, is_admin, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		sess.TokenHash, sess.UserID, sess.Username, sess.IsAdmin, sess.ExpiresAt.UTC())
+	return err
+}
+
+// GetSession returns the session with the given token hash, or nil.
+func (s *Store) GetSession(tokenHash string) (*Session, error) {
+	var sess Session
+	err := s.db.QueryRow(`SELECT token_hash, user_id, username, is_admin, expires_at FROM sessions WHERE token_hash = ?`, tokenHash).
+		Scan(&sess.TokenHash, &sess.UserID, &sess.Username, &sess.IsAdmin, &sess.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// DeleteSession removes a session (sign-out, rotation, or expiry).
+func (s *Store) DeleteSession(tokenHash string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	return err
+}
+
+// DeleteUserSessions signs a user out everywhere.
+func (s *Store) DeleteUserSessions(userID int64) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+// DeleteExpiredSessions removes sessions that expired before now and returns how many.
+func (s *Store) DeleteExpiredSessions(now time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
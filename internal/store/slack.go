@@ -0,0 +1,45 @@
+package store
+
+import "database/sql"
+
+// SetSlackUser links a Slack user ID to a user, replacing earlier links of either side.
+// An empty slackUserID removes the user's link.
+func (s *Store) SetSlackUser(userID int64, slackUserID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM slack_users WHERE user_id = ? OR slack_user_id = ?`, userID, slackUserID); err != nil {
+		return err
+	}
+	if slackUserID != "" {
+		if _, err := tx.Exec(`INSERT INTO slack_users (slack_user_id, user_id) VALUES (?, ?)`, slackUserID, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SlackUserID returns the Slack user ID linked to a user, or "".
+func (s *Store) SlackUserID(userID int64) (string, error) {
+	var id string
+	err := s.db.QueryRow(`SELECT slack_user_id FROM slack_users WHERE user_id = ?`, userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, err
+}
+
+// UserBySlackID returns the user linked to a Slack user ID, or nil.
+func (s *Store) UserBySlackID(slackUserID string) (*User, error) {
+	var userID int64
+	err := s.db.QueryRow(`SELECT user_id FROM slack_users WHERE slack_user_id = ?`, slackUserID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetUser(userID)
+}
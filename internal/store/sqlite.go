@@ -0,0 +1,31 @@
+package store
+
+import (
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// pureGoSQLiteDriver is the database/sql name of modernc.org/sqlite, which needs no cgo.
+const pureGoSQLiteDriver = "sqlite"
+
+// pureGoSQLiteDSN adds the settings that make the pure-Go driver behave like go-sqlite3 on the same
+// database file: a 5s busy timeout, and times written as "2006-01-02 15:04:05.999999999-07:00" so
+// they compare correctly with datetime('now') in SQL.
+func pureGoSQLiteDSN(dsn string) string {
+	var params []string
+	if !strings.Contains(dsn, "busy_timeout") {
+		params = append(params, "_pragma=busy_timeout(5000)")
+	}
+	if !strings.Contains(dsn, "_time_format=") {
+		params = append(params, "_time_format=sqlite")
+	}
+	if len(params) == 0 {
+		return dsn
+	}
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + strings.Join(params, "&")
+}
@@ -0,0 +1,8 @@
+//go:build cgo
+
+package store
+
+import _ "github.com/mattn/go-sqlite3"
+
+// defaultSQLiteDriver is the driver of "sqlite3" databases: go-sqlite3 when built with cgo.
+const defaultSQLiteDriver = "sqlite3"
@@ -0,0 +1,7 @@
+//go:build !cgo
+
+package store
+
+// defaultSQLiteDriver is the driver of "sqlite3" databases: without cgo, go-sqlite3 is only a stub,
+// so the pure-Go driver is used.
+const defaultSQLiteDriver = pureGoSQLiteDriver
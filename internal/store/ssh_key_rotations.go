@@ -0,0 +1,63 @@
+package store
+
+import "time"
+
+// SSHKeyRotation records the replacement of an SSH key's private key. Fingerprints are SHA256
+// fingerprints of the public keys ("" when a key could not be parsed); Generated is set when the
+// server generated the new key.
+type SSHKeyRotation struct {
+	ID             int64     `json:"id"`
+	KeyID          int64     `json:"key_id"`
+	OldFingerprint string    `json:"old_fingerprint"`
+	NewFingerprint string    `json:"new_fingerprint"`
+	Generated      bool      `json:"generated"`
+	RotatedBy      string    `json:"rotated_by"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// RotateSSHKey replaces the private key of an SSH key and records r in one transaction. It
+// returns sql.ErrNoRows when the key does not exist.
+func (s *Store) RotateSSHKey(privateKey string, r SSHKeyRotation) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE ssh_keys SET private_key = ? WHERE id = ?`, privateKey, r.KeyID)
+	if err != nil {
+		return 0, err
+	}
+	if err := requireAffected(res); err != nil {
+		return 0, err
+	}
+	res, err = tx.Exec(`INSERT INTO ssh_key_rotations (key_id, old_fingerprint, new_fingerprint, generated, rotated_by) VALUES (?, ?, ?, ?, ?)`,
+		r.KeyID, r.OldFingerprint, r.NewFingerprint, r.Generated, r.RotatedBy)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// ListSSHKeyRotations returns the rotations of an SSH key, newest first.
+func (s *Store) ListSSHKeyRotations(keyID int64) ([]SSHKeyRotation, error) {
+	rows, err := s.db.Query(`SELECT id, key_id, old_fingerprint, new_fingerprint, generated, rotated_by, created_at FROM ssh_key_rotations WHERE key_id = ? ORDER BY id DESC`, keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rotations := make([]SSHKeyRotation, 0)
+	for rows.Next() {
+		var r SSHKeyRotation
+		if err := rows.Scan(&r.ID, &r.KeyID, &r.OldFingerprint, &r.NewFingerprint, &r.Generated, &r.RotatedBy, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rotations = append(rotations, r)
+	}
+	return rotations, rows.Err()
+}
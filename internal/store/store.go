@@ -9,20 +9,41 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // Run represents a single pipeline run stored in the runs table.
-// Status is one of: pending, running, success, failed.
+// Status is one of: pending, running, success, failed, interrupted (the server lost track of it, e.g. after a crash).
+// DeletedAt is set when the run was soft-deleted; such runs are excluded from listings and counts.
 type Run struct {
 	ID          int64      `json:"id"`
 	AppID       string     `json:"app_id"`
 	TriggeredBy string     `json:"triggered_by,omitempty"`
-	Status      string     `json:"status"` // pending, running, success, failed
+	Status      string     `json:"status"` // pending, running, success, failed, interrupted
 	CommitSHA   string     `json:"commit_sha,omitempty"`
 	Log         string     `json:"log,omitempty"`
 	StartedAt   time.Time  `json:"started_at"`
 	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy   string     `json:"deleted_by,omitempty"`
+	Slow        bool       `json:"slow,omitempty"` // exceeded the app's expected duration budget
+	// FailureReason labels a failed run by the failure rule its log matched (e.g. oom, git_auth).
+	FailureReason string `json:"failure_reason,omitempty"`
+	// LogKey is set when the log lives in the log store instead of the log column (GetRun only).
+	LogKey  string `json:"-"`
+	LogSize int64  `json:"log_size,omitempty"`
+	// HeartbeatAt is the last time the executing server reported the run alive (GetRun only).
+	HeartbeatAt *time.Time `json:"heartbeat_at,omitempty"`
+	// TriggeredByRunID is the upstream run whose completion started this run (GetRun only).
+	TriggeredByRunID int64 `json:"triggered_by_run_id,omitempty"`
+	// RetryOfRunID is the failed run this run retries, and Attempt its attempt number, 1 for a
+	// first run (GetRun only).
+	RetryOfRunID int64 `json:"retry_of_run_id,omitempty"`
+	Attempt      int   `json:"attempt,omitempty"`
+	// PinnedAt is set while the run is pinned, which keeps it from being deleted or purged;
+	// PinnedBy and PinNote are loaded by GetRun and ListPinnedRuns only.
+	PinnedAt *time.Time `json:"pinned_at,omitempty"`
+	PinnedBy string     `json:"pinned_by,omitempty"`
+	PinNote  string     `json:"pin_note,omitempty"`
 }
 
 // User represents a user and the groups they belong to.
@@ -60,13 +81,33 @@ type GlobalEnvVar struct {
 type Store struct {
 	db     *sql.DB
 	driver string
+	// logSearch is the run log search backend (see setupLogSearch).
+	logSearch string
 }
 
-// New opens the database and runs migrations. driver is "sqlite3" or "mysql".
-// For sqlite3, dsn is the file path (e.g. "data/cicd.db"). For mysql, dsn is the connection string (e.g. "user:password@tcp(host:3306)/dbname?parseTime=true").
+// Driver returns the database driver name ("sqlite3", "sqlite" or "mysql").
+func (s *Store) Driver() string { return s.driver }
+
+// New opens the database and runs migrations. driver is "sqlite3", "sqlite" or "mysql". "sqlite3" is
+// the cgo SQLite driver (github.com/mattn/go-sqlite3), or the pure-Go one in binaries built with
+// CGO_ENABLED=0; "sqlite" is always the pure-Go driver (modernc.org/sqlite). Both use the same files.
+// For SQLite, dsn is the file path (e.g. "data/cicd.db"). For mysql, dsn is the connection string (e.g. "user:password@tcp(host:3306)/dbname");
+// times are always stored in UTC (see mysqlUTCDSN), and those stored in the old session time zone
+// are converted once (see migrateMySQLLocalTimes).
 func New(driver, dsn string) (*Store, error) {
-	if driver == "" {
-		driver = "sqlite3"
+	if driver == "" || driver == "sqlite3" {
+		driver = defaultSQLiteDriver
+	}
+	if driver == pureGoSQLiteDriver {
+		dsn = pureGoSQLiteDSN(dsn)
+	}
+	var mysqlTimeZone string
+	if driver == "mysql" {
+		var err error
+		mysqlTimeZone = mysqlDSNTimeZone(dsn)
+		if dsn, err = mysqlUTCDSN(dsn); err != nil {
+			return nil, err
+		}
 	}
 	db, err := sql.Open(driver, dsn)
 	if err != nil {
@@ -80,7 +121,13 @@ func New(driver, dsn string) (*Store, error) {
 		db.Close()
 		return nil, err
 	}
-	return &Store{db: db, driver: driver}, nil
+	if driver == "mysql" {
+		if err := migrateMySQLLocalTimes(db, mysqlTimeZone); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &Store{db: db, driver: driver, logSearch: setupLogSearch(db, driver)}, nil
 }
 
 func (s *Store) nowExpr() string {
@@ -90,6 +137,24 @@ func (s *Store) nowExpr() string {
 	return "datetime('now')"
 }
 
+// agoExpr returns an SQL expression for the timestamp d before now.
+func (s *Store) agoExpr(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	if s.driver == "mysql" {
+		return fmt.Sprintf("(NOW() - INTERVAL %d SECOND)", seconds)
+	}
+	return fmt.Sprintf("datetime('now', '-%d seconds')", seconds)
+}
+
+// inPlaceholders returns "?,?,..." for n values and the values as query args.
+func inPlaceholders(values []string) (string, []interface{}) {
+	args := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return strings.TrimRight(strings.Repeat("?,", len(values)), ","), args
+}
+
 // migrate creates the runs table and indexes if they do not exist.
 func migrate(db *sql.DB, driver string) error {
 	if driver == "mysql" {
@@ -109,6 +174,21 @@ func migrate(db *sql.DB, driver string) error {
 			return err
 		}
 		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN triggered_by VARCHAR(255)`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN deleted_at DATETIME NULL`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN deleted_by VARCHAR(255)`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN slow TINYINT(1) NOT NULL DEFAULT 0`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN log_key VARCHAR(512) NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN log_size BIGINT NOT NULL DEFAULT 0`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN heartbeat_at DATETIME NULL`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN triggered_by_run_id BIGINT NULL`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN failure_reason VARCHAR(64) NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN retry_of_run_id BIGINT NULL`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN attempt INT NOT NULL DEFAULT 1`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN pinned_at DATETIME NULL`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN pinned_by VARCHAR(255)`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN pin_note VARCHAR(512) NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN commit_message VARCHAR(1024) NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`CREATE INDEX idx_runs_triggered_by_run_id ON runs(triggered_by_run_id)`)
 		_, err = db.Exec(`
 			CREATE TABLE IF NOT EXISTS users (
 				id BIGINT AUTO_INCREMENT PRIMARY KEY,
@@ -161,6 +241,34 @@ func migrate(db *sql.DB, driver string) error {
 		if err != nil {
 			return err
 		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS ssh_key_rotations (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				key_id BIGINT NOT NULL,
+				old_fingerprint VARCHAR(255) NOT NULL,
+				new_fingerprint VARCHAR(255) NOT NULL,
+				generated TINYINT(1) NOT NULL DEFAULT 0,
+				rotated_by VARCHAR(255) NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_ssh_key_rotations_key (key_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS registries (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				name VARCHAR(255) NOT NULL UNIQUE,
+				url VARCHAR(512) NOT NULL,
+				username VARCHAR(255) NOT NULL,
+				token TEXT NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+		`)
+		if err != nil {
+			return err
+		}
 		_, err = db.Exec(`
 			CREATE TABLE IF NOT EXISTS global_env_vars (
 				id BIGINT AUTO_INCREMENT PRIMARY KEY,
@@ -172,6 +280,489 @@ func migrate(db *sql.DB, driver string) error {
 		if err != nil {
 			return err
 		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS quotas (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				scope VARCHAR(50) NOT NULL,
+				scope_id VARCHAR(255) NOT NULL,
+				max_runs_per_day INT NOT NULL DEFAULT 0,
+				max_run_duration_sec INT NOT NULL DEFAULT 0,
+				max_concurrent_runs INT NOT NULL DEFAULT 0,
+				UNIQUE KEY uq_quotas_scope (scope, scope_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_triggers (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				app_id VARCHAR(255) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				token_hash CHAR(64) NOT NULL UNIQUE,
+				created_by VARCHAR(255) NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS trigger_deliveries (
+				trigger_id BIGINT NOT NULL,
+				idempotency_key VARCHAR(255) NOT NULL,
+				run_id BIGINT NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (trigger_id, idempotency_key)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS slack_users (
+				slack_user_id VARCHAR(64) PRIMARY KEY,
+				user_id BIGINT NOT NULL UNIQUE
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS app_tags (
+				app_id VARCHAR(255) NOT NULL,
+				tag VARCHAR(64) NOT NULL,
+				PRIMARY KEY (app_id, tag)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS user_favorites (
+				user_id BIGINT NOT NULL,
+				app_id VARCHAR(255) NOT NULL,
+				position INT NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, app_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_comments (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				run_id BIGINT NOT NULL,
+				author VARCHAR(255) NOT NULL,
+				body TEXT NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_run_comments_run (run_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_step_usage (
+				run_id BIGINT NOT NULL,
+				position INT NOT NULL,
+				step VARCHAR(255) NOT NULL,
+				duration_ms BIGINT NOT NULL DEFAULT 0,
+				cpu_seconds DOUBLE NOT NULL DEFAULT 0,
+				avg_cpu_percent DOUBLE NOT NULL DEFAULT 0,
+				peak_cpu_percent DOUBLE NOT NULL DEFAULT 0,
+				avg_rss_bytes BIGINT NOT NULL DEFAULT 0,
+				peak_rss_bytes BIGINT NOT NULL DEFAULT 0,
+				disk_read_bytes BIGINT NOT NULL DEFAULT 0,
+				disk_write_bytes BIGINT NOT NULL DEFAULT 0,
+				samples INT NOT NULL DEFAULT 0,
+				PRIMARY KEY (run_id, position)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_env (
+				run_id BIGINT NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				value TEXT NOT NULL,
+				PRIMARY KEY (run_id, name)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_findings (
+				run_id BIGINT NOT NULL,
+				position INT NOT NULL,
+				step VARCHAR(255) NOT NULL,
+				tool VARCHAR(64) NOT NULL,
+				vuln_id VARCHAR(255) NOT NULL,
+				package VARCHAR(512) NOT NULL,
+				installed_version VARCHAR(255) NOT NULL,
+				fixed_version VARCHAR(255) NOT NULL,
+				severity VARCHAR(32) NOT NULL,
+				title TEXT NOT NULL,
+				target VARCHAR(1024) NOT NULL,
+				PRIMARY KEY (run_id, position)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_approvals (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				run_id BIGINT NOT NULL,
+				step VARCHAR(255) NOT NULL,
+				plan TEXT NOT NULL,
+				status VARCHAR(32) NOT NULL,
+				approver_groups VARCHAR(1024) NOT NULL DEFAULT '',
+				decided_by VARCHAR(255),
+				decided_at DATETIME NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_run_approvals_run (run_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, _ = db.Exec(`ALTER TABLE run_approvals ADD COLUMN approver_groups VARCHAR(1024) NOT NULL DEFAULT ''`)
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_artifacts (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				run_id BIGINT NOT NULL,
+				step VARCHAR(255) NOT NULL,
+				name VARCHAR(1024) NOT NULL,
+				storage_key VARCHAR(1024) NOT NULL,
+				size_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_run_artifacts_run (run_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_images (
+				run_id BIGINT PRIMARY KEY,
+				image VARCHAR(512) NOT NULL,
+				digest VARCHAR(128) NOT NULL
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_notifications (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				run_id BIGINT NOT NULL,
+				event VARCHAR(255) NOT NULL,
+				message TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				INDEX idx_run_notifications_run (run_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS promotions (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				app_id VARCHAR(255) NOT NULL,
+				environment VARCHAR(255) NOT NULL,
+				source_image VARCHAR(512) NOT NULL,
+				target_image VARCHAR(512) NOT NULL,
+				digest VARCHAR(128) NOT NULL,
+				source_run_id BIGINT NOT NULL DEFAULT 0,
+				deploy_run_id BIGINT NOT NULL DEFAULT 0,
+				promoted_by VARCHAR(255) NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_promotions_app_env (app_id, environment, id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS deploy_freezes (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				environment VARCHAR(255) NOT NULL,
+				starts_at DATETIME NOT NULL,
+				ends_at DATETIME NOT NULL,
+				reason TEXT NOT NULL,
+				created_by VARCHAR(255) NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_deploy_freezes_ends (ends_at)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS api_tokens (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				scope VARCHAR(32) NOT NULL,
+				app_ids TEXT NOT NULL,
+				token_hash VARCHAR(64) NOT NULL UNIQUE,
+				expires_at DATETIME NULL,
+				last_used_at DATETIME NULL,
+				rotated_at DATETIME NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_api_tokens_user (user_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS user_invites (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				username VARCHAR(255) NOT NULL,
+				email VARCHAR(255) NOT NULL,
+				is_admin TINYINT(1) NOT NULL DEFAULT 0,
+				group_ids TEXT NOT NULL,
+				token_hash VARCHAR(64) NOT NULL UNIQUE,
+				invited_by VARCHAR(255) NOT NULL,
+				expires_at DATETIME NOT NULL,
+				accepted_at DATETIME NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS sessions (
+				token_hash VARCHAR(64) PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				username VARCHAR(255) NOT NULL,
+				is_admin TINYINT(1) NOT NULL DEFAULT 0,
+				expires_at DATETIME NOT NULL,
+				INDEX idx_sessions_user (user_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS leader_leases (
+				name VARCHAR(64) PRIMARY KEY,
+				holder VARCHAR(255) NOT NULL,
+				expires_at DATETIME NOT NULL
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS train_runs (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				train VARCHAR(255) NOT NULL,
+				status VARCHAR(50) NOT NULL,
+				stage INT NOT NULL DEFAULT -1,
+				params TEXT NOT NULL,
+				error TEXT NOT NULL,
+				triggered_by VARCHAR(255) NOT NULL,
+				started_at DATETIME NOT NULL,
+				ended_at DATETIME NULL,
+				INDEX idx_train_runs_train (train, id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS train_run_runs (
+				train_run_id BIGINT NOT NULL,
+				stage INT NOT NULL,
+				app_id VARCHAR(255) NOT NULL,
+				run_id BIGINT NOT NULL,
+				PRIMARY KEY (train_run_id, app_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS releases (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				version VARCHAR(255) NOT NULL,
+				environment VARCHAR(255) NOT NULL,
+				changelog TEXT NOT NULL,
+				created_by VARCHAR(255) NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_releases_environment (environment, id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS release_runs (
+				release_id BIGINT NOT NULL,
+				run_id BIGINT NOT NULL,
+				PRIMARY KEY (release_id, run_id),
+				INDEX idx_release_runs_run (run_id)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS group_landing (
+				group_id BIGINT PRIMARY KEY,
+				page VARCHAR(50) NOT NULL,
+				app_ids TEXT NOT NULL
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_issues (
+				run_id BIGINT NOT NULL,
+				position INT NOT NULL,
+				issue_key VARCHAR(64) NOT NULL,
+				PRIMARY KEY (run_id, position)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS jira_settings (
+				id INT PRIMARY KEY,
+				base_url VARCHAR(1024) NOT NULL,
+				username VARCHAR(255) NOT NULL,
+				token TEXT NOT NULL,
+				environments TEXT NOT NULL,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS git_providers (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				name VARCHAR(255) NOT NULL UNIQUE,
+				kind VARCHAR(32) NOT NULL,
+				api_url VARCHAR(512) NOT NULL,
+				token TEXT NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS log_redaction_rules (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				pattern TEXT NOT NULL,
+				description VARCHAR(255) NOT NULL DEFAULT '',
+				created_by VARCHAR(255) NOT NULL DEFAULT '',
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS run_digests (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				run_id BIGINT NOT NULL,
+				app_id VARCHAR(255) NOT NULL,
+				kind VARCHAR(16) NOT NULL,
+				image VARCHAR(512) NOT NULL,
+				tag VARCHAR(128) NOT NULL DEFAULT '',
+				digest VARCHAR(128) NOT NULL,
+				step VARCHAR(255) NOT NULL DEFAULT '',
+				environment VARCHAR(255) NOT NULL DEFAULT '',
+				replaced_digest VARCHAR(128) NOT NULL DEFAULT '',
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_run_digests_run (run_id),
+				INDEX idx_run_digests_digest (digest)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS app_drift (
+				app_id VARCHAR(255) PRIMARY KEY,
+				deploy_run_id BIGINT NOT NULL,
+				resources TEXT NOT NULL,
+				status VARCHAR(32) NOT NULL,
+				diff MEDIUMTEXT NOT NULL,
+				error TEXT NOT NULL,
+				checked_at DATETIME NULL,
+				drifted_since DATETIME NULL
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS preview_envs (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				app_id VARCHAR(255) NOT NULL,
+				branch VARCHAR(255) NOT NULL,
+				namespace VARCHAR(63) NOT NULL,
+				url TEXT NOT NULL,
+				status VARCHAR(32) NOT NULL,
+				last_run_id BIGINT NOT NULL,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				deleted_at DATETIME NULL,
+				delete_reason VARCHAR(255) NOT NULL,
+				INDEX idx_preview_envs_app (app_id, branch, status),
+				INDEX idx_preview_envs_expiry (status, expires_at)
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS k8s_debug_holds (
+				run_id BIGINT PRIMARY KEY,
+				app_id VARCHAR(255) NOT NULL,
+				namespace VARCHAR(63) NOT NULL,
+				job VARCHAR(255) NOT NULL,
+				pod VARCHAR(255) NOT NULL,
+				expires_at DATETIME NOT NULL
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS maintenance_mode (
+				id TINYINT PRIMARY KEY,
+				message VARCHAR(512) NOT NULL,
+				queue_runs TINYINT(1) NOT NULL DEFAULT 0,
+				since DATETIME NOT NULL,
+				set_by VARCHAR(255) NOT NULL
+			);
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			CREATE TABLE IF NOT EXISTS held_runs (
+				run_id BIGINT PRIMARY KEY
+			);
+		`)
+		if err != nil {
+			return err
+		}
 		_, err = db.Exec(`CREATE INDEX idx_runs_app_id ON runs(app_id)`)
 		if err != nil {
 			// ignore if exists
@@ -221,15 +812,356 @@ func migrate(db *sql.DB, driver string) error {
 			private_key TEXT NOT NULL,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		);
+		CREATE TABLE IF NOT EXISTS ssh_key_rotations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			key_id INTEGER NOT NULL,
+			old_fingerprint TEXT NOT NULL,
+			new_fingerprint TEXT NOT NULL,
+			generated INTEGER NOT NULL DEFAULT 0,
+			rotated_by TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_ssh_key_rotations_key ON ssh_key_rotations(key_id);
+		CREATE TABLE IF NOT EXISTS registries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			url TEXT NOT NULL,
+			username TEXT NOT NULL,
+			token TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
 		CREATE TABLE IF NOT EXISTS global_env_vars (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			name TEXT NOT NULL UNIQUE,
 			value TEXT NOT NULL,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		);
+		CREATE TABLE IF NOT EXISTS quotas (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			scope TEXT NOT NULL,
+			scope_id TEXT NOT NULL,
+			max_runs_per_day INTEGER NOT NULL DEFAULT 0,
+			max_run_duration_sec INTEGER NOT NULL DEFAULT 0,
+			max_concurrent_runs INTEGER NOT NULL DEFAULT 0,
+			UNIQUE (scope, scope_id)
+		);
+		CREATE TABLE IF NOT EXISTS run_triggers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			app_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_by TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS trigger_deliveries (
+			trigger_id INTEGER NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			run_id INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (trigger_id, idempotency_key)
+		);
+		CREATE TABLE IF NOT EXISTS slack_users (
+			slack_user_id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL UNIQUE
+		);
+		CREATE TABLE IF NOT EXISTS app_tags (
+			app_id TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (app_id, tag)
+		);
+		CREATE TABLE IF NOT EXISTS user_favorites (
+			user_id INTEGER NOT NULL,
+			app_id TEXT NOT NULL,
+			position INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, app_id)
+		);
+		CREATE TABLE IF NOT EXISTS run_comments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			author TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_run_comments_run ON run_comments(run_id);
+		CREATE TABLE IF NOT EXISTS run_step_usage (
+			run_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			step TEXT NOT NULL,
+			duration_ms INTEGER NOT NULL DEFAULT 0,
+			cpu_seconds REAL NOT NULL DEFAULT 0,
+			avg_cpu_percent REAL NOT NULL DEFAULT 0,
+			peak_cpu_percent REAL NOT NULL DEFAULT 0,
+			avg_rss_bytes INTEGER NOT NULL DEFAULT 0,
+			peak_rss_bytes INTEGER NOT NULL DEFAULT 0,
+			disk_read_bytes INTEGER NOT NULL DEFAULT 0,
+			disk_write_bytes INTEGER NOT NULL DEFAULT 0,
+			samples INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (run_id, position)
+		);
+		CREATE TABLE IF NOT EXISTS run_env (
+			run_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (run_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS run_findings (
+			run_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			step TEXT NOT NULL,
+			tool TEXT NOT NULL,
+			vuln_id TEXT NOT NULL,
+			package TEXT NOT NULL,
+			installed_version TEXT NOT NULL,
+			fixed_version TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			title TEXT NOT NULL,
+			target TEXT NOT NULL,
+			PRIMARY KEY (run_id, position)
+		);
+		CREATE TABLE IF NOT EXISTS run_approvals (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			step TEXT NOT NULL,
+			plan TEXT NOT NULL,
+			status TEXT NOT NULL,
+			approver_groups TEXT NOT NULL DEFAULT '',
+			decided_by TEXT,
+			decided_at DATETIME,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_run_approvals_run ON run_approvals(run_id);
+		CREATE TABLE IF NOT EXISTS run_artifacts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			step TEXT NOT NULL,
+			name TEXT NOT NULL,
+			storage_key TEXT NOT NULL,
+			size_bytes INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_run_artifacts_run ON run_artifacts(run_id);
+		CREATE TABLE IF NOT EXISTS run_images (
+			run_id INTEGER PRIMARY KEY,
+			image TEXT NOT NULL,
+			digest TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS run_notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			message TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_run_notifications_run ON run_notifications(run_id);
+		CREATE TABLE IF NOT EXISTS promotions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			app_id TEXT NOT NULL,
+			environment TEXT NOT NULL,
+			source_image TEXT NOT NULL,
+			target_image TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			source_run_id INTEGER NOT NULL DEFAULT 0,
+			deploy_run_id INTEGER NOT NULL DEFAULT 0,
+			promoted_by TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_promotions_app_env ON promotions(app_id, environment, id);
+		CREATE TABLE IF NOT EXISTS deploy_freezes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			environment TEXT NOT NULL,
+			starts_at DATETIME NOT NULL,
+			ends_at DATETIME NOT NULL,
+			reason TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_deploy_freezes_ends ON deploy_freezes(ends_at);
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			app_ids TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			rotated_at DATETIME,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+		CREATE TABLE IF NOT EXISTS user_invites (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			email TEXT NOT NULL,
+			is_admin INTEGER NOT NULL DEFAULT 0,
+			group_ids TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			invited_by TEXT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			accepted_at DATETIME,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			username TEXT NOT NULL,
+			is_admin INTEGER NOT NULL DEFAULT 0,
+			expires_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+		CREATE TABLE IF NOT EXISTS leader_leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS train_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			train TEXT NOT NULL,
+			status TEXT NOT NULL,
+			stage INTEGER NOT NULL DEFAULT -1,
+			params TEXT NOT NULL,
+			error TEXT NOT NULL,
+			triggered_by TEXT NOT NULL,
+			started_at DATETIME NOT NULL,
+			ended_at DATETIME
+		);
+		CREATE INDEX IF NOT EXISTS idx_train_runs_train ON train_runs(train, id);
+		CREATE TABLE IF NOT EXISTS train_run_runs (
+			train_run_id INTEGER NOT NULL,
+			stage INTEGER NOT NULL,
+			app_id TEXT NOT NULL,
+			run_id INTEGER NOT NULL,
+			PRIMARY KEY (train_run_id, app_id)
+		);
+		CREATE TABLE IF NOT EXISTS releases (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			version TEXT NOT NULL,
+			environment TEXT NOT NULL,
+			changelog TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_releases_environment ON releases(environment, id);
+		CREATE TABLE IF NOT EXISTS release_runs (
+			release_id INTEGER NOT NULL,
+			run_id INTEGER NOT NULL,
+			PRIMARY KEY (release_id, run_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_release_runs_run ON release_runs(run_id);
+		CREATE TABLE IF NOT EXISTS group_landing (
+			group_id INTEGER PRIMARY KEY,
+			page TEXT NOT NULL,
+			app_ids TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS run_issues (
+			run_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			issue_key TEXT NOT NULL,
+			PRIMARY KEY (run_id, position)
+		);
+		CREATE TABLE IF NOT EXISTS jira_settings (
+			id INTEGER PRIMARY KEY,
+			base_url TEXT NOT NULL,
+			username TEXT NOT NULL,
+			token TEXT NOT NULL,
+			environments TEXT NOT NULL,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS git_providers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			kind TEXT NOT NULL,
+			api_url TEXT NOT NULL,
+			token TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS log_redaction_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			pattern TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS run_digests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			app_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			image TEXT NOT NULL,
+			tag TEXT NOT NULL DEFAULT '',
+			digest TEXT NOT NULL,
+			step TEXT NOT NULL DEFAULT '',
+			environment TEXT NOT NULL DEFAULT '',
+			replaced_digest TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_run_digests_run ON run_digests(run_id);
+		CREATE INDEX IF NOT EXISTS idx_run_digests_digest ON run_digests(digest);
+		CREATE TABLE IF NOT EXISTS app_drift (
+			app_id TEXT PRIMARY KEY,
+			deploy_run_id INTEGER NOT NULL,
+			resources TEXT NOT NULL,
+			status TEXT NOT NULL,
+			diff TEXT NOT NULL,
+			error TEXT NOT NULL,
+			checked_at DATETIME,
+			drifted_since DATETIME
+		);
+		CREATE TABLE IF NOT EXISTS preview_envs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			app_id TEXT NOT NULL,
+			branch TEXT NOT NULL,
+			namespace TEXT NOT NULL,
+			url TEXT NOT NULL,
+			status TEXT NOT NULL,
+			last_run_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			deleted_at DATETIME,
+			delete_reason TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_preview_envs_app ON preview_envs(app_id, branch, status);
+		CREATE INDEX IF NOT EXISTS idx_preview_envs_expiry ON preview_envs(status, expires_at);
+		CREATE TABLE IF NOT EXISTS k8s_debug_holds (
+			run_id INTEGER PRIMARY KEY,
+			app_id TEXT NOT NULL,
+			namespace TEXT NOT NULL,
+			job TEXT NOT NULL,
+			pod TEXT NOT NULL,
+			expires_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS maintenance_mode (
+			id INTEGER PRIMARY KEY,
+			message TEXT NOT NULL,
+			queue_runs INTEGER NOT NULL DEFAULT 0,
+			since DATETIME NOT NULL,
+			set_by TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS held_runs (
+			run_id INTEGER PRIMARY KEY
+		);
 	`)
 	if err == nil {
 		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN triggered_by TEXT`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN deleted_at DATETIME`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN deleted_by TEXT`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN slow INTEGER NOT NULL DEFAULT 0`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN log_key TEXT NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN log_size INTEGER NOT NULL DEFAULT 0`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN heartbeat_at DATETIME`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN triggered_by_run_id INTEGER`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN failure_reason TEXT NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN retry_of_run_id INTEGER`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN attempt INTEGER NOT NULL DEFAULT 1`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN pinned_at DATETIME`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN pinned_by TEXT`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN pin_note TEXT NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`ALTER TABLE runs ADD COLUMN commit_message TEXT NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`ALTER TABLE run_approvals ADD COLUMN approver_groups TEXT NOT NULL DEFAULT ''`)
+		_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS idx_runs_triggered_by_run_id ON runs(triggered_by_run_id)`)
 		_, _ = db.Exec(`ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0`)
 	}
 	return err
@@ -351,7 +1283,7 @@ func (s *Store) GetSSHKeyByName(name string) (*SSHKey, error) {
 	return &k, nil
 }
 
-// DeleteSSHKey deletes one SSH key by ID.
+// DeleteSSHKey deletes one SSH key by ID, with its rotation history.
 func (s *Store) DeleteSSHKey(id int64) error {
 	res, err := s.db.Exec(`DELETE FROM ssh_keys WHERE id = ?`, id)
 	if err != nil {
@@ -364,7 +1296,8 @@ func (s *Store) DeleteSSHKey(id int64) error {
 	if affected == 0 {
 		return sql.ErrNoRows
 	}
-	return nil
+	_, err = s.db.Exec(`DELETE FROM ssh_key_rotations WHERE key_id = ?`, id)
+	return err
 }
 
 // CreateRun inserts a new run and returns its ID.
@@ -377,6 +1310,17 @@ func (s *Store) CreateRun(appID, commitSHA, triggeredBy string) (int64, error) {
 	return res.LastInsertId()
 }
 
+// CreateFinishedRun inserts a run that has already ended with status at endedAt (e.g. seeded demo
+// runs) and returns its ID. The log is set separately.
+func (s *Store) CreateFinishedRun(appID, commitSHA, triggeredBy, status string, startedAt, endedAt time.Time) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO runs (app_id, triggered_by, status, commit_sha, started_at, ended_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		appID, triggeredBy, status, commitSHA, startedAt.UTC(), endedAt.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
 // UpdateRunLog updates only the log content for a run (e.g. while streaming).
 func (s *Store) UpdateRunLog(id int64, log string) error {
 	_, err := s.db.Exec(`UPDATE runs SET log = ? WHERE id = ?`, log, id)
@@ -394,14 +1338,133 @@ func (s *Store) UpdateRunStatus(id int64, status, log string) error {
 	return err
 }
 
+// UnfinishedRuns returns the pending and running runs that are not soft-deleted (ID, app, trigger, and status only).
+func (s *Store) UnfinishedRuns() ([]Run, error) {
+	return s.unfinishedRunsWhere("1 = 1")
+}
+
+func (s *Store) unfinishedRunsWhere(cond string) ([]Run, error) {
+	rows, err := s.db.Query(`SELECT id, app_id, COALESCE(triggered_by,''), status FROM runs WHERE status IN ('pending', 'running') AND deleted_at IS NULL AND ` + cond + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var r Run
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// ClaimRun moves a pending run to running and reports whether this caller did, so a run is only
+// executed once even when several server replicas could start it.
+func (s *Store) ClaimRun(id int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE runs SET status = 'running' WHERE id = ? AND status = 'pending'`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// MarkRunInterrupted sets a pending or running run to interrupted and reports whether it did.
+func (s *Store) MarkRunInterrupted(id int64) (bool, error) {
+	query := fmt.Sprintf(`UPDATE runs SET status = 'interrupted', ended_at = %s WHERE id = ? AND status IN ('pending', 'running')`, s.nowExpr())
+	res, err := s.db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// MarkRunSlow flags a run that exceeded its app's expected duration budget.
+func (s *Store) MarkRunSlow(id int64) error {
+	res, err := s.db.Exec(`UPDATE runs SET slow = 1 WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// SetRunFailureReason records why a failed run failed ("" clears it).
+func (s *Store) SetRunFailureReason(id int64, reason string) error {
+	_, err := s.db.Exec(`UPDATE runs SET failure_reason = ? WHERE id = ?`, reason, id)
+	return err
+}
+
+// SetRunRetry records that run id retries the failed run retryOfRunID as attempt number attempt.
+func (s *Store) SetRunRetry(id, retryOfRunID int64, attempt int) error {
+	_, err := s.db.Exec(`UPDATE runs SET retry_of_run_id = ?, attempt = ? WHERE id = ?`, retryOfRunID, attempt, id)
+	return err
+}
+
+// SetRunCommit records the commit a run checked out and its subject line.
+func (s *Store) SetRunCommit(id int64, commitSHA, commitMessage string) error {
+	_, err := s.db.Exec(`UPDATE runs SET commit_sha = ?, commit_message = ? WHERE id = ?`, commitSHA, commitMessage, id)
+	return err
+}
+
+// PreviousRunCommit returns the commit of the latest successful run of an app before run
+// beforeRunID, or "" if there is none.
+func (s *Store) PreviousRunCommit(appID string, beforeRunID int64) (string, error) {
+	var sha string
+	err := s.db.QueryRow(`
+		SELECT commit_sha FROM runs
+		WHERE app_id = ? AND id < ? AND status = 'success' AND COALESCE(commit_sha,'') != '' AND deleted_at IS NULL
+		ORDER BY id DESC LIMIT 1
+	`, appID, beforeRunID).Scan(&sha)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return sha, err
+}
+
+// LatestRunsByCommit returns, per commit SHA of shas, the latest run of an app that checked it
+// out. Commits without runs are missing from the map.
+func (s *Store) LatestRunsByCommit(appID string, shas []string) (map[string]Run, error) {
+	out := make(map[string]Run)
+	if len(shas) == 0 {
+		return out, nil
+	}
+	placeholders, args := inPlaceholders(shas)
+	rows, err := s.db.Query(`
+		SELECT id, app_id, COALESCE(triggered_by,''), status, commit_sha, started_at, ended_at, COALESCE(slow,0), COALESCE(failure_reason,'')
+		FROM runs WHERE app_id = ? AND commit_sha IN (`+placeholders+`) AND deleted_at IS NULL ORDER BY id
+	`, append([]interface{}{appID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Run
+		var endedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			r.EndedAt = &endedAt.Time
+		}
+		out[r.CommitSHA] = r
+	}
+	return out, rows.Err()
+}
+
 // GetRun returns a run by ID.
 func (s *Store) GetRun(id int64) (*Run, error) {
 	var r Run
-	var endedAt sql.NullTime
+	var endedAt, deletedAt, heartbeatAt, pinnedAt sql.NullTime
 	err := s.db.QueryRow(`
-		SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at
+		SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at, deleted_at, COALESCE(deleted_by,''), COALESCE(slow,0), COALESCE(failure_reason,''),
+			COALESCE(log_key,''), COALESCE(log_size,0), heartbeat_at, COALESCE(triggered_by_run_id,0), COALESCE(retry_of_run_id,0), COALESCE(attempt,1),
+			pinned_at, COALESCE(pinned_by,''), COALESCE(pin_note,'')
 		FROM runs WHERE id = ?
-	`, id).Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.Log, &r.StartedAt, &endedAt)
+	`, id).Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.Log, &r.StartedAt, &endedAt, &deletedAt, &r.DeletedBy, &r.Slow, &r.FailureReason,
+		&r.LogKey, &r.LogSize, &heartbeatAt, &r.TriggeredByRunID, &r.RetryOfRunID, &r.Attempt, &pinnedAt, &r.PinnedBy, &r.PinNote)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -411,10 +1474,19 @@ func (s *Store) GetRun(id int64) (*Run, error) {
 	if endedAt.Valid {
 		r.EndedAt = &endedAt.Time
 	}
+	if deletedAt.Valid {
+		r.DeletedAt = &deletedAt.Time
+	}
+	if heartbeatAt.Valid {
+		r.HeartbeatAt = &heartbeatAt.Time
+	}
+	if pinnedAt.Valid {
+		r.PinnedAt = &pinnedAt.Time
+	}
 	return &r, nil
 }
 
-// ListRuns returns runs, optionally filtered by appID, with limit and offset for pagination.
+// ListRuns returns runs that are not soft-deleted, optionally filtered by appID, with limit and offset for pagination.
 func (s *Store) ListRuns(appID string, limit, offset int) ([]Run, error) {
 	if limit <= 0 {
 		limit = 50
@@ -426,13 +1498,13 @@ func (s *Store) ListRuns(appID string, limit, offset int) ([]Run, error) {
 	var err error
 	if appID != "" {
 		rows, err = s.db.Query(`
-			SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at
-			FROM runs WHERE app_id = ? ORDER BY started_at DESC LIMIT ? OFFSET ?
+			SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at, COALESCE(slow,0), COALESCE(failure_reason,''), pinned_at
+			FROM runs WHERE app_id = ? AND deleted_at IS NULL ORDER BY started_at DESC LIMIT ? OFFSET ?
 		`, appID, limit, offset)
 	} else {
 		rows, err = s.db.Query(`
-			SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at
-			FROM runs ORDER BY started_at DESC LIMIT ? OFFSET ?
+			SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at, COALESCE(slow,0), COALESCE(failure_reason,''), pinned_at
+			FROM runs WHERE deleted_at IS NULL ORDER BY started_at DESC LIMIT ? OFFSET ?
 		`, limit, offset)
 	}
 	if err != nil {
@@ -442,35 +1514,63 @@ func (s *Store) ListRuns(appID string, limit, offset int) ([]Run, error) {
 	runs := make([]Run, 0)
 	for rows.Next() {
 		var r Run
-		var endedAt sql.NullTime
-		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.Log, &r.StartedAt, &endedAt); err != nil {
+		var endedAt, pinnedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.Log, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason, &pinnedAt); err != nil {
 			return nil, err
 		}
 		if endedAt.Valid {
 			r.EndedAt = &endedAt.Time
 		}
+		if pinnedAt.Valid {
+			r.PinnedAt = &pinnedAt.Time
+		}
 		runs = append(runs, r)
 	}
 	return runs, rows.Err()
 }
 
-// CountRuns returns the total number of runs, optionally filtered by appID.
+// CountRuns returns the total number of runs that are not soft-deleted, optionally filtered by appID.
 func (s *Store) CountRuns(appID string) (int64, error) {
 	var count int64
 	if appID != "" {
-		err := s.db.QueryRow(`SELECT COUNT(*) FROM runs WHERE app_id = ?`, appID).Scan(&count)
+		err := s.db.QueryRow(`SELECT COUNT(*) FROM runs WHERE app_id = ? AND deleted_at IS NULL`, appID).Scan(&count)
 		return count, err
 	}
-	err := s.db.QueryRow(`SELECT COUNT(*) FROM runs`).Scan(&count)
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM runs WHERE deleted_at IS NULL`).Scan(&count)
 	return count, err
 }
 
-// DeleteRunsByAppID deletes all runs for a given app.
+// CountUnfinishedRuns returns the number of pending (queued) and running runs that are not soft-deleted.
+func (s *Store) CountUnfinishedRuns() (pending, running int64, err error) {
+	err = s.db.QueryRow(`SELECT
+		COALESCE(SUM(CASE WHEN status = 'pending' THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN status = 'running' THEN 1 ELSE 0 END), 0)
+		FROM runs WHERE status IN ('pending', 'running') AND deleted_at IS NULL`).Scan(&pending, &running)
+	return pending, running, err
+}
+
+// DeleteRunsByAppID deletes all runs for a given app except pinned ones.
 func (s *Store) DeleteRunsByAppID(appID string) error {
-	_, err := s.db.Exec(`DELETE FROM runs WHERE app_id = ?`, appID)
+	if err := s.deleteRunDetails(`app_id = ? AND pinned_at IS NULL`, appID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM runs WHERE app_id = ? AND pinned_at IS NULL`, appID)
 	return err
 }
 
+// runDetailTables hold per-run rows keyed by run_id that are deleted together with their runs.
+var runDetailTables = []string{"run_comments", "run_step_usage", "run_env", "run_findings", "run_approvals", "run_artifacts", "run_images", "run_digests", "run_notifications", "release_runs", "run_issues", "held_runs"}
+
+// deleteRunDetails deletes the rows of runDetailTables for the runs matching where.
+func (s *Store) deleteRunDetails(where string, args ...interface{}) error {
+	for _, table := range runDetailTables {
+		if _, err := s.db.Exec(`DELETE FROM `+table+` WHERE run_id IN (SELECT id FROM runs WHERE `+where+`)`, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ListRunsByAppIDs returns runs for the allowed app IDs.
 func (s *Store) ListRunsByAppIDs(appIDs []string, limit, offset int) ([]Run, error) {
 	if len(appIDs) == 0 {
@@ -489,8 +1589,8 @@ func (s *Store) ListRunsByAppIDs(appIDs []string, limit, offset int) ([]Run, err
 	}
 	args = append(args, limit, offset)
 	query := fmt.Sprintf(`
-		SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at
-		FROM runs WHERE app_id IN (%s) ORDER BY started_at DESC LIMIT ? OFFSET ?
+		SELECT id, app_id, COALESCE(triggered_by,''), status, COALESCE(commit_sha,''), COALESCE(log,''), started_at, ended_at, COALESCE(slow,0), COALESCE(failure_reason,''), pinned_at
+		FROM runs WHERE app_id IN (%s) AND deleted_at IS NULL ORDER BY started_at DESC LIMIT ? OFFSET ?
 	`, placeholders)
 	rows, err := s.db.Query(query, args...)
 	if err != nil {
@@ -500,13 +1600,16 @@ func (s *Store) ListRunsByAppIDs(appIDs []string, limit, offset int) ([]Run, err
 	runs := make([]Run, 0)
 	for rows.Next() {
 		var r Run
-		var endedAt sql.NullTime
-		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.Log, &r.StartedAt, &endedAt); err != nil {
+		var endedAt, pinnedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.Log, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason, &pinnedAt); err != nil {
 			return nil, err
 		}
 		if endedAt.Valid {
 			r.EndedAt = &endedAt.Time
 		}
+		if pinnedAt.Valid {
+			r.PinnedAt = &pinnedAt.Time
+		}
 		runs = append(runs, r)
 	}
 	return runs, rows.Err()
@@ -523,11 +1626,47 @@ func (s *Store) CountRunsByAppIDs(appIDs []string) (int64, error) {
 		args = append(args, appID)
 	}
 	var count int64
-	query := fmt.Sprintf(`SELECT COUNT(*) FROM runs WHERE app_id IN (%s)`, placeholders)
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM runs WHERE app_id IN (%s) AND deleted_at IS NULL`, placeholders)
 	err := s.db.QueryRow(query, args...).Scan(&count)
 	return count, err
 }
 
+// LatestRuns returns the newest run (without log) of each app that has runs, in one query.
+// appIDs restricts the apps (nil = all).
+func (s *Store) LatestRuns(appIDs []string) ([]Run, error) {
+	if appIDs != nil && len(appIDs) == 0 {
+		return []Run{}, nil
+	}
+	filter, args := "", []interface{}(nil)
+	if appIDs != nil {
+		var placeholders string
+		placeholders, args = inPlaceholders(appIDs)
+		filter = " AND app_id IN (" + placeholders + ")"
+	}
+	rows, err := s.db.Query(`
+		SELECT r.id, r.app_id, COALESCE(r.triggered_by,''), r.status, COALESCE(r.commit_sha,''), r.started_at, r.ended_at, COALESCE(r.slow,0), COALESCE(r.failure_reason,'')
+		FROM runs r JOIN (SELECT MAX(id) AS id FROM runs WHERE deleted_at IS NULL`+filter+` GROUP BY app_id) latest ON r.id = latest.id
+		ORDER BY r.app_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var r Run
+		var endedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.AppID, &r.TriggeredBy, &r.Status, &r.CommitSHA, &r.StartedAt, &endedAt, &r.Slow, &r.FailureReason); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			r.EndedAt = &endedAt.Time
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
 // CreateUser inserts a user and returns the generated ID.
 func (s *Store) CreateUser(username, passwordHash string, isAdmin bool) (int64, error) {
 	admin := 0
@@ -653,6 +1792,15 @@ func (s *Store) DeleteUser(userID int64) error {
 	if _, err := tx.Exec(`DELETE FROM user_groups WHERE user_id = ?`, userID); err != nil {
 		return err
 	}
+	if _, err := tx.Exec(`DELETE FROM user_favorites WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM slack_users WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM api_tokens WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
 	res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, userID)
 	if err != nil {
 		return err
@@ -888,6 +2036,45 @@ func (s *Store) AppIDsByUserGroupIDs(groupIDs []int64) ([]string, error) {
 	return out, rows.Err()
 }
 
+// AllGroupAppIDs returns the app IDs assigned to each group, for groups with at least one app.
+func (s *Store) AllGroupAppIDs() (map[int64][]string, error) {
+	rows, err := s.db.Query(`SELECT group_id, app_id FROM app_groups ORDER BY group_id, app_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int64][]string)
+	for rows.Next() {
+		var groupID int64
+		var appID string
+		if err := rows.Scan(&groupID, &appID); err != nil {
+			return nil, err
+		}
+		out[groupID] = append(out[groupID], appID)
+	}
+	return out, rows.Err()
+}
+
+// AllGroupUserIDs returns the user IDs of each group, for groups with at least one user.
+func (s *Store) AllGroupUserIDs() (map[int64][]int64, error) {
+	rows, err := s.db.Query(`SELECT group_id, user_id FROM user_groups ORDER BY group_id, user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int64][]int64)
+	for rows.Next() {
+		var groupID, userID int64
+		if err := rows.Scan(&groupID, &userID); err != nil {
+			return nil, err
+		}
+		out[groupID] = append(out[groupID], userID)
+	}
+	return out, rows.Err()
+}
+
 // Close closes the database connection.
 func (s *Store) Close() error {
 	return s.db.Close()
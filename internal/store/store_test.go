@@ -1,8 +1,13 @@
 package store
 
 import (
+	"database/sql"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 func TestStore_CreateRun_UpdateRunStatus_GetRun(t *testing.T) {
@@ -242,3 +247,929 @@ func TestStore_GlobalEnvVarsCRUD(t *testing.T) {
 		t.Fatalf("expected no env vars after delete, got %d", len(vars))
 	}
 }
+
+func TestStore_QuotasAndRunCounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	id, err := st.SetQuota(Quota{Scope: QuotaScopeApp, ScopeID: "app1", MaxRunsPerDay: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameID, err := st.SetQuota(Quota{Scope: QuotaScopeApp, ScopeID: "app1", MaxRunsPerDay: 3, MaxConcurrentRuns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sameID != id {
+		t.Fatalf("expected upsert to keep id %d, got %d", id, sameID)
+	}
+	quotas, err := st.ListQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas) != 1 || quotas[0].MaxRunsPerDay != 3 || quotas[0].MaxConcurrentRuns != 1 {
+		t.Fatalf("unexpected quotas: %+v", quotas)
+	}
+
+	runID, _ := st.CreateRun("app1", "", "admin")
+	_, _ = st.CreateRun("app1", "", "admin")
+	_, _ = st.CreateRun("app2", "", "admin")
+	if err := st.UpdateRunStatus(runID, "success", "done"); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := st.CountRunsSince([]string{"app1"}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 runs in the last day for app1, got %d", count)
+	}
+	active, err := st.CountActiveRuns([]string{"app1", "app2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active != 2 {
+		t.Fatalf("expected 2 active runs, got %d", active)
+	}
+
+	if err := st.DeleteQuota(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteQuota(id); err == nil {
+		t.Fatal("expected error deleting missing quota")
+	}
+}
+
+func TestStore_SoftDeleteRestoreAndPurgeRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trash.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	keep, err := st.CreateRun("app1", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := st.CreateRun("app1", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SoftDeleteRun(gone, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SoftDeleteRun(gone, "admin"); err != sql.ErrNoRows {
+		t.Fatalf("expected ErrNoRows deleting twice, got %v", err)
+	}
+	runs, err := st.ListRuns("app1", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].ID != keep {
+		t.Fatalf("expected only kept run listed, got %+v", runs)
+	}
+	if total, _ := st.CountRuns(""); total != 1 {
+		t.Fatalf("expected count 1, got %d", total)
+	}
+	run, err := st.GetRun(gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run == nil || run.DeletedAt == nil || run.DeletedBy != "admin" {
+		t.Fatalf("expected deleted run still readable with audit fields, got %+v", run)
+	}
+	deleted, err := st.ListDeletedRuns(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != gone {
+		t.Fatalf("unexpected deleted runs: %+v", deleted)
+	}
+
+	if err := st.RestoreRun(gone); err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := st.CountRuns("app1"); total != 2 {
+		t.Fatalf("expected restored run counted, got %d", total)
+	}
+
+	if err := st.SoftDeleteRun(gone, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.PurgeDeletedRuns(time.Hour); err != nil || n != 0 {
+		t.Fatalf("expected nothing purged yet, got %d, %v", n, err)
+	}
+	if n, err := st.PurgeDeletedRuns(0); err != nil || n != 1 {
+		t.Fatalf("expected one run purged, got %d, %v", n, err)
+	}
+	if run, _ := st.GetRun(gone); run != nil {
+		t.Fatalf("expected purged run gone, got %+v", run)
+	}
+}
+
+func TestStore_PinnedRunsSurviveDeletion(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "pins.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	pinned, _ := st.CreateRun("app1", "", "admin")
+	other, _ := st.CreateRun("app1", "", "admin")
+	if err := st.PinRun(pinned, "alice", "v2.0 release"); err != nil {
+		t.Fatal(err)
+	}
+	run, err := st.GetRun(pinned)
+	if err != nil || run.PinnedAt == nil || run.PinnedBy != "alice" || run.PinNote != "v2.0 release" {
+		t.Fatalf("expected pinned run, got %+v (%v)", run, err)
+	}
+	runs, err := st.ListRuns("app1", 10, 0)
+	if err != nil || len(runs) != 2 {
+		t.Fatalf("expected 2 runs, got %+v (%v)", runs, err)
+	}
+	for _, r := range runs {
+		if (r.PinnedAt != nil) != (r.ID == pinned) {
+			t.Fatalf("expected pinned_at only on the pinned run in listings, got %+v", runs)
+		}
+	}
+	pins, err := st.ListPinnedRuns(nil, 10, 0)
+	if err != nil || len(pins) != 1 || pins[0].ID != pinned || pins[0].PinNote != "v2.0 release" {
+		t.Fatalf("unexpected pinned runs %+v (%v)", pins, err)
+	}
+	if n, _ := st.CountPinnedRuns([]string{"app2"}); n != 0 {
+		t.Fatalf("expected no pinned runs of app2, got %d", n)
+	}
+	if pins, _ := st.ListPinnedRuns([]string{}, 10, 0); len(pins) != 0 {
+		t.Fatalf("expected no pinned runs for no apps, got %+v", pins)
+	}
+	if err := st.SoftDeleteRun(pinned, "admin"); err != sql.ErrNoRows {
+		t.Fatalf("expected pinned run not deletable, got %v", err)
+	}
+
+	if err := st.DeleteRunsByAppID("app1"); err != nil {
+		t.Fatal(err)
+	}
+	if run, _ := st.GetRun(other); run != nil {
+		t.Fatalf("expected unpinned run deleted, got %+v", run)
+	}
+	if run, _ := st.GetRun(pinned); run == nil {
+		t.Fatal("expected pinned run kept when its app's runs are deleted")
+	}
+
+	if err := st.UnpinRun(pinned); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UnpinRun(pinned); err != sql.ErrNoRows {
+		t.Fatalf("expected ErrNoRows unpinning twice, got %v", err)
+	}
+	if err := st.SoftDeleteRun(pinned, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.PinRun(pinned, "alice", ""); err != sql.ErrNoRows {
+		t.Fatalf("expected deleted run not pinnable, got %v", err)
+	}
+	if n, err := st.PurgeDeletedRuns(0); err != nil || n != 1 {
+		t.Fatalf("expected unpinned run purged, got %d, %v", n, err)
+	}
+}
+
+func TestStore_SearchRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	byCommit, err := st.CreateRun("app1", "abc123def", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byLog, err := st.CreateRun("app2", "fff000", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(byLog, "failed", "=== Step: test ===\npanic: connection refused to db\nexit 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := st.CreateRun("app1", "abc999", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SoftDeleteRun(deleted, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := st.SearchRuns("abc", nil, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != byCommit || hits[0].Matched != "commit_sha" {
+		t.Fatalf("unexpected commit hits: %+v", hits)
+	}
+	hits, err = st.SearchRuns("connection refused", nil, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Fatalf("expected log content ignored without includeLog, got %+v", hits)
+	}
+	hits, err = st.SearchRuns("connection refused", nil, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != byLog || hits[0].Matched != "log" || hits[0].Snippet != "panic: connection refused to db" {
+		t.Fatalf("unexpected log hits: %+v", hits)
+	}
+	if err := st.SetRunCommit(byLog, "fff000", "Fix rounding in invoice totals"); err != nil {
+		t.Fatal(err)
+	}
+	hits, err = st.SearchRuns("invoice total", nil, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != byLog || hits[0].Matched != "commit_message" || hits[0].CommitMessage != "Fix rounding in invoice totals" {
+		t.Fatalf("unexpected commit message hits: %+v", hits)
+	}
+	hits, err = st.SearchRuns("bob", []string{"app1"}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Fatalf("expected app filter to exclude app2, got %+v", hits)
+	}
+}
+
+func TestStore_AppTags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if err := st.SetAppTags("app1", []string{"go", "team:payments"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppTags("app2", []string{"team:payments"}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := st.AppIDsWithTags([]string{"team:payments", "go", "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "app1" {
+		t.Fatalf("expected only app1 to have both tags, got %v", ids)
+	}
+	all, err := st.AllAppTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all["app1"]) != 2 || len(all["app2"]) != 1 {
+		t.Fatalf("unexpected tags: %+v", all)
+	}
+	if err := st.SetAppTags("app1", nil); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := st.AppTags("app1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 {
+		t.Fatalf("expected tags cleared, got %v", tags)
+	}
+}
+
+func TestStore_Favorites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "favorites.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	for _, appID := range []string{"app2", "app1", "app2"} {
+		if err := st.AddFavorite(1, appID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.AddFavorite(2, "app1"); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := st.FavoriteAppIDs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "app2" || ids[1] != "app1" {
+		t.Fatalf("expected favorites in pin order, got %v", ids)
+	}
+	if err := st.RemoveFavorite(1, "app2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RemoveFavorite(1, "app2"); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows removing missing favorite, got %v", err)
+	}
+	if err := st.DeleteAppFavorites("app1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []int64{1, 2} {
+		ids, err := st.FavoriteAppIDs(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 0 {
+			t.Fatalf("expected no favorites for user %d, got %v", userID, ids)
+		}
+	}
+}
+
+func TestStore_RunCommentsRemovedWithRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "comments.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	runA, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runB, err := st.CreateRun("app-b", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, runID := range []int64{runA, runA, runB} {
+		if _, err := st.CreateRunComment(runID, "dev", "flaky"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comments, err := st.ListRunComments(runA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 || comments[0].Author != "dev" || comments[0].ID > comments[1].ID {
+		t.Fatalf("unexpected comments: %+v", comments)
+	}
+
+	if err := st.DeleteRunsByAppID("app-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SoftDeleteRun(runB, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.PurgeDeletedRuns(0); err != nil {
+		t.Fatal(err)
+	}
+	for _, runID := range []int64{runA, runB} {
+		comments, err := st.ListRunComments(runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) != 0 {
+			t.Fatalf("expected comments of run %d removed, got %+v", runID, comments)
+		}
+	}
+}
+
+func TestStore_RunStepUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := []RunStepUsage{
+		{Step: "test", DurationMs: 1500, CPUSeconds: 2.5, AvgCPUPercent: 160, PeakCPUPercent: 390, AvgRSSBytes: 1 << 20, PeakRSSBytes: 4 << 20, Samples: 2},
+		{Step: "build", DurationMs: 200, DiskWriteBytes: 4096},
+	}
+	if err := st.SetRunStepUsage(runID, usage); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.ListRunStepUsage(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != usage[0] || got[1] != usage[1] {
+		t.Fatalf("unexpected usage: %+v", got)
+	}
+	if err := st.DeleteRunsByAppID("app-a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.ListRunStepUsage(runID); err != nil || len(got) != 0 {
+		t.Fatalf("expected usage removed with run, got %+v (%v)", got, err)
+	}
+}
+
+func TestStore_RunFindings(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "findings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings := []RunFinding{
+		{Step: "scan", Tool: "trivy-image", ID: "CVE-2024-2", Package: "openssl", InstalledVersion: "3.0.1", FixedVersion: "3.0.2", Severity: "CRITICAL", Title: "overflow", Target: "alpine 3.19"},
+		{Step: "scan", Tool: "trivy-image", ID: "CVE-2024-1", Package: "zlib", InstalledVersion: "1.2", Severity: "LOW", Target: "alpine 3.19"},
+	}
+	if err := st.SetRunFindings(runID, findings); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.ListRunFindings(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != findings[0] || got[1] != findings[1] {
+		t.Fatalf("unexpected findings: %+v", got)
+	}
+	if err := st.DeleteRunsByAppID("app-a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.ListRunFindings(runID); err != nil || len(got) != 0 {
+		t.Fatalf("expected findings removed with run, got %+v (%v)", got, err)
+	}
+}
+
+func TestStore_AppDrift(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "drift.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if d, err := st.GetAppDrift("web"); err != nil || d != nil {
+		t.Fatalf("expected no drift record, got %+v (%v)", d, err)
+	}
+	if err := st.SetAppDeployed("web", 1, []string{"deployment.apps/web", "service/web"}); err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := st.SetAppDriftResult("web", 1, DriftDrifted, "-replicas: 3", "", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppDriftResult("web", 1, DriftDrifted, "-replicas: 2", "", first.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := st.GetAppDrift("web")
+	if err != nil || d == nil {
+		t.Fatalf("get drift: %+v (%v)", d, err)
+	}
+	if d.Status != DriftDrifted || d.Diff != "-replicas: 2" || len(d.Resources) != 2 || d.DriftedSince == nil || !d.DriftedSince.Equal(first) || !d.CheckedAt.Equal(first.Add(time.Hour)) {
+		t.Fatalf("unexpected drift record %+v", d)
+	}
+	if err := st.SetAppDeployed("web", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetAppDriftResult("web", 1, DriftInSync, "", "", first); err != sql.ErrNoRows {
+		t.Fatalf("expected a result for an older deploy to be refused, got %v", err)
+	}
+	if err := st.SetAppDriftResult("web", 2, DriftInSync, "", "", first); err != nil {
+		t.Fatal(err)
+	}
+	list, err := st.ListAppDrift([]string{"web", "api"})
+	if err != nil || len(list) != 1 || list[0].Status != DriftInSync || list[0].DriftedSince != nil || len(list[0].Resources) != 0 {
+		t.Fatalf("unexpected drift list %+v (%v)", list, err)
+	}
+	if err := st.DeleteAppDrift("web"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := st.ListAppDrift(nil); err != nil || len(list) != 0 {
+		t.Fatalf("expected drift record deleted, got %+v (%v)", list, err)
+	}
+}
+
+func TestStore_PreviewEnvs(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "previews.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	id, err := st.SavePreviewEnv("web", "feature/a", "web-feature-a", "https://a.example.com", 1, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := st.SavePreviewEnv("web", "feature/a", "web-feature-a", "https://a.example.com", 2, now.Add(time.Minute), now.Add(2*time.Hour))
+	if err != nil || again != id {
+		t.Fatalf("expected the active preview updated, got %d (%v)", again, err)
+	}
+	if _, err := st.SavePreviewEnv("web", "feature/b", "web-feature-b", "", 3, now, now.Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := st.ActivePreviewEnv("web", "feature/a")
+	if err != nil || p == nil || p.LastRunID != 2 || !p.ExpiresAt.Equal(now.Add(2*time.Hour)) || !p.CreatedAt.Equal(now) || p.Status != PreviewActive {
+		t.Fatalf("unexpected preview %+v (%v)", p, err)
+	}
+	expired, err := st.ExpiredPreviewEnvs(now.Add(150 * time.Minute))
+	if err != nil || len(expired) != 1 || expired[0].ID != id {
+		t.Fatalf("expected feature/a expired, got %+v (%v)", expired, err)
+	}
+	if err := st.MarkPreviewEnvDeleted(id, "ttl", now.Add(150*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.MarkPreviewEnvDeleted(id, "ttl", now.Add(150*time.Minute)); err != sql.ErrNoRows {
+		t.Fatalf("expected a deleted preview not to be deleted again, got %v", err)
+	}
+	if p, err := st.ActivePreviewEnv("web", "feature/a"); err != nil || p != nil {
+		t.Fatalf("expected no active preview, got %+v (%v)", p, err)
+	}
+	if p, err := st.GetPreviewEnv(id); err != nil || p == nil || p.Status != PreviewDeleted || p.DeleteReason != "ttl" || p.DeletedAt == nil {
+		t.Fatalf("unexpected deleted preview %+v (%v)", p, err)
+	}
+	if list, err := st.ListPreviewEnvs([]string{"web"}, PreviewActive); err != nil || len(list) != 1 || list[0].Branch != "feature/b" {
+		t.Fatalf("unexpected active previews %+v (%v)", list, err)
+	}
+	if list, err := st.ListPreviewEnvs(nil, ""); err != nil || len(list) != 2 {
+		t.Fatalf("unexpected previews %+v (%v)", list, err)
+	}
+	if err := st.DeleteAppPreviewEnvs("web"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := st.ListPreviewEnvs(nil, ""); err != nil || len(list) != 0 {
+		t.Fatalf("expected previews deleted, got %+v (%v)", list, err)
+	}
+}
+
+func TestStore_K8sDebugHolds(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "holds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, h := range []K8sDebugHold{
+		{RunID: 1, AppID: "web", Namespace: "apps", Job: "noppflow-run-1", Pod: "noppflow-run-1-abcde", ExpiresAt: now.Add(time.Minute)},
+		{RunID: 1, AppID: "web", Namespace: "apps", Job: "noppflow-run-1", Pod: "noppflow-run-1-fghij", ExpiresAt: now.Add(time.Hour)},
+		{RunID: 2, AppID: "web", Namespace: "apps", Job: "noppflow-run-2", Pod: "noppflow-run-2-abcde", ExpiresAt: now.Add(time.Minute)},
+	} {
+		if err := st.SaveK8sDebugHold(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h, err := st.GetK8sDebugHold(1, now); err != nil || h == nil || h.Pod != "noppflow-run-1-fghij" || !h.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected the later hold of run 1, got %+v (%v)", h, err)
+	}
+	if h, err := st.GetK8sDebugHold(2, now.Add(2*time.Minute)); err != nil || h != nil {
+		t.Fatalf("expected the hold of run 2 expired, got %+v (%v)", h, err)
+	}
+	if err := st.DeleteExpiredK8sDebugHolds(now.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := st.GetK8sDebugHold(2, now); err != nil || h != nil {
+		t.Fatalf("expected the expired hold deleted, got %+v (%v)", h, err)
+	}
+	if err := st.DeleteK8sDebugHold(1); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := st.GetK8sDebugHold(1, now); err != nil || h != nil {
+		t.Fatalf("expected the hold released, got %+v (%v)", h, err)
+	}
+}
+
+func TestStore_MaintenanceAndHeldRuns(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "maintenance.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if m, err := st.GetMaintenance(); err != nil || m != nil {
+		t.Fatalf("expected maintenance mode off, got %+v (%v)", m, err)
+	}
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, m := range []Maintenance{{Message: "DB upgrade", Since: since, By: "admin"}, {QueueRuns: true, Since: since, By: "ops"}} {
+		if err := st.SetMaintenance(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err := st.GetMaintenance(); err != nil || m == nil || m.Message != "" || !m.QueueRuns || m.By != "ops" || !m.Since.Equal(since) {
+		t.Fatalf("expected the later switch, got %+v (%v)", m, err)
+	}
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, err := st.CreateRun("web", "", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.HoldRun(id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := st.MarkRunInterrupted(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.CountHeldRuns(); err != nil || n != 2 {
+		t.Fatalf("expected the 2 pending held runs counted, got %d (%v)", n, err)
+	}
+	if err := st.DeleteHeldRuns(ids[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.CountHeldRuns(); err != nil || n != 1 {
+		t.Fatalf("expected 1 held run left, got %d (%v)", n, err)
+	}
+
+	if err := st.ClearMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := st.GetMaintenance(); err != nil || m != nil {
+		t.Fatalf("expected maintenance mode off, got %+v (%v)", m, err)
+	}
+}
+
+func TestStore_RunIssuesAndJiraSettings(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "jira.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	now := time.Now().UTC()
+	shaA, shaB := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	if _, err := st.CreateFinishedRun("app-a", shaA, "admin", "success", now.Add(-time.Hour), now.Add(-50*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateFinishedRun("app-a", shaB, "admin", "failed", now.Add(-40*time.Minute), now.Add(-30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	runID, err := st.CreateRun("app-a", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha, err := st.PreviousRunCommit("app-a", runID); err != nil || sha != shaA {
+		t.Fatalf("expected the last successful commit, got %q (%v)", sha, err)
+	}
+	if sha, err := st.PreviousRunCommit("app-b", runID); err != nil || sha != "" {
+		t.Fatalf("expected no previous commit, got %q (%v)", sha, err)
+	}
+
+	if err := st.SetRunIssues(runID, []string{"PAY-2", "OPS-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.ListRunIssues(runID); err != nil || strings.Join(got, ",") != "PAY-2,OPS-1" {
+		t.Fatalf("unexpected issues %v (%v)", got, err)
+	}
+	if err := st.DeleteRunsByAppID("app-a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.ListRunIssues(runID); err != nil || len(got) != 0 {
+		t.Fatalf("expected issues removed with run, got %v (%v)", got, err)
+	}
+
+	if js, err := st.GetJiraSettings(); err != nil || js != nil {
+		t.Fatalf("expected no settings, got %+v (%v)", js, err)
+	}
+	want := JiraSettings{BaseURL: "https://acme.atlassian.net", Username: "ci@acme.io", Token: "t1", Environments: []JiraEnvironment{{Environment: "prod", Comment: true, Transition: "Done"}}}
+	if err := st.SetJiraSettings(want); err != nil {
+		t.Fatal(err)
+	}
+	want.Token = "t2"
+	if err := st.SetJiraSettings(want); err != nil {
+		t.Fatal(err)
+	}
+	js, err := st.GetJiraSettings()
+	if err != nil || js == nil {
+		t.Fatalf("expected settings, got %v", err)
+	}
+	if js.BaseURL != want.BaseURL || js.Token != "t2" || len(js.Environments) != 1 || js.Environments[0] != want.Environments[0] || js.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected settings %+v", js)
+	}
+	if err := st.DeleteJiraSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if js, err := st.GetJiraSettings(); err != nil || js != nil {
+		t.Fatalf("expected settings removed, got %+v (%v)", js, err)
+	}
+}
+
+func TestStore_RunHeartbeats(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "heartbeat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	alive, err := st.CreateRun("app1", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := st.CreateRun("app1", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(done, "success", ""); err != nil {
+		t.Fatal(err)
+	}
+	if run, _ := st.GetRun(alive); run.HeartbeatAt != nil {
+		t.Fatalf("expected no heartbeat yet, got %v", run.HeartbeatAt)
+	}
+	if err := st.TouchRunHeartbeats([]int64{alive, done}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.TouchRunHeartbeats(nil); err != nil {
+		t.Fatal(err)
+	}
+	if run, _ := st.GetRun(alive); run.HeartbeatAt == nil {
+		t.Fatal("expected heartbeat recorded")
+	}
+	if runs, err := st.LiveRuns(time.Hour); err != nil || len(runs) != 1 || runs[0].ID != alive {
+		t.Fatalf("expected run %d live, got %+v (%v)", alive, runs, err)
+	}
+	if runs, err := st.StaleRuns(time.Hour); err != nil || len(runs) != 0 {
+		t.Fatalf("expected no stale runs, got %+v (%v)", runs, err)
+	}
+	if runs, err := st.StaleRuns(0); err != nil || len(runs) != 1 || runs[0].ID != alive || runs[0].AppID != "app1" {
+		t.Fatalf("expected run %d stale, got %+v (%v)", alive, runs, err)
+	}
+}
+
+func TestStore_SessionsAndLeases(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	now := time.Now()
+	if err := st.CreateSession(Session{TokenHash: "live", UserID: 7, Username: "ann", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CreateSession(Session{TokenHash: "old", UserID: 8, Username: "bob", IsAdmin: true, ExpiresAt: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if sess, err := st.GetSession("live"); err != nil || sess == nil || sess.UserID != 7 || sess.Username != "ann" || sess.IsAdmin {
+		t.Fatalf("unexpected session %+v (%v)", sess, err)
+	}
+	if n, err := st.DeleteExpiredSessions(now); err != nil || n != 1 {
+		t.Fatalf("expected one expired session deleted, got %d (%v)", n, err)
+	}
+	if err := st.DeleteUserSessions(7); err != nil {
+		t.Fatal(err)
+	}
+	if sess, err := st.GetSession("live"); err != nil || sess != nil {
+		t.Fatalf("expected session deleted, got %+v (%v)", sess, err)
+	}
+
+	if ok, err := st.AcquireLease("scheduler", "a", time.Minute, now); err != nil || !ok {
+		t.Fatalf("expected a to take the free lease, got %v (%v)", ok, err)
+	}
+	if ok, err := st.AcquireLease("scheduler", "b", time.Minute, now); err != nil || ok {
+		t.Fatalf("expected b to be refused, got %v (%v)", ok, err)
+	}
+	if ok, err := st.AcquireLease("scheduler", "a", time.Minute, now); err != nil || !ok {
+		t.Fatalf("expected a to renew, got %v (%v)", ok, err)
+	}
+	later := now.Add(2 * time.Minute)
+	if holder, err := st.LeaseHolder("scheduler", later); err != nil || holder != "" {
+		t.Fatalf("expected expired lease to be free, got %q (%v)", holder, err)
+	}
+	if ok, err := st.AcquireLease("scheduler", "b", time.Minute, later); err != nil || !ok {
+		t.Fatalf("expected b to take over the expired lease, got %v (%v)", ok, err)
+	}
+	if holder, _ := st.LeaseHolder("scheduler", later); holder != "b" {
+		t.Fatalf("expected b to hold the lease, got %q", holder)
+	}
+}
+
+func TestStore_PureGoSQLiteDriverSharesDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.db")
+	st, err := New("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.CreateRun("my-app", "abc123", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(id, "success", "done"); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	st, err = New("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if st.Driver() != "sqlite" {
+		t.Fatalf("expected driver sqlite, got %q", st.Driver())
+	}
+	run, err := st.GetRun(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run == nil || run.Status != "success" || run.Log != "done" || run.EndedAt == nil || time.Since(run.StartedAt) > time.Minute {
+		t.Fatalf("unexpected run %+v", run)
+	}
+	// Times bound by the pure-Go driver must compare with datetime('now') like go-sqlite3's.
+	now := time.Now()
+	if _, err := st.CreateFinishedRun("other-app", "old", "admin", "success", now.Add(-2*time.Hour), now.Add(-110*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateFinishedRun("other-app", "new", "admin", "failed", now.Add(-10*time.Minute), now.Add(-5*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.CountRunsSince([]string{"other-app"}, time.Hour); err != nil || n != 1 {
+		t.Fatalf("expected 1 run of other-app in the last hour, got %d (%v)", n, err)
+	}
+	hits, err := st.SearchRuns("done", nil, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != id {
+		t.Fatalf("expected log search to find run %d, got %+v", id, hits)
+	}
+}
+
+func TestMySQLUTCDSN(t *testing.T) {
+	dsn, err := mysqlUTCDSN("user:pw@tcp(db:3306)/ci?loc=Local&time_zone=%27Europe%2FBerlin%27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.ParseTime || cfg.Loc != time.UTC || cfg.Params["time_zone"] != "'+00:00'" || cfg.DBName != "ci" {
+		t.Fatalf("unexpected config from %s: %+v", dsn, cfg)
+	}
+	if zone := mysqlDSNTimeZone("user:pw@tcp(db:3306)/ci?time_zone=%27Europe%2FBerlin%27"); zone != "Europe/Berlin" {
+		t.Fatalf("expected the DSN time zone, got %q", zone)
+	}
+	if zone := mysqlDSNTimeZone("user:pw@tcp(db:3306)/ci"); zone != "" {
+		t.Fatalf("expected no DSN time zone, got %q", zone)
+	}
+}
+
+func TestStore_CommitGroups(t *testing.T) {
+	st, err := New("sqlite3", filepath.Join(t.TempDir(), "groups.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	now := time.Now().UTC().Truncate(time.Second)
+	shaA, shaB := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	failed, _ := st.CreateFinishedRun("app1", shaA, "webhook", "failed", now.Add(-time.Hour), now.Add(-50*time.Minute))
+	retry, _ := st.CreateFinishedRun("app1", shaA, "admin", "success", now.Add(-40*time.Minute), now.Add(-30*time.Minute))
+	other, _ := st.CreateFinishedRun("app2", shaA, "webhook", "success", now.Add(-20*time.Minute), now.Add(-10*time.Minute))
+	noCommit, _ := st.CreateRun("app1", "", "admin")
+	running, _ := st.CreateRun("app1", "", "webhook")
+	if err := st.SetRunCommit(running, shaB, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateRunStatus(running, "running", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := st.ListCommitGroups(nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 4 {
+		t.Fatalf("expected 4 groups, got %+v", groups)
+	}
+	if g := groups[0]; g.CommitSHA != shaB || g.Status != "running" || g.Count != 1 || g.Runs[0].ID != running {
+		t.Fatalf("unexpected first group %+v", g)
+	}
+	if g := groups[1]; g.CommitSHA != "" || g.Count != 1 || g.Runs[0].ID != noCommit || g.Status != "pending" {
+		t.Fatalf("expected the run without commit alone, got %+v", g)
+	}
+	if g := groups[2]; g.AppID != "app2" || g.Runs[0].ID != other {
+		t.Fatalf("expected app2 group, got %+v", g)
+	}
+	g := groups[3]
+	if g.AppID != "app1" || g.CommitSHA != shaA || g.Count != 2 || g.Status != "success" ||
+		g.Runs[0].ID != retry || g.Runs[1].ID != failed || g.Statuses["failed"] != 1 || g.Statuses["success"] != 1 {
+		t.Fatalf("expected retried commit grouped with the retry's status, got %+v", g)
+	}
+	if total, err := st.CountCommitGroups(nil); err != nil || total != 4 {
+		t.Fatalf("expected 4 groups in total, got %d (%v)", total, err)
+	}
+
+	groups, err = st.ListCommitGroups([]string{"app1"}, 1, 1)
+	if err != nil || len(groups) != 1 || groups[0].Runs[0].ID != noCommit {
+		t.Fatalf("expected second app1 group, got %+v (%v)", groups, err)
+	}
+	if total, err := st.CountCommitGroups([]string{"app1"}); err != nil || total != 3 {
+		t.Fatalf("expected 3 app1 groups, got %d (%v)", total, err)
+	}
+	if groups, err := st.ListCommitGroups([]string{}, 10, 0); err != nil || len(groups) != 0 {
+		t.Fatalf("expected no groups for no apps, got %+v (%v)", groups, err)
+	}
+}
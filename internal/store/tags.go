@@ -0,0 +1,99 @@
+package store
+
+import "fmt"
+
+// AppTags returns the tags of an app, sorted.
+func (s *Store) AppTags(appID string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT tag FROM app_tags WHERE app_id = ? ORDER BY tag`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		out = append(out, tag)
+	}
+	return out, rows.Err()
+}
+
+// AllAppTags returns the tags of every tagged app, keyed by app ID.
+func (s *Store) AllAppTags() (map[string][]string, error) {
+	rows, err := s.db.Query(`SELECT app_id, tag FROM app_tags ORDER BY app_id, tag`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]string)
+	for rows.Next() {
+		var appID, tag string
+		if err := rows.Scan(&appID, &tag); err != nil {
+			return nil, err
+		}
+		out[appID] = append(out[appID], tag)
+	}
+	return out, rows.Err()
+}
+
+// SetAppTags replaces all tags for an app.
+func (s *Store) SetAppTags(appID string, tags []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM app_tags WHERE app_id = ?`, appID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec(`INSERT INTO app_tags (app_id, tag) VALUES (?, ?)`, appID, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AppIDsWithTags returns the IDs of apps that have all the given tags.
+func (s *Store) AppIDsWithTags(tags []string) ([]string, error) {
+	unique := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		if _, ok := seen[tag]; !ok {
+			seen[tag] = struct{}{}
+			unique = append(unique, tag)
+		}
+	}
+	tags = unique
+	if len(tags) == 0 {
+		return []string{}, nil
+	}
+	placeholders, args := inPlaceholders(tags)
+	args = append(args, len(tags))
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT app_id FROM app_tags WHERE tag IN (%s)
+		GROUP BY app_id HAVING COUNT(*) = ? ORDER BY app_id
+	`, placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]string, 0)
+	for rows.Next() {
+		var appID string
+		if err := rows.Scan(&appID); err != nil {
+			return nil, err
+		}
+		out = append(out, appID)
+	}
+	return out, rows.Err()
+}
+
+// DeleteAppTags removes all tags of an app (used when the app is deleted).
+func (s *Store) DeleteAppTags(appID string) error {
+	_, err := s.db.Exec(`DELETE FROM app_tags WHERE app_id = ?`, appID)
+	return err
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TrainRun is one run of a release train. Status is running, success, or failed; Stage is the
+// index of the last stage whose runs were started (-1 before the first). Runs lists the app runs
+// of the started stages with their current status (GetTrainRun only).
+type TrainRun struct {
+	ID          int64             `json:"id"`
+	Train       string            `json:"train"`
+	Status      string            `json:"status"`
+	Stage       int               `json:"stage"`
+	Params      map[string]string `json:"params"`
+	Error       string            `json:"error,omitempty"`
+	TriggeredBy string            `json:"triggered_by"`
+	StartedAt   time.Time         `json:"started_at"`
+	EndedAt     *time.Time        `json:"ended_at,omitempty"`
+	Runs        []TrainRunRun     `json:"runs,omitempty"`
+}
+
+// TrainRunRun is the run of one app started by a train run.
+type TrainRunRun struct {
+	Stage  int    `json:"stage"`
+	AppID  string `json:"app_id"`
+	RunID  int64  `json:"run_id"`
+	Status string `json:"status"`
+}
+
+// CreateTrainRun records a started train run and returns its ID.
+func (s *Store) CreateTrainRun(train, triggeredBy string, params map[string]string) (int64, error) {
+	if params == nil {
+		params = map[string]string{}
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(fmt.Sprintf(`INSERT INTO train_runs (train, status, stage, params, error, triggered_by, started_at) VALUES (?, 'running', -1, ?, '', ?, %s)`, s.nowExpr()),
+		train, string(data), triggeredBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// AdvanceTrainRun moves a running train run from stage from to stage to and reports whether it
+// did; false means another server advanced or finished it first.
+func (s *Store) AdvanceTrainRun(id int64, from, to int) (bool, error) {
+	res, err := s.db.Exec(`UPDATE train_runs SET stage = ? WHERE id = ? AND stage = ? AND status = 'running'`, to, id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// AddTrainRunRun records the run of an app started by a train run in stage.
+func (s *Store) AddTrainRunRun(trainRunID int64, stage int, appID string, runID int64) error {
+	_, err := s.db.Exec(`INSERT INTO train_run_runs (train_run_id, stage, app_id, run_id) VALUES (?, ?, ?, ?)`, trainRunID, stage, appID, runID)
+	return err
+}
+
+// FinishTrainRun ends a running train run with status and an optional error message; finishing
+// one that already ended does nothing.
+func (s *Store) FinishTrainRun(id int64, status, errMsg string) error {
+	_, err := s.db.Exec(fmt.Sprintf(`UPDATE train_runs SET status = ?, error = ?, ended_at = %s WHERE id = ? AND status = 'running'`, s.nowExpr()),
+		status, errMsg, id)
+	return err
+}
+
+const trainRunColumns = `id, train, status, stage, params, error, triggered_by, started_at, ended_at`
+
+func scanTrainRun(row interface{ Scan(...interface{}) error }) (TrainRun, error) {
+	var tr TrainRun
+	var params string
+	var endedAt sql.NullTime
+	if err := row.Scan(&tr.ID, &tr.Train, &tr.Status, &tr.Stage, &params, &tr.Error, &tr.TriggeredBy, &tr.StartedAt, &endedAt); err != nil {
+		return tr, err
+	}
+	if endedAt.Valid {
+		tr.EndedAt = &endedAt.Time
+	}
+	tr.Params = map[string]string{}
+	if err := json.Unmarshal([]byte(params), &tr.Params); err != nil {
+		return tr, fmt.Errorf("train run %d: params: %w", tr.ID, err)
+	}
+	return tr, nil
+}
+
+// GetTrainRun returns a train run with its app runs, or nil.
+func (s *Store) GetTrainRun(id int64) (*TrainRun, error) {
+	tr, err := scanTrainRun(s.db.QueryRow(`SELECT `+trainRunColumns+` FROM train_runs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`
+		SELECT t.stage, t.app_id, t.run_id, COALESCE(r.status,'')
+		FROM train_run_runs t LEFT JOIN runs r ON r.id = t.run_id
+		WHERE t.train_run_id = ? ORDER BY t.stage, t.app_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tr.Runs = make([]TrainRunRun, 0)
+	for rows.Next() {
+		var r TrainRunRun
+		if err := rows.Scan(&r.Stage, &r.AppID, &r.RunID, &r.Status); err != nil {
+			return nil, err
+		}
+		tr.Runs = append(tr.Runs, r)
+	}
+	return &tr, rows.Err()
+}
+
+// ListTrainRuns returns the runs of a train, newest first, without their app runs.
+func (s *Store) ListTrainRuns(train string, limit, offset int) ([]TrainRun, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := s.db.Query(`SELECT `+trainRunColumns+` FROM train_runs WHERE train = ? ORDER BY id DESC LIMIT ? OFFSET ?`, train, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]TrainRun, 0)
+	for rows.Next() {
+		tr, err := scanTrainRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tr)
+	}
+	return out, rows.Err()
+}
+
+// RunningTrainRunIDs returns the IDs of the train runs that have not ended.
+func (s *Store) RunningTrainRunIDs() ([]int64, error) {
+	rows, err := s.db.Query(`SELECT id FROM train_runs WHERE status = 'running' ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
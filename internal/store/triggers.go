@@ -0,0 +1,116 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RunTrigger is an inbound trigger token of an app. Only the SHA-256 hash of the token is stored.
+type RunTrigger struct {
+	ID        int64     `json:"id"`
+	AppID     string    `json:"app_id"`
+	Name      string    `json:"name"`
+	TokenHash string    `json:"-"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateRunTrigger stores a trigger and returns its ID.
+func (s *Store) CreateRunTrigger(t RunTrigger) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO run_triggers (app_id, name, token_hash, created_by) VALUES (?, ?, ?, ?)`, t.AppID, t.Name, t.TokenHash, t.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListRunTriggers returns an app's triggers ordered by name.
+func (s *Store) ListRunTriggers(appID string) ([]RunTrigger, error) {
+	rows, err := s.db.Query(`SELECT id, app_id, name, token_hash, created_by, created_at FROM run_triggers WHERE app_id = ? ORDER BY name, id`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunTrigger, 0)
+	for rows.Next() {
+		var t RunTrigger
+		if err := rows.Scan(&t.ID, &t.AppID, &t.Name, &t.TokenHash, &t.CreatedBy, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// GetRunTriggerByTokenHash returns the trigger with the given token hash, or nil.
+func (s *Store) GetRunTriggerByTokenHash(hash string) (*RunTrigger, error) {
+	var t RunTrigger
+	err := s.db.QueryRow(`SELECT id, app_id, name, token_hash, created_by, created_at FROM run_triggers WHERE token_hash = ?`, hash).
+		Scan(&t.ID, &t.AppID, &t.Name, &t.TokenHash, &t.CreatedBy, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteRunTrigger deletes a trigger of an app and its delivery records.
+func (s *Store) DeleteRunTrigger(appID string, id int64) error {
+	res, err := s.db.Exec(`DELETE FROM run_triggers WHERE id = ? AND app_id = ?`, id, appID)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM trigger_deliveries WHERE trigger_id = ?`, id)
+	return err
+}
+
+// DeleteAppRunTriggers deletes all triggers of an app and their delivery records.
+func (s *Store) DeleteAppRunTriggers(appID string) error {
+	if _, err := s.db.Exec(`DELETE FROM trigger_deliveries WHERE trigger_id IN (SELECT id FROM run_triggers WHERE app_id = ?)`, appID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM run_triggers WHERE app_id = ?`, appID)
+	return err
+}
+
+// ReserveTriggerDelivery claims an idempotency key for a trigger. It returns claimed=false and the
+// run of the earlier delivery (0 while that delivery is still starting) when the key was already used
+// within ttl; older keys are forgotten.
+func (s *Store) ReserveTriggerDelivery(triggerID int64, key string, ttl time.Duration) (claimed bool, runID int64, err error) {
+	if _, err := s.db.Exec(fmt.Sprintf(`DELETE FROM trigger_deliveries WHERE trigger_id = ? AND created_at < %s`, s.agoExpr(ttl)), triggerID); err != nil {
+		return false, 0, err
+	}
+	insert := `INSERT OR IGNORE INTO trigger_deliveries (trigger_id, idempotency_key) VALUES (?, ?)`
+	if s.driver == "mysql" {
+		insert = `INSERT IGNORE INTO trigger_deliveries (trigger_id, idempotency_key) VALUES (?, ?)`
+	}
+	res, err := s.db.Exec(insert, triggerID, key)
+	if err != nil {
+		return false, 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, 0, err
+	} else if n == 1 {
+		return true, 0, nil
+	}
+	err = s.db.QueryRow(`SELECT run_id FROM trigger_deliveries WHERE trigger_id = ? AND idempotency_key = ?`, triggerID, key).Scan(&runID)
+	return false, runID, err
+}
+
+// CompleteTriggerDelivery records the run started for a reserved idempotency key.
+func (s *Store) CompleteTriggerDelivery(triggerID int64, key string, runID int64) error {
+	_, err := s.db.Exec(`UPDATE trigger_deliveries SET run_id = ? WHERE trigger_id = ? AND idempotency_key = ?`, runID, triggerID, key)
+	return err
+}
+
+// ReleaseTriggerDelivery forgets a reserved key whose run could not be started, so a retry can start it.
+func (s *Store) ReleaseTriggerDelivery(triggerID int64, key string) error {
+	_, err := s.db.Exec(`DELETE FROM trigger_deliveries WHERE trigger_id = ? AND idempotency_key = ?`, triggerID, key)
+	return err
+}
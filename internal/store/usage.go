@@ -0,0 +1,61 @@
+package store
+
+// RunStepUsage is the resource usage recorded for one step of a run (see pipeline.StepUsage).
+type RunStepUsage struct {
+	Step           string  `json:"step"`
+	DurationMs     int64   `json:"duration_ms"`
+	CPUSeconds     float64 `json:"cpu_seconds"`
+	AvgCPUPercent  float64 `json:"avg_cpu_percent"`
+	PeakCPUPercent float64 `json:"peak_cpu_percent"`
+	AvgRSSBytes    int64   `json:"avg_rss_bytes"`
+	PeakRSSBytes   int64   `json:"peak_rss_bytes"`
+	DiskReadBytes  int64   `json:"disk_read_bytes"`
+	DiskWriteBytes int64   `json:"disk_write_bytes"`
+	Samples        int     `json:"samples"`
+}
+
+// SetRunStepUsage replaces the step usage of a run; usage is stored in step order.
+func (s *Store) SetRunStepUsage(runID int64, usage []RunStepUsage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM run_step_usage WHERE run_id = ?`, runID); err != nil {
+		return err
+	}
+	for i, u := range usage {
+		if _, err := tx.Exec(`
+			INSERT INTO run_step_usage (run_id, position, step, duration_ms, cpu_seconds, avg_cpu_percent, peak_cpu_percent,
+				avg_rss_bytes, peak_rss_bytes, disk_read_bytes, disk_write_bytes, samples)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, runID, i, u.Step, u.DurationMs, u.CPUSeconds, u.AvgCPUPercent, u.PeakCPUPercent,
+			u.AvgRSSBytes, u.PeakRSSBytes, u.DiskReadBytes, u.DiskWriteBytes, u.Samples); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListRunStepUsage returns the step usage of a run in step order.
+func (s *Store) ListRunStepUsage(runID int64) ([]RunStepUsage, error) {
+	rows, err := s.db.Query(`
+		SELECT step, duration_ms, cpu_seconds, avg_cpu_percent, peak_cpu_percent, avg_rss_bytes, peak_rss_bytes,
+			disk_read_bytes, disk_write_bytes, samples
+		FROM run_step_usage WHERE run_id = ? ORDER BY position
+	`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]RunStepUsage, 0)
+	for rows.Next() {
+		var u RunStepUsage
+		if err := rows.Scan(&u.Step, &u.DurationMs, &u.CPUSeconds, &u.AvgCPUPercent, &u.PeakCPUPercent, &u.AvgRSSBytes,
+			&u.PeakRSSBytes, &u.DiskReadBytes, &u.DiskWriteBytes, &u.Samples); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
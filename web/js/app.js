@@ -68,6 +68,12 @@ async function getApps() {
   return res.json();
 }
 
+async function getAppsOverview() {
+  const res = await fetchApi('/apps/overview');
+  if (!res.ok) return [];
+  return res.json();
+}
+
 async function triggerRun(appId) {
   const res = await fetchApi(`/apps/${encodeURIComponent(appId)}/run`, {
     method: 'POST',
@@ -163,6 +169,32 @@ async function createUser(user) {
   return res.json();
 }
 
+async function inviteUser(invite) {
+  const res = await fetchApi('/users/invite', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(invite),
+  });
+  if (!res.ok) {
+    const err = await res.json().catch(() => ({}));
+    throw new Error(err.error || 'Failed to invite user');
+  }
+  return res.json();
+}
+
+async function acceptInvite(token, password) {
+  const res = await fetchApi('/users/accept-invite', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ token, password }),
+  });
+  if (!res.ok) {
+    const err = await res.json().catch(() => ({}));
+    throw new Error(err.error || 'Failed to accept invite');
+  }
+  return res.json();
+}
+
 async function setUserGroups(userId, groupIds) {
   const res = await fetchApi(`/users/${encodeURIComponent(String(userId))}/groups`, {
     method: 'PUT',
@@ -256,6 +288,19 @@ async function setGroupApps(groupId, appIds) {
   return res.json();
 }
 
+async function setGroupLanding(groupId, page, appIds) {
+  const res = await fetchApi(`/groups/${encodeURIComponent(String(groupId))}/landing`, {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ page, app_ids: appIds }),
+  });
+  if (!res.ok) {
+    const err = await res.json().catch(() => ({}));
+    throw new Error(err.error || 'Failed to update group landing');
+  }
+  return res.json();
+}
+
 async function getAppGroups(appId) {
   const res = await fetchApi(`/apps/${encodeURIComponent(appId)}/groups`);
   if (!res.ok) {
@@ -310,6 +355,33 @@ async function deleteSSHKeyById(keyId) {
   }
 }
 
+async function getGitProviders() {
+  const res = await fetchApi('/git-providers');
+  if (!res.ok) {
+    const err = await res.json().catch(() => ({}));
+    throw new Error(err.error || 'Failed to load git providers');
+  }
+  return res.json();
+}
+
+async function getProviderRepos(providerId, owner) {
+  const res = await fetchApi(`/git-providers/${encodeURIComponent(String(providerId))}/repos?owner=${encodeURIComponent(owner)}`);
+  if (!res.ok) {
+    const err = await res.json().catch(() => ({}));
+    throw new Error(err.error || 'Failed to list repositories');
+  }
+  return res.json();
+}
+
+async function getProviderBranches(providerId, repo) {
+  const res = await fetchApi(`/git-providers/${encodeURIComponent(String(providerId))}/branches?repo=${encodeURIComponent(repo)}`);
+  if (!res.ok) {
+    const err = await res.json().catch(() => ({}));
+    throw new Error(err.error || 'Failed to list branches');
+  }
+  return res.json();
+}
+
 async function getEnvVars() {
   const res = await fetchApi('/env-vars');
   if (!res.ok) {
@@ -377,7 +449,29 @@ function statusClass(status) {
   }
 }
 
-function formatDate(iso) {
+// Timezone times are shown in: the server's -timezone (from /api/status), or per app its
+// timezone (from /api/apps). Empty means the browser's timezone.
+let displayTimeZone = '';
+let appTimeZones = null;
+
+async function loadDisplayTimeZone() {
+  try {
+    const res = await fetch('/api/status', { credentials: 'same-origin' });
+    if (res.ok) displayTimeZone = (await res.json()).timezone || '';
+  } catch (_) {}
+}
+
+async function loadAppTimeZones() {
+  if (appTimeZones) return;
+  appTimeZones = {};
+  try {
+    const res = await fetch('/api/apps', { credentials: 'same-origin' });
+    if (!res.ok) return;
+    (await res.json()).forEach(app => { if (app.timezone) appTimeZones[app.id] = app.timezone; });
+  } catch (_) {}
+}
+
+function formatDate(iso, timeZone) {
   if (!iso) return '—';
   const d = new Date(iso);
   const now = new Date();
@@ -385,7 +479,9 @@ function formatDate(iso) {
   if (diff < 60000) return 'Just now';
   if (diff < 3600000) return `${Math.floor(diff / 60000)}m ago`;
   if (diff < 86400000) return `${Math.floor(diff / 3600000)}h ago`;
-  return d.toLocaleDateString() + ' ' + d.toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+  const tz = timeZone || displayTimeZone;
+  const opts = tz ? { timeZone: tz } : {};
+  return d.toLocaleDateString([], opts) + ' ' + d.toLocaleTimeString([], { ...opts, hour: '2-digit', minute: '2-digit' });
 }
 
 function formatDuration(run) {
@@ -415,6 +511,8 @@ function renderApps(container, apps) {
     <article class="app-card" data-app-id="${escapeHtml(app.id)}">
       <h3>${escapeHtml(app.name)}</h3>
       <p class="app-id">${escapeHtml(app.id)}</p>
+      ${app.owner && app.owner.team ? `<p class="app-owner">Owner: ${escapeHtml(app.owner.team)}</p>` : ''}
+      ${app.last_run ? `<p class="app-last-run"><span class="badge ${statusClass(app.last_run.status)}">${escapeHtml(app.last_run.status)}</span> ${escapeHtml(formatDate(app.last_run.started_at, app.timezone))} · ${escapeHtml(formatDuration(app.last_run))}</p>` : ''}
       <div class="card-actions">
         <button type="button" class="btn btn-primary run-btn btn-run" data-app-id="${escapeHtml(app.id)}">Run</button>
         <button type="button" class="btn btn-ghost edit-btn btn-edit" data-app-id="${escapeHtml(app.id)}">Edit</button>
@@ -495,11 +593,11 @@ function renderRuns(container, runs, total, page) {
             <td class="run-expand-col">
               <button type="button" class="run-expand-btn" data-run-id="${run.id}" aria-label="Expand log">▶</button>
             </td>
-            <td class="run-id">#${run.id}</td>
+            <td class="run-id">#${run.id}${run.pinned_at ? ' <span class="run-pinned" title="Pinned: not deleted by retention or app deletion">pinned</span>' : ''}</td>
             <td>${escapeHtml(run.app_id)}</td>
             <td>${escapeHtml(run.triggered_by || '—')}</td>
-            <td><span class="badge ${statusClass(run.status)}">${escapeHtml(run.status)}</span></td>
-            <td>${formatDate(run.started_at)}</td>
+            <td><span class="badge ${statusClass(run.status)}">${escapeHtml(run.status)}</span>${run.failure_reason ? ` <span class="failure-reason">${escapeHtml(run.failure_reason)}</span>` : ''}</td>
+            <td>${formatDate(run.started_at, appTimeZones && appTimeZones[run.app_id])}</td>
             <td>${formatDuration(run)}</td>
           </tr>
           <tr class="run-log-row" id="run-log-${run.id}" data-run-id="${run.id}" hidden>
@@ -602,6 +700,8 @@ async function toggleRunLogInline(runId) {
 const logOverlay = document.getElementById('log-overlay');
 const logTitle = document.getElementById('log-title');
 const logContent = document.getElementById('log-content');
+const logIssues = document.getElementById('log-issues');
+const logExport = document.getElementById('log-export');
 const logClose = document.getElementById('log-close');
 
 let logPollInterval = null;
@@ -615,17 +715,35 @@ function stopLogPolling() {
 }
 
 function updateLogFromRun(run) {
-  if (logTitle) logTitle.textContent = `Run #${run.id} · ${run.app_id} · ${run.status}${run.status === 'running' || run.status === 'pending' ? ' ● Live' : ''}`;
+  const upstream = run.triggered_by_run_id ? ` · after run #${run.triggered_by_run_id}` : '';
+  const retry = run.retry_of_run_id ? ` · attempt ${run.attempt}, retry of #${run.retry_of_run_id}` : '';
+  const reason = run.failure_reason ? ` (${run.failure_reason})` : '';
+  const downstream = (run.downstream_runs || []).map((d) => `#${d.id} ${d.app_id}`).join(', ');
+  if (logTitle) logTitle.textContent = `Run #${run.id} · ${run.app_id} · ${run.status}${reason}${upstream}${retry}${downstream ? ` · started ${downstream}` : ''}${run.status === 'running' || run.status === 'pending' ? ' ● Live' : ''}`;
   if (logContent) logContent.textContent = run.log || '(no log yet)';
+  renderRunIssues(run.issues || []);
   if (run.status === 'success' || run.status === 'failed') {
     stopLogPolling();
   }
 }
 
+function renderRunIssues(issues) {
+  if (!logIssues) return;
+  logIssues.hidden = issues.length === 0;
+  logIssues.innerHTML = issues.length === 0 ? '' : 'Issues: ' + issues.map((i) => i.url
+    ? `<a href="${escapeHtml(i.url)}" target="_blank" rel="noopener">${escapeHtml(i.key)}</a>`
+    : escapeHtml(i.key)).join(', ');
+}
+
 async function openLogModal(runId) {
   stopLogPolling();
   if (logTitle) logTitle.textContent = `Run #${runId} — Loading…`;
   if (logContent) logContent.textContent = '';
+  renderRunIssues([]);
+  if (logExport) {
+    logExport.href = `${API}/runs/${runId}/export`;
+    logExport.hidden = false;
+  }
   if (logOverlay) logOverlay.setAttribute('aria-hidden', 'false');
 
   try {
@@ -667,23 +785,40 @@ document.addEventListener('keydown', (e) => {
 });
 
 let allAppsCache = [];
+// Landing apps of the user's groups, shown instead of all apps until "Show all apps" is clicked.
+let landingAppIDs = new Set();
+let showAllApps = false;
 
 function applyFilter() {
   const container = document.getElementById('apps-grid');
   if (!container) return;
   const searchEl = document.getElementById('apps-search');
   const q = (searchEl && searchEl.value) ? searchEl.value.trim().toLowerCase() : '';
-  const filtered = !q ? allAppsCache : allAppsCache.filter(a =>
-    (a.name || '').toLowerCase().includes(q) || (a.id || '').toLowerCase().includes(q)
+  const landingOnly = landingAppIDs.size > 0 && !showAllApps;
+  const filtered = allAppsCache.filter(a =>
+    (!landingOnly || landingAppIDs.has(a.id)) &&
+    (!q || (a.name || '').toLowerCase().includes(q) || (a.id || '').toLowerCase().includes(q))
   );
   renderApps(container, filtered);
 }
 
+// landingPath returns the page the user's groups land on after login.
+async function landingPath() {
+  try {
+    const profile = await getProfile();
+    if (profile.landing && profile.landing.page === 'apps') return '/apps.html';
+  } catch (_) {}
+  return '/';
+}
+
 async function loadApps() {
   const container = document.getElementById('apps-grid');
   if (!container) return;
   try {
-    const apps = await getApps();
+    const [apps, overview] = await Promise.all([getApps(), getAppsOverview().catch(() => [])]);
+    const lastRuns = {};
+    overview.forEach(o => { lastRuns[o.id] = o.last_run; });
+    apps.forEach(app => { app.last_run = lastRuns[app.id] || null; });
     allAppsCache = apps;
     if (document.getElementById('apps-search')) {
       applyFilter();
@@ -700,6 +835,7 @@ async function loadRuns() {
   if (!container) return;
   const wasExpanded = expandedRunId;
   try {
+    await loadAppTimeZones();
     const offset = (runsCurrentPage - 1) * RUNS_PAGE_SIZE;
     const data = await getRuns('', RUNS_PAGE_SIZE, offset);
     const runs = data.runs || data;
@@ -955,6 +1091,13 @@ async function openAppForm(appId) {
       setElementValue('app-deploy-manifest-path', app.deploy_manifest_path || '');
       setElementValue('app-helm-chart', app.helm_chart || '');
       setElementValue('app-helm-values-path', app.helm_values_path || '');
+      const owner = app.owner || {};
+      setElementValue('app-owner-team', owner.team || '');
+      setElementValue('app-owner-on-call', owner.on_call || '');
+      setElementValue('app-owner-slack-channel', owner.slack_channel || '');
+      const autoRetry = app.auto_retry || {};
+      setElementValue('app-auto-retry-max', String(autoRetry.max_retries || 0));
+      setElementValue('app-auto-retry-reasons', (autoRetry.reasons || []).join(', '));
       refreshDeployModeFields();
       renderSSHKeyOptions(app.ssh_key_name || '', !!(currentUser && currentUser.is_admin));
       setAppStepsInForm(getEffectiveStepsForForm(app));
@@ -966,6 +1109,7 @@ async function openAppForm(appId) {
     form.reset();
     document.getElementById('app-branch').value = 'main';
     refreshDeployModeFields();
+    initRepoBrowser();
     try {
       appSSHKeysCache = await getSSHKeys();
       renderSSHKeyOptions('', true);
@@ -980,6 +1124,63 @@ async function openAppForm(appId) {
   }
 }
 
+let browsedRepos = [];
+
+// initRepoBrowser shows the repository browser of the add-app form when git providers exist.
+async function initRepoBrowser() {
+  const browser = document.getElementById('repo-browser');
+  const providerSelect = document.getElementById('repo-browser-provider');
+  const repoSelect = document.getElementById('repo-browser-repo');
+  if (!browser || !providerSelect || !repoSelect) return;
+  browser.hidden = true;
+  repoSelect.hidden = true;
+  let providers = [];
+  try {
+    providers = await getGitProviders();
+  } catch (_) {
+    return;
+  }
+  if (!providers.length) return;
+  providerSelect.innerHTML = providers.map((p) => `<option value="${p.id}">${escapeHtml(p.name)} (${escapeHtml(p.kind)})</option>`).join('');
+  browser.hidden = false;
+}
+
+async function loadBrowsedRepos() {
+  const providerId = document.getElementById('repo-browser-provider').value;
+  const owner = document.getElementById('repo-browser-owner').value.trim();
+  const repoSelect = document.getElementById('repo-browser-repo');
+  try {
+    browsedRepos = await getProviderRepos(providerId, owner);
+  } catch (err) {
+    showToast(err.message || 'Failed to list repositories', 'error');
+    return;
+  }
+  repoSelect.innerHTML = `<option value="">${browsedRepos.length ? 'Select a repository…' : 'No repositories found'}</option>` +
+    browsedRepos.map((r, i) => `<option value="${i}">${escapeHtml(r.full_name)}${r.private ? ' (private)' : ''}</option>`).join('');
+  repoSelect.hidden = false;
+}
+
+async function selectBrowsedRepo() {
+  const repo = browsedRepos[Number(document.getElementById('repo-browser-repo').value)];
+  if (!repo || document.getElementById('repo-browser-repo').value === '') return;
+  setElementValue('app-repo', repo.clone_url);
+  setElementValue('app-branch', repo.default_branch || 'main');
+  const nameInput = document.getElementById('app-name');
+  if (nameInput && !nameInput.value.trim()) nameInput.value = repo.name;
+  const options = document.getElementById('app-branch-options');
+  if (!options) return;
+  options.innerHTML = '';
+  try {
+    const branches = await getProviderBranches(document.getElementById('repo-browser-provider').value, repo.full_name);
+    options.innerHTML = branches.map((b) => `<option value="${escapeHtml(b.name)}"></option>`).join('');
+  } catch (_) {}
+}
+
+const repoBrowserLoad = document.getElementById('repo-browser-load');
+if (repoBrowserLoad) repoBrowserLoad.addEventListener('click', loadBrowsedRepos);
+const repoBrowserRepo = document.getElementById('repo-browser-repo');
+if (repoBrowserRepo) repoBrowserRepo.addEventListener('change', selectBrowsedRepo);
+
 function closeAppForm() {
   if (appFormOverlay) {
     appFormOverlay.setAttribute('aria-hidden', 'true');
@@ -1016,6 +1217,15 @@ if (appForm) {
       deploy_manifest_path: (document.getElementById('app-deploy-manifest-path') || {}).value || '',
       helm_chart: (document.getElementById('app-helm-chart') || {}).value || '',
       helm_values_path: (document.getElementById('app-helm-values-path') || {}).value || '',
+      owner: {
+        team: (document.getElementById('app-owner-team') || {}).value || '',
+        on_call: (document.getElementById('app-owner-on-call') || {}).value || '',
+        slack_channel: (document.getElementById('app-owner-slack-channel') || {}).value || '',
+      },
+      auto_retry: {
+        max_retries: parseInt((document.getElementById('app-auto-retry-max') || {}).value || '0', 10) || 0,
+        reasons: ((document.getElementById('app-auto-retry-reasons') || {}).value || '').split(',').map((r) => r.trim()).filter(Boolean),
+      },
       steps,
     };
     if (!app.ssh_key_name.trim() && (!editId || (currentUser && currentUser.is_admin))) {
@@ -1099,7 +1309,20 @@ function initRunsPage() {
   if (refreshBtn) refreshBtn.addEventListener('click', loadRuns);
 }
 
-function initAppsPage() {
+async function initAppsPage() {
+  const showAllBtn = document.getElementById('apps-show-all');
+  try {
+    const profile = await getProfile();
+    landingAppIDs = new Set((profile.landing && profile.landing.app_ids) || []);
+  } catch (_) {}
+  if (showAllBtn && landingAppIDs.size > 0) {
+    showAllBtn.hidden = false;
+    showAllBtn.addEventListener('click', () => {
+      showAllApps = !showAllApps;
+      showAllBtn.textContent = showAllApps ? 'Show my team\'s apps' : 'Show all apps';
+      applyFilter();
+    });
+  }
   loadApps();
   const searchInput = document.getElementById('apps-search');
   if (searchInput) searchInput.addEventListener('input', applyFilter);
@@ -1496,6 +1719,39 @@ async function initAccessPage() {
     });
   }
 
+  const inviteBtn = document.getElementById('user-invite-btn');
+  if (inviteBtn) {
+    inviteBtn.addEventListener('click', async () => {
+      const usernameInput = document.getElementById('user-username');
+      const emailInput = document.getElementById('user-email');
+      const isAdminInput = document.getElementById('user-is-admin');
+      const username = usernameInput ? usernameInput.value.trim() : '';
+      if (!username) {
+        showToast('Username is required.', 'error');
+        return;
+      }
+      try {
+        const data = await inviteUser({
+          username: username,
+          email: emailInput ? emailInput.value.trim() : '',
+          group_ids: selectedGroupIDsFromContainer(document.getElementById('user-group-selector')),
+          is_admin: !!(isAdminInput && isAdminInput.checked),
+        });
+        if (usernameInput) usernameInput.value = '';
+        if (emailInput) emailInput.value = '';
+        if (isAdminInput) isAdminInput.checked = false;
+        renderGroupSelector(document.getElementById('user-group-selector'), groups, []);
+        if (data.emailed) {
+          showToast('Invitation emailed.', 'success');
+        } else {
+          window.prompt('Send this invitation link to the user (shown once):', window.location.origin + '/accept-invite.html?token=' + encodeURIComponent(data.token));
+        }
+      } catch (err) {
+        showToast(err.message || 'Failed to invite user', 'error');
+      }
+    });
+  }
+
   const sshKeyForm = document.getElementById('ssh-key-form');
   if (sshKeyForm) {
     sshKeyForm.addEventListener('submit', async (e) => {
@@ -1650,12 +1906,18 @@ async function initGroupPage() {
   const appsBox = document.getElementById('group-apps-selector');
   const saveUsersBtn = document.getElementById('save-group-users');
   const saveAppsBtn = document.getElementById('save-group-apps');
+  const landingPage = document.getElementById('group-landing-page');
+  const landingAppsBox = document.getElementById('group-landing-apps-selector');
+  const saveLandingBtn = document.getElementById('save-group-landing');
 
   async function reload() {
     const data = await getGroup(groupID);
     groupTitle.textContent = `Group: ${data.name}`;
     renderGroupUsersSelector(usersBox, data.available_users || [], data.user_ids || []);
     renderGroupAppsSelector(appsBox, data.available_apps || [], data.app_ids || []);
+    const landing = data.landing || {};
+    if (landingPage) landingPage.value = landing.page || '';
+    renderGroupAppsSelector(landingAppsBox, data.available_apps || [], landing.app_ids || []);
   }
 
   if (saveUsersBtn) {
@@ -1688,6 +1950,20 @@ async function initGroupPage() {
     });
   }
 
+  if (saveLandingBtn) {
+    saveLandingBtn.addEventListener('click', async () => {
+      saveLandingBtn.disabled = true;
+      try {
+        await setGroupLanding(groupID, landingPage ? landingPage.value : '', selectedAppIDs(landingAppsBox));
+        showToast('Group landing updated.', 'success');
+      } catch (err) {
+        showToast(err.message || 'Failed to save landing', 'error');
+      } finally {
+        saveLandingBtn.disabled = false;
+      }
+    });
+  }
+
   try {
     await reload();
   } catch (err) {
@@ -1772,7 +2048,7 @@ async function initLoginPage() {
   if (!loginForm) return false;
   try {
     await getMe();
-    window.location.href = '/';
+    window.location.href = await landingPath();
     return true;
   } catch (_) {}
 
@@ -1784,7 +2060,7 @@ async function initLoginPage() {
     if (errorEl) errorEl.hidden = true;
     try {
       await login(username.trim(), password);
-      window.location.href = '/';
+      window.location.href = await landingPath();
     } catch (err) {
       if (errorEl) {
         errorEl.textContent = err.message || 'Login failed';
@@ -1795,6 +2071,30 @@ async function initLoginPage() {
   return true;
 }
 
+async function initAcceptInvitePage() {
+  const form = document.getElementById('accept-invite-form');
+  if (!form) return false;
+  const token = new URLSearchParams(window.location.search).get('token') || '';
+  form.addEventListener('submit', async (e) => {
+    e.preventDefault();
+    const password = (document.getElementById('invite-password') || {}).value || '';
+    const confirm = (document.getElementById('invite-password-confirm') || {}).value || '';
+    const errorEl = document.getElementById('invite-error');
+    if (errorEl) errorEl.hidden = true;
+    try {
+      if (password !== confirm) throw new Error('Passwords do not match');
+      await acceptInvite(token, password);
+      window.location.href = '/';
+    } catch (err) {
+      if (errorEl) {
+        errorEl.textContent = err.message || 'Failed to accept invite';
+        errorEl.hidden = false;
+      }
+    }
+  });
+  return true;
+}
+
 async function ensureAuthenticated() {
   try {
     const data = await getMe();
@@ -1812,9 +2112,11 @@ async function init() {
     return;
   }
   if (await initLoginPage()) return;
+  if (await initAcceptInvitePage()) return;
   const me = await ensureAuthenticated();
   if (!me) return;
   bindHeaderUser(me);
+  await loadDisplayTimeZone();
   const isAccessPage = !!document.getElementById('groups-container');
   const isGroupPage = !!document.getElementById('group-title');
   if (!me.is_admin && (isAccessPage || isGroupPage)) {
@@ -1824,7 +2126,7 @@ async function init() {
   }
   try {
     if (document.getElementById('runs-container')) initRunsPage();
-    if (document.getElementById('apps-grid')) initAppsPage();
+    if (document.getElementById('apps-grid')) await initAppsPage();
     if (document.getElementById('app-form')) await initAppFormPage();
     if (document.getElementById('profile-info')) initProfilePage();
     if (document.getElementById('group-title')) initGroupPage();